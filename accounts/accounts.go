@@ -0,0 +1,223 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// maxErrorMessageSize is the maximum number of bytes of an error
+	// response's body we include in the error we return.
+	maxErrorMessageSize = 1 << 10
+	// pinnedSkylinksPageSize is the number of skylinks we ask for with each
+	// page of pinned skylinks.
+	pinnedSkylinksPageSize = 1000
+	// pinnedSkylinksPath is the path of the accounts endpoint which lists the
+	// skylinks pinned by at least one user.
+	pinnedSkylinksPath = "/skylinks/pinned"
+)
+
+var (
+	// ErrAuthFailed is returned when accounts rejects our bearer token or
+	// its absence.
+	ErrAuthFailed = errors.New("accounts authentication failed")
+	// ErrRequestRejected is returned when accounts responds to a request
+	// with a 4xx status code other than the ones for failed authentication.
+	ErrRequestRejected = errors.New("accounts rejected the request")
+	// ErrServerError is returned when accounts fails a request with a 5xx
+	// status code or any other status code we don't expect.
+	ErrServerError = errors.New("accounts failed the request")
+	// ErrTimeout is returned when a call to accounts doesn't complete within
+	// the client's timeout.
+	ErrTimeout = errors.New("accounts call timed out")
+	// ErrUnreachable is returned when a request fails to reach accounts,
+	// e.g. because it's not running.
+	ErrUnreachable = errors.New("accounts is unreachable")
+)
+
+type (
+	// Client talks to the accounts service.
+	Client struct {
+		staticBaseURL    string
+		staticHTTPClient *http.Client
+		// staticToken is the bearer token we authenticate with. We don't
+		// authenticate if it's empty.
+		staticToken string
+
+		// aliveErr is the result of the latest health probe, made at
+		// aliveCheckedAt. See Alive.
+		aliveErr       error
+		aliveCheckedAt time.Time
+		mu             sync.Mutex
+	}
+
+	// PinnedSkylink is a skylink which at least one user pins.
+	PinnedSkylink struct {
+		Skylink string `json:"skylink"`
+		// Users is the number of users who pin the skylink.
+		Users int `json:"users"`
+	}
+
+	// PinnedSkylinksPage is a page of the skylinks pinned by the users, as
+	// returned by accounts.
+	PinnedSkylinksPage struct {
+		Items    []PinnedSkylink `json:"items"`
+		Offset   int             `json:"offset"`
+		PageSize int             `json:"pageSize"`
+		// Count is the total number of pinned skylinks.
+		Count int `json:"count"`
+	}
+)
+
+// NewClient returns a new accounts client which talks to the accounts service
+// at the given base URL, e.g. "http://10.10.10.70:3000". If token is not empty,
+// the client sends it as a bearer token with each request. Each call fails with
+// ErrTimeout if it takes longer than timeout. A timeout of zero disables
+// timeouts.
+func NewClient(baseURL, token string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.AddContext(err, "invalid accounts URL")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid accounts URL '%s', expected an http or https URL with a host", baseURL)
+	}
+	if timeout < 0 {
+		return nil, fmt.Errorf("invalid accounts timeout %v", timeout)
+	}
+	return &Client{
+		staticBaseURL:    strings.TrimSuffix(u.String(), "/"),
+		staticHTTPClient: &http.Client{Timeout: timeout},
+		staticToken:      token,
+	}, nil
+}
+
+// PinnedSkylinks returns the page of at most pageSize skylinks pinned by the
+// users which starts at the given offset. The pages are ordered by the time the
+// skylinks were first pinned, so the skylinks pinned while we're paging through
+// them end up on the last pages.
+func (c *Client) PinnedSkylinks(ctx context.Context, offset, pageSize int) (PinnedSkylinksPage, error) {
+	query := url.Values{}
+	query.Set("offset", strconv.Itoa(offset))
+	query.Set("pageSize", strconv.Itoa(pageSize))
+	var page PinnedSkylinksPage
+	err := c.getJSON(ctx, pinnedSkylinksPath, query, &page)
+	if err != nil {
+		return PinnedSkylinksPage{}, errors.AddContext(err, "failed to fetch pinned skylinks")
+	}
+	return page, nil
+}
+
+// ForEachPinnedSkylink pages through all skylinks pinned by the users and calls
+// fn for each of them. It stops at the first error returned by fn.
+func (c *Client) ForEachPinnedSkylink(ctx context.Context, fn func(PinnedSkylink) error) error {
+	for offset := 0; ; {
+		page, err := c.PinnedSkylinks(ctx, offset, pinnedSkylinksPageSize)
+		if err != nil {
+			return err
+		}
+		for _, ps := range page.Items {
+			err = fn(ps)
+			if err != nil {
+				return err
+			}
+		}
+		offset += len(page.Items)
+		if len(page.Items) == 0 || offset >= page.Count {
+			return nil
+		}
+	}
+}
+
+// getJSON sends a GET request to the given path of the accounts service and
+// decodes the JSON response into resp.
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, resp interface{}) error {
+	r, err := c.get(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(r)
+	err = json.NewDecoder(r.Body).Decode(resp)
+	if err != nil {
+		return errors.Compose(errors.AddContext(err, "failed to decode response"), ErrServerError)
+	}
+	return nil
+}
+
+// get sends a GET request to the given path of the accounts service. It fails
+// if accounts doesn't respond with a 2xx status code. The caller must close the
+// response's body.
+func (c *Client) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := c.staticBaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to build request")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.staticToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.staticToken)
+	}
+	r, err := c.staticHTTPClient.Do(req)
+	if err != nil {
+		return nil, classifyErr(ctx, err)
+	}
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		defer drainAndClose(r)
+		return nil, statusErr(r)
+	}
+	return r, nil
+}
+
+// drainAndClose reads the rest of the given response's body and closes it, so
+// the connection can be reused.
+func drainAndClose(r *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, r.Body)
+	_ = r.Body.Close()
+}
+
+// classifyErr composes the given error, returned by the HTTP client, with
+// ErrTimeout or ErrUnreachable. It returns the context's error instead if the
+// caller's context is done.
+func classifyErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return errors.Compose(err, ErrTimeout)
+	}
+	return errors.Compose(err, ErrUnreachable)
+}
+
+// statusErr returns the error which describes the given response with an
+// unexpected status code. It includes the status code and the beginning of the
+// response's body, which usually holds accounts' error message.
+func statusErr(r *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxErrorMessageSize))
+	err := fmt.Errorf("accounts responded with status %d", r.StatusCode)
+	if msg := strings.TrimSpace(string(body)); msg != "" {
+		err = fmt.Errorf("accounts responded with status %d: %s", r.StatusCode, msg)
+	}
+	switch {
+	case r.StatusCode == http.StatusUnauthorized || r.StatusCode == http.StatusForbidden:
+		return errors.Compose(err, ErrAuthFailed)
+	case r.StatusCode >= 400 && r.StatusCode <= 499:
+		return errors.Compose(err, ErrRequestRejected)
+	default:
+		return errors.Compose(err, ErrServerError)
+	}
+}
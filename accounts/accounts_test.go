@@ -0,0 +1,185 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// newTestClient returns a client which talks to the given test server.
+func newTestClient(t *testing.T, srv *httptest.Server, token string, timeout time.Duration) *Client {
+	c, err := NewClient(srv.URL, token, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestNewClient ensures that NewClient rejects invalid base URLs and timeouts.
+func TestNewClient(t *testing.T) {
+	t.Parallel()
+
+	valid := []string{"http://10.10.10.70:3000", "https://accounts.example.com/", "http://localhost:3000/api"}
+	for _, u := range valid {
+		if _, err := NewClient(u, "", time.Minute); err != nil {
+			t.Fatalf("Expected '%s' to be valid, got '%v'", u, err)
+		}
+	}
+	invalid := []string{"", "10.10.10.70:3000", "ftp://10.10.10.70", "http://", "http://%zz"}
+	for _, u := range invalid {
+		if _, err := NewClient(u, "", time.Minute); err == nil {
+			t.Fatalf("Expected '%s' to be invalid", u)
+		}
+	}
+	if _, err := NewClient(valid[0], "", -time.Second); err == nil {
+		t.Fatal("Expected a negative timeout to be invalid")
+	}
+}
+
+// TestForEachPinnedSkylink ensures that ForEachPinnedSkylink pages through all
+// pinned skylinks and that it authenticates with the bearer token.
+func TestForEachPinnedSkylink(t *testing.T) {
+	t.Parallel()
+
+	// Serve more skylinks than fit on two pages.
+	total := 2*pinnedSkylinksPageSize + 1
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api"+pinnedSkylinksPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests++
+		offset, _ := strconv.Atoi(req.FormValue("offset"))
+		pageSize, _ := strconv.Atoi(req.FormValue("pageSize"))
+		page := PinnedSkylinksPage{Offset: offset, PageSize: pageSize, Count: total}
+		for i := offset; i < total && i < offset+pageSize; i++ {
+			page.Items = append(page.Items, PinnedSkylink{Skylink: fmt.Sprint(i), Users: 1})
+		}
+		_ = json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+	c, err := NewClient(srv.URL+"/api/", "token", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var skylinks []string
+	err = c.ForEachPinnedSkylink(context.Background(), func(ps PinnedSkylink) error {
+		skylinks = append(skylinks, ps.Skylink)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skylinks) != total {
+		t.Fatalf("Expected %d skylinks, got %d", total, len(skylinks))
+	}
+	for i, sl := range skylinks {
+		if sl != fmt.Sprint(i) {
+			t.Fatalf("Expected skylink %d to be '%d', got '%s'", i, i, sl)
+		}
+	}
+	if requests != 3 {
+		t.Fatalf("Expected 3 requests, got %d", requests)
+	}
+
+	// The errors returned by fn stop the iteration.
+	errStop := errors.New("stop")
+	n := 0
+	err = c.ForEachPinnedSkylink(context.Background(), func(PinnedSkylink) error {
+		n++
+		return errStop
+	})
+	if !errors.Contains(err, errStop) || n != 1 {
+		t.Fatalf("Expected to stop after 1 skylink with '%v', got %d and '%v'", errStop, n, err)
+	}
+}
+
+// TestPinnedSkylinksErrors ensures that PinnedSkylinks classifies the failed
+// calls and reports the status codes.
+func TestPinnedSkylinksErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		status int
+		body   string
+		err    error
+	}{
+		{http.StatusBadRequest, `{"message":"invalid pageSize"}`, ErrRequestRejected},
+		{http.StatusUnauthorized, "", ErrAuthFailed},
+		{http.StatusForbidden, "", ErrAuthFailed},
+		{http.StatusNotFound, "not found", ErrRequestRejected},
+		{http.StatusInternalServerError, "", ErrServerError},
+		{http.StatusOK, "not json", ErrServerError},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(tt.status)
+			_, _ = w.Write([]byte(tt.body))
+		}))
+		_, err := newTestClient(t, srv, "", time.Minute).PinnedSkylinks(context.Background(), 0, 10)
+		srv.Close()
+		if !errors.Contains(err, tt.err) {
+			t.Fatalf("%d: expected '%v', got '%v'", tt.status, tt.err, err)
+		}
+		if tt.status == http.StatusOK {
+			continue
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("status %d", tt.status)) {
+			t.Fatalf("%d: expected the status code in the error, got '%v'", tt.status, err)
+		}
+		if !strings.Contains(err.Error(), tt.body) {
+			t.Fatalf("%d: expected the body in the error, got '%v'", tt.status, err)
+		}
+	}
+}
+
+// TestPinnedSkylinksTimeout ensures that the calls which take longer than the
+// client's timeout fail with ErrTimeout, that the calls to an unreachable
+// accounts fail with ErrUnreachable and that the calls fail with the context's
+// error once it's done.
+func TestPinnedSkylinksTimeout(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-done:
+		case <-req.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	_, err := newTestClient(t, srv, "", 50*time.Millisecond).PinnedSkylinks(context.Background(), 0, 10)
+	if !errors.Contains(err, ErrTimeout) {
+		t.Fatalf("Expected '%v', got '%v'", ErrTimeout, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = newTestClient(t, srv, "", time.Minute).PinnedSkylinks(ctx, 0, 10)
+	if !errors.Contains(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	_, err = newTestClient(t, closed, "", time.Minute).PinnedSkylinks(context.Background(), 0, 10)
+	if !errors.Contains(err, ErrUnreachable) {
+		t.Fatalf("Expected '%v', got '%v'", ErrUnreachable, err)
+	}
+}
@@ -0,0 +1,51 @@
+package accounts
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+const (
+	// healthPath is the path of accounts' health endpoint.
+	healthPath = "/health"
+	// healthTimeout is how long Alive waits for accounts to respond.
+	healthTimeout = time.Second
+)
+
+var (
+	// healthCacheTTL is how long we reuse the result of a health probe.
+	healthCacheTTL = build.Select(build.Var{
+		Standard: 10 * time.Second,
+		Dev:      10 * time.Second,
+		Testing:  100 * time.Millisecond,
+	}).(time.Duration)
+)
+
+// Alive probes accounts' health endpoint and returns nil if accounts responded
+// with a 2xx status code within healthTimeout. We reuse the result for
+// healthCacheTTL, so frequent health checks of pinner don't hammer accounts.
+// Concurrent callers wait for the same probe.
+func (c *Client) Alive() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.aliveCheckedAt.IsZero() && time.Since(c.aliveCheckedAt) < healthCacheTTL {
+		return c.aliveErr
+	}
+	// The probe doesn't depend on the caller's context, so a cancelled
+	// request doesn't leave a failed probe in the cache.
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	r, err := c.get(ctx, healthPath, nil)
+	if err == nil {
+		drainAndClose(r)
+	}
+	if errors.Contains(err, context.DeadlineExceeded) {
+		err = errors.Compose(err, ErrTimeout)
+	}
+	c.aliveErr = err
+	c.aliveCheckedAt = time.Now()
+	return err
+}
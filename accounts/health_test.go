@@ -0,0 +1,71 @@
+package accounts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestAlive ensures that Alive reports whether accounts responds to its health
+// probes, that it reuses the result for a while and that it gives up on slow
+// probes.
+func TestAlive(t *testing.T) {
+	t.Parallel()
+
+	var probes, status int32 = 0, http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != healthPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&probes, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+	c := newTestClient(t, srv, "", time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if err := c.Alive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&probes); n != 1 {
+		t.Fatalf("Expected 1 probe, got %d", n)
+	}
+	// The failure shows once the cached result expires.
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	if err := c.Alive(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(healthCacheTTL)
+	if err := c.Alive(); !errors.Contains(err, ErrServerError) {
+		t.Fatalf("Expected '%v', got '%v'", ErrServerError, err)
+	}
+	if n := atomic.LoadInt32(&probes); n != 2 {
+		t.Fatalf("Expected 2 probes, got %d", n)
+	}
+
+	// Probes time out after healthTimeout, regardless of the client's
+	// timeout.
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-done:
+		case <-req.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(done)
+	start := time.Now()
+	err := newTestClient(t, slow, "", time.Minute).Alive()
+	if !errors.Contains(err, ErrTimeout) {
+		t.Fatalf("Expected '%v', got '%v'", ErrTimeout, err)
+	}
+	if d := time.Since(start); d > 2*healthTimeout {
+		t.Fatalf("Expected the probe to time out after %v, took %v", healthTimeout, d)
+	}
+}
@@ -0,0 +1,347 @@
+package accounts
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+const (
+	// jwksPath is the path of the accounts endpoint which serves the public
+	// keys accounts signs its JWTs with, as a JSON Web Key Set.
+	jwksPath = "/.well-known/jwks.json"
+)
+
+var (
+	// ErrInvalidToken is returned when a JWT is malformed, its signature is
+	// invalid or it has expired.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrInsufficientClaim is returned when a valid JWT doesn't carry the
+	// claim we require or its value is too low.
+	ErrInsufficientClaim = errors.New("insufficient claim")
+
+	// jwksMaxAge is how long we use the keys we fetched from accounts
+	// before we fetch them again.
+	jwksMaxAge = build.Select(build.Var{
+		Standard: time.Hour,
+		Dev:      time.Minute,
+		Testing:  500 * time.Millisecond,
+	}).(time.Duration)
+	// jwksMinRefreshInterval is the minimum time between two fetches of the
+	// keys. It keeps tokens with unknown key IDs from making us hammer
+	// accounts.
+	jwksMinRefreshInterval = build.Select(build.Var{
+		Standard: time.Minute,
+		Dev:      10 * time.Second,
+		Testing:  100 * time.Millisecond,
+	}).(time.Duration)
+)
+
+type (
+	// JWK is a public key in the JSON Web Key format. We support RSA and
+	// P-256 keys.
+	JWK struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg,omitempty"`
+		Use string `json:"use,omitempty"`
+		// N and E are the modulus and the exponent of RSA keys.
+		N string `json:"n,omitempty"`
+		E string `json:"e,omitempty"`
+		// Crv, X and Y are the curve and the coordinates of EC keys.
+		Crv string `json:"crv,omitempty"`
+		X   string `json:"x,omitempty"`
+		Y   string `json:"y,omitempty"`
+	}
+
+	// JWKS is a JSON Web Key Set.
+	JWKS struct {
+		Keys []JWK `json:"keys"`
+	}
+
+	// JWTValidator validates the JWTs accounts issues against the public
+	// keys accounts serves and checks that they carry the required claim.
+	// It caches the keys and refreshes them periodically and whenever it
+	// comes across a token signed with a key it doesn't know.
+	JWTValidator struct {
+		staticClient *Client
+		// staticClaim is the dot-separated path of the claim we require,
+		// e.g. "tier", and staticClaimMin is its minimum value.
+		staticClaim    string
+		staticClaimMin float64
+
+		// keys are the keys we last fetched, keyed by their ID, at
+		// fetchedAt. attemptedAt is the time of the last attempt to fetch
+		// them, successful or not, and fetchErr is its error. fetching is
+		// closed once the ongoing fetch is done and it's nil while there
+		// is none.
+		keys        map[string]jwtKey
+		fetchedAt   time.Time
+		attemptedAt time.Time
+		fetchErr    error
+		fetching    chan struct{}
+		mu          sync.Mutex
+	}
+
+	// jwtKey is a parsed public key together with the algorithm it's used
+	// with.
+	jwtKey struct {
+		alg string
+		key crypto.PublicKey
+	}
+
+	// jwtHeader is the header of a JWT.
+	jwtHeader struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+)
+
+// JWKS returns the public keys accounts signs its JWTs with.
+func (c *Client) JWKS(ctx context.Context) (JWKS, error) {
+	var jwks JWKS
+	err := c.getJSON(ctx, jwksPath, nil, &jwks)
+	if err != nil {
+		return JWKS{}, errors.AddContext(err, "failed to fetch JWKS")
+	}
+	return jwks, nil
+}
+
+// NewJWTValidator returns a new JWTValidator which fetches the keys via the
+// given client and requires the claim at the given dot-separated path to be a
+// number not lower than claimMin.
+func NewJWTValidator(client *Client, claim string, claimMin float64) (*JWTValidator, error) {
+	if client == nil {
+		return nil, errors.New("no accounts client provided")
+	}
+	if claim == "" {
+		return nil, errors.New("no claim provided")
+	}
+	return &JWTValidator{
+		staticClient:   client,
+		staticClaim:    claim,
+		staticClaimMin: claimMin,
+	}, nil
+}
+
+// Validate checks the given JWT's signature, expiry and required claim. It
+// returns the token's claims if they all check out. It fails with
+// ErrInvalidToken or ErrInsufficientClaim otherwise, or with the error which
+// kept it from fetching the keys.
+func (v *JWTValidator) Validate(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.Compose(errors.New("malformed token"), ErrInvalidToken)
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.Compose(errors.AddContext(err, "malformed header"), ErrInvalidToken)
+	}
+	key, err := v.managedKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != key.alg {
+		return nil, errors.Compose(fmt.Errorf("unexpected algorithm '%s'", header.Alg), ErrInvalidToken)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Compose(errors.AddContext(err, "malformed signature"), ErrInvalidToken)
+	}
+	if err = verifySignature(key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, errors.Compose(err, ErrInvalidToken)
+	}
+	var claims map[string]interface{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.Compose(errors.AddContext(err, "malformed claims"), ErrInvalidToken)
+	}
+	now := float64(time.Now().Unix())
+	exp, ok := claims["exp"].(float64)
+	if !ok || now >= exp {
+		return nil, errors.Compose(errors.New("token has expired"), ErrInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, errors.Compose(errors.New("token is not valid yet"), ErrInvalidToken)
+	}
+	var val interface{} = claims
+	for _, name := range strings.Split(v.staticClaim, ".") {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			val = nil
+			break
+		}
+		val = m[name]
+	}
+	if n, ok := val.(float64); !ok || n < v.staticClaimMin {
+		return nil, errors.Compose(fmt.Errorf("claim '%s' is %v, expected at least %v", v.staticClaim, val, v.staticClaimMin), ErrInsufficientClaim)
+	}
+	return claims, nil
+}
+
+// managedKey returns the key with the given ID. It fetches the keys from
+// accounts in the background if our copy is too old or doesn't have the key,
+// unless we tried to fetch them very recently. It keeps using the keys we have
+// while it fetches them and when the fetch fails. It only waits for the fetch,
+// or for the given context, if it doesn't have the key.
+func (v *JWTValidator) managedKey(ctx context.Context, kid string) (jwtKey, error) {
+	v.mu.Lock()
+	key, exists := v.keys[kid]
+	if exists && time.Since(v.fetchedAt) < jwksMaxAge {
+		v.mu.Unlock()
+		return key, nil
+	}
+	fetching := v.fetching
+	if fetching == nil && time.Since(v.attemptedAt) >= jwksMinRefreshInterval {
+		v.attemptedAt = time.Now()
+		fetching = make(chan struct{})
+		v.fetching = fetching
+		go v.threadedFetchKeys(fetching)
+	}
+	v.mu.Unlock()
+	if exists {
+		return key, nil
+	}
+	if fetching != nil {
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return jwtKey{}, ctx.Err()
+		}
+		v.mu.Lock()
+		key, exists = v.keys[kid]
+		err := v.fetchErr
+		v.mu.Unlock()
+		if !exists && err != nil {
+			return jwtKey{}, err
+		}
+	}
+	if !exists {
+		return jwtKey{}, errors.Compose(fmt.Errorf("unknown key '%s'", kid), ErrInvalidToken)
+	}
+	return key, nil
+}
+
+// threadedFetchKeys fetches the keys from accounts and replaces ours with them,
+// unless the fetch fails. It closes the given channel once it's done. The fetch
+// doesn't belong to any of the requests which wait for it, so it doesn't use
+// their contexts. The accounts client's timeout bounds it instead.
+func (v *JWTValidator) threadedFetchKeys(fetching chan struct{}) {
+	jwks, err := v.staticClient.JWKS(context.Background())
+	var keys map[string]jwtKey
+	if err == nil {
+		keys = make(map[string]jwtKey, len(jwks.Keys))
+		for _, k := range jwks.Keys {
+			if k.Use != "" && k.Use != "sig" {
+				continue
+			}
+			pk, err := parseJWK(k)
+			if err != nil {
+				continue
+			}
+			keys[k.Kid] = pk
+		}
+	}
+	v.mu.Lock()
+	if err == nil {
+		v.keys = keys
+		v.fetchedAt = time.Now()
+	}
+	v.fetchErr = err
+	v.fetching = nil
+	v.mu.Unlock()
+	close(fetching)
+}
+
+// decodeSegment decodes the given base64url-encoded JSON segment of a JWT into
+// v.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// parseJWK parses the given JWK into a public key. Keys without an algorithm
+// get the default one for their type.
+func parseJWK(k JWK) (jwtKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err := errors.Compose(err1, err2); err != nil {
+			return jwtKey{}, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return jwtKey{}, errors.New("invalid RSA exponent")
+		}
+		alg := k.Alg
+		if alg == "" {
+			alg = "RS256"
+		}
+		if alg != "RS256" {
+			return jwtKey{}, fmt.Errorf("unsupported algorithm '%s'", alg)
+		}
+		pk := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return jwtKey{alg: alg, key: pk}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return jwtKey{}, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err := errors.Compose(err1, err2); err != nil {
+			return jwtKey{}, err
+		}
+		alg := k.Alg
+		if alg == "" {
+			alg = "ES256"
+		}
+		if alg != "ES256" {
+			return jwtKey{}, fmt.Errorf("unsupported algorithm '%s'", alg)
+		}
+		pk := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pk.Curve.IsOnCurve(pk.X, pk.Y) {
+			return jwtKey{}, errors.New("invalid EC key")
+		}
+		return jwtKey{alg: alg, key: pk}, nil
+	default:
+		return jwtKey{}, fmt.Errorf("unsupported key type '%s'", k.Kty)
+	}
+}
+
+// verifySignature checks the given signature of the given signed part of a JWT
+// with the given key.
+func verifySignature(key jwtKey, signed string, sig []byte) error {
+	h := sha256.Sum256([]byte(signed))
+	switch pk := key.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pk, crypto.SHA256, h[:], sig)
+	case *ecdsa.PublicKey:
+		// JWS encodes ECDSA signatures as the concatenation of R and S.
+		if len(sig) != 64 {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pk, h[:], r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported key")
+	}
+}
@@ -0,0 +1,333 @@
+package accounts
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+type (
+	// testJWKS serves a JWKS and counts how often it's fetched.
+	testJWKS struct {
+		jwks    JWKS
+		fetches int
+		down    bool
+		delay   time.Duration
+		mu      sync.Mutex
+	}
+)
+
+// ServeHTTP implements http.Handler.
+func (tj *testJWKS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	tj.mu.Lock()
+	delay := tj.delay
+	tj.mu.Unlock()
+	time.Sleep(delay)
+	tj.mu.Lock()
+	defer tj.mu.Unlock()
+	if req.URL.Path != jwksPath || tj.down {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	tj.fetches++
+	_ = json.NewEncoder(w).Encode(tj.jwks)
+}
+
+// set replaces the served keys.
+func (tj *testJWKS) set(keys ...JWK) {
+	tj.mu.Lock()
+	defer tj.mu.Unlock()
+	tj.jwks = JWKS{Keys: keys}
+}
+
+// setDown makes the JWKS endpoint fail or recover.
+func (tj *testJWKS) setDown(down bool) {
+	tj.mu.Lock()
+	defer tj.mu.Unlock()
+	tj.down = down
+}
+
+// setDelay makes the JWKS endpoint take the given time to respond.
+func (tj *testJWKS) setDelay(d time.Duration) {
+	tj.mu.Lock()
+	defer tj.mu.Unlock()
+	tj.delay = d
+}
+
+// numFetches returns the number of times the JWKS was fetched.
+func (tj *testJWKS) numFetches() int {
+	tj.mu.Lock()
+	defer tj.mu.Unlock()
+	return tj.fetches
+}
+
+// rsaJWK returns the JWK of the given RSA key.
+func rsaJWK(kid string, sk *rsa.PrivateKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(sk.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(sk.E)).Bytes()),
+	}
+}
+
+// ecJWK returns the JWK of the given P-256 key.
+func ecJWK(kid string, sk *ecdsa.PrivateKey) JWK {
+	return JWK{
+		Kty: "EC",
+		Kid: kid,
+		Alg: "ES256",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(sk.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(sk.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// signJWT returns a JWT with the given claims, signed with the given key.
+func signJWT(t *testing.T, alg, kid string, sk crypto.Signer, claims map[string]interface{}) string {
+	header, err1 := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	payload, err2 := json.Marshal(claims)
+	if err := errors.Compose(err1, err2); err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := sk.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// TestJWTValidator ensures that the JWTValidator accepts the valid tokens
+// which carry the required claim and rejects all others.
+func TestJWTValidator(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err1 := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, err2 := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, err3 := rsa.GenerateKey(rand.Reader, 2048)
+	if err := errors.Compose(err1, err2, err3); err != nil {
+		t.Fatal(err)
+	}
+	tj := &testJWKS{}
+	tj.set(rsaJWK("rsa", rsaKey), ecJWK("ec", ecKey))
+	srv := httptest.NewServer(tj)
+	defer srv.Close()
+	v, err := NewJWTValidator(newTestClient(t, srv, "", time.Minute), "session.tier", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(tier interface{}, exp int64) map[string]interface{} {
+		return map[string]interface{}{"sub": "user", "exp": exp, "session": map[string]interface{}{"tier": tier}}
+	}
+
+	valid := []string{
+		signJWT(t, "RS256", "rsa", rsaKey, claims(4, exp)),
+		signJWT(t, "ES256", "ec", ecKey, claims(5, exp)),
+	}
+	for i, token := range valid {
+		if _, err = v.Validate(ctx, token); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"Malformed":    "not.a.jwt.at.all",
+		"Expired":      signJWT(t, "RS256", "rsa", rsaKey, claims(4, time.Now().Add(-time.Minute).Unix())),
+		"NoExpiry":     signJWT(t, "RS256", "rsa", rsaKey, map[string]interface{}{"session": map[string]interface{}{"tier": 4}}),
+		"WrongKey":     signJWT(t, "RS256", "rsa", otherKey, claims(4, exp)),
+		"WrongAlg":     signJWT(t, "ES256", "rsa", ecKey, claims(4, exp)),
+		"UnknownKey":   signJWT(t, "RS256", "other", otherKey, claims(4, exp)),
+		"MixedUpParts": valid[0][:len(valid[0])-10] + valid[1][len(valid[1])-10:],
+	}
+	for name, token := range invalid {
+		if _, err = v.Validate(ctx, token); !errors.Contains(err, ErrInvalidToken) {
+			t.Fatalf("%s: expected '%v', got '%v'", name, ErrInvalidToken, err)
+		}
+	}
+
+	insufficient := map[string]string{
+		"LowTier":     signJWT(t, "RS256", "rsa", rsaKey, claims(3, exp)),
+		"NonNumeric":  signJWT(t, "RS256", "rsa", rsaKey, claims("admin", exp)),
+		"MissingTier": signJWT(t, "RS256", "rsa", rsaKey, map[string]interface{}{"exp": exp}),
+	}
+	for name, token := range insufficient {
+		if _, err = v.Validate(ctx, token); !errors.Contains(err, ErrInsufficientClaim) {
+			t.Fatalf("%s: expected '%v', got '%v'", name, ErrInsufficientClaim, err)
+		}
+	}
+}
+
+// TestJWTValidatorKeyCache ensures that the JWTValidator caches the keys,
+// refreshes them once they get old or when it comes across an unknown key and
+// keeps using them while accounts is down.
+func TestJWTValidatorKeyCache(t *testing.T) {
+	t.Parallel()
+
+	key1, err1 := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key2, err2 := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := errors.Compose(err1, err2); err != nil {
+		t.Fatal(err)
+	}
+	tj := &testJWKS{}
+	tj.set(ecJWK("key1", key1))
+	srv := httptest.NewServer(tj)
+	defer srv.Close()
+	v, err := NewJWTValidator(newTestClient(t, srv, "", time.Minute), "tier", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	claims := map[string]interface{}{"tier": 1, "exp": time.Now().Add(time.Hour).Unix()}
+	token1 := signJWT(t, "ES256", "key1", key1, claims)
+	token2 := signJWT(t, "ES256", "key2", key2, claims)
+
+	// The keys are fetched once.
+	for i := 0; i < 3; i++ {
+		if _, err = v.Validate(ctx, token1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := tj.numFetches(); n != 1 {
+		t.Fatalf("Expected 1 fetch, got %d", n)
+	}
+
+	// Accounts rotates its keys. Right after a fetch, an unknown key doesn't
+	// trigger another one.
+	tj.set(ecJWK("key1", key1), ecJWK("key2", key2))
+	if _, err = v.Validate(ctx, token2); !errors.Contains(err, ErrInvalidToken) {
+		t.Fatalf("Expected '%v', got '%v'", ErrInvalidToken, err)
+	}
+	if n := tj.numFetches(); n != 1 {
+		t.Fatalf("Expected 1 fetch, got %d", n)
+	}
+	// A little later it does.
+	time.Sleep(jwksMinRefreshInterval)
+	if _, err = v.Validate(ctx, token2); err != nil {
+		t.Fatal(err)
+	}
+	if n := tj.numFetches(); n != 2 {
+		t.Fatalf("Expected 2 fetches, got %d", n)
+	}
+
+	// Once the keys get old, we try to refresh them but keep using them
+	// while accounts is down.
+	tj.setDown(true)
+	time.Sleep(jwksMaxAge)
+	if _, err = v.Validate(ctx, token1); err != nil {
+		t.Fatal(err)
+	}
+	waitForFetch(v)
+	if _, err = v.Validate(ctx, token1); err != nil {
+		t.Fatal(err)
+	}
+	// Once accounts is back, we pick up the removal of a key. We keep using
+	// the old keys until the fetch is done.
+	tj.setDown(false)
+	tj.set(ecJWK("key2", key2))
+	time.Sleep(jwksMinRefreshInterval)
+	if _, err = v.Validate(ctx, token1); err != nil {
+		t.Fatal(err)
+	}
+	waitForFetch(v)
+	if _, err = v.Validate(ctx, token1); !errors.Contains(err, ErrInvalidToken) {
+		t.Fatalf("Expected '%v', got '%v'", ErrInvalidToken, err)
+	}
+	if n := tj.numFetches(); n != 3 {
+		t.Fatalf("Expected 3 fetches, got %d", n)
+	}
+}
+
+// TestJWTValidatorSlowFetch ensures that a slow fetch of the keys doesn't hold
+// up the tokens signed with the keys we have and that a request which gives up
+// on the fetch doesn't abort it.
+func TestJWTValidatorSlowFetch(t *testing.T) {
+	t.Parallel()
+
+	key1, err1 := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key2, err2 := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := errors.Compose(err1, err2); err != nil {
+		t.Fatal(err)
+	}
+	tj := &testJWKS{}
+	tj.set(ecJWK("key1", key1))
+	srv := httptest.NewServer(tj)
+	defer srv.Close()
+	v, err := NewJWTValidator(newTestClient(t, srv, "", time.Minute), "tier", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	claims := map[string]interface{}{"tier": 1, "exp": time.Now().Add(time.Hour).Unix()}
+	token1 := signJWT(t, "ES256", "key1", key1, claims)
+	token2 := signJWT(t, "ES256", "key2", key2, claims)
+	if _, err = v.Validate(ctx, token1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Accounts rotates its keys and gets slow.
+	delay := time.Second
+	tj.setDelay(delay)
+	tj.set(ecJWK("key1", key1), ecJWK("key2", key2))
+	time.Sleep(jwksMinRefreshInterval)
+	// The request with the unknown key gives up before the fetch is done.
+	reqCtx, cancel := context.WithTimeout(ctx, delay/10)
+	defer cancel()
+	if _, err = v.Validate(reqCtx, token2); !errors.Contains(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+	// The known key doesn't wait for the fetch.
+	start := time.Now()
+	if _, err = v.Validate(ctx, token1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= delay/2 {
+		t.Fatalf("Expected not to wait for the fetch, waited for %v", elapsed)
+	}
+	// The fetch still completes, without another one.
+	if _, err = v.Validate(ctx, token2); err != nil {
+		t.Fatal(err)
+	}
+	if n := tj.numFetches(); n != 2 {
+		t.Fatalf("Expected 2 fetches, got %d", n)
+	}
+}
+
+// waitForFetch waits for the validator's ongoing fetch of the keys, if any.
+func waitForFetch(v *JWTValidator) {
+	v.mu.Lock()
+	fetching := v.fetching
+	v.mu.Unlock()
+	if fetching != nil {
+		<-fetching
+	}
+}
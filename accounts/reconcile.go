@@ -0,0 +1,332 @@
+package accounts
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/logger"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/threadgroup"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// maxSkylinksSample is the maximum number of skylinks we keep in each
+	// of the samples in the reconciliation status.
+	maxSkylinksSample = 10
+)
+
+var (
+	// ErrReconcilerClosed is returned when a reconciliation is interrupted
+	// because the reconciler is shutting down.
+	ErrReconcilerClosed = errors.New("reconciler closed")
+
+	// driftReportCheckInterval is how often we check whether the latest
+	// drift report is old enough for us to produce a new one.
+	driftReportCheckInterval = build.Select(build.Var{
+		Standard: time.Hour,
+		Dev:      time.Minute,
+		Testing:  100 * time.Millisecond,
+	}).(time.Duration)
+)
+
+type (
+	// Reconciler reconciles the skylinks the database marks as pinned with
+	// the ones the users pin according to accounts, which is authoritative.
+	Reconciler struct {
+		staticClient *Client
+		staticDB     *database.DB
+		staticLogger logger.ExtFieldLogger
+		staticTG     *threadgroup.ThreadGroup
+
+		status ReconcileStatus
+		mu     sync.Mutex
+	}
+
+	// ReconcileStatus represents the status of a reconciliation. The drift
+	// report is complete once the reconciliation has finished without an
+	// error.
+	ReconcileStatus struct {
+		InProgress bool
+		// Error holds the error of the reconciliation. It isn't serialised
+		// because errors don't marshal to JSON, ErrorMessage is used instead.
+		Error        error `json:"-"`
+		ErrorMessage string
+		database.DriftReport
+		// NumMarkedPinned is the number of unpinned skylinks which the
+		// reconciliation marked as pinned.
+		NumMarkedPinned int64
+		// NumAdded is the number of missing skylinks which the
+		// reconciliation added. They have no servers yet, so the scanners
+		// pick them up and pin them.
+		NumAdded int
+	}
+)
+
+// NewReconciler returns a new Reconciler.
+func NewReconciler(client *Client, db *database.DB, logger logger.ExtFieldLogger) *Reconciler {
+	return &Reconciler{
+		staticClient: client,
+		staticDB:     db,
+		staticLogger: logger,
+		staticTG:     &threadgroup.ThreadGroup{},
+	}
+}
+
+// Close cancels any reconciliation in progress and waits for it to exit.
+func (r *Reconciler) Close() error {
+	return r.staticTG.Stop()
+}
+
+// Reconcile starts a new reconciliation in the background, unless one is
+// already in progress. A dry run only reports the drift between accounts and
+// the database, without changing anything.
+func (r *Reconciler) Reconcile(dryRun bool) {
+	err := r.staticTG.Add()
+	if err != nil {
+		// The reconciler is shutting down.
+		return
+	}
+	r.mu.Lock()
+	if r.status.InProgress {
+		r.mu.Unlock()
+		r.staticTG.Done()
+		return
+	}
+	r.status = ReconcileStatus{
+		InProgress: true,
+		DriftReport: database.DriftReport{
+			DryRun:    dryRun,
+			StartTime: time.Now().UTC(),
+		},
+	}
+	r.mu.Unlock()
+	go r.threadedReconcile()
+}
+
+// ScheduleDriftReports makes the reconciler produce a drift report with a dry
+// run whenever the latest one stored in the database is older than the given
+// period. Going by the stored reports means that restarts don't postpone the
+// next report and that the servers of a cluster don't all produce their own.
+// A zero period disables the reports.
+func (r *Reconciler) ScheduleDriftReports(period time.Duration) error {
+	if period <= 0 {
+		return nil
+	}
+	err := r.staticTG.Add()
+	if err != nil {
+		return err
+	}
+	go r.threadedScheduleDriftReports(period)
+	return nil
+}
+
+// Status returns the status of the latest reconciliation.
+func (r *Reconciler) Status() ReconcileStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.status
+	s.InvalidSample = append([]string{}, r.status.InvalidSample...)
+	s.MissingSample = append([]string{}, r.status.MissingSample...)
+	s.UnpinnedSample = append([]string{}, r.status.UnpinnedSample...)
+	s.UnreferencedSample = append([]string{}, r.status.UnreferencedSample...)
+	return s
+}
+
+// threadedReconcile performs the actual reconciliation and stores its drift
+// report, if it succeeded. The caller is expected to have marked the
+// reconciliation as started and to have added it to the thread group.
+func (r *Reconciler) threadedReconcile() {
+	defer r.staticTG.Done()
+	r.mu.Lock()
+	dryRun := r.status.DryRun
+	r.mu.Unlock()
+	err := r.managedReconcile(r.staticTG.StopCtx(), dryRun)
+	if err != nil {
+		r.staticLogger.Warn(errors.AddContext(err, "accounts reconciliation failed"))
+	}
+	select {
+	case <-r.staticTG.StopChan():
+		err = errors.Compose(err, ErrReconcilerClosed)
+	default:
+	}
+	r.mu.Lock()
+	r.status.InProgress = false
+	r.status.EndTime = time.Now().UTC()
+	r.status.Error = err
+	if err != nil {
+		r.status.ErrorMessage = err.Error()
+	}
+	report := r.status.DriftReport
+	r.mu.Unlock()
+	if err != nil {
+		return
+	}
+	err = r.staticDB.SaveDriftReport(r.staticTG.StopCtx(), report)
+	if err != nil {
+		r.staticLogger.Warn(errors.AddContext(err, "failed to save drift report"))
+	}
+}
+
+// threadedScheduleDriftReports periodically checks the age of the latest drift
+// report and starts a dry run once it's older than the given period, until the
+// reconciler is closed.
+func (r *Reconciler) threadedScheduleDriftReports(period time.Duration) {
+	defer r.staticTG.Done()
+	ticker := time.NewTicker(driftReportCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.staticTG.StopChan():
+			return
+		case <-ticker.C:
+		}
+		latest, err := r.staticDB.LatestDriftReport(r.staticTG.StopCtx())
+		if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
+			r.staticLogger.Debug(errors.AddContext(err, "failed to fetch the latest drift report"))
+			continue
+		}
+		if err == nil && time.Since(latest.EndTime) < period {
+			continue
+		}
+		r.Reconcile(true)
+	}
+}
+
+// managedReconcile pages through the skylinks the users pin according to
+// accounts and compares them with the ones the database marks as pinned,
+// recording the discrepancies in the status' drift report. Unless it's a dry
+// run, it then marks the skylinks the users pin as pinned, adding the ones the
+// database doesn't know about. We keep the skylinks reported by accounts in
+// memory, so we can tell which ones the database has in excess.
+func (r *Reconciler) managedReconcile(ctx context.Context, dryRun bool) error {
+	// referenced maps the skylinks reported by accounts to whether the
+	// database marks them as pinned.
+	referenced := make(map[string]bool)
+	var invalid []string
+	numInvalid := 0
+	err := r.staticClient.ForEachPinnedSkylink(ctx, func(ps PinnedSkylink) error {
+		sl, err := database.SkylinkFromString(ps.Skylink)
+		if err != nil {
+			numInvalid++
+			invalid = appendSample(invalid, ps.Skylink)
+			return nil
+		}
+		referenced[sl.String()] = false
+		return nil
+	})
+	r.mu.Lock()
+	r.status.NumAccountsSkylinks = len(referenced)
+	r.status.NumInvalidSkylinks = numInvalid
+	r.status.InvalidSample = invalid
+	r.mu.Unlock()
+	if numInvalid > 0 {
+		r.staticLogger.Warnf("Accounts reported %d invalid skylinks, e.g. %v", numInvalid, invalid)
+	}
+	if err != nil {
+		// We can't tell which skylinks are unreferenced without the full
+		// list from accounts.
+		return err
+	}
+
+	var unreferenced []string
+	numUnreferenced := 0
+	err = r.staticDB.ForEachPinnedSkylink(ctx, func(sl string) error {
+		if _, exists := referenced[sl]; exists {
+			referenced[sl] = true
+			return nil
+		}
+		numUnreferenced++
+		unreferenced = appendSample(unreferenced, sl)
+		return nil
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to list pinned skylinks")
+	}
+	r.mu.Lock()
+	r.status.NumUnreferenced = numUnreferenced
+	r.status.UnreferencedSample = unreferenced
+	r.mu.Unlock()
+	if numUnreferenced > 0 {
+		r.staticLogger.Warnf("Found %d pinned skylinks which no user pins, e.g. %v", numUnreferenced, unreferenced)
+	}
+
+	// The skylinks the users pin, which the database doesn't mark as pinned,
+	// are either missing from the database or marked as unpinned.
+	var notPinned []string
+	for sl, pinned := range referenced {
+		if !pinned {
+			notPinned = append(notPinned, sl)
+		}
+	}
+	sort.Strings(notPinned)
+	missing, err := r.staticDB.MissingSkylinks(ctx, notPinned)
+	if err != nil {
+		return errors.AddContext(err, "failed to find missing skylinks")
+	}
+	isMissing := make(map[string]struct{}, len(missing))
+	for _, sl := range missing {
+		isMissing[sl] = struct{}{}
+	}
+	var unpinned, missingSample, unpinnedSample []string
+	for _, sl := range notPinned {
+		if _, exists := isMissing[sl]; exists {
+			missingSample = appendSample(missingSample, sl)
+			continue
+		}
+		unpinned = append(unpinned, sl)
+		unpinnedSample = appendSample(unpinnedSample, sl)
+	}
+	r.mu.Lock()
+	r.status.NumMissing = len(missing)
+	r.status.MissingSample = missingSample
+	r.status.NumUnpinned = len(unpinned)
+	r.status.UnpinnedSample = unpinnedSample
+	r.mu.Unlock()
+	if len(notPinned) > 0 {
+		r.staticLogger.Warnf("Found %d skylinks which users pin but the database doesn't know about and %d which it marks as unpinned.", len(missing), len(unpinned))
+	}
+	if dryRun {
+		return nil
+	}
+	return r.managedMarkPinned(ctx, unpinned, missing)
+}
+
+// managedMarkPinned marks the given unpinned skylinks as pinned and adds the
+// given missing ones.
+func (r *Reconciler) managedMarkPinned(ctx context.Context, unpinned, missing []string) error {
+	_, modified, err := r.staticDB.MarkPinnedMany(ctx, unpinned)
+	r.mu.Lock()
+	r.status.NumMarkedPinned = modified
+	r.mu.Unlock()
+	if err != nil {
+		return errors.AddContext(err, "failed to mark skylinks as pinned")
+	}
+	for _, s := range missing {
+		sl, err := database.SkylinkFromString(s)
+		if err != nil {
+			continue
+		}
+		err = r.staticDB.MarkPinned(ctx, sl)
+		if err != nil {
+			return errors.AddContext(err, "failed to add skylink")
+		}
+		r.mu.Lock()
+		r.status.NumAdded++
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// appendSample appends the given skylink to the given sample, unless the
+// sample is full.
+func appendSample(sample []string, skylink string) []string {
+	if len(sample) >= maxSkylinksSample {
+		return sample
+	}
+	return append(sample, skylink)
+}
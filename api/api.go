@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
-	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/skynetlabs/pinner/accounts"
+	"github.com/skynetlabs/pinner/conf"
 	"github.com/skynetlabs/pinner/database"
 	"github.com/skynetlabs/pinner/logger"
 	"github.com/skynetlabs/pinner/skyd"
+	"github.com/skynetlabs/pinner/sweeper"
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/SkynetLabs/skyd/build"
 )
@@ -19,21 +21,42 @@ type (
 	// API is the central struct which gives us access to all subsystems.
 	API struct {
 		staticServerName string
+		staticAccounts   *accounts.Client
 		staticDB         *database.DB
 		staticLogger     logger.ExtFieldLogger
+		staticReconciler *accounts.Reconciler
 		staticRouter     *httprouter.Router
 		staticSkydClient skyd.Client
+		staticSweeper    *sweeper.Sweeper
 
-		latestSweepStatus   SweepStatus
-		latestSweepStatusMu sync.Mutex
+		// staticAccountsHookSecret is the secret shared with accounts, with
+		// which it signs its requests to POST /hooks/accounts. The hooks
+		// are disabled when it's empty.
+		staticAccountsHookSecret string
+		// staticJWTValidator validates the JWTs accounts issues. When it's
+		// set, all calls, other than the ones to the health check and the
+		// hooks, need a valid JWT. It can be nil.
+		staticJWTValidator *accounts.JWTValidator
+
+		// config is the static configuration the process uses, see
+		// SetConfig. It's nil until it's set.
+		config *conf.Config
+		// clusterConfig is where GET /config/effective gets the
+		// cluster-wide configuration the server uses from, see
+		// SetClusterConfigSource. It's nil until it's set.
+		clusterConfig ClusterConfigSource
+		mu            sync.Mutex
 	}
 
-	// SweepStatus represents the status of a sweep.
-	SweepStatus struct {
-		InProgress bool
-		Error      error
-		StartTime  time.Time
-		EndTime    time.Time
+	// Option customizes an API created by New.
+	Option func(*API)
+
+	// ClusterConfigSource is whatever holds the cluster-wide configuration
+	// the server uses, i.e. the scanner.
+	ClusterConfigSource interface {
+		// ClusterConfig returns the cluster-wide configuration values the
+		// server uses, along with the database values they're parsed from.
+		ClusterConfig() (conf.ClusterConfig, map[string]string)
 	}
 
 	// errorWrap is a helper type for converting an `error` struct to JSON.
@@ -42,8 +65,9 @@ type (
 	}
 )
 
-// New returns a new initialised API.
-func New(serverName string, db *database.DB, logger logger.ExtFieldLogger, skydClient skyd.Client) (*API, error) {
+// New returns a new initialised API. The API needs the accounts client, the
+// reconciler and the sweeper, so New fails unless the options provide them.
+func New(serverName string, db *database.DB, logger logger.ExtFieldLogger, skydClient skyd.Client, opts ...Option) (*API, error) {
 	if db == nil {
 		return nil, errors.New("no DB provided")
 	}
@@ -60,19 +84,108 @@ func New(serverName string, db *database.DB, logger logger.ExtFieldLogger, skydC
 		staticRouter:     router,
 		staticSkydClient: skydClient,
 	}
+	for _, opt := range opts {
+		opt(apiInstance)
+	}
+	if apiInstance.staticAccounts == nil {
+		return nil, errors.New("no accounts client provided")
+	}
+	if apiInstance.staticSweeper == nil {
+		return nil, errors.New("no sweeper provided")
+	}
+	if apiInstance.staticReconciler == nil {
+		return nil, errors.New("no reconciler provided")
+	}
 	apiInstance.buildHTTPRoutes()
 	return apiInstance, nil
 }
 
-// ServeHTTP implements the http.Handler interface.
+// WithAccounts sets the client with which the API talks to accounts and the
+// reconciler which reconciles the database with accounts.
+func WithAccounts(accountsClient *accounts.Client, reconciler *accounts.Reconciler) Option {
+	return func(api *API) {
+		api.staticAccounts = accountsClient
+		api.staticReconciler = reconciler
+	}
+}
+
+// WithAccountsHookSecret sets the secret shared with accounts, with which it
+// signs its requests to POST /hooks/accounts. The hooks are disabled without
+// it.
+func WithAccountsHookSecret(secret string) Option {
+	return func(api *API) {
+		api.staticAccountsHookSecret = secret
+	}
+}
+
+// WithJWTValidator makes all calls, other than the ones to the health check
+// and the hooks, need a JWT which the given validator accepts.
+func WithJWTValidator(v *accounts.JWTValidator) Option {
+	return func(api *API) {
+		api.staticJWTValidator = v
+	}
+}
+
+// WithSweeper sets the sweeper which the API schedules and reports on.
+func WithSweeper(s *sweeper.Sweeper) Option {
+	return func(api *API) {
+		api.staticSweeper = s
+	}
+}
+
+// ServeHTTP implements the http.Handler interface. It authenticates the
+// callers with their JWT, if the API requires one.
 func (api *API) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if api.staticJWTValidator != nil && !authExempt[req.URL.Path] {
+		code, err := api.authenticate(req)
+		if err != nil {
+			api.WriteError(w, err, code)
+			return
+		}
+	}
 	api.staticRouter.ServeHTTP(w, req)
 }
 
+// SetConfig sets the static configuration the process uses, which GET
+// /config/effective reports. It's called again whenever the configuration is
+// reloaded.
+func (api *API) SetConfig(cfg conf.Config) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.config = &cfg
+}
+
+// managedConfig returns the static configuration the process uses and whether
+// it's been set.
+func (api *API) managedConfig() (conf.Config, bool) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.config == nil {
+		return conf.Config{}, false
+	}
+	return *api.config, true
+}
+
+// SetClusterConfigSource sets where GET /config/effective gets the
+// cluster-wide configuration the server uses from.
+func (api *API) SetClusterConfigSource(src ClusterConfigSource) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.clusterConfig = src
+}
+
+// managedClusterConfigSource returns where the cluster-wide configuration the
+// server uses comes from and whether it's been set.
+func (api *API) managedClusterConfigSource() (ClusterConfigSource, bool) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.clusterConfig, api.clusterConfig != nil
+}
+
 // ListenAndServe starts the API server on the given port.
 func (api *API) ListenAndServe(port int) error {
 	api.staticLogger.Info(fmt.Sprintf("Listening on port %d", port))
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), api.staticRouter)
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), api)
 }
 
 // WriteError an error to the API caller.
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/skynetlabs/pinner/accounts"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// jwtCookieName is the name of the cookie in which accounts stores the
+	// JWTs it issues.
+	jwtCookieName = "skynet-jwt"
+)
+
+var (
+	// authExempt lists the paths which don't require a JWT. The health
+	// check needs to work for load balancers and the hooks authenticate
+	// accounts with their own signatures.
+	authExempt = map[string]bool{
+		"/health":         true,
+		"/hooks/accounts": true,
+	}
+)
+
+// authenticate checks that the request carries a valid JWT with the required
+// claim, either as a bearer token or in the accounts cookie. It returns the
+// status code with which to reject the request if it doesn't.
+func (api *API) authenticate(req *http.Request) (int, error) {
+	token := ""
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	} else if c, err := req.Cookie(jwtCookieName); err == nil {
+		token = c.Value
+	}
+	if token == "" {
+		return http.StatusUnauthorized, errors.New("missing token")
+	}
+	_, err := api.staticJWTValidator.Validate(req.Context(), token)
+	switch {
+	case err == nil:
+		return http.StatusOK, nil
+	case errors.Contains(err, accounts.ErrInvalidToken):
+		return http.StatusUnauthorized, err
+	case errors.Contains(err, accounts.ErrInsufficientClaim):
+		return http.StatusForbidden, err
+	default:
+		// We couldn't fetch the keys from accounts.
+		return http.StatusServiceUnavailable, errors.AddContext(err, "failed to validate token")
+	}
+}
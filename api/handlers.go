@@ -3,27 +3,128 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/skynetlabs/pinner/conf"
 	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/skyd"
 	"gitlab.com/NebulousLabs/errors"
-	"gitlab.com/SkynetLabs/skyd/build"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type (
+	// CacheGET is the response type of GET /cache
+	CacheGET struct {
+		// Size is the number of skylinks in the cache of skylinks pinned by
+		// the local skyd.
+		Size int `json:"size"`
+		// LastRebuild describes the last finished cache rebuild. It's nil
+		// if no rebuild has finished yet.
+		LastRebuild *CacheRebuildGET `json:"lastRebuild,omitempty"`
+		// Resolve describes the usage of the cache of resolved V2 skylinks.
+		Resolve skyd.ResolveCacheStats `json:"resolve"`
+	}
+	// CacheRebuildGET describes a finished cache rebuild.
+	CacheRebuildGET struct {
+		Root     string        `json:"root"`
+		Start    time.Time     `json:"start"`
+		End      time.Time     `json:"end"`
+		Duration time.Duration `json:"duration"`
+		Error    string        `json:"error,omitempty"`
+	}
+	// ConfigExport holds all cluster-wide configuration values, keyed by
+	// their keys. It's the response type of GET /config/export and the
+	// request type of PUT /config/export.
+	ConfigExport map[string]string
 	// HealthGET is the response type of GET /health
 	HealthGET struct {
-		DBAlive    bool `json:"dbAlive"`
-		MinPinners int  `json:"minPinners"`
+		// AccountsAlive tells us whether accounts responded to a health
+		// probe and AccountsError is why it didn't, if it didn't. They are
+		// only set on verbose requests.
+		AccountsAlive *bool  `json:"accountsAlive,omitempty"`
+		AccountsError string `json:"accountsError,omitempty"`
+		// DBAlive tells us whether the primary answered a ping.
+		DBAlive bool `json:"dbAlive"`
+		// DBError is why we failed to reach the database, if we did.
+		DBError    string `json:"dbError,omitempty"`
+		MinPinners int    `json:"minPinners"`
+		// SkydBreaker is the state of the circuit breaker around the calls
+		// to skyd. It's "open" while skyd is considered unavailable.
+		SkydBreaker skyd.BreakerState `json:"skydBreaker"`
+		// SkydThrottle describes how much the client-side rate limits slow
+		// down the calls to skyd.
+		SkydThrottle skyd.ThrottleStats `json:"skydThrottle"`
+		// SkydCalls holds the stats of the calls to skyd, keyed by the
+		// client method. It's only set on verbose requests.
+		SkydCalls map[string]skyd.CallStats `json:"skydCalls,omitempty"`
+	}
+	// SkylinkGET is the response type of GET /skylink/:skylink
+	SkylinkGET struct {
+		Skylink string `json:"skylink"`
+		// Pinned tells us whether the database marks the skylink as
+		// pinned, i.e. whether pinner keeps it alive.
+		Pinned bool `json:"pinned"`
+		// Servers is the list of servers which the database lists as
+		// pinning the skylink.
+		Servers []string `json:"servers"`
+		// Owners holds the opaque identifiers of the users who pin the
+		// skylink, e.g. their accounts IDs.
+		Owners []string `json:"owners"`
+		// PinnedLocally tells us whether the local skyd is pinning the
+		// skylink right now. It's null while we can't tell, e.g. when
+		// skyd doesn't respond.
+		PinnedLocally *bool `json:"pinnedLocally"`
+		// CreatedAt is when the skylink entered the database.
+		CreatedAt time.Time `json:"createdAt"`
+		// UpdatedAt is when the skylink's servers or flags last changed.
+		UpdatedAt time.Time `json:"updatedAt"`
+		// UnpinnedAt is when the skylink was first unpinned and UnpinnedBy
+		// is the server which did it. They are empty while the skylink is
+		// pinned.
+		UnpinnedAt *time.Time `json:"unpinnedAt,omitempty"`
+		UnpinnedBy string     `json:"unpinnedBy,omitempty"`
+		// Size, IsDirectory and ContentType describe the skyfile, as far as
+		// we know it. They are empty until we fetch its metadata.
+		Size        uint64 `json:"size,omitempty"`
+		IsDirectory bool   `json:"isDirectory,omitempty"`
+		ContentType string `json:"contentType,omitempty"`
 	}
-	// SkylinkRequest describes a request that only provides a skylink.
+	// SkylinkRequest describes a request that provides a skylink and,
+	// optionally, the opaque identifier of the user on whose behalf we pin or
+	// unpin it.
 	SkylinkRequest struct {
 		Skylink string
+		Owner   string
+	}
+	// StatsGET is the response type of GET /stats
+	StatsGET struct {
+		// DBPool describes the pool of connections to the database.
+		DBPool database.PoolStats `json:"dbPool"`
+		// DBCommands holds the stats of the commands we sent to the
+		// database, keyed by the command's name.
+		DBCommands map[string]database.CommandStats `json:"dbCommands"`
+		// DocSizes holds the stats of the sizes of the skylinks'
+		// documents. It's only set on deep requests.
+		DocSizes *database.DocSizeStats `json:"docSizes,omitempty"`
+		// MinPinners is the current value of min_pinners.
+		MinPinners int `json:"minPinners"`
+		// PinnerCounts is a histogram of the pinned skylinks by the number
+		// of servers which pin them.
+		PinnerCounts map[int]int64 `json:"pinnerCounts"`
+		// Underpinned is the number of unblocked skylinks which are pinned
+		// by fewer than MinPinners servers.
+		Underpinned int64 `json:"underpinned"`
+	}
+	// ReconcileAccountsPOSTResponse is the response to POST
+	// /reconcile/accounts
+	ReconcileAccountsPOSTResponse struct {
+		Href string
 	}
 	// SweepPOSTResponse is the response to POST /sweep
 	SweepPOSTResponse struct {
@@ -31,18 +132,161 @@ type (
 	}
 )
 
-// healthGET returns the status of the service
+// cacheGET returns the size of the cache of skylinks pinned by the local skyd,
+// information about its last rebuild and the usage of the cache of resolved V2
+// skylinks.
+func (api *API) cacheGET(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	resp := CacheGET{
+		Size:    api.staticSkydClient.CacheSize(),
+		Resolve: api.staticSkydClient.ResolveCacheStats(),
+	}
+	if info := api.staticSkydClient.LastCacheRebuild(); !info.Start.IsZero() {
+		resp.LastRebuild = &CacheRebuildGET{
+			Root:     info.Root.String(),
+			Start:    info.Start,
+			End:      info.End,
+			Duration: info.Duration,
+		}
+		if info.Err != nil {
+			resp.LastRebuild.Error = info.Err.Error()
+		}
+	}
+	api.WriteJSON(w, resp)
+}
+
+// configDELETE removes the given cluster-wide configuration value, which resets
+// it to its default. It returns 404 if the value is not set.
+func (api *API) configDELETE(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	err := api.staticDB.DeleteConfigValue(req.Context(), ps.ByName("key"))
+	if errors.Contains(err, database.ErrInternalConfigKey) || errors.Contains(err, database.ErrInvalidConfigValue) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		api.WriteError(w, errors.New("configuration value not set"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteSuccess(w)
+}
+
+// configEffectiveGET responds with the configuration the server actually uses:
+// its static configuration with the secrets redacted, the cluster-wide values
+// as they apply to it and the values derived from them, each with its source.
+// It also lists the server's invalid cluster-wide values in the database.
+func (api *API) configEffectiveGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	cfg, ok := api.managedConfig()
+	if !ok {
+		api.WriteError(w, errors.New("configuration not available"), http.StatusServiceUnavailable)
+		return
+	}
+	src, ok := api.managedClusterConfigSource()
+	if !ok {
+		api.WriteError(w, errors.New("cluster configuration not available"), http.StatusServiceUnavailable)
+		return
+	}
+	cc, values := src.ClusterConfig()
+	ec, err := conf.LoadEffectiveConfig(req.Context(), api.staticDB, cfg, cc, values)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, ec)
+}
+
+// configExportGET returns all cluster-wide configuration values, including the
+// ones this version of pinner doesn't know, so they can be imported into
+// another cluster via PUT /config/export.
+func (api *API) configExportGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	values, err := api.staticDB.AllConfig(req.Context())
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, ConfigExport(values))
+}
+
+// configExportPUT sets the given cluster-wide configuration values, e.g. the
+// ones exported from another cluster via GET /config/export. Values which
+// aren't given are left alone. The values can include the per-server
+// overrides of dry_run, e.g. "dry_run.server1".
+func (api *API) configExportPUT(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body ConfigExport
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	for key, val := range body {
+		if !conf.IsDryRunKey(key) {
+			continue
+		}
+		if key == conf.DryRunKey("") {
+			api.WriteError(w, fmt.Errorf("'%s' is missing the server name", key), http.StatusBadRequest)
+			return
+		}
+		if _, err = database.ParseConfigBool(key, val); err != nil {
+			api.WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	err = api.staticDB.SetConfigValues(req.Context(), body)
+	if errors.Contains(err, database.ErrInternalConfigKey) || errors.Contains(err, database.ErrInvalidConfigValue) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteSuccess(w)
+}
+
+// healthGET returns the status of the service.
+//
+// The optional `verbose` query parameter adds the stats of the calls to skyd,
+// which tell us whether skyd is what slows pinner down, and whether accounts is
+// reachable.
 func (api *API) healthGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	mp, err := conf.MinPinners(req.Context(), api.staticDB)
+	verbose := false
+	if val := req.FormValue("verbose"); val != "" {
+		var err error
+		verbose, err = strconv.ParseBool(val)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "invalid verbose parameter"), http.StatusBadRequest)
+			return
+		}
+	}
 	var status HealthGET
+	err := api.staticDB.Healthy(req.Context())
 	status.DBAlive = err == nil
-	status.MinPinners = mp
+	if err != nil {
+		status.DBError = err.Error()
+	}
+	mp, err := conf.MinPinners(req.Context(), api.staticDB)
+	if err == nil {
+		status.MinPinners = mp
+	}
+	status.SkydBreaker = api.staticSkydClient.BreakerState()
+	status.SkydThrottle = api.staticSkydClient.ThrottleStats()
+	if verbose {
+		status.SkydCalls = api.staticSkydClient.GetStats()
+		err = api.staticAccounts.Alive()
+		alive := err == nil
+		status.AccountsAlive = &alive
+		if err != nil {
+			status.AccountsError = err.Error()
+		}
+	}
 	api.WriteJSON(w, status)
 }
 
 // pinPOST informs pinner that a given skylink is pinned on the current server.
 // If the skylink already exists and it's marked for unpinning, this method will
-// unmark it.
+// unmark it. If the request names an owner, we add it to the skylink's owners.
 func (api *API) pinPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	var body SkylinkRequest
 	err := json.NewDecoder(req.Body).Decode(&body)
@@ -50,13 +294,13 @@ func (api *API) pinPOST(w http.ResponseWriter, req *http.Request, _ httprouter.P
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	sl, err := api.parseAndResolve(body.Skylink)
+	sl, err := api.parseAndResolve(req.Context(), body.Skylink)
 	if errors.Contains(err, database.ErrInvalidSkylink) {
 		api.WriteError(w, database.ErrInvalidSkylink, http.StatusBadRequest)
 		return
 	}
 	if err != nil {
-		api.WriteError(w, err, http.StatusInternalServerError)
+		api.WriteError(w, err, skydErrorStatus(err))
 		return
 	}
 	// Create the skylink.
@@ -66,15 +310,24 @@ func (api *API) pinPOST(w http.ResponseWriter, req *http.Request, _ httprouter.P
 	if errors.Contains(err, database.ErrSkylinkExists) {
 		err = api.staticDB.AddServerForSkylink(req.Context(), sl, api.staticServerName, true)
 	}
+	if err == nil && body.Owner != "" {
+		err = api.staticDB.AddOwner(req.Context(), sl, body.Owner)
+	}
+	if errors.Contains(err, database.ErrSkylinkTooLarge) {
+		api.WriteError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	api.storeMetadata(req.Context(), sl)
 	api.WriteSuccess(w)
 }
 
 // unpinPOST informs pinner that a given skylink should no longer be pinned by
-// any server.
+// any server. If the request names an owner, it only removes that owner from
+// the skylink and the skylink is unpinned once its last owner is removed.
 func (api *API) unpinPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	var body SkylinkRequest
 	err := json.NewDecoder(req.Body).Decode(&body)
@@ -82,16 +335,26 @@ func (api *API) unpinPOST(w http.ResponseWriter, req *http.Request, _ httprouter
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	sl, err := api.parseAndResolve(body.Skylink)
+	sl, err := api.parseAndResolve(req.Context(), body.Skylink)
 	if errors.Contains(err, database.ErrInvalidSkylink) {
 		api.WriteError(w, database.ErrInvalidSkylink, http.StatusBadRequest)
 		return
 	}
 	if err != nil {
-		api.WriteError(w, err, http.StatusInternalServerError)
+		api.WriteError(w, err, skydErrorStatus(err))
+		return
+	}
+	// If an owner unpins the skylink, we only unpin it once its last owner
+	// does.
+	if body.Owner != "" {
+		_, err = api.staticDB.RemoveOwner(req.Context(), sl, body.Owner)
+	} else {
+		err = api.staticDB.MarkUnpinned(req.Context(), sl, api.staticServerName)
+	}
+	if errors.Contains(err, database.ErrSkylinkNotExist) {
+		api.WriteError(w, err, http.StatusNotFound)
 		return
 	}
-	err = api.staticDB.MarkUnpinned(req.Context(), sl)
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -99,18 +362,209 @@ func (api *API) unpinPOST(w http.ResponseWriter, req *http.Request, _ httprouter
 	api.WriteSuccess(w)
 }
 
+// reconcileAccountsPOST starts a background reconciliation of the skylinks
+// marked as pinned in the database with the ones the users pin according to
+// accounts, unless one is already in progress. It responds with the location of
+// the reconciliation's status.
+//
+// The optional `dry_run` query parameter makes the reconciliation only report
+// the drift between accounts and the database, without changing anything.
+func (api *API) reconcileAccountsPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	dryRun := false
+	if val := req.FormValue("dry_run"); val != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(val)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "invalid dry_run parameter"), http.StatusBadRequest)
+			return
+		}
+	}
+	api.staticReconciler.Reconcile(dryRun)
+	api.WriteJSONCustomStatus(w, ReconcileAccountsPOSTResponse{"/reconcile/accounts/status"}, http.StatusAccepted)
+}
+
+// reconcileAccountsLatestGET responds with the drift report of the latest
+// successful reconciliation with accounts, run by any server in the cluster.
+func (api *API) reconcileAccountsLatestGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	r, err := api.staticDB.LatestDriftReport(req.Context())
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		api.WriteError(w, errors.New("no drift report found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, r)
+}
+
+// reconcileAccountsStatusGET responds with the status of the latest
+// reconciliation with accounts.
+func (api *API) reconcileAccountsStatusGET(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	api.WriteJSON(w, api.staticReconciler.Status())
+}
+
+// serversRepairPOST merges the server names which only differ from their
+// normalized form, e.g. by case or surrounding whitespace, into it. It responds
+// with the merges it made and the names which are invalid even once
+// normalized. See database.RepairServerNames.
+//
+// The optional `dry_run` query parameter makes it only report the merges,
+// without changing anything.
+func (api *API) serversRepairPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	dryRun := false
+	if val := req.FormValue("dry_run"); val != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(val)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "invalid dry_run parameter"), http.StatusBadRequest)
+			return
+		}
+	}
+	r, err := api.staticDB.RepairServerNames(req.Context(), dryRun)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, r)
+}
+
+// skylinkGET responds with what the database knows about the given skylink and
+// whether the local skyd is pinning it.
+func (api *API) skylinkGET(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	sl, err := api.parseAndResolve(req.Context(), ps.ByName("skylink"))
+	if errors.Contains(err, database.ErrInvalidSkylink) {
+		api.WriteError(w, database.ErrInvalidSkylink, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, skydErrorStatus(err))
+		return
+	}
+	s, err := api.staticDB.FindSkylink(req.Context(), sl)
+	if errors.Contains(err, database.ErrSkylinkNotExist) {
+		api.WriteError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	var unpinnedAt *time.Time
+	if !s.UnpinnedAt.IsZero() {
+		unpinnedAt = &s.UnpinnedAt
+	}
+	var pinnedLocally *bool
+	pinning, err := api.staticSkydClient.IsPinning(req.Context(), sl.String())
+	if err == nil {
+		pinnedLocally = &pinning
+	} else {
+		api.staticLogger.Debug(errors.AddContext(err, "failed to check whether skyd pins the skylink"))
+	}
+	api.WriteJSON(w, SkylinkGET{
+		Skylink:       s.Skylink,
+		Pinned:        s.Pinned,
+		Servers:       s.Servers,
+		Owners:        s.Owners,
+		PinnedLocally: pinnedLocally,
+		CreatedAt:     s.CreatedAt,
+		UpdatedAt:     s.UpdatedAt,
+		UnpinnedAt:    unpinnedAt,
+		UnpinnedBy:    s.UnpinnedBy,
+		Size:          s.Size,
+		IsDirectory:   s.IsDirectory,
+		ContentType:   s.ContentType,
+	})
+}
+
+// statsGET responds with the number of pinned skylinks by the number of servers
+// which pin them, the number of underpinned skylinks and the stats of the pool
+// of connections to the database.
+//
+// The optional `deep` query parameter adds the stats of the sizes of the
+// skylinks' documents. They take a scan of the whole collection.
+func (api *API) statsGET(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	deep := false
+	if val := req.FormValue("deep"); val != "" {
+		var err error
+		deep, err = strconv.ParseBool(val)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "invalid deep parameter"), http.StatusBadRequest)
+			return
+		}
+	}
+	mp, err := conf.MinPinners(req.Context(), api.staticDB)
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to fetch min_pinners"), http.StatusInternalServerError)
+		return
+	}
+	counts, err := api.staticDB.CountsByPinnerCount(req.Context())
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	underpinned, err := api.staticDB.CountUnderpinned(req.Context(), mp)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	var docSizes *database.DocSizeStats
+	if deep {
+		stats, err := api.staticDB.DocSizeStats(req.Context())
+		if err != nil {
+			api.WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		docSizes = &stats
+	}
+	api.WriteJSON(w, StatsGET{
+		DBPool:       api.staticDB.PoolStats(),
+		DBCommands:   api.staticDB.CommandStats(),
+		DocSizes:     docSizes,
+		MinPinners:   mp,
+		PinnerCounts: counts,
+		Underpinned:  underpinned,
+	})
+}
+
 // sweepPOST instructs pinner to scan the list of skylinks pinned by skyd and
 // update its database. This call is non-blocking, i.e. it will immediately
 // return with a success and it will only start a new sweep if there isn't one
 // already running. The response is 202 Accepted and the response body contains
 // an endpoint link on which the caller can check the status of the sweep.
-func (api *API) sweepPOST(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	api.latestSweepStatusMu.Lock()
-	// If there is no sweep in progress - kick one off.
-	if !api.latestSweepStatus.InProgress {
-		go api.threadedPerformSweep()
+//
+// The optional `force` query parameter makes the sweep bypass the safety check
+// which prevents it from removing the server from too many skylinks.
+//
+// The optional `path` query parameter limits the sweep to the subtree of skyd's
+// filesystem under the given SiaPath, e.g. "var/skynet/foo". See
+// Sweeper.SweepSubtree for the exact semantics.
+func (api *API) sweepPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	force := false
+	if val := req.FormValue("force"); val != "" {
+		var err error
+		force, err = strconv.ParseBool(val)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "invalid force parameter"), http.StatusBadRequest)
+			return
+		}
+	}
+	if val := req.FormValue("path"); val != "" {
+		root, err := skymodules.NewSiaPath(val)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "invalid path parameter"), http.StatusBadRequest)
+			return
+		}
+		if !root.Equals(skymodules.SkynetFolder) && !strings.HasPrefix(root.Path, skymodules.SkynetFolder.Path+"/") {
+			api.WriteError(w, errors.New("path must be within the skynet folder"), http.StatusBadRequest)
+			return
+		}
+		api.staticSweeper.SweepSubtree(root, force)
+	} else if force {
+		api.staticSweeper.ForceSweep()
+	} else {
+		api.staticSweeper.Sweep()
 	}
-	api.latestSweepStatusMu.Unlock()
 	// TODO If we want to be able to uniquely identify sweeps we can issue ids
 	//  for them and keep their statuses in a map. This would be the appropriate
 	//  RESTful approach. I am not sure we need that because all we care about
@@ -121,21 +575,19 @@ func (api *API) sweepPOST(w http.ResponseWriter, _ *http.Request, _ httprouter.P
 
 // sweepStatusGET responds with the status of the latest sweep.
 func (api *API) sweepStatusGET(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	api.latestSweepStatusMu.Lock()
-	defer api.latestSweepStatusMu.Unlock()
-	api.WriteJSON(w, api.latestSweepStatus)
+	api.WriteJSON(w, api.staticSweeper.Status())
 }
 
 // parseAndResolve parses the given string representation of a skylink and
 // resolves it to a V1 skylink, in case it's a V2.
-func (api *API) parseAndResolve(skylink string) (skymodules.Skylink, error) {
+func (api *API) parseAndResolve(ctx context.Context, skylink string) (skymodules.Skylink, error) {
 	var sl skymodules.Skylink
 	err := sl.LoadString(skylink)
 	if err != nil {
 		return skymodules.Skylink{}, errors.Compose(err, database.ErrInvalidSkylink)
 	}
 	if sl.IsSkylinkV2() {
-		s, err := api.staticSkydClient.Resolve(sl.String())
+		s, err := api.staticSkydClient.Resolve(ctx, sl.String())
 		if err != nil {
 			return skymodules.Skylink{}, err
 		}
@@ -147,95 +599,29 @@ func (api *API) parseAndResolve(skylink string) (skymodules.Skylink, error) {
 	return sl, nil
 }
 
-// threadedPerformSweep performs the actual sweep operation.
-// TODO This can be moved to a separate `sweeper` type which would also hold the
-//  status of the latest sweep as well as the relevant mutex. This can
-//  streamline the structure of API. I recommend this as a F/U.
-func (api *API) threadedPerformSweep() {
-	api.latestSweepStatusMu.Lock()
-	// Double-check for parallel sweeps.
-	if api.latestSweepStatus.InProgress {
-		api.latestSweepStatusMu.Unlock()
-		return
-	}
-	// Initialise the status to "a sweep is running".
-	api.latestSweepStatus = SweepStatus{
-		InProgress: true,
-		Error:      nil,
-		StartTime:  time.Now().UTC(),
-		EndTime:    time.Time{},
-	}
-	api.latestSweepStatusMu.Unlock()
-	// Define an error variable which will represent the success of the scan.
-	var err error
-	// Ensure that we'll finalize the sweep on returning from this method.
-	defer func() {
-		api.latestSweepStatusMu.Lock()
-		api.latestSweepStatus.InProgress = false
-		api.latestSweepStatus.EndTime = time.Now().UTC()
-		api.latestSweepStatus.Error = err
-		api.latestSweepStatusMu.Unlock()
-	}()
-
-	// Perform the actual sweep.
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	var cacheErr error
-	go func() {
-		defer wg.Done()
-		res := api.staticSkydClient.RebuildCache()
-		<-res.ErrAvail
-		cacheErr = res.ExternErr
-	}()
-
-	// We use an independent context because we are not strictly bound to a
-	// specific API call. Also, this operation can take significant amount of
-	// time and we don't want it to fail because of a timeout.
-	ctx := context.Background()
-	dbCtx, cancel := context.WithDeadline(ctx, time.Now().UTC().Add(database.MongoDefaultTimeout))
-	defer cancel()
-
-	// Get pinned skylinks from the DB
-	dbSkylinks, err := api.staticDB.SkylinksForServer(dbCtx, api.staticServerName)
-	if err != nil {
-		err = errors.AddContext(err, "failed to fetch skylinks for server")
-		return
-	}
-	wg.Wait()
-	if cacheErr != nil {
-		err = errors.AddContext(cacheErr, "failed to rebuild skyd cache")
-		return
-	}
-
-	unknown, missing := api.staticSkydClient.DiffPinnedSkylinks(dbSkylinks)
-
-	// Remove all unknown skylink from the database.
-	var s skymodules.Skylink
-	for _, sl := range unknown {
-		s, err = database.SkylinkFromString(sl)
-		if err != nil {
-			err = errors.AddContext(err, "invalid skylink found in DB")
-			build.Critical(err)
-			continue
-		}
-		err = api.staticDB.RemoveServerFromSkylink(ctx, s, api.staticServerName)
-		if err != nil {
-			err = errors.AddContext(err, "failed to unpin skylink")
-			return
-		}
+// storeMetadata fetches the metadata of the given skylink from skyd and stores
+// its size and type in the database. It's not critical for pinning the skylink,
+// so we only log any errors. The sweep fills in the missing sizes later.
+func (api *API) storeMetadata(ctx context.Context, sl skymodules.Skylink) {
+	meta, err := api.staticSkydClient.Metadata(ctx, sl.String())
+	if err != nil {
+		api.staticLogger.Debug(errors.AddContext(err, fmt.Sprintf("failed to fetch the metadata of '%s'", sl)))
+		return
 	}
-	// Add all missing skylinks to the database.
-	for _, sl := range missing {
-		s, err = database.SkylinkFromString(sl)
-		if err != nil {
-			err = errors.AddContext(err, "invalid skylink reported by skyd")
-			build.Critical(err)
-			continue
-		}
-		err = api.staticDB.AddServerForSkylink(ctx, s, api.staticServerName, false)
-		if err != nil {
-			err = errors.AddContext(err, "failed to unpin skylink")
-			return
-		}
+	err = api.staticDB.SetSkylinkMetadata(ctx, sl, meta)
+	if err != nil {
+		api.staticLogger.Debug(errors.AddContext(err, fmt.Sprintf("failed to store the metadata of '%s'", sl)))
+	}
+}
+
+// skydErrorStatus returns the HTTP status with which to respond to the given
+// error from skyd. Errors which mean that we can't talk to skyd right now get a
+// 503 Service Unavailable, all others a 500 Internal Server Error.
+func skydErrorStatus(err error) int {
+	if errors.Contains(err, skyd.ErrSkydUnavailable) ||
+		errors.Contains(err, skyd.ErrSkydUnreachable) ||
+		errors.Contains(err, skyd.ErrTimeout) {
+		return http.StatusServiceUnavailable
 	}
+	return http.StatusInternalServerError
 }
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// AccountsHookSignatureHeader is the header which holds the signature of
+	// the requests accounts sends to POST /hooks/accounts. See
+	// SignAccountsHook.
+	AccountsHookSignatureHeader = "X-Accounts-Signature"
+	// AccountsHookTimestampHeader is the header which holds the time at which
+	// accounts signed the request, in seconds since the Unix epoch.
+	AccountsHookTimestampHeader = "X-Accounts-Timestamp"
+
+	// accountsHookMaxBodySize is the maximum size of the body of a request to
+	// POST /hooks/accounts.
+	accountsHookMaxBodySize = 16 << 20
+	// accountsHookMaxSkew is the maximum difference between the time at which
+	// accounts signed a request and the time we receive it. We reject the
+	// requests outside of this window, so a captured request can't be
+	// replayed later on.
+	accountsHookMaxSkew = 5 * time.Minute
+)
+
+var (
+	// ErrInvalidSignature is returned when the signature of a request to
+	// POST /hooks/accounts doesn't match its body.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrStaleRequest is returned when a request to POST /hooks/accounts was
+	// signed outside of the accepted time window.
+	ErrStaleRequest = errors.New("request timestamp is outside of the accepted window")
+)
+
+type (
+	// AccountsHookPOST is the body of the requests accounts sends to POST
+	// /hooks/accounts, e.g. when it deletes a user. It lists the skylinks
+	// which no remaining user pins.
+	AccountsHookPOST struct {
+		Skylinks []string `json:"skylinks"`
+	}
+	// AccountsHookPOSTResponse is the response to POST /hooks/accounts.
+	AccountsHookPOSTResponse struct {
+		// Matched is the number of the given skylinks which we know about.
+		Matched int64 `json:"matched"`
+		// Unpinned is the number of skylinks we marked as unpinned. It
+		// excludes the ones which were already unpinned.
+		Unpinned int64 `json:"unpinned"`
+	}
+)
+
+// SignAccountsHook returns the signature of a request to POST /hooks/accounts
+// with the given body, signed at the given time with the given secret. It's
+// the hex-encoded HMAC-SHA256 of the timestamp, a dot and the body.
+func SignAccountsHook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp)
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// accountsHookPOST marks the skylinks listed by accounts as unpinned. Accounts
+// signs its requests with the shared secret, see SignAccountsHook. We reject
+// the requests with an invalid signature or one made outside of the accepted
+// time window.
+func (api *API) accountsHookPOST(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if api.staticAccountsHookSecret == "" {
+		api.WriteError(w, errors.New("accounts hooks are not configured"), http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, accountsHookMaxBodySize))
+	if err != nil {
+		api.WriteError(w, errors.AddContext(err, "failed to read body"), http.StatusBadRequest)
+		return
+	}
+	err = verifyAccountsHook(api.staticAccountsHookSecret, req.Header, body, time.Now())
+	if err != nil {
+		api.WriteError(w, err, http.StatusUnauthorized)
+		return
+	}
+	var hook AccountsHookPOST
+	err = json.Unmarshal(body, &hook)
+	if err != nil {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	matched, modified, err := api.staticDB.MarkUnpinnedMany(req.Context(), hook.Skylinks, api.staticServerName)
+	if err != nil {
+		api.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	api.staticLogger.Infof("Accounts unpinned %d skylinks, %d of them were pinned.", len(hook.Skylinks), modified)
+	api.WriteJSON(w, AccountsHookPOSTResponse{Matched: matched, Unpinned: modified})
+}
+
+// verifyAccountsHook checks that the given headers carry a valid signature of
+// the given body, made within accountsHookMaxSkew of now.
+func verifyAccountsHook(secret string, h http.Header, body []byte, now time.Time) error {
+	ts, err := strconv.ParseInt(h.Get(AccountsHookTimestampHeader), 10, 64)
+	if err != nil {
+		return errors.AddContext(err, "invalid timestamp")
+	}
+	signedAt := time.Unix(ts, 0)
+	if signedAt.Before(now.Add(-accountsHookMaxSkew)) || signedAt.After(now.Add(accountsHookMaxSkew)) {
+		return ErrStaleRequest
+	}
+	sig, err := hex.DecodeString(h.Get(AccountsHookSignatureHeader))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	expected, _ := hex.DecodeString(SignAccountsHook(secret, ts, body))
+	if !hmac.Equal(sig, expected) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
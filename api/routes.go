@@ -2,9 +2,21 @@ package api
 
 // buildHTTPRoutes registers all HTTP routes and their handlers.
 func (api *API) buildHTTPRoutes() {
+	api.staticRouter.GET("/cache", api.cacheGET)
+	api.staticRouter.DELETE("/config/:key", api.configDELETE)
+	api.staticRouter.GET("/config/effective", api.configEffectiveGET)
+	api.staticRouter.GET("/config/export", api.configExportGET)
+	api.staticRouter.PUT("/config/export", api.configExportPUT)
 	api.staticRouter.GET("/health", api.healthGET)
+	api.staticRouter.POST("/hooks/accounts", api.accountsHookPOST)
 
 	api.staticRouter.POST("/pin", api.pinPOST)
+	api.staticRouter.POST("/reconcile/accounts", api.reconcileAccountsPOST)
+	api.staticRouter.GET("/reconcile/accounts/latest", api.reconcileAccountsLatestGET)
+	api.staticRouter.GET("/reconcile/accounts/status", api.reconcileAccountsStatusGET)
+	api.staticRouter.POST("/servers/repair", api.serversRepairPOST)
+	api.staticRouter.GET("/skylink/:skylink", api.skylinkGET)
+	api.staticRouter.GET("/stats", api.statsGET)
 	api.staticRouter.POST("/unpin", api.unpinPOST)
 	api.staticRouter.POST("/sweep", api.sweepPOST)
 	api.staticRouter.GET("/sweep/status", api.sweepStatusGET)
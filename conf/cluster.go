@@ -0,0 +1,156 @@
+package conf
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/skynetlabs/pinner/database"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+const (
+	// defaultPinDeadlineFactor is the default value of pin_deadline_factor.
+	// minPinDeadlineFactor and maxPinDeadlineFactor are its bounds. We
+	// never give up on a skylink before its estimated upload time.
+	defaultPinDeadlineFactor = 2
+	minPinDeadlineFactor     = 1
+	maxPinDeadlineFactor     = 100
+	// maxSleepBetweenPins is the highest allowed value of
+	// sleep_between_pins.
+	maxSleepBetweenPins = time.Hour
+)
+
+var (
+	// defaultSleepBetweenPins is the default value of sleep_between_pins.
+	// We want to sleep after a failed pin in order to avoid a tight loop of
+	// errors.
+	defaultSleepBetweenPins = build.Select(build.Var{
+		Standard: 10 * time.Second,
+		Dev:      time.Second,
+		Testing:  time.Millisecond,
+	}).(time.Duration)
+)
+
+type (
+	// ClusterConfig holds the cluster-wide configuration values the scanner
+	// uses, as they apply to a given server. See the corresponding Conf*
+	// constants for their descriptions.
+	ClusterConfig struct {
+		DryRun            bool
+		LazyPinning       bool
+		LockDuration      time.Duration
+		MaxPinSize        uint64
+		MaxPinsPerCycle   int
+		MinPinners        int
+		PinDeadlineFactor float64
+		SleepBetweenPins  time.Duration
+	}
+)
+
+// DefaultClusterConfig returns the values of ClusterConfig which apply when
+// none of them is set in the database.
+func DefaultClusterConfig() ClusterConfig {
+	return ClusterConfig{
+		DryRun:            false,
+		LazyPinning:       true,
+		LockDuration:      database.DefaultLockDuration,
+		MaxPinSize:        0,
+		MaxPinsPerCycle:   0,
+		MinPinners:        defaultMinPinners,
+		PinDeadlineFactor: defaultPinDeadlineFactor,
+		SleepBetweenPins:  defaultSleepBetweenPins,
+	}
+}
+
+// ClusterConfigKeys returns the keys of the configuration settings which make
+// up the ClusterConfig of the given server.
+func ClusterConfigKeys(server string) []string {
+	return []string{
+		ConfDryRun,
+		DryRunKey(server),
+		ConfLazyPinning,
+		ConfLockDuration,
+		ConfMaxPinSize,
+		ConfMaxPinsPerCycle,
+		ConfMinPinners,
+		ConfPinDeadlineFactor,
+		ConfSleepBetweenPins,
+	}
+}
+
+// LoadClusterConfig loads the ClusterConfig of the given server from the
+// database with a single query. The values which aren't set get their
+// defaults. If any of the values is invalid, it returns an error listing all
+// invalid values, so the caller can keep using the values it has rather than
+// fall back to the defaults. It also returns the database values it parsed,
+// which tell us where each setting comes from, see LoadEffectiveConfig.
+func LoadClusterConfig(ctx context.Context, db *database.DB, server string) (ClusterConfig, map[string]string, error) {
+	values, err := db.ConfigValues(ctx, ClusterConfigKeys(server)...)
+	if err != nil {
+		return ClusterConfig{}, nil, errors.AddContext(err, "failed to load the cluster configuration")
+	}
+	cc, err := parseClusterConfig(values, server)
+	if err != nil {
+		return ClusterConfig{}, nil, err
+	}
+	return cc, values, nil
+}
+
+// parseClusterConfig parses the given configuration values into the
+// ClusterConfig of the given server. See LoadClusterConfig.
+func parseClusterConfig(values map[string]string, server string) (ClusterConfig, error) {
+	cc := DefaultClusterConfig()
+	var errs []error
+	if val, ok := values[ConfDryRun]; ok {
+		dr, err := database.ParseConfigBool(ConfDryRun, val)
+		errs = append(errs, err)
+		cc.DryRun = dr
+	}
+	// The server's own dry_run value takes precedence.
+	if val, ok := values[DryRunKey(server)]; ok {
+		dr, err := database.ParseConfigBool(DryRunKey(server), val)
+		errs = append(errs, err)
+		cc.DryRun = dr
+	}
+	if val, ok := values[ConfLazyPinning]; ok {
+		lp, err := database.ParseConfigBool(ConfLazyPinning, val)
+		errs = append(errs, err)
+		cc.LazyPinning = lp
+	}
+	if val, ok := values[ConfLockDuration]; ok {
+		ld, err := parseLockDuration(val)
+		errs = append(errs, err)
+		cc.LockDuration = ld
+	}
+	if val, ok := values[ConfMaxPinSize]; ok {
+		size, err := database.ParseConfigInt(ConfMaxPinSize, val, 0, math.MaxInt)
+		errs = append(errs, err)
+		cc.MaxPinSize = uint64(size)
+	}
+	if val, ok := values[ConfMaxPinsPerCycle]; ok {
+		n, err := database.ParseConfigInt(ConfMaxPinsPerCycle, val, 0, math.MaxInt32)
+		errs = append(errs, err)
+		cc.MaxPinsPerCycle = n
+	}
+	if val, ok := values[ConfMinPinners]; ok {
+		mp, err := database.ParseConfigInt(ConfMinPinners, val, minPinnersMinValue, maxPinnersMinValue)
+		errs = append(errs, err)
+		cc.MinPinners = mp
+	}
+	if val, ok := values[ConfPinDeadlineFactor]; ok {
+		f, err := database.ParseConfigFloat(ConfPinDeadlineFactor, val, minPinDeadlineFactor, maxPinDeadlineFactor)
+		errs = append(errs, err)
+		cc.PinDeadlineFactor = f
+	}
+	if val, ok := values[ConfSleepBetweenPins]; ok {
+		d, err := database.ParseConfigDuration(ConfSleepBetweenPins, val, 0, maxSleepBetweenPins)
+		errs = append(errs, err)
+		cc.SleepBetweenPins = d
+	}
+	if err := errors.Compose(errs...); err != nil {
+		return ClusterConfig{}, err
+	}
+	return cc, nil
+}
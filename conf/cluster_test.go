@@ -0,0 +1,142 @@
+package conf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skynetlabs/pinner/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestParseClusterConfig ensures that parseClusterConfig applies the defaults
+// to the values which aren't set and that the server's own dry_run value takes
+// precedence over the cluster-wide one.
+func TestParseClusterConfig(t *testing.T) {
+	t.Parallel()
+
+	server := "server1"
+	// Nothing is set.
+	cc, err := parseClusterConfig(nil, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cc, DefaultClusterConfig()) {
+		t.Fatalf("Expected the defaults %+v, got %+v", DefaultClusterConfig(), cc)
+	}
+
+	// Some values are set.
+	cc, err = parseClusterConfig(map[string]string{
+		ConfLazyPinning:      "false",
+		ConfMaxPinSize:       "1048576",
+		ConfSleepBetweenPins: "30s",
+	}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DefaultClusterConfig()
+	expected.LazyPinning = false
+	expected.MaxPinSize = 1 << 20
+	expected.SleepBetweenPins = 30 * time.Second
+	if !reflect.DeepEqual(cc, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, cc)
+	}
+
+	// All values are set.
+	values := map[string]string{
+		ConfDryRun:            "true",
+		ConfLazyPinning:       "false",
+		ConfLockDuration:      "2h",
+		ConfMaxPinSize:        "1000",
+		ConfMaxPinsPerCycle:   "50",
+		ConfMinPinners:        "4",
+		ConfPinDeadlineFactor: "3.5",
+		ConfSleepBetweenPins:  "0s",
+	}
+	cc, err = parseClusterConfig(values, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = ClusterConfig{
+		DryRun:            true,
+		LazyPinning:       false,
+		LockDuration:      2 * time.Hour,
+		MaxPinSize:        1000,
+		MaxPinsPerCycle:   50,
+		MinPinners:        4,
+		PinDeadlineFactor: 3.5,
+		SleepBetweenPins:  0,
+	}
+	if !reflect.DeepEqual(cc, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, cc)
+	}
+
+	// The server's own dry_run value overrides the cluster-wide one. The
+	// other servers' values don't matter.
+	values[DryRunKey(server)] = "false"
+	values[DryRunKey("server2")] = "true"
+	cc, err = parseClusterConfig(values, server)
+	if err != nil || cc.DryRun {
+		t.Fatalf("Expected dry_run to be off, got %t and '%v'", cc.DryRun, err)
+	}
+	delete(values, ConfDryRun)
+	values[DryRunKey(server)] = "true"
+	cc, err = parseClusterConfig(values, server)
+	if err != nil || !cc.DryRun {
+		t.Fatalf("Expected dry_run to be on, got %t and '%v'", cc.DryRun, err)
+	}
+}
+
+// TestParseClusterConfigBounds ensures that parseClusterConfig rejects the
+// values which can't be parsed or which are out of bounds, and that it reports
+// all of them at once.
+func TestParseClusterConfigBounds(t *testing.T) {
+	t.Parallel()
+
+	server := "server1"
+	valid := map[string][]string{
+		ConfLockDuration:      {"1m", "168h"},
+		ConfMaxPinSize:        {"0", "1099511627776"},
+		ConfMaxPinsPerCycle:   {"0", "1000000"},
+		ConfMinPinners:        {"1", "10"},
+		ConfPinDeadlineFactor: {"1", "100"},
+		ConfSleepBetweenPins:  {"0s", "1h"},
+	}
+	invalid := map[string][]string{
+		ConfDryRun:            {"maybe", ""},
+		DryRunKey(server):     {"maybe"},
+		ConfLazyPinning:       {"lazy"},
+		ConfLockDuration:      {"59s", "169h", "7"},
+		ConfMaxPinSize:        {"-1", "1GB"},
+		ConfMaxPinsPerCycle:   {"-1", "ten"},
+		ConfMinPinners:        {"0", "11"},
+		ConfPinDeadlineFactor: {"0.5", "101", "NaN"},
+		ConfSleepBetweenPins:  {"-1s", "61m", "10"},
+	}
+	for key, vals := range valid {
+		for _, val := range vals {
+			if _, err := parseClusterConfig(map[string]string{key: val}, server); err != nil {
+				t.Fatalf("Expected %s '%s' to be valid, got '%v'", key, val, err)
+			}
+		}
+	}
+	for key, vals := range invalid {
+		for _, val := range vals {
+			_, err := parseClusterConfig(map[string]string{key: val}, server)
+			if !errors.Contains(err, database.ErrInvalidConfigValue) {
+				t.Fatalf("Expected %s '%s' to be rejected with '%v', got '%v'", key, val, database.ErrInvalidConfigValue, err)
+			}
+		}
+	}
+
+	// All invalid values are reported.
+	_, err := parseClusterConfig(map[string]string{
+		ConfMinPinners:        "0",
+		ConfPinDeadlineFactor: "0",
+		ConfMaxPinsPerCycle:   "3",
+	}, server)
+	if err == nil || !strings.Contains(err.Error(), ConfMinPinners) || !strings.Contains(err.Error(), ConfPinDeadlineFactor) {
+		t.Fatalf("Expected both invalid values in the error, got '%v'", err)
+	}
+}
@@ -3,9 +3,11 @@ package conf
 import (
 	"context"
 	"fmt"
-	"log"
+	"math"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -14,32 +16,81 @@ import (
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/SkynetLabs/skyd/build"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 // Default configuration values.
 // For individual descriptions see Config.
 const (
-	defaultAccountsHost = "10.10.10.70"
-	defaultAccountsPort = "3000"
-	defaultLogFile      = "" // disabled logging to file
-	defaultLogLevel     = logrus.InfoLevel
-	defaultSiaAPIHost   = "10.10.10.10"
-	defaultSiaAPIPort   = "9980"
-	defaultMinPinners   = 1
+	defaultAccountsHost    = "10.10.10.70"
+	defaultAccountsPort    = "3000"
+	defaultAccountsTimeout = time.Minute
+	defaultCacheWorkers    = 4
+	defaultLogFile         = "" // disabled logging to file
+	defaultLogLevel        = logrus.InfoLevel
+	defaultSiaAPIHost      = "10.10.10.10"
+	defaultSiaAPIPort      = "9980"
+	defaultSiaAPIScheme    = "http"
+	defaultMinPinners      = 1
+
+	defaultDriftReportInterval    = 7 * 24 * time.Hour
+	defaultSkydRetries            = 3
+	defaultSkydTimeout            = time.Minute
+	defaultSkydUnpinConcurrency   = 10
+	defaultSweepMaxRemovalPercent = 50
 )
 
 // Cluster-wide configuration variable names.
 // Stored in the database.
 const (
+	// ConfDeletedRetention holds the name of the configuration setting which
+	// defines how long we keep the soft-deleted skylinks before we remove
+	// them for good, e.g. "168h". Until then they can be restored. Zero
+	// disables the removal.
+	ConfDeletedRetention = "deleted_retention"
 	// ConfDryRun holds the name of the configuration setting which defines
 	// whether we execute pin/unpin calls against skyd or not. Note that all
 	// database operations will still be executed, i.e. skylinks records will
 	// be updated. After using this option you will need to prune the database
-	// before being able to use the service in "actual mode".
+	// before being able to use the service in "actual mode". It can be
+	// overridden per server, see DryRunKey.
 	ConfDryRun = "dry_run"
+	// ConfLazyPinning holds the name of the configuration setting which
+	// defines whether we pin skylinks lazily, i.e. whether skyd only uploads
+	// their base sectors before returning and leaves their fanouts to the
+	// repair loop. Lazy pins return fast but they don't verify that the
+	// fanout can be downloaded.
+	ConfLazyPinning = "lazy_pinning"
+	// ConfLockDuration holds the name of the configuration setting which
+	// defines how long we lock skylinks for while we are trying to pin them,
+	// e.g. "2h". Shorter locks let other servers retry failed pins sooner,
+	// longer ones give the pins of huge files the time they need.
+	ConfLockDuration = "lock_duration"
+	// ConfMaxPinSize holds the name of the configuration setting which
+	// defines the size in bytes above which the scanner doesn't pin
+	// skylinks. It only applies to the skylinks whose size we know. Zero
+	// means no limit.
+	ConfMaxPinSize = "max_pin_size"
+	// ConfMaxPinsPerCycle holds the name of the configuration setting which
+	// defines the maximum number of skylinks a server pins per scan. Zero
+	// means no limit.
+	ConfMaxPinsPerCycle = "max_pins_per_cycle"
 	// ConfMinPinners holds the name of the configuration setting which defines
 	// the minimum number of pinners we want to ensure for each skyfile.
 	ConfMinPinners = "min_pinners"
+	// ConfPinDeadlineFactor holds the name of the configuration setting
+	// which defines how many times the estimated upload time we wait for a
+	// pinned skylink to become healthy before we move on.
+	ConfPinDeadlineFactor = "pin_deadline_factor"
+	// ConfSleepBetweenPins holds the name of the configuration setting which
+	// defines how long the scanner sleeps after a failed pin before it tries
+	// the next one, e.g. "10s".
+	ConfSleepBetweenPins = "sleep_between_pins"
+	// ConfUnpinnedRetention holds the name of the configuration setting which
+	// defines how long we keep the skylinks which have been unpinned and
+	// which no server pins anymore before we delete them, e.g. "720h". Zero
+	// disables the deletion.
+	ConfUnpinnedRetention = "unpinned_retention"
 )
 
 const (
@@ -54,18 +105,119 @@ const (
 	// portal operator. The number 10 was arbitrarily chosen as an acceptable
 	// upper bound.
 	maxPinnersMinValue = 10
+	// minLockDuration and maxLockDuration are the bounds of the cluster-wide
+	// lock duration. Locks shorter than a minute would expire before most
+	// pins finish and locks longer than a week would keep skylinks whose
+	// pinner died underpinned for too long.
+	minLockDuration = time.Minute
+	maxLockDuration = 7 * 24 * time.Hour
+	// defaultDeletedRetention is how long we keep soft-deleted skylinks by
+	// default. minDeletedRetention is the shortest retention we allow, so
+	// there is always a window in which we can restore them.
+	defaultDeletedRetention = 7 * 24 * time.Hour
+	minDeletedRetention     = 24 * time.Hour
+	// defaultUnpinnedRetention is how long we keep unpinned skylinks by
+	// default. minUnpinnedRetention is the shortest retention we allow, so a
+	// typo can't make us delete skylinks which were just unpinned, e.g. by
+	// mistake.
+	defaultUnpinnedRetention = 90 * 24 * time.Hour
+	minUnpinnedRetention     = 24 * time.Hour
+
+	// maxDocSize is the highest allowed value of PINNER_DB_MAX_DOC_SIZE.
+	// It's MongoDB's limit of the size of a document.
+	maxDocSize = 16 << 20
+
+	// timeOfDayFormat is the format in which we expect the time of day at
+	// which we anchor the sweeps, e.g. "03:30".
+	timeOfDayFormat = "15:04"
 )
 
+var (
+	// processEnv holds the names of the variables the process' environment
+	// held before we first loaded the .env file. dotEnvVars holds the names
+	// of the variables we set from the .env file. See loadDotEnv.
+	processEnv map[string]struct{}
+	dotEnvVars = make(map[string]struct{})
+	dotEnvMu   sync.Mutex
+
+	// DefaultSleepBetweenScans defines how often the scanner scans the DB
+	// for underpinned skylinks, unless PINNER_SLEEP_BETWEEN_SCANS says
+	// otherwise.
+	DefaultSleepBetweenScans = build.Select(build.Var{
+		// In production we want to use a prime number of hours, so we can
+		// de-sync the scan and the sweeps.
+		Standard: 19 * time.Hour,
+		Dev:      1 * time.Minute,
+		Testing:  300 * time.Millisecond,
+	}).(time.Duration)
+)
+
+// SleepVariationFactor defines how much the sleep between scans will vary
+// between executions. It represents percent.
+const SleepVariationFactor = 0.1
+
 type (
 	// Config represents the entire configurable state of the service. If a
 	// value is not here, then it can't be configured.
 	Config struct {
+		// AccountsHookSecret defines the secret shared with accounts, with
+		// which it signs its requests to pinner's hooks. The hooks are
+		// disabled when it's empty.
+		AccountsHookSecret string
 		// AccountsHost defines the IP or hostname of the local accounts service.
 		AccountsHost string
 		// AccountsPort defines the port of the local accounts service.
 		AccountsPort string
+		// AccountsTimeout defines the maximum duration of a single call to
+		// accounts. Zero means no timeout.
+		AccountsTimeout time.Duration
+		// AccountsToken defines the bearer token we authenticate with when
+		// calling accounts. If it's empty we don't authenticate.
+		AccountsToken string
+		// AlertWebhookURL defines the URL to which we POST alerts which need
+		// the operator's attention. If it's empty we only log them.
+		AlertWebhookURL string
+		// CacheRebuildWorkers defines the number of workers which walk
+		// skyd's filesystem in parallel when rebuilding the skylinks cache.
+		CacheRebuildWorkers int
 		// DBCredentials holds all the information we need to connect to the DB.
 		DBCredentials database.DBCredentials
+		// DBMaxConnIdleTime defines how long a connection to the database
+		// can stay idle before we close it. Zero means the driver's default.
+		DBMaxConnIdleTime time.Duration
+		// DBMaxDocSize defines the size in bytes above which we refuse to
+		// add servers or owners to a skylink's document. Zero disables the
+		// check.
+		DBMaxDocSize int64
+		// DBMaxPoolSize and DBMinPoolSize define the maximum and minimum
+		// number of connections we keep open to each database server. Zero
+		// means the driver's default.
+		DBMaxPoolSize uint64
+		DBMinPoolSize uint64
+		// DBOpTimeout defines the maximum duration of a single database
+		// operation. Zero means no timeout.
+		DBOpTimeout time.Duration
+		// DBReportingReadPref defines the read preference of the heavy
+		// reporting queries, e.g. the stats, so they can stay off the
+		// primary.
+		DBReportingReadPref readpref.Mode
+		// DBSlowOpThreshold defines the duration above which we log database
+		// operations as slow. Zero disables the logging.
+		DBSlowOpThreshold time.Duration
+		// DBUnderpinnedHint defines the index we hint MongoDB to use when
+		// looking for underpinned skylinks. Empty lets MongoDB pick.
+		DBUnderpinnedHint string
+		// DriftReportInterval defines how often we report the drift between
+		// the skylinks the users pin according to accounts and the ones the
+		// database marks as pinned. Zero disables the reports.
+		DriftReportInterval time.Duration
+		// JWTClaim defines the dot-separated path of the claim which the
+		// JWTs accounts issues must carry in order to call pinner's API,
+		// e.g. "tier". If it's empty the API doesn't require JWTs.
+		JWTClaim string
+		// JWTClaimMin defines the minimum value of JWTClaim, e.g. the tier
+		// of admins.
+		JWTClaimMin float64
 		// Logfile defines the log file we want to write to. If it's empty we do
 		// not log to a file.
 		LogFile string
@@ -84,128 +236,529 @@ type (
 		SiaAPIHost string
 		// SiaAPIPort is the port of the local skyd.
 		SiaAPIPort string
+		// SiaAPIScheme is the scheme over which we talk to the local skyd,
+		// either "http" or "https".
+		SiaAPIScheme string
+		// SiaAPICACert is the path to a PEM file holding the CA certificates
+		// we trust when we talk to skyd over HTTPS, e.g. the CA of an
+		// internal TLS proxy. If it's empty we trust the system's CAs.
+		SiaAPICACert string
+		// SkydReadRate defines the maximum number of calls per second which
+		// read from skyd, e.g. metadata, health and directory listings.
+		// Zero means unlimited.
+		SkydReadRate float64
+		// SkydRetries defines how many times we retry idempotent calls to
+		// skyd which timed out or failed to reach skyd.
+		SkydRetries int
+		// SkydTimeout defines the maximum duration of a single call to skyd.
+		// Standard pins get more time, depending on the skyfile's size.
+		// Zero means no timeout.
+		SkydTimeout time.Duration
+		// SkydUnpinConcurrency defines the maximum number of unpin calls a
+		// bulk unpin sends to skyd at the same time.
+		SkydUnpinConcurrency int
+		// SkydVerifyPins defines whether we confirm with skyd that it still
+		// pins the skylinks our cache says it pins before we decide not to
+		// pin them. This costs an extra call to skyd per such skylink.
+		SkydVerifyPins bool
+		// SkydWriteRate defines the maximum number of pin and unpin calls per
+		// second to skyd. Zero means unlimited.
+		SkydWriteRate float64
 		// SleepBetweenScans defines the time between scans in hours.
 		SleepBetweenScans time.Duration
+		// SweepTimeOfDay defines the time of day (UTC) at which the scheduled
+		// sweeps start, e.g. "03:30". If it's empty, the sweeps are not
+		// aligned to any specific time of day.
+		SweepTimeOfDay string
+		// SweepUnpin defines whether sweeps unpin from the local skyd the
+		// skylinks which are marked as unpinned in the database. If it's
+		// false, sweeps only report those skylinks.
+		SweepUnpin bool
+		// SweepMaxRemovalPercent defines the maximum percentage of the
+		// server's skylinks a sweep can remove the server from. Sweeps which
+		// would remove more fail and alert the operator, unless forced.
+		SweepMaxRemovalPercent int
+
+		// Sources holds where each setting comes from, keyed by its env
+		// var. See Source. It's not a setting itself.
+		Sources map[string]Source `setting:"-"`
 	}
 )
 
-// LoadConfig loads the required service defaultConfig from the environment and
-// the provided .env file.
-func LoadConfig() (Config, error) {
+// LoadConfig loads the required service defaultConfig from the environment, the
+// provided .env file and the optional configuration file PINNER_CONFIG_FILE
+// points to, in this order of precedence. The defaults apply last. It can be
+// called again to reload the configuration, e.g. after the files changed. It
+// also returns the keys in the configuration file it doesn't know, so the
+// caller can warn about them.
+func LoadConfig() (Config, []string, error) {
 	// Load the environment variables from the .env file.
 	// Existing variables take precedence and won't be overwritten.
-	_ = godotenv.Load()
+	loadDotEnv()
+
+	// Load the configuration file, if there is one. The env vars take
+	// precedence over its values.
+	var fileVals map[string]string
+	var unknown []string
+	if path, ok := os.LookupEnv("PINNER_CONFIG_FILE"); ok && path != "" {
+		var err error
+		fileVals, unknown, err = loadConfigFile(path)
+		if err != nil {
+			return Config{}, nil, err
+		}
+	}
+	lookup := func(key string) (string, bool) {
+		if val, ok := os.LookupEnv(key); ok {
+			return val, true
+		}
+		val, ok := fileVals[key]
+		return val, ok
+	}
 
 	// Start with the default values.
 	cfg := Config{
 		AccountsHost:      defaultAccountsHost,
 		AccountsPort:      defaultAccountsPort,
+		AccountsTimeout:   defaultAccountsTimeout,
 		DBCredentials:     database.DBCredentials{},
+		DBMaxDocSize:      database.DefaultMaxDocSize,
+		DBOpTimeout:       database.MongoDefaultTimeout,
+		DBSlowOpThreshold: database.DefaultSlowOpThreshold,
 		LogFile:           defaultLogFile,
 		LogLevel:          defaultLogLevel,
 		MinPinners:        defaultMinPinners,
 		SiaAPIHost:        defaultSiaAPIHost,
 		SiaAPIPort:        defaultSiaAPIPort,
+		SiaAPIScheme:      defaultSiaAPIScheme,
+		SkydRetries:       defaultSkydRetries,
+		SkydTimeout:       defaultSkydTimeout,
 		SleepBetweenScans: 0, // This will be ignored by the scanner.
+
+		CacheRebuildWorkers:    defaultCacheWorkers,
+		DBReportingReadPref:    readpref.SecondaryPreferredMode,
+		DriftReportInterval:    defaultDriftReportInterval,
+		SkydUnpinConcurrency:   defaultSkydUnpinConcurrency,
+		SweepMaxRemovalPercent: defaultSweepMaxRemovalPercent,
 	}
 
 	var ok bool
 	var val string
 
 	// Required
-	if cfg.ServerName, ok = os.LookupEnv("SERVER_DOMAIN"); !ok {
-		return Config{}, errors.New("missing env var SERVER_DOMAIN")
+	if cfg.ServerName, ok = lookup("SERVER_DOMAIN"); !ok {
+		return Config{}, nil, errors.New("missing env var SERVER_DOMAIN")
 	}
-	if cfg.DBCredentials.User, ok = os.LookupEnv("SKYNET_DB_USER"); !ok {
-		return Config{}, errors.New("missing env var SKYNET_DB_USER")
+	// The server name ends up in the database, so a stray space or a
+	// capital letter would split the server in two.
+	cfg.ServerName = database.NormalizeServerName(cfg.ServerName)
+	if err := database.ValidateServerName(cfg.ServerName); err != nil {
+		return Config{}, nil, errors.AddContext(err, "invalid env var SERVER_DOMAIN")
 	}
-	if cfg.DBCredentials.Password, ok = os.LookupEnv("SKYNET_DB_PASS"); !ok {
-		return Config{}, errors.New("missing env var SKYNET_DB_PASS")
+	// The DB's connection string overrides the individual DB variables, so
+	// they are only required when it's missing. The user and password still
+	// apply if the connection string holds no credentials.
+	cfg.DBCredentials.URI, _ = lookup("SKYNET_DB_URI")
+	uriSet := cfg.DBCredentials.URI != ""
+	if cfg.DBCredentials.User, ok = lookup("SKYNET_DB_USER"); !ok && !uriSet {
+		return Config{}, nil, errors.New("missing env var SKYNET_DB_USER")
 	}
-	if cfg.DBCredentials.Host, ok = os.LookupEnv("SKYNET_DB_HOST"); !ok {
-		return Config{}, errors.New("missing env var SKYNET_DB_HOST")
+	if cfg.DBCredentials.Password, ok = lookup("SKYNET_DB_PASS"); !ok && !uriSet {
+		return Config{}, nil, errors.New("missing env var SKYNET_DB_PASS")
 	}
-	if cfg.DBCredentials.Port, ok = os.LookupEnv("SKYNET_DB_PORT"); !ok {
-		return Config{}, errors.New("missing env var SKYNET_DB_PORT")
+	if cfg.DBCredentials.Host, ok = lookup("SKYNET_DB_HOST"); !ok && !uriSet {
+		return Config{}, nil, errors.New("missing env var SKYNET_DB_HOST")
 	}
-	if cfg.SiaAPIPassword, ok = os.LookupEnv("SIA_API_PASSWORD"); !ok {
-		return Config{}, errors.New("missing env var SIA_API_PASSWORD")
+	if cfg.DBCredentials.Port, ok = lookup("SKYNET_DB_PORT"); !ok && !uriSet {
+		return Config{}, nil, errors.New("missing env var SKYNET_DB_PORT")
+	}
+	if cfg.SiaAPIPassword, ok = lookup("SIA_API_PASSWORD"); !ok {
+		return Config{}, nil, errors.New("missing env var SIA_API_PASSWORD")
 	}
 
 	// Optional
-	if val, ok = os.LookupEnv("SKYNET_ACCOUNTS_HOST"); ok {
+	if val, ok = lookup("SKYNET_ACCOUNTS_HOST"); ok {
 		cfg.AccountsHost = val
 	}
-	if val, ok = os.LookupEnv("SKYNET_ACCOUNTS_PORT"); ok {
+	if val, ok = lookup("SKYNET_ACCOUNTS_PORT"); ok {
 		cfg.AccountsPort = val
 	}
-	if val, ok = os.LookupEnv("PINNER_LOG_FILE"); ok {
+	if val, ok = lookup("PINNER_ACCOUNTS_HOOK_SECRET"); ok {
+		cfg.AccountsHookSecret = val
+	}
+	if val, ok = lookup("PINNER_ACCOUNTS_TIMEOUT"); ok {
+		// Check for a bare number and interpret that as seconds.
+		if _, err := strconv.ParseInt(val, 0, 0); err == nil {
+			val += "s"
+		}
+		dur, err := time.ParseDuration(val)
+		if err != nil || dur < 0 {
+			return Config{}, nil, fmt.Errorf("PINNER_ACCOUNTS_TIMEOUT has an invalid value of '%s'", val)
+		}
+		cfg.AccountsTimeout = dur
+	}
+	if val, ok = lookup("PINNER_ACCOUNTS_TOKEN"); ok {
+		cfg.AccountsToken = val
+	}
+	if val, ok = lookup("PINNER_CACHE_REBUILD_WORKERS"); ok {
+		workers, err := strconv.Atoi(val)
+		if err != nil || workers < 1 {
+			return Config{}, nil, fmt.Errorf("PINNER_CACHE_REBUILD_WORKERS has an invalid value of '%s', expected a positive number", val)
+		}
+		cfg.CacheRebuildWorkers = workers
+	}
+	if val, ok = lookup("PINNER_ALERT_WEBHOOK_URL"); ok {
+		cfg.AlertWebhookURL = val
+	}
+	if val, ok = lookup("PINNER_DB_MAX_CONN_IDLE_TIME"); ok {
+		dur, err := time.ParseDuration(val)
+		if err != nil || dur < 0 {
+			return Config{}, nil, fmt.Errorf("PINNER_DB_MAX_CONN_IDLE_TIME has an invalid value of '%s'", val)
+		}
+		cfg.DBMaxConnIdleTime = dur
+	}
+	if val, ok = lookup("PINNER_DB_MAX_DOC_SIZE"); ok {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 || size > maxDocSize {
+			return Config{}, nil, fmt.Errorf("PINNER_DB_MAX_DOC_SIZE has an invalid value of '%s', expected a number of bytes between 0 and %d", val, maxDocSize)
+		}
+		cfg.DBMaxDocSize = size
+	}
+	if val, ok = lookup("PINNER_DB_MAX_POOL_SIZE"); ok {
+		size, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("PINNER_DB_MAX_POOL_SIZE has an invalid value of '%s', expected a non-negative number", val)
+		}
+		cfg.DBMaxPoolSize = size
+	}
+	if val, ok = lookup("PINNER_DB_MIN_POOL_SIZE"); ok {
+		size, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("PINNER_DB_MIN_POOL_SIZE has an invalid value of '%s', expected a non-negative number", val)
+		}
+		cfg.DBMinPoolSize = size
+	}
+	if cfg.DBMaxPoolSize > 0 && cfg.DBMinPoolSize > cfg.DBMaxPoolSize {
+		return Config{}, nil, fmt.Errorf("PINNER_DB_MIN_POOL_SIZE (%d) can't be larger than PINNER_DB_MAX_POOL_SIZE (%d)", cfg.DBMinPoolSize, cfg.DBMaxPoolSize)
+	}
+	if val, ok = lookup("PINNER_DB_OP_TIMEOUT"); ok {
+		dur, err := time.ParseDuration(val)
+		if err != nil || dur < 0 {
+			return Config{}, nil, fmt.Errorf("PINNER_DB_OP_TIMEOUT has an invalid value of '%s'", val)
+		}
+		cfg.DBOpTimeout = dur
+	}
+	if val, ok = lookup("PINNER_DB_REPORTING_READ_PREF"); ok {
+		mode, err := readpref.ModeFromString(val)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("PINNER_DB_REPORTING_READ_PREF has an invalid value of '%s', expected one of primary, primaryPreferred, secondary, secondaryPreferred or nearest", val)
+		}
+		cfg.DBReportingReadPref = mode
+	}
+	if val, ok = lookup("PINNER_DB_SLOW_OP_THRESHOLD"); ok {
+		dur, err := time.ParseDuration(val)
+		if err != nil || dur < 0 {
+			return Config{}, nil, fmt.Errorf("PINNER_DB_SLOW_OP_THRESHOLD has an invalid value of '%s'", val)
+		}
+		cfg.DBSlowOpThreshold = dur
+	}
+	if val, ok = lookup("PINNER_DB_UNDERPINNED_HINT"); ok {
+		cfg.DBUnderpinnedHint = val
+	}
+	if val, ok = lookup("PINNER_DRIFT_REPORT_INTERVAL"); ok {
+		dur, err := time.ParseDuration(val)
+		if err != nil || dur < 0 {
+			return Config{}, nil, fmt.Errorf("PINNER_DRIFT_REPORT_INTERVAL has an invalid value of '%s'", val)
+		}
+		cfg.DriftReportInterval = dur
+	}
+	if val, ok = lookup("PINNER_JWT_CLAIM"); ok {
+		cfg.JWTClaim = val
+	}
+	if val, ok = lookup("PINNER_JWT_CLAIM_MIN"); ok {
+		min, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("PINNER_JWT_CLAIM_MIN has an invalid value of '%s', expected a number", val)
+		}
+		cfg.JWTClaimMin = min
+	} else if cfg.JWTClaim != "" {
+		return Config{}, nil, errors.New("PINNER_JWT_CLAIM requires PINNER_JWT_CLAIM_MIN")
+	}
+	if val, ok = lookup("PINNER_LOG_FILE"); ok {
 		cfg.LogFile = val
 	}
-	if val, ok = os.LookupEnv("PINNER_LOG_LEVEL"); ok {
+	if val, ok = lookup("PINNER_LOG_LEVEL"); ok {
 		lvl, err := logrus.ParseLevel(val)
 		if err != nil {
-			log.Fatalf("PINNER_LOG_LEVEL has an invalid value of '%s'", val)
+			return Config{}, nil, fmt.Errorf("PINNER_LOG_LEVEL has an invalid value of '%s'", val)
 		}
 		cfg.LogLevel = lvl
 	}
-	if val, ok = os.LookupEnv("PINNER_SLEEP_BETWEEN_SCANS"); ok {
+	if val, ok = lookup("PINNER_SKYD_READ_RATE"); ok {
+		rate, err := strconv.ParseFloat(val, 64)
+		if err != nil || rate < 0 {
+			return Config{}, nil, fmt.Errorf("PINNER_SKYD_READ_RATE has an invalid value of '%s', expected a non-negative number", val)
+		}
+		cfg.SkydReadRate = rate
+	}
+	if val, ok = lookup("PINNER_SKYD_RETRIES"); ok {
+		retries, err := strconv.Atoi(val)
+		if err != nil || retries < 0 {
+			return Config{}, nil, fmt.Errorf("PINNER_SKYD_RETRIES has an invalid value of '%s', expected a non-negative number", val)
+		}
+		cfg.SkydRetries = retries
+	}
+	if val, ok = lookup("PINNER_SKYD_TIMEOUT"); ok {
+		// Check for a bare number and interpret that as seconds.
+		if _, err := strconv.ParseInt(val, 0, 0); err == nil {
+			val += "s"
+		}
+		dur, err := time.ParseDuration(val)
+		if err != nil || dur < 0 {
+			return Config{}, nil, fmt.Errorf("PINNER_SKYD_TIMEOUT has an invalid value of '%s'", val)
+		}
+		cfg.SkydTimeout = dur
+	}
+	if val, ok = lookup("PINNER_SKYD_UNPIN_CONCURRENCY"); ok {
+		concurrency, err := strconv.Atoi(val)
+		if err != nil || concurrency < 1 {
+			return Config{}, nil, fmt.Errorf("PINNER_SKYD_UNPIN_CONCURRENCY has an invalid value of '%s', expected a positive number", val)
+		}
+		cfg.SkydUnpinConcurrency = concurrency
+	}
+	if val, ok = lookup("PINNER_SKYD_VERIFY_PINS"); ok {
+		verify, err := strconv.ParseBool(val)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("PINNER_SKYD_VERIFY_PINS has an invalid value of '%s'", val)
+		}
+		cfg.SkydVerifyPins = verify
+	}
+	if val, ok = lookup("PINNER_SKYD_WRITE_RATE"); ok {
+		rate, err := strconv.ParseFloat(val, 64)
+		if err != nil || rate < 0 {
+			return Config{}, nil, fmt.Errorf("PINNER_SKYD_WRITE_RATE has an invalid value of '%s', expected a non-negative number", val)
+		}
+		cfg.SkydWriteRate = rate
+	}
+	if val, ok = lookup("PINNER_SLEEP_BETWEEN_SCANS"); ok {
 		// Check for a bare number and interpret that as seconds.
 		if _, err := strconv.ParseInt(val, 0, 0); err == nil {
 			val += "s"
 		}
 		dur, err := time.ParseDuration(val)
 		if err != nil {
-			log.Fatalf("PINNER_SLEEP_BETWEEN_SCANS has an invalid value of '%s'", val)
+			return Config{}, nil, fmt.Errorf("PINNER_SLEEP_BETWEEN_SCANS has an invalid value of '%s'", val)
 		}
 		cfg.SleepBetweenScans = dur
 	}
-	if val, ok = os.LookupEnv("API_HOST"); ok {
+	if val, ok = lookup("PINNER_SWEEP_TIME_OF_DAY"); ok {
+		if _, err := ParseTimeOfDay(val); err != nil {
+			return Config{}, nil, fmt.Errorf("PINNER_SWEEP_TIME_OF_DAY has an invalid value of '%s', expected format HH:MM", val)
+		}
+		cfg.SweepTimeOfDay = val
+	}
+	if val, ok = lookup("PINNER_SWEEP_UNPIN"); ok {
+		unpin, err := strconv.ParseBool(val)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("PINNER_SWEEP_UNPIN has an invalid value of '%s'", val)
+		}
+		cfg.SweepUnpin = unpin
+	}
+	if val, ok = lookup("PINNER_SWEEP_MAX_REMOVAL_PERCENT"); ok {
+		pct, err := strconv.Atoi(val)
+		if err != nil || pct < 0 || pct > 100 {
+			return Config{}, nil, fmt.Errorf("PINNER_SWEEP_MAX_REMOVAL_PERCENT has an invalid value of '%s', expected a number between 0 and 100", val)
+		}
+		cfg.SweepMaxRemovalPercent = pct
+	}
+	if val, ok = lookup("API_HOST"); ok {
 		cfg.SiaAPIHost = val
 	}
-	if val, ok = os.LookupEnv("API_PORT"); ok {
+	if val, ok = lookup("API_PORT"); ok {
 		cfg.SiaAPIPort = val
 	}
+	if val, ok = lookup("SIA_API_SCHEME"); ok {
+		if val != "http" && val != "https" {
+			return Config{}, nil, fmt.Errorf("SIA_API_SCHEME has an invalid value of '%s', expected 'http' or 'https'", val)
+		}
+		cfg.SiaAPIScheme = val
+	}
+	if val, ok = lookup("SIA_API_CA_CERT"); ok && val != "" {
+		if cfg.SiaAPIScheme != "https" {
+			return Config{}, nil, errors.New("SIA_API_CA_CERT can only be used with SIA_API_SCHEME set to 'https'")
+		}
+		// Fail early if we can't read the file. The skyd client parses it.
+		if _, err := os.ReadFile(val); err != nil {
+			return Config{}, nil, errors.AddContext(err, fmt.Sprintf("failed to read the SIA_API_CA_CERT file '%s'", val))
+		}
+		cfg.SiaAPICACert = val
+	}
+	cfg.Sources = configSources(fileVals)
 
-	return cfg, nil
+	return cfg, unknown, nil
+}
+
+// loadDotEnv loads the variables from the .env file into the environment. The
+// variables the process started with take precedence. Loading the file again
+// picks up the changes to it, including the variables removed from it. If we
+// fail to read the file, we keep the variables we loaded from it before.
+func loadDotEnv() {
+	dotEnvMu.Lock()
+	defer dotEnvMu.Unlock()
+	if processEnv == nil {
+		processEnv = make(map[string]struct{})
+		for _, kv := range os.Environ() {
+			processEnv[strings.SplitN(kv, "=", 2)[0]] = struct{}{}
+		}
+	}
+	vals, err := godotenv.Read()
+	if err != nil {
+		return
+	}
+	for key := range dotEnvVars {
+		if _, exists := vals[key]; !exists {
+			_ = os.Unsetenv(key)
+			delete(dotEnvVars, key)
+		}
+	}
+	for key, val := range vals {
+		if _, exists := processEnv[key]; exists {
+			continue
+		}
+		_ = os.Setenv(key, val)
+		dotEnvVars[key] = struct{}{}
+	}
+}
+
+// SleepBetweenScansBounds returns the time between scans the scanner uses when
+// it's configured with the given one, together with the bounds of its random
+// variation. A value of zero or less means the default.
+func SleepBetweenScansBounds(configured time.Duration) (sleep, lower, upper time.Duration) {
+	sleep = configured
+	if sleep <= 0 {
+		sleep = DefaultSleepBetweenScans
+	}
+	variation := time.Duration(float64(sleep) * SleepVariationFactor)
+	return sleep, sleep - variation, sleep + variation
+}
+
+// ParseTimeOfDay parses a time of day in the "15:04" format and returns it
+// as an offset from midnight.
+func ParseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse(timeOfDayFormat, s)
+	if err != nil {
+		return 0, errors.AddContext(err, "invalid time of day, expected format HH:MM")
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
 }
 
 // DryRun returns the cluster-wide value of the dry_run switch. This switch
 // tells Pinner to omit the pin/unpin calls to skyd and assume they were
 // successful.
 func DryRun(ctx context.Context, db *database.DB) (bool, error) {
-	val, err := db.ConfigValue(ctx, ConfDryRun)
+	return db.ConfigValueBool(ctx, ConfDryRun, false)
+}
+
+// DryRunForServer returns the value of the dry_run switch for the given
+// server. Its own value takes precedence over the cluster-wide one, so we
+// can dry-run a single server, e.g. a new one we don't trust yet.
+func DryRunForServer(ctx context.Context, db *database.DB, server string) (bool, error) {
+	key := DryRunKey(server)
+	val, err := db.ConfigValue(ctx, key)
 	if errors.Contains(err, mongo.ErrNoDocuments) {
-		return false, nil
+		return DryRun(ctx, db)
 	}
 	if err != nil {
 		return false, err
 	}
-	dr, err := strconv.ParseBool(val)
-	if err != nil {
-		return false, err
-	}
-	return dr, nil
+	return database.ParseConfigBool(key, val)
+}
+
+// DryRunKey returns the name of the configuration setting which overrides the
+// cluster-wide dry_run switch for the given server, e.g. "dry_run.server1".
+func DryRunKey(server string) string {
+	return ConfDryRun + "." + server
+}
+
+// IsDryRunKey returns true if the given key is the name of the cluster-wide
+// dry_run switch or of a server's override of it.
+func IsDryRunKey(key string) bool {
+	return key == ConfDryRun || strings.HasPrefix(key, ConfDryRun+".")
+}
+
+// LazyPinning returns the cluster-wide value of the lazy_pinning switch. This
+// switch tells Pinner whether to pin skylinks lazily. It defaults to true.
+func LazyPinning(ctx context.Context, db *database.DB) (bool, error) {
+	return db.ConfigValueBool(ctx, ConfLazyPinning, true)
+}
+
+// LockDuration returns the cluster-wide duration of the locks we put on
+// skylinks while we are trying to pin them. It defaults to
+// database.DefaultLockDuration.
+func LockDuration(ctx context.Context, db *database.DB) (time.Duration, error) {
+	return db.ConfigValueDuration(ctx, ConfLockDuration, database.DefaultLockDuration, minLockDuration, maxLockDuration)
 }
 
 // MinPinners returns the cluster-wide value of the minimum number of servers we
 // expect to be pinning each skylink.
 func MinPinners(ctx context.Context, db *database.DB) (int, error) {
-	val, err := db.ConfigValue(ctx, ConfMinPinners)
+	mp, err := db.ConfigValueInt(ctx, ConfMinPinners, defaultMinPinners, minPinnersMinValue, maxPinnersMinValue)
+	if errors.Contains(err, database.ErrInvalidConfigValue) {
+		build.Critical(errors.AddContext(err, "invalid database configuration"))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return mp, nil
+}
+
+// DeletedRetention returns the cluster-wide duration for which we keep the
+// soft-deleted skylinks before we remove them for good. It's zero if we don't
+// remove them.
+func DeletedRetention(ctx context.Context, db *database.DB) (time.Duration, error) {
+	val, err := db.ConfigValue(ctx, ConfDeletedRetention)
 	if errors.Contains(err, mongo.ErrNoDocuments) {
-		return defaultMinPinners, nil
+		return defaultDeletedRetention, nil
 	}
 	if err != nil {
 		return 0, err
 	}
-	mp, err := strconv.ParseInt(val, 10, 0)
+	return parseDeletedRetention(val)
+}
+
+// UnpinnedRetention returns the cluster-wide duration for which we keep the
+// skylinks which have been unpinned and which no server pins anymore. It's zero
+// if we don't delete them.
+func UnpinnedRetention(ctx context.Context, db *database.DB) (time.Duration, error) {
+	val, err := db.ConfigValue(ctx, ConfUnpinnedRetention)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return defaultUnpinnedRetention, nil
+	}
 	if err != nil {
 		return 0, err
 	}
-	if mp < minPinnersMinValue || mp > maxPinnersMinValue {
-		errMsg := fmt.Sprintf("Invalid min_pinners value in database configuration! The value must be between %d and %d, it was %v.", mp, minPinnersMinValue, maxPinnersMinValue)
-		build.Critical(errMsg)
-		return 0, errors.New(errMsg)
+	return parseUnpinnedRetention(val)
+}
+
+// parseDeletedRetention parses the given value of the deleted_retention
+// setting. Zero is allowed and disables the removal.
+func parseDeletedRetention(val string) (time.Duration, error) {
+	if d, err := time.ParseDuration(val); err == nil && d == 0 {
+		return 0, nil
+	}
+	return database.ParseConfigDuration(ConfDeletedRetention, val, minDeletedRetention, time.Duration(math.MaxInt64))
+}
+
+// parseLockDuration parses the given value of the lock_duration setting and
+// ensures that it's within bounds.
+func parseLockDuration(val string) (time.Duration, error) {
+	return database.ParseConfigDuration(ConfLockDuration, val, minLockDuration, maxLockDuration)
+}
+
+// parseUnpinnedRetention parses the given value of the unpinned_retention
+// setting. Zero is allowed and disables the deletion.
+func parseUnpinnedRetention(val string) (time.Duration, error) {
+	if d, err := time.ParseDuration(val); err == nil && d == 0 {
+		return 0, nil
 	}
-	return int(mp), nil
+	return database.ParseConfigDuration(ConfUnpinnedRetention, val, minUnpinnedRetention, time.Duration(math.MaxInt64))
 }
@@ -2,15 +2,28 @@ package conf
 
 import (
 	"encoding/hex"
+	"fmt"
 	"math"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/skynetlabs/pinner/database"
+	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
 )
 
+// requiredEnvValue returns a valid value for the given required env var.
+func requiredEnvValue(key string) string {
+	if key == "SERVER_DOMAIN" {
+		return "pinner.example.com"
+	}
+	return key + "value"
+}
+
 // TestLoadConfig ensures that LoadConfig works as expected.
 func TestLoadConfig(t *testing.T) {
 	envVarsReq := []string{
@@ -24,11 +37,38 @@ func TestLoadConfig(t *testing.T) {
 	envVarsOpt := []string{
 		"SKYNET_ACCOUNTS_HOST",
 		"SKYNET_ACCOUNTS_PORT",
+		"SKYNET_DB_URI",
+		"PINNER_ACCOUNTS_HOOK_SECRET",
+		"PINNER_ACCOUNTS_TIMEOUT",
+		"PINNER_ACCOUNTS_TOKEN",
+		"PINNER_ALERT_WEBHOOK_URL",
+		"PINNER_CACHE_REBUILD_WORKERS",
+		"PINNER_DB_MAX_CONN_IDLE_TIME",
+		"PINNER_DB_MAX_DOC_SIZE",
+		"PINNER_DB_MAX_POOL_SIZE",
+		"PINNER_DB_MIN_POOL_SIZE",
+		"PINNER_DB_OP_TIMEOUT",
+		"PINNER_DB_REPORTING_READ_PREF",
+		"PINNER_DB_SLOW_OP_THRESHOLD",
+		"PINNER_DB_UNDERPINNED_HINT",
+		"PINNER_DRIFT_REPORT_INTERVAL",
+		"PINNER_JWT_CLAIM",
+		"PINNER_JWT_CLAIM_MIN",
 		"PINNER_LOG_FILE",
 		"PINNER_LOG_LEVEL",
+		"PINNER_SKYD_READ_RATE",
+		"PINNER_SKYD_RETRIES",
+		"PINNER_SKYD_TIMEOUT",
+		"PINNER_SKYD_VERIFY_PINS",
+		"PINNER_SKYD_WRITE_RATE",
 		"PINNER_SLEEP_BETWEEN_SCANS",
+		"PINNER_SWEEP_TIME_OF_DAY",
+		"PINNER_SWEEP_UNPIN",
+		"PINNER_SWEEP_MAX_REMOVAL_PERCENT",
 		"API_HOST",
 		"API_PORT",
+		"SIA_API_SCHEME",
+		"SIA_API_CA_CERT",
 	}
 	envVars := append(envVarsReq, envVarsOpt...)
 	// Store all env var values.
@@ -42,7 +82,7 @@ func TestLoadConfig(t *testing.T) {
 	// Set all required vars, so the test will pass even if the environment is
 	// not fully set.
 	for _, key := range envVarsReq {
-		err := os.Setenv(key, key+"value")
+		err := os.Setenv(key, requiredEnvValue(key))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -72,7 +112,7 @@ func TestLoadConfig(t *testing.T) {
 		}
 	}(values)
 	// Get the values without setting any optionals.
-	cfg, err := LoadConfig()
+	cfg, _, err := LoadConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -102,21 +142,69 @@ func TestLoadConfig(t *testing.T) {
 	if cfg.AccountsPort != defaultAccountsPort {
 		t.Fatal("Bad AccountsPort")
 	}
+	if cfg.AccountsTimeout != defaultAccountsTimeout || cfg.AccountsToken != "" || cfg.AccountsHookSecret != "" {
+		t.Fatal("Bad AccountsTimeout, AccountsToken or AccountsHookSecret")
+	}
 	if cfg.LogFile != defaultLogFile {
 		t.Fatal("Bad LogFile")
 	}
 	if cfg.LogLevel != defaultLogLevel {
 		t.Fatal("Bad LogLevel")
 	}
+	if cfg.CacheRebuildWorkers != defaultCacheWorkers {
+		t.Fatal("Bad CacheRebuildWorkers")
+	}
+	if cfg.DBMaxConnIdleTime != 0 || cfg.DBMaxPoolSize != 0 || cfg.DBMinPoolSize != 0 {
+		t.Fatal("Bad DBMaxConnIdleTime, DBMaxPoolSize or DBMinPoolSize")
+	}
+	if cfg.SkydRetries != defaultSkydRetries {
+		t.Fatal("Bad SkydRetries")
+	}
+	if cfg.SkydTimeout != defaultSkydTimeout {
+		t.Fatal("Bad SkydTimeout")
+	}
+	if cfg.SkydVerifyPins {
+		t.Fatal("Bad SkydVerifyPins")
+	}
+	if cfg.SkydReadRate != 0 || cfg.SkydWriteRate != 0 {
+		t.Fatal("Bad SkydReadRate or SkydWriteRate")
+	}
 	if cfg.SleepBetweenScans != 0 {
 		t.Fatal("Bad SleepBetweenScans")
 	}
+	if cfg.SweepTimeOfDay != "" {
+		t.Fatal("Bad SweepTimeOfDay")
+	}
+	if cfg.SweepUnpin {
+		t.Fatal("Bad SweepUnpin")
+	}
+	if cfg.SweepMaxRemovalPercent != defaultSweepMaxRemovalPercent {
+		t.Fatal("Bad SweepMaxRemovalPercent")
+	}
+	if cfg.AlertWebhookURL != "" {
+		t.Fatal("Bad AlertWebhookURL")
+	}
+	if cfg.DBUnderpinnedHint != "" {
+		t.Fatal("Bad DBUnderpinnedHint")
+	}
+	if cfg.DriftReportInterval != defaultDriftReportInterval {
+		t.Fatal("Bad DriftReportInterval")
+	}
+	if cfg.JWTClaim != "" || cfg.JWTClaimMin != 0 {
+		t.Fatal("Bad JWTClaim or JWTClaimMin")
+	}
+	if cfg.DBCredentials.URI != "" {
+		t.Fatal("Bad DBCredentials.URI")
+	}
 	if cfg.SiaAPIHost != defaultSiaAPIHost {
 		t.Fatal("Bad SiaAPIHost")
 	}
 	if cfg.SiaAPIPort != defaultSiaAPIPort {
 		t.Fatal("Bad SiaAPIPort")
 	}
+	if cfg.SiaAPIScheme != defaultSiaAPIScheme || cfg.SiaAPICACert != "" {
+		t.Fatal("Bad SiaAPIScheme or SiaAPICACert")
+	}
 
 	// Set the optionals to custom values.
 	optionalValues := make(map[string]string)
@@ -127,13 +215,124 @@ func TestLoadConfig(t *testing.T) {
 			t.Fatal(err)
 		}
 	}
-	// We'll set a special value for PINNER_SLEEP_BETWEEN_SCANS and
-	// PINNER_LOG_LEVEL because they need to have valid values.
+	// We'll set a special value for PINNER_ACCOUNTS_TIMEOUT,
+	// PINNER_CACHE_REBUILD_WORKERS, PINNER_DB_MAX_CONN_IDLE_TIME,
+	// PINNER_DB_MAX_DOC_SIZE,
+	// PINNER_DB_MAX_POOL_SIZE, PINNER_DB_MIN_POOL_SIZE, PINNER_DB_OP_TIMEOUT,
+	// PINNER_DB_REPORTING_READ_PREF, PINNER_DB_SLOW_OP_THRESHOLD,
+	// PINNER_DRIFT_REPORT_INTERVAL, PINNER_JWT_CLAIM_MIN, PINNER_SKYD_READ_RATE, PINNER_SKYD_RETRIES, PINNER_SKYD_TIMEOUT,
+	// PINNER_SKYD_VERIFY_PINS, PINNER_SKYD_WRITE_RATE,
+	// PINNER_SLEEP_BETWEEN_SCANS, PINNER_SWEEP_TIME_OF_DAY, PINNER_SWEEP_UNPIN,
+	// PINNER_SWEEP_MAX_REMOVAL_PERCENT and PINNER_LOG_LEVEL because they need
+	// to have valid values.
+	optionalValues["PINNER_ACCOUNTS_TIMEOUT"] = time.Duration(fastrand.Intn(math.MaxInt)).String()
+	err = os.Setenv("PINNER_ACCOUNTS_TIMEOUT", optionalValues["PINNER_ACCOUNTS_TIMEOUT"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_CACHE_REBUILD_WORKERS"] = fmt.Sprint(fastrand.Intn(16) + 1)
+	err = os.Setenv("PINNER_CACHE_REBUILD_WORKERS", optionalValues["PINNER_CACHE_REBUILD_WORKERS"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_DB_MAX_CONN_IDLE_TIME"] = time.Duration(fastrand.Intn(math.MaxInt)).String()
+	err = os.Setenv("PINNER_DB_MAX_CONN_IDLE_TIME", optionalValues["PINNER_DB_MAX_CONN_IDLE_TIME"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_DB_MAX_DOC_SIZE"] = fmt.Sprint(fastrand.Intn(16 << 20))
+	err = os.Setenv("PINNER_DB_MAX_DOC_SIZE", optionalValues["PINNER_DB_MAX_DOC_SIZE"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	minPool := fastrand.Intn(10)
+	optionalValues["PINNER_DB_MIN_POOL_SIZE"] = fmt.Sprint(minPool)
+	err = os.Setenv("PINNER_DB_MIN_POOL_SIZE", optionalValues["PINNER_DB_MIN_POOL_SIZE"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_DB_MAX_POOL_SIZE"] = fmt.Sprint(minPool + fastrand.Intn(100) + 1)
+	err = os.Setenv("PINNER_DB_MAX_POOL_SIZE", optionalValues["PINNER_DB_MAX_POOL_SIZE"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"PINNER_DB_OP_TIMEOUT", "PINNER_DB_SLOW_OP_THRESHOLD", "PINNER_DRIFT_REPORT_INTERVAL"} {
+		optionalValues[key] = (time.Duration(fastrand.Intn(600)) * time.Second).String()
+		err = os.Setenv(key, optionalValues[key])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	readPrefs := []string{"primary", "primaryPreferred", "secondary", "secondaryPreferred", "nearest"}
+	optionalValues["PINNER_DB_REPORTING_READ_PREF"] = readPrefs[fastrand.Intn(len(readPrefs))]
+	err = os.Setenv("PINNER_DB_REPORTING_READ_PREF", optionalValues["PINNER_DB_REPORTING_READ_PREF"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_JWT_CLAIM_MIN"] = fmt.Sprint(fastrand.Intn(10))
+	err = os.Setenv("PINNER_JWT_CLAIM_MIN", optionalValues["PINNER_JWT_CLAIM_MIN"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_SKYD_READ_RATE"] = fmt.Sprint(float64(fastrand.Intn(1000)) / 10)
+	err = os.Setenv("PINNER_SKYD_READ_RATE", optionalValues["PINNER_SKYD_READ_RATE"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_SKYD_WRITE_RATE"] = fmt.Sprint(float64(fastrand.Intn(1000)) / 10)
+	err = os.Setenv("PINNER_SKYD_WRITE_RATE", optionalValues["PINNER_SKYD_WRITE_RATE"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_SKYD_RETRIES"] = fmt.Sprint(fastrand.Intn(10))
+	err = os.Setenv("PINNER_SKYD_RETRIES", optionalValues["PINNER_SKYD_RETRIES"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_SKYD_TIMEOUT"] = time.Duration(fastrand.Intn(math.MaxInt)).String()
+	err = os.Setenv("PINNER_SKYD_TIMEOUT", optionalValues["PINNER_SKYD_TIMEOUT"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_SKYD_VERIFY_PINS"] = "true"
+	err = os.Setenv("PINNER_SKYD_VERIFY_PINS", optionalValues["PINNER_SKYD_VERIFY_PINS"])
+	if err != nil {
+		t.Fatal(err)
+	}
 	optionalValues["PINNER_SLEEP_BETWEEN_SCANS"] = time.Duration(fastrand.Intn(math.MaxInt)).String()
 	err = os.Setenv("PINNER_SLEEP_BETWEEN_SCANS", optionalValues["PINNER_SLEEP_BETWEEN_SCANS"])
 	if err != nil {
 		t.Fatal(err)
 	}
+	optionalValues["PINNER_SWEEP_TIME_OF_DAY"] = fmt.Sprintf("%02d:%02d", fastrand.Intn(24), fastrand.Intn(60))
+	err = os.Setenv("PINNER_SWEEP_TIME_OF_DAY", optionalValues["PINNER_SWEEP_TIME_OF_DAY"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_SWEEP_UNPIN"] = "true"
+	err = os.Setenv("PINNER_SWEEP_UNPIN", optionalValues["PINNER_SWEEP_UNPIN"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["PINNER_SWEEP_MAX_REMOVAL_PERCENT"] = fmt.Sprint(fastrand.Intn(101))
+	err = os.Setenv("PINNER_SWEEP_MAX_REMOVAL_PERCENT", optionalValues["PINNER_SWEEP_MAX_REMOVAL_PERCENT"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["SIA_API_SCHEME"] = "https"
+	err = os.Setenv("SIA_API_SCHEME", optionalValues["SIA_API_SCHEME"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionalValues["SIA_API_CA_CERT"] = filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(optionalValues["SIA_API_CA_CERT"], []byte("certificates"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv("SIA_API_CA_CERT", optionalValues["SIA_API_CA_CERT"])
+	if err != nil {
+		t.Fatal(err)
+	}
 	// Random log level between 0 (Panic) and 7 (Trace).
 	optionalValues["PINNER_LOG_LEVEL"] = logrus.Level(fastrand.Intn(int(logrus.TraceLevel) + 1)).String()
 	err = os.Setenv("PINNER_LOG_LEVEL", optionalValues["PINNER_LOG_LEVEL"])
@@ -141,7 +340,7 @@ func TestLoadConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Load the config again.
-	cfg, err = LoadConfig()
+	cfg, _, err = LoadConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -152,19 +351,474 @@ func TestLoadConfig(t *testing.T) {
 	if cfg.AccountsPort != optionalValues["SKYNET_ACCOUNTS_PORT"] {
 		t.Fatal("Bad AccountsPort")
 	}
+	if tm, err := time.ParseDuration(optionalValues["PINNER_ACCOUNTS_TIMEOUT"]); err != nil || cfg.AccountsTimeout != tm {
+		t.Fatal("Bad AccountsTimeout")
+	}
+	if cfg.AccountsToken != optionalValues["PINNER_ACCOUNTS_TOKEN"] {
+		t.Fatal("Bad AccountsToken")
+	}
+	if cfg.AccountsHookSecret != optionalValues["PINNER_ACCOUNTS_HOOK_SECRET"] {
+		t.Fatal("Bad AccountsHookSecret")
+	}
 	if cfg.LogFile != optionalValues["PINNER_LOG_FILE"] {
 		t.Fatal("Bad LogFile")
 	}
 	if cfg.LogLevel.String() != optionalValues["PINNER_LOG_LEVEL"] {
 		t.Fatal("Bad LogLevel")
 	}
+	if fmt.Sprint(cfg.CacheRebuildWorkers) != optionalValues["PINNER_CACHE_REBUILD_WORKERS"] {
+		t.Fatal("Bad CacheRebuildWorkers")
+	}
+	if tm, err := time.ParseDuration(optionalValues["PINNER_DB_MAX_CONN_IDLE_TIME"]); err != nil || cfg.DBMaxConnIdleTime != tm {
+		t.Fatal("Bad DBMaxConnIdleTime")
+	}
+	if fmt.Sprint(cfg.DBMaxDocSize) != optionalValues["PINNER_DB_MAX_DOC_SIZE"] {
+		t.Fatal("Bad DBMaxDocSize")
+	}
+	if fmt.Sprint(cfg.DBMaxPoolSize) != optionalValues["PINNER_DB_MAX_POOL_SIZE"] {
+		t.Fatal("Bad DBMaxPoolSize")
+	}
+	if fmt.Sprint(cfg.DBMinPoolSize) != optionalValues["PINNER_DB_MIN_POOL_SIZE"] {
+		t.Fatal("Bad DBMinPoolSize")
+	}
+	if cfg.DBOpTimeout.String() != optionalValues["PINNER_DB_OP_TIMEOUT"] {
+		t.Fatal("Bad DBOpTimeout")
+	}
+	if cfg.DBReportingReadPref.String() != optionalValues["PINNER_DB_REPORTING_READ_PREF"] {
+		t.Fatal("Bad DBReportingReadPref")
+	}
+	if cfg.DBSlowOpThreshold.String() != optionalValues["PINNER_DB_SLOW_OP_THRESHOLD"] {
+		t.Fatal("Bad DBSlowOpThreshold")
+	}
+	if cfg.DBUnderpinnedHint != optionalValues["PINNER_DB_UNDERPINNED_HINT"] {
+		t.Fatal("Bad DBUnderpinnedHint")
+	}
+	if cfg.DriftReportInterval.String() != optionalValues["PINNER_DRIFT_REPORT_INTERVAL"] {
+		t.Fatal("Bad DriftReportInterval")
+	}
+	if cfg.JWTClaim != optionalValues["PINNER_JWT_CLAIM"] || fmt.Sprint(cfg.JWTClaimMin) != optionalValues["PINNER_JWT_CLAIM_MIN"] {
+		t.Fatal("Bad JWTClaim or JWTClaimMin")
+	}
+	if cfg.DBCredentials.URI != optionalValues["SKYNET_DB_URI"] {
+		t.Fatal("Bad DBCredentials.URI")
+	}
+	if fmt.Sprint(cfg.SkydReadRate) != optionalValues["PINNER_SKYD_READ_RATE"] {
+		t.Fatal("Bad SkydReadRate")
+	}
+	if fmt.Sprint(cfg.SkydWriteRate) != optionalValues["PINNER_SKYD_WRITE_RATE"] {
+		t.Fatal("Bad SkydWriteRate")
+	}
+	if fmt.Sprint(cfg.SkydRetries) != optionalValues["PINNER_SKYD_RETRIES"] {
+		t.Fatal("Bad SkydRetries")
+	}
+	if tm, err := time.ParseDuration(optionalValues["PINNER_SKYD_TIMEOUT"]); err != nil || cfg.SkydTimeout != tm {
+		t.Fatal("Bad SkydTimeout")
+	}
+	if !cfg.SkydVerifyPins {
+		t.Fatal("Bad SkydVerifyPins")
+	}
 	if tm, err := time.ParseDuration(optionalValues["PINNER_SLEEP_BETWEEN_SCANS"]); err != nil || cfg.SleepBetweenScans != tm {
 		t.Fatal("Bad SleepBetweenScans")
 	}
+	if cfg.SweepTimeOfDay != optionalValues["PINNER_SWEEP_TIME_OF_DAY"] {
+		t.Fatal("Bad SweepTimeOfDay")
+	}
+	if !cfg.SweepUnpin {
+		t.Fatal("Bad SweepUnpin")
+	}
+	if fmt.Sprint(cfg.SweepMaxRemovalPercent) != optionalValues["PINNER_SWEEP_MAX_REMOVAL_PERCENT"] {
+		t.Fatal("Bad SweepMaxRemovalPercent")
+	}
+	if cfg.AlertWebhookURL != optionalValues["PINNER_ALERT_WEBHOOK_URL"] {
+		t.Fatal("Bad AlertWebhookURL")
+	}
 	if cfg.SiaAPIHost != optionalValues["API_HOST"] {
 		t.Fatal("Bad SiaAPIHost")
 	}
 	if cfg.SiaAPIPort != optionalValues["API_PORT"] {
 		t.Fatal("Bad SiaAPIPort")
 	}
+	if cfg.SiaAPIScheme != optionalValues["SIA_API_SCHEME"] {
+		t.Fatal("Bad SiaAPIScheme")
+	}
+	if cfg.SiaAPICACert != optionalValues["SIA_API_CA_CERT"] {
+		t.Fatal("Bad SiaAPICACert")
+	}
+}
+
+// TestLoadConfigDBPoolSize ensures that LoadConfig rejects a minimum pool size
+// which is larger than the maximum one.
+func TestLoadConfigDBPoolSize(t *testing.T) {
+	for _, key := range []string{"SERVER_DOMAIN", "SKYNET_DB_USER", "SKYNET_DB_PASS", "SKYNET_DB_HOST", "SKYNET_DB_PORT", "SIA_API_PASSWORD"} {
+		t.Setenv(key, requiredEnvValue(key))
+	}
+	tests := []struct {
+		min   string
+		max   string
+		valid bool
+	}{
+		{min: "0", max: "0", valid: true},
+		{min: "10", max: "0", valid: true},
+		{min: "5", max: "5", valid: true},
+		{min: "5", max: "10", valid: true},
+		{min: "11", max: "10"},
+	}
+	for _, tst := range tests {
+		t.Setenv("PINNER_DB_MIN_POOL_SIZE", tst.min)
+		t.Setenv("PINNER_DB_MAX_POOL_SIZE", tst.max)
+		_, _, err := LoadConfig()
+		if tst.valid && err != nil {
+			t.Fatalf("Expected min %s and max %s to be valid, got '%v'", tst.min, tst.max, err)
+		}
+		if !tst.valid && (err == nil || !strings.Contains(err.Error(), "can't be larger than")) {
+			t.Fatalf("Expected min %s and max %s to be rejected, got '%v'", tst.min, tst.max, err)
+		}
+	}
+}
+
+// TestLoadConfigServerName ensures that LoadConfig normalizes SERVER_DOMAIN and
+// rejects the names which are invalid once normalized.
+func TestLoadConfigServerName(t *testing.T) {
+	for _, key := range []string{"SKYNET_DB_USER", "SKYNET_DB_PASS", "SKYNET_DB_HOST", "SKYNET_DB_PORT", "SIA_API_PASSWORD"} {
+		t.Setenv(key, requiredEnvValue(key))
+	}
+	normalized := map[string]string{
+		"pinner.example.com":      "pinner.example.com",
+		" Pinner.Example.COM\n":   "pinner.example.com",
+		"\tEU-GER-1.siasky.net  ": "eu-ger-1.siasky.net",
+	}
+	for val, expected := range normalized {
+		t.Setenv("SERVER_DOMAIN", val)
+		cfg, _, err := LoadConfig()
+		if err != nil {
+			t.Fatalf("Expected '%s' to be valid, got '%v'", val, err)
+		}
+		if cfg.ServerName != expected {
+			t.Fatalf("Expected '%s' to become '%s', got '%s'", val, expected, cfg.ServerName)
+		}
+	}
+	for _, val := range []string{"", "  ", "eu_ger_1", "eu ger 1", "$first", "pinner.example.com/path"} {
+		t.Setenv("SERVER_DOMAIN", val)
+		_, _, err := LoadConfig()
+		if !errors.Contains(err, database.ErrInvalidServerName) || !strings.Contains(err.Error(), "SERVER_DOMAIN") {
+			t.Fatalf("Expected '%s' to be rejected, got '%v'", val, err)
+		}
+	}
+}
+
+// TestLoadConfigDBURI ensures that the individual DB variables are only
+// required when there is no DB connection string.
+func TestLoadConfigDBURI(t *testing.T) {
+	for _, key := range []string{"SERVER_DOMAIN", "SIA_API_PASSWORD"} {
+		t.Setenv(key, requiredEnvValue(key))
+	}
+	dbVars := []string{"SKYNET_DB_USER", "SKYNET_DB_PASS", "SKYNET_DB_HOST", "SKYNET_DB_PORT"}
+	for _, key := range dbVars {
+		// Setenv restores the original value at the end of the test.
+		t.Setenv(key, "")
+		err := os.Unsetenv(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("SKYNET_DB_URI", "")
+	_, _, err := LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "missing env var SKYNET_DB_USER") {
+		t.Fatalf("Expected a missing SKYNET_DB_USER, got '%v'", err)
+	}
+
+	uri := "mongodb://h1:27017,h2:27017/?replicaSet=rs0&authSource=admin"
+	t.Setenv("SKYNET_DB_URI", uri)
+	cfg, _, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DBCredentials.URI != uri || cfg.DBCredentials.User != "" || cfg.DBCredentials.Host != "" {
+		t.Fatalf("Unexpected DB credentials %+v", cfg.DBCredentials)
+	}
+	// The user and password are still picked up alongside the URI.
+	t.Setenv("SKYNET_DB_USER", "user")
+	t.Setenv("SKYNET_DB_PASS", "pass")
+	cfg, _, err = LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DBCredentials.User != "user" || cfg.DBCredentials.Password != "pass" {
+		t.Fatalf("Unexpected DB credentials %+v", cfg.DBCredentials)
+	}
+}
+
+// TestLoadConfigSiaAPITLS ensures that LoadConfig rejects invalid settings for
+// talking to skyd over HTTPS.
+func TestLoadConfigSiaAPITLS(t *testing.T) {
+	for _, key := range []string{"SERVER_DOMAIN", "SKYNET_DB_USER", "SKYNET_DB_PASS", "SKYNET_DB_HOST", "SKYNET_DB_PORT", "SIA_API_PASSWORD"} {
+		t.Setenv(key, requiredEnvValue(key))
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	tests := []struct {
+		name   string
+		scheme string
+		caCert string
+		errMsg string
+	}{
+		{name: "InvalidScheme", scheme: "ftp", errMsg: "SIA_API_SCHEME has an invalid value"},
+		{name: "CAWithoutHTTPS", scheme: "http", caCert: caFile, errMsg: "SIA_API_CA_CERT can only be used"},
+		{name: "UnreadableCA", scheme: "https", caCert: caFile, errMsg: "failed to read the SIA_API_CA_CERT file"},
+	}
+	for _, tst := range tests {
+		t.Setenv("SIA_API_SCHEME", tst.scheme)
+		t.Setenv("SIA_API_CA_CERT", tst.caCert)
+		_, _, err := LoadConfig()
+		if err == nil || !strings.Contains(err.Error(), tst.errMsg) {
+			t.Fatalf("%s: expected error '%s', got '%v'", tst.name, tst.errMsg, err)
+		}
+	}
+}
+
+// TestLoadConfigJWT ensures that LoadConfig requires a minimum value alongside
+// the JWT claim.
+func TestLoadConfigJWT(t *testing.T) {
+	for _, key := range []string{"SERVER_DOMAIN", "SKYNET_DB_USER", "SKYNET_DB_PASS", "SKYNET_DB_HOST", "SKYNET_DB_PORT", "SIA_API_PASSWORD"} {
+		t.Setenv(key, requiredEnvValue(key))
+	}
+	t.Setenv("PINNER_JWT_CLAIM", "tier")
+	t.Setenv("PINNER_JWT_CLAIM_MIN", "")
+	err := os.Unsetenv("PINNER_JWT_CLAIM_MIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "PINNER_JWT_CLAIM requires PINNER_JWT_CLAIM_MIN") {
+		t.Fatalf("Expected a missing PINNER_JWT_CLAIM_MIN, got '%v'", err)
+	}
+	t.Setenv("PINNER_JWT_CLAIM_MIN", "4")
+	cfg, _, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.JWTClaim != "tier" || cfg.JWTClaimMin != 4 {
+		t.Fatalf("Unexpected JWT claim '%s' >= %v", cfg.JWTClaim, cfg.JWTClaimMin)
+	}
+}
+
+// TestLoadConfigInvalid ensures that LoadConfig returns an error for invalid
+// values, so a reload with a bad value doesn't take the service down.
+func TestLoadConfigInvalid(t *testing.T) {
+	for _, key := range []string{"SERVER_DOMAIN", "SKYNET_DB_USER", "SKYNET_DB_PASS", "SKYNET_DB_HOST", "SKYNET_DB_PORT", "SIA_API_PASSWORD"} {
+		t.Setenv(key, requiredEnvValue(key))
+	}
+	invalid := map[string]string{
+		"PINNER_ACCOUNTS_TIMEOUT":    "-1s",
+		"PINNER_LOG_LEVEL":           "loud",
+		"PINNER_SLEEP_BETWEEN_SCANS": "often",
+		"PINNER_SWEEP_TIME_OF_DAY":   "25:00",
+	}
+	for key, val := range invalid {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, val)
+			_, _, err := LoadConfig()
+			if err == nil || !strings.Contains(err.Error(), key) {
+				t.Fatalf("Expected an error about %s, got '%v'", key, err)
+			}
+		})
+	}
+}
+
+// TestLoadConfigDotEnv ensures that LoadConfig picks up the changes to the .env
+// file when it's called again and that the variables the process started with
+// take precedence.
+func TestLoadConfigDotEnv(t *testing.T) {
+	for _, key := range []string{"SERVER_DOMAIN", "SKYNET_DB_USER", "SKYNET_DB_PASS", "SKYNET_DB_HOST", "SKYNET_DB_PORT", "SIA_API_PASSWORD"} {
+		t.Setenv(key, requiredEnvValue(key))
+	}
+	// godotenv reads the .env file in the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// Make sure the process' environment is recorded before we write the
+	// file.
+	_, _, err = LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := os.Getenv("HOME")
+	writeDotEnv := func(content string) {
+		if err := os.WriteFile(".env", []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeDotEnv("PINNER_LOG_LEVEL=debug\nHOME=/nowhere\n")
+	cfg, _, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != logrus.DebugLevel {
+		t.Fatalf("Expected log level %v, got %v", logrus.DebugLevel, cfg.LogLevel)
+	}
+	if os.Getenv("HOME") != home {
+		t.Fatal("Expected the process' environment to take precedence")
+	}
+
+	writeDotEnv("PINNER_LOG_LEVEL=warn\n")
+	cfg, _, err = LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != logrus.WarnLevel {
+		t.Fatalf("Expected log level %v, got %v", logrus.WarnLevel, cfg.LogLevel)
+	}
+
+	// Removing the variable from the file restores the default.
+	writeDotEnv("")
+	cfg, _, err = LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != defaultLogLevel {
+		t.Fatalf("Expected log level %v, got %v", defaultLogLevel, cfg.LogLevel)
+	}
+}
+
+// TestParseLockDuration ensures that we only accept lock durations within
+// bounds.
+func TestParseLockDuration(t *testing.T) {
+	tests := []struct {
+		val   string
+		d     time.Duration
+		valid bool
+	}{
+		{val: "1m", d: time.Minute, valid: true},
+		{val: "90m", d: 90 * time.Minute, valid: true},
+		{val: "168h", d: 7 * 24 * time.Hour, valid: true},
+		{val: "59s"},
+		{val: "169h"},
+		{val: "-1h"},
+		{val: "7"},
+		{val: ""},
+	}
+	for _, tst := range tests {
+		d, err := parseLockDuration(tst.val)
+		if tst.valid && (err != nil || d != tst.d) {
+			t.Fatalf("Expected '%s' to parse as %v, got %v and '%v'", tst.val, tst.d, d, err)
+		}
+		if !tst.valid && err == nil {
+			t.Fatalf("Expected '%s' to be rejected, got %v", tst.val, d)
+		}
+	}
+}
+
+// TestParseUnpinnedRetention ensures that we only accept retention periods
+// which are zero or long enough.
+func TestParseUnpinnedRetention(t *testing.T) {
+	tests := []struct {
+		val   string
+		d     time.Duration
+		valid bool
+	}{
+		{val: "0", valid: true},
+		{val: "0s", valid: true},
+		{val: "24h", d: 24 * time.Hour, valid: true},
+		{val: "2160h", d: 90 * 24 * time.Hour, valid: true},
+		{val: "23h59m"},
+		{val: "-1h"},
+		{val: "90"},
+		{val: ""},
+	}
+	for _, tst := range tests {
+		d, err := parseUnpinnedRetention(tst.val)
+		if tst.valid && (err != nil || d != tst.d) {
+			t.Fatalf("Expected '%s' to parse as %v, got %v and '%v'", tst.val, tst.d, d, err)
+		}
+		if !tst.valid && err == nil {
+			t.Fatalf("Expected '%s' to be rejected, got %v", tst.val, d)
+		}
+	}
+}
+
+// TestParseDeletedRetention ensures that we only accept retention periods of
+// soft-deleted skylinks which are zero or long enough.
+func TestParseDeletedRetention(t *testing.T) {
+	tests := []struct {
+		val   string
+		d     time.Duration
+		valid bool
+	}{
+		{val: "0", valid: true},
+		{val: "24h", d: 24 * time.Hour, valid: true},
+		{val: "168h", d: 7 * 24 * time.Hour, valid: true},
+		{val: "23h"},
+		{val: "-24h"},
+		{val: "7"},
+		{val: ""},
+	}
+	for _, tst := range tests {
+		d, err := parseDeletedRetention(tst.val)
+		if tst.valid && (err != nil || d != tst.d) {
+			t.Fatalf("Expected '%s' to parse as %v, got %v and '%v'", tst.val, tst.d, d, err)
+		}
+		if !tst.valid && err == nil {
+			t.Fatalf("Expected '%s' to be rejected, got %v", tst.val, d)
+		}
+	}
+}
+
+// TestIsDryRunKey ensures that IsDryRunKey recognises the cluster-wide dry_run
+// key and the per-server ones.
+func TestIsDryRunKey(t *testing.T) {
+	t.Parallel()
+
+	if key := DryRunKey("server1"); key != "dry_run.server1" || !IsDryRunKey(key) {
+		t.Fatalf("Expected 'dry_run.server1' to be a dry_run key, got '%s'", key)
+	}
+	if !IsDryRunKey(ConfDryRun) {
+		t.Fatal("Expected 'dry_run' to be a dry_run key")
+	}
+	for _, key := range []string{"dry_runs", "dryrun.server1", "min_pinners", ""} {
+		if IsDryRunKey(key) {
+			t.Fatalf("Expected '%s' not to be a dry_run key", key)
+		}
+	}
+}
+
+// TestParseTimeOfDay ensures that ParseTimeOfDay works as expected.
+func TestParseTimeOfDay(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		input    string
+		expected time.Duration
+		valid    bool
+	}{
+		"midnight":     {input: "00:00", expected: 0, valid: true},
+		"early":        {input: "03:30", expected: 3*time.Hour + 30*time.Minute, valid: true},
+		"last minute":  {input: "23:59", expected: 23*time.Hour + 59*time.Minute, valid: true},
+		"empty":        {input: "", valid: false},
+		"bad hour":     {input: "24:00", valid: false},
+		"bad minute":   {input: "12:60", valid: false},
+		"with seconds": {input: "12:00:00", valid: false},
+		"garbage":      {input: "noon", valid: false},
+	}
+	for name, tt := range tests {
+		d, err := ParseTimeOfDay(tt.input)
+		if tt.valid && err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Fatalf("%s: expected an error, got %v", name, d)
+		}
+		if tt.valid && d != tt.expected {
+			t.Fatalf("%s: expected %v, got %v", name, tt.expected, d)
+		}
+	}
 }
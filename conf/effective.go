@@ -0,0 +1,177 @@
+package conf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/skynetlabs/pinner/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// Sources of the configuration values.
+const (
+	// SourceDefault marks the values nobody set.
+	SourceDefault Source = "default"
+	// SourceEnv marks the values set in the environment or the .env file.
+	SourceEnv Source = "env"
+	// SourceFile marks the values set in the configuration file.
+	SourceFile Source = "file"
+	// SourceDB marks the cluster-wide values set in the database.
+	SourceDB Source = "db"
+)
+
+type (
+	// Source tells us where a configuration value comes from.
+	Source string
+
+	// EffectiveValue is a configuration value, formatted the way we set it,
+	// together with its source.
+	EffectiveValue struct {
+		Value  string `json:"value"`
+		Source Source `json:"source"`
+	}
+
+	// EffectiveConfig is the configuration a server actually uses. It's
+	// what we look at when a server behaves differently from the others.
+	EffectiveConfig struct {
+		// Static holds the settings the process loaded at startup or on
+		// its last reload, keyed by their env vars. The secrets are
+		// redacted, see Config.Redacted.
+		Static map[string]EffectiveValue `json:"static"`
+		// Cluster holds the cluster-wide settings the server uses, keyed
+		// by their keys. The server loads them from the database
+		// periodically, so they may lag behind it.
+		Cluster map[string]EffectiveValue `json:"cluster"`
+		// Invalid holds the server's cluster-wide values in the database
+		// which are invalid, keyed by their keys. The server ignores all
+		// changes to the cluster-wide settings while there are any, see
+		// LoadClusterConfig.
+		Invalid map[string]InvalidValue `json:"invalid,omitempty"`
+		// Derived holds the values we compute from the settings, e.g. the
+		// bounds of the randomized sleep between scans. Their source is
+		// the source of the setting they are derived from.
+		Derived map[string]EffectiveValue `json:"derived"`
+	}
+
+	// InvalidValue is an invalid configuration value together with the
+	// reason why it's invalid.
+	InvalidValue struct {
+		Value string `json:"value"`
+		Error string `json:"error"`
+	}
+)
+
+// LoadEffectiveConfig returns the effective configuration of the server with
+// the given static configuration, which uses the given cluster-wide
+// configuration, parsed from the given database values. See LoadClusterConfig.
+// It loads the current values from the database in order to list the invalid
+// ones.
+func LoadEffectiveConfig(ctx context.Context, db *database.DB, cfg Config, cc ClusterConfig, ccValues map[string]string) (EffectiveConfig, error) {
+	values, err := db.ConfigValues(ctx, ClusterConfigKeys(cfg.ServerName)...)
+	if err != nil {
+		return EffectiveConfig{}, errors.AddContext(err, "failed to load the cluster configuration")
+	}
+	return newEffectiveConfig(cfg, cc, ccValues, values)
+}
+
+// newEffectiveConfig returns the effective configuration of the server with the
+// given static configuration and the given cluster-wide configuration, parsed
+// from the given values. It lists the invalid ones among the given current
+// values.
+func newEffectiveConfig(cfg Config, cc ClusterConfig, ccValues, values map[string]string) (EffectiveConfig, error) {
+	ec := EffectiveConfig{
+		Static:  make(map[string]EffectiveValue, len(configFileKeys)),
+		Cluster: make(map[string]EffectiveValue),
+		Derived: make(map[string]EffectiveValue),
+	}
+	// Only ever look at the redacted copy.
+	redactedCfg := reflect.ValueOf(cfg.Redacted())
+	for key, env := range configFileKeys {
+		field, ok := configField(redactedCfg, key)
+		if !ok {
+			return EffectiveConfig{}, fmt.Errorf("no field for the setting '%s'", key)
+		}
+		ec.Static[env] = EffectiveValue{Value: fmt.Sprint(field.Interface()), Source: cfg.Source(env)}
+	}
+	// setCluster adds the cluster-wide value under the given key. Its source
+	// is the database if we parsed it from any of the given keys.
+	setCluster := func(key string, val interface{}, keys ...string) {
+		src := SourceDefault
+		for _, k := range append([]string{key}, keys...) {
+			if _, ok := ccValues[k]; ok {
+				src = SourceDB
+			}
+		}
+		ec.Cluster[key] = EffectiveValue{Value: fmt.Sprint(val), Source: src}
+	}
+	setCluster(ConfDryRun, cc.DryRun, DryRunKey(cfg.ServerName))
+	setCluster(ConfLazyPinning, cc.LazyPinning)
+	setCluster(ConfLockDuration, cc.LockDuration)
+	setCluster(ConfMaxPinSize, cc.MaxPinSize)
+	setCluster(ConfMaxPinsPerCycle, cc.MaxPinsPerCycle)
+	setCluster(ConfMinPinners, cc.MinPinners)
+	setCluster(ConfPinDeadlineFactor, cc.PinDeadlineFactor)
+	setCluster(ConfSleepBetweenPins, cc.SleepBetweenPins)
+	for key, val := range values {
+		_, err := parseClusterConfig(map[string]string{key: val}, cfg.ServerName)
+		if err == nil {
+			continue
+		}
+		if ec.Invalid == nil {
+			ec.Invalid = make(map[string]InvalidValue)
+		}
+		ec.Invalid[key] = InvalidValue{Value: val, Error: err.Error()}
+	}
+	sleep, lower, upper := SleepBetweenScansBounds(cfg.SleepBetweenScans)
+	src := cfg.Source("PINNER_SLEEP_BETWEEN_SCANS")
+	ec.Derived["sleep_between_scans"] = EffectiveValue{Value: sleep.String(), Source: src}
+	ec.Derived["sleep_between_scans_min"] = EffectiveValue{Value: lower.String(), Source: src}
+	ec.Derived["sleep_between_scans_max"] = EffectiveValue{Value: upper.String(), Source: src}
+	return ec, nil
+}
+
+// Source returns the source of the setting with the given env var.
+func (cfg Config) Source(env string) Source {
+	if src, ok := cfg.Sources[env]; ok {
+		return src
+	}
+	return SourceDefault
+}
+
+// configSources returns the sources of all settings, keyed by their env vars.
+// The env vars take precedence over the given values of the configuration
+// file, see LoadConfig.
+func configSources(fileVals map[string]string) map[string]Source {
+	sources := make(map[string]Source, len(configFileKeys))
+	for _, env := range configFileKeys {
+		if _, ok := os.LookupEnv(env); ok {
+			sources[env] = SourceEnv
+		} else if _, ok := fileVals[env]; ok {
+			sources[env] = SourceFile
+		} else {
+			sources[env] = SourceDefault
+		}
+	}
+	return sources
+}
+
+// configField returns the field of the given Config which holds the setting
+// with the given configuration file key. The keys mirror the fields' names, so
+// "sia_api_password" is SiaAPIPassword and "db_credentials.uri" is
+// DBCredentials.URI.
+func configField(v reflect.Value, key string) (reflect.Value, bool) {
+	for _, part := range strings.Split(key, ".") {
+		name := strings.ReplaceAll(part, "_", "")
+		field := v.FieldByNameFunc(func(f string) bool {
+			return strings.ToLower(f) == name
+		})
+		if !field.IsValid() {
+			return reflect.Value{}, false
+		}
+		v = field
+	}
+	return v, true
+}
@@ -0,0 +1,160 @@
+package conf
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/skynetlabs/pinner/database"
+)
+
+// TestEffectiveConfig ensures that the effective configuration holds all
+// settings with their sources and that it never holds any secrets.
+func TestEffectiveConfig(t *testing.T) {
+	secrets := map[string]string{
+		"SIA_API_PASSWORD":            "siaapisecret",
+		"SKYNET_DB_PASS":              "dbpasssecret",
+		"PINNER_ACCOUNTS_HOOK_SECRET": "hooksecret",
+		"PINNER_ACCOUNTS_TOKEN":       "tokensecret",
+		"PINNER_ALERT_WEBHOOK_URL":    "https://hooks.example.com/webhooksecret",
+		"SKYNET_DB_URI":               "mongodb://dbuser:urisecret@h1:27017/?replicaSet=rs0",
+	}
+	for key, val := range secrets {
+		t.Setenv(key, val)
+	}
+	t.Setenv("SERVER_DOMAIN", "pinner.example.com")
+	t.Setenv("SKYNET_DB_USER", "dbuser")
+	t.Setenv("PINNER_SLEEP_BETWEEN_SCANS", "10h")
+	// The file sets the log level and the skyd retries but the env var
+	// takes precedence for the retries.
+	t.Setenv("PINNER_SKYD_RETRIES", "7")
+	for _, key := range []string{"PINNER_LOG_LEVEL", "API_HOST"} {
+		t.Setenv(key, "")
+		_ = os.Unsetenv(key)
+	}
+	writeConfigFile(t, "pinner.yml", "log_level: debug\nskyd_retries: 5\n")
+	cfg, _, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := cfg.ServerName
+	values := map[string]string{
+		ConfDryRun:        "false",
+		DryRunKey(server): "true",
+		ConfMinPinners:    "3",
+	}
+	cc, err := parseClusterConfig(values, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := newEffectiveConfig(cfg, cc, values, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ec.Invalid) != 0 {
+		t.Fatalf("Expected no invalid values, got %v", ec.Invalid)
+	}
+
+	// All settings are there.
+	if len(ec.Static) != len(configFileKeys) {
+		t.Fatalf("Expected %d static settings, got %d", len(configFileKeys), len(ec.Static))
+	}
+	if len(ec.Cluster) != len(ClusterConfigKeys(server))-1 {
+		t.Fatalf("Expected %d cluster settings, got %v", len(ClusterConfigKeys(server))-1, ec.Cluster)
+	}
+	// None of the secrets are.
+	b, err := json.Marshal(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range secrets {
+		if key == "SKYNET_DB_URI" {
+			val = "urisecret"
+		}
+		if strings.Contains(string(b), val) {
+			t.Fatalf("Expected the value of %s to be redacted, got %s", key, b)
+		}
+	}
+	for _, key := range []string{"SIA_API_PASSWORD", "SKYNET_DB_PASS"} {
+		if v := ec.Static[key]; v.Value != redacted || v.Source != SourceEnv {
+			t.Fatalf("Expected %s to be redacted and come from the env, got %+v", key, v)
+		}
+	}
+
+	expected := map[string]EffectiveValue{
+		"SERVER_DOMAIN":              {Value: server, Source: SourceEnv},
+		"PINNER_LOG_LEVEL":           {Value: "debug", Source: SourceFile},
+		"PINNER_SKYD_RETRIES":        {Value: "7", Source: SourceEnv},
+		"PINNER_SLEEP_BETWEEN_SCANS": {Value: "10h0m0s", Source: SourceEnv},
+		"API_HOST":                   {Value: defaultSiaAPIHost, Source: SourceDefault},
+		"SKYNET_DB_USER":             {Value: "dbuser", Source: SourceEnv},
+	}
+	for key, ev := range expected {
+		if ec.Static[key] != ev {
+			t.Fatalf("Expected %s to be %+v, got %+v", key, ev, ec.Static[key])
+		}
+	}
+	// The server's own dry_run value takes precedence.
+	expected = map[string]EffectiveValue{
+		ConfDryRun:           {Value: "true", Source: SourceDB},
+		ConfMinPinners:       {Value: "3", Source: SourceDB},
+		ConfLazyPinning:      {Value: "true", Source: SourceDefault},
+		ConfSleepBetweenPins: {Value: defaultSleepBetweenPins.String(), Source: SourceDefault},
+	}
+	for key, ev := range expected {
+		if ec.Cluster[key] != ev {
+			t.Fatalf("Expected %s to be %+v, got %+v", key, ev, ec.Cluster[key])
+		}
+	}
+	// The scanner sleeps for 10h +/- 10%.
+	expected = map[string]EffectiveValue{
+		"sleep_between_scans":     {Value: "10h0m0s", Source: SourceEnv},
+		"sleep_between_scans_min": {Value: "9h0m0s", Source: SourceEnv},
+		"sleep_between_scans_max": {Value: "11h0m0s", Source: SourceEnv},
+	}
+	for key, ev := range expected {
+		if ec.Derived[key] != ev {
+			t.Fatalf("Expected %s to be %+v, got %+v", key, ev, ec.Derived[key])
+		}
+	}
+
+	// Invalid values in the database are listed next to the values the
+	// server uses.
+	current := map[string]string{
+		ConfDryRun:        "false",
+		DryRunKey(server): "true",
+		ConfMinPinners:    "100",
+	}
+	ec, err = newEffectiveConfig(cfg, cc, values, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ec.Cluster[ConfMinPinners]; v.Value != "3" {
+		t.Fatalf("Expected %s to be 3, got %+v", ConfMinPinners, v)
+	}
+	if len(ec.Invalid) != 1 || ec.Invalid[ConfMinPinners].Value != "100" {
+		t.Fatalf("Expected %s to be invalid, got %v", ConfMinPinners, ec.Invalid)
+	}
+	if !strings.Contains(ec.Invalid[ConfMinPinners].Error, database.ErrInvalidConfigValue.Error()) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidConfigValue, ec.Invalid[ConfMinPinners].Error)
+	}
+}
+
+// TestSleepBetweenScansBounds ensures that SleepBetweenScansBounds applies the
+// default and the random variation.
+func TestSleepBetweenScansBounds(t *testing.T) {
+	t.Parallel()
+
+	sleep, lower, upper := SleepBetweenScansBounds(0)
+	if sleep != DefaultSleepBetweenScans {
+		t.Fatalf("Expected the default of %v, got %v", DefaultSleepBetweenScans, sleep)
+	}
+	if lower >= sleep || upper <= sleep {
+		t.Fatalf("Expected %v to be within %v and %v", sleep, lower, upper)
+	}
+	sleep, lower, upper = SleepBetweenScansBounds(100)
+	if sleep != 100 || lower != 90 || upper != 110 {
+		t.Fatalf("Expected 100 within 90 and 110, got %v within %v and %v", sleep, lower, upper)
+	}
+}
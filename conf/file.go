@@ -0,0 +1,124 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// configFileKeys maps the keys of the configuration file to the env vars
+	// they stand in for. The keys mirror the fields of Config. Nested keys,
+	// such as the ones of DBCredentials, are joined with dots.
+	configFileKeys = map[string]string{
+		"accounts_hook_secret":      "PINNER_ACCOUNTS_HOOK_SECRET",
+		"accounts_host":             "SKYNET_ACCOUNTS_HOST",
+		"accounts_port":             "SKYNET_ACCOUNTS_PORT",
+		"accounts_timeout":          "PINNER_ACCOUNTS_TIMEOUT",
+		"accounts_token":            "PINNER_ACCOUNTS_TOKEN",
+		"alert_webhook_url":         "PINNER_ALERT_WEBHOOK_URL",
+		"cache_rebuild_workers":     "PINNER_CACHE_REBUILD_WORKERS",
+		"db_credentials.host":       "SKYNET_DB_HOST",
+		"db_credentials.password":   "SKYNET_DB_PASS",
+		"db_credentials.port":       "SKYNET_DB_PORT",
+		"db_credentials.uri":        "SKYNET_DB_URI",
+		"db_credentials.user":       "SKYNET_DB_USER",
+		"db_max_conn_idle_time":     "PINNER_DB_MAX_CONN_IDLE_TIME",
+		"db_max_doc_size":           "PINNER_DB_MAX_DOC_SIZE",
+		"db_max_pool_size":          "PINNER_DB_MAX_POOL_SIZE",
+		"db_min_pool_size":          "PINNER_DB_MIN_POOL_SIZE",
+		"db_op_timeout":             "PINNER_DB_OP_TIMEOUT",
+		"db_reporting_read_pref":    "PINNER_DB_REPORTING_READ_PREF",
+		"db_slow_op_threshold":      "PINNER_DB_SLOW_OP_THRESHOLD",
+		"db_underpinned_hint":       "PINNER_DB_UNDERPINNED_HINT",
+		"drift_report_interval":     "PINNER_DRIFT_REPORT_INTERVAL",
+		"jwt_claim":                 "PINNER_JWT_CLAIM",
+		"jwt_claim_min":             "PINNER_JWT_CLAIM_MIN",
+		"log_file":                  "PINNER_LOG_FILE",
+		"log_level":                 "PINNER_LOG_LEVEL",
+		"server_name":               "SERVER_DOMAIN",
+		"sia_api_ca_cert":           "SIA_API_CA_CERT",
+		"sia_api_host":              "API_HOST",
+		"sia_api_password":          "SIA_API_PASSWORD",
+		"sia_api_port":              "API_PORT",
+		"sia_api_scheme":            "SIA_API_SCHEME",
+		"skyd_read_rate":            "PINNER_SKYD_READ_RATE",
+		"skyd_retries":              "PINNER_SKYD_RETRIES",
+		"skyd_timeout":              "PINNER_SKYD_TIMEOUT",
+		"skyd_unpin_concurrency":    "PINNER_SKYD_UNPIN_CONCURRENCY",
+		"skyd_verify_pins":          "PINNER_SKYD_VERIFY_PINS",
+		"skyd_write_rate":           "PINNER_SKYD_WRITE_RATE",
+		"sleep_between_scans":       "PINNER_SLEEP_BETWEEN_SCANS",
+		"sweep_max_removal_percent": "PINNER_SWEEP_MAX_REMOVAL_PERCENT",
+		"sweep_time_of_day":         "PINNER_SWEEP_TIME_OF_DAY",
+		"sweep_unpin":               "PINNER_SWEEP_UNPIN",
+	}
+)
+
+// loadConfigFile reads the YAML or JSON configuration file at the given path.
+// Files with a .json extension are parsed as JSON, all others as YAML. It
+// returns the file's values keyed by the env vars they stand in for, in the
+// same format as the env vars, and the keys it doesn't know, sorted.
+func loadConfigFile(path string) (map[string]string, []string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.AddContext(err, "failed to read the config file")
+	}
+	var doc map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		// Keep the numbers as they are written, so large integers don't
+		// turn into floats.
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		err = dec.Decode(&doc)
+	} else {
+		err = yaml.Unmarshal(b, &doc)
+	}
+	if err != nil {
+		return nil, nil, errors.AddContext(err, fmt.Sprintf("failed to parse the config file '%s'", path))
+	}
+	vals := make(map[string]string)
+	var unknown []string
+	err = flattenConfigFile("", doc, vals, &unknown)
+	if err != nil {
+		return nil, nil, errors.AddContext(err, fmt.Sprintf("invalid config file '%s'", path))
+	}
+	sort.Strings(unknown)
+	return vals, unknown, nil
+}
+
+// flattenConfigFile adds the values of the given section of the configuration
+// file to vals, keyed by their env vars. It adds the keys it doesn't know to
+// unknown.
+func flattenConfigFile(prefix string, section map[string]interface{}, vals map[string]string, unknown *[]string) error {
+	for k, v := range section {
+		key := prefix + k
+		if sub, ok := v.(map[string]interface{}); ok {
+			if err := flattenConfigFile(key+".", sub, vals, unknown); err != nil {
+				return err
+			}
+			continue
+		}
+		env, known := configFileKeys[key]
+		if !known {
+			*unknown = append(*unknown, key)
+			continue
+		}
+		switch v.(type) {
+		case nil:
+			vals[env] = ""
+		case string, bool, int, float64, json.Number:
+			vals[env] = fmt.Sprint(v)
+		default:
+			return fmt.Errorf("'%s' has an invalid value of '%v', expected a scalar", key, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writeConfigFile writes the given content to a config file with the given
+// name in a temporary directory and points PINNER_CONFIG_FILE to it.
+func writeConfigFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PINNER_CONFIG_FILE", path)
+	return path
+}
+
+// TestLoadConfigFile ensures that LoadConfig picks up the values of the config
+// file, that the env vars take precedence over them and that the defaults
+// apply to the values neither of them sets.
+func TestLoadConfigFile(t *testing.T) {
+	yamlFile := `
+server_name: file.example.com
+log_level: debug
+sleep_between_scans: 2h
+skyd_retries: 5
+sweep_unpin: true
+db_credentials:
+  user: fileuser
+  host: filehost
+  port: 27018
+`
+	jsonFile := `{
+	"server_name": "file.example.com",
+	"log_level": "debug",
+	"sleep_between_scans": "2h",
+	"skyd_retries": 5,
+	"sweep_unpin": true,
+	"db_credentials": {"user": "fileuser", "host": "filehost", "port": "27018"}
+}`
+	for name, content := range map[string]string{"pinner.yml": yamlFile, "pinner.json": jsonFile} {
+		// The secrets come from the env vars. So does the server name,
+		// overriding the file.
+		t.Setenv("SERVER_DOMAIN", "env.example.com")
+		t.Setenv("SKYNET_DB_PASS", "envpass")
+		t.Setenv("SIA_API_PASSWORD", "envpassword")
+		t.Setenv("PINNER_SKYD_RETRIES", "7")
+		// Unset the env vars the file sets.
+		for _, key := range []string{"SKYNET_DB_USER", "SKYNET_DB_HOST", "SKYNET_DB_PORT", "PINNER_LOG_LEVEL", "PINNER_SLEEP_BETWEEN_SCANS", "PINNER_SWEEP_UNPIN", "SKYNET_ACCOUNTS_HOST"} {
+			t.Setenv(key, "")
+			_ = os.Unsetenv(key)
+		}
+		writeConfigFile(t, name, content)
+
+		cfg, _, err := LoadConfig()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// From the env.
+		if cfg.ServerName != "env.example.com" || cfg.DBCredentials.Password != "envpass" || cfg.SiaAPIPassword != "envpassword" || cfg.SkydRetries != 7 {
+			t.Fatalf("%s: expected the env values, got %+v", name, cfg)
+		}
+		// From the file.
+		if cfg.DBCredentials.User != "fileuser" || cfg.DBCredentials.Host != "filehost" || cfg.DBCredentials.Port != "27018" {
+			t.Fatalf("%s: expected the file's DB credentials, got %+v", name, cfg.DBCredentials)
+		}
+		if cfg.LogLevel != logrus.DebugLevel || cfg.SleepBetweenScans != 2*time.Hour || !cfg.SweepUnpin {
+			t.Fatalf("%s: expected the file's values, got %+v", name, cfg)
+		}
+		// From the defaults.
+		if cfg.AccountsHost != defaultAccountsHost || cfg.SkydTimeout != defaultSkydTimeout {
+			t.Fatalf("%s: expected the default values, got %+v", name, cfg)
+		}
+	}
+}
+
+// TestLoadConfigFileUnknownKeys ensures that loadConfigFile and LoadConfig
+// report the keys they don't know without failing.
+func TestLoadConfigFileUnknownKeys(t *testing.T) {
+	path := writeConfigFile(t, "pinner.yml", `
+server_name: file.example.com
+sleep_betwen_scans: 2h
+db_credentials:
+  user: fileuser
+  passwd: secret
+`)
+	vals, unknown, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"SERVER_DOMAIN": "file.example.com", "SKYNET_DB_USER": "fileuser"}
+	if !reflect.DeepEqual(vals, expected) {
+		t.Fatalf("Expected %v, got %v", expected, vals)
+	}
+	expectedUnknown := []string{"db_credentials.passwd", "sleep_betwen_scans"}
+	if !reflect.DeepEqual(unknown, expectedUnknown) {
+		t.Fatalf("Expected unknown keys %v, got %v", expectedUnknown, unknown)
+	}
+
+	for _, key := range []string{"SERVER_DOMAIN", "SKYNET_DB_USER", "SKYNET_DB_PASS", "SKYNET_DB_HOST", "SKYNET_DB_PORT", "SIA_API_PASSWORD"} {
+		t.Setenv(key, requiredEnvValue(key))
+	}
+	_, unknown, err = LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unknown, expectedUnknown) {
+		t.Fatalf("Expected unknown keys %v, got %v", expectedUnknown, unknown)
+	}
+}
+
+// TestLoadConfigFileMalformed ensures that LoadConfig fails on config files
+// it can't parse or which hold invalid values.
+func TestLoadConfigFileMalformed(t *testing.T) {
+	for _, key := range []string{"SERVER_DOMAIN", "SKYNET_DB_USER", "SKYNET_DB_PASS", "SKYNET_DB_HOST", "SKYNET_DB_PORT", "SIA_API_PASSWORD"} {
+		t.Setenv(key, requiredEnvValue(key))
+	}
+	t.Setenv("PINNER_SLEEP_BETWEEN_SCANS", "")
+	_ = os.Unsetenv("PINNER_SLEEP_BETWEEN_SCANS")
+
+	malformed := map[string]string{
+		"pinner.yml":  "server_name: [unclosed",
+		"pinner.json": `{"server_name": "file.example.com",}`,
+		"list.yml":    "- server_name\n- log_level\n",
+		"nested.yml":  "log_level:\n  - debug\n",
+		"value.yml":   "sleep_between_scans: soon\n",
+	}
+	for name, content := range malformed {
+		writeConfigFile(t, name, content)
+		if _, _, err := LoadConfig(); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+
+	// A missing file is an error, too.
+	t.Setenv("PINNER_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yml"))
+	if _, _, err := LoadConfig(); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
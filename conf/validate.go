@@ -0,0 +1,81 @@
+package conf
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/skynetlabs/pinner/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// maxSleepBetweenScans is the longest time we allow between two scans.
+	// Longer sleeps leave new and underpinned skylinks waiting for too long
+	// and are most likely a mistake, e.g. a missing unit.
+	maxSleepBetweenScans = 24 * time.Hour
+	// redacted replaces the secrets in the configuration we print.
+	redacted = "[redacted]"
+)
+
+// Validate checks the configuration for values which LoadConfig accepts but
+// which would only fail later on, or worse, end up in the database. It returns
+// all problems it finds at once.
+func (cfg Config) Validate() error {
+	var errs []error
+	if err := database.ValidateServerName(cfg.ServerName); err != nil {
+		errs = append(errs, errors.AddContext(err, "SERVER_DOMAIN has an invalid value"))
+	}
+	errs = append(errs, validatePort("SKYNET_ACCOUNTS_PORT", cfg.AccountsPort))
+	errs = append(errs, validatePort("API_PORT", cfg.SiaAPIPort))
+	// The DB's connection string overrides the port.
+	if cfg.DBCredentials.URI == "" {
+		errs = append(errs, validatePort("SKYNET_DB_PORT", cfg.DBCredentials.Port))
+	}
+	if cfg.MinPinners < minPinnersMinValue || cfg.MinPinners > maxPinnersMinValue {
+		errs = append(errs, fmt.Errorf("MinPinners has an invalid value of %d, expected a number between %d and %d", cfg.MinPinners, minPinnersMinValue, maxPinnersMinValue))
+	}
+	if cfg.SleepBetweenScans < 0 || cfg.SleepBetweenScans > maxSleepBetweenScans {
+		errs = append(errs, fmt.Errorf("PINNER_SLEEP_BETWEEN_SCANS has an invalid value of %v, expected a duration between 0 and %v", cfg.SleepBetweenScans, maxSleepBetweenScans))
+	}
+	if cfg.LogLevel > logrus.TraceLevel {
+		errs = append(errs, fmt.Errorf("PINNER_LOG_LEVEL has an invalid value of %d", cfg.LogLevel))
+	}
+	return errors.Compose(errs...)
+}
+
+// Redacted returns a copy of the configuration with its secrets replaced, so
+// it can be printed. Empty secrets stay empty, so we can tell they aren't set.
+func (cfg Config) Redacted() Config {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	redact(&cfg.AccountsHookSecret)
+	redact(&cfg.AccountsToken)
+	redact(&cfg.DBCredentials.Password)
+	redact(&cfg.SiaAPIPassword)
+	// Webhook URLs usually carry a token in their path.
+	redact(&cfg.AlertWebhookURL)
+	if cfg.DBCredentials.URI != "" {
+		if u, err := url.Parse(cfg.DBCredentials.URI); err == nil {
+			cfg.DBCredentials.URI = u.Redacted()
+		} else {
+			cfg.DBCredentials.URI = redacted
+		}
+	}
+	return cfg
+}
+
+// validatePort returns an error if the given value of the given variable is
+// not a valid port number.
+func validatePort(name, port string) error {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return fmt.Errorf("%s has an invalid value of '%s', expected a port number between 1 and 65535", name, port)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const (
+	// maxCommandNames is the maximum number of command names we keep
+	// separate stats for. We record the commands with any further names
+	// under otherCommands, so a misbehaving driver or server can't make the
+	// stats grow without bounds.
+	maxCommandNames = 32
+	// otherCommands is the name under which we record the commands which
+	// don't fit within maxCommandNames.
+	otherCommands = "other"
+)
+
+type (
+	// CommandStats describes the commands with a given name we sent to the
+	// database.
+	CommandStats struct {
+		// Commands is the number of commands which completed.
+		Commands int64 `json:"commands"`
+		// Failures is the number of commands which failed.
+		Failures int64 `json:"failures"`
+		// TotalDuration is the total time the commands took. Together with
+		// Commands it gives us the average duration.
+		TotalDuration time.Duration `json:"totalDuration"`
+		// MaxDuration is the longest time a single command took.
+		MaxDuration time.Duration `json:"maxDuration"`
+	}
+
+	// commandStats keeps track of the commands we send to the database via
+	// the driver's command events.
+	commandStats struct {
+		stats map[string]*CommandStats
+		mu    sync.Mutex
+	}
+)
+
+// newCommandStats returns an empty commandStats.
+func newCommandStats() *commandStats {
+	return &commandStats{
+		stats: make(map[string]*CommandStats),
+	}
+}
+
+// CommandStats returns a copy of the stats of the commands we sent to the
+// database so far, keyed by the command's name.
+func (db *DB) CommandStats() map[string]CommandStats {
+	return db.staticCommandStats.managedStats()
+}
+
+// managedRecord records a command with the given name which took the given
+// number of nanoseconds.
+func (cs *commandStats) managedRecord(name string, durationNanos int64, failed bool) {
+	d := time.Duration(durationNanos)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	s, exists := cs.stats[name]
+	if !exists && len(cs.stats) >= maxCommandNames {
+		name = otherCommands
+		s, exists = cs.stats[name]
+	}
+	if !exists {
+		s = &CommandStats{}
+		cs.stats[name] = s
+	}
+	s.Commands++
+	if failed {
+		s.Failures++
+	}
+	s.TotalDuration += d
+	if d > s.MaxDuration {
+		s.MaxDuration = d
+	}
+}
+
+// managedStats returns a copy of the stats, keyed by the command's name.
+func (cs *commandStats) managedStats() map[string]CommandStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	stats := make(map[string]CommandStats, len(cs.stats))
+	for name, s := range cs.stats {
+		stats[name] = *s
+	}
+	return stats
+}
+
+// monitor returns a command monitor which updates the stats. It passes all
+// events on to next, if it's not nil.
+func (cs *commandStats) monitor(next *event.CommandMonitor) *event.CommandMonitor {
+	m := &event.CommandMonitor{
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			cs.managedRecord(e.CommandName, e.DurationNanos, false)
+			if next != nil && next.Succeeded != nil {
+				next.Succeeded(ctx, e)
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			cs.managedRecord(e.CommandName, e.DurationNanos, true)
+			if next != nil && next.Failed != nil {
+				next.Failed(ctx, e)
+			}
+		},
+	}
+	if next != nil {
+		m.Started = next.Started
+	}
+	return m
+}
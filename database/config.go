@@ -0,0 +1,458 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// DefaultConfigCacheTTL is the duration for which the services cache the
+	// cluster-wide configuration values. See WithConfigCacheTTL.
+	DefaultConfigCacheTTL = 30 * time.Second
+)
+
+var (
+	// ErrInvalidConfigValue is returned when a configuration value can't be
+	// parsed or it's out of bounds.
+	ErrInvalidConfigValue = errors.New("invalid configuration value")
+	// ErrInternalConfigKey is returned when we try to import a configuration
+	// value which the database uses for its own bookkeeping.
+	ErrInternalConfigKey = errors.New("internal configuration key")
+
+	// internalConfigKeys are the keys of the configuration documents which
+	// the database uses for its own bookkeeping, e.g. the schema version.
+	// They describe the database itself, so we don't export or import them.
+	internalConfigKeys = map[string]struct{}{
+		confSchemaVersion:       {},
+		confMigrationLock:       {},
+		confKeySkylinksProgress: {},
+	}
+)
+
+type (
+	// ConfigUpdate is a change of a cluster-wide configuration value. See
+	// WatchConfig.
+	ConfigUpdate struct {
+		Key   string
+		Value string
+	}
+
+	// configCache caches the configuration values we read from the
+	// database. It's disabled when its TTL is zero.
+	configCache struct {
+		entries map[string]configEntry
+		ttl     time.Duration
+		mu      sync.Mutex
+	}
+
+	// configEntry is a cached configuration value. We also cache the values
+	// which are not set, so the defaults don't cost us a query every time.
+	configEntry struct {
+		value   string
+		exists  bool
+		expires time.Time
+	}
+)
+
+// AllConfig returns all cluster-wide configuration values stored in the
+// database, keyed by their keys. This includes the values of keys this version
+// of pinner doesn't know, so they survive a round trip through
+// SetConfigValues.
+func (db *DB) AllConfig(ctx context.Context) (map[string]string, error) {
+	db.staticLogger.Trace("Entering AllConfig")
+	defer db.staticLogger.Trace("Exiting  AllConfig")
+	ctx, done := db.operation(ctx, collConfig, "AllConfig")
+	defer done()
+	filter := bson.M{"key": bson.M{"$nin": configKeys(internalConfigKeys)}}
+	opts := options.Find().SetProjection(bson.M{"_id": 0, "key": 1, "value": 1})
+	c, err := db.staticDB.Collection(collConfig).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find the configuration values")
+	}
+	var results []struct {
+		Key   string
+		Value string
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode the configuration values")
+	}
+	values := make(map[string]string, len(results))
+	for _, r := range results {
+		values[r.Key] = r.Value
+	}
+	return values, nil
+}
+
+// ConfigValue returns a cluster-wide configuration value, stored in the
+// database. It returns mongo.ErrNoDocuments if the value is not set.
+func (db *DB) ConfigValue(ctx context.Context, key string) (string, error) {
+	if val, exists, cached := db.staticConfigCache.get(key); cached {
+		if !exists {
+			return "", mongo.ErrNoDocuments
+		}
+		return val, nil
+	}
+	ctx, done := db.operation(ctx, collConfig, "ConfigValue")
+	defer done()
+	sr := db.staticDB.Collection(collConfig).FindOne(ctx, bson.M{"key": key})
+	if sr.Err() == mongo.ErrNoDocuments {
+		db.staticConfigCache.set(key, "", false)
+	}
+	if sr.Err() != nil {
+		return "", sr.Err()
+	}
+	var result = struct {
+		Value string
+	}{}
+	err := sr.Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	db.staticConfigCache.set(key, result.Value, true)
+	return result.Value, nil
+}
+
+// ConfigValues returns the cluster-wide configuration values under the given
+// keys, keyed by their keys. The keys which are not set are missing from the
+// result. It fetches all values which aren't cached with a single query.
+func (db *DB) ConfigValues(ctx context.Context, keys ...string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	var missing []string
+	for _, key := range keys {
+		val, exists, cached := db.staticConfigCache.get(key)
+		if !cached {
+			missing = append(missing, key)
+			continue
+		}
+		if exists {
+			values[key] = val
+		}
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+	ctx, done := db.operation(ctx, collConfig, "ConfigValues")
+	defer done()
+	filter := bson.M{"key": bson.M{"$in": missing}}
+	opts := options.Find().SetProjection(bson.M{"_id": 0, "key": 1, "value": 1})
+	c, err := db.staticDB.Collection(collConfig).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find the configuration values")
+	}
+	var results []struct {
+		Key   string
+		Value string
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode the configuration values")
+	}
+	found := make(map[string]string, len(results))
+	for _, r := range results {
+		found[r.Key] = r.Value
+	}
+	for _, key := range missing {
+		val, exists := found[key]
+		db.staticConfigCache.set(key, val, exists)
+		if exists {
+			values[key] = val
+		}
+	}
+	return values, nil
+}
+
+// ConfigValueBool returns the cluster-wide configuration value under the given
+// key as a bool. It returns def if the value is not set.
+func (db *DB) ConfigValueBool(ctx context.Context, key string, def bool) (bool, error) {
+	val, err := db.ConfigValue(ctx, key)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return def, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return ParseConfigBool(key, val)
+}
+
+// ConfigValueDuration returns the cluster-wide configuration value under the
+// given key as a duration between min and max. It returns def if the value is
+// not set.
+func (db *DB) ConfigValueDuration(ctx context.Context, key string, def, min, max time.Duration) (time.Duration, error) {
+	val, err := db.ConfigValue(ctx, key)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return def, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ParseConfigDuration(key, val, min, max)
+}
+
+// ConfigValueInt returns the cluster-wide configuration value under the given
+// key as an int between min and max. It returns def if the value is not set.
+func (db *DB) ConfigValueInt(ctx context.Context, key string, def, min, max int) (int, error) {
+	val, err := db.ConfigValue(ctx, key)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return def, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ParseConfigInt(key, val, min, max)
+}
+
+// DeleteConfigValue removes a cluster-wide configuration value from the
+// database, so the services fall back to its default. It returns
+// mongo.ErrNoDocuments if the value is not set.
+func (db *DB) DeleteConfigValue(ctx context.Context, key string) error {
+	db.staticLogger.Tracef("Entering DeleteConfigValue. Key: '%s'", key)
+	defer db.staticLogger.Tracef("Exiting  DeleteConfigValue. Key: '%s'", key)
+	if _, internal := internalConfigKeys[key]; internal {
+		return errors.AddContext(ErrInternalConfigKey, key)
+	}
+	if key == "" {
+		return errors.AddContext(ErrInvalidConfigValue, "empty key")
+	}
+	ctx, done := db.operation(ctx, collConfig, "DeleteConfigValue")
+	defer done()
+	dr, err := db.staticDB.Collection(collConfig).DeleteOne(ctx, bson.M{"key": key})
+	db.staticConfigCache.invalidate(key)
+	if err != nil {
+		return errors.AddContext(err, "failed to delete the configuration value")
+	}
+	if dr.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// InvalidateConfigCache drops all cached configuration values, so the next
+// reads fetch them from the database.
+func (db *DB) InvalidateConfigCache() {
+	db.staticConfigCache.invalidate()
+}
+
+// SetConfigValue updates a cluster-wide configuration value, stored in the
+// database.
+func (db *DB) SetConfigValue(ctx context.Context, key, value string) error {
+	ctx, done := db.operation(ctx, collConfig, "SetConfigValue")
+	defer done()
+	opts := options.Update().SetUpsert(true)
+	filter := bson.M{"key": key}
+	update := bson.M{
+		"$set": bson.M{
+			"key":   key,
+			"value": value,
+		},
+	}
+	_, err := db.staticDB.Collection(collConfig).UpdateOne(ctx, filter, update, opts)
+	db.staticConfigCache.invalidate(key)
+	return err
+}
+
+// SetConfigValues updates the given cluster-wide configuration values in a
+// single bulk write. The keys don't need to be known to this version of pinner.
+// Values which aren't given are left alone. Each value is set atomically but the
+// values are not set together, so concurrent writers might see some of them
+// set and others not yet.
+func (db *DB) SetConfigValues(ctx context.Context, values map[string]string) error {
+	db.staticLogger.Tracef("Entering SetConfigValues. Values: %d", len(values))
+	defer db.staticLogger.Tracef("Exiting  SetConfigValues. Values: %d", len(values))
+	if len(values) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(values))
+	models := make([]mongo.WriteModel, 0, len(values))
+	for key, value := range values {
+		if _, internal := internalConfigKeys[key]; internal {
+			return errors.AddContext(ErrInternalConfigKey, key)
+		}
+		if key == "" {
+			return errors.AddContext(ErrInvalidConfigValue, "empty key")
+		}
+		keys = append(keys, key)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"key": key}).
+			SetUpdate(bson.M{"$set": bson.M{"key": key, "value": value}}).
+			SetUpsert(true))
+	}
+	ctx, done := db.operation(ctx, collConfig, "SetConfigValues")
+	defer done()
+	_, err := db.staticDB.Collection(collConfig).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	db.staticConfigCache.invalidate(keys...)
+	if err != nil {
+		return errors.AddContext(err, "failed to set the configuration values")
+	}
+	return nil
+}
+
+// WatchConfig returns a channel on which we send the configuration values as
+// they're set, by any instance. We drop them from the cache as they change, so
+// the next reads return the new values. We don't send the deleted values, as
+// the change stream doesn't tell us their keys, but we drop the whole cache
+// when any of them gets deleted. The channel is closed when the context
+// is cancelled or when the change stream fails, after which the caller might
+// want to watch again.
+//
+// Change streams need a replica set or a sharded cluster, so WatchConfig fails
+// against a standalone server. The callers should keep polling the values they
+// care about in that case.
+func (db *DB) WatchConfig(ctx context.Context) (<-chan ConfigUpdate, error) {
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.M{"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete"}}}}},
+	}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	cs, err := db.staticDB.Collection(collConfig).Watch(ctx, pipeline, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to watch the configuration")
+	}
+	updates := make(chan ConfigUpdate)
+	go func() {
+		defer close(updates)
+		defer func() {
+			if errClose := cs.Close(db.staticCtx); errClose != nil {
+				db.staticLogger.Debug(errors.AddContext(errClose, "failed to close the configuration change stream"))
+			}
+		}()
+		for cs.Next(ctx) {
+			var event struct {
+				OperationType string `bson:"operationType"`
+				FullDocument  struct {
+					Key   string `bson:"key"`
+					Value string `bson:"value"`
+				} `bson:"fullDocument"`
+			}
+			err := cs.Decode(&event)
+			if err != nil {
+				db.staticLogger.Warn(errors.AddContext(err, "failed to decode a configuration change"))
+				continue
+			}
+			if event.OperationType == "delete" {
+				db.staticConfigCache.invalidate()
+				continue
+			}
+			// The document is gone if it was deleted after the change.
+			if event.FullDocument.Key == "" {
+				continue
+			}
+			db.staticConfigCache.invalidate(event.FullDocument.Key)
+			select {
+			case updates <- ConfigUpdate{Key: event.FullDocument.Key, Value: event.FullDocument.Value}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if cs.Err() != nil && ctx.Err() == nil {
+			db.staticLogger.Warn(errors.AddContext(cs.Err(), "the configuration change stream failed"))
+		}
+	}()
+	return updates, nil
+}
+
+// ParseConfigBool parses the value of the given configuration setting as a
+// bool.
+func ParseConfigBool(key, val string) (bool, error) {
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.AddContext(ErrInvalidConfigValue, fmt.Sprintf("%s '%s' is not a bool", key, val))
+	}
+	return b, nil
+}
+
+// ParseConfigDuration parses the value of the given configuration setting as a
+// duration and ensures that it's between min and max.
+func ParseConfigDuration(key, val string, min, max time.Duration) (time.Duration, error) {
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, errors.AddContext(ErrInvalidConfigValue, fmt.Sprintf("%s '%s' is not a duration", key, val))
+	}
+	if d < min || d > max {
+		return 0, errors.AddContext(ErrInvalidConfigValue, fmt.Sprintf("%s '%s' is not between %v and %v", key, val, min, max))
+	}
+	return d, nil
+}
+
+// ParseConfigFloat parses the value of the given configuration setting as a
+// float and ensures that it's between min and max.
+func ParseConfigFloat(key, val string, min, max float64) (float64, error) {
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errors.AddContext(ErrInvalidConfigValue, fmt.Sprintf("%s '%s' is not a number", key, val))
+	}
+	if f < min || f > max {
+		return 0, errors.AddContext(ErrInvalidConfigValue, fmt.Sprintf("%s '%s' is not between %v and %v", key, val, min, max))
+	}
+	return f, nil
+}
+
+// ParseConfigInt parses the value of the given configuration setting as an int
+// and ensures that it's between min and max.
+func ParseConfigInt(key, val string, min, max int) (int, error) {
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, errors.AddContext(ErrInvalidConfigValue, fmt.Sprintf("%s '%s' is not an integer", key, val))
+	}
+	if i < min || i > max {
+		return 0, errors.AddContext(ErrInvalidConfigValue, fmt.Sprintf("%s '%s' is not between %d and %d", key, val, min, max))
+	}
+	return i, nil
+}
+
+// configKeys returns the keys of the given set.
+func configKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// get returns the cached value of the given key. The last return value is
+// false if we have no fresh value cached.
+func (c *configCache) get(key string) (val string, exists bool, cached bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return "", false, false
+	}
+	return e.value, e.exists, true
+}
+
+// invalidate drops the cached values of the given keys or, if none are given,
+// all cached values.
+func (c *configCache) invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(keys) == 0 {
+		c.entries = make(map[string]configEntry)
+		return
+	}
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+}
+
+// set caches the value of the given key.
+func (c *configCache) set(key, val string, exists bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 {
+		return
+	}
+	c.entries[key] = configEntry{
+		value:   val,
+		exists:  exists,
+		expires: time.Now().Add(c.ttl),
+	}
+}
@@ -3,16 +3,19 @@ package database
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/skynetlabs/pinner/logger"
 	"gitlab.com/NebulousLabs/errors"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readconcern"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
 )
 
 const (
@@ -24,12 +27,25 @@ var (
 	// ErrCtxFailedToConnect is the context we add to an error when we fail to
 	// connect to the db.
 	ErrCtxFailedToConnect = "failed to connect to the db"
+	// ErrCtxInvalidURI is the context we add to an error when the DB's
+	// connection string is invalid.
+	ErrCtxInvalidURI = "invalid DB connection string"
 
 	// dbName defines the name of the database this service uses
 	dbName = "pinner"
 	// collConfig defines the name of the collection which will hold the
 	// cluster-wide service configuration.
 	collConfig = "configuration"
+	// collDriftReports defines the name of the collection which will hold
+	// the reports of the drift between accounts and the database. See
+	// DriftReport.
+	collDriftReports = "drift_reports"
+	// collServers defines the name of the collection which will hold
+	// information about the servers in the cluster, e.g. their heartbeats.
+	collServers = "servers"
+	// collServerStats defines the name of the collection which will hold
+	// the loads of the servers in the cluster. See ServerLoad.
+	collServerStats = "server_stats"
 	// collSkylinks defines the name of the collection which will hold
 	// information about skylinks
 	collSkylinks = "skylinks"
@@ -39,11 +55,63 @@ type (
 	// DB holds a connection to the database, as well as helpful shortcuts to
 	// collections and utilities.
 	DB struct {
+		// commandMonitor is notified of the commands we send to the
+		// database, if it's not nil.
+		commandMonitor *event.CommandMonitor
+		// lockDuration is the duration of the locks we put on skylinks
+		// while we are trying to pin them.
+		lockDuration time.Duration
+		// maxDocSize is the size in bytes above which we refuse to grow
+		// the skylinks' documents. See WithMaxDocSize.
+		maxDocSize int64
+		// opTimeout is the maximum duration of a single database
+		// operation and slowOpThreshold is the duration above which we log
+		// operations as slow. See operation.
+		opTimeout       time.Duration
+		slowOpThreshold time.Duration
+		// maxConnIdleTime, maxPoolSize and minPoolSize size the pool of
+		// connections to the database. Zero values leave the driver's
+		// defaults in place.
+		maxConnIdleTime time.Duration
+		maxPoolSize     uint64
+		minPoolSize     uint64
+		// serverName is the name of the server this instance runs on. See
+		// WithServerName.
+		serverName string
+		// reportingReadPref is the read preference of the reporting
+		// queries. See reporting.
+		reportingReadPref *readpref.ReadPref
+		// underpinnedHint is the name of the index FindAndLockUnderpinned
+		// hints MongoDB to use. It's empty if we let the query planner
+		// pick. See WithUnderpinnedHint.
+		underpinnedHint string
+		// unhealthySince is when Healthy first failed to reach the
+		// database. It's zero while the database is reachable.
+		unhealthySince time.Time
+		mu             sync.Mutex
+
 		staticCtx    context.Context
 		staticDB     *mongo.Database
 		staticLogger logger.ExtFieldLogger
+		// staticPoolStats keeps track of the pool of connections to the
+		// database.
+		staticPoolStats *poolStats
+		// staticCommandStats keeps track of the commands we send to the
+		// database.
+		staticCommandStats *commandStats
+		// staticConfigCache holds the configuration values we recently
+		// read from the database.
+		staticConfigCache *configCache
+		// staticTransactions is true if WithTransaction runs its callbacks
+		// in transactions. It's false if the deployment doesn't support
+		// them or if the DB was created with WithoutTransactions.
+		staticTransactions bool
 	}
 
+	// Option customizes a DB created by NewCustomDB. The options are applied
+	// before we connect.
+	Option func(*DB)
+
 	// DBCredentials is a helper struct that binds together all values needed for
 	// establishing a DB connection.
 	DBCredentials struct {
@@ -51,16 +119,64 @@ type (
 		Password string
 		Host     string
 		Port     string
+		// URI is an optional MongoDB connection string, e.g.
+		// "mongodb://h1:27017,h2:27017/?replicaSet=rs0" or
+		// "mongodb+srv://cluster.example.com". When it's set, it overrides
+		// Host and Port. User and Password only apply if the URI doesn't
+		// hold any credentials of its own.
+		URI string
 	}
 )
 
 // New creates a new database connection.
-func New(ctx context.Context, creds DBCredentials, logger logger.ExtFieldLogger) (*DB, error) {
-	return NewCustomDB(ctx, dbName, creds, logger)
+func New(ctx context.Context, creds DBCredentials, logger logger.ExtFieldLogger, opts ...Option) (*DB, error) {
+	return NewCustomDB(ctx, dbName, creds, logger, opts...)
+}
+
+// clientOptions returns the client options which connect to the database
+// described by the credentials. We always use our own read and write concerns
+// and read preference, even if the URI sets different ones.
+func (creds DBCredentials) clientOptions() (*options.ClientOptions, error) {
+	if creds.URI == "" {
+		auth := options.Credential{
+			Username: creds.User,
+			Password: creds.Password,
+		}
+		opts := options.Client().
+			ApplyURI(fmt.Sprintf("mongodb://%s:%s/", creds.Host, creds.Port)).
+			SetAuth(auth)
+		return opts, nil
+	}
+	if !strings.HasPrefix(creds.URI, "mongodb://") && !strings.HasPrefix(creds.URI, "mongodb+srv://") {
+		return nil, errors.AddContext(errors.New("the scheme must be mongodb:// or mongodb+srv://"), ErrCtxInvalidURI)
+	}
+	opts := options.Client().ApplyURI(creds.URI)
+	if err := opts.Validate(); err != nil {
+		return nil, errors.AddContext(err, ErrCtxInvalidURI)
+	}
+	if len(opts.Hosts) == 0 {
+		return nil, errors.AddContext(errors.New("no hosts"), ErrCtxInvalidURI)
+	}
+	if creds.User != "" && (opts.Auth == nil || opts.Auth.Username == "") {
+		// The driver ignores the URI's auth options, e.g. its authSource,
+		// unless the URI holds a username, so we pick them up ourselves.
+		cs, err := connstring.Parse(creds.URI)
+		if err != nil {
+			return nil, errors.AddContext(err, ErrCtxInvalidURI)
+		}
+		opts.SetAuth(options.Credential{
+			AuthMechanism:           cs.AuthMechanism,
+			AuthMechanismProperties: cs.AuthMechanismProperties,
+			AuthSource:              cs.AuthSource,
+			Username:                creds.User,
+			Password:                creds.Password,
+		})
+	}
+	return opts, nil
 }
 
 // NewCustomDB creates a new database connection to a database with a custom name.
-func NewCustomDB(ctx context.Context, dbName string, creds DBCredentials, logger logger.ExtFieldLogger) (*DB, error) {
+func NewCustomDB(ctx context.Context, dbName string, creds DBCredentials, logger logger.ExtFieldLogger, customOpts ...Option) (*DB, error) {
 	if ctx == nil {
 		return nil, errors.New("invalid context provided")
 	}
@@ -68,48 +184,139 @@ func NewCustomDB(ctx context.Context, dbName string, creds DBCredentials, logger
 		return nil, errors.New("invalid logger provided")
 	}
 
-	auth := options.Credential{
-		Username: creds.User,
-		Password: creds.Password,
+	pdb := &DB{
+		lockDuration:      DefaultLockDuration,
+		maxDocSize:        DefaultMaxDocSize,
+		opTimeout:         MongoDefaultTimeout,
+		reportingReadPref: readpref.SecondaryPreferred(),
+		slowOpThreshold:   DefaultSlowOpThreshold,
+		staticCtx:         ctx,
+		staticLogger:      logger,
+		staticPoolStats:   &poolStats{},
+		staticConfigCache: &configCache{
+			entries: make(map[string]configEntry),
+		},
+		staticCommandStats: newCommandStats(),
+		staticTransactions: true,
+	}
+	for _, opt := range customOpts {
+		opt(pdb)
 	}
-	opts := options.Client().
-		ApplyURI(fmt.Sprintf("mongodb://%s:%s/", creds.Host, creds.Port)).
-		SetAuth(auth).
-		SetReadConcern(readconcern.Local()).
+	opts, err := creds.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts.SetReadConcern(readconcern.Local()).
 		SetReadPreference(readpref.Nearest()).
 		SetWriteConcern(writeconcern.New(writeconcern.WMajority(), writeconcern.WTimeout(30*time.Second))).
 		SetCompressors([]string{"zstd", "zlib", "snappy"})
+	opts.SetMonitor(pdb.staticCommandStats.monitor(pdb.commandMonitor))
+	opts.SetPoolMonitor(pdb.staticPoolStats.monitor())
+	if pdb.maxConnIdleTime > 0 {
+		opts.SetMaxConnIdleTime(pdb.maxConnIdleTime)
+	}
+	if pdb.maxPoolSize > 0 {
+		opts.SetMaxPoolSize(pdb.maxPoolSize)
+	}
+	if pdb.minPoolSize > 0 {
+		opts.SetMinPoolSize(pdb.minPoolSize)
+	}
 	c, err := mongo.Connect(ctx, opts)
 	if err != nil {
 		return nil, errors.AddContext(err, ErrCtxFailedToConnect)
 	}
 	db := c.Database(dbName)
-	err = ensureDBSchema(ctx, db, logger)
+	err = migrate(ctx, db, pdb.serverName, logger)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{
-		staticCtx:    ctx,
-		staticDB:     db,
-		staticLogger: logger,
-	}, nil
+	if pdb.staticTransactions {
+		pdb.staticTransactions, err = supportsTransactions(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		if !pdb.staticTransactions {
+			logger.Warn("The database doesn't support transactions. Multi-document operations won't be atomic.")
+		}
+	}
+	pdb.staticDB = db
+	return pdb, nil
 }
 
-// ConfigValue returns a cluster-wide configuration value, stored in the
-// database.
-func (db *DB) ConfigValue(ctx context.Context, key string) (string, error) {
-	sr := db.staticDB.Collection(collConfig).FindOne(ctx, bson.M{"key": key})
-	if sr.Err() != nil {
-		return "", sr.Err()
+// WithCommandMonitor makes the DB notify the given monitor of the commands it
+// sends to the database, e.g. in order to measure how much data they transfer.
+func WithCommandMonitor(m *event.CommandMonitor) Option {
+	return func(db *DB) {
+		db.commandMonitor = m
 	}
-	var result = struct {
-		Value string
-	}{}
-	err := sr.Decode(&result)
-	if err != nil {
-		return "", err
+}
+
+// WithConfigCacheTTL makes the DB cache the configuration values it reads for
+// the given duration, so the services which check them often don't hit the
+// database every time. Values we set through this DB invalidate its cache but
+// other instances only see them once their cached values expire. The cache is
+// disabled by default.
+func WithConfigCacheTTL(ttl time.Duration) Option {
+	return func(db *DB) {
+		db.staticConfigCache.ttl = ttl
+	}
+}
+
+// WithLockDuration sets the initial duration of the locks we put on skylinks
+// while we are trying to pin them. It defaults to DefaultLockDuration.
+func WithLockDuration(d time.Duration) Option {
+	return func(db *DB) {
+		db.lockDuration = d
+	}
+}
+
+// WithMaxConnIdleTime closes the connections to the database which have been
+// idle for longer than the given duration. Zero keeps the driver's default.
+func WithMaxConnIdleTime(d time.Duration) Option {
+	return func(db *DB) {
+		db.maxConnIdleTime = d
+	}
+}
+
+// WithPoolSize sets the minimum and the maximum number of connections the
+// driver keeps open to each database server. Zero keeps the driver's default.
+func WithPoolSize(min, max uint64) Option {
+	return func(db *DB) {
+		db.minPoolSize = min
+		db.maxPoolSize = max
+	}
+}
+
+// WithReportingReadPref sets the read preference of the reporting queries, e.g.
+// the stats, which don't need the latest data and which we'd rather keep off
+// the primary. It defaults to readpref.SecondaryPreferredMode.
+func WithReportingReadPref(mode readpref.Mode) Option {
+	return func(db *DB) {
+		rp, err := readpref.New(mode)
+		if err != nil {
+			db.staticLogger.Warn(errors.AddContext(err, "invalid reporting read preference, keeping the default"))
+			return
+		}
+		db.reportingReadPref = rp
+	}
+}
+
+// WithServerName tells the DB the name of the server it runs on. Before it
+// migrates the database, it records in the server's heartbeat that the server
+// runs this version of pinner. The migrations which can't run while older
+// versions are active rely on that.
+func WithServerName(server string) Option {
+	return func(db *DB) {
+		db.serverName = server
+	}
+}
+
+// WithoutTransactions makes WithTransaction run its callbacks without a
+// transaction, as it does when the deployment doesn't support them.
+func WithoutTransactions() Option {
+	return func(db *DB) {
+		db.staticTransactions = false
 	}
-	return result.Value, nil
 }
 
 // Disconnect closes the connection to the database in an orderly fashion.
@@ -117,6 +324,14 @@ func (db *DB) Disconnect(ctx context.Context) error {
 	return db.staticDB.Client().Disconnect(ctx)
 }
 
+// LockDuration returns the duration of the locks we put on skylinks while we
+// are trying to pin them.
+func (db *DB) LockDuration() time.Duration {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.lockDuration
+}
+
 // Ping sends a ping command to verify that the client can connect to the DB and
 // specifically to the primary.
 func (db *DB) Ping(ctx context.Context) error {
@@ -125,37 +340,50 @@ func (db *DB) Ping(ctx context.Context) error {
 	return db.staticDB.Client().Ping(ctx2, readpref.Primary())
 }
 
-// SetConfigValue updates a cluster-wide configuration value, stored in the
-// database.
-func (db *DB) SetConfigValue(ctx context.Context, key, value string) error {
-	opts := options.Update().SetUpsert(true)
-	filter := bson.M{"key": key}
-	update := bson.M{
-		"$set": bson.M{
-			"key":   key,
-			"value": value,
-		},
-	}
-	_, err := db.staticDB.Collection(collConfig).UpdateOne(ctx, filter, update, opts)
-	return err
+// reporting returns a handle of the given collection for the reporting queries,
+// i.e. the heavy reads which don't need the latest data, such as the stats. It
+// reads with the reporting read preference, see WithReportingReadPref, so those
+// queries don't compete with the writes on the primary. Correctness-critical
+// reads must not use it.
+func (db *DB) reporting(coll string) *mongo.Collection {
+	return db.staticDB.Collection(coll, options.Collection().SetReadPreference(db.reportingReadPref))
 }
 
-// ensureDBSchema checks that we have all collections and indexes we need and
-// creates them if needed.
-// See https://docs.mongodb.com/manual/indexes/
-// See https://docs.mongodb.com/manual/core/index-unique/
-func ensureDBSchema(ctx context.Context, db *mongo.Database, log logger.ExtFieldLogger) error {
-	for collName, models := range schema() {
-		coll, err := ensureCollection(ctx, db, collName)
-		if err != nil {
-			return err
-		}
-		iv := coll.Indexes()
-		names, err := iv.CreateMany(ctx, models)
-		if err != nil {
-			return errors.AddContext(err, "failed to create indexes")
+// SetLockDuration sets the duration of the locks we put on skylinks while we
+// are trying to pin them. It only affects the locks we put from now on. The
+// cluster-wide value is stored under conf.ConfLockDuration, which is where
+// the callers should get it from.
+func (db *DB) SetLockDuration(d time.Duration) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.lockDuration = d
+}
+
+// dropIndexes drops those of the given indexes which exist on the collection.
+func dropIndexes(ctx context.Context, coll *mongo.Collection, names []string, log logger.ExtFieldLogger) error {
+	iv := coll.Indexes()
+	c, err := iv.List(ctx)
+	if err != nil {
+		return errors.AddContext(err, "failed to list indexes")
+	}
+	var existing []struct {
+		Name string `bson:"name"`
+	}
+	err = c.All(ctx, &existing)
+	if err != nil {
+		return errors.AddContext(err, "failed to decode indexes")
+	}
+	for _, idx := range existing {
+		for _, name := range names {
+			if idx.Name != name {
+				continue
+			}
+			_, err = iv.DropOne(ctx, name)
+			if err != nil {
+				return errors.AddContext(err, fmt.Sprintf("failed to drop obsolete index '%s'", name))
+			}
+			log.Infof("Dropped obsolete index '%s' of collection '%s'", name, coll.Name())
 		}
-		log.Debugf("Ensured index exists: %v", names)
 	}
 	return nil
 }
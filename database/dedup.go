@@ -0,0 +1,107 @@
+package database
+
+import (
+	"context"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// corruptServersExamples is the number of skylinks with corrupt lists of
+	// servers AuditServers lists in its warning.
+	corruptServersExamples = 10
+)
+
+// SkylinksWithCorruptServers returns up to limit skylinks whose list of servers
+// holds a server more than once or an empty server name. Our own writes don't
+// produce such lists but older versions of pinner and manual edits did. They
+// skew num_servers and, with it, the number of pinners we count. See
+// DedupServers.
+func (db *DB) SkylinksWithCorruptServers(ctx context.Context, limit int) ([]string, error) {
+	ctx, done := db.operation(ctx, collSkylinks, "SkylinksWithCorruptServers")
+	defer done()
+	opts := options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(int64(limit))
+	c, err := db.staticDB.Collection(collSkylinks).Find(ctx, corruptServersFilter(), opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find skylinks with corrupt servers")
+	}
+	var results []struct {
+		Skylink string `bson:"_id"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode results")
+	}
+	skylinks := make([]string, 0, len(results))
+	for _, r := range results {
+		skylinks = append(skylinks, r.Skylink)
+	}
+	return skylinks, nil
+}
+
+// DedupServers removes the duplicate and empty server names from the lists of
+// servers of all skylinks, keeping the first occurrence of each server, and
+// updates their num_servers to match. It returns the number of skylinks it
+// repaired.
+func (db *DB) DedupServers(ctx context.Context) (int64, error) {
+	db.staticLogger.Trace("Entering DedupServers")
+	defer db.staticLogger.Trace("Exiting  DedupServers")
+	ctx, done := db.operation(ctx, collSkylinks, "DedupServers")
+	defer done()
+	update := withPipelineTimestamps(mongo.Pipeline{
+		{{"$set", bson.M{"servers": bson.M{"$reduce": bson.M{
+			"input":        bson.M{"$ifNull": bson.A{"$servers", bson.A{}}},
+			"initialValue": bson.A{},
+			"in": bson.M{"$cond": bson.A{
+				bson.M{"$or": bson.A{
+					bson.M{"$eq": bson.A{"$$this", ""}},
+					bson.M{"$in": bson.A{"$$this", "$$value"}},
+				}},
+				"$$value",
+				bson.M{"$concatArrays": bson.A{"$$value", bson.A{"$$this"}}},
+			}},
+		}}}}},
+		{{"$set", bson.M{"num_servers": bson.M{"$size": "$servers"}}}},
+	})
+	ur, err := db.staticDB.Collection(collSkylinks).UpdateMany(ctx, corruptServersFilter(), update)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to dedup servers")
+	}
+	return ur.ModifiedCount, nil
+}
+
+// AuditServers looks for skylinks with corrupt lists of servers, warns about
+// them and repairs them. See SkylinksWithCorruptServers.
+func (db *DB) AuditServers(ctx context.Context) error {
+	skylinks, err := db.SkylinksWithCorruptServers(ctx, corruptServersExamples)
+	if err != nil {
+		return err
+	}
+	if len(skylinks) == 0 {
+		db.staticLogger.Debug("No skylinks list duplicate or empty servers.")
+		return nil
+	}
+	db.staticLogger.Warnf("Found skylinks which list duplicate or empty servers, e.g. %v", skylinks)
+	n, err := db.DedupServers(ctx)
+	if err != nil {
+		return err
+	}
+	db.staticLogger.Infof("Removed the duplicate and empty servers of %d skylinks", n)
+	return nil
+}
+
+// corruptServersFilter returns the filter which matches the skylinks whose
+// list of servers holds a server more than once or an empty server name.
+func corruptServersFilter() bson.M {
+	servers := bson.M{"$ifNull": bson.A{"$servers", bson.A{}}}
+	return bson.M{"$expr": bson.M{"$or": bson.A{
+		bson.M{"$in": bson.A{"", servers}},
+		bson.M{"$ne": bson.A{
+			bson.M{"$size": bson.M{"$setUnion": bson.A{servers}}},
+			bson.M{"$size": servers},
+		}},
+	}}}
+}
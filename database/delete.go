@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SoftDeleteSkylink marks the skylink as deleted. The read queries don't see
+// soft-deleted skylinks, so to the rest of pinner it looks as if the skylink
+// doesn't exist, until RestoreSkylink brings it back or PurgeDeleted removes
+// it for good. Pinning the skylink again, or a server reporting that it pins
+// it, restores it as well. It returns ErrSkylinkNotExist if there is no such
+// skylink or if it's already deleted.
+//
+// It doesn't remove any servers from the skylink, so their loads still count
+// it.
+func (db *DB) SoftDeleteSkylink(ctx context.Context, skylink skymodules.Skylink) error {
+	db.staticLogger.Tracef("Entering SoftDeleteSkylink. Skylink: '%s'", skylink)
+	defer db.staticLogger.Tracef("Exiting  SoftDeleteSkylink. Skylink: '%s'", skylink)
+	ctx, done := db.operation(ctx, collSkylinks, "SoftDeleteSkylink")
+	defer done()
+	filter := notDeleted(bson.M{"_id": skylink.String()})
+	ur, err := db.staticDB.Collection(collSkylinks).UpdateOne(ctx, filter, softDeleteUpdate())
+	if err != nil {
+		return errors.AddContext(err, "failed to delete skylink")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrSkylinkNotExist
+	}
+	return nil
+}
+
+// RestoreSkylink undoes the soft-deletion of the skylink. Restoring a skylink
+// which isn't deleted has no effect. It returns ErrSkylinkNotExist if there is
+// no such skylink, e.g. because PurgeDeleted already removed it.
+func (db *DB) RestoreSkylink(ctx context.Context, skylink skymodules.Skylink) error {
+	db.staticLogger.Tracef("Entering RestoreSkylink. Skylink: '%s'", skylink)
+	defer db.staticLogger.Tracef("Exiting  RestoreSkylink. Skylink: '%s'", skylink)
+	ctx, done := db.operation(ctx, collSkylinks, "RestoreSkylink")
+	defer done()
+	filter := bson.M{"_id": skylink.String()}
+	update := withTimestamps(bson.M{"$unset": bson.M{"deleted_at": ""}})
+	ur, err := db.staticDB.Collection(collSkylinks).UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to restore skylink")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrSkylinkNotExist
+	}
+	return nil
+}
+
+// PurgeDeleted removes the skylinks which have been soft-deleted for longer
+// than the given retention period from the database for good. It returns the
+// number of removed skylinks.
+func (db *DB) PurgeDeleted(ctx context.Context, retention time.Duration) (int64, error) {
+	db.staticLogger.Tracef("Entering PurgeDeleted. Retention: %v", retention)
+	defer db.staticLogger.Tracef("Exiting  PurgeDeleted. Retention: %v", retention)
+	ctx, done := db.operation(ctx, collSkylinks, "PurgeDeleted")
+	defer done()
+	if retention <= 0 {
+		return 0, errors.New("invalid retention period")
+	}
+	filter := bson.M{
+		"deleted_at": bson.M{"$type": "date"},
+		// We use the database's notion of time, like DeleteUnpinned.
+		"$expr": bson.M{"$lt": bson.A{
+			"$deleted_at",
+			bson.M{"$subtract": bson.A{"$$NOW", retention.Milliseconds()}},
+		}},
+	}
+	dr, err := db.staticDB.Collection(collSkylinks).DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to purge deleted skylinks")
+	}
+	return dr.DeletedCount, nil
+}
+
+// notDeleted returns a copy of the given filter which excludes the soft-deleted
+// skylinks. All queries which read skylinks on behalf of the rest of pinner
+// need to use it.
+func notDeleted(filter bson.M) bson.M {
+	f := make(bson.M, len(filter)+1)
+	for k, v := range filter {
+		f[k] = v
+	}
+	f["deleted_at"] = bson.M{"$exists": false}
+	return f
+}
+
+// softDeleteUpdate returns the update which soft-deletes a skylink.
+func softDeleteUpdate() bson.M {
+	return withTimestamps(bson.M{"$currentDate": bson.M{"deleted_at": true}})
+}
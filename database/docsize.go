@@ -0,0 +1,187 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// DefaultMaxDocSize is the default size in bytes above which we refuse
+	// to grow a skylink's document. It's well below MongoDB's hard limit of
+	// 16MiB, so we notice the growing documents long before they become a
+	// problem. See WithMaxDocSize.
+	DefaultMaxDocSize = 8 << 20
+	// docSizeSample is the number of documents we sample in order to
+	// estimate the percentiles of the documents' sizes.
+	docSizeSample = 1000
+	// largestDocs is the number of largest documents we report.
+	largestDocs = 10
+)
+
+var (
+	// ErrSkylinkTooLarge is returned when we refuse to add a server or an
+	// owner to a skylink because its document reached the maximum size.
+	ErrSkylinkTooLarge = errors.New("skylink document is too large")
+)
+
+type (
+	// DocSize is the size of a skylink's document in bytes.
+	DocSize struct {
+		Skylink string `json:"skylink" bson:"_id"`
+		Size    int64  `json:"size" bson:"size"`
+	}
+
+	// DocSizeStats describes the sizes of the skylinks' documents in bytes.
+	DocSizeStats struct {
+		// Documents is the number of documents.
+		Documents int64 `json:"documents"`
+		// Max is the size of the largest document.
+		Max int64 `json:"max"`
+		// P50, P90 and P99 are the percentiles of the sizes, estimated from
+		// a sample of the documents.
+		P50 int64 `json:"p50"`
+		P90 int64 `json:"p90"`
+		P99 int64 `json:"p99"`
+		// Largest are the largest documents, largest first.
+		Largest []DocSize `json:"largest"`
+	}
+)
+
+// WithMaxDocSize sets the size in bytes above which we refuse to add servers or
+// owners to a skylink's document and return ErrSkylinkTooLarge instead. It
+// defaults to DefaultMaxDocSize. Zero disables the check.
+func WithMaxDocSize(size int64) Option {
+	return func(db *DB) {
+		db.maxDocSize = size
+	}
+}
+
+// DocSizeStats returns the stats of the sizes of the skylinks' documents. It
+// logs a warning listing the largest documents if any of them is at least half
+// the maximum size. It has to read the whole collection, so it's slow on large
+// databases.
+func (db *DB) DocSizeStats(ctx context.Context) (DocSizeStats, error) {
+	ctx, done := db.operation(ctx, collSkylinks, "DocSizeStats")
+	defer done()
+	pipeline := mongo.Pipeline{
+		{{"$project", bson.M{"size": bson.M{"$bsonSize": "$$ROOT"}}}},
+		{{"$facet", bson.M{
+			"count":   bson.A{bson.M{"$count": "n"}},
+			"largest": bson.A{bson.M{"$sort": bson.M{"size": -1}}, bson.M{"$limit": largestDocs}},
+			"sample":  bson.A{bson.M{"$sample": bson.M{"size": docSizeSample}}, bson.M{"$project": bson.M{"_id": 0, "size": 1}}},
+		}}},
+	}
+	c, err := db.reporting(collSkylinks).Aggregate(ctx, pipeline)
+	if err != nil {
+		return DocSizeStats{}, errors.AddContext(err, "failed to aggregate document sizes")
+	}
+	var results []struct {
+		Count []struct {
+			N int64 `bson:"n"`
+		} `bson:"count"`
+		Largest []DocSize `bson:"largest"`
+		Sample  []struct {
+			Size int64 `bson:"size"`
+		} `bson:"sample"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return DocSizeStats{}, errors.AddContext(err, "failed to decode document sizes")
+	}
+	stats := DocSizeStats{Largest: []DocSize{}}
+	if len(results) == 0 || len(results[0].Count) == 0 {
+		return stats, nil
+	}
+	r := results[0]
+	stats.Documents = r.Count[0].N
+	stats.Largest = r.Largest
+	if len(r.Largest) > 0 {
+		stats.Max = r.Largest[0].Size
+	}
+	sizes := make([]int64, 0, len(r.Sample))
+	for _, s := range r.Sample {
+		sizes = append(sizes, s.Size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	stats.P50 = percentile(sizes, 50)
+	stats.P90 = percentile(sizes, 90)
+	stats.P99 = percentile(sizes, 99)
+
+	if db.maxDocSize > 0 && stats.Max >= db.maxDocSize/2 {
+		var large []string
+		for _, d := range stats.Largest {
+			if d.Size >= db.maxDocSize/2 {
+				large = append(large, fmt.Sprintf("%s (%d bytes)", d.Skylink, d.Size))
+			}
+		}
+		db.staticLogger.Warnf("Skylink documents approaching the maximum size of %d bytes: %v", db.maxDocSize, large)
+	}
+	return stats, nil
+}
+
+// percentile returns the p-th percentile of the given sorted values, using the
+// nearest-rank method. It returns zero if there are no values.
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// withinSizeCap returns a copy of the given filter which only matches the
+// skylinks which already have the given value in the given array field or whose
+// document is smaller than the maximum size, i.e. the ones we can add the value
+// to. It returns the filter unchanged if the check is disabled.
+func (db *DB) withinSizeCap(filter bson.M, field, value string) bson.M {
+	if db.maxDocSize <= 0 {
+		return filter
+	}
+	f := make(bson.M, len(filter)+1)
+	for k, v := range filter {
+		f[k] = v
+	}
+	f["$or"] = bson.A{
+		bson.M{field: value},
+		bson.M{"$expr": bson.M{"$lt": bson.A{bson.M{"$bsonSize": "$$ROOT"}, db.maxDocSize}}},
+	}
+	return f
+}
+
+// oversizedSkylinks returns the skylinks matched by the given filter whose
+// document reached the maximum size. It returns nothing if the check is
+// disabled.
+func (db *DB) oversizedSkylinks(ctx context.Context, filter bson.M) ([]string, error) {
+	if db.maxDocSize <= 0 {
+		return nil, nil
+	}
+	pipeline := mongo.Pipeline{
+		{{"$match", filter}},
+		{{"$match", bson.M{"$expr": bson.M{"$gte": bson.A{bson.M{"$bsonSize": "$$ROOT"}, db.maxDocSize}}}}},
+		{{"$project", bson.M{"_id": 1}}},
+	}
+	c, err := db.staticDB.Collection(collSkylinks).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find oversized skylinks")
+	}
+	var results []struct {
+		Skylink string `bson:"_id"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode oversized skylinks")
+	}
+	skylinks := make([]string, 0, len(results))
+	for _, r := range results {
+		skylinks = append(skylinks, r.Skylink)
+	}
+	return skylinks, nil
+}
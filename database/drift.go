@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// DriftReport describes the discrepancies between the skylinks the users
+	// pin according to accounts and the ones the database marks as pinned,
+	// as found by a reconciliation. The samples hold a few skylinks of each
+	// discrepancy class, so an operator can investigate.
+	DriftReport struct {
+		// DryRun is true if the reconciliation only reported the drift.
+		// Otherwise, it marked the missing and unpinned skylinks as
+		// pinned.
+		DryRun    bool      `bson:"dry_run"`
+		StartTime time.Time `bson:"start_time"`
+		EndTime   time.Time `bson:"end_time"`
+		// NumAccountsSkylinks is the number of distinct valid skylinks which
+		// the users pin according to accounts.
+		NumAccountsSkylinks int `bson:"num_accounts_skylinks"`
+		// NumInvalidSkylinks is the number of invalid skylinks reported by
+		// accounts. We ignore them.
+		NumInvalidSkylinks int      `bson:"num_invalid_skylinks"`
+		InvalidSample      []string `bson:"invalid_sample"`
+		// NumMissing is the number of skylinks the users pin, which the
+		// database doesn't know about.
+		NumMissing    int      `bson:"num_missing"`
+		MissingSample []string `bson:"missing_sample"`
+		// NumUnpinned is the number of skylinks the users pin, which the
+		// database marks as unpinned or deleted.
+		NumUnpinned    int      `bson:"num_unpinned"`
+		UnpinnedSample []string `bson:"unpinned_sample"`
+		// NumUnreferenced is the number of skylinks the database marks as
+		// pinned, which no user pins.
+		NumUnreferenced    int      `bson:"num_unreferenced"`
+		UnreferencedSample []string `bson:"unreferenced_sample"`
+	}
+)
+
+// LatestDriftReport returns the most recent drift report. It returns
+// mongo.ErrNoDocuments if there are none.
+func (db *DB) LatestDriftReport(ctx context.Context) (DriftReport, error) {
+	ctx, done := db.operation(ctx, collDriftReports, "LatestDriftReport")
+	defer done()
+	// We store a handful of reports per week, so the collection doesn't
+	// need an index.
+	opts := options.FindOne().SetProjection(bson.M{"_id": 0}).SetSort(bson.M{"end_time": -1})
+	sr := db.staticDB.Collection(collDriftReports).FindOne(ctx, bson.M{}, opts)
+	if sr.Err() == mongo.ErrNoDocuments {
+		return DriftReport{}, sr.Err()
+	}
+	if sr.Err() != nil {
+		return DriftReport{}, errors.AddContext(sr.Err(), "failed to find drift report")
+	}
+	var r DriftReport
+	err := sr.Decode(&r)
+	if err != nil {
+		return DriftReport{}, errors.AddContext(err, "failed to decode drift report")
+	}
+	return r, nil
+}
+
+// SaveDriftReport stores the given drift report.
+func (db *DB) SaveDriftReport(ctx context.Context, r DriftReport) error {
+	ctx, done := db.operation(ctx, collDriftReports, "SaveDriftReport")
+	defer done()
+	_, err := db.staticDB.Collection(collDriftReports).InsertOne(ctx, r)
+	return err
+}
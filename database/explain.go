@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type (
+	// QueryPlan describes the plan MongoDB picks for a query.
+	QueryPlan struct {
+		// Stages are the stages of the winning plan, outermost first.
+		Stages []string
+		// Indexes are the names of the indexes the winning plan uses.
+		Indexes []string
+		// CollScan tells us that the winning plan scans the whole
+		// collection.
+		CollScan bool
+	}
+)
+
+// WithUnderpinnedHint makes FindAndLockUnderpinned hint MongoDB to use the
+// index with the given name, e.g. "num_servers", in case the query planner
+// picks a worse plan on its own. An empty name leaves the choice to the query
+// planner, which is the default.
+func WithUnderpinnedHint(index string) Option {
+	return func(db *DB) {
+		db.underpinnedHint = index
+	}
+}
+
+// ExplainUnderpinned returns the plan MongoDB picks for the query with which
+// FindAndLockUnderpinned looks for underpinned skylinks. It doesn't lock any
+// skylinks.
+func (db *DB) ExplainUnderpinned(ctx context.Context, server string, minPinners int) (QueryPlan, error) {
+	ctx, done := db.operation(ctx, collSkylinks, "ExplainUnderpinned")
+	defer done()
+	cmd := bson.D{
+		{"findAndModify", collSkylinks},
+		{"query", underpinnedFilter(server, minPinners)},
+		{"update", db.lockUpdate(server)},
+	}
+	if db.underpinnedHint != "" {
+		cmd = append(cmd, bson.E{"hint", db.underpinnedHint})
+	}
+	var result struct {
+		QueryPlanner struct {
+			WinningPlan bson.M `bson:"winningPlan"`
+		} `bson:"queryPlanner"`
+	}
+	err := db.staticDB.RunCommand(ctx, bson.D{{"explain", cmd}, {"verbosity", "queryPlanner"}}).Decode(&result)
+	if err != nil {
+		return QueryPlan{}, errors.AddContext(err, "failed to explain the underpinned query")
+	}
+	var plan QueryPlan
+	plan.walk(result.QueryPlanner.WinningPlan)
+	return plan, nil
+}
+
+// AuditUnderpinned explains the underpinned query and logs its plan. It warns
+// if the plan scans the whole collection, which gets slow on large databases.
+func (db *DB) AuditUnderpinned(ctx context.Context, server string, minPinners int) error {
+	plan, err := db.ExplainUnderpinned(ctx, server, minPinners)
+	if err != nil {
+		return err
+	}
+	db.staticLogger.Debugf("The underpinned query runs with stages %v and indexes %v", plan.Stages, plan.Indexes)
+	if plan.CollScan {
+		db.staticLogger.Warnf("The underpinned query scans the whole skylinks collection. Consider hinting it to use an index via PINNER_DB_UNDERPINNED_HINT.")
+	}
+	return nil
+}
+
+// walk adds the stages of the given plan and of all of its input stages to the
+// QueryPlan. The layout of the plans differs between the versions of MongoDB,
+// so we look for stages in all nested documents.
+func (qp *QueryPlan) walk(v interface{}) {
+	switch v := v.(type) {
+	case bson.M:
+		if stage, ok := v["stage"].(string); ok {
+			qp.Stages = append(qp.Stages, stage)
+			if stage == "COLLSCAN" {
+				qp.CollScan = true
+			}
+		}
+		if index, ok := v["indexName"].(string); ok {
+			qp.Indexes = append(qp.Indexes, index)
+		}
+		for _, key := range []string{"queryPlan", "inputStage", "inputStages", "outerStage", "innerStage"} {
+			if child, ok := v[key]; ok {
+				qp.walk(child)
+			}
+		}
+	case bson.A:
+		for _, child := range v {
+			qp.walk(child)
+		}
+	}
+}
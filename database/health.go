@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	// healthCheckTimeout is how long Healthy waits for the primary to answer.
+	healthCheckTimeout = 2 * time.Second
+)
+
+type (
+	// PoolStats describes the pool of connections to the database.
+	PoolStats struct {
+		// Open is the number of open connections.
+		Open int64 `json:"open"`
+		// InUse is the number of connections which are currently checked
+		// out of the pool.
+		InUse int64 `json:"inUse"`
+		// CheckoutFailures is the number of times we failed to get a
+		// connection from the pool, e.g. because the database was
+		// unreachable.
+		CheckoutFailures int64 `json:"checkoutFailures"`
+		// Cleared is the number of times the driver dropped all connections
+		// to a server, e.g. because it restarted.
+		Cleared int64 `json:"cleared"`
+	}
+
+	// poolStats keeps track of the pool of connections via the driver's pool
+	// events.
+	poolStats struct {
+		open             int64
+		inUse            int64
+		checkoutFailures int64
+		cleared          int64
+	}
+)
+
+// Healthy pings the primary with a short timeout. It returns nil if the
+// primary answered. The driver reconnects on its own after outages, Healthy
+// only tells us whether it has succeeded. We log the outages and how long they
+// lasted.
+func (db *DB) Healthy(ctx context.Context) error {
+	ctx2, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	err := db.staticDB.Client().Ping(ctx2, readpref.Primary())
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err != nil {
+		if db.unhealthySince.IsZero() {
+			db.unhealthySince = time.Now()
+			db.staticLogger.Warn(errors.AddContext(err, "lost the connection to the database"))
+		}
+		return errors.AddContext(err, "the database is unreachable")
+	}
+	if !db.unhealthySince.IsZero() {
+		db.staticLogger.Infof("Reconnected to the database after %v", time.Since(db.unhealthySince))
+		db.unhealthySince = time.Time{}
+	}
+	return nil
+}
+
+// PoolStats returns the current stats of the pool of connections to the
+// database.
+func (db *DB) PoolStats() PoolStats {
+	return PoolStats{
+		Open:             atomic.LoadInt64(&db.staticPoolStats.open),
+		InUse:            atomic.LoadInt64(&db.staticPoolStats.inUse),
+		CheckoutFailures: atomic.LoadInt64(&db.staticPoolStats.checkoutFailures),
+		Cleared:          atomic.LoadInt64(&db.staticPoolStats.cleared),
+	}
+}
+
+// monitor returns a pool monitor which updates the stats.
+func (ps *poolStats) monitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			switch e.Type {
+			case event.ConnectionCreated:
+				atomic.AddInt64(&ps.open, 1)
+			case event.ConnectionClosed:
+				atomic.AddInt64(&ps.open, -1)
+			case event.GetSucceeded:
+				atomic.AddInt64(&ps.inUse, 1)
+			case event.ConnectionReturned:
+				atomic.AddInt64(&ps.inUse, -1)
+			case event.GetFailed:
+				atomic.AddInt64(&ps.checkoutFailures, 1)
+			case event.PoolCleared:
+				atomic.AddInt64(&ps.cleared, 1)
+			}
+		},
+	}
+}
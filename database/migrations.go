@@ -0,0 +1,734 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/skynetlabs/pinner/logger"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// confSchemaVersion is the key of the configuration document which holds
+	// the ID of the last migration applied to the database.
+	confSchemaVersion = "schema_version"
+	// confMigrationLock is the key of the configuration document which
+	// serves as a lock, so only one instance runs the migrations at a time.
+	confMigrationLock = "schema_migration_lock"
+	// confKeySkylinksProgress is the key of the configuration document which
+	// holds the ID of the last skylink keySkylinksBySkylink copied, so it
+	// can resume the copy where it stopped.
+	confKeySkylinksProgress = "schema_migration_key_skylinks_progress"
+
+	// migrationLockDuration is how long a migration lock is valid. If the
+	// instance holding it dies, the others take over once it expires.
+	migrationLockDuration = 10 * time.Minute
+	// migrationLockRetry is how long we wait before we check again whether
+	// the instance holding the migration lock is done.
+	migrationLockRetry = time.Second
+	// migrationBatchSize is the number of documents the migrations which
+	// copy documents copy at a time.
+	migrationBatchSize = 1000
+	// activeServerWindow is how recently a server needs to have swept for us
+	// to consider it active. Servers sweep once a day.
+	activeServerWindow = 48 * time.Hour
+)
+
+var (
+	// ErrOldServersActive is returned when a migration can't run because
+	// servers which run an older version of pinner, which doesn't know the
+	// migration, are still active. Their writes would get lost.
+	ErrOldServersActive = errors.New("servers running an older version of pinner are active")
+)
+
+type (
+	// migration is a one-time change to the database. Migrations must be
+	// safe to run again if they fail midway.
+	migration struct {
+		id   int
+		name string
+		fn   func(ctx context.Context, db *mongo.Database, log logger.ExtFieldLogger) error
+	}
+
+	// legacySkylink is the layout of the skylink documents before migration
+	// 8 made the skylinks their IDs. The migrations which run before it must
+	// use it instead of Skylink.
+	legacySkylink struct {
+		ID        primitive.ObjectID `bson:"_id"`
+		Skylink   string             `bson:"skylink"`
+		Servers   []string           `bson:"servers"`
+		Pinned    bool               `bson:"pinned"`
+		Size      uint64             `bson:"size"`
+		Blocked   bool               `bson:"blocked"`
+		Owners    []string           `bson:"owners"`
+		CreatedAt time.Time          `bson:"created_at"`
+	}
+)
+
+// migrations returns the ordered list of all migrations. New migrations go at
+// the end, with an ID one higher than the last one. Never change or reorder the
+// existing ones.
+func migrations() []migration {
+	return []migration{
+		{id: 1, name: "create collections and indexes", fn: ensureDBSchema},
+		{id: 2, name: "backfill the skylinks' created_at", fn: backfillCreatedAt},
+		{id: 3, name: "compute the server loads", fn: createServerLoads},
+		{id: 4, name: "backfill the unpinned skylinks' unpinned_at", fn: backfillUnpinnedAt},
+		{id: 5, name: "backfill the skylinks' num_servers", fn: backfillNumServers},
+		{id: 6, name: "backfill the skylinks' missing servers", fn: backfillServers},
+		{id: 7, name: "canonicalize the skylinks", fn: canonicalizeSkylinks},
+		{id: 8, name: "key the skylinks by their skylink", fn: keySkylinksBySkylink},
+		{id: 9, name: "index the soft-deleted skylinks", fn: indexDeletedSkylinks},
+	}
+}
+
+// ensureDBSchema creates the collections and indexes of the first schema
+// version and drops the indexes older versions of pinner created which that
+// version didn't need. It's the first migration, see migrations, so the
+// indexes are frozen here. Later changes go into migrations of their own.
+// See https://docs.mongodb.com/manual/indexes/
+// See https://docs.mongodb.com/manual/core/index-unique/
+func ensureDBSchema(ctx context.Context, db *mongo.Database, log logger.ExtFieldLogger) error {
+	baseline := map[string][]mongo.IndexModel{
+		collSkylinks: {
+			{
+				Keys:    bson.D{{"skylink", 1}},
+				Options: options.Index().SetName("skylink").SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{"locked_by", 1}},
+				Options: options.Index().SetName("locked_by"),
+			},
+			{
+				Keys:    bson.D{{"lock_expires", 1}},
+				Options: options.Index().SetName("lock_expires"),
+			},
+			{
+				Keys:    bson.D{{"servers", 1}},
+				Options: options.Index().SetName("servers"),
+			},
+			{
+				Keys:    bson.D{{"pinned", 1}},
+				Options: options.Index().SetName("pinned"),
+			},
+			{
+				Keys:    bson.D{{"pinned", 1}, {"lock_expires", 1}},
+				Options: options.Index().SetName("pinned_lock_expires"),
+			},
+		},
+		collServers: {
+			{
+				Keys:    bson.D{{"name", 1}},
+				Options: options.Index().SetName("name").SetUnique(true),
+			},
+		},
+		collConfig: {
+			{
+				Keys:    bson.D{{"key", 1}},
+				Options: options.Index().SetName("key").SetUnique(true),
+			},
+		},
+	}
+	for collName, models := range baseline {
+		coll, err := ensureCollection(ctx, db, collName)
+		if err != nil {
+			return err
+		}
+		iv := coll.Indexes()
+		names, err := iv.CreateMany(ctx, models)
+		if err != nil {
+			return errors.AddContext(err, "failed to create indexes")
+		}
+		log.Debugf("Ensured index exists: %v", names)
+	}
+	// The "unpin" field was replaced by "pinned".
+	return dropIndexes(ctx, db.Collection(collSkylinks), []string{"unpin"}, log)
+}
+
+// backfillCreatedAt sets the created_at field of the skylinks which don't have
+// one to the time their ID was generated, which is when they were inserted.
+func backfillCreatedAt(ctx context.Context, db *mongo.Database, log logger.ExtFieldLogger) error {
+	filter := bson.M{"created_at": bson.M{"$exists": false}}
+	update := mongo.Pipeline{
+		{{"$set", bson.M{"created_at": bson.M{"$toDate": "$_id"}}}},
+	}
+	ur, err := db.Collection(collSkylinks).UpdateMany(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to backfill created_at")
+	}
+	log.Infof("Backfilled created_at of %d skylinks", ur.ModifiedCount)
+	return nil
+}
+
+// backfillUnpinnedAt sets the unpinned_at field of the unpinned skylinks which
+// don't have one. We don't know when they were unpinned, so we use the last time
+// they changed or, if we don't know that either, now. This errs on the side of
+// keeping them around for longer.
+func backfillUnpinnedAt(ctx context.Context, db *mongo.Database, log logger.ExtFieldLogger) error {
+	filter := bson.M{
+		"pinned":      false,
+		"unpinned_at": bson.M{"$exists": false},
+	}
+	update := mongo.Pipeline{
+		{{"$set", bson.M{"unpinned_at": bson.M{"$ifNull": bson.A{"$updated_at", "$$NOW"}}}}},
+	}
+	ur, err := db.Collection(collSkylinks).UpdateMany(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to backfill unpinned_at")
+	}
+	log.Infof("Backfilled unpinned_at of %d skylinks", ur.ModifiedCount)
+	return nil
+}
+
+// backfillNumServers sets the num_servers field of all skylinks to the number of
+// their servers and creates its index. We recompute the skylinks which already
+// have the field as well, in case an older version of pinner changed their
+// servers since.
+func backfillNumServers(ctx context.Context, db *mongo.Database, log logger.ExtFieldLogger) error {
+	update := mongo.Pipeline{
+		{{"$set", bson.M{"num_servers": bson.M{"$size": bson.M{"$ifNull": bson.A{"$servers", bson.A{}}}}}}},
+	}
+	ur, err := db.Collection(collSkylinks).UpdateMany(ctx, bson.M{}, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to backfill num_servers")
+	}
+	log.Infof("Backfilled num_servers of %d skylinks", ur.ModifiedCount)
+	_, err = db.Collection(collSkylinks).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"num_servers", 1}},
+		Options: options.Index().SetName("num_servers"),
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to create the num_servers index")
+	}
+	return nil
+}
+
+// backfillServers sets the servers of the skylinks which don't have any to an
+// empty list. Older versions of pinner created such skylinks when they marked
+// skylinks they didn't know as pinned or unpinned.
+func backfillServers(ctx context.Context, db *mongo.Database, log logger.ExtFieldLogger) error {
+	filter := bson.M{"servers": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{
+		"servers":     bson.A{},
+		"num_servers": 0,
+	}}
+	ur, err := db.Collection(collSkylinks).UpdateMany(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to backfill servers")
+	}
+	log.Infof("Backfilled servers of %d skylinks", ur.ModifiedCount)
+	return nil
+}
+
+// canonicalizeSkylinks re-keys the skylinks which we stored in an encoding other
+// than their canonical one. If the canonical skylink exists as well, we merge
+// the two documents into the canonical one. Strings which aren't valid
+// skylinks are left alone. We recompute the server loads at the end because
+// the merges might have counted skylinks twice.
+func canonicalizeSkylinks(ctx context.Context, db *mongo.Database, log logger.ExtFieldLogger) error {
+	coll := db.Collection(collSkylinks)
+	opts := options.Find().SetProjection(bson.M{"skylink": 1})
+	c, err := coll.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return errors.AddContext(err, "failed to list skylinks")
+	}
+	defer func() {
+		_ = c.Close(ctx)
+	}()
+	var rekeyed, merged, invalid int
+	for c.Next(ctx) {
+		var doc legacySkylink
+		if err = c.Decode(&doc); err != nil {
+			return errors.AddContext(err, "failed to decode skylink")
+		}
+		canonical, err := canonicalSkylink(doc.Skylink)
+		if err != nil {
+			invalid++
+			continue
+		}
+		if canonical == doc.Skylink {
+			continue
+		}
+		_, err = coll.UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{"$set": bson.M{"skylink": canonical}})
+		if err == nil {
+			rekeyed++
+			continue
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return errors.AddContext(err, fmt.Sprintf("failed to re-key skylink '%s'", doc.Skylink))
+		}
+		err = mergeSkylink(ctx, coll, doc.ID, canonical)
+		if err != nil {
+			return errors.AddContext(err, fmt.Sprintf("failed to merge skylink '%s' into '%s'", doc.Skylink, canonical))
+		}
+		merged++
+	}
+	if err = c.Err(); err != nil {
+		return errors.AddContext(err, "failed to iterate over skylinks")
+	}
+	if invalid > 0 {
+		log.Warnf("Found %d invalid skylinks while canonicalizing the skylinks", invalid)
+	}
+	log.Infof("Canonicalized %d skylinks, merged %d duplicates", rekeyed+merged, merged)
+	if merged == 0 {
+		return nil
+	}
+	return reconcileServerLoads(ctx, db)
+}
+
+// mergeSkylink merges the skylink document with the given ID into the one of
+// the canonical skylink and deletes it. The merged skylink is pinned by the
+// servers and owned by the owners of both documents. It's pinned unless both
+// were unpinned and blocked if either was blocked.
+func mergeSkylink(ctx context.Context, coll *mongo.Collection, id primitive.ObjectID, canonical string) error {
+	var dup legacySkylink
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&dup)
+	if err == mongo.ErrNoDocuments {
+		// Someone else merged it already.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	update := bson.M{
+		"$addToSet": bson.M{"servers": bson.M{"$each": append([]string{}, dup.Servers...)}},
+		"$max":      bson.M{"size": dup.Size},
+	}
+	if len(dup.Owners) > 0 {
+		update["$addToSet"].(bson.M)["owners"] = bson.M{"$each": dup.Owners}
+	}
+	set := bson.M{}
+	if dup.Pinned {
+		set["pinned"] = true
+		update["$unset"] = bson.M{"unpinned_at": ""}
+	}
+	if dup.Blocked {
+		set["blocked"] = true
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if !dup.CreatedAt.IsZero() {
+		update["$min"] = bson.M{"created_at": dup.CreatedAt}
+	}
+	// We can't use withTimestamps because its $setOnInsert of created_at
+	// conflicts with the $min above.
+	update["$currentDate"] = bson.M{"updated_at": true}
+	_, err = coll.UpdateOne(ctx, bson.M{"skylink": canonical}, update)
+	if err != nil {
+		return err
+	}
+	// Keep num_servers in sync with the merged servers.
+	numServers := mongo.Pipeline{
+		{{"$set", bson.M{"num_servers": bson.M{"$size": bson.M{"$ifNull": bson.A{"$servers", bson.A{}}}}}}},
+	}
+	_, err = coll.UpdateOne(ctx, bson.M{"skylink": canonical}, numServers)
+	if err != nil {
+		return err
+	}
+	_, err = coll.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// keySkylinksBySkylink makes the skylinks the IDs of their documents. This
+// drops the separate unique index on the skylinks and makes the collection
+// straightforward to shard by its ID. MongoDB can't change the ID of a
+// document, so we copy the skylinks into a new collection and swap it for the
+// old one. That needs the database user to be allowed to rename collections,
+// see the README.
+//
+// The writes of servers which still run an older version of pinner would get
+// lost while we copy, so we refuse to run while any of them are active. The
+// servers which run this version wait for the migration to finish before they
+// write anything. If we fail midway, we resume the copy where it stopped.
+func keySkylinksBySkylink(ctx context.Context, db *mongo.Database, log logger.ExtFieldLogger) error {
+	coll := db.Collection(collSkylinks)
+	// The documents we've already copied don't have a skylink field.
+	err := coll.FindOne(ctx, bson.M{"skylink": bson.M{"$exists": true}}).Err()
+	if err != nil && err != mongo.ErrNoDocuments {
+		return errors.AddContext(err, "failed to look for skylinks to copy")
+	}
+	if err == nil {
+		err = ensureNoOldServers(ctx, db, 8)
+		if err != nil {
+			return err
+		}
+		tmp := collSkylinks + "_keyed"
+		n, err := copyKeyedSkylinks(ctx, db, tmp, log)
+		if err != nil {
+			return err
+		}
+		rename := bson.D{
+			{"renameCollection", db.Name() + "." + tmp},
+			{"to", db.Name() + "." + collSkylinks},
+			{"dropTarget", true},
+		}
+		err = db.Client().Database("admin").RunCommand(ctx, rename).Err()
+		if err != nil {
+			return errors.AddContext(err, "failed to replace the skylinks collection")
+		}
+		log.Infof("Keyed %d skylinks by their skylink", n)
+	}
+	// The copy is done, so we don't need its progress anymore.
+	_, err = db.Collection(collConfig).DeleteOne(ctx, bson.M{"key": confKeySkylinksProgress})
+	if err != nil {
+		return errors.AddContext(err, "failed to delete the progress of the copy")
+	}
+	// The copy doesn't have any indexes but its ID index, so we recreate the
+	// ones the collection had at this schema version. The collections which
+	// we didn't need to copy still have the separate skylink index.
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{"locked_by", 1}},
+			Options: options.Index().SetName("locked_by"),
+		},
+		{
+			Keys:    bson.D{{"lock_expires", 1}},
+			Options: options.Index().SetName("lock_expires"),
+		},
+		{
+			Keys:    bson.D{{"servers", 1}},
+			Options: options.Index().SetName("servers"),
+		},
+		{
+			Keys:    bson.D{{"pinned", 1}},
+			Options: options.Index().SetName("pinned"),
+		},
+		{
+			Keys:    bson.D{{"pinned", 1}, {"lock_expires", 1}},
+			Options: options.Index().SetName("pinned_lock_expires"),
+		},
+		{
+			Keys:    bson.D{{"num_servers", 1}},
+			Options: options.Index().SetName("num_servers"),
+		},
+	}
+	_, err = coll.Indexes().CreateMany(ctx, indexes)
+	if err != nil {
+		return errors.AddContext(err, "failed to create the skylinks indexes")
+	}
+	return dropIndexes(ctx, coll, []string{"skylink"}, log)
+}
+
+// copyKeyedSkylinks copies the skylinks which have a skylink field into the
+// given collection, with their skylinks as their IDs. It copies them in batches,
+// in the order of their IDs, and records the ID of the last one it copied
+// after each batch, so it resumes where it stopped if it fails midway. It
+// returns the number of skylinks it copied.
+func copyKeyedSkylinks(ctx context.Context, db *mongo.Database, tmp string, log logger.ExtFieldLogger) (int, error) {
+	config := db.Collection(collConfig)
+	dst := db.Collection(tmp)
+	// Documents without a skylink can't be keyed by it and are of no use
+	// anyway.
+	filter := bson.M{"skylink": bson.M{"$type": "string"}}
+	var progress struct {
+		Value string `bson:"value"`
+	}
+	err := config.FindOne(ctx, bson.M{"key": confKeySkylinksProgress}).Decode(&progress)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, errors.AddContext(err, "failed to fetch the progress of the copy")
+	}
+	if err == mongo.ErrNoDocuments {
+		// Whatever the copy holds is left over from an attempt which
+		// didn't record its progress, so we start over.
+		err = dst.Drop(ctx)
+		if err != nil {
+			return 0, errors.AddContext(err, "failed to drop the earlier copy")
+		}
+	} else {
+		last, err := primitive.ObjectIDFromHex(progress.Value)
+		if err != nil {
+			return 0, errors.AddContext(err, "invalid progress of the copy")
+		}
+		filter["_id"] = bson.M{"$gt": last}
+		log.Infof("Resuming the copy of the skylinks after %s", progress.Value)
+	}
+	opts := options.Find().SetSort(bson.D{{"_id", 1}}).SetBatchSize(migrationBatchSize)
+	c, err := db.Collection(collSkylinks).Find(ctx, filter, opts)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to list skylinks")
+	}
+	defer func() {
+		_ = c.Close(ctx)
+	}()
+	copied := 0
+	batch := make([]mongo.WriteModel, 0, migrationBatchSize)
+	var lastID primitive.ObjectID
+	// flush copies the batch and records its last ID.
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := dst.BulkWrite(ctx, batch)
+		if err != nil {
+			return errors.AddContext(err, "failed to copy the skylinks")
+		}
+		update := bson.M{"$set": bson.M{"value": lastID.Hex()}}
+		_, err = config.UpdateOne(ctx, bson.M{"key": confKeySkylinksProgress}, update, options.Update().SetUpsert(true))
+		if err != nil {
+			return errors.AddContext(err, "failed to record the progress of the copy")
+		}
+		copied += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for c.Next(ctx) {
+		var doc bson.M
+		if err = c.Decode(&doc); err != nil {
+			return 0, errors.AddContext(err, "failed to decode skylink")
+		}
+		id, ok := doc["_id"].(primitive.ObjectID)
+		if !ok {
+			return 0, fmt.Errorf("unexpected ID '%v' of skylink '%v'", doc["_id"], doc["skylink"])
+		}
+		sl := doc["skylink"]
+		doc["_id"] = sl
+		delete(doc, "skylink")
+		// Replacing instead of inserting makes it safe to copy a skylink
+		// again, e.g. if we failed before we recorded the progress.
+		batch = append(batch, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": sl}).SetReplacement(doc).SetUpsert(true))
+		lastID = id
+		if len(batch) == migrationBatchSize {
+			if err = flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err = c.Err(); err != nil {
+		return 0, errors.AddContext(err, "failed to iterate over skylinks")
+	}
+	if err = flush(); err != nil {
+		return 0, err
+	}
+	return copied, nil
+}
+
+// ensureNoOldServers returns ErrOldServersActive if any of the servers which
+// swept within activeServerWindow runs a version of pinner which doesn't know
+// the migration with the given ID. The servers record the latest migration
+// they know in their heartbeats when they start, see registerSchemaVersion.
+func ensureNoOldServers(ctx context.Context, db *mongo.Database, id int) error {
+	filter := bson.M{
+		"last_sweep_end": bson.M{"$gt": time.Now().UTC().Add(-activeServerWindow)},
+		"$or": bson.A{
+			bson.M{"schema_version": bson.M{"$exists": false}},
+			bson.M{"schema_version": bson.M{"$lt": id}},
+		},
+	}
+	opts := options.Find().SetProjection(bson.M{"name": 1})
+	c, err := db.Collection(collServers).Find(ctx, filter, opts)
+	if err != nil {
+		return errors.AddContext(err, "failed to look for servers running an older version of pinner")
+	}
+	var servers []struct {
+		Name string `bson:"name"`
+	}
+	err = c.All(ctx, &servers)
+	if err != nil {
+		return errors.AddContext(err, "failed to decode servers")
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(servers))
+	for _, s := range servers {
+		names = append(names, s.Name)
+	}
+	return errors.AddContext(ErrOldServersActive, fmt.Sprintf("upgrade or stop %v before migration %d can run", names, id))
+}
+
+// registerSchemaVersion records in the heartbeat of the given server the latest
+// schema version this version of pinner knows. See ensureNoOldServers.
+func registerSchemaVersion(ctx context.Context, db *mongo.Database, server string) error {
+	update := bson.M{"$set": bson.M{"schema_version": LatestSchemaVersion()}}
+	_, err := db.Collection(collServers).UpdateOne(ctx, bson.M{"name": server}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return errors.AddContext(err, "failed to record the server's schema version")
+	}
+	return nil
+}
+
+// indexDeletedSkylinks creates the index of the skylinks' deleted_at field.
+func indexDeletedSkylinks(ctx context.Context, db *mongo.Database, _ logger.ExtFieldLogger) error {
+	_, err := db.Collection(collSkylinks).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"deleted_at", 1}},
+		Options: options.Index().SetName("deleted_at").SetSparse(true),
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to create the deleted_at index")
+	}
+	return nil
+}
+
+// createServerLoads creates the collection of server loads and computes them
+// from the existing skylinks.
+func createServerLoads(ctx context.Context, db *mongo.Database, _ logger.ExtFieldLogger) error {
+	_, err := db.Collection(collServerStats).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"server", 1}},
+		Options: options.Index().SetName("server").SetUnique(true),
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to create the server loads indexes")
+	}
+	return reconcileServerLoads(ctx, db)
+}
+
+// LatestSchemaVersion returns the schema version of a database to which all
+// migrations have been applied.
+func LatestSchemaVersion() int {
+	ms := migrations()
+	return ms[len(ms)-1].id
+}
+
+// SchemaVersion returns the ID of the last migration applied to the database.
+func (db *DB) SchemaVersion(ctx context.Context) (int, error) {
+	return schemaVersion(ctx, db.staticDB)
+}
+
+// migrate applies all pending migrations to the database, in order. Only one
+// instance applies them at a time, the others wait for it to finish. If a
+// migration fails, we don't apply the ones after it and return its error. If
+// the server's name is given, we first record that it runs this version of
+// pinner, see registerSchemaVersion.
+func migrate(ctx context.Context, db *mongo.Database, server string, log logger.ExtFieldLogger) error {
+	// The lock relies on the unique index on the configuration keys, so we
+	// need to create it first.
+	_, err := db.Collection(collConfig).Indexes().CreateMany(ctx, schema()[collConfig])
+	if err != nil {
+		return errors.AddContext(err, "failed to create the configuration indexes")
+	}
+	if server != "" {
+		err = registerSchemaVersion(ctx, db, server)
+		if err != nil {
+			return err
+		}
+	}
+	latest := LatestSchemaVersion()
+	owner := primitive.NewObjectID().Hex()
+	for {
+		version, err := schemaVersion(ctx, db)
+		if err != nil {
+			return err
+		}
+		if version >= latest {
+			if version > latest {
+				log.Warnf("The database schema version %d is newer than the latest one we know, %d.", version, latest)
+			}
+			return nil
+		}
+		locked, err := lockMigrations(ctx, db, owner)
+		if err != nil {
+			return err
+		}
+		if locked {
+			break
+		}
+		log.Debug("Waiting for another instance to migrate the database.")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(migrationLockRetry):
+		}
+	}
+	defer func() {
+		_, errUnlock := db.Collection(collConfig).DeleteOne(ctx, bson.M{"key": confMigrationLock, "value": owner})
+		if errUnlock != nil {
+			log.Warn(errors.AddContext(errUnlock, "failed to release the migration lock"))
+		}
+	}()
+
+	// Another instance might have finished the migrations while we were
+	// acquiring the lock.
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations() {
+		if m.id <= version {
+			continue
+		}
+		log.Infof("Applying database migration %d: %s", m.id, m.name)
+		start := time.Now()
+		err = m.fn(ctx, db, log)
+		if err != nil {
+			return errors.AddContext(err, fmt.Sprintf("database migration %d failed", m.id))
+		}
+		err = setSchemaVersion(ctx, db, m.id)
+		if err != nil {
+			return err
+		}
+		log.Infof("Applied database migration %d in %v", m.id, time.Since(start))
+	}
+	return nil
+}
+
+// lockMigrations tries to acquire the migration lock for the given owner. It
+// returns false if another owner holds a lock which hasn't expired yet.
+func lockMigrations(ctx context.Context, db *mongo.Database, owner string) (bool, error) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	filter := bson.M{
+		"key": confMigrationLock,
+		"$or": bson.A{
+			bson.M{"value": owner},
+			bson.M{"expires": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"value":   owner,
+			"expires": now.Add(migrationLockDuration),
+		},
+	}
+	// If someone else holds the lock, the filter doesn't match and the upsert
+	// violates the unique index on the key.
+	_, err := db.Collection(collConfig).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.AddContext(err, "failed to acquire the migration lock")
+	}
+	return true, nil
+}
+
+// schemaVersion returns the ID of the last migration applied to the database.
+// It's zero for databases to which we've never applied one.
+func schemaVersion(ctx context.Context, db *mongo.Database) (int, error) {
+	sr := db.Collection(collConfig).FindOne(ctx, bson.M{"key": confSchemaVersion})
+	if sr.Err() == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if sr.Err() != nil {
+		return 0, errors.AddContext(sr.Err(), "failed to fetch the schema version")
+	}
+	var result struct {
+		Value string
+	}
+	err := sr.Decode(&result)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to decode the schema version")
+	}
+	version, err := strconv.Atoi(result.Value)
+	if err != nil {
+		return 0, errors.AddContext(err, "invalid schema version")
+	}
+	return version, nil
+}
+
+// setSchemaVersion records the ID of the last migration applied to the
+// database.
+func setSchemaVersion(ctx context.Context, db *mongo.Database, version int) error {
+	filter := bson.M{"key": confSchemaVersion}
+	update := bson.M{"$set": bson.M{"value": strconv.Itoa(version)}}
+	_, err := db.Collection(collConfig).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return errors.AddContext(err, "failed to store the schema version")
+	}
+	return nil
+}
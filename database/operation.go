@@ -0,0 +1,74 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DefaultSlowOpThreshold is the default duration above which we log
+	// database operations as slow. See WithSlowOpThreshold.
+	DefaultSlowOpThreshold = 5 * time.Second
+)
+
+type (
+	// OpOptions customize the database operations run with a context
+	// returned by WithOpOptions.
+	OpOptions struct {
+		// Timeout overrides the DB's operation timeout. Zero keeps the DB's
+		// timeout.
+		Timeout time.Duration
+	}
+
+	// opOptionsKey is the key under which we store the OpOptions in a
+	// context.
+	opOptionsKey struct{}
+)
+
+// WithOpOptions returns a copy of ctx which makes the database operations run
+// with it use the given options, e.g. a longer timeout for an operation we
+// know to be slow.
+func WithOpOptions(ctx context.Context, opts OpOptions) context.Context {
+	return context.WithValue(ctx, opOptionsKey{}, opts)
+}
+
+// WithOpTimeout sets the maximum duration of a single database operation. A
+// caller's deadline which expires sooner still applies. It defaults to
+// MongoDefaultTimeout. Zero disables the timeout.
+func WithOpTimeout(d time.Duration) Option {
+	return func(db *DB) {
+		db.opTimeout = d
+	}
+}
+
+// WithSlowOpThreshold makes the DB log the operations which take longer than
+// the given duration. It defaults to DefaultSlowOpThreshold. Zero disables the
+// logging.
+func WithSlowOpThreshold(d time.Duration) Option {
+	return func(db *DB) {
+		db.slowOpThreshold = d
+	}
+}
+
+// operation prepares the context of a database operation on the given
+// collection. The returned context expires once the operation timeout passes.
+// The caller must call the returned function once the operation is done, which
+// releases the context and logs the operation if it was slow.
+func (db *DB) operation(ctx context.Context, coll, name string) (context.Context, func()) {
+	timeout := db.opTimeout
+	if opts, ok := ctx.Value(opOptionsKey{}).(OpOptions); ok && opts.Timeout > 0 {
+		timeout = opts.Timeout
+	}
+	cancel := func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	start := time.Now()
+	return ctx, func() {
+		cancel()
+		d := time.Since(start)
+		if db.slowOpThreshold > 0 && d > db.slowOpThreshold {
+			db.staticLogger.Warnf("Slow database operation %s on collection '%s' took %v", name, coll, d)
+		}
+	}
+}
@@ -9,16 +9,18 @@ import (
 // schema returns a mapping between a collection name and the indexes that
 // must exist for that collection.
 //
+// The schema is what the migrations build, but they don't apply it. Each of
+// them creates the indexes it introduces, so changes to the schema need a
+// migration which makes them.
+//
 // We return a map literal instead of using a global variable because the global
 // variable causes data races when multiple tests are creating their own
 // databases and are iterating over the schema at the same time.
 func schema() map[string][]mongo.IndexModel {
 	return map[string][]mongo.IndexModel{
 		collSkylinks: {
-			{
-				Keys:    bson.D{{"skylink", 1}},
-				Options: options.Index().SetName("skylink").SetUnique(true),
-			},
+			// The skylinks are the documents' IDs, so they don't need an
+			// index of their own.
 			{
 				Keys:    bson.D{{"locked_by", 1}},
 				Options: options.Index().SetName("locked_by"),
@@ -35,6 +37,33 @@ func schema() map[string][]mongo.IndexModel {
 				Keys:    bson.D{{"pinned", 1}},
 				Options: options.Index().SetName("pinned"),
 			},
+			// Supports the underpinned query of FindAndLockUnderpinned.
+			{
+				Keys:    bson.D{{"pinned", 1}, {"lock_expires", 1}},
+				Options: options.Index().SetName("pinned_lock_expires"),
+			},
+			{
+				Keys:    bson.D{{"num_servers", 1}},
+				Options: options.Index().SetName("num_servers"),
+			},
+			// Supports PurgeDeleted. Only the soft-deleted skylinks have
+			// the field.
+			{
+				Keys:    bson.D{{"deleted_at", 1}},
+				Options: options.Index().SetName("deleted_at").SetSparse(true),
+			},
+		},
+		collServers: {
+			{
+				Keys:    bson.D{{"name", 1}},
+				Options: options.Index().SetName("name").SetUnique(true),
+			},
+		},
+		collServerStats: {
+			{
+				Keys:    bson.D{{"server", 1}},
+				Options: options.Index().SetName("server").SetUnique(true),
+			},
 		},
 		collConfig: {
 			{
@@ -0,0 +1,386 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrServerNotExist is returned when we try to get a server that doesn't
+	// exist.
+	ErrServerNotExist = errors.New("server does not exist")
+	// ErrInvalidServerName is returned when a server name is empty, too long
+	// or contains characters other than lowercase letters, digits, dots and
+	// dashes. See ValidateServerName.
+	ErrInvalidServerName = errors.New("invalid server name")
+
+	// serverNameRegex matches the characters we allow in server names.
+	serverNameRegex = regexp.MustCompile(`^[a-z0-9.-]+$`)
+)
+
+const (
+	// maxServerNameLen is the maximum length of a server name. It's the
+	// maximum length of a domain name.
+	maxServerNameLen = 253
+)
+
+type (
+	// RemovalProgressFn is a function which gets called after each batch of
+	// RemoveServer with the number of skylinks the server has been removed
+	// from so far.
+	RemovalProgressFn func(removed int64)
+
+	// ServerInfo represents a server's heartbeat document in the DB. It tells
+	// us when the server last successfully reconciled the database with its
+	// local skyd.
+	ServerInfo struct {
+		Name           string    `bson:"name"`
+		LastSweepStart time.Time `bson:"last_sweep_start"`
+		LastSweepEnd   time.Time `bson:"last_sweep_end"`
+		NumSkylinks    int       `bson:"num_skylinks"`
+		PinnerVersion  string    `bson:"pinner_version"`
+		// LastSweepBytesAdded and LastSweepBytesRemoved hold the total size
+		// of the skylinks the last sweep added the server to and removed it
+		// from. Skylinks of unknown size are not included.
+		LastSweepBytesAdded   uint64 `bson:"last_sweep_bytes_added"`
+		LastSweepBytesRemoved uint64 `bson:"last_sweep_bytes_removed"`
+		// SchemaVersion is the latest database schema version the
+		// server's version of pinner knows. Older versions of pinner don't
+		// set it. See WithServerName.
+		SchemaVersion int `bson:"schema_version"`
+	}
+
+	// ServerNameMerge describes the merge of a server name into its
+	// normalized form. See RepairServerNames.
+	ServerNameMerge struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+
+	// ServerNameRepair describes the outcome of RepairServerNames.
+	ServerNameRepair struct {
+		// Merges are the merges we made, or would make on a dry run.
+		Merges []ServerNameMerge `json:"merges"`
+		// Invalid are the names which are invalid even once normalized.
+		Invalid []string `json:"invalid,omitempty"`
+	}
+)
+
+// NormalizeServerName returns the normalized form of the given server name: we
+// trim the surrounding whitespace and lowercase it.
+func NormalizeServerName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// ValidateServerName checks that the given server name is not empty, not longer
+// than a domain name and that it only contains lowercase letters, digits, dots
+// and dashes. The names we get from the configuration should be normalized
+// first, see NormalizeServerName.
+func ValidateServerName(name string) error {
+	if name == "" {
+		return errors.AddContext(ErrInvalidServerName, "empty server name")
+	}
+	if len(name) > maxServerNameLen {
+		return errors.AddContext(ErrInvalidServerName, fmt.Sprintf("server name is longer than %d characters", maxServerNameLen))
+	}
+	if !serverNameRegex.MatchString(name) {
+		return errors.AddContext(ErrInvalidServerName, fmt.Sprintf("server name '%s' contains characters other than a-z, 0-9, '.' and '-'", name))
+	}
+	return nil
+}
+
+// ServerInfo fetches the heartbeat document of the given server.
+func (db *DB) ServerInfo(ctx context.Context, name string) (ServerInfo, error) {
+	ctx, done := db.operation(ctx, collServers, "ServerInfo")
+	defer done()
+	sr := db.staticDB.Collection(collServers).FindOne(ctx, bson.M{"name": name})
+	if sr.Err() == mongo.ErrNoDocuments {
+		return ServerInfo{}, ErrServerNotExist
+	}
+	if sr.Err() != nil {
+		return ServerInfo{}, sr.Err()
+	}
+	var info ServerInfo
+	err := sr.Decode(&info)
+	if err != nil {
+		return ServerInfo{}, errors.AddContext(err, "failed to decode server info")
+	}
+	return info, nil
+}
+
+// UpsertServerInfo creates or replaces the heartbeat document of the given
+// server.
+func (db *DB) UpsertServerInfo(ctx context.Context, info ServerInfo) error {
+	db.staticLogger.Tracef("Entering UpsertServerInfo. Server: '%s'", info.Name)
+	defer db.staticLogger.Tracef("Exiting  UpsertServerInfo. Server: '%s'", info.Name)
+	ctx, done := db.operation(ctx, collServers, "UpsertServerInfo")
+	defer done()
+	if err := ValidateServerName(info.Name); err != nil {
+		return err
+	}
+	filter := bson.M{"name": info.Name}
+	opts := options.Replace().SetUpsert(true)
+	_, err := db.staticDB.Collection(collServers).ReplaceOne(ctx, filter, info, opts)
+	return err
+}
+
+// RenameServer replaces the old name of a server with the new one everywhere:
+// in the lists of servers pinning the skylinks, in the skylinks' locks, in the
+// server's heartbeat and in its load. If a server with the new name already
+// exists, the two are merged and the new server's heartbeat is the one we keep.
+// The rename happens in a single transaction, see WithTransaction.
+func (db *DB) RenameServer(ctx context.Context, oldName, newName string) error {
+	db.staticLogger.Tracef("Entering RenameServer. Old name: '%s', new name: '%s'", oldName, newName)
+	defer db.staticLogger.Tracef("Exiting  RenameServer. Old name: '%s', new name: '%s'", oldName, newName)
+	ctx, done := db.operation(ctx, collSkylinks, "RenameServer")
+	defer done()
+	// The old name may be one we wrote before we validated the names, so
+	// we only require it to be set.
+	if oldName == "" {
+		return errors.AddContext(ErrInvalidServerName, "empty server name")
+	}
+	if err := ValidateServerName(newName); err != nil {
+		return err
+	}
+	if oldName == newName {
+		return nil
+	}
+	return db.WithTransaction(ctx, func(ctx context.Context) error {
+		skylinks := db.staticDB.Collection(collSkylinks)
+		// The skylinks which both servers pin only lose the old name. We
+		// can't add the new name and remove the old one in the same update.
+		filter := bson.M{"servers": bson.M{"$all": bson.A{oldName, newName}}}
+		_, err := skylinks.UpdateMany(ctx, filter, withPipelineTimestamps(removeServerUpdate(oldName)))
+		if err != nil {
+			return errors.AddContext(err, "failed to remove the old name from the skylinks")
+		}
+		filter = bson.M{"servers": oldName}
+		_, err = skylinks.UpdateMany(ctx, filter, withTimestamps(bson.M{"$set": bson.M{"servers.$": newName}}))
+		if err != nil {
+			return errors.AddContext(err, "failed to rename the server in the skylinks")
+		}
+		_, err = skylinks.UpdateMany(ctx, bson.M{"locked_by": oldName}, bson.M{"$set": bson.M{"locked_by": newName}})
+		if err != nil {
+			return errors.AddContext(err, "failed to rename the server in the locks")
+		}
+
+		servers := db.staticDB.Collection(collServers)
+		n, err := servers.CountDocuments(ctx, bson.M{"name": newName})
+		if err != nil {
+			return errors.AddContext(err, "failed to look up the new server")
+		}
+		if n == 0 {
+			_, err = servers.UpdateOne(ctx, bson.M{"name": oldName}, bson.M{"$set": bson.M{"name": newName}})
+		} else {
+			_, err = servers.DeleteOne(ctx, bson.M{"name": oldName})
+		}
+		if err != nil {
+			return errors.AddContext(err, "failed to rename the server's heartbeat")
+		}
+
+		_, err = db.staticDB.Collection(collServerStats).DeleteOne(ctx, bson.M{"server": oldName})
+		if err != nil {
+			return errors.AddContext(err, "failed to remove the old server's load")
+		}
+		return db.ReconcileServerLoad(ctx, newName)
+	})
+}
+
+// RepairServerNames merges the server names which differ from their normalized
+// form, e.g. by case or surrounding whitespace, into the normalized one. Such
+// names predate the validation of the server names and they split a server's
+// skylinks, locks, heartbeat and load between several names. Each merge is a
+// RenameServer. If dryRun is true, we only report the merges we would make.
+//
+// The names which are invalid even once normalized are left alone and
+// reported, so they can be fixed with a manual rename. If a merge fails, we
+// return the merges made so far together with the error.
+func (db *DB) RepairServerNames(ctx context.Context, dryRun bool) (ServerNameRepair, error) {
+	db.staticLogger.Tracef("Entering RepairServerNames. Dry run: %t", dryRun)
+	defer db.staticLogger.Tracef("Exiting  RepairServerNames. Dry run: %t", dryRun)
+	names, err := db.serverNames(ctx)
+	if err != nil {
+		return ServerNameRepair{}, errors.AddContext(err, "failed to fetch the server names")
+	}
+	var merges []ServerNameMerge
+	r := ServerNameRepair{Merges: []ServerNameMerge{}}
+	for _, name := range names {
+		normalized := NormalizeServerName(name)
+		if ValidateServerName(normalized) != nil {
+			r.Invalid = append(r.Invalid, name)
+			continue
+		}
+		if normalized != name {
+			merges = append(merges, ServerNameMerge{From: name, To: normalized})
+		}
+	}
+	if dryRun {
+		r.Merges = append(r.Merges, merges...)
+		return r, nil
+	}
+	for _, m := range merges {
+		err = db.RenameServer(ctx, m.From, m.To)
+		if err != nil {
+			return r, errors.AddContext(err, fmt.Sprintf("failed to merge '%s' into '%s'", m.From, m.To))
+		}
+		db.staticLogger.Infof("Merged server name '%s' into '%s'.", m.From, m.To)
+		r.Merges = append(r.Merges, m)
+	}
+	return r, nil
+}
+
+// serverNames returns the sorted names of all servers we know about, the ones
+// pinning skylinks, holding locks, sending heartbeats and having a load.
+func (db *DB) serverNames(ctx context.Context) ([]string, error) {
+	ctx, done := db.operation(ctx, collSkylinks, "ServerNames")
+	defer done()
+	sources := []struct {
+		coll  string
+		field string
+	}{
+		{collSkylinks, "servers"},
+		{collSkylinks, "locked_by"},
+		{collServers, "name"},
+		{collServerStats, "server"},
+	}
+	unique := make(map[string]struct{})
+	for _, src := range sources {
+		values, err := db.staticDB.Collection(src.coll).Distinct(ctx, src.field, bson.M{})
+		if err != nil {
+			return nil, errors.AddContext(err, fmt.Sprintf("failed to fetch the distinct values of %s.%s", src.coll, src.field))
+		}
+		for _, v := range values {
+			if name, ok := v.(string); ok && name != "" {
+				unique[name] = struct{}{}
+			}
+		}
+	}
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RemoveServer removes every trace of the given server, e.g. once it's been
+// decommissioned: it's no longer listed as pinning any skylinks, its locks are
+// released and its heartbeat and its load are deleted. It returns the number of
+// skylinks it removed the server from.
+//
+// A server can pin millions of skylinks, so we remove it from them in batches,
+// in the order of their IDs, instead of in a single transaction. If progress is
+// not nil, it's called after each batch with the number of skylinks we removed
+// the server from so far. We stop between batches once ctx is cancelled, in
+// which case we return the number of skylinks we got to and the context's
+// error. Removing the server again finishes the job.
+func (db *DB) RemoveServer(ctx context.Context, server string, progress RemovalProgressFn) (int64, error) {
+	db.staticLogger.Tracef("Entering RemoveServer. Server: '%s'", server)
+	defer db.staticLogger.Tracef("Exiting  RemoveServer. Server: '%s'", server)
+	if server == "" {
+		return 0, errors.New("invalid server name")
+	}
+	var removed int64
+	after := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		n, last, err := db.removeServerBatch(ctx, server, after)
+		if err != nil {
+			return removed, errors.AddContext(err, "failed to remove the server from the skylinks")
+		}
+		if last == "" {
+			break
+		}
+		removed += n
+		after = last
+		if progress != nil {
+			progress(removed)
+		}
+	}
+
+	ctx, done := db.operation(ctx, collSkylinks, "RemoveServer")
+	defer done()
+	update := bson.M{
+		"$set": bson.M{
+			"locked_by":    "",
+			"lock_expires": time.Time{},
+		},
+	}
+	_, err := db.staticDB.Collection(collSkylinks).UpdateMany(ctx, bson.M{"locked_by": server}, update)
+	if err != nil {
+		return removed, errors.AddContext(err, "failed to release the server's locks")
+	}
+	_, err = db.staticDB.Collection(collServers).DeleteOne(ctx, bson.M{"name": server})
+	if err != nil {
+		return removed, errors.AddContext(err, "failed to remove the server's heartbeat")
+	}
+	_, err = db.staticDB.Collection(collServerStats).DeleteOne(ctx, bson.M{"server": server})
+	if err != nil {
+		return removed, errors.AddContext(err, "failed to remove the server's load")
+	}
+	return removed, nil
+}
+
+// removeServerBatch removes the server from the next batch of the skylinks it
+// pins, the ones which come after the given skylink in the order of their IDs.
+// It returns the number of skylinks it removed the server from and the last
+// skylink of the batch. The last skylink is empty once there are no more
+// batches.
+func (db *DB) removeServerBatch(ctx context.Context, server, after string) (int64, string, error) {
+	ctx, done := db.operation(ctx, collSkylinks, "RemoveServer")
+	defer done()
+	skylinks := db.staticDB.Collection(collSkylinks)
+	filter := bson.M{"servers": server}
+	if after != "" {
+		filter["_id"] = bson.M{"$gt": after}
+	}
+	opts := options.Find().
+		SetProjection(bson.M{"_id": 1}).
+		SetSort(bson.M{"_id": 1}).
+		SetLimit(int64(skylinksBatchSize))
+	c, err := skylinks.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, "", err
+	}
+	var results []struct {
+		Skylink string `bson:"_id"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return 0, "", errors.AddContext(err, "failed to decode results")
+	}
+	if len(results) == 0 {
+		return 0, "", nil
+	}
+	batch := make([]string, 0, len(results))
+	for _, r := range results {
+		batch = append(batch, r.Skylink)
+	}
+	filter = bson.M{
+		"_id":     bson.M{"$in": batch},
+		"servers": server,
+	}
+	// Keep the server's load accurate in case we don't get to remove the
+	// server from all of its skylinks.
+	load, err := db.loadOf(ctx, filter)
+	if err != nil {
+		return 0, "", err
+	}
+	ur, err := skylinks.UpdateMany(ctx, filter, withPipelineTimestamps(removeServerUpdate(server)))
+	if err != nil {
+		return 0, "", err
+	}
+	db.incServerLoad(ctx, server, -load.skylinks, -load.bytes)
+	return ur.ModifiedCount, batch[len(batch)-1], nil
+}
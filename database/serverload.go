@@ -0,0 +1,235 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// ServerLoad describes how much a server pins according to the database.
+	//
+	// We maintain the loads incrementally as we add servers to skylinks and
+	// remove them. Concurrent writes can make them drift, so each sweep
+	// recomputes the load of the server it sweeps. See ReconcileServerLoad.
+	ServerLoad struct {
+		Server string `bson:"server"`
+		// Skylinks is the number of skylinks the server pins.
+		Skylinks int64 `bson:"skylinks"`
+		// Bytes is the total size of the skylinks the server pins. Skylinks
+		// of unknown size are not included.
+		Bytes int64 `bson:"bytes"`
+		// ReconciledAt is the last time we recomputed the load from scratch.
+		ReconciledAt time.Time `bson:"reconciled_at"`
+	}
+
+	// loadBefore is the part of a skylink's document, as it was before an
+	// update, which tells us how the update changed a server's load. See
+	// loadProjection.
+	loadBefore struct {
+		// Servers holds the server if it pinned the skylink.
+		Servers []string `bson:"servers"`
+		Size    int64    `bson:"size"`
+	}
+
+	// loadDelta is a change of a server's load.
+	loadDelta struct {
+		skylinks int64
+		bytes    int64
+	}
+)
+
+// AllServerLoads returns the loads of all servers we know of, ordered by the
+// servers' names. It's a reporting query, see reporting.
+func (db *DB) AllServerLoads(ctx context.Context) ([]ServerLoad, error) {
+	ctx, done := db.operation(ctx, collServerStats, "AllServerLoads")
+	defer done()
+	opts := options.Find().SetProjection(bson.M{"_id": 0}).SetSort(bson.M{"server": 1})
+	c, err := db.reporting(collServerStats).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find server loads")
+	}
+	loads := []ServerLoad{}
+	err = c.All(ctx, &loads)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode server loads")
+	}
+	return loads, nil
+}
+
+// ServerLoad returns the load of the given server. Servers we don't know of
+// have no load.
+func (db *DB) ServerLoad(ctx context.Context, server string) (ServerLoad, error) {
+	ctx, done := db.operation(ctx, collServerStats, "ServerLoad")
+	defer done()
+	opts := options.FindOne().SetProjection(bson.M{"_id": 0})
+	sr := db.staticDB.Collection(collServerStats).FindOne(ctx, bson.M{"server": server}, opts)
+	if sr.Err() == mongo.ErrNoDocuments {
+		return ServerLoad{Server: server}, nil
+	}
+	if sr.Err() != nil {
+		return ServerLoad{}, errors.AddContext(sr.Err(), "failed to find server load")
+	}
+	var load ServerLoad
+	err := sr.Decode(&load)
+	if err != nil {
+		return ServerLoad{}, errors.AddContext(err, "failed to decode server load")
+	}
+	return load, nil
+}
+
+// ReconcileServerLoad recomputes the load of the given server from the
+// skylinks it pins, correcting any drift of the incremental updates.
+func (db *DB) ReconcileServerLoad(ctx context.Context, server string) error {
+	db.staticLogger.Tracef("Entering ReconcileServerLoad. Server: '%s'", server)
+	defer db.staticLogger.Tracef("Exiting  ReconcileServerLoad. Server: '%s'", server)
+	ctx, done := db.operation(ctx, collSkylinks, "ReconcileServerLoad")
+	defer done()
+	delta, err := db.loadOf(ctx, bson.M{"servers": server})
+	if err != nil {
+		return err
+	}
+	return setServerLoads(ctx, db.staticDB, map[string]loadDelta{server: delta}, false)
+}
+
+// ReconcileServerLoads recomputes the loads of all servers from scratch. It
+// goes over all skylinks, so it's expensive.
+func (db *DB) ReconcileServerLoads(ctx context.Context) error {
+	db.staticLogger.Trace("Entering ReconcileServerLoads")
+	defer db.staticLogger.Trace("Exiting  ReconcileServerLoads")
+	ctx, done := db.operation(ctx, collSkylinks, "ReconcileServerLoads")
+	defer done()
+	return reconcileServerLoads(ctx, db.staticDB)
+}
+
+// reconcileServerLoads recomputes the loads of all servers from scratch.
+// Servers which no longer pin anything keep a load of zero.
+func reconcileServerLoads(ctx context.Context, db *mongo.Database) error {
+	pipeline := mongo.Pipeline{
+		{{"$project", bson.M{"_id": 0, "servers": 1, "size": 1}}},
+		{{"$unwind", "$servers"}},
+		{{"$group", bson.M{
+			"_id":      "$servers",
+			"skylinks": bson.M{"$sum": 1},
+			"bytes":    bson.M{"$sum": bson.M{"$ifNull": bson.A{"$size", 0}}},
+		}}},
+	}
+	c, err := db.Collection(collSkylinks).Aggregate(ctx, pipeline)
+	if err != nil {
+		return errors.AddContext(err, "failed to aggregate server loads")
+	}
+	var results []struct {
+		Server   string `bson:"_id"`
+		Skylinks int64  `bson:"skylinks"`
+		Bytes    int64  `bson:"bytes"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return errors.AddContext(err, "failed to decode server loads")
+	}
+	loads := make(map[string]loadDelta, len(results))
+	for _, r := range results {
+		loads[r.Server] = loadDelta{skylinks: r.Skylinks, bytes: r.Bytes}
+	}
+	// Zero the loads of the servers which don't pin anything anymore.
+	current, err := db.Collection(collServerStats).Distinct(ctx, "server", bson.M{})
+	if err != nil {
+		return errors.AddContext(err, "failed to list servers")
+	}
+	for _, s := range current {
+		if server, ok := s.(string); ok {
+			if _, exists := loads[server]; !exists {
+				loads[server] = loadDelta{}
+			}
+		}
+	}
+	return setServerLoads(ctx, db, loads, false)
+}
+
+// loadOf returns the number and the total size of the skylinks which match the
+// given filter.
+func (db *DB) loadOf(ctx context.Context, filter bson.M) (loadDelta, error) {
+	pipeline := mongo.Pipeline{
+		{{"$match", filter}},
+		{{"$group", bson.M{
+			"_id":      nil,
+			"skylinks": bson.M{"$sum": 1},
+			"bytes":    bson.M{"$sum": bson.M{"$ifNull": bson.A{"$size", 0}}},
+		}}},
+	}
+	c, err := db.staticDB.Collection(collSkylinks).Aggregate(ctx, pipeline)
+	if err != nil {
+		return loadDelta{}, errors.AddContext(err, "failed to aggregate load")
+	}
+	var results []struct {
+		Skylinks int64 `bson:"skylinks"`
+		Bytes    int64 `bson:"bytes"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return loadDelta{}, errors.AddContext(err, "failed to decode load")
+	}
+	if len(results) == 0 {
+		return loadDelta{}, nil
+	}
+	return loadDelta{skylinks: results[0].Skylinks, bytes: results[0].Bytes}, nil
+}
+
+// incServerLoads applies the given changes to the loads of the servers.
+// The loads are not critical and the sweeps correct them, so we only log the
+// errors instead of failing the write which caused the changes.
+func (db *DB) incServerLoads(ctx context.Context, deltas map[string]loadDelta) {
+	err := setServerLoads(ctx, db.staticDB, deltas, true)
+	if err != nil {
+		db.staticLogger.Warn(errors.AddContext(err, "failed to update server loads"))
+	}
+}
+
+// incServerLoad applies the given change to the load of the server.
+func (db *DB) incServerLoad(ctx context.Context, server string, skylinks, bytes int64) {
+	if skylinks == 0 && bytes == 0 {
+		return
+	}
+	db.incServerLoads(ctx, map[string]loadDelta{server: {skylinks: skylinks, bytes: bytes}})
+}
+
+// loadProjection projects a skylink's document onto a loadBefore for the given
+// server.
+func loadProjection(server string) bson.M {
+	return bson.M{
+		"_id":     0,
+		"size":    1,
+		"servers": bson.M{"$elemMatch": bson.M{"$eq": server}},
+	}
+}
+
+// setServerLoads sets the loads of the given servers or, if inc is true,
+// increments them by the given values.
+func setServerLoads(ctx context.Context, db *mongo.Database, loads map[string]loadDelta, inc bool) error {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	models := make([]mongo.WriteModel, 0, len(loads))
+	for server, l := range loads {
+		if inc && l == (loadDelta{}) {
+			continue
+		}
+		var update bson.M
+		if inc {
+			update = bson.M{"$inc": bson.M{"skylinks": l.skylinks, "bytes": l.bytes}}
+		} else {
+			update = bson.M{"$set": bson.M{"skylinks": l.skylinks, "bytes": l.bytes, "reconciled_at": now}}
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"server": server}).
+			SetUpdate(update).
+			SetUpsert(true))
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	_, err := db.Collection(collServerStats).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
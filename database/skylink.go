@@ -2,12 +2,12 @@ package database
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -25,21 +25,47 @@ var (
 	// ErrNoSkylinksLocked is returned when we try to lock underpinned skylinks
 	// for pinning but we fail to do so.
 	ErrNoSkylinksLocked = errors.New("no skylinks locked")
+	// ErrLockedByAnotherServer is returned when we try to unlock a skylink
+	// which another server holds locked.
+	ErrLockedByAnotherServer = errors.New("skylink is locked by another server")
 	// ErrNoUnderpinnedSkylinks is returned when all skylinks in the database
 	// are either sufficiently pinned or pinned by the local server.
 	ErrNoUnderpinnedSkylinks = errors.New("no underpinned skylinks found")
-	// LockDuration defines the duration of a database lock. We lock skylinks
-	// while we are trying to pin them to a new server. The goal is to only
-	// allow a single server to pin a given skylink at a time.
-	LockDuration = 7 * time.Hour
+	// ErrInvalidPageToken is returned when we get a continuation token which
+	// we didn't issue.
+	ErrInvalidPageToken = errors.New("invalid page token")
+	// ErrStaleRevision is returned when we try to update a skylink based on
+	// a revision which someone else has updated in the meantime.
+	ErrStaleRevision = errors.New("skylink revision is stale")
+	// skylinksBatchSize defines the maximum number of skylinks we send to the
+	// database in a single batch operation. We need to limit this in order to
+	// stay well below MongoDB's 16MB BSON document limit and to avoid hitting
+	// the operation timeout on large batches.
+	skylinksBatchSize = 1000
+)
+
+const (
+	// DefaultLockDuration is the default duration of a database lock. We
+	// lock skylinks while we are trying to pin them to a new server. The goal
+	// is to only allow a single server to pin a given skylink at a time. See
+	// DB.SetLockDuration.
+	DefaultLockDuration = 7 * time.Hour
 )
 
 type (
+	// BatchProgressFn is a function which gets called after each processed
+	// batch of a batch operation, informing the caller of its progress.
+	BatchProgressFn func(batchesDone, batchesTotal int)
+
 	// Skylink represents a skylink object in the DB.
 	Skylink struct {
-		ID      primitive.ObjectID `bson:"_id,omitempty"`
-		Skylink string             `bson:"skylink"`
-		Servers []string           `bson:"servers"`
+		// Skylink is the canonical form of the skylink. It's the document's
+		// ID, so it's unique and a natural shard key.
+		Skylink string   `bson:"_id"`
+		Servers []string `bson:"servers"`
+		// NumServers is the number of servers in Servers. We keep it next to
+		// the list, so we can filter and sort on it using an index.
+		NumServers int `bson:"num_servers"`
 		// Pinned tells us that at least one user is actively pinning this
 		// skylink and we want to keep it alive. If Pinned is false then all
 		// servers should actively unpin the skylink and stop paying for it.
@@ -47,34 +73,84 @@ type (
 		Pinned      bool      `bson:"pinned"`
 		LockedBy    string    `bson:"locked_by"`
 		LockExpires time.Time `bson:"lock_expires"`
+		// Size is the size of the skyfile in bytes. It's zero when we don't
+		// know it yet.
+		Size uint64 `bson:"size,omitempty"`
+		// IsDirectory and ContentType describe the skyfile, as far as its
+		// metadata tells us. They are only set once we fetched the
+		// metadata, see SetSkylinkMetadata.
+		IsDirectory bool   `bson:"is_directory,omitempty"`
+		ContentType string `bson:"content_type,omitempty"`
+		// Blocked tells us that skyd refused to pin the skylink because it's
+		// on the blocklist. We don't try to pin blocked skylinks anymore.
+		Blocked bool `bson:"blocked,omitempty"`
+		// Owners holds opaque identifiers of the users who pin the skylink,
+		// e.g. their accounts IDs. A skylink is unpinned once the last of
+		// its owners unpins it. Skylinks pinned without an owner don't have
+		// any.
+		Owners []string `bson:"owners,omitempty"`
+		// UnpinnedAt is when the skylink was first unpinned. It's zero while
+		// the skylink is pinned. We delete skylinks which have been unpinned
+		// for long enough, see DeleteUnpinned.
+		UnpinnedAt time.Time `bson:"unpinned_at,omitempty"`
+		// UnpinnedBy is the server which first unpinned the skylink, at
+		// UnpinnedAt. It's empty while the skylink is pinned and for
+		// skylinks unpinned by their last owner or before we started
+		// tracking it.
+		UnpinnedBy string `bson:"unpinned_by,omitempty"`
+		// DeletedAt is when the skylink was soft-deleted. The read queries
+		// don't see soft-deleted skylinks. See SoftDeleteSkylink.
+		DeletedAt time.Time `bson:"deleted_at,omitempty"`
+		// CreatedAt is the time the skylink entered the database. For
+		// skylinks which predate this field it's approximated by the time
+		// their ID was generated.
+		CreatedAt time.Time `bson:"created_at"`
+		// UpdatedAt is the last time the skylink's servers or flags changed.
+		// Locking and unlocking the skylink doesn't count as a change. It's
+		// zero for skylinks which haven't changed since we started tracking
+		// it.
+		UpdatedAt time.Time `bson:"updated_at"`
+		// Revision is incremented with each update which changes
+		// UpdatedAt. It allows us to detect concurrent updates when we read
+		// a skylink, compute changes and write them back. See
+		// UpdateSkylinkWithRevision.
+		Revision int64 `bson:"revision"`
 	}
 )
 
 // CreateSkylink inserts a new skylink into the DB. Returns an error if it
 // already exists.
 func (db *DB) CreateSkylink(ctx context.Context, skylink skymodules.Skylink, server string) (Skylink, error) {
-	if server == "" {
-		return Skylink{}, errors.New("invalid server name")
+	ctx, done := db.operation(ctx, collSkylinks, "CreateSkylink")
+	defer done()
+	if err := ValidateServerName(server); err != nil {
+		return Skylink{}, err
 	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
 	s := Skylink{
-		Skylink: skylink.String(),
-		Servers: []string{server},
-		Pinned:  true,
+		Skylink:    skylink.String(),
+		Servers:    []string{server},
+		NumServers: 1,
+		Pinned:     true,
+		CreatedAt:  now,
+		UpdatedAt:  now,
 	}
-	ir, err := db.staticDB.Collection(collSkylinks).InsertOne(ctx, s)
+	_, err := db.staticDB.Collection(collSkylinks).InsertOne(ctx, s)
 	if mongo.IsDuplicateKeyError(err) {
 		return Skylink{}, ErrSkylinkExists
 	}
 	if err != nil {
 		return Skylink{}, err
 	}
-	s.ID = ir.InsertedID.(primitive.ObjectID)
+	db.incServerLoad(ctx, server, 1, 0)
 	return s, nil
 }
 
 // FindSkylink fetches a skylink from the DB.
 func (db *DB) FindSkylink(ctx context.Context, skylink skymodules.Skylink) (Skylink, error) {
-	sr := db.staticDB.Collection(collSkylinks).FindOne(ctx, bson.M{"skylink": skylink.String()})
+	ctx, done := db.operation(ctx, collSkylinks, "FindSkylink")
+	defer done()
+	sr := db.staticDB.Collection(collSkylinks).FindOne(ctx, notDeleted(bson.M{"_id": skylink.String()}))
 	if sr.Err() == mongo.ErrNoDocuments {
 		return Skylink{}, ErrSkylinkNotExist
 	}
@@ -89,27 +165,291 @@ func (db *DB) FindSkylink(ctx context.Context, skylink skymodules.Skylink) (Skyl
 	return s, nil
 }
 
+// FindSkylinks fetches the given skylinks from the DB. It returns the documents
+// it finds and the skylinks which have none, in no particular order. The
+// skylinks can be in any encoding, the missing ones are returned as given.
+//
+// The skylinks are processed in batches. A failure to process a batch doesn't
+// prevent us from processing the remaining ones, all errors are returned
+// together at the end.
+func (db *DB) FindSkylinks(ctx context.Context, skylinks []string) ([]Skylink, []string, error) {
+	db.staticLogger.Tracef("Entering FindSkylinks. Skylinks: %d", len(skylinks))
+	defer db.staticLogger.Tracef("Exiting  FindSkylinks. Skylinks: %d", len(skylinks))
+	canonical, originals, _ := canonicalSkylinks(skylinks)
+	var found []Skylink
+	var missing []string
+	err := processInBatches(canonical, nil, func(batch []string) error {
+		ctx, done := db.operation(ctx, collSkylinks, "FindSkylinks")
+		defer done()
+		c, err := db.staticDB.Collection(collSkylinks).Find(ctx, notDeleted(bson.M{"_id": bson.M{"$in": batch}}))
+		if err != nil {
+			return errors.AddContext(err, "failed to find skylinks")
+		}
+		var results []Skylink
+		err = c.All(ctx, &results)
+		if err != nil {
+			return errors.AddContext(err, "failed to decode results")
+		}
+		exist := make(map[string]struct{}, len(results))
+		for _, r := range results {
+			exist[r.Skylink] = struct{}{}
+		}
+		for _, sl := range batch {
+			if _, ok := exist[sl]; !ok {
+				missing = append(missing, originals[sl]...)
+			}
+		}
+		found = append(found, results...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return found, missing, nil
+}
+
 // MarkPinned marks a skylink as pinned (or no longer unpinned), meaning
 // that Pinner should make sure it's pinned by the minimum number of servers.
+// Skylinks we don't know yet are added without any servers.
 func (db *DB) MarkPinned(ctx context.Context, skylink skymodules.Skylink) error {
 	db.staticLogger.Tracef("Entering MarkPinned. Skylink: '%s'", skylink)
 	defer db.staticLogger.Tracef("Exiting  MarkPinned. Skylink: '%s'", skylink)
-	filter := bson.M{"skylink": skylink.String()}
-	update := bson.M{"$set": bson.M{"pinned": true}}
+	ctx, done := db.operation(ctx, collSkylinks, "MarkPinned")
+	defer done()
+	filter := bson.M{"_id": skylink.String()}
+	update := withTimestamps(bson.M{
+		"$set":         bson.M{"pinned": true},
+		"$unset":       bson.M{"unpinned_at": "", "unpinned_by": "", "deleted_at": ""},
+		"$setOnInsert": newSkylinkFields(),
+	})
 	opts := options.Update().SetUpsert(true)
 	_, err := db.staticDB.Collection(collSkylinks).UpdateOne(ctx, filter, update, opts)
 	return err
 }
 
 // MarkUnpinned marks a skylink as unpinned, meaning that all servers
-// should stop pinning it.
-func (db *DB) MarkUnpinned(ctx context.Context, skylink skymodules.Skylink) error {
-	db.staticLogger.Tracef("Entering MarkUnpinned. Skylink: '%s'", skylink)
-	defer db.staticLogger.Tracef("Exiting  MarkUnpinned. Skylink: '%s'", skylink)
-	filter := bson.M{"skylink": skylink.String()}
-	update := bson.M{"$set": bson.M{"pinned": false}}
+// should stop pinning it, and records the given server as the one which
+// unpinned it. Unpinning a skylink again doesn't change the time it was first
+// unpinned or the server which did it. Skylinks we don't know yet are added
+// without any servers, so the servers which later come across them know not to
+// pin them.
+func (db *DB) MarkUnpinned(ctx context.Context, skylink skymodules.Skylink, server string) error {
+	db.staticLogger.Tracef("Entering MarkUnpinned. Skylink: '%s', server: '%s'", skylink, server)
+	defer db.staticLogger.Tracef("Exiting  MarkUnpinned. Skylink: '%s', server: '%s'", skylink, server)
+	ctx, done := db.operation(ctx, collSkylinks, "MarkUnpinned")
+	defer done()
+	if err := ValidateServerName(server); err != nil {
+		return err
+	}
+	filter := bson.M{"_id": skylink.String()}
 	opts := options.Update().SetUpsert(true)
-	_, err := db.staticDB.Collection(collSkylinks).UpdateOne(ctx, filter, update, opts)
+	_, err := db.staticDB.Collection(collSkylinks).UpdateOne(ctx, filter, markUnpinnedUpdate(server), opts)
+	return err
+}
+
+// MarkPinnedMany marks the given skylinks as pinned, like MarkPinned, but
+// doesn't add the ones we don't know yet. It returns the number of skylinks it
+// found and the number of those which weren't pinned before, so the callers can
+// tell which skylinks don't exist. The skylinks can be in any encoding and we
+// count each of them once.
+//
+// The skylinks are processed in batches. A failure to process a batch doesn't
+// prevent us from processing the remaining ones, all errors are returned
+// together at the end.
+func (db *DB) MarkPinnedMany(ctx context.Context, skylinks []string) (matched, modified int64, err error) {
+	db.staticLogger.Tracef("Entering MarkPinnedMany. Skylinks: %d", len(skylinks))
+	defer db.staticLogger.Tracef("Exiting  MarkPinnedMany. Skylinks: %d", len(skylinks))
+	filter := bson.M{"$or": bson.A{
+		bson.M{"pinned": bson.M{"$ne": true}},
+		bson.M{"deleted_at": bson.M{"$exists": true}},
+	}}
+	update := withTimestamps(bson.M{
+		"$set":   bson.M{"pinned": true},
+		"$unset": bson.M{"unpinned_at": "", "unpinned_by": "", "deleted_at": ""},
+	})
+	return db.markMany(ctx, "MarkPinnedMany", skylinks, filter, update)
+}
+
+// MarkUnpinnedMany marks the given skylinks as unpinned by the given server,
+// like MarkUnpinned, but doesn't add the ones we don't know yet. It returns the
+// number of skylinks it found and the number of those which weren't unpinned
+// before, so the callers can tell which skylinks don't exist. The skylinks can
+// be in any encoding and we count each of them once.
+//
+// The skylinks are processed in batches. A failure to process a batch doesn't
+// prevent us from processing the remaining ones, all errors are returned
+// together at the end.
+func (db *DB) MarkUnpinnedMany(ctx context.Context, skylinks []string, server string) (matched, modified int64, err error) {
+	db.staticLogger.Tracef("Entering MarkUnpinnedMany. Skylinks: %d, server: '%s'", len(skylinks), server)
+	defer db.staticLogger.Tracef("Exiting  MarkUnpinnedMany. Skylinks: %d, server: '%s'", len(skylinks), server)
+	if err := ValidateServerName(server); err != nil {
+		return 0, 0, err
+	}
+	filter := bson.M{"pinned": bson.M{"$ne": false}}
+	return db.markMany(ctx, "MarkUnpinnedMany", skylinks, filter, markUnpinnedUpdate(server))
+}
+
+// markMany applies the given update to the given skylinks which match the
+// given filter, i.e. the ones which need it, in batches. It returns the number
+// of skylinks which exist and the number of the ones it updated.
+func (db *DB) markMany(ctx context.Context, name string, skylinks []string, filter bson.M, update interface{}) (matched, modified int64, err error) {
+	canonical, _, _ := canonicalSkylinks(skylinks)
+	err = processInBatches(canonical, nil, func(batch []string) error {
+		ctx, done := db.operation(ctx, collSkylinks, name)
+		defer done()
+		f := make(bson.M, len(filter)+1)
+		for k, v := range filter {
+			f[k] = v
+		}
+		f["_id"] = bson.M{"$in": batch}
+		ur, err := db.staticDB.Collection(collSkylinks).UpdateMany(ctx, f, update)
+		if err != nil {
+			return errors.AddContext(err, "failed to update skylinks")
+		}
+		modified += ur.ModifiedCount
+		absent, err := db.absentSkylinks(ctx, batch)
+		if err != nil {
+			return err
+		}
+		matched += int64(len(batch) - len(absent))
+		return nil
+	})
+	return matched, modified, err
+}
+
+// UpdateSkylinkWithRevision applies the given update to the skylink, unless
+// someone else updated the skylink since we read it at the given revision, in
+// which case it returns ErrStaleRevision. The caller is expected to read the
+// skylink again, recompute its changes and retry. Skylinks which predate
+// revisions are at revision zero.
+//
+// The update must be an update document, e.g. {"$set": {...}}. We add the
+// timestamps and increment the revision.
+func (db *DB) UpdateSkylinkWithRevision(ctx context.Context, skylink skymodules.Skylink, expectedRevision int64, update bson.M) error {
+	db.staticLogger.Tracef("Entering UpdateSkylinkWithRevision. Skylink: '%s', revision: %d", skylink, expectedRevision)
+	defer db.staticLogger.Tracef("Exiting  UpdateSkylinkWithRevision. Skylink: '%s', revision: %d", skylink, expectedRevision)
+	ctx, done := db.operation(ctx, collSkylinks, "UpdateSkylinkWithRevision")
+	defer done()
+	if len(update) == 0 {
+		return errors.New("empty update")
+	}
+	filter := bson.M{
+		"_id":      skylink.String(),
+		"revision": expectedRevision,
+	}
+	if expectedRevision == 0 {
+		// A missing revision matches null.
+		filter["revision"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	ur, err := db.staticDB.Collection(collSkylinks).UpdateOne(ctx, filter, withTimestamps(update))
+	if err != nil {
+		return errors.AddContext(err, "failed to update skylink")
+	}
+	if ur.MatchedCount > 0 {
+		return nil
+	}
+	// Tell the skylinks which don't exist apart from the ones which moved
+	// on.
+	_, err = db.FindSkylink(ctx, skylink)
+	if err != nil {
+		return err
+	}
+	return ErrStaleRevision
+}
+
+// AddOwner adds the given owner to the owners of the skylink and marks the
+// skylink as pinned. Adding an owner twice has no effect. If the skylink's
+// document reached the maximum size, we don't add new owners and return
+// ErrSkylinkTooLarge.
+func (db *DB) AddOwner(ctx context.Context, skylink skymodules.Skylink, owner string) error {
+	db.staticLogger.Tracef("Entering AddOwner. Skylink: '%s', owner: '%s'", skylink, owner)
+	defer db.staticLogger.Tracef("Exiting  AddOwner. Skylink: '%s', owner: '%s'", skylink, owner)
+	ctx, done := db.operation(ctx, collSkylinks, "AddOwner")
+	defer done()
+	if owner == "" {
+		return errors.New("invalid owner")
+	}
+	filter := db.withinSizeCap(bson.M{"_id": skylink.String()}, "owners", owner)
+	update := withTimestamps(bson.M{
+		"$addToSet": bson.M{"owners": owner},
+		"$set":      bson.M{"pinned": true},
+		"$unset":    bson.M{"unpinned_at": "", "unpinned_by": "", "deleted_at": ""},
+	})
+	ur, err := db.staticDB.Collection(collSkylinks).UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if ur.MatchedCount == 0 {
+		// Tell the skylinks which don't exist apart from the ones which
+		// are too large.
+		_, err = db.FindSkylink(ctx, skylink)
+		if err != nil {
+			return err
+		}
+		return ErrSkylinkTooLarge
+	}
+	return nil
+}
+
+// RemoveOwner removes the given owner from the owners of the skylink. If that
+// was the skylink's last owner, it also marks the skylink as unpinned, in the
+// same write, and returns true. Removing an owner the skylink doesn't have has
+// no effect, so it never unpins skylinks which were pinned without an owner.
+func (db *DB) RemoveOwner(ctx context.Context, skylink skymodules.Skylink, owner string) (unpinned bool, err error) {
+	db.staticLogger.Tracef("Entering RemoveOwner. Skylink: '%s', owner: '%s'", skylink, owner)
+	defer db.staticLogger.Tracef("Exiting  RemoveOwner. Skylink: '%s', owner: '%s'", skylink, owner)
+	ctx, done := db.operation(ctx, collSkylinks, "RemoveOwner")
+	defer done()
+	filter := bson.M{
+		"_id":    skylink.String(),
+		"owners": owner,
+	}
+	// We compute the new owners and the pinned flag in the same update, so
+	// concurrent removals can't leave a skylink without owners pinned.
+	noOwners := bson.M{"$eq": bson.A{bson.M{"$size": "$owners"}, 0}}
+	update := mongo.Pipeline{
+		{{"$set", bson.M{
+			"owners": bson.M{"$setDifference": bson.A{"$owners", bson.A{owner}}},
+		}}},
+		{{"$set", bson.M{
+			"pinned":      bson.M{"$cond": bson.A{noOwners, false, "$pinned"}},
+			"unpinned_at": bson.M{"$cond": bson.A{noOwners, bson.M{"$ifNull": bson.A{"$unpinned_at", "$$NOW"}}, "$unpinned_at"}},
+		}}},
+	}
+	update = withPipelineTimestamps(update)
+	opts := options.FindOneAndUpdate().
+		SetProjection(bson.M{"_id": 0, "owners": 1}).
+		SetReturnDocument(options.After)
+	sr := db.staticDB.Collection(collSkylinks).FindOneAndUpdate(ctx, filter, update, opts)
+	if sr.Err() == mongo.ErrNoDocuments {
+		// Tell the skylinks which don't exist apart from the ones which
+		// don't have this owner.
+		_, err = db.FindSkylink(ctx, skylink)
+		return false, err
+	}
+	if sr.Err() != nil {
+		return false, sr.Err()
+	}
+	var after struct {
+		Owners []string `bson:"owners"`
+	}
+	err = sr.Decode(&after)
+	if err != nil {
+		return false, errors.AddContext(err, "failed to decode the skylink")
+	}
+	return len(after.Owners) == 0, nil
+}
+
+// MarkBlocked marks a skylink as blocked, meaning that skyd refuses to pin it
+// and Pinner should stop trying to pin it.
+func (db *DB) MarkBlocked(ctx context.Context, skylink skymodules.Skylink) error {
+	db.staticLogger.Tracef("Entering MarkBlocked. Skylink: '%s'", skylink)
+	defer db.staticLogger.Tracef("Exiting  MarkBlocked. Skylink: '%s'", skylink)
+	ctx, done := db.operation(ctx, collSkylinks, "MarkBlocked")
+	defer done()
+	filter := bson.M{"_id": skylink.String()}
+	update := withTimestamps(bson.M{"$set": bson.M{"blocked": true}})
+	_, err := db.staticDB.Collection(collSkylinks).UpdateOne(ctx, filter, update)
 	return err
 }
 
@@ -123,90 +463,385 @@ func (db *DB) MarkUnpinned(ctx context.Context, skylink skymodules.Skylink) erro
 // pinners of a given skylink will set the unpin field to false is we are doing
 // that because we know that a user is pinning it but not so if we are running
 // a server sweep and documenting which skylinks are pinned by this server.
+//
+// Skylinks inserted by this method are always pinned, regardless of markPinned,
+// just like the ones inserted by CreateSkylink.
+//
+// If the skylink's document reached the maximum size, we don't add new servers
+// to it and return ErrSkylinkTooLarge. See WithMaxDocSize.
 func (db *DB) AddServerForSkylink(ctx context.Context, skylink skymodules.Skylink, server string, markPinned bool) error {
 	db.staticLogger.Tracef("Entering AddServerForSkylink. Skylink: '%s', server: '%s'", skylink, server)
 	defer db.staticLogger.Tracef("Exiting  AddServerForSkylink. Skylink: '%s', server: '%s'", skylink, server)
-	filter := bson.M{"skylink": skylink.String()}
-	var update bson.M
-	if markPinned {
-		update = bson.M{
-			"$addToSet": bson.M{"servers": server},
-			"$set":      bson.M{"pinned": true},
+	ctx, done := db.operation(ctx, collSkylinks, "AddServerForSkylink")
+	defer done()
+	if err := ValidateServerName(server); err != nil {
+		return err
+	}
+	filter := bson.M{"_id": skylink.String()}
+	update := withPipelineTimestamps(addServerUpdate(server, markPinned))
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.Before).
+		SetProjection(loadProjection(server))
+	sr := db.staticDB.Collection(collSkylinks).FindOneAndUpdate(ctx, db.withinSizeCap(filter, "servers", server), update, opts)
+	if sr.Err() == mongo.ErrNoDocuments {
+		// We inserted the skylink.
+		db.incServerLoad(ctx, server, 1, 0)
+		return nil
+	}
+	if mongo.IsDuplicateKeyError(sr.Err()) {
+		// The skylink exists but it didn't match the size cap, so the
+		// upsert tried to insert it again.
+		oversized, err := db.oversizedSkylinks(ctx, filter)
+		if err == nil && len(oversized) > 0 {
+			return ErrSkylinkTooLarge
 		}
-	} else {
-		update = bson.M{"$addToSet": bson.M{"servers": server}}
 	}
-	opts := options.Update().SetUpsert(true)
-	_, err := db.staticDB.Collection(collSkylinks).UpdateOne(ctx, filter, update, opts)
-	return err
+	if sr.Err() != nil {
+		return sr.Err()
+	}
+	var before loadBefore
+	err := sr.Decode(&before)
+	if err != nil {
+		return errors.AddContext(err, "failed to decode skylink")
+	}
+	if len(before.Servers) == 0 {
+		db.incServerLoad(ctx, server, 1, before.Size)
+	}
+	return nil
+}
+
+// AddServerForSkylinks adds a new server to the list of servers known to be
+// pinning each of the given skylinks. Skylinks which don't exist in the database
+// will be inserted as fully-formed documents. This operation is idempotent. See
+// AddServerForSkylink for details on markPinned. The skylinks can be in any
+// encoding, we store them in their canonical one. If any of them is invalid,
+// we don't add the server to any of them and return ErrInvalidSkylink.
+//
+// We don't use upserts here because an upsert with an `$in` filter inserts a
+// single document whose skylink field is the `$in` clause itself. Instead, we
+// update the existing documents and then insert the ones which are missing.
+//
+// We skip the skylinks whose document reached the maximum size and return
+// ErrSkylinkTooLarge once we're done with the rest.
+//
+// The skylinks are processed in batches. A failure to process a batch doesn't
+// prevent us from processing the remaining ones, all errors are returned
+// together at the end. If progress is not nil, it's called after each batch.
+func (db *DB) AddServerForSkylinks(ctx context.Context, skylinks []string, server string, markPinned bool, progress BatchProgressFn) error {
+	db.staticLogger.Tracef("Entering AddServerForSkylinks. Skylinks: %d, server: '%s'", len(skylinks), server)
+	defer db.staticLogger.Tracef("Exiting  AddServerForSkylinks. Skylinks: %d, server: '%s'", len(skylinks), server)
+	if err := ValidateServerName(server); err != nil {
+		return err
+	}
+	canonical, _, invalid := canonicalSkylinks(skylinks)
+	if len(invalid) > 0 {
+		return errors.AddContext(ErrInvalidSkylink, fmt.Sprintf("%d invalid skylinks, e.g. '%s'", len(invalid), invalid[0]))
+	}
+	update := withPipelineTimestamps(addServerUpdate(server, markPinned))
+	coll := db.staticDB.Collection(collSkylinks)
+	return processInBatches(canonical, progress, func(batch []string) error {
+		ctx, done := db.operation(ctx, collSkylinks, "AddServerForSkylinks")
+		defer done()
+		// Find the skylinks we can't add the server to because their
+		// documents are too large. We still add it to the rest.
+		missingServer := bson.M{
+			"_id":     bson.M{"$in": batch},
+			"servers": bson.M{"$ne": server},
+		}
+		oversized, err := db.oversizedSkylinks(ctx, missingServer)
+		if err != nil {
+			return err
+		}
+		var errTooLarge error
+		if len(oversized) > 0 {
+			errTooLarge = errors.AddContext(ErrSkylinkTooLarge, fmt.Sprintf("%d skylinks, e.g. '%s'", len(oversized), oversized[0]))
+		}
+		// Find out how much we are adding to the server's load before we
+		// add it.
+		added, err := db.loadOf(ctx, db.withinSizeCap(missingServer, "servers", server))
+		if err != nil {
+			return err
+		}
+		filter := db.withinSizeCap(bson.M{"_id": bson.M{"$in": batch}}, "servers", server)
+		_, err = coll.UpdateMany(ctx, filter, update)
+		if err != nil {
+			return errors.AddContext(err, "failed to update existing skylinks")
+		}
+		db.incServerLoad(ctx, server, added.skylinks, added.bytes)
+		absent, err := db.absentSkylinks(ctx, batch)
+		if err != nil {
+			return err
+		}
+		if len(absent) == 0 {
+			return errTooLarge
+		}
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		docs := make([]interface{}, 0, len(absent))
+		for _, sl := range absent {
+			docs = append(docs, Skylink{
+				Skylink:    sl,
+				Servers:    []string{server},
+				NumServers: 1,
+				// New skylinks are pinned by default. We only set this to
+				// false when a user explicitly unpins the skylink.
+				Pinned:    true,
+				CreatedAt: now,
+				UpdatedAt: now,
+			})
+		}
+		_, err = coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		if mongo.IsDuplicateKeyError(err) {
+			// Some of the skylinks got inserted by someone else after we
+			// checked for them. They now exist, so we can update them.
+			filter = db.withinSizeCap(bson.M{"_id": bson.M{"$in": absent}}, "servers", server)
+			_, err = coll.UpdateMany(ctx, filter, update)
+		}
+		if err != nil {
+			return errors.AddContext(err, "failed to insert new skylinks")
+		}
+		db.incServerLoad(ctx, server, int64(len(absent)), 0)
+		return errTooLarge
+	})
 }
 
-// RemoveServerFromSkylink removes a server to the list of servers known to be
+// RemoveServerFromSkylink removes a server from the list of servers known to be
 // pinning this skylink. If the skylink does not exist in the database it will
-// not be inserted.
+// not be inserted and we return ErrSkylinkNotExist. Removing a server which
+// isn't on the list is not an error.
 func (db *DB) RemoveServerFromSkylink(ctx context.Context, skylink skymodules.Skylink, server string) error {
 	db.staticLogger.Tracef("Entering RemoveServerFromSkylink. Skylink: '%s', server: '%s'", skylink, server)
 	defer db.staticLogger.Tracef("Exiting  RemoveServerFromSkylink. Skylink: '%s', server: '%s'", skylink, server)
-	filter := bson.M{
-		"skylink": skylink.String(),
-		"servers": server,
+	ctx, done := db.operation(ctx, collSkylinks, "RemoveServerFromSkylink")
+	defer done()
+	filter := bson.M{"_id": skylink.String()}
+	update := withPipelineTimestamps(removeServerUpdate(server))
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.Before).
+		SetProjection(loadProjection(server))
+	sr := db.staticDB.Collection(collSkylinks).FindOneAndUpdate(ctx, filter, update, opts)
+	if sr.Err() == mongo.ErrNoDocuments {
+		return ErrSkylinkNotExist
 	}
-	update := bson.M{"$pull": bson.M{"servers": server}}
-	_, err := db.staticDB.Collection(collSkylinks).UpdateOne(ctx, filter, update)
-	return err
+	if sr.Err() != nil {
+		return sr.Err()
+	}
+	var before loadBefore
+	err := sr.Decode(&before)
+	if err != nil {
+		return errors.AddContext(err, "failed to decode skylink")
+	}
+	if len(before.Servers) > 0 {
+		db.incServerLoad(ctx, server, -1, -before.Size)
+	}
+	return nil
+}
+
+// RemoveServerFromSkylinks removes a server from the list of servers known to
+// be pinning each of the given skylinks. Skylinks which don't exist in the
+// database will not be inserted. The skylinks can be in any encoding.
+//
+// The skylinks are processed in batches. A failure to process a batch doesn't
+// prevent us from processing the remaining ones, all errors are returned
+// together at the end. If progress is not nil, it's called after each batch.
+func (db *DB) RemoveServerFromSkylinks(ctx context.Context, skylinks []string, server string, progress BatchProgressFn) error {
+	db.staticLogger.Tracef("Entering RemoveServerFromSkylinks. Skylinks: %d, server: '%s'", len(skylinks), server)
+	defer db.staticLogger.Tracef("Exiting  RemoveServerFromSkylinks. Skylinks: %d, server: '%s'", len(skylinks), server)
+	canonical, _, _ := canonicalSkylinks(skylinks)
+	update := withPipelineTimestamps(removeServerUpdate(server))
+	return processInBatches(canonical, progress, func(batch []string) error {
+		ctx, done := db.operation(ctx, collSkylinks, "RemoveServerFromSkylinks")
+		defer done()
+		filter := bson.M{
+			"_id":     bson.M{"$in": batch},
+			"servers": server,
+		}
+		// Find out how much we are removing from the server's load before
+		// we remove it.
+		removed, err := db.loadOf(ctx, filter)
+		if err != nil {
+			return err
+		}
+		_, err = db.staticDB.Collection(collSkylinks).UpdateMany(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		db.incServerLoad(ctx, server, -removed.skylinks, -removed.bytes)
+		return nil
+	})
 }
 
 // FindAndLockUnderpinned fetches and locks a single underpinned skylink
 // from the database. The method selects only skylinks which are not pinned by
-// the given server.
+// the given server and which are not blocked. It returns the skylink's document
+// as it is after locking it, without its lists of servers and owners, which
+// can be long.
 //
 // The MongoDB query is this:
 // db.getCollection('skylinks').find({
 //     "pinned": { "$ne": false }},
-//     "$expr": { "$lt": [{ "$size": "$servers" }, 2 ]},
+//     "blocked": { "$ne": true }},
+//     "num_servers": { "$lt": 2 },
 //     "servers": { "$nin": [ "ro-tex.siasky.ivo.NOPE" ]},
 //     "$or": [
 //         { "lock_expires" : { "$exists": false }},
 //         { "lock_expires" : { "$lt": new Date() }}
 //     ]
 // })
-func (db *DB) FindAndLockUnderpinned(ctx context.Context, server string, minPinners int) (skymodules.Skylink, error) {
-	filter := bson.M{
-		// We use pinned != false because pinned == true is the default but it's
-		// possible that we've missed setting that somewhere.
-		"pinned": bson.M{"$ne": false},
-		// Pinned by fewer than the minimum number of servers.
-		"$expr": bson.M{"$lt": bson.A{bson.M{"$size": "$servers"}, minPinners}},
-		// Not pinned by the given server.
-		"servers": bson.M{"$nin": bson.A{server}},
-		// Unlocked.
-		"$or": bson.A{
-			bson.M{"lock_expires": bson.M{"$exists": false}},
-			bson.M{"lock_expires": bson.M{"$lt": time.Now().UTC().Truncate(time.Millisecond)}},
-		},
+func (db *DB) FindAndLockUnderpinned(ctx context.Context, server string, minPinners int) (Skylink, error) {
+	ctx, done := db.operation(ctx, collSkylinks, "FindAndLockUnderpinned")
+	defer done()
+	if err := ValidateServerName(server); err != nil {
+		return Skylink{}, err
 	}
-	update := bson.M{
-		"$set": bson.M{
-			"locked_by":    server,
-			"lock_expires": time.Now().UTC().Add(LockDuration).Truncate(time.Millisecond),
-		},
+	filter := underpinnedFilter(server, minPinners)
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"servers": 0, "owners": 0})
+	if db.underpinnedHint != "" {
+		opts.SetHint(db.underpinnedHint)
 	}
-	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
-	sr := db.staticDB.Collection(collSkylinks).FindOneAndUpdate(ctx, filter, update, opts)
+	sr := db.staticDB.Collection(collSkylinks).FindOneAndUpdate(ctx, filter, db.lockUpdate(server), opts)
 	if sr.Err() == mongo.ErrNoDocuments {
-		return skymodules.Skylink{}, ErrNoUnderpinnedSkylinks
+		return Skylink{}, ErrNoUnderpinnedSkylinks
 	}
 	if sr.Err() != nil {
-		return skymodules.Skylink{}, sr.Err()
+		return Skylink{}, sr.Err()
+	}
+	var s Skylink
+	err := sr.Decode(&s)
+	if err != nil {
+		return Skylink{}, errors.AddContext(err, "failed to decode result")
+	}
+	return s, nil
+}
+
+// FindAndLockUnderpinnedSkylink is like FindAndLockUnderpinned but it only
+// returns the locked skylink.
+func (db *DB) FindAndLockUnderpinnedSkylink(ctx context.Context, server string, minPinners int) (skymodules.Skylink, error) {
+	s, err := db.FindAndLockUnderpinned(ctx, server, minPinners)
+	if err != nil {
+		return skymodules.Skylink{}, err
+	}
+	return SkylinkFromString(s.Skylink)
+}
+
+// FindAndLockUnderpinnedBatch fetches and locks up to n underpinned skylinks,
+// using the same criteria as FindAndLockUnderpinned. Each skylink is locked on
+// its own, so other servers can lock the remaining underpinned skylinks while
+// we are locking ours.
+//
+// It returns ErrNoUnderpinnedSkylinks if it fails to lock any skylinks. If it
+// fails after locking some, it returns them together with the error, so the
+// caller can unlock them.
+func (db *DB) FindAndLockUnderpinnedBatch(ctx context.Context, server string, minPinners, n int) ([]skymodules.Skylink, error) {
+	db.staticLogger.Tracef("Entering FindAndLockUnderpinnedBatch. Server: '%s', n: %d", server, n)
+	defer db.staticLogger.Tracef("Exiting  FindAndLockUnderpinnedBatch. Server: '%s', n: %d", server, n)
+	if n <= 0 {
+		return nil, errors.New("invalid batch size")
+	}
+	var locked []skymodules.Skylink
+	for len(locked) < n {
+		sl, err := db.FindAndLockUnderpinnedSkylink(ctx, server, minPinners)
+		if errors.Contains(err, ErrNoUnderpinnedSkylinks) {
+			break
+		}
+		if err != nil {
+			return locked, err
+		}
+		locked = append(locked, sl)
 	}
-	var result struct {
-		Skylink string
+	if len(locked) == 0 {
+		return nil, ErrNoUnderpinnedSkylinks
 	}
-	err := sr.Decode(&result)
+	return locked, nil
+}
+
+// CountUnderpinned returns the number of skylinks which are pinned by fewer
+// than minPinners servers and which aren't blocked, i.e. the backlog of the
+// scanners across all servers. Unlike FindAndLockUnderpinned it doesn't care
+// which servers pin the skylinks or whether they are locked. It's a reporting
+// query, see reporting.
+func (db *DB) CountUnderpinned(ctx context.Context, minPinners int) (int64, error) {
+	ctx, done := db.operation(ctx, collSkylinks, "CountUnderpinned")
+	defer done()
+	filter := notDeleted(bson.M{
+		"pinned":      bson.M{"$ne": false},
+		"blocked":     bson.M{"$ne": true},
+		"num_servers": bson.M{"$lt": minPinners},
+	})
+	n, err := db.reporting(collSkylinks).CountDocuments(ctx, filter)
 	if err != nil {
-		return skymodules.Skylink{}, errors.AddContext(err, "failed to decode result")
+		return 0, errors.AddContext(err, "failed to count underpinned skylinks")
 	}
-	return SkylinkFromString(result.Skylink)
+	return n, nil
+}
+
+// CountUnderpinnedForServer returns the number of skylinks the given server's
+// scanner could lock and pin right now, i.e. the number of skylinks
+// FindAndLockUnderpinned would return one by one until it runs out. Unlike
+// CountUnderpinned it excludes the skylinks the server already pins and the
+// locked ones. It reads from the primary, so its result matches what the
+// scanner sees.
+func (db *DB) CountUnderpinnedForServer(ctx context.Context, server string, minPinners int) (int64, error) {
+	db.staticLogger.Tracef("Entering CountUnderpinnedForServer. Server: '%s'", server)
+	defer db.staticLogger.Tracef("Exiting  CountUnderpinnedForServer. Server: '%s'", server)
+	ctx, done := db.operation(ctx, collSkylinks, "CountUnderpinnedForServer")
+	defer done()
+	opts := options.Count()
+	if db.underpinnedHint != "" {
+		opts.SetHint(db.underpinnedHint)
+	}
+	n, err := db.staticDB.Collection(collSkylinks).CountDocuments(ctx, underpinnedFilter(server, minPinners), opts)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to count underpinned skylinks for server")
+	}
+	return n, nil
+}
+
+// CountsByPinnerCount returns a histogram of the pinned skylinks by the number
+// of servers which pin them, e.g. {0: 3, 1: 10, 2: 500}. Numbers of pinners
+// which no skylink has are not included in the result. It's a reporting query,
+// see reporting.
+//
+// The MongoDB query is this:
+// db.getCollection('skylinks').aggregate([
+//     { "$match": {
+//         "pinned": { "$ne": false },
+//         "deleted_at": { "$exists": false }
+//     }},
+//     { "$group": {
+//         "_id": "$num_servers",
+//         "count": { "$sum": 1 }
+//     }}
+// ])
+func (db *DB) CountsByPinnerCount(ctx context.Context) (map[int]int64, error) {
+	ctx, done := db.operation(ctx, collSkylinks, "CountsByPinnerCount")
+	defer done()
+	pipeline := mongo.Pipeline{
+		{{"$match", notDeleted(bson.M{"pinned": bson.M{"$ne": false}})}},
+		{{"$group", bson.M{
+			"_id":   "$num_servers",
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+	c, err := db.reporting(collSkylinks).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to aggregate skylinks by pinner count")
+	}
+	var results []struct {
+		Pinners int   `bson:"_id"`
+		Count   int64 `bson:"count"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode results")
+	}
+	counts := make(map[int]int64, len(results))
+	for _, r := range results {
+		counts[r.Pinners] = r.Count
+	}
+	return counts, nil
 }
 
 // SkylinksForServer returns a list of skylinks pinned by the given server
@@ -214,7 +849,10 @@ func (db *DB) FindAndLockUnderpinned(ctx context.Context, server string, minPinn
 // list of skylink the server is actually pinning, it's the list the database
 // knows of.
 func (db *DB) SkylinksForServer(ctx context.Context, server string) ([]string, error) {
-	c, err := db.staticDB.Collection(collSkylinks).Find(ctx, bson.M{"servers": server})
+	ctx, done := db.operation(ctx, collSkylinks, "SkylinksForServer")
+	defer done()
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	c, err := db.staticDB.Collection(collSkylinks).Find(ctx, notDeleted(bson.M{"servers": server}), opts)
 	if errors.Contains(err, mongo.ErrNoDocuments) {
 		return []string{}, nil
 	}
@@ -222,7 +860,7 @@ func (db *DB) SkylinksForServer(ctx context.Context, server string) ([]string, e
 		return nil, err
 	}
 	var results []struct {
-		Skylink string
+		Skylink string `bson:"_id"`
 	}
 	err = c.All(ctx, &results)
 	if err != nil {
@@ -235,13 +873,100 @@ func (db *DB) SkylinksForServer(ctx context.Context, server string) ([]string, e
 	return skylinks, nil
 }
 
+// ForEachSkylinkForServer calls fn for each skylink pinned by the given server.
+// Unlike SkylinksForServer, it streams the skylinks from the database, so it
+// doesn't need to hold them all in memory. It stops at the first error returned
+// by fn.
+func (db *DB) ForEachSkylinkForServer(ctx context.Context, server string, fn func(skylink string) error) error {
+	db.staticLogger.Tracef("Entering ForEachSkylinkForServer. Server: '%s'", server)
+	defer db.staticLogger.Tracef("Exiting  ForEachSkylinkForServer. Server: '%s'", server)
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	c, err := db.staticDB.Collection(collSkylinks).Find(ctx, notDeleted(bson.M{"servers": server}), opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := c.Close(ctx); errClose != nil {
+			db.staticLogger.Debug(errors.AddContext(errClose, "failed to close cursor"))
+		}
+	}()
+	for c.Next(ctx) {
+		var result struct {
+			Skylink string `bson:"_id"`
+		}
+		err = c.Decode(&result)
+		if err != nil {
+			return errors.AddContext(err, "failed to decode result")
+		}
+		err = fn(result.Skylink)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// SkylinksForServerPage returns a page of at most limit skylinks pinned by the
+// given server. The pages are ordered by the skylinks, so paging through
+// them lists each skylink the server pins throughout at most once, even if
+// other skylinks get added or removed in the meantime. The ones which get added
+// may or may not be listed. The first page is fetched with an empty token, each
+// following one with the token returned with the previous page. The token is
+// empty when there are no more pages.
+func (db *DB) SkylinksForServerPage(ctx context.Context, server, token string, limit int) ([]string, string, error) {
+	db.staticLogger.Tracef("Entering SkylinksForServerPage. Server: '%s', token: '%s'", server, token)
+	defer db.staticLogger.Tracef("Exiting  SkylinksForServerPage. Server: '%s', token: '%s'", server, token)
+	ctx, done := db.operation(ctx, collSkylinks, "SkylinksForServerPage")
+	defer done()
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid page limit %d", limit)
+	}
+	filter := notDeleted(bson.M{"servers": server})
+	if token != "" {
+		// The tokens are the last skylinks of the pages. This also rejects
+		// the hex IDs older versions of pinner issued.
+		if sl, err := canonicalSkylink(token); err != nil || sl != token {
+			return nil, "", errors.Compose(err, ErrInvalidPageToken)
+		}
+		filter["_id"] = bson.M{"$gt": token}
+	}
+	// We fetch one extra skylink to tell whether there is another page.
+	opts := options.Find().
+		SetProjection(bson.M{"_id": 1}).
+		SetSort(bson.M{"_id": 1}).
+		SetLimit(int64(limit) + 1)
+	c, err := db.staticDB.Collection(collSkylinks).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	var results []Skylink
+	err = c.All(ctx, &results)
+	if err != nil {
+		return nil, "", errors.AddContext(err, "failed to decode results")
+	}
+	next := ""
+	if len(results) > limit {
+		results = results[:limit]
+		next = results[limit-1].Skylink
+	}
+	skylinks := make([]string, len(results))
+	for i, r := range results {
+		skylinks[i] = r.Skylink
+	}
+	return skylinks, next, nil
+}
+
 // UnlockSkylink removes the lock on the skylink put while we're trying to pin
-// it to a new server.
+// it to a new server. Unlocking a skylink which isn't locked is a no-op. It
+// returns ErrSkylinkNotExist if the skylink doesn't exist and
+// ErrLockedByAnotherServer if another server holds the lock.
 func (db *DB) UnlockSkylink(ctx context.Context, skylink skymodules.Skylink, server string) error {
 	db.staticLogger.Tracef("Entering UnlockSkylink. Skylink: '%s', server: '%s'", skylink, server)
 	defer db.staticLogger.Tracef("Exiting  UnlockSkylink. Skylink: '%s', server: '%s'", skylink, server)
+	ctx, done := db.operation(ctx, collSkylinks, "UnlockSkylink")
+	defer done()
 	filter := bson.M{
-		"skylink":   skylink.String(),
+		"_id":       skylink.String(),
 		"locked_by": server,
 	}
 	update := bson.M{
@@ -251,10 +976,590 @@ func (db *DB) UnlockSkylink(ctx context.Context, skylink skymodules.Skylink, ser
 		},
 	}
 	ur, err := db.staticDB.Collection(collSkylinks).UpdateOne(ctx, filter, update)
-	if errors.Contains(err, mongo.ErrNoDocuments) || ur.ModifiedCount == 0 {
-		return ErrNoSkylinksLocked
+	if err != nil {
+		return err
 	}
-	return err
+	if ur.MatchedCount > 0 {
+		return nil
+	}
+	// We didn't hold the lock, find out why.
+	opts := options.FindOne().SetProjection(bson.M{"_id": 0, "locked_by": 1})
+	sr := db.staticDB.Collection(collSkylinks).FindOne(ctx, bson.M{"_id": skylink.String()}, opts)
+	if sr.Err() == mongo.ErrNoDocuments {
+		return ErrSkylinkNotExist
+	}
+	if sr.Err() != nil {
+		return sr.Err()
+	}
+	var s struct {
+		LockedBy string `bson:"locked_by"`
+	}
+	err = sr.Decode(&s)
+	if err != nil {
+		return errors.AddContext(err, "failed to decode skylink")
+	}
+	if s.LockedBy != "" {
+		return ErrLockedByAnotherServer
+	}
+	return nil
+}
+
+// MarkServerPinnedAndUnlock adds the given server to the list of servers
+// pinning the skylink and removes the server's lock on it in a single write, so
+// a crash can't leave behind a skylink which we've pinned but still hold
+// locked.
+//
+// If the skylink isn't locked by the given server, e.g. because our lock
+// expired and someone else locked it, we still add the server but we leave the
+// lock untouched and return ErrNoSkylinksLocked.
+//
+// If the skylink's document reached the maximum size, we neither add the server
+// nor release the lock and return ErrSkylinkTooLarge. See WithMaxDocSize.
+func (db *DB) MarkServerPinnedAndUnlock(ctx context.Context, skylink skymodules.Skylink, server string) error {
+	db.staticLogger.Tracef("Entering MarkServerPinnedAndUnlock. Skylink: '%s', server: '%s'", skylink, server)
+	defer db.staticLogger.Tracef("Exiting  MarkServerPinnedAndUnlock. Skylink: '%s', server: '%s'", skylink, server)
+	ctx, done := db.operation(ctx, collSkylinks, "MarkServerPinnedAndUnlock")
+	defer done()
+	if err := ValidateServerName(server); err != nil {
+		return err
+	}
+	filter := bson.M{
+		"_id":       skylink.String(),
+		"locked_by": server,
+	}
+	update := append(addServerUpdate(server, false), bson.D{{"$set", bson.M{
+		"locked_by":    "",
+		"lock_expires": time.Time{},
+	}}})
+	update = withPipelineTimestamps(update)
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.Before).
+		SetProjection(loadProjection(server))
+	sr := db.staticDB.Collection(collSkylinks).FindOneAndUpdate(ctx, db.withinSizeCap(filter, "servers", server), update, opts)
+	if sr.Err() != nil && sr.Err() != mongo.ErrNoDocuments {
+		return sr.Err()
+	}
+	if sr.Err() == nil {
+		var before loadBefore
+		err := sr.Decode(&before)
+		if err != nil {
+			return errors.AddContext(err, "failed to decode skylink")
+		}
+		if len(before.Servers) == 0 {
+			db.incServerLoad(ctx, server, 1, before.Size)
+		}
+		return nil
+	}
+	err := db.AddServerForSkylink(ctx, skylink, server, false)
+	if err != nil {
+		return errors.AddContext(err, "failed to add server to a skylink we don't hold locked")
+	}
+	return ErrNoSkylinksLocked
+}
+
+// absentSkylinks returns the subset of the given skylinks which don't have a
+// document in the database.
+func (db *DB) absentSkylinks(ctx context.Context, skylinks []string) ([]string, error) {
+	filter := bson.M{"_id": bson.M{"$in": skylinks}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	c, err := db.staticDB.Collection(collSkylinks).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find existing skylinks")
+	}
+	var results []struct {
+		Skylink string `bson:"_id"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode results")
+	}
+	existing := make(map[string]struct{}, len(results))
+	for _, r := range results {
+		existing[r.Skylink] = struct{}{}
+	}
+	var absent []string
+	for _, sl := range skylinks {
+		if _, exists := existing[sl]; !exists {
+			absent = append(absent, sl)
+		}
+	}
+	return absent, nil
+}
+
+// UnpinnedSkylinks returns the subset of the given skylinks which have a
+// document in the database that marks them as unpinned. The lookup is done in
+// batches. The skylinks can be in any encoding, they are returned as given.
+func (db *DB) UnpinnedSkylinks(ctx context.Context, skylinks []string) ([]string, error) {
+	db.staticLogger.Tracef("Entering UnpinnedSkylinks. Skylinks: %d", len(skylinks))
+	defer db.staticLogger.Tracef("Exiting  UnpinnedSkylinks. Skylinks: %d", len(skylinks))
+	canonical, originals, _ := canonicalSkylinks(skylinks)
+	var unpinned []string
+	err := processInBatches(canonical, nil, func(batch []string) error {
+		ctx, done := db.operation(ctx, collSkylinks, "UnpinnedSkylinks")
+		defer done()
+		filter := notDeleted(bson.M{
+			"_id":    bson.M{"$in": batch},
+			"pinned": false,
+		})
+		opts := options.Find().SetProjection(bson.M{"_id": 1})
+		c, err := db.staticDB.Collection(collSkylinks).Find(ctx, filter, opts)
+		if err != nil {
+			return errors.AddContext(err, "failed to find unpinned skylinks")
+		}
+		var results []struct {
+			Skylink string `bson:"_id"`
+		}
+		err = c.All(ctx, &results)
+		if err != nil {
+			return errors.AddContext(err, "failed to decode results")
+		}
+		for _, r := range results {
+			unpinned = append(unpinned, originals[r.Skylink]...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unpinned, nil
+}
+
+// MissingSkylinks returns the subset of the given skylinks which don't have a
+// document in the database. Soft-deleted skylinks still have one. The lookup is
+// done in batches. The skylinks can be in any encoding, they are returned as
+// given. Invalid skylinks are never missing.
+func (db *DB) MissingSkylinks(ctx context.Context, skylinks []string) ([]string, error) {
+	db.staticLogger.Tracef("Entering MissingSkylinks. Skylinks: %d", len(skylinks))
+	defer db.staticLogger.Tracef("Exiting  MissingSkylinks. Skylinks: %d", len(skylinks))
+	canonical, originals, invalid := canonicalSkylinks(skylinks)
+	isInvalid := make(map[string]struct{}, len(invalid))
+	for _, s := range invalid {
+		isInvalid[s] = struct{}{}
+	}
+	var missing []string
+	err := processInBatches(canonical, nil, func(batch []string) error {
+		ctx, done := db.operation(ctx, collSkylinks, "MissingSkylinks")
+		defer done()
+		absent, err := db.absentSkylinks(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, sl := range absent {
+			if _, ok := isInvalid[sl]; !ok {
+				missing = append(missing, originals[sl]...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return missing, nil
+}
+
+// ForEachPinnedSkylink calls fn for each skylink the database marks as pinned,
+// regardless of the servers which pin it. It streams the skylinks from the
+// database and stops at the first error returned by fn.
+func (db *DB) ForEachPinnedSkylink(ctx context.Context, fn func(skylink string) error) error {
+	db.staticLogger.Tracef("Entering ForEachPinnedSkylink")
+	defer db.staticLogger.Tracef("Exiting  ForEachPinnedSkylink")
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	c, err := db.staticDB.Collection(collSkylinks).Find(ctx, notDeleted(bson.M{"pinned": bson.M{"$ne": false}}), opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := c.Close(ctx); errClose != nil {
+			db.staticLogger.Debug(errors.AddContext(errClose, "failed to close cursor"))
+		}
+	}()
+	for c.Next(ctx) {
+		var result struct {
+			Skylink string `bson:"_id"`
+		}
+		err = c.Decode(&result)
+		if err != nil {
+			return errors.AddContext(err, "failed to decode result")
+		}
+		err = fn(result.Skylink)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// SkylinkSizes returns the stored sizes of the given skylinks, keyed by the
+// skylinks as given. Skylinks whose size we don't know are not included in the
+// result.
+func (db *DB) SkylinkSizes(ctx context.Context, skylinks []string) (map[string]uint64, error) {
+	db.staticLogger.Tracef("Entering SkylinkSizes. Skylinks: %d", len(skylinks))
+	defer db.staticLogger.Tracef("Exiting  SkylinkSizes. Skylinks: %d", len(skylinks))
+	canonical, originals, _ := canonicalSkylinks(skylinks)
+	sizes := make(map[string]uint64)
+	err := processInBatches(canonical, nil, func(batch []string) error {
+		ctx, done := db.operation(ctx, collSkylinks, "SkylinkSizes")
+		defer done()
+		filter := notDeleted(bson.M{
+			"_id":  bson.M{"$in": batch},
+			"size": bson.M{"$gt": 0},
+		})
+		opts := options.Find().SetProjection(bson.M{"_id": 1, "size": 1})
+		c, err := db.staticDB.Collection(collSkylinks).Find(ctx, filter, opts)
+		if err != nil {
+			return errors.AddContext(err, "failed to find skylink sizes")
+		}
+		var results []Skylink
+		err = c.All(ctx, &results)
+		if err != nil {
+			return errors.AddContext(err, "failed to decode results")
+		}
+		for _, r := range results {
+			for _, sl := range originals[r.Skylink] {
+				sizes[sl] = r.Size
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// SetSkylinkSizes stores the given sizes of skylinks. Skylinks which don't
+// exist in the database are ignored.
+func (db *DB) SetSkylinkSizes(ctx context.Context, sizes map[string]uint64) error {
+	db.staticLogger.Tracef("Entering SetSkylinkSizes. Skylinks: %d", len(sizes))
+	defer db.staticLogger.Tracef("Exiting  SetSkylinkSizes. Skylinks: %d", len(sizes))
+	// Key the sizes by the canonical skylinks. Strings which aren't valid
+	// skylinks can't match any document, so we keep them as they are.
+	canonicalSizes := make(map[string]uint64, len(sizes))
+	for sl, size := range sizes {
+		if c, err := canonicalSkylink(sl); err == nil {
+			sl = c
+		}
+		canonicalSizes[sl] = size
+	}
+	sizes = canonicalSizes
+	skylinks := make([]string, 0, len(sizes))
+	for sl := range sizes {
+		skylinks = append(skylinks, sl)
+	}
+	return processInBatches(skylinks, nil, func(batch []string) error {
+		ctx, done := db.operation(ctx, collSkylinks, "SetSkylinkSizes")
+		defer done()
+		// The new sizes change the loads of the servers which pin the
+		// skylinks.
+		opts := options.Find().SetProjection(bson.M{"_id": 1, "size": 1, "servers": 1})
+		c, err := db.staticDB.Collection(collSkylinks).Find(ctx, bson.M{"_id": bson.M{"$in": batch}}, opts)
+		if err != nil {
+			return errors.AddContext(err, "failed to find skylinks")
+		}
+		var docs []Skylink
+		err = c.All(ctx, &docs)
+		if err != nil {
+			return errors.AddContext(err, "failed to decode skylinks")
+		}
+		deltas := make(map[string]loadDelta)
+		for _, d := range docs {
+			diff := int64(sizes[d.Skylink]) - int64(d.Size)
+			if diff == 0 {
+				continue
+			}
+			for _, server := range d.Servers {
+				delta := deltas[server]
+				delta.bytes += diff
+				deltas[server] = delta
+			}
+		}
+		models := make([]mongo.WriteModel, 0, len(batch))
+		for _, sl := range batch {
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": sl}).
+				SetUpdate(withTimestamps(bson.M{"$set": bson.M{"size": sizes[sl]}})))
+		}
+		_, err = db.staticDB.Collection(collSkylinks).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return errors.AddContext(err, "failed to store skylink sizes")
+		}
+		db.incServerLoads(ctx, deltas)
+		return nil
+	})
+}
+
+// SetSkylinkMetadata stores the size and the type of the skyfile, as given by
+// its metadata, on the skylink's document. A zero length doesn't tell us
+// anything, so we keep the size we already know in that case. It returns
+// ErrSkylinkNotExist if there is no such skylink.
+func (db *DB) SetSkylinkMetadata(ctx context.Context, skylink skymodules.Skylink, meta skymodules.SkyfileMetadata) error {
+	db.staticLogger.Tracef("Entering SetSkylinkMetadata. Skylink: '%s'", skylink)
+	defer db.staticLogger.Tracef("Exiting  SetSkylinkMetadata. Skylink: '%s'", skylink)
+	ctx, done := db.operation(ctx, collSkylinks, "SetSkylinkMetadata")
+	defer done()
+	set := bson.M{"is_directory": meta.IsDirectory()}
+	if meta.Length > 0 {
+		set["size"] = meta.Length
+	}
+	update := bson.M{"$set": set}
+	if ct := meta.ContentType(); ct != "" {
+		set["content_type"] = ct
+	} else {
+		update["$unset"] = bson.M{"content_type": ""}
+	}
+	// The new size changes the loads of the servers which pin the skylink.
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.Before).
+		SetProjection(bson.M{"_id": 0, "size": 1, "servers": 1})
+	sr := db.staticDB.Collection(collSkylinks).FindOneAndUpdate(ctx, bson.M{"_id": skylink.String()}, withTimestamps(update), opts)
+	if sr.Err() == mongo.ErrNoDocuments {
+		return ErrSkylinkNotExist
+	}
+	if sr.Err() != nil {
+		return errors.AddContext(sr.Err(), "failed to store skylink metadata")
+	}
+	var before loadBefore
+	err := sr.Decode(&before)
+	if err != nil {
+		return errors.AddContext(err, "failed to decode skylink")
+	}
+	if diff := int64(meta.Length) - before.Size; meta.Length > 0 && diff != 0 {
+		deltas := make(map[string]loadDelta, len(before.Servers))
+		for _, server := range before.Servers {
+			deltas[server] = loadDelta{bytes: diff}
+		}
+		db.incServerLoads(ctx, deltas)
+	}
+	return nil
+}
+
+// NumBatches returns the number of batches a batch operation over the given
+// number of skylinks will be split into.
+func NumBatches(numSkylinks int) int {
+	return (numSkylinks + skylinksBatchSize - 1) / skylinksBatchSize
+}
+
+// processInBatches splits the given skylinks into batches of skylinksBatchSize
+// and calls fn for each one of them. It continues processing even if some of
+// the batches fail and returns all errors together. If progress is not nil,
+// it's called after each batch.
+func processInBatches(skylinks []string, progress BatchProgressFn, fn func(batch []string) error) error {
+	var errs []error
+	total := NumBatches(len(skylinks))
+	for i := 0; i < total; i++ {
+		end := (i + 1) * skylinksBatchSize
+		if end > len(skylinks) {
+			end = len(skylinks)
+		}
+		err := fn(skylinks[i*skylinksBatchSize : end])
+		if err != nil {
+			errs = append(errs, errors.AddContext(err, fmt.Sprintf("failed to process batch %d of %d", i+1, total)))
+		}
+		if progress != nil {
+			progress(i+1, total)
+		}
+	}
+	return errors.Compose(errs...)
+}
+
+// ClearExpiredLocks removes the locks of all skylinks whose lock has expired,
+// e.g. locks left behind by servers which crashed while pinning. It returns the
+// number of cleared locks.
+func (db *DB) ClearExpiredLocks(ctx context.Context) (int64, error) {
+	ctx, done := db.operation(ctx, collSkylinks, "ClearExpiredLocks")
+	defer done()
+	db.staticLogger.Trace("Entering ClearExpiredLocks")
+	defer db.staticLogger.Trace("Exiting  ClearExpiredLocks")
+	filter := bson.M{
+		"locked_by": bson.M{"$exists": true, "$ne": ""},
+		// We use the database's notion of time instead of ours in order to
+		// avoid issues with clock drift between servers.
+		"$expr": bson.M{"$lt": bson.A{"$lock_expires", "$$NOW"}},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"locked_by":    "",
+			"lock_expires": time.Time{},
+		},
+	}
+	ur, err := db.staticDB.Collection(collSkylinks).UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return ur.ModifiedCount, nil
+}
+
+// DeleteUnpinned soft-deletes the skylinks which have been unpinned for longer
+// than the given retention period and which no server pins anymore. It returns
+// the number of deleted skylinks. PurgeDeleted removes them for good later.
+func (db *DB) DeleteUnpinned(ctx context.Context, retention time.Duration) (int64, error) {
+	db.staticLogger.Tracef("Entering DeleteUnpinned. Retention: %v", retention)
+	defer db.staticLogger.Tracef("Exiting  DeleteUnpinned. Retention: %v", retention)
+	ctx, done := db.operation(ctx, collSkylinks, "DeleteUnpinned")
+	defer done()
+	if retention <= 0 {
+		return 0, errors.New("invalid retention period")
+	}
+	filter := notDeleted(bson.M{
+		"pinned":    false,
+		"servers.0": bson.M{"$exists": false},
+		// Missing fields compare as lower than any date.
+		"unpinned_at": bson.M{"$type": "date"},
+		// We use the database's notion of time, like ClearExpiredLocks.
+		"$expr": bson.M{"$lt": bson.A{
+			"$unpinned_at",
+			bson.M{"$subtract": bson.A{"$$NOW", retention.Milliseconds()}},
+		}},
+	})
+	ur, err := db.staticDB.Collection(collSkylinks).UpdateMany(ctx, filter, softDeleteUpdate())
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to delete unpinned skylinks")
+	}
+	return ur.ModifiedCount, nil
+}
+
+// underpinnedFilter returns the filter which selects the skylinks the given
+// server should lock and pin, i.e. the ones which are pinned by fewer than
+// minPinners servers, not by the given one, and which are neither blocked nor
+// locked nor deleted.
+func underpinnedFilter(server string, minPinners int) bson.M {
+	return notDeleted(bson.M{
+		// We use pinned != false because pinned == true is the default but it's
+		// possible that we've missed setting that somewhere.
+		"pinned": bson.M{"$ne": false},
+		// Not blocked.
+		"blocked": bson.M{"$ne": true},
+		// Pinned by fewer than the minimum number of servers.
+		"num_servers": bson.M{"$lt": minPinners},
+		// Not pinned by the given server.
+		"servers": bson.M{"$nin": bson.A{server}},
+		// Unlocked.
+		"$or": bson.A{
+			bson.M{"lock_expires": bson.M{"$exists": false}},
+			bson.M{"lock_expires": bson.M{"$lt": time.Now().UTC().Truncate(time.Millisecond)}},
+		},
+	})
+}
+
+// lockUpdate returns the update which locks a skylink for the given server for
+// the DB's lock duration.
+func (db *DB) lockUpdate(server string) bson.M {
+	return bson.M{
+		"$set": bson.M{
+			"locked_by":    server,
+			"lock_expires": time.Now().UTC().Add(db.LockDuration()).Truncate(time.Millisecond),
+		},
+	}
+}
+
+// addServerUpdate returns the pipeline update which adds the given server to
+// the skylink's servers, unless it's already there, and updates num_servers to
+// match. Pipeline updates allow us to keep the two in sync in a single write.
+// See AddServerForSkylink for details on markPinned.
+func addServerUpdate(server string, markPinned bool) mongo.Pipeline {
+	servers := bson.M{"$ifNull": bson.A{"$servers", bson.A{}}}
+	// We use $literal, so server names can't be mistaken for field paths.
+	srv := bson.M{"$literal": server}
+	update := mongo.Pipeline{
+		{{"$set", bson.M{"servers": bson.M{"$cond": bson.A{
+			bson.M{"$in": bson.A{srv, servers}},
+			servers,
+			bson.M{"$concatArrays": bson.A{servers, bson.A{srv}}},
+		}}}}},
+		{{"$set", bson.M{"num_servers": bson.M{"$size": "$servers"}}}},
+		// A skylink which a server pins is no longer deleted.
+		{{"$unset", "deleted_at"}},
+	}
+	if markPinned {
+		return append(update,
+			bson.D{{"$set", bson.M{"pinned": true}}},
+			bson.D{{"$unset", bson.A{"unpinned_at", "unpinned_by"}}},
+		)
+	}
+	// New skylinks are pinned by default. We only set this to false when a
+	// user explicitly unpins the skylink.
+	return append(update, bson.D{{"$set", bson.M{"pinned": bson.M{"$ifNull": bson.A{"$pinned", true}}}}})
+}
+
+// removeServerUpdate returns the pipeline update which removes the given
+// server from the skylink's servers and updates num_servers to match.
+func removeServerUpdate(server string) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{"$set", bson.M{"servers": bson.M{"$filter": bson.M{
+			"input": bson.M{"$ifNull": bson.A{"$servers", bson.A{}}},
+			"cond":  bson.M{"$ne": bson.A{"$$this", bson.M{"$literal": server}}},
+		}}}}},
+		{{"$set", bson.M{"num_servers": bson.M{"$size": "$servers"}}}},
+	}
+}
+
+// withPipelineTimestamps is the equivalent of withTimestamps for pipeline
+// updates.
+func withPipelineTimestamps(update mongo.Pipeline) mongo.Pipeline {
+	return append(update, bson.D{{"$set", bson.M{
+		"created_at": bson.M{"$ifNull": bson.A{"$created_at", time.Now().UTC().Truncate(time.Millisecond)}},
+		"updated_at": "$$NOW",
+		"revision":   bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$revision", 0}}, 1}},
+	}}})
+}
+
+// newSkylinkFields returns the fields the upserts which create skylinks set on
+// insert, so the documents they create have the same shape as the ones
+// CreateSkylink inserts, only without any servers.
+func newSkylinkFields() bson.M {
+	return bson.M{
+		"servers":      bson.A{},
+		"num_servers":  0,
+		"locked_by":    "",
+		"lock_expires": time.Time{},
+	}
+}
+
+// markUnpinnedUpdate returns the pipeline update which marks a skylink as
+// unpinned by the given server. We only record the time and the server of the
+// first unpin, so we need a pipeline update in order to set both or neither.
+// Pipeline updates don't support $setOnInsert, so the fields of new skylinks
+// only get their defaults if they are missing.
+func markUnpinnedUpdate(server string) mongo.Pipeline {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	unpinned := bson.M{"$eq": bson.A{bson.M{"$type": "$unpinned_at"}, "date"}}
+	set := bson.M{
+		"pinned":      false,
+		"unpinned_at": bson.M{"$cond": bson.A{unpinned, "$unpinned_at", now}},
+		// We use $literal, so server names can't be mistaken for field
+		// paths.
+		"unpinned_by": bson.M{"$cond": bson.A{unpinned, "$unpinned_by", bson.M{"$literal": server}}},
+	}
+	for field, value := range newSkylinkFields() {
+		set[field] = bson.M{"$ifNull": bson.A{"$" + field, bson.M{"$literal": value}}}
+	}
+	return withPipelineTimestamps(mongo.Pipeline{{{"$set", set}}})
+}
+
+// withTimestamps adds the updates of the skylink's timestamps to the given
+// update. It sets updated_at to the database's current time and, in case the
+// update inserts a new skylink, created_at to ours. It also increments the
+// skylink's revision.
+func withTimestamps(update bson.M) bson.M {
+	setOnInsert, ok := update["$setOnInsert"].(bson.M)
+	if !ok {
+		setOnInsert = bson.M{}
+		update["$setOnInsert"] = setOnInsert
+	}
+	setOnInsert["created_at"] = time.Now().UTC().Truncate(time.Millisecond)
+	currentDate, ok := update["$currentDate"].(bson.M)
+	if !ok {
+		currentDate = bson.M{}
+		update["$currentDate"] = currentDate
+	}
+	currentDate["updated_at"] = true
+	inc, ok := update["$inc"].(bson.M)
+	if !ok {
+		inc = bson.M{}
+		update["$inc"] = inc
+	}
+	inc["revision"] = 1
+	return update
 }
 
 // IsNoSkylinksNeedPinning returns true when the given error indicates that
@@ -272,3 +1577,36 @@ func SkylinkFromString(s string) (skymodules.Skylink, error) {
 	}
 	return sl, nil
 }
+
+// canonicalSkylink returns the canonical string form of the given skylink,
+// which is the one we store. Skylinks arrive in different encodings, e.g.
+// base32 or with a path, and we want all of them to map to the same document.
+func canonicalSkylink(s string) (string, error) {
+	sl, err := SkylinkFromString(s)
+	if err != nil {
+		return "", errors.Compose(ErrInvalidSkylink, err)
+	}
+	return sl.String(), nil
+}
+
+// canonicalSkylinks returns the canonical forms of the given skylinks, without
+// duplicates and in the order of their first occurrence, together with the
+// given strings which map to each of them. Strings which aren't valid skylinks
+// are kept as they are, so they only match themselves, and are also returned
+// in invalid.
+func canonicalSkylinks(skylinks []string) (canonical []string, originals map[string][]string, invalid []string) {
+	canonical = make([]string, 0, len(skylinks))
+	originals = make(map[string][]string, len(skylinks))
+	for _, s := range skylinks {
+		c, err := canonicalSkylink(s)
+		if err != nil {
+			c = s
+			invalid = append(invalid, s)
+		}
+		if _, exists := originals[c]; !exists {
+			canonical = append(canonical, c)
+		}
+		originals[c] = append(originals[c], s)
+	}
+	return canonical, originals, invalid
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+)
+
+// WithTransaction runs fn in a transaction, so either all of its writes are
+// applied or none of them are. fn must do all of its work through the context
+// it's given, which binds it to the transaction's session.
+//
+// The driver retries fn when the transaction fails with a transient error, so
+// fn must be safe to run more than once.
+//
+// Transactions need a replica set or a sharded cluster. Against a standalone
+// server, or when the DB was created with WithoutTransactions, we log a warning
+// and run fn without a transaction, that is, a failure midway leaves behind
+// the writes fn made before it.
+func (db *DB) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !db.staticTransactions {
+		db.staticLogger.Warn("Transactions are not supported, running the operation without one.")
+		return fn(ctx)
+	}
+	session, err := db.staticDB.Client().StartSession()
+	if err != nil {
+		return errors.AddContext(err, "failed to start a session")
+	}
+	defer session.EndSession(ctx)
+	opts := options.Transaction().SetReadConcern(readconcern.Snapshot())
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	}, opts)
+	return err
+}
+
+// supportsTransactions returns whether the deployment we're connected to
+// supports transactions, i.e. whether it's a replica set or a sharded cluster.
+func supportsTransactions(ctx context.Context, db *mongo.Database) (bool, error) {
+	var result struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := db.RunCommand(ctx, bson.D{{"isMaster", 1}}).Decode(&result)
+	if err != nil {
+		return false, errors.AddContext(err, "failed to inspect the database topology")
+	}
+	return result.SetName != "" || result.Msg == "isdbgrid", nil
+}
@@ -12,6 +12,8 @@ require (
 	gitlab.com/SkynetLabs/skyd v1.5.11-0.20220602130931-5cc1e329e59d
 	go.mongodb.org/mongo-driver v1.9.1
 	go.sia.tech/siad v1.5.8
+	golang.org/x/sync v0.0.0-20220601150217-0de741cfad7f
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -49,8 +51,6 @@ require (
 	gitlab.com/NebulousLabs/writeaheadlog v0.0.0-20200907122230-17c1f03b80d4 // indirect
 	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e // indirect
 	golang.org/x/net v0.0.0-20220607020251-c690dde0001d // indirect
-	golang.org/x/sync v0.0.0-20220601150217-0de741cfad7f // indirect
 	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
 	golang.org/x/text v0.3.7 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
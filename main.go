@@ -2,24 +2,33 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"os"
 
+	"github.com/sirupsen/logrus"
+	"github.com/skynetlabs/pinner/accounts"
 	"github.com/skynetlabs/pinner/api"
 	"github.com/skynetlabs/pinner/build"
 	"github.com/skynetlabs/pinner/conf"
 	"github.com/skynetlabs/pinner/database"
 	"github.com/skynetlabs/pinner/logger"
 	"github.com/skynetlabs/pinner/skyd"
+	"github.com/skynetlabs/pinner/sweeper"
 	"github.com/skynetlabs/pinner/workers"
 	"gitlab.com/NebulousLabs/errors"
 )
 
 func main() {
 	// Load the configuration from the environment and the local .env file.
-	cfg, err := conf.LoadConfig()
+	cfg, unknown, err := conf.LoadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = cfg.Validate()
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "invalid configuration"))
+	}
 
 	// Initialise the global context and logger. These will be used throughout
 	// the service. Once the context is closed, any background threads will
@@ -34,29 +43,115 @@ func main() {
 			log.Println(errors.AddContext(err, "failed to close logger"))
 		}
 	}()
+	warnUnknownKeys(logger, unknown)
+	logger.Infof("Effective configuration: %+v", cfg.Redacted())
 
 	// Initialised the database connection.
-	db, err := database.New(ctx, cfg.DBCredentials, logger)
+	db, err := database.New(ctx, cfg.DBCredentials, logger,
+		database.WithConfigCacheTTL(database.DefaultConfigCacheTTL),
+		database.WithMaxConnIdleTime(cfg.DBMaxConnIdleTime),
+		database.WithMaxDocSize(cfg.DBMaxDocSize),
+		database.WithPoolSize(cfg.DBMinPoolSize, cfg.DBMaxPoolSize),
+		database.WithOpTimeout(cfg.DBOpTimeout),
+		database.WithReportingReadPref(cfg.DBReportingReadPref),
+		database.WithServerName(cfg.ServerName),
+		database.WithSlowOpThreshold(cfg.DBSlowOpThreshold),
+		database.WithUnderpinnedHint(cfg.DBUnderpinnedHint),
+	)
 	if err != nil {
 		log.Fatal(errors.AddContext(err, database.ErrCtxFailedToConnect))
 	}
+	// In debug mode, check that the underpinned query uses an index and
+	// repair the skylinks which list the same server more than once.
+	if cfg.LogLevel >= logrus.DebugLevel {
+		err = db.AuditUnderpinned(ctx, cfg.ServerName, cfg.MinPinners)
+		if err != nil {
+			logger.Warn(errors.AddContext(err, "failed to audit the underpinned query"))
+		}
+		err = db.AuditServers(ctx)
+		if err != nil {
+			logger.Warn(errors.AddContext(err, "failed to audit the skylinks' servers"))
+		}
+	}
 
 	// Start the background scanner.
-	skydClient := skyd.NewClient(cfg.SiaAPIHost, cfg.SiaAPIPort, cfg.SiaAPIPassword, skyd.NewCache(), logger)
+	cache := skyd.NewCacheWithWorkers(cfg.CacheRebuildWorkers)
+	skydClient, err := skyd.NewClient(cfg.SiaAPIHost, cfg.SiaAPIPort, cfg.SiaAPIPassword, cache, logger,
+		skyd.WithScheme(cfg.SiaAPIScheme, cfg.SiaAPICACert),
+		skyd.WithTimeout(cfg.SkydTimeout),
+		skyd.WithRetries(cfg.SkydRetries),
+		skyd.WithPinVerification(cfg.SkydVerifyPins),
+		skyd.WithRateLimits(cfg.SkydReadRate, cfg.SkydWriteRate),
+		skyd.WithUnpinConcurrency(cfg.SkydUnpinConcurrency),
+	)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to create the skyd client"))
+	}
 	scanner := workers.NewScanner(db, logger, cfg.MinPinners, cfg.ServerName, cfg.SleepBetweenScans, skydClient)
 	err = scanner.Start()
 	if err != nil {
 		log.Fatal(errors.AddContext(err, "failed to start Scanner"))
 	}
 
+	// Start the background sweeper.
+	var alert sweeper.AlertFn
+	if cfg.AlertWebhookURL != "" {
+		alert = sweeper.NewWebhookAlert(cfg.AlertWebhookURL, logger)
+	}
+	swpr := sweeper.New(db, skydClient, cfg.ServerName, cfg.SweepUnpin, cfg.SweepMaxRemovalPercent, alert, logger)
+	err = swpr.UpdateSchedule(sweeper.SweepInterval, cfg.SweepTimeOfDay)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to schedule sweeps"))
+	}
+
+	// The reconciler reconciles the database with the skylinks the users pin
+	// according to accounts, when asked to via the API, and periodically
+	// reports the drift between them.
+	accountsClient, err := accounts.NewClient(fmt.Sprintf("http://%s:%s", cfg.AccountsHost, cfg.AccountsPort), cfg.AccountsToken, cfg.AccountsTimeout)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to create the accounts client"))
+	}
+	reconciler := accounts.NewReconciler(accountsClient, db, logger)
+	err = reconciler.ScheduleDriftReports(cfg.DriftReportInterval)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "failed to schedule drift reports"))
+	}
+	// If configured, the API only accepts calls with a JWT issued by accounts
+	// which carries the required claim.
+	var jwtValidator *accounts.JWTValidator
+	if cfg.JWTClaim != "" {
+		jwtValidator, err = accounts.NewJWTValidator(accountsClient, cfg.JWTClaim, cfg.JWTClaimMin)
+		if err != nil {
+			log.Fatal(errors.AddContext(err, "failed to create the JWT validator"))
+		}
+	}
+
 	// Initialise the server.
-	server, err := api.New(cfg.ServerName, db, logger, skydClient)
+	server, err := api.New(cfg.ServerName, db, logger, skydClient,
+		api.WithAccounts(accountsClient, reconciler),
+		api.WithSweeper(swpr),
+		api.WithAccountsHookSecret(cfg.AccountsHookSecret),
+		api.WithJWTValidator(jwtValidator),
+	)
 	if err != nil {
 		log.Fatal(errors.AddContext(err, "failed to build the api"))
 	}
+	server.SetConfig(cfg)
+	server.SetClusterConfigSource(scanner)
+
+	// Reload the settings which can change at runtime on SIGHUP.
+	go threadedReloadOnSIGHUP(cfg, logger, scanner, swpr, server)
 
 	logger.Print("Starting Pinner service")
 	logger.Printf("GitRevision: %v (built %v)", build.GitRevision, build.BuildTime)
 	err = server.ListenAndServe(4000)
-	log.Fatal(errors.Compose(err, scanner.Close()))
+	log.Fatal(errors.Compose(err, scanner.Close(), swpr.Close(), reconciler.Close(), cache.Close()))
+}
+
+// warnUnknownKeys warns about the given keys in the configuration file which
+// pinner doesn't know, most likely typos. See conf.LoadConfig.
+func warnUnknownKeys(logger *logger.Logger, unknown []string) {
+	for _, key := range unknown {
+		logger.Warnf("Unknown key '%s' in the config file '%s'.", key, os.Getenv("PINNER_CONFIG_FILE"))
+	}
 }
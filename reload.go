@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/skynetlabs/pinner/api"
+	"github.com/skynetlabs/pinner/conf"
+	"github.com/skynetlabs/pinner/logger"
+	"github.com/skynetlabs/pinner/sweeper"
+	"github.com/skynetlabs/pinner/workers"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// threadedReloadOnSIGHUP reloads the configuration whenever the process
+// receives a SIGHUP and hands the configuration in effect to the API. See
+// reloadConfig.
+func threadedReloadOnSIGHUP(cfg conf.Config, logger *logger.Logger, scanner *workers.Scanner, swpr *sweeper.Sweeper, server *api.API) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		logger.Info("Received SIGHUP, reloading the configuration.")
+		var err error
+		cfg, err = reloadConfig(cfg, logger, scanner, swpr)
+		if err != nil {
+			logger.Warn(errors.AddContext(err, "failed to reload the configuration"))
+			continue
+		}
+		server.SetConfig(cfg)
+	}
+}
+
+// reloadConfig loads the configuration again and applies the settings which
+// can change at runtime: the log level, the time between scans and the time of
+// day of the scheduled sweeps. It logs what changed and which of the changed
+// settings only take effect after a restart. It returns the configuration in
+// effect, which is the given one if the new one is invalid.
+func reloadConfig(cfg conf.Config, logger *logger.Logger, scanner *workers.Scanner, swpr *sweeper.Sweeper) (conf.Config, error) {
+	newCfg, unknown, err := conf.LoadConfig()
+	if err != nil {
+		return cfg, err
+	}
+	warnUnknownKeys(logger, unknown)
+	err = newCfg.Validate()
+	if err != nil {
+		return cfg, err
+	}
+	if newCfg.SweepTimeOfDay != cfg.SweepTimeOfDay {
+		err = swpr.UpdateSchedule(sweeper.SweepInterval, newCfg.SweepTimeOfDay)
+		if err != nil {
+			return cfg, errors.AddContext(err, "failed to reschedule sweeps")
+		}
+		logger.Infof("Changed the time of day of the sweeps from '%s' to '%s'.", cfg.SweepTimeOfDay, newCfg.SweepTimeOfDay)
+		cfg.SweepTimeOfDay = newCfg.SweepTimeOfDay
+		cfg.Sources = withSource(cfg.Sources, "PINNER_SWEEP_TIME_OF_DAY", newCfg.Source("PINNER_SWEEP_TIME_OF_DAY"))
+	}
+	if newCfg.LogLevel != cfg.LogLevel {
+		logger.SetLevel(newCfg.LogLevel)
+		logger.Infof("Changed the log level from %v to %v.", cfg.LogLevel, newCfg.LogLevel)
+		cfg.LogLevel = newCfg.LogLevel
+		cfg.Sources = withSource(cfg.Sources, "PINNER_LOG_LEVEL", newCfg.Source("PINNER_LOG_LEVEL"))
+	}
+	if newCfg.SleepBetweenScans != cfg.SleepBetweenScans {
+		scanner.SetSleepBetweenScans(newCfg.SleepBetweenScans)
+		logger.Infof("Changed the sleep between scans from %v to %v.", cfg.SleepBetweenScans, newCfg.SleepBetweenScans)
+		cfg.SleepBetweenScans = newCfg.SleepBetweenScans
+		cfg.Sources = withSource(cfg.Sources, "PINNER_SLEEP_BETWEEN_SCANS", newCfg.Source("PINNER_SLEEP_BETWEEN_SCANS"))
+	}
+	// Whatever else changed needs a restart. We only log the names of the
+	// settings because some of them are secrets.
+	if changed := changedSettings(cfg, newCfg); len(changed) > 0 {
+		logger.Warnf("The following settings changed but they only take effect after a restart: %v", changed)
+	}
+	return cfg, nil
+}
+
+// withSource returns a copy of the given sources with the source of the given
+// setting replaced. The API may still be reading the original.
+func withSource(sources map[string]conf.Source, env string, src conf.Source) map[string]conf.Source {
+	updated := make(map[string]conf.Source, len(sources))
+	for k, v := range sources {
+		updated[k] = v
+	}
+	updated[env] = src
+	return updated
+}
+
+// changedSettings returns the names of the settings which differ between the
+// given configurations. The fields tagged `setting:"-"` are not settings.
+func changedSettings(old, new conf.Config) []string {
+	var changed []string
+	o := reflect.ValueOf(old)
+	n := reflect.ValueOf(new)
+	for i := 0; i < o.NumField(); i++ {
+		if o.Type().Field(i).Tag.Get("setting") == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			changed = append(changed, o.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
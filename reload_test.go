@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/skynetlabs/pinner/conf"
+	"github.com/skynetlabs/pinner/logger"
+	"github.com/skynetlabs/pinner/sweeper"
+	"github.com/skynetlabs/pinner/workers"
+)
+
+// TestReloadConfig ensures that reloadConfig applies the settings which can
+// change at runtime, leaves the others alone and keeps the old configuration
+// when the new one is invalid.
+func TestReloadConfig(t *testing.T) {
+	env := map[string]string{
+		"SERVER_DOMAIN":              "pinner.example.com",
+		"SKYNET_DB_USER":             "user",
+		"SKYNET_DB_PASS":             "pass",
+		"SKYNET_DB_HOST":             "localhost",
+		"SKYNET_DB_PORT":             "27017",
+		"SIA_API_PASSWORD":           "password",
+		"PINNER_LOG_LEVEL":           "info",
+		"PINNER_SLEEP_BETWEEN_SCANS": "1h",
+		// Anchor the sweeps, so none of them runs during the test.
+		"PINNER_SWEEP_TIME_OF_DAY": "03:30",
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	// Don't pick up a .env file.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	cfg, _, err := conf.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := logger.New(cfg.LogLevel, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := workers.NewScanner(nil, l, cfg.MinPinners, cfg.ServerName, cfg.SleepBetweenScans, nil)
+	swpr := sweeper.New(nil, nil, cfg.ServerName, false, cfg.SweepMaxRemovalPercent, nil, l)
+	defer func() {
+		if err := swpr.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	err = swpr.UpdateSchedule(sweeper.SweepInterval, cfg.SweepTimeOfDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PINNER_LOG_LEVEL", "debug")
+	t.Setenv("PINNER_SLEEP_BETWEEN_SCANS", "2h")
+	t.Setenv("PINNER_SWEEP_TIME_OF_DAY", "04:30")
+	t.Setenv("SERVER_DOMAIN", "other.example.com")
+	newCfg, err := reloadConfig(cfg, l, scanner, swpr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.GetLevel() != logrus.DebugLevel || newCfg.LogLevel != logrus.DebugLevel {
+		t.Fatalf("Expected log level %v, got %v and %v", logrus.DebugLevel, l.GetLevel(), newCfg.LogLevel)
+	}
+	if sleep := scanner.SleepBetweenScans(); sleep < time.Hour {
+		t.Fatalf("Expected the sleep between scans to be around 2h, got %v", sleep)
+	}
+	if newCfg.SleepBetweenScans != 2*time.Hour || newCfg.SweepTimeOfDay != "04:30" {
+		t.Fatalf("Expected the new sleep and sweep time, got %v and '%s'", newCfg.SleepBetweenScans, newCfg.SweepTimeOfDay)
+	}
+	// The server name requires a restart.
+	if newCfg.ServerName != cfg.ServerName {
+		t.Fatalf("Expected server name '%s', got '%s'", cfg.ServerName, newCfg.ServerName)
+	}
+	changed := changedSettings(newCfg, cfg)
+	if len(changed) != 3 {
+		t.Fatalf("Expected 3 changed settings, got %v", changed)
+	}
+
+	// An invalid configuration changes nothing.
+	t.Setenv("PINNER_LOG_LEVEL", "trace")
+	t.Setenv("PINNER_SLEEP_BETWEEN_SCANS", "not a duration")
+	cfg2, err := reloadConfig(newCfg, l, scanner, swpr)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !reflect.DeepEqual(cfg2, newCfg) || l.GetLevel() != logrus.DebugLevel {
+		t.Fatalf("Expected the configuration to remain unchanged, got %+v", cfg2)
+	}
+}
@@ -0,0 +1,80 @@
+package skyd
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.com/SkynetLabs/skyd/build"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.sia.tech/siad/crypto"
+)
+
+var (
+	// blocklistRefreshInterval is the time for which we use our copy of
+	// skyd's blocklist before we fetch a fresh one.
+	blocklistRefreshInterval = build.Select(build.Var{
+		Standard: 10 * time.Minute,
+		Dev:      time.Minute,
+		Testing:  time.Second,
+	}).(time.Duration)
+)
+
+type (
+	// blocklist is a copy of skyd's portal blocklist. skyd lists the hashes
+	// of the merkle roots of the blocked skylinks.
+	blocklist struct {
+		hashes map[crypto.Hash]struct{}
+		// updated is the time at which we last fetched the blocklist. It's
+		// zero if we never fetched it.
+		updated time.Time
+
+		staticNow func() time.Time
+		staticTTL time.Duration
+		mu        sync.Mutex
+	}
+)
+
+// newBlocklist returns an empty blocklist which goes stale ttl after each
+// update. It uses now to tell the time.
+func newBlocklist(ttl time.Duration, now func() time.Time) *blocklist {
+	return &blocklist{
+		hashes:    make(map[crypto.Hash]struct{}),
+		staticNow: now,
+		staticTTL: ttl,
+	}
+}
+
+// managedContains returns true if the blocklist contains the given skylink.
+func (bl *blocklist) managedContains(sl skymodules.Skylink) bool {
+	hash := crypto.HashObject(sl.MerkleRoot())
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	_, exists := bl.hashes[hash]
+	return exists
+}
+
+// managedFetched returns true if we ever fetched the blocklist.
+func (bl *blocklist) managedFetched() bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return !bl.updated.IsZero()
+}
+
+// managedStale returns true if it's time to fetch a fresh blocklist.
+func (bl *blocklist) managedStale() bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return bl.updated.IsZero() || bl.staticNow().Sub(bl.updated) >= bl.staticTTL
+}
+
+// managedUpdate replaces the blocklist with the given hashes.
+func (bl *blocklist) managedUpdate(hashes []crypto.Hash) {
+	m := make(map[crypto.Hash]struct{}, len(hashes))
+	for _, h := range hashes {
+		m[h] = struct{}{}
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.hashes = m
+	bl.updated = bl.staticNow()
+}
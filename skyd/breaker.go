@@ -0,0 +1,139 @@
+package skyd
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+const (
+	// BreakerClosed means that calls to skyd go through as usual.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen means that skyd is considered unavailable and calls to it
+	// fail fast with ErrSkydUnavailable.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen means that the cool-down period is over and a single
+	// probing call is allowed through. Its outcome decides whether the
+	// breaker closes or opens again.
+	BreakerHalfOpen BreakerState = "half-open"
+
+	// breakerThreshold is the number of consecutive connection-level
+	// failures after which we open the breaker.
+	breakerThreshold = 5
+)
+
+var (
+	// ErrSkydUnavailable is returned without calling skyd while the circuit
+	// breaker is open, i.e. after skyd repeatedly failed to respond.
+	ErrSkydUnavailable = errors.New("skyd is unavailable")
+
+	// breakerCooldown is the time the breaker stays open before it lets a
+	// probing call through.
+	breakerCooldown = build.Select(build.Var{
+		Standard: 30 * time.Second,
+		Dev:      10 * time.Second,
+		Testing:  100 * time.Millisecond,
+	}).(time.Duration)
+)
+
+type (
+	// BreakerState describes the state of the circuit breaker around the
+	// calls to skyd.
+	BreakerState string
+
+	// breaker is a circuit breaker. It opens after a number of consecutive
+	// connection-level failures and stays open for a cool-down period, during
+	// which all calls fail fast. After that it lets a single probing call
+	// through and closes if it succeeds.
+	breaker struct {
+		consecutiveFailures int
+		openedAt            time.Time
+		probing             bool
+		state               BreakerState
+
+		staticCooldown  time.Duration
+		staticNow       func() time.Time
+		staticThreshold int
+		mu              sync.Mutex
+	}
+)
+
+// newBreaker returns a new, closed, breaker. The now function allows tests to
+// control the passage of time.
+func newBreaker(threshold int, cooldown time.Duration, now func() time.Time) *breaker {
+	return &breaker{
+		state:           BreakerClosed,
+		staticCooldown:  cooldown,
+		staticNow:       now,
+		staticThreshold: threshold,
+	}
+}
+
+// managedAllow returns ErrSkydUnavailable if the call should not go through.
+// Once the cool-down period is over, it lets a single probing call through and
+// transitions the breaker to half-open.
+func (b *breaker) managedAllow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		return nil
+	case BreakerOpen:
+		if b.staticNow().Sub(b.openedAt) < b.staticCooldown {
+			return ErrSkydUnavailable
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return nil
+	default:
+		// Only one probing call at a time.
+		if b.probing {
+			return ErrSkydUnavailable
+		}
+		b.probing = true
+		return nil
+	}
+}
+
+// managedReport records the outcome of a call which managedAllow let through.
+// Only connection-level failures count against skyd. Any other outcome,
+// including errors returned by skyd itself, proves that skyd is reachable.
+func (b *breaker) managedReport(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil || !isConnectionFailure(err) {
+		b.consecutiveFailures = 0
+		b.probing = false
+		b.state = BreakerClosed
+		return
+	}
+	b.consecutiveFailures++
+	if b.state == BreakerHalfOpen || b.consecutiveFailures >= b.staticThreshold {
+		b.state = BreakerOpen
+		b.openedAt = b.staticNow()
+		b.probing = false
+	}
+}
+
+// managedCancel records that the caller of a call which managedAllow let
+// through gave up on it. That tells us nothing about skyd, so we leave the
+// state alone and only let another call probe skyd, if this one was probing.
+func (b *breaker) managedCancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// managedState returns the current state of the breaker. An open breaker whose
+// cool-down period is over is reported as half-open because the next call is
+// going to probe skyd.
+func (b *breaker) managedState() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && b.staticNow().Sub(b.openedAt) >= b.staticCooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
@@ -0,0 +1,140 @@
+package skyd
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// testClock is a clock which only moves when told to.
+type testClock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+// Now returns the current time of the clock.
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by the given duration.
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// TestBreaker ensures that the breaker transitions between its states as
+// expected.
+func TestBreaker(t *testing.T) {
+	t.Parallel()
+
+	clock := &testClock{now: time.Now()}
+	threshold := 3
+	cooldown := time.Minute
+	b := newBreaker(threshold, cooldown, clock.Now)
+	// The breaker sees the errors after callOnce has classified them.
+	errConn := classifyErr(errors.New("GET request failed: connection refused"))
+	errAPI := classifyErr(errors.New("GET request error: not found"))
+
+	// fail reports a number of connection-level failures.
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := b.managedAllow(); err != nil {
+				t.Fatal(err)
+			}
+			b.managedReport(errConn)
+		}
+	}
+	expectState := func(state BreakerState) {
+		t.Helper()
+		if s := b.managedState(); s != state {
+			t.Fatalf("Expected state '%s', got '%s'", state, s)
+		}
+	}
+
+	// Failures below the threshold keep the breaker closed. So do errors
+	// returned by skyd, which also reset the failure count.
+	fail(threshold - 1)
+	expectState(BreakerClosed)
+	if err := b.managedAllow(); err != nil {
+		t.Fatal(err)
+	}
+	b.managedReport(errAPI)
+	fail(threshold - 1)
+	expectState(BreakerClosed)
+
+	// Reaching the threshold opens the breaker and calls fail fast.
+	fail(1)
+	expectState(BreakerOpen)
+	if err := b.managedAllow(); !errors.Contains(err, ErrSkydUnavailable) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrSkydUnavailable, err)
+	}
+
+	// After the cool-down a single probe goes through.
+	clock.Advance(cooldown)
+	expectState(BreakerHalfOpen)
+	if err := b.managedAllow(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.managedAllow(); !errors.Contains(err, ErrSkydUnavailable) {
+		t.Fatalf("Expected a second probe to fail with '%v', got '%v'", ErrSkydUnavailable, err)
+	}
+	// A failed probe opens the breaker again.
+	b.managedReport(errConn)
+	expectState(BreakerOpen)
+
+	// A successful probe closes it.
+	clock.Advance(cooldown)
+	if err := b.managedAllow(); err != nil {
+		t.Fatal(err)
+	}
+	b.managedReport(nil)
+	expectState(BreakerClosed)
+	if err := b.managedAllow(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestClientBreaker ensures that the client fails fast once skyd repeatedly
+// fails to respond.
+func TestClientBreaker(t *testing.T) {
+	t.Parallel()
+
+	var numRequests int
+	var mu sync.Mutex
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		numRequests++
+		mu.Unlock()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+	for i := 0; i < breakerThreshold; i++ {
+		_, err := c.Metadata(context.Background(), randomSkylink())
+		if err == nil || errors.Contains(err, ErrSkydUnavailable) {
+			t.Fatalf("Expected a connection error, got '%v'", err)
+		}
+	}
+	if s := c.BreakerState(); s != BreakerOpen {
+		t.Fatalf("Expected state '%s', got '%s'", BreakerOpen, s)
+	}
+	_, err := c.Metadata(context.Background(), randomSkylink())
+	if !errors.Contains(err, ErrSkydUnavailable) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrSkydUnavailable, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if numRequests != breakerThreshold {
+		t.Fatalf("Expected %d requests, got %d", breakerThreshold, numRequests)
+	}
+}
@@ -1,105 +1,356 @@
 package skyd
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/skynetlabs/pinner/database"
 	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/threadgroup"
 	"gitlab.com/SkynetLabs/skyd/build"
-	"gitlab.com/SkynetLabs/skyd/node/api"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
 )
 
+const (
+	// maxSkippedDirsFraction is the maximum fraction of the skynet directories
+	// we can fail to fetch during a cache rebuild before we consider the
+	// rebuild failed.
+	maxSkippedDirsFraction = 0.05
+
+	// DefaultRebuildWorkers is the default number of workers which walk
+	// skyd's filesystem in parallel during a cache rebuild.
+	DefaultRebuildWorkers = 4
+)
+
+var (
+	// ErrTooManySkippedDirs is returned when a cache rebuild fails to fetch
+	// too many of the skynet directories from skyd.
+	ErrTooManySkippedDirs = errors.New("too many skynet directories could not be fetched")
+	// ErrCacheClosed is returned when a cache rebuild is interrupted or
+	// refused because the cache is shutting down.
+	ErrCacheClosed = errors.New("cache closed")
+	// ErrRebuildAborted is returned when a cache rebuild stops before
+	// walking the whole filesystem because its context is done or the cache
+	// is shutting down.
+	ErrRebuildAborted = errors.New("cache rebuild aborted")
+	// ErrRebuildInProgress is returned when we refuse to replace the
+	// contents of the cache because a rebuild is in progress.
+	ErrRebuildInProgress = errors.New("cache rebuild in progress")
+)
+
 type (
 	// PinnedSkylinksCache is a simple cache of the renter's directory
 	// information, so we don't need to fetch that for each skylink we
 	// potentially want to pin/unpin.
 	PinnedSkylinksCache struct {
-		result   *RebuildCacheResult
-		skylinks map[string]struct{}
-		mu       sync.Mutex
+		result *RebuildCacheResult
+		// lastRebuild describes the last finished rebuild.
+		lastRebuild RebuildInfo
+		// skylinks holds all skylinks in the cache, in their canonical form.
+		// See normalizeSkylink.
+		skylinks skylinkMap
+		// invalidSkylinks is the number of invalid skylinks the cache has
+		// dropped since it was created.
+		invalidSkylinks int
+		mu              sync.Mutex
+		// diffMu ensures that only one diff runs at a time, so diffs don't
+		// interfere with each other's marks. Subtree rebuilds also hold it
+		// while they update the cache in place.
+		diffMu sync.Mutex
+
+		// staticNumWorkers is the number of workers which walk the
+		// filesystem during a rebuild.
+		staticNumWorkers int
+		staticTG         *threadgroup.ThreadGroup
+	}
+	// cacheEntry holds the information the cache keeps about a skylink.
+	cacheEntry struct {
+		// seen tells us whether a diff in progress has seen the skylink,
+		// which allows us to diff without copying the cache.
+		seen bool
+		// dirs holds the directories in which the rebuilds found the
+		// skylink. It's nil for skylinks added via Add. Subtree rebuilds
+		// use it to tell whether a skylink is still pinned elsewhere.
+		//
+		// Most skylinks are in a single directory, so all skylinks found
+		// only in the same directory share the same list. That's why the
+		// lists must be replaced rather than modified. Keeping a pointer
+		// instead of a slice also keeps the entries small, which matters
+		// for caches of millions of skylinks.
+		dirs *[]skymodules.SiaPath
+	}
+	// RebuildInfo describes a finished cache rebuild.
+	RebuildInfo struct {
+		// Root is the directory from which the rebuild walked the
+		// filesystem. It's skymodules.SkynetFolder for full rebuilds.
+		Root     skymodules.SiaPath
+		Start    time.Time
+		End      time.Time
+		Duration time.Duration
+		// Err is the error with which the rebuild failed, if any.
+		Err error
 	}
+	// SkylinkIterator calls visit for each skylink in a collection and
+	// returns any error it encounters while iterating.
+	SkylinkIterator func(visit func(skylink string)) error
 	// RebuildCacheResult informs the caller on the status of a cache rebuild.
-	// The error should not be read before the channel is closed.
+	// Done returns a channel which is closed once the rebuild completes. The
+	// methods which report the outcome of the rebuild, e.g. Err, block until
+	// then.
 	RebuildCacheResult struct {
-		// ErrAvail indicates the status of the cache rebuild progress -
-		// if it's not closed then the rebuild is still in progress. We expose
-		// it as a <-chan, so the receiver cannot close it.
+		// ErrAvail is the channel returned by Done.
+		//
+		// Deprecated: use Done. It will be removed in the next release.
 		ErrAvail <-chan struct{}
-		// ExternErr holds the error state of the cache rebuild process. It must
-		// only be read after ErrAvail is closed.
+		// ExternErr is set to Err once the rebuild completes.
+		//
+		// Deprecated: use Err. It will be removed in the next release.
 		ExternErr error
-		// errAvail indicates the status of the cache rebuild progress.
-		// We expose this same channel as <-chan ErrAvail.
+		// ExternSkippedDirs is set to SkippedDirs once the rebuild completes.
+		//
+		// Deprecated: use SkippedDirs. It will be removed in the next
+		// release.
+		ExternSkippedDirs map[skymodules.SiaPath]error
+		// ExternFound and ExternRemoved are set to Found and Removed once the
+		// rebuild completes.
+		//
+		// Deprecated: use Found and Removed. They will be removed in the next
+		// release.
+		ExternFound   []string
+		ExternRemoved []string
+		// ExternInvalidSkylinks is set to InvalidSkylinks once the rebuild
+		// completes.
+		//
+		// Deprecated: use InvalidSkylinks. It will be removed in the next
+		// release.
+		ExternInvalidSkylinks int
+		// Root is the directory from which the rebuild walks the filesystem.
+		// It's skymodules.SkynetFolder for full rebuilds.
+		Root skymodules.SiaPath
+
+		// The fields below hold the outcome of the rebuild. They are only
+		// written before errAvail is closed and only read after that.
+		err             error
+		skippedDirs     map[skymodules.SiaPath]error
+		found           []string
+		removed         []string
+		invalidSkylinks int
+		// errAvail is closed once the rebuild completes.
 		errAvail chan struct{}
+		// dirsWalked and dirsDiscovered track the progress of the rebuild.
+		// The number of discovered directories grows as we walk the
+		// filesystem, so the ratio between the two is only an estimate.
+		dirsWalked     int
+		dirsDiscovered int
+		progressMu     sync.Mutex
 	}
 )
 
-// NewCache returns a new cache instance.
+// NewCache returns a new cache instance which uses DefaultRebuildWorkers
+// workers for its rebuilds.
 func NewCache() *PinnedSkylinksCache {
+	return NewCacheWithWorkers(DefaultRebuildWorkers)
+}
+
+// NewCacheWithWorkers returns a new cache instance which walks skyd's
+// filesystem with the given number of workers during its rebuilds.
+func NewCacheWithWorkers(numWorkers int) *PinnedSkylinksCache {
 	return &PinnedSkylinksCache{
 		result:   nil,
-		skylinks: make(map[string]struct{}),
+		skylinks: newSkylinkMap(),
 		mu:       sync.Mutex{},
+
+		staticNumWorkers: numWorkers,
+		staticTG:         &threadgroup.ThreadGroup{},
 	}
 }
 
-// Add registers the given skylinks in the cache.
+// Close interrupts any rebuild in progress and waits for it to exit. Rebuilds
+// started after closing fail with ErrCacheClosed.
+func (psc *PinnedSkylinksCache) Close() error {
+	return psc.staticTG.Stop()
+}
+
+// Add registers the given skylinks in the cache. It normalizes them first and
+// drops the invalid ones. See normalizeSkylink.
 func (psc *PinnedSkylinksCache) Add(skylinks ...string) {
 	psc.mu.Lock()
 	defer psc.mu.Unlock()
 	for _, s := range skylinks {
-		psc.skylinks[s] = struct{}{}
+		s, ok := normalizeSkylink(s)
+		if !ok {
+			psc.invalidSkylinks++
+			continue
+		}
+		if _, exists := psc.skylinks.get(s); !exists {
+			psc.skylinks.set(s, cacheEntry{})
+		}
 	}
 }
 
 // Contains returns true when the given skylink is in the cache.
 func (psc *PinnedSkylinksCache) Contains(skylink string) bool {
+	skylink, ok := normalizeSkylink(skylink)
+	if !ok {
+		return false
+	}
 	psc.mu.Lock()
 	defer psc.mu.Unlock()
-	_, exists := psc.skylinks[skylink]
+	_, exists := psc.skylinks.get(skylink)
 	return exists
 }
 
+// Count returns the number of skylinks in the cache.
+func (psc *PinnedSkylinksCache) Count() int {
+	psc.mu.Lock()
+	defer psc.mu.Unlock()
+	return psc.skylinks.len()
+}
+
+// Dirs returns the directories in which the rebuilds found the given skylink.
+// It's empty for skylinks which the cache doesn't hold or which were added via
+// Add since the last rebuild.
+func (psc *PinnedSkylinksCache) Dirs(skylink string) []skymodules.SiaPath {
+	skylink, ok := normalizeSkylink(skylink)
+	if !ok {
+		return nil
+	}
+	psc.mu.Lock()
+	defer psc.mu.Unlock()
+	e, _ := psc.skylinks.get(skylink)
+	return append([]skymodules.SiaPath(nil), e.dirList()...)
+}
+
+// InvalidSkylinks returns the number of invalid skylinks the cache has dropped
+// since it was created, be it from its rebuilds, from Add or from the inputs
+// of its diffs.
+func (psc *PinnedSkylinksCache) InvalidSkylinks() int {
+	psc.mu.Lock()
+	defer psc.mu.Unlock()
+	return psc.invalidSkylinks
+}
+
+// LastRebuild returns information about the last finished rebuild. Its Start
+// is zero if no rebuild has finished yet.
+func (psc *PinnedSkylinksCache) LastRebuild() RebuildInfo {
+	psc.mu.Lock()
+	defer psc.mu.Unlock()
+	return psc.lastRebuild
+}
+
 // Diff returns two lists of skylinks - the ones that are in the given list but
-// are not in the cache (missing) and the ones that are in the cache but are not
-// in the given list (removed).
+// are not in the cache (unknown) and the ones that are in the cache but are not
+// in the given list (missing). Both lists are sorted. The given skylinks are
+// normalized and the invalid ones are dropped, so unknown only holds canonical
+// skylinks.
 func (psc *PinnedSkylinksCache) Diff(sls []string) (unknown []string, missing []string) {
+	iterate := func(visit func(string)) error {
+		for _, sl := range sls {
+			visit(sl)
+		}
+		return nil
+	}
+	// The iterator never fails, so we can safely ignore the error.
+	unknown, missing, _ = psc.DiffStream(iterate)
+	return
+}
+
+// DiffStream works like Diff but it consumes the skylinks one by one, which
+// allows the caller to stream them, e.g. from a database cursor, instead of
+// holding them all in memory. Instead of copying the cache, it marks the
+// skylinks it sees directly in it.
+//
+// If the cache gets rebuilt during the diff, the diff is performed against the
+// state of the cache before the rebuild. See PageDiff for consuming the
+// results in pages.
+func (psc *PinnedSkylinksCache) DiffStream(iterate SkylinkIterator) (unknown []string, missing []string, err error) {
+	psc.diffMu.Lock()
+	defer psc.diffMu.Unlock()
 	psc.mu.Lock()
-	defer psc.mu.Unlock()
-	removedMap := make(map[string]struct{}, len(psc.skylinks))
-	for sl := range psc.skylinks {
-		removedMap[sl] = struct{}{}
-	}
-	for _, sl := range sls {
-		// Remove this skylink from the removedMap, because it has not been
-		// removed.
-		delete(removedMap, sl)
-		// If it's not in the cache - add it to the added list.
-		_, exists := psc.skylinks[sl]
+	skylinks := psc.skylinks
+	psc.mu.Unlock()
+
+	err = iterate(func(sl string) {
+		sl, ok := normalizeSkylink(sl)
+		psc.mu.Lock()
+		defer psc.mu.Unlock()
+		if !ok {
+			psc.invalidSkylinks++
+			return
+		}
+		e, exists := skylinks.get(sl)
 		if !exists {
 			unknown = append(unknown, sl)
+			return
 		}
+		e.seen = true
+		skylinks.set(sl, e)
+	})
+
+	// Collect all skylinks we haven't seen and reset the marks.
+	psc.mu.Lock()
+	defer psc.mu.Unlock()
+	missing = skylinks.unmark()
+	if err != nil {
+		return nil, nil, err
 	}
-	// Transform the removed map into a list.
-	for sl := range removedMap {
-		missing = append(missing, sl)
-	}
-	return
+	sort.Strings(unknown)
+	sort.Strings(missing)
+	return unknown, missing, nil
 }
 
 // Rebuild rebuilds the cache of skylinks pinned by the local skyd. The
 // rebuilding happens in a goroutine, allowing the method to return a channel
 // on which the caller can either wait or select. The caller can check whether
-// the rebuild was successful by calling Error().
-func (psc *PinnedSkylinksCache) Rebuild(skydClient Client) RebuildCacheResult {
+// the rebuild was successful by checking Err once the channel is closed.
+//
+// The rebuild tolerates failures to fetch a small fraction of the directories
+// (see maxSkippedDirsFraction). Those directories are reported by SkippedDirs.
+//
+// The rebuild aborts with ErrRebuildAborted as soon as the given context is
+// done, e.g. because the service is shutting down.
+func (psc *PinnedSkylinksCache) Rebuild(ctx context.Context, skydClient Client) *RebuildCacheResult {
+	return psc.RebuildSubtree(ctx, skydClient, skymodules.SkynetFolder)
+}
+
+// RebuildSubtree works like Rebuild but it only walks the subtree under the
+// given root and updates the part of the cache which belongs to it:
+//   - skylinks found under root are added to the cache.
+//   - skylinks which the cache knows were under root but are no longer found
+//     there are removed from the cache, unless they are known to be pinned
+//     elsewhere. The removed skylinks are reported by Removed.
+//
+// The cache learns where skylinks are only from rebuilds, so a subtree rebuild
+// can only recognise removals from directories which a previous rebuild has
+// walked. If the subtree rebuild skips any directories it doesn't remove any
+// skylinks from the cache.
+//
+// If a rebuild is already in progress this method returns its result, even if
+// it rebuilds a different part of the cache. The caller can tell by checking
+// the result's Root. The rebuild in progress keeps using the context of the
+// call which started it.
+func (psc *PinnedSkylinksCache) RebuildSubtree(ctx context.Context, skydClient Client, root skymodules.SiaPath) *RebuildCacheResult {
 	psc.mu.Lock()
 	defer psc.mu.Unlock()
-	if !psc.isRebuildInProgress() {
-		psc.result = NewRebuildCacheResult()
-		// Kick off the actual rebuild in a separate goroutine.
-		go psc.threadedRebuild(skydClient)
+	if psc.isRebuildInProgress() {
+		return psc.result
+	}
+	if err := psc.staticTG.Add(); err != nil {
+		res := NewRebuildCacheResult()
+		res.Root = root
+		res.err = ErrCacheClosed
+		res.close()
+		return res
 	}
-	return *psc.result
+	psc.result = NewRebuildCacheResult()
+	psc.result.Root = root
+	// Kick off the actual rebuild in a separate goroutine.
+	go psc.threadedRebuild(ctx, skydClient, root)
+	return psc.result
 }
 
 // Remove removes the given skylinks in the cache.
@@ -107,8 +358,39 @@ func (psc *PinnedSkylinksCache) Remove(skylinks ...string) {
 	psc.mu.Lock()
 	defer psc.mu.Unlock()
 	for _, s := range skylinks {
-		delete(psc.skylinks, s)
+		if s, ok := normalizeSkylink(s); ok {
+			psc.skylinks.delete(s)
+		}
+	}
+}
+
+// SetAll atomically replaces the contents of the cache with the given
+// skylinks, e.g. with a set imported from elsewhere or persisted by an earlier
+// run. It normalizes the skylinks and fails with database.ErrInvalidSkylink
+// without changing the cache if any of them is invalid. See normalizeSkylink.
+//
+// SetAll fails with ErrRebuildInProgress while a rebuild is in progress,
+// because the rebuild would silently replace the new skylinks once it's done.
+// A rebuild started after SetAll replaces them as usual. Like the skylinks
+// added via Add, the new skylinks are not associated with any directories, so
+// subtree rebuilds don't remove them. Diffs in progress keep running against
+// the previous contents of the cache.
+func (psc *PinnedSkylinksCache) SetAll(skylinks []string) error {
+	sls := newSkylinkMap()
+	for _, s := range skylinks {
+		sl, ok := normalizeSkylink(s)
+		if !ok {
+			return errors.AddContext(database.ErrInvalidSkylink, fmt.Sprintf("invalid skylink '%s'", s))
+		}
+		sls.set(sl, cacheEntry{})
 	}
+	psc.mu.Lock()
+	defer psc.mu.Unlock()
+	if psc.isRebuildInProgress() {
+		return ErrRebuildInProgress
+	}
+	psc.skylinks = sls
+	return nil
 }
 
 // isRebuildInProgress returns true if a cache rebuild is in progress.
@@ -117,70 +399,266 @@ func (psc *PinnedSkylinksCache) isRebuildInProgress() bool {
 	return psc.result != nil
 }
 
+// isClosed returns true if the cache is shutting down.
+func (psc *PinnedSkylinksCache) isClosed() bool {
+	select {
+	case <-psc.staticTG.StopChan():
+		return true
+	default:
+		return false
+	}
+}
+
 // threadedRebuild performs the actual cache rebuild process. It reports any
 // errors by setting the psc.err variable and it always closes the rebuildCh on
 // exit.
-func (psc *PinnedSkylinksCache) threadedRebuild(skydClient Client) {
+func (psc *PinnedSkylinksCache) threadedRebuild(ctx context.Context, skydClient Client, root skymodules.SiaPath) {
+	defer psc.staticTG.Done()
+	start := time.Now()
+	psc.mu.Lock()
+	res := psc.result
+	psc.mu.Unlock()
+
 	var err error
+	var skipped map[skymodules.SiaPath]error
 	// Ensure that we properly wrap up the rebuild process.
 	defer func() {
 		psc.mu.Lock()
 		// Update the result.
-		psc.result.ExternErr = err
+		psc.result.err = err
+		psc.result.skippedDirs = skipped
 		psc.result.close()
 		// Mark the rebuild as done.
 		psc.result = nil
+		end := time.Now()
+		psc.lastRebuild = RebuildInfo{
+			Root:     root,
+			Start:    start,
+			End:      end,
+			Duration: end.Sub(start),
+			Err:      err,
+		}
 		psc.mu.Unlock()
 	}()
 
-	// Walk the entire Skynet folder and scan all files we find for skylinks.
-	dirsToWalk := []skymodules.SiaPath{skymodules.SkynetFolder}
-	sls := make(map[string]struct{})
-	var rd api.RenterDirectory
-	for len(dirsToWalk) > 0 {
-		// Pop the first dir and walk it.
-		dir := dirsToWalk[0]
-		dirsToWalk = dirsToWalk[1:]
-		rd, err = skydClient.RenterDirRootGet(dir)
-		if err != nil {
-			err = errors.AddContext(err, "failed to fetch skynet directories from skyd")
-			return
+	// Stop walking when either the caller or the cache wants us to.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-psc.staticTG.StopChan():
+			cancel()
+		case <-ctx.Done():
 		}
-		for _, f := range rd.Files {
-			for _, sl := range f.Skylinks {
-				sls[sl] = struct{}{}
+	}()
+
+	// Walk the filesystem under root and scan all files we find for skylinks.
+	w, err := walkFilesystem(ctx, skydClient, root, psc.staticNumWorkers, res.setProgress)
+	if errors.Contains(err, ErrRebuildAborted) && psc.isClosed() {
+		err = errors.Compose(err, ErrCacheClosed)
+	}
+	if err != nil {
+		return
+	}
+	skipped = w.skipped
+	res.invalidSkylinks = w.invalid
+	psc.mu.Lock()
+	psc.invalidSkylinks += w.invalid
+	psc.mu.Unlock()
+	sls := w.sls
+	walked := w.walked
+	numDirs := w.numDirs
+	firstErr := w.firstErr
+
+	// Decide whether we can tolerate the directories we skipped.
+	if float64(len(skipped)) > maxSkippedDirsFraction*float64(numDirs) {
+		err = errors.Compose(firstErr, ErrTooManySkippedDirs)
+		err = errors.AddContext(err, fmt.Sprintf("failed to fetch %d out of %d skynet directories from skyd", len(skipped), numDirs))
+		return
+	}
+
+	// Update the cache.
+	if root.Equals(skymodules.SkynetFolder) {
+		psc.mu.Lock()
+		psc.skylinks = sls
+		psc.mu.Unlock()
+		return
+	}
+	inSubtree := func(dir skymodules.SiaPath) bool {
+		_, ok := walked[dir]
+		return ok || isSubtree(dir, root)
+	}
+	res.found, res.removed = psc.mergeSubtree(sls, inSubtree, len(skipped) == 0)
+}
+
+// mergeSubtree updates the cache with the skylinks found by a subtree rebuild.
+// If prune is true, it first forgets all the directories for which inSubtree
+// returns true and removes the skylinks which are left without directories
+// and were not found again. It returns the skylinks found in the subtree and
+// the ones it removed from the cache.
+func (psc *PinnedSkylinksCache) mergeSubtree(sls skylinkMap, inSubtree func(skymodules.SiaPath) bool, prune bool) (found, removed []string) {
+	// Hold the diff lock, so we don't pull the cache from under a diff in
+	// progress.
+	psc.diffMu.Lock()
+	defer psc.diffMu.Unlock()
+	psc.mu.Lock()
+	defer psc.mu.Unlock()
+	if prune {
+		psc.skylinks.each(func(sl string, e cacheEntry) {
+			var dirs []skymodules.SiaPath
+			for _, dir := range e.dirList() {
+				if !inSubtree(dir) {
+					dirs = append(dirs, dir)
+				}
+			}
+			if len(dirs) == len(e.dirList()) {
+				return
+			}
+			_, foundAgain := sls.get(sl)
+			if len(dirs) == 0 && !foundAgain {
+				psc.skylinks.delete(sl)
+				removed = append(removed, sl)
+				return
+			}
+			e.dirs = nil
+			if len(dirs) > 0 {
+				e.dirs = &dirs
+			}
+			psc.skylinks.set(sl, e)
+		})
+	}
+	found = make([]string, 0, sls.len())
+	sls.each(func(sl string, newEntry cacheEntry) {
+		found = append(found, sl)
+		e, _ := psc.skylinks.get(sl)
+		if e.dirs == nil {
+			// Share the new list.
+			e.dirs = newEntry.dirs
+		} else {
+			dirs := e.dirList()
+			n := len(dirs)
+			for _, dir := range newEntry.dirList() {
+				if !containsPath(dirs, dir) {
+					// Copy the list, it might be shared.
+					dirs = append(dirs[:len(dirs):len(dirs)], dir)
+				}
+			}
+			if len(dirs) > n {
+				e.dirs = &dirs
 			}
 		}
-		// Grab all subdirs and queue them for walking.
-		// Skip the first element because that's current directory.
-		for i := 1; i < len(rd.Directories); i++ {
-			dirsToWalk = append(dirsToWalk, rd.Directories[i].SiaPath)
+		psc.skylinks.set(sl, e)
+	})
+	return found, removed
+}
+
+// dirList returns the directories in which the rebuilds found the skylink. The
+// caller must not modify the list.
+func (e cacheEntry) dirList() []skymodules.SiaPath {
+	if e.dirs == nil {
+		return nil
+	}
+	return *e.dirs
+}
+
+// containsPath returns true if the given list contains the given path.
+func containsPath(paths []skymodules.SiaPath, path skymodules.SiaPath) bool {
+	for _, p := range paths {
+		if p.Equals(path) {
+			return true
 		}
 	}
+	return false
+}
 
-	// Update the cache.
-	psc.mu.Lock()
-	psc.skylinks = sls
-	psc.mu.Unlock()
+// isSubtree returns true if dir is root or one of its descendants.
+func isSubtree(dir, root skymodules.SiaPath) bool {
+	return dir.Equals(root) || strings.HasPrefix(dir.Path, root.Path+"/")
 }
 
 // NewRebuildCacheResult returns a new RebuildCacheResult
 func NewRebuildCacheResult() *RebuildCacheResult {
 	ch := make(chan struct{})
 	return &RebuildCacheResult{
-		errAvail:  ch,
-		ErrAvail:  ch,
-		ExternErr: nil,
+		errAvail: ch,
+		ErrAvail: ch,
 	}
 }
 
-// close ensures that we don't try to close the results channel more than once.
+// close marks the rebuild as complete. It ensures that we don't try to close
+// the results channel more than once.
 func (rr *RebuildCacheResult) close() {
 	select {
-	case <-rr.ErrAvail:
+	case <-rr.errAvail:
 		build.Critical("double close on a results channel")
 		return
 	default:
 	}
+	rr.ExternErr = rr.err
+	rr.ExternSkippedDirs = rr.skippedDirs
+	rr.ExternFound = rr.found
+	rr.ExternRemoved = rr.removed
+	rr.ExternInvalidSkylinks = rr.invalidSkylinks
 	close(rr.errAvail)
 }
+
+// Done returns a channel which is closed once the rebuild completes.
+func (rr *RebuildCacheResult) Done() <-chan struct{} {
+	return rr.errAvail
+}
+
+// Err returns the error with which the rebuild failed, if any. It blocks until
+// the rebuild completes.
+func (rr *RebuildCacheResult) Err() error {
+	<-rr.errAvail
+	return rr.err
+}
+
+// SkippedDirs returns the directories we failed to walk during the rebuild,
+// along with the errors we got for them. When this is not empty the rebuild
+// was partial, i.e. the cache might be missing some of the skylinks pinned by
+// skyd. It blocks until the rebuild completes.
+func (rr *RebuildCacheResult) SkippedDirs() map[skymodules.SiaPath]error {
+	<-rr.errAvail
+	return rr.skippedDirs
+}
+
+// Found returns the skylinks a subtree rebuild found under Root. It blocks
+// until the rebuild completes. Full rebuilds don't report any.
+func (rr *RebuildCacheResult) Found() []string {
+	<-rr.errAvail
+	return rr.found
+}
+
+// Removed returns the skylinks a subtree rebuild removed from the cache
+// because they were previously found under Root, are no longer there and were
+// not found anywhere else. It blocks until the rebuild completes. Full
+// rebuilds don't report any.
+func (rr *RebuildCacheResult) Removed() []string {
+	<-rr.errAvail
+	return rr.removed
+}
+
+// InvalidSkylinks returns the number of invalid skylinks the rebuild found in
+// skyd's files and dropped. It blocks until the rebuild completes.
+func (rr *RebuildCacheResult) InvalidSkylinks() int {
+	<-rr.errAvail
+	return rr.invalidSkylinks
+}
+
+// Progress returns the number of directories walked so far and the number of
+// directories discovered so far. It's safe to call while the rebuild is in
+// progress.
+func (rr *RebuildCacheResult) Progress() (walked, discovered int) {
+	rr.progressMu.Lock()
+	defer rr.progressMu.Unlock()
+	return rr.dirsWalked, rr.dirsDiscovered
+}
+
+// setProgress updates the progress of the rebuild.
+func (rr *RebuildCacheResult) setProgress(walked, discovered int) {
+	rr.progressMu.Lock()
+	defer rr.progressMu.Unlock()
+	rr.dirsWalked = walked
+	rr.dirsDiscovered = discovered
+}
@@ -1,7 +1,18 @@
 package skyd
 
 import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
 	"testing"
+	"time"
+
+	"github.com/skynetlabs/pinner/database"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/node/api"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
 )
 
 // TestCacheBase covers the base functionality of PinnedSkylinksCache:
@@ -13,9 +24,9 @@ import (
 func TestCacheBase(t *testing.T) {
 	t.Parallel()
 
-	sl1 := "A_CuSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
-	sl2 := "B_CuSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
-	sl3 := "C_CuSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	sl1 := "AAA_Cb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	sl2 := "AAB_Cb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	sl3 := "AAC_Cb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
 
 	c := NewCache()
 	if c.Contains(sl1) {
@@ -44,22 +55,103 @@ func TestCacheBase(t *testing.T) {
 	}
 }
 
+// TestCacheNormalize ensures that the cache normalizes the skylinks it gets
+// from Add, from the inputs of its diffs and from its rebuilds, and that it
+// drops and counts the invalid ones.
+func TestCacheNormalize(t *testing.T) {
+	t.Parallel()
+
+	var sl skymodules.Skylink
+	if err := sl.LoadString(randomSkylink()); err != nil {
+		t.Fatal(err)
+	}
+	canonical := sl.String()
+	dirty := []string{
+		canonical,
+		" " + canonical + "\n",
+		canonical + "/index.html",
+		sl.Base32EncodedString(),
+	}
+	invalid := []string{"", "not a skylink", "/" + canonical, canonical[1:]}
+	// assertCanonical makes sure the cache only holds the canonical form of
+	// the skylink.
+	assertCanonical := func(c *PinnedSkylinksCache) {
+		t.Helper()
+		if n := c.Count(); n != 1 {
+			t.Fatalf("Expected a single skylink, got %d", n)
+		}
+		_, missing := c.Diff(nil)
+		if len(missing) != 1 || missing[0] != canonical || len(missing[0]) != encodedSkylinkSize {
+			t.Fatalf("Expected only '%s' in the cache, got %v", canonical, missing)
+		}
+	}
+
+	c := NewCache()
+	c.Add(append(dirty, invalid...)...)
+	assertCanonical(c)
+	if n := c.InvalidSkylinks(); n != len(invalid) {
+		t.Fatalf("Expected %d invalid skylinks, got %d", len(invalid), n)
+	}
+	for _, s := range dirty {
+		if !c.Contains(s) {
+			t.Fatalf("Expected the cache to contain '%s'", s)
+		}
+	}
+
+	// The dirty forms match the cached skylink and the invalid ones are
+	// neither unknown nor missing.
+	unknown, missing := c.Diff(append(dirty, invalid...))
+	if len(unknown) != 0 || len(missing) != 0 {
+		t.Fatalf("Expected no unknown and no missing skylinks, got %v and %v", unknown, missing)
+	}
+	if n := c.InvalidSkylinks(); n != 2*len(invalid) {
+		t.Fatalf("Expected %d invalid skylinks, got %d", 2*len(invalid), n)
+	}
+	// Unknown skylinks are reported in their canonical form.
+	c.Remove(dirty[2])
+	unknown, _ = c.Diff(dirty[2:3])
+	if len(unknown) != 1 || unknown[0] != canonical {
+		t.Fatalf("Expected '%s' as the single unknown skylink, got %v", canonical, unknown)
+	}
+
+	// Rebuilds normalize the skylinks reported by skyd.
+	skyd := NewSkydClientMock(WithDirectory(skymodules.SkynetFolder, api.RenterDirectory{
+		Files: []skymodules.FileInfo{
+			{Skylinks: dirty[:2]},
+			{Skylinks: append(dirty[2:], invalid...)},
+		},
+	}))
+	c = NewCache()
+	rr := c.Rebuild(context.Background(), skyd)
+	<-rr.Done()
+	if rr.Err() != nil {
+		t.Fatal(rr.Err())
+	}
+	assertCanonical(c)
+	if rr.InvalidSkylinks() != len(invalid) {
+		t.Fatalf("Expected %d invalid skylinks, got %d", len(invalid), rr.InvalidSkylinks())
+	}
+	if n := c.InvalidSkylinks(); n != len(invalid) {
+		t.Fatalf("Expected %d invalid skylinks, got %d", len(invalid), n)
+	}
+}
+
 // TestCacheRebuild covers the Rebuild functionality of PinnedSkylinksCache.
 func TestCacheRebuild(t *testing.T) {
 	t.Parallel()
 
-	sl := "XX_uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	sl := "AAXX_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
 
 	c := NewCache()
 	// Add a skylink to the cache. Expect this to be gone after the rebuild.
 	c.Add(sl)
 	skyd := NewSkydClientMock()
 	sls := skyd.MockFilesystem()
-	rr := c.Rebuild(skyd)
+	rr := c.Rebuild(context.Background(), skyd)
 	// Wait for the rebuild to finish.
-	<-rr.ErrAvail
-	if rr.ExternErr != nil {
-		t.Fatal(rr.ExternErr)
+	<-rr.Done()
+	if rr.Err() != nil {
+		t.Fatal(rr.Err())
 	}
 	// Ensure that all expected skylinks are in the cache now.
 	for _, s := range sls {
@@ -72,3 +164,619 @@ func TestCacheRebuild(t *testing.T) {
 		t.Fatalf("Expected skylink '%s' to not be present after the rebuild.", sl)
 	}
 }
+
+// TestCacheRebuildInfo ensures that the cache reports its size and the timing
+// of its last rebuild.
+func TestCacheRebuildInfo(t *testing.T) {
+	t.Parallel()
+
+	c := NewCache()
+	if c.Count() != 0 {
+		t.Fatalf("Expected an empty cache, got %d skylinks", c.Count())
+	}
+	if !c.LastRebuild().Start.IsZero() {
+		t.Fatal("Expected no rebuild info before the first rebuild.")
+	}
+	skyd := NewSkydClientMock()
+	sls := skyd.MockFilesystem()
+	before := time.Now()
+	rr := c.Rebuild(context.Background(), skyd)
+	<-rr.Done()
+	if rr.Err() != nil {
+		t.Fatal(rr.Err())
+	}
+	if c.Count() != len(sls) {
+		t.Fatalf("Expected %d skylinks, got %d", len(sls), c.Count())
+	}
+	info := c.LastRebuild()
+	if info.Start.Before(before) || info.End.Before(info.Start) || info.End.After(time.Now()) {
+		t.Fatalf("Unexpected rebuild times: start %v, end %v", info.Start, info.End)
+	}
+	if info.Duration != info.End.Sub(info.Start) {
+		t.Fatalf("Expected duration %v, got %v", info.End.Sub(info.Start), info.Duration)
+	}
+	if info.Err != nil || !info.Root.Equals(skymodules.SkynetFolder) {
+		t.Fatalf("Unexpected rebuild info %+v", info)
+	}
+
+	// Fail a rebuild. Expect the error to be reported and the cache to keep
+	// its skylinks.
+	skyd.SetMapping(skymodules.SkynetFolder, rdReturnType{Err: errors.New("failed to read root")})
+	rr = c.Rebuild(context.Background(), skyd)
+	<-rr.Done()
+	if rr.Err() == nil {
+		t.Fatal("Expected the rebuild to fail.")
+	}
+	next := c.LastRebuild()
+	if next.Err == nil || next.Start.Before(info.End) {
+		t.Fatalf("Unexpected rebuild info %+v", next)
+	}
+	if c.Count() != len(sls) {
+		t.Fatalf("Expected %d skylinks, got %d", len(sls), c.Count())
+	}
+}
+
+// TestCacheRebuildSubtree ensures that a subtree rebuild only updates the part
+// of the cache which belongs to the subtree.
+func TestCacheRebuildSubtree(t *testing.T) {
+	t.Parallel()
+
+	slR0 := "AA___b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slB0 := "AAB__b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slC0 := "AAC1_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slC1 := "AAC2_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slNew := "AANW_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	added := "AAXX_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	dirB := skymodules.DirectoryInfo{SiaPath: skymodules.SiaPath{Path: "dirB"}}
+	dirC := skymodules.DirectoryInfo{SiaPath: skymodules.SiaPath{Path: "dirC"}}
+
+	skyd := NewSkydClientMock()
+	sls := skyd.MockFilesystem()
+	// Also pin the root's skylink in dirC.
+	skyd.SetMapping(dirC.SiaPath, rdReturnType{
+		RD: api.RenterDirectory{
+			Directories: []skymodules.DirectoryInfo{dirC},
+			Files:       []skymodules.FileInfo{{Skylinks: []string{slC0, slC1}}, {Skylinks: []string{slR0}}},
+		},
+	})
+	c := NewCache()
+	rr := c.Rebuild(context.Background(), skyd)
+	<-rr.Done()
+	if rr.Err() != nil {
+		t.Fatal(rr.Err())
+	}
+	// Add a skylink the cache doesn't know the location of.
+	c.Add(added)
+
+	// Unpin C2 and the root's skylink from dirC and pin a new skylink in
+	// dirB.
+	skyd.SetMapping(dirC.SiaPath, rdReturnType{
+		RD: api.RenterDirectory{
+			Directories: []skymodules.DirectoryInfo{dirC},
+			Files:       []skymodules.FileInfo{{Skylinks: []string{slC0}}},
+		},
+	})
+	skyd.SetMapping(dirB.SiaPath, rdReturnType{
+		RD: api.RenterDirectory{
+			Directories: []skymodules.DirectoryInfo{dirB, dirC},
+			Files:       []skymodules.FileInfo{{Skylinks: []string{slB0}}, {Skylinks: []string{slNew}}},
+		},
+	})
+	rr = c.RebuildSubtree(context.Background(), skyd, dirB.SiaPath)
+	<-rr.Done()
+	if rr.Err() != nil {
+		t.Fatal(rr.Err())
+	}
+	if !rr.Root.Equals(dirB.SiaPath) {
+		t.Fatalf("Expected root '%s', got '%s'", dirB.SiaPath, rr.Root)
+	}
+	found := append([]string{}, rr.Found()...)
+	sort.Strings(found)
+	expectedFound := []string{slB0, slC0, slNew}
+	if !reflect.DeepEqual(found, expectedFound) {
+		t.Fatalf("Expected found %v, got %v", expectedFound, found)
+	}
+	// Only C2 is gone. The root's skylink is still pinned in the root.
+	if !reflect.DeepEqual(rr.Removed(), []string{slC1}) {
+		t.Fatalf("Expected removed %v, got %v", []string{slC1}, rr.Removed())
+	}
+	for _, sl := range append(sls, slNew, added) {
+		if sl == slC1 {
+			continue
+		}
+		if !c.Contains(sl) {
+			t.Fatalf("Expected skylink '%s' to be in the cache.", sl)
+		}
+	}
+	if c.Contains(slC1) {
+		t.Fatalf("Expected skylink '%s' to not be in the cache.", slC1)
+	}
+
+	// Fail to read dirC and unpin everything from dirB. Expect the rebuild
+	// not to remove any skylinks. A single failure out of two directories is
+	// too many, so we give dirB enough empty subdirectories.
+	skyd.SetMapping(dirC.SiaPath, rdReturnType{Err: errors.New("failed to read dirC")})
+	dirs := []skymodules.DirectoryInfo{dirB, dirC}
+	for i := 0; i < 30; i++ {
+		sp := skymodules.SiaPath{Path: fmt.Sprintf("dirB%d", i)}
+		dirs = append(dirs, skymodules.DirectoryInfo{SiaPath: sp})
+		skyd.SetMapping(sp, rdReturnType{})
+	}
+	skyd.SetMapping(dirB.SiaPath, rdReturnType{
+		RD: api.RenterDirectory{Directories: dirs},
+	})
+	rr = c.RebuildSubtree(context.Background(), skyd, dirB.SiaPath)
+	<-rr.Done()
+	if rr.Err() != nil {
+		t.Fatal(rr.Err())
+	}
+	if len(rr.SkippedDirs()) != 1 || len(rr.Removed()) != 0 {
+		t.Fatalf("Expected one skipped dir and no removals, got %v and %v", rr.SkippedDirs(), rr.Removed())
+	}
+	if !c.Contains(slB0) || !c.Contains(slNew) {
+		t.Fatal("Expected the skylinks of dirB to remain in the cache.")
+	}
+}
+
+// slowClient is a skyd client which takes a while to return directories.
+type slowClient struct {
+	*ClientMock
+	delay time.Duration
+}
+
+// RenterDirRootGet returns the directory after a delay.
+func (c *slowClient) RenterDirRootGet(ctx context.Context, siaPath skymodules.SiaPath) (api.RenterDirectory, error) {
+	time.Sleep(c.delay)
+	return c.ClientMock.RenterDirRootGet(ctx, siaPath)
+}
+
+// blockingClient is a skyd client whose directory fetches block until their
+// context is done.
+type blockingClient struct {
+	*ClientMock
+	// fetching receives a value each time a fetch starts blocking.
+	fetching chan struct{}
+}
+
+// RenterDirRootGet blocks until the context is done.
+func (c *blockingClient) RenterDirRootGet(ctx context.Context, _ skymodules.SiaPath) (api.RenterDirectory, error) {
+	c.fetching <- struct{}{}
+	<-ctx.Done()
+	return api.RenterDirectory{}, ctx.Err()
+}
+
+// mockDeepFilesystem builds a filesystem of the given depth in which each
+// directory has the given number of subdirectories and a file with a single
+// skylink. It returns all skylinks in the filesystem.
+func mockDeepFilesystem(skyd *ClientMock, depth, fanout int) []string {
+	var sls []string
+	var build func(sp skymodules.SiaPath, level int)
+	build = func(sp skymodules.SiaPath, level int) {
+		sl := randomSkylink()
+		sls = append(sls, sl)
+		dirs := []skymodules.DirectoryInfo{{SiaPath: sp}}
+		if level < depth {
+			for i := 0; i < fanout; i++ {
+				sub := skymodules.SiaPath{Path: fmt.Sprintf("%s/%d", sp.Path, i)}
+				dirs = append(dirs, skymodules.DirectoryInfo{SiaPath: sub})
+				build(sub, level+1)
+			}
+		}
+		skyd.SetMapping(sp, rdReturnType{
+			RD: api.RenterDirectory{
+				Directories: dirs,
+				Files:       []skymodules.FileInfo{{Skylinks: []string{sl}}},
+			},
+		})
+	}
+	build(skymodules.SkynetFolder, 0)
+	return sls
+}
+
+// TestCacheRebuildParallel ensures that a rebuild with many workers finds all
+// skylinks in a deep filesystem and that closing the cache interrupts a
+// rebuild in progress.
+func TestCacheRebuildParallel(t *testing.T) {
+	t.Parallel()
+
+	skyd := NewSkydClientMock()
+	sls := mockDeepFilesystem(skyd, 4, 4)
+
+	for _, numWorkers := range []int{1, 8} {
+		c := NewCacheWithWorkers(numWorkers)
+		rr := c.Rebuild(context.Background(), skyd)
+		<-rr.Done()
+		if rr.Err() != nil {
+			t.Fatal(rr.Err())
+		}
+		walked, discovered := rr.Progress()
+		if walked != discovered || walked != len(sls) {
+			t.Fatalf("Expected %d walked dirs, got %d out of %d", len(sls), walked, discovered)
+		}
+		unknown, missing := c.Diff(sls)
+		if len(unknown) != 0 || len(missing) != 0 {
+			t.Fatalf("Expected the cache to hold exactly the skylinks of the filesystem, got %d unknown and %d missing", len(unknown), len(missing))
+		}
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Walking the slow filesystem takes seconds. Expect closing the cache to
+	// interrupt the rebuild much sooner.
+	c := NewCacheWithWorkers(4)
+	rr := c.Rebuild(context.Background(), &slowClient{ClientMock: skyd, delay: 10 * time.Millisecond})
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected Close to return promptly, it took %v", elapsed)
+	}
+	<-rr.Done()
+	if !errors.Contains(rr.Err(), ErrCacheClosed) || !errors.Contains(rr.Err(), ErrRebuildAborted) {
+		t.Fatalf("Expected errors '%v' and '%v', got '%v'", ErrCacheClosed, ErrRebuildAborted, rr.Err())
+	}
+	// Rebuilds fail after closing.
+	rr = c.Rebuild(context.Background(), skyd)
+	<-rr.Done()
+	if !errors.Contains(rr.Err(), ErrCacheClosed) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrCacheClosed, rr.Err())
+	}
+}
+
+// TestCacheRebuildAbort ensures that a rebuild aborts with ErrRebuildAborted
+// as soon as its context is done and that an aborted rebuild leaves the cache
+// untouched.
+func TestCacheRebuildAbort(t *testing.T) {
+	t.Parallel()
+
+	skyd := NewSkydClientMock()
+	mockDeepFilesystem(skyd, 2, 2)
+	sl := randomSkylink()
+	c := NewCache()
+	c.Add(sl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	skydc := &blockingClient{ClientMock: skyd, fetching: make(chan struct{}, 1)}
+	rr := c.Rebuild(ctx, skydc)
+	// Wait for the walk to start and abort it mid-fetch.
+	<-skydc.fetching
+	cancel()
+	select {
+	case <-rr.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the rebuild to abort promptly.")
+	}
+	if !errors.Contains(rr.Err(), ErrRebuildAborted) || errors.Contains(rr.Err(), ErrCacheClosed) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrRebuildAborted, rr.Err())
+	}
+	if !c.Contains(sl) || c.Count() != 1 {
+		t.Fatal("Expected the aborted rebuild to leave the cache untouched.")
+	}
+	if info := c.LastRebuild(); !errors.Contains(info.Err, ErrRebuildAborted) {
+		t.Fatalf("Expected the last rebuild to have failed with '%v', got '%v'", ErrRebuildAborted, info.Err)
+	}
+
+	// The cache still rebuilds with a fresh context.
+	rr = c.Rebuild(context.Background(), skyd)
+	<-rr.Done()
+	if rr.Err() != nil {
+		t.Fatal(rr.Err())
+	}
+	if c.Contains(sl) {
+		t.Fatal("Expected the rebuild to replace the cache.")
+	}
+
+	// The mock aborts its rebuilds the same way.
+	skyd.SetRebuildCacheDelay(time.Hour)
+	ctx, cancel = context.WithCancel(context.Background())
+	rr = skyd.RebuildCache(ctx)
+	cancel()
+	select {
+	case <-rr.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the mock rebuild to abort promptly.")
+	}
+	if !errors.Contains(rr.Err(), ErrRebuildAborted) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrRebuildAborted, rr.Err())
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCacheRebuildListingOrder ensures that the rebuild doesn't rely on the
+// current directory being the first one in skyd's listing and that it doesn't
+// walk a directory twice, even if skyd lists it as a subdirectory of one of
+// its descendants.
+func TestCacheRebuildListingOrder(t *testing.T) {
+	t.Parallel()
+
+	slR := "AAR__b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slA := "AAA__b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slB := "AAB__b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	root := skymodules.DirectoryInfo{SiaPath: skymodules.SkynetFolder}
+	dirA := skymodules.DirectoryInfo{SiaPath: skymodules.SiaPath{Path: "dirA"}}
+	dirB := skymodules.DirectoryInfo{SiaPath: skymodules.SiaPath{Path: "dirB"}}
+	skyd := NewSkydClientMock(
+		// The current directory is not the first one.
+		WithDirectory(root.SiaPath, api.RenterDirectory{
+			Directories: []skymodules.DirectoryInfo{dirA, root, dirB},
+			Files:       []skymodules.FileInfo{{Skylinks: []string{slR}}},
+		}),
+		// The current directory is missing.
+		WithDirectory(dirA.SiaPath, api.RenterDirectory{
+			Files: []skymodules.FileInfo{{Skylinks: []string{slA}}},
+		}),
+		// The listing points back to the root and to dirA.
+		WithDirectory(dirB.SiaPath, api.RenterDirectory{
+			Directories: []skymodules.DirectoryInfo{dirB, root, dirA},
+			Files:       []skymodules.FileInfo{{Skylinks: []string{slB}}},
+		}),
+	)
+	c := NewCache()
+	rr := c.Rebuild(context.Background(), skyd)
+	select {
+	case <-rr.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Rebuild didn't finish, it's probably walking in circles.")
+	}
+	if rr.Err() != nil {
+		t.Fatal(rr.Err())
+	}
+	for _, sl := range []string{slR, slA, slB} {
+		if !c.Contains(sl) {
+			t.Fatalf("Expected skylink '%s' to be in the cache.", sl)
+		}
+	}
+	if walked, _ := rr.Progress(); walked != 3 {
+		t.Fatalf("Expected 3 walked directories, got %d", walked)
+	}
+}
+
+// TestCacheRebuildSkippedDirs ensures that the cache rebuild tolerates failures
+// to fetch a small fraction of the directories and fails when too many of them
+// can't be fetched.
+func TestCacheRebuildSkippedDirs(t *testing.T) {
+	t.Parallel()
+
+	// Too many failures. The mocked filesystem has five directories, so a
+	// single failure is over the threshold.
+	skyd := NewSkydClientMock()
+	_ = skyd.MockFilesystem()
+	dirC := skymodules.SiaPath{Path: "dirC"}
+	skyd.SetMapping(dirC, rdReturnType{Err: errors.New("failed to read dirC")})
+	rr := NewCache().Rebuild(context.Background(), skyd)
+	<-rr.Done()
+	if !errors.Contains(rr.Err(), ErrTooManySkippedDirs) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrTooManySkippedDirs, rr.Err())
+	}
+
+	// A single failure in a large filesystem. Build a root with enough
+	// subdirectories, one skylink in each.
+	numDirs := 30
+	var dirs []skymodules.DirectoryInfo
+	var sls []string
+	var opts []MockOption
+	for i := 0; i < numDirs; i++ {
+		sp := skymodules.SiaPath{Path: fmt.Sprintf("dir%d", i)}
+		sl := fmt.Sprintf("AA%02d_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg", i)
+		dirs = append(dirs, skymodules.DirectoryInfo{SiaPath: sp})
+		sls = append(sls, sl)
+		opts = append(opts, WithDirectory(sp, api.RenterDirectory{
+			Files: []skymodules.FileInfo{{Skylinks: []string{sl}}},
+		}))
+	}
+	opts = append(opts, WithDirectory(skymodules.SkynetFolder, api.RenterDirectory{
+		Directories: append([]skymodules.DirectoryInfo{{SiaPath: skymodules.SkynetFolder}}, dirs...),
+	}))
+	// Make one of the directories fail.
+	failingDir := dirs[numDirs/2].SiaPath
+	failingSl := sls[numDirs/2]
+	opts = append(opts, WithDirectoryError(failingDir, errors.New("failed to read dir")))
+	skyd = NewSkydClientMock(opts...)
+	c := NewCache()
+	rr = c.Rebuild(context.Background(), skyd)
+	<-rr.Done()
+	if rr.Err() != nil {
+		t.Fatal(rr.Err())
+	}
+	if len(rr.SkippedDirs()) != 1 || rr.SkippedDirs()[failingDir] == nil {
+		t.Fatalf("Expected '%s' to be the only skipped dir, got %v", failingDir, rr.SkippedDirs())
+	}
+	// Ensure that all skylinks from the readable directories are in the cache.
+	for _, sl := range sls {
+		if sl == failingSl {
+			continue
+		}
+		if !c.Contains(sl) {
+			t.Fatalf("Expected skylink '%s' to be in the cache.", sl)
+		}
+	}
+	if c.Contains(failingSl) {
+		t.Fatalf("Expected skylink '%s' to not be in the cache.", failingSl)
+	}
+}
+
+// TestCacheSetAll ensures that SetAll replaces the contents of the cache,
+// that it rejects invalid skylinks and that it doesn't race with rebuilds.
+func TestCacheSetAll(t *testing.T) {
+	t.Parallel()
+
+	var sl skymodules.Skylink
+	if err := sl.LoadString(randomSkylink()); err != nil {
+		t.Fatal(err)
+	}
+	old := randomSkylink()
+	other := randomSkylink()
+	c := NewCache()
+	c.Add(old)
+
+	// Replace the cache. The skylinks are normalized.
+	if err := c.SetAll([]string{sl.Base32EncodedString(), sl.String() + "/index.html", other}); err != nil {
+		t.Fatal(err)
+	}
+	_, missing := c.Diff(nil)
+	expected := []string{sl.String(), other}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(missing, expected) {
+		t.Fatalf("Expected the cache to hold %v, got %v", expected, missing)
+	}
+
+	// An invalid skylink leaves the cache untouched.
+	err := c.SetAll([]string{old, "not a skylink"})
+	if !errors.Contains(err, database.ErrInvalidSkylink) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrInvalidSkylink, err)
+	}
+	if c.Count() != 2 || c.Contains(old) {
+		t.Fatal("Expected the failed SetAll to leave the cache untouched.")
+	}
+
+	// SetAll is refused while a rebuild is in progress.
+	skyd := NewSkydClientMock()
+	mockDeepFilesystem(skyd, 1, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	skydc := &blockingClient{ClientMock: skyd, fetching: make(chan struct{}, 1)}
+	rr := c.Rebuild(ctx, skydc)
+	<-skydc.fetching
+	if err = c.SetAll([]string{old}); !errors.Contains(err, ErrRebuildInProgress) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrRebuildInProgress, err)
+	}
+	cancel()
+	<-rr.Done()
+	if c.Count() != 2 || c.Contains(old) {
+		t.Fatal("Expected the refused SetAll to leave the cache untouched.")
+	}
+	// Once the rebuild is done, SetAll works again and a later rebuild
+	// replaces its skylinks.
+	if err = c.SetAll([]string{old}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Count() != 1 || !c.Contains(old) {
+		t.Fatal("Expected the cache to only hold the new skylink.")
+	}
+	rr = c.Rebuild(context.Background(), skyd)
+	<-rr.Done()
+	if rr.Err() != nil {
+		t.Fatal(rr.Err())
+	}
+	if c.Contains(old) {
+		t.Fatal("Expected the rebuild to replace the skylinks set via SetAll.")
+	}
+}
+
+// TestRebuildCacheResultEarlyCall ensures that reading the outcome of a
+// rebuild before it completes blocks until it does and that the deprecated
+// fields match the methods once it has.
+func TestRebuildCacheResultEarlyCall(t *testing.T) {
+	t.Parallel()
+
+	skyd := NewSkydClientMock()
+	skyd.SetRebuildCacheDelay(100 * time.Millisecond)
+	errRebuild := errors.New("failed to rebuild")
+	skyd.SetRebuildCacheError(errRebuild)
+	rr := skyd.RebuildCacheSubtree(context.Background(), skymodules.SkynetFolder)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rr.Err()
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("Expected Err to block until the rebuild completes, got '%v'", err)
+	case <-rr.Done():
+		t.Fatal("Expected the rebuild to be in progress.")
+	case <-time.After(20 * time.Millisecond):
+	}
+	select {
+	case err := <-errCh:
+		if !errors.Contains(err, errRebuild) {
+			t.Fatalf("Expected error '%v', got '%v'", errRebuild, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Err to return once the rebuild completes.")
+	}
+	// The channel is closed and the deprecated fields mirror the methods.
+	<-rr.Done()
+	if rr.ExternErr != rr.Err() || rr.ErrAvail != rr.Done() {
+		t.Fatalf("Expected the deprecated fields to match the methods, got '%v' and '%v'", rr.ExternErr, rr.Err())
+	}
+	if !reflect.DeepEqual(rr.ExternFound, rr.Found()) || !reflect.DeepEqual(rr.ExternRemoved, rr.Removed()) {
+		t.Fatalf("Expected the deprecated fields to match the methods, got %v and %v", rr.ExternFound, rr.Found())
+	}
+}
+
+// TestCacheDiffStream ensures that DiffStream diffs a stream of skylinks
+// against the cache without copying the cache.
+func TestCacheDiffStream(t *testing.T) {
+	// This test measures the memory allocated by the diff, so we don't want it
+	// to run in parallel with other tests.
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// Fill the cache with a few hundred thousand skylinks and prepare a list
+	// of skylinks which mostly overlaps with it, as it usually happens in
+	// production.
+	numSkylinks := 300000
+	numDiff := 100
+	c := NewCache()
+	sls := make([]string, 0, numSkylinks)
+	for i := 0; i < numSkylinks; i++ {
+		sl := randomSkylink()
+		c.Add(sl)
+		if i >= numDiff {
+			sls = append(sls, sl)
+		}
+	}
+	for i := 0; i < numDiff; i++ {
+		sls = append(sls, randomSkylink())
+	}
+	iterate := func(visit func(string)) error {
+		for _, sl := range sls {
+			visit(sl)
+		}
+		return nil
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	unknown, missing, err := c.DiffStream(iterate)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) != numDiff || len(missing) != numDiff {
+		t.Fatalf("Expected %d unknown and %d missing skylinks, got %d and %d", numDiff, numDiff, len(unknown), len(missing))
+	}
+	// Copying the cache would allocate at least a pointer and a length per
+	// skylink. Expect the diff to allocate an order of magnitude less than
+	// that.
+	allocated := after.TotalAlloc - before.TotalAlloc
+	limit := uint64(numSkylinks * 16 / 10)
+	if allocated > limit {
+		t.Fatalf("Expected the diff to allocate less than %d bytes, allocated %d", limit, allocated)
+	}
+	// Make sure the diff reset its marks, so a second diff yields the same
+	// result.
+	unknown, missing, err = c.DiffStream(iterate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) != numDiff || len(missing) != numDiff {
+		t.Fatalf("Expected %d unknown and %d missing skylinks, got %d and %d", numDiff, numDiff, len(unknown), len(missing))
+	}
+
+	// Make sure that iteration errors are returned.
+	errIter := errors.New("iteration failed")
+	_, _, err = c.DiffStream(func(visit func(string)) error {
+		visit(sls[0])
+		return errIter
+	})
+	if !errors.Contains(err, errIter) {
+		t.Fatalf("Expected error '%v', got '%v'", errIter, err)
+	}
+}
@@ -0,0 +1,132 @@
+package skyd
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+var (
+	// ErrTimeout is returned when a call to skyd doesn't complete within the
+	// configured timeout.
+	ErrTimeout = errors.New("skyd call timed out")
+
+	// retryBaseInterval is the time we wait before the first retry of a
+	// failed call. Each following retry waits twice as long as the previous
+	// one, up to retryMaxInterval.
+	retryBaseInterval = build.Select(build.Var{
+		Standard: time.Second,
+		Dev:      time.Second,
+		Testing:  10 * time.Millisecond,
+	}).(time.Duration)
+	// retryMaxInterval is the longest time we wait between two retries.
+	retryMaxInterval = build.Select(build.Var{
+		Standard: 30 * time.Second,
+		Dev:      30 * time.Second,
+		Testing:  100 * time.Millisecond,
+	}).(time.Duration)
+)
+
+// callOnce calls fn and fails with ErrTimeout if fn doesn't return within the
+// given timeout. A timeout of zero means no timeout. It fails with the
+// context's error if the context is done before fn returns. If the given
+// breaker is open, callOnce fails with ErrSkydUnavailable without calling fn.
+// The errors returned by fn are classified with classifyErr.
+//
+// The skyd client doesn't support contexts or timeouts, so a call which times
+// out or gets cancelled keeps running in its own goroutine until the
+// underlying request returns. Its results are discarded.
+func callOnce[T any](ctx context.Context, b *breaker, timeout time.Duration, fn func() (T, error)) (T, error) {
+	var zero T
+	// Don't let a call which is already cancelled take the breaker's probe.
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	if err := b.managedAllow(); err != nil {
+		return zero, err
+	}
+	val, err := callWithTimeout(ctx, timeout, func() (T, error) {
+		val, err := fn()
+		return val, classifyErr(err)
+	})
+	if err != nil && err == ctx.Err() {
+		// The caller gave up on the call, which tells us nothing about skyd.
+		b.managedCancel()
+		return zero, err
+	}
+	b.managedReport(err)
+	return val, err
+}
+
+// callWithTimeout calls fn and fails with ErrTimeout if fn doesn't return
+// within the given timeout. A timeout of zero means no timeout. It fails with
+// the context's error if the context is done before fn returns.
+func callWithTimeout[T any](ctx context.Context, timeout time.Duration, fn func() (T, error)) (T, error) {
+	if timeout == 0 && ctx.Done() == nil {
+		return fn()
+	}
+	type result struct {
+		val T
+		err error
+	}
+	// The channel is buffered, so an abandoned call can always exit.
+	resCh := make(chan result, 1)
+	go func() {
+		val, err := fn()
+		resCh <- result{val, err}
+	}()
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	var zero T
+	select {
+	case res := <-resCh:
+		return res.val, res.err
+	case <-timeoutCh:
+		return zero, ErrTimeout
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// callWithRetry works like callOnce but it retries failed calls up to the given
+// number of times, backing off exponentially between attempts. It only retries
+// errors which might be transient, i.e. timeouts and failures to reach skyd.
+// It doesn't retry once the breaker opens or the context is done. Each attempt
+// waits for the given rate limiter to let it through. Only use it for
+// idempotent calls.
+func callWithRetry[T any](ctx context.Context, rl *rateLimiter, b *breaker, timeout time.Duration, retries int, fn func() (T, error)) (T, error) {
+	interval := retryBaseInterval
+	for attempt := 0; ; attempt++ {
+		if err := rl.managedWait(ctx); err != nil {
+			var zero T
+			return zero, err
+		}
+		val, err := callOnce(ctx, b, timeout, fn)
+		if err == nil || attempt >= retries || !isConnectionFailure(err) {
+			return val, err
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+		interval *= 2
+		if interval > retryMaxInterval {
+			interval = retryMaxInterval
+		}
+	}
+}
+
+// isConnectionFailure returns true if the given error is a timeout or an error
+// which prevented the request from reaching skyd. Those might be transient,
+// unlike the errors returned by skyd itself, which won't go away by retrying.
+func isConnectionFailure(err error) bool {
+	return errors.Contains(err, ErrTimeout) || errors.Contains(err, ErrSkydUnreachable)
+}
@@ -0,0 +1,90 @@
+package skyd
+
+import (
+	"sort"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// diffTokenUnknown and diffTokenMissing prefix the continuation tokens of
+	// pages which end in the unknown and in the missing skylinks,
+	// respectively.
+	diffTokenUnknown = "u:"
+	diffTokenMissing = "m:"
+)
+
+var (
+	// ErrInvalidDiffToken is returned when a continuation token passed to
+	// PageDiff wasn't returned by it.
+	ErrInvalidDiffToken = errors.New("invalid diff continuation token")
+)
+
+type (
+	// DiffPage holds a page of the results of a diff.
+	DiffPage struct {
+		Unknown []string
+		Missing []string
+		// NextToken is the continuation token of the next page. It's empty
+		// on the last page.
+		NextToken string
+	}
+)
+
+// PageDiff returns the page of the given diff results which follows the given
+// continuation token. An empty token returns the first page. A page holds up
+// to limit skylinks, all unknown skylinks coming before all missing ones. A
+// limit of zero or less returns all remaining skylinks in a single page.
+//
+// The unknown and missing skylinks must be sorted, as DiffPinnedSkylinks
+// returns them. The token holds the last skylink of its page rather than a
+// position, so it stays valid for the results of a later diff. Skylinks which
+// that diff adds before the token are skipped.
+func PageDiff(unknown, missing []string, token string, limit int) (DiffPage, error) {
+	// Find where the page starts.
+	var u, m int
+	switch {
+	case token == "":
+	case strings.HasPrefix(token, diffTokenUnknown):
+		u = searchAfter(unknown, strings.TrimPrefix(token, diffTokenUnknown))
+	case strings.HasPrefix(token, diffTokenMissing):
+		u = len(unknown)
+		m = searchAfter(missing, strings.TrimPrefix(token, diffTokenMissing))
+	default:
+		return DiffPage{}, ErrInvalidDiffToken
+	}
+	if limit <= 0 {
+		limit = len(unknown) + len(missing)
+	}
+
+	var page DiffPage
+	uEnd := minInt(u+limit, len(unknown))
+	page.Unknown = unknown[u:uEnd]
+	mEnd := minInt(m+limit-len(page.Unknown), len(missing))
+	page.Missing = missing[m:mEnd]
+	switch {
+	case mEnd < len(missing) && len(page.Missing) > 0:
+		page.NextToken = diffTokenMissing + page.Missing[len(page.Missing)-1]
+	case mEnd < len(missing) || uEnd < len(unknown):
+		// The page is full of unknown skylinks.
+		page.NextToken = diffTokenUnknown + page.Unknown[len(page.Unknown)-1]
+	}
+	return page, nil
+}
+
+// minInt returns the smaller of the given integers.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// searchAfter returns the index of the first skylink in the given sorted list
+// which comes after the given one.
+func searchAfter(skylinks []string, skylink string) int {
+	return sort.Search(len(skylinks), func(i int) bool {
+		return skylinks[i] > skylink
+	})
+}
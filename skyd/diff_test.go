@@ -0,0 +1,124 @@
+package skyd
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestDiffSorted ensures that both the cache and the mock return sorted diffs.
+func TestDiffSorted(t *testing.T) {
+	t.Parallel()
+
+	pinned := make([]string, 100)
+	for i := range pinned {
+		pinned[i] = randomSkylink()
+	}
+	listed := make([]string, 100)
+	for i := range listed {
+		listed[i] = randomSkylink()
+	}
+	iterate := func(visit func(string)) error {
+		for _, sl := range listed {
+			visit(sl)
+		}
+		return nil
+	}
+	expectedUnknown := append([]string{}, listed...)
+	sort.Strings(expectedUnknown)
+	expectedMissing := append([]string{}, pinned...)
+	sort.Strings(expectedMissing)
+
+	c := NewCache()
+	c.Add(pinned...)
+	mock := NewSkydClientMock(WithPinnedSkylinks(pinned...))
+	diffs := map[string]func(SkylinkIterator) ([]string, []string, error){
+		"cache": c.DiffStream,
+		"mock":  mock.DiffPinnedSkylinks,
+	}
+	for name, diff := range diffs {
+		unknown, missing, err := diff(iterate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(unknown, expectedUnknown) {
+			t.Fatalf("%s: expected sorted unknown skylinks %v, got %v", name, expectedUnknown, unknown)
+		}
+		if !reflect.DeepEqual(missing, expectedMissing) {
+			t.Fatalf("%s: expected sorted missing skylinks %v, got %v", name, expectedMissing, missing)
+		}
+	}
+}
+
+// TestPageDiff ensures that PageDiff pages through the results of a diff and
+// that its tokens stay valid for the results of a later diff.
+func TestPageDiff(t *testing.T) {
+	t.Parallel()
+
+	unknown := []string{"a", "c", "e"}
+	missing := []string{"b", "d"}
+
+	// pageAll collects all pages of the given size.
+	pageAll := func(limit int) (pages []DiffPage) {
+		token := ""
+		for {
+			page, err := PageDiff(unknown, missing, token, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages = append(pages, page)
+			if page.NextToken == "" {
+				return pages
+			}
+			token = page.NextToken
+		}
+	}
+	for _, limit := range []int{0, 1, 2, 3, 5, 10} {
+		pages := pageAll(limit)
+		var gotUnknown, gotMissing []string
+		for _, page := range pages {
+			if limit > 0 && len(page.Unknown)+len(page.Missing) > limit {
+				t.Fatalf("limit %d: expected at most %d skylinks per page, got %v", limit, limit, page)
+			}
+			if len(page.Unknown)+len(page.Missing) == 0 {
+				t.Fatalf("limit %d: got an empty page", limit)
+			}
+			gotUnknown = append(gotUnknown, page.Unknown...)
+			gotMissing = append(gotMissing, page.Missing...)
+		}
+		if !reflect.DeepEqual(gotUnknown, unknown) || !reflect.DeepEqual(gotMissing, missing) {
+			t.Fatalf("limit %d: expected %v and %v, got %v and %v", limit, unknown, missing, gotUnknown, gotMissing)
+		}
+	}
+
+	// A page of two ends in the unknown skylinks, so the next page picks up
+	// after its last skylink even if a later diff adds skylinks before it.
+	page, err := PageDiff(unknown, missing, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err = PageDiff([]string{"0", "a", "b", "c", "e"}, missing, page.NextToken, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Unknown, []string{"e"}) || !reflect.DeepEqual(page.Missing, []string{"b"}) {
+		t.Fatalf("Expected [e] and [b], got %v and %v", page.Unknown, page.Missing)
+	}
+
+	// Empty results fit in a single, empty page.
+	page, err = PageDiff(nil, nil, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Unknown) != 0 || len(page.Missing) != 0 || page.NextToken != "" {
+		t.Fatalf("Expected an empty last page, got %v", page)
+	}
+
+	// Tokens we didn't return are rejected.
+	_, err = PageDiff(unknown, missing, "not a token", 2)
+	if !errors.Contains(err, ErrInvalidDiffToken) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrInvalidDiffToken, err)
+	}
+}
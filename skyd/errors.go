@@ -0,0 +1,115 @@
+package skyd
+
+import (
+	"context"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules/renter"
+	"gitlab.com/SkynetLabs/skyd/skymodules/renter/filesystem"
+)
+
+var (
+	// ErrAuthFailed is returned when skyd rejects our API password.
+	ErrAuthFailed = errors.New("skyd authentication failed")
+	// ErrGeneric is returned when skyd fails a call for a reason we don't
+	// classify more specifically.
+	ErrGeneric = errors.New("skyd call failed")
+	// ErrNotEnoughFunds is returned when skyd can't do what we asked because
+	// the renter lacks the funds for it.
+	ErrNotEnoughFunds = errors.New("skyd has not enough funds")
+	// ErrSkydUnreachable is returned when a request fails to reach skyd,
+	// e.g. because it's not running.
+	ErrSkydUnreachable = errors.New("skyd is unreachable")
+)
+
+var (
+	// authFailedMessages are the messages with which skyd rejects our API
+	// password.
+	authFailedMessages = []string{
+		"API authentication failed",
+	}
+	// notEnoughFundsMessages are the messages with which skyd reports that
+	// the renter lacks funds.
+	notEnoughFundsMessages = []string{
+		"insufficient funds",
+		"insufficient balance",
+		"not enough funds",
+		"not enough money",
+	}
+	// unreachableMessages are the messages of the errors which prevent a
+	// request from reaching skyd. The skyd client adds context such as "GET
+	// request failed" to all of them.
+	unreachableMessages = []string{
+		"request failed",
+		"connection refused",
+		"connection reset",
+		"no such host",
+	}
+)
+
+// classifyErr composes the given error, returned by the skyd client, with the
+// sentinel error which describes it: ErrAuthFailed, ErrNotEnoughFunds,
+// ErrSkydUnreachable, ErrSkylinkBlocked or, if none of those fit, ErrGeneric.
+// It leaves nil, errors which pinner produced itself, such as ErrTimeout, and
+// errors which have already been classified unchanged.
+//
+// The skyd client doesn't return typed errors, so this is the one place where
+// we look at error messages. All other code should check for the sentinels.
+func classifyErr(err error) error {
+	if err == nil || isOwnErr(err) {
+		return err
+	}
+	msg := err.Error()
+	var sentinel error
+	switch {
+	case containsAny(msg, authFailedMessages):
+		sentinel = ErrAuthFailed
+	case containsAny(msg, unreachableMessages):
+		sentinel = ErrSkydUnreachable
+	case strings.Contains(msg, renter.ErrSkylinkBlocked.Error()):
+		sentinel = ErrSkylinkBlocked
+	case containsAny(msg, notEnoughFundsMessages):
+		sentinel = ErrNotEnoughFunds
+	default:
+		sentinel = ErrGeneric
+	}
+	return errors.Compose(err, sentinel)
+}
+
+// containsAny returns true if msg contains any of the given substrings.
+func containsAny(msg string, substrs []string) bool {
+	for _, s := range substrs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwnErr returns true if the given error was produced by pinner rather than
+// returned by skyd, or if it's already classified.
+func isOwnErr(err error) bool {
+	return errors.Contains(err, context.Canceled) ||
+		errors.Contains(err, context.DeadlineExceeded) ||
+		errors.Contains(err, ErrAuthFailed) ||
+		errors.Contains(err, ErrGeneric) ||
+		errors.Contains(err, ErrNotEnoughFunds) ||
+		errors.Contains(err, ErrSkydUnavailable) ||
+		errors.Contains(err, ErrSkydUnreachable) ||
+		errors.Contains(err, ErrSkylinkAlreadyPinned) ||
+		errors.Contains(err, ErrSkylinkBlocked) ||
+		errors.Contains(err, ErrTimeout)
+}
+
+// isExistErr returns true if the given error indicates that skyd already has a
+// file at the requested path.
+func isExistErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), filesystem.ErrExists.Error())
+}
+
+// isNotExistErr returns true if the given error indicates that skyd doesn't
+// have the requested path.
+func isNotExistErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), filesystem.ErrNotExist.Error())
+}
@@ -0,0 +1,70 @@
+package skyd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules/renter"
+)
+
+// TestClassifyErr ensures that classifyErr maps the errors returned by the skyd
+// client to the right sentinel errors and leaves our own errors alone.
+func TestClassifyErr(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		err      error
+		sentinel error
+	}{
+		{"auth", errors.New("POST request error: API authentication failed."), ErrAuthFailed},
+		{"connection refused", errors.New("GET request failed: Get \"http://localhost:9980/renter\": dial tcp 127.0.0.1:9980: connect: connection refused"), ErrSkydUnreachable},
+		{"connection reset", errors.New("read tcp 127.0.0.1:54321->127.0.0.1:9980: read: connection reset by peer"), ErrSkydUnreachable},
+		{"no such host", errors.New("GET request failed: dial tcp: lookup sia: no such host"), ErrSkydUnreachable},
+		{"blocked", errors.AddContext(renter.ErrSkylinkBlocked, "POST request error: failed to pin"), ErrSkylinkBlocked},
+		{"insufficient funds", errors.New("POST request error: contract has insufficient funds to support upload"), ErrNotEnoughFunds},
+		{"not enough money", errors.New("POST request error: not enough money to pay both siafund fee and also host payout"), ErrNotEnoughFunds},
+		{"generic", errors.New("GET request error: unable to get the metadata"), ErrGeneric},
+	}
+	for _, tt := range tests {
+		err := classifyErr(tt.err)
+		if !errors.Contains(err, tt.sentinel) {
+			t.Fatalf("%s: expected '%v', got '%v'", tt.name, tt.sentinel, err)
+		}
+		// The original error is still there.
+		if !strings.Contains(err.Error(), tt.err.Error()) {
+			t.Fatalf("%s: expected '%v' to contain '%v'", tt.name, err, tt.err)
+		}
+		// Classifying twice doesn't add anything.
+		if again := classifyErr(err); again.Error() != err.Error() {
+			t.Fatalf("%s: expected '%v', got '%v'", tt.name, err, again)
+		}
+	}
+
+	// Our own errors stay as they are.
+	if err := classifyErr(nil); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	own := []error{
+		context.Canceled,
+		context.DeadlineExceeded,
+		ErrSkydUnavailable,
+		ErrSkylinkAlreadyPinned,
+		ErrTimeout,
+		errors.AddContext(ErrTimeout, "failed to pin"),
+	}
+	for _, err := range own {
+		if c := classifyErr(err); c.Error() != err.Error() {
+			t.Fatalf("Expected '%v', got '%v'", err, c)
+		}
+	}
+	// Only the classified connection failures are retried.
+	if !isConnectionFailure(classifyErr(errors.New("GET request failed: EOF"))) {
+		t.Fatal("Expected an unreachable skyd to be a connection failure.")
+	}
+	if isConnectionFailure(classifyErr(errors.New("GET request error: not found"))) {
+		t.Fatal("Expected a generic error not to be a connection failure.")
+	}
+}
@@ -0,0 +1,36 @@
+package skyd
+
+import (
+	"time"
+
+	"go.sia.tech/siad/modules"
+)
+
+// Handy constants used to improve readability.
+const (
+	// AssumedUploadSpeedInBytes is the upload speed we assume when we estimate
+	// how long an upload takes. It's 25% of 1Gbps.
+	AssumedUploadSpeedInBytes = 1 << 30 / 4 / 8
+	// BaseSectorRedundancy is the number of copies of a skyfile's base sector
+	// the renter uploads.
+	BaseSectorRedundancy = 10
+	// FanoutRedundancy is the number of copies of a skyfile's fanout the
+	// renter uploads.
+	FanoutRedundancy = 3
+)
+
+// EstimateUploadTime returns a ballpark value of how long it takes the renter
+// to upload the given number of copies of the fanout and of the base sector of
+// a skyfile of the given length.
+//
+// It assumes that all skyfiles are large files (base sector + fanout) and that
+// the metadata fills up the base sector, to err on the safe side.
+func EstimateUploadTime(length, fanoutCopies, baseSectorCopies uint64) time.Duration {
+	chunkSize := 10 * modules.SectorSizeStandard
+	numChunks := length / chunkSize
+	if length%chunkSize > 0 {
+		numChunks++
+	}
+	upload := numChunks*chunkSize*fanoutCopies + baseSectorCopies*modules.SectorSize
+	return time.Duration(upload/AssumedUploadSpeedInBytes) * time.Second
+}
@@ -1,26 +1,48 @@
 package skyd
 
 import (
+	"context"
+	"sort"
 	"sync"
 	"time"
 
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/SkynetLabs/skyd/node/api"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.sia.tech/siad/types"
 )
 
+// Make sure the mock implements the full Client interface.
+var _ Client = (*ClientMock)(nil)
+
 type (
 	// ClientMock is a mock of skyd.Client
 	ClientMock struct {
+		blocked        map[string]struct{}
+		blocklistError error
+		breakerState   BreakerState
 		filesystemMock map[skymodules.SiaPath]rdReturnType
+		fileHealth     map[skymodules.SiaPath]FileHealthResult
+		lastRebuild    RebuildInfo
 		metadata       map[string]skymodules.SkyfileMetadata
 		metadataErrors map[string]error
 		skylinks       map[string]struct{}
+		lazyPins       map[string]bool
+		pins           map[string]int
 		pinError       error
 		unpinError     error
+		rebuildDelay   time.Duration
+		rebuildError   error
+		renterSummary  RenterSummary
+		renterError    error
 
-		mu sync.Mutex
+		// staticFaults holds the latencies and failures the mock injects
+		// into its calls. See FailNextCalls, SetErrorRate and SetLatency.
+		staticFaults *mockFaults
+		mu           sync.Mutex
 	}
+	// MockOption configures a ClientMock when it's created.
+	MockOption func(c *ClientMock)
 	// rdReturnType describes the return values of RenterDirRootGet and allows
 	// us to build a directory structure representation in NodeSkydClientMock.
 	rdReturnType struct {
@@ -29,19 +51,92 @@ type (
 	}
 )
 
-// NewSkydClientMock returns an initialised copy of ClientMock
-func NewSkydClientMock() *ClientMock {
-	return &ClientMock{
+// NewSkydClientMock returns an initialised copy of ClientMock, configured with
+// the given options.
+func NewSkydClientMock(opts ...MockOption) *ClientMock {
+	c := &ClientMock{
+		blocked:        make(map[string]struct{}),
+		breakerState:   BreakerClosed,
 		filesystemMock: make(map[skymodules.SiaPath]rdReturnType),
+		fileHealth:     make(map[skymodules.SiaPath]FileHealthResult),
 		metadata:       make(map[string]skymodules.SkyfileMetadata),
 		metadataErrors: make(map[string]error),
 		skylinks:       make(map[string]struct{}),
+		lazyPins:       make(map[string]bool),
+		pins:           make(map[string]int),
+		rebuildDelay:   100 * time.Millisecond,
+		renterSummary: RenterSummary{
+			AllowanceFunds:  types.SiacoinPrecision.Mul64(1000),
+			RemainingFunds:  types.SiacoinPrecision.Mul64(500),
+			ActiveContracts: 50,
+		},
+		staticFaults: newMockFaults(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithPinnedSkylinks makes the mock start with the given skylinks pinned.
+func WithPinnedSkylinks(skylinks ...string) MockOption {
+	return func(c *ClientMock) {
+		for _, sl := range skylinks {
+			c.skylinks[sl] = struct{}{}
+		}
+	}
+}
+
+// WithBlockedSkylinks makes the mock start with the given skylinks on the
+// blocklist.
+func WithBlockedSkylinks(skylinks ...string) MockOption {
+	return func(c *ClientMock) {
+		for _, sl := range skylinks {
+			c.blocked[sl] = struct{}{}
+		}
+	}
+}
+
+// WithDirectory makes RenterDirRootGet return the given directory for the
+// given path, allowing tests to lay out the mocked filesystem.
+func WithDirectory(siaPath skymodules.SiaPath, rd api.RenterDirectory) MockOption {
+	return func(c *ClientMock) {
+		c.filesystemMock[siaPath] = rdReturnType{RD: rd}
+	}
+}
+
+// WithDirectoryError makes RenterDirRootGet fail with the given error for the
+// given path.
+func WithDirectoryError(siaPath skymodules.SiaPath, err error) MockOption {
+	return func(c *ClientMock) {
+		c.filesystemMock[siaPath] = rdReturnType{Err: err}
 	}
 }
 
+// BreakerState returns the breaker state set via SetBreakerState.
+func (c *ClientMock) BreakerState() BreakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.breakerState
+}
+
+// CacheSize returns the number of skylinks pinned in the mock.
+func (c *ClientMock) CacheSize() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.skylinks)
+}
+
 // DiffPinnedSkylinks is a carbon copy of PinnedSkylinksCache's version of the
-// method.
-func (c *ClientMock) DiffPinnedSkylinks(skylinks []string) (unknown []string, missing []string) {
+// method, except that it collects the iterated skylinks before diffing.
+func (c *ClientMock) DiffPinnedSkylinks(iterate SkylinkIterator) (unknown []string, missing []string, err error) {
+	var skylinks []string
+	err = iterate(func(sl string) {
+		skylinks = append(skylinks, sl)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	removedMap := make(map[string]struct{}, len(c.skylinks))
@@ -62,24 +157,83 @@ func (c *ClientMock) DiffPinnedSkylinks(skylinks []string) (unknown []string, mi
 	for sl := range removedMap {
 		missing = append(missing, sl)
 	}
+	sort.Strings(unknown)
+	sort.Strings(missing)
 	return
 }
 
-// FileHealth returns the health of the given skylink.
-func (c *ClientMock) FileHealth(_ skymodules.SiaPath) (float64, error) {
-	return 0, nil
+// FileHealth returns the health of the given sia file, as set via
+// SetFileHealth. Files are fully healthy by default.
+func (c *ClientMock) FileHealth(ctx context.Context, sp skymodules.SiaPath) (float64, error) {
+	if err := c.staticFaults.managedInject(ctx, "FileHealth"); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fh := c.fileHealth[sp]
+	return fh.Health, fh.Err
 }
 
-// IsPinning checks whether skyd is pinning the given skylink.
-func (c *ClientMock) IsPinning(skylink string) bool {
+// FileHealthBatch returns the health of each of the given sia files, as set
+// via SetFileHealth.
+func (c *ClientMock) FileHealthBatch(ctx context.Context, sps []skymodules.SiaPath) []FileHealthResult {
+	results := make([]FileHealthResult, len(sps))
+	if err := c.staticFaults.managedInject(ctx, "FileHealthBatch"); err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	_, exists := c.skylinks[skylink]
-	return exists
+	for i, sp := range sps {
+		if err := ctx.Err(); err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i] = c.fileHealth[sp]
+	}
+	return results
+}
+
+// GetStats returns no stats because the mock doesn't call skyd.
+func (c *ClientMock) GetStats() map[string]CallStats {
+	return map[string]CallStats{}
+}
+
+// IsBlocked checks whether the given skylink is on the mocked blocklist or
+// returns the error set via SetBlocklistError.
+func (c *ClientMock) IsBlocked(ctx context.Context, skylink string) (bool, error) {
+	if err := c.staticFaults.managedInject(ctx, "IsBlocked"); err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.blocklistError != nil {
+		return false, c.blocklistError
+	}
+	_, exists := c.blocked[skylink]
+	return exists, nil
+}
+
+// IsPinning checks whether skyd is pinning the given skylink. The mock always
+// knows.
+func (c *ClientMock) IsPinning(_ context.Context, skylink string) (bool, error) {
+	return c.Pinning(skylink), nil
+}
+
+// LastCacheRebuild returns information about the last finished mock rebuild.
+func (c *ClientMock) LastCacheRebuild() RebuildInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastRebuild
 }
 
 // Metadata returns the metadata of the skylink or the pre-set error.
-func (c *ClientMock) Metadata(skylink string) (skymodules.SkyfileMetadata, error) {
+func (c *ClientMock) Metadata(ctx context.Context, skylink string) (skymodules.SkyfileMetadata, error) {
+	if err := c.staticFaults.managedInject(ctx, "Metadata"); err != nil {
+		return skymodules.SkyfileMetadata{}, err
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.metadataErrors[skylink] != nil {
@@ -90,34 +244,145 @@ func (c *ClientMock) Metadata(skylink string) (skymodules.SkyfileMetadata, error
 
 // Pin mocks a pin action and responds with a predefined error.
 // If the predefined error is nil, it adds the given skylink to the list of
-// skylinks pinned in the mock.
-func (c *ClientMock) Pin(skylink string) (skymodules.SiaPath, error) {
+// skylinks pinned in the mock and records the mode of the pin. See
+// PinnedLazily.
+func (c *ClientMock) Pin(ctx context.Context, skylink string, lazy bool) (skymodules.SiaPath, error) {
+	if err := c.staticFaults.managedInject(ctx, "Pin"); err != nil {
+		return skymodules.SiaPath{}, err
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.pinError == nil {
 		c.skylinks[skylink] = struct{}{}
+		c.lazyPins[skylink] = lazy
+		c.pins[skylink]++
 	}
 	sp := skymodules.SiaPath{
 		Path: skylink,
 	}
-	return sp, c.pinError
+	// Classify the error the same way the real client does.
+	return sp, classifyErr(c.pinError)
+}
+
+// NumPins returns the number of times the mock successfully pinned the given
+// skylink.
+func (c *ClientMock) NumPins(skylink string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pins[skylink]
 }
 
-// RebuildCache is a noop mock that takes at least 100ms.
-func (c *ClientMock) RebuildCache() RebuildCacheResult {
-	closedCh := make(chan struct{})
-	close(closedCh)
+// Pinning returns true if the mock pins the given skylink. It's IsPinning
+// without the error, for the tests' convenience.
+func (c *ClientMock) Pinning(skylink string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, exists := c.skylinks[skylink]
+	return exists
+}
+
+// PinnedLazily returns true if the mock's last successful pin of the given
+// skylink was a lazy one. It returns false for skylinks the mock doesn't pin
+// and for skylinks it started with.
+func (c *ClientMock) PinnedLazily(skylink string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lazyPins[skylink]
+}
+
+// RebuildCache is a noop mock that takes at least 100ms, unless a different
+// delay is set via SetRebuildCacheDelay. It reports all directories of the
+// mocked filesystem as walked and fails with the error set via
+// SetRebuildCacheError, if any. It aborts with ErrRebuildAborted if the context
+// is done before the delay passes.
+func (c *ClientMock) RebuildCache(ctx context.Context) *RebuildCacheResult {
+	c.mu.Lock()
+	numDirs := len(c.filesystemMock)
+	delay := c.rebuildDelay
+	rebuildErr := c.rebuildError
+	c.mu.Unlock()
+	res := NewRebuildCacheResult()
+	res.Root = skymodules.SkynetFolder
+	start := time.Now()
 	// Do some work. There are tests which rely on this value to be above 50ms.
-	time.Sleep(100 * time.Millisecond)
-	return RebuildCacheResult{
-		errAvail:  closedCh,
-		ErrAvail:  closedCh,
-		ExternErr: nil,
+	afterRebuildDelay(ctx, delay, func(errAbort error) {
+		if errAbort != nil {
+			rebuildErr = errAbort
+		} else {
+			res.setProgress(numDirs, numDirs)
+		}
+		res.err = rebuildErr
+		c.recordRebuild(res.Root, start, rebuildErr)
+		res.close()
+	})
+	return res
+}
+
+// RebuildCacheSubtree works like RebuildCache. The mock doesn't track where
+// its skylinks are pinned, so it reports all of them as found under any root
+// and it never reports any skylinks as removed.
+func (c *ClientMock) RebuildCacheSubtree(ctx context.Context, root skymodules.SiaPath) *RebuildCacheResult {
+	c.mu.Lock()
+	found := make([]string, 0, len(c.skylinks))
+	for sl := range c.skylinks {
+		found = append(found, sl)
+	}
+	delay := c.rebuildDelay
+	rebuildErr := c.rebuildError
+	c.mu.Unlock()
+	res := NewRebuildCacheResult()
+	res.Root = root
+	start := time.Now()
+	afterRebuildDelay(ctx, delay, func(errAbort error) {
+		if errAbort != nil {
+			rebuildErr = errAbort
+		} else {
+			res.setProgress(1, 1)
+			res.found = found
+		}
+		res.err = rebuildErr
+		c.recordRebuild(root, start, rebuildErr)
+		res.close()
+	})
+	return res
+}
+
+// afterRebuildDelay calls fn in a separate goroutine once the given delay
+// passes. If the context is done first, it calls fn right away with
+// ErrRebuildAborted.
+func afterRebuildDelay(ctx context.Context, delay time.Duration, fn func(errAbort error)) {
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			fn(nil)
+		case <-ctx.Done():
+			fn(errors.Compose(ErrRebuildAborted, ctx.Err()))
+		}
+	}()
+}
+
+// recordRebuild records a finished mock rebuild, so LastCacheRebuild can
+// report it.
+func (c *ClientMock) recordRebuild(root skymodules.SiaPath, start time.Time, err error) {
+	end := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastRebuild = RebuildInfo{
+		Root:     root,
+		Start:    start,
+		End:      end,
+		Duration: end.Sub(start),
+		Err:      err,
 	}
 }
 
 // RenterDirRootGet is a functional mock.
-func (c *ClientMock) RenterDirRootGet(siaPath skymodules.SiaPath) (rd api.RenterDirectory, err error) {
+func (c *ClientMock) RenterDirRootGet(ctx context.Context, siaPath skymodules.SiaPath) (rd api.RenterDirectory, err error) {
+	if err := c.staticFaults.managedInject(ctx, "RenterDirRootGet"); err != nil {
+		return api.RenterDirectory{}, err
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	r, exists := c.filesystemMock[siaPath]
@@ -134,21 +399,75 @@ func (c *ClientMock) SetMapping(siaPath skymodules.SiaPath, rdrt rdReturnType) {
 	c.filesystemMock[siaPath] = rdrt
 }
 
+// RenterSummary returns the summary and the error set via SetRenterSummary.
+// By default, it reports a renter with funds and active contracts.
+func (c *ClientMock) RenterSummary(ctx context.Context) (RenterSummary, error) {
+	if err := c.staticFaults.managedInject(ctx, "RenterSummary"); err != nil {
+		return RenterSummary{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.renterSummary, c.renterError
+}
+
 // Resolve is a noop mock.
-func (c *ClientMock) Resolve(skylink string) (string, error) {
+func (c *ClientMock) Resolve(ctx context.Context, skylink string) (string, error) {
+	if err := c.staticFaults.managedInject(ctx, "Resolve"); err != nil {
+		return "", err
+	}
 	return skylink, nil
 }
 
+// ResolveCacheStats returns empty stats because the mock doesn't cache
+// resolutions.
+func (c *ClientMock) ResolveCacheStats() ResolveCacheStats {
+	return ResolveCacheStats{}
+}
+
+// ThrottleStats returns empty stats because the mock doesn't limit its calls.
+func (c *ClientMock) ThrottleStats() ThrottleStats {
+	return ThrottleStats{}
+}
+
 // Unpin mocks an unpin action and responds with a predefined error.
 // If the error is nil, Unpin removes the skylink from the list of pinned
 // skylinks.
-func (c *ClientMock) Unpin(skylink string) error {
+func (c *ClientMock) Unpin(ctx context.Context, skylink string) error {
+	if err := c.staticFaults.managedInject(ctx, "Unpin"); err != nil {
+		return err
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.unpinError == nil {
 		delete(c.skylinks, skylink)
+		delete(c.lazyPins, skylink)
+	}
+	return classifyErr(c.unpinError)
+}
+
+// UnpinMany mocks a bulk unpin by unpinning the given skylinks one by one.
+func (c *ClientMock) UnpinMany(ctx context.Context, skylinks []string) map[string]error {
+	errs := make(map[string]error, len(skylinks))
+	for _, sl := range skylinks {
+		errs[sl] = c.Unpin(ctx, sl)
 	}
-	return c.unpinError
+	return errs
+}
+
+// SetFileHealth sets the health and the error FileHealth and FileHealthBatch
+// return for the given sia file.
+func (c *ClientMock) SetFileHealth(sp skymodules.SiaPath, health float64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fileHealth[sp] = FileHealthResult{Health: health, Err: err}
+}
+
+// SetRenterSummary sets the summary and the error RenterSummary returns.
+func (c *ClientMock) SetRenterSummary(summary RenterSummary, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.renterSummary = summary
+	c.renterError = err
 }
 
 // SetMetadata sets the metadata or error returned when fetching metadata for a
@@ -160,6 +479,45 @@ func (c *ClientMock) SetMetadata(skylink string, meta skymodules.SkyfileMetadata
 	c.metadataErrors[skylink] = err
 }
 
+// SetBlocked adds the given skylink to the mocked blocklist or removes it.
+func (c *ClientMock) SetBlocked(skylink string, blocked bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if blocked {
+		c.blocked[skylink] = struct{}{}
+	} else {
+		delete(c.blocked, skylink)
+	}
+}
+
+// SetBlocklistError sets the error returned by IsBlocked.
+func (c *ClientMock) SetBlocklistError(e error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocklistError = e
+}
+
+// SetBreakerState sets the breaker state reported by the mock.
+func (c *ClientMock) SetBreakerState(state BreakerState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.breakerState = state
+}
+
+// SetRebuildCacheDelay sets the time it takes RebuildCache to complete.
+func (c *ClientMock) SetRebuildCacheDelay(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rebuildDelay = d
+}
+
+// SetRebuildCacheError sets the error returned by RebuildCache.
+func (c *ClientMock) SetRebuildCacheError(e error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rebuildError = e
+}
+
 // SetPinError sets the pin error
 func (c *ClientMock) SetPinError(e error) {
 	c.mu.Lock()
@@ -181,21 +539,21 @@ func (c *ClientMock) SetUnpinError(e error) {
 //
 // SkynetFolder/ (three dirs, one file)
 //    dirA/ (two files, one skylink each)
-//       fileA1 (A1_uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg)
-//       fileA2 (A2_uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg)
+//       fileA1 (AAA1_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg)
+//       fileA2 (AAA2_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg)
 //    dirB/ (one file, one dir)
 //       dirC/ (one file, two skylinks)
-//          fileC (C1_uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg, C2_uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg)
-//       fileB (B__uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg)
+//          fileC (AAC1_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg, AAC2_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg)
+//       fileB (AAB__b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg)
 //    dirD/ (empty)
-//    file (___uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg)
+//    file (AA___b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg)
 func (c *ClientMock) MockFilesystem() []string {
-	slR0 := "___uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
-	slA1 := "A1_uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
-	slA2 := "A2_uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
-	slC0 := "C1_uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
-	slC1 := "C2_uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
-	slB0 := "B__uSb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slR0 := "AA___b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slA1 := "AAA1_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slA2 := "AAA2_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slC0 := "AAC1_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slC1 := "AAC2_b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	slB0 := "AAB__b3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
 
 	dirAsp := skymodules.SiaPath{Path: "dirA"}
 	dirBsp := skymodules.SiaPath{Path: "dirB"}
@@ -0,0 +1,124 @@
+package skyd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+var (
+	// ErrMockFault is the error with which ClientMock fails the calls it
+	// picks for failure, unless the test chooses a different one.
+	ErrMockFault = errors.New("injected mock failure")
+)
+
+type (
+	// MockLatency is a distribution of the latency ClientMock adds to the
+	// calls of a method. Each call takes a uniformly random time between Min
+	// and Max.
+	MockLatency struct {
+		Min time.Duration
+		Max time.Duration
+	}
+
+	// mockFaults holds the latencies and the failures ClientMock injects
+	// into its calls. It has its own mutex, so the mock doesn't hold its
+	// main lock while it delays a call.
+	mockFaults struct {
+		// latencies holds the latency distribution of each method, keyed
+		// by the method's name.
+		latencies map[string]MockLatency
+		// errorRate is the fraction of calls which fail with errorRateErr.
+		errorRate    float64
+		errorRateErr error
+		// failNext is the number of upcoming calls which fail with
+		// failNextErr.
+		failNext    int
+		failNextErr error
+		mu          sync.Mutex
+	}
+)
+
+// newMockFaults returns a mockFaults which injects no faults.
+func newMockFaults() *mockFaults {
+	return &mockFaults{
+		latencies: make(map[string]MockLatency),
+	}
+}
+
+// managedInject delays a call to the given method according to its latency
+// distribution and decides whether the call fails. It returns the context's
+// error if the context is done before or while the call is delayed. Injected
+// errors are classified like the real client's.
+func (f *mockFaults) managedInject(ctx context.Context, method string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	var delay time.Duration
+	if l, exists := f.latencies[method]; exists {
+		delay = l.Min
+		if l.Max > l.Min {
+			delay += time.Duration(fastrand.Uint64n(uint64(l.Max - l.Min + 1)))
+		}
+	}
+	var err error
+	switch {
+	case f.failNext > 0:
+		f.failNext--
+		err = f.failNextErr
+	case fastrand.Intn(1000000) < int(f.errorRate*1000000):
+		err = f.errorRateErr
+	}
+	f.mu.Unlock()
+
+	if delay > 0 {
+		if errSleep := sleepCtx(ctx, delay); errSleep != nil {
+			return errSleep
+		}
+	}
+	return classifyErr(err)
+}
+
+// FailNextCalls makes the next n calls to the mock fail with the given error,
+// or with ErrMockFault if it's nil. It counts the calls to FileHealth,
+// FileHealthBatch, IsBlocked, Metadata, Pin, RenterDirRootGet, RenterSummary,
+// Resolve and Unpin.
+func (c *ClientMock) FailNextCalls(n int, err error) {
+	if err == nil {
+		err = ErrMockFault
+	}
+	c.staticFaults.mu.Lock()
+	defer c.staticFaults.mu.Unlock()
+	c.staticFaults.failNext = n
+	c.staticFaults.failNextErr = err
+}
+
+// SetErrorRate makes the given fraction of the calls to the mock fail with the
+// given error, or with ErrMockFault if it's nil. It applies to the same
+// methods as FailNextCalls. A rate of zero turns the random failures off.
+func (c *ClientMock) SetErrorRate(rate float64, err error) {
+	if err == nil {
+		err = ErrMockFault
+	}
+	c.staticFaults.mu.Lock()
+	defer c.staticFaults.mu.Unlock()
+	c.staticFaults.errorRate = rate
+	c.staticFaults.errorRateErr = err
+}
+
+// SetLatency sets the latency distribution of the calls to the given method,
+// e.g. "Pin". It applies to the same methods as FailNextCalls. A zero latency
+// makes the calls instant again.
+func (c *ClientMock) SetLatency(method string, l MockLatency) {
+	c.staticFaults.mu.Lock()
+	defer c.staticFaults.mu.Unlock()
+	if l == (MockLatency{}) {
+		delete(c.staticFaults.latencies, method)
+		return
+	}
+	c.staticFaults.latencies[method] = l
+}
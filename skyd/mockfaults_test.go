@@ -0,0 +1,95 @@
+package skyd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+)
+
+// TestClientMockFaults ensures that the mock injects the latencies and the
+// failures we ask for and that it's safe to reconfigure them while it's in use.
+func TestClientMockFaults(t *testing.T) {
+	t.Parallel()
+
+	c := NewSkydClientMock()
+	ctx := context.Background()
+
+	// Fail the next few calls, with the default error and with a custom one
+	// which gets classified like the real client's errors.
+	c.FailNextCalls(2, nil)
+	for i := 0; i < 2; i++ {
+		_, err := c.Pin(ctx, randomSkylink(), true)
+		if !errors.Contains(err, ErrMockFault) {
+			t.Fatalf("Expected error '%v', got '%v'", ErrMockFault, err)
+		}
+	}
+	if _, err := c.Pin(ctx, randomSkylink(), true); err != nil {
+		t.Fatal(err)
+	}
+	c.FailNextCalls(1, errors.New("connection refused"))
+	if _, err := c.RenterSummary(ctx); !errors.Contains(err, ErrSkydUnreachable) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrSkydUnreachable, err)
+	}
+
+	// Fail all calls and then none.
+	c.SetErrorRate(1, nil)
+	results := c.FileHealthBatch(ctx, make([]skymodules.SiaPath, 3))
+	for _, res := range results {
+		if !errors.Contains(res.Err, ErrMockFault) {
+			t.Fatalf("Expected error '%v', got '%v'", ErrMockFault, res.Err)
+		}
+	}
+	c.SetErrorRate(0, nil)
+	if _, err := c.Metadata(ctx, randomSkylink()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delay the calls of a single method.
+	latency := MockLatency{Min: 50 * time.Millisecond, Max: 100 * time.Millisecond}
+	c.SetLatency("Unpin", latency)
+	start := time.Now()
+	if err := c.Unpin(ctx, randomSkylink()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < latency.Min {
+		t.Fatalf("Expected the call to take at least %v, it took %v", latency.Min, elapsed)
+	}
+	start = time.Now()
+	if _, err := c.Resolve(ctx, randomSkylink()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= latency.Min {
+		t.Fatalf("Expected an instant call, it took %v", elapsed)
+	}
+	// A delayed call gives up once its context is done.
+	ctxTimeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := c.Unpin(ctxTimeout, randomSkylink()); !errors.Contains(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected error '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+
+	// Reconfigure the mock while it's in use. The race detector catches any
+	// unsynchronized access.
+	c.SetLatency("Pin", MockLatency{Max: time.Millisecond})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				switch i % 3 {
+				case 0:
+					c.SetErrorRate(0.5, nil)
+				case 1:
+					c.FailNextCalls(1, nil)
+				}
+				_, _ = c.Pin(ctx, randomSkylink(), true)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,123 @@
+package skyd
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type (
+	// ThrottleStats describes how much the client-side rate limits slow down
+	// the calls to skyd.
+	ThrottleStats struct {
+		// Read describes the rate limit of the calls which only read from
+		// skyd, e.g. metadata, health and directory listings.
+		Read RateLimitStats `json:"read"`
+		// Write describes the rate limit of the calls which change skyd's
+		// state, i.e. pins and unpins.
+		Write RateLimitStats `json:"write"`
+	}
+	// RateLimitStats describes the usage of a single rate limit.
+	RateLimitStats struct {
+		// Rate is the maximum number of calls per second. Zero means
+		// unlimited.
+		Rate float64 `json:"rate"`
+		// Waiting is the number of calls currently waiting for their turn.
+		Waiting int `json:"waiting"`
+		// CurrentWait is the time a new call would have to wait right now.
+		CurrentWait time.Duration `json:"currentWait"`
+		// TotalWait is the total time calls have spent waiting.
+		TotalWait time.Duration `json:"totalWait"`
+	}
+
+	// rateLimiter is a token bucket which holds a single token and gets a
+	// new one every 1/rate seconds. Calls which find the bucket empty wait for
+	// their turn, so consecutive calls are at least 1/rate seconds apart.
+	rateLimiter struct {
+		// next is the time at which the next call can go through.
+		next      time.Time
+		waiting   int
+		totalWait time.Duration
+
+		staticInterval time.Duration
+		staticNow      func() time.Time
+		staticRate     float64
+		staticSleep    func(ctx context.Context, d time.Duration) error
+		mu             sync.Mutex
+	}
+)
+
+// newRateLimiter returns a rate limiter which lets through up to rate calls
+// per second. A rate of zero or less means no limit. The now and sleep
+// functions allow tests to control the passage of time.
+func newRateLimiter(rate float64, now func() time.Time, sleep func(ctx context.Context, d time.Duration) error) *rateLimiter {
+	rl := &rateLimiter{
+		staticNow:   now,
+		staticSleep: sleep,
+	}
+	if rate > 0 {
+		rl.staticInterval = time.Duration(float64(time.Second) / rate)
+		rl.staticRate = rate
+	}
+	return rl
+}
+
+// managedWait blocks until the caller's turn comes or the context is done, in
+// which case it returns the context's error.
+func (rl *rateLimiter) managedWait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if rl.staticInterval == 0 {
+		return nil
+	}
+	rl.mu.Lock()
+	now := rl.staticNow()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	wait := rl.next.Sub(now)
+	rl.next = rl.next.Add(rl.staticInterval)
+	if wait == 0 {
+		rl.mu.Unlock()
+		return nil
+	}
+	rl.waiting++
+	rl.totalWait += wait
+	rl.mu.Unlock()
+
+	err := rl.staticSleep(ctx, wait)
+
+	rl.mu.Lock()
+	rl.waiting--
+	rl.mu.Unlock()
+	return err
+}
+
+// managedStats returns the usage stats of the rate limiter.
+func (rl *rateLimiter) managedStats() RateLimitStats {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	stats := RateLimitStats{
+		Rate:      rl.staticRate,
+		Waiting:   rl.waiting,
+		TotalWait: rl.totalWait,
+	}
+	if now := rl.staticNow(); rl.next.After(now) {
+		stats.CurrentWait = rl.next.Sub(now)
+	}
+	return stats
+}
+
+// sleepCtx sleeps for the given duration or until the context is done, in
+// which case it returns the context's error.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
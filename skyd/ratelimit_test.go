@@ -0,0 +1,76 @@
+package skyd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestRateLimiter ensures that the rate limiter spaces out the calls it lets
+// through and that it doesn't limit anything without a rate.
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	clock := &testClock{now: time.Now()}
+	// sleep advances the clock instead of sleeping.
+	sleep := func(ctx context.Context, d time.Duration) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		clock.Advance(d)
+		return nil
+	}
+
+	// Without a rate nothing waits.
+	rl := newRateLimiter(0, clock.Now, sleep)
+	start := clock.Now()
+	for i := 0; i < 10; i++ {
+		if err := rl.managedWait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !clock.Now().Equal(start) {
+		t.Fatal("Expected no waiting without a rate.")
+	}
+
+	// Two calls per second are half a second apart.
+	rl = newRateLimiter(2, clock.Now, sleep)
+	interval := 500 * time.Millisecond
+	var last time.Time
+	for i := 0; i < 5; i++ {
+		if err := rl.managedWait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		now := clock.Now()
+		if i > 0 && now.Sub(last) != interval {
+			t.Fatalf("Expected the calls to be %v apart, got %v", interval, now.Sub(last))
+		}
+		last = now
+	}
+	stats := rl.managedStats()
+	if stats.Rate != 2 || stats.TotalWait != 4*interval || stats.CurrentWait != interval || stats.Waiting != 0 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	// An idle limiter doesn't save up calls, it only lets one through right
+	// away.
+	clock.Advance(time.Minute)
+	start = clock.Now()
+	for i := 0; i < 2; i++ {
+		if err := rl.managedWait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := clock.Now().Sub(start); d != interval {
+		t.Fatalf("Expected to wait for %v, waited for %v", interval, d)
+	}
+
+	// Waiting stops once the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := rl.managedWait(ctx); !errors.Contains(err, context.Canceled) {
+		t.Fatalf("Expected error '%v', got '%v'", context.Canceled, err)
+	}
+}
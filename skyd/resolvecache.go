@@ -0,0 +1,128 @@
+package skyd
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// resolveCacheSize is the maximum number of resolved V2 skylinks we keep
+	// in the resolve cache.
+	resolveCacheSize = 10000
+	// resolveCacheTTL is the time for which we keep a resolved V2 skylink in
+	// the resolve cache. V2 skylinks can be updated to point to a different
+	// V1 skylink, so we can only trust a resolution for a limited time.
+	resolveCacheTTL = 10 * time.Minute
+)
+
+type (
+	// ResolveCacheStats describes the usage of the cache of resolved V2
+	// skylinks.
+	ResolveCacheStats struct {
+		// Hits is the number of resolutions served from the cache.
+		Hits uint64 `json:"hits"`
+		// Misses is the number of resolutions we had to ask skyd for.
+		Misses uint64 `json:"misses"`
+		// Size is the number of resolutions currently in the cache.
+		Size int `json:"size"`
+	}
+
+	// resolveCache is a size- and age-bounded cache of V2 skylinks resolved
+	// to V1 skylinks. Entries are only invalidated by expiring.
+	resolveCache struct {
+		entries map[string]resolveEntry
+		// order holds the keys in the order in which they were added. All
+		// entries live for the same time, so this is also the order in
+		// which they expire. It can hold stale keys of entries which have
+		// been replaced since.
+		order  []resolveKey
+		hits   uint64
+		misses uint64
+
+		staticMaxSize int
+		staticNow     func() time.Time
+		staticTTL     time.Duration
+		mu            sync.Mutex
+	}
+	// resolveEntry is a V1 skylink in the resolve cache.
+	resolveEntry struct {
+		skylink string
+		expires time.Time
+	}
+	// resolveKey is a key in the eviction queue of the resolve cache. The
+	// key is stale if its entry has a different expiry time.
+	resolveKey struct {
+		skylink string
+		expires time.Time
+	}
+)
+
+// newResolveCache returns a new resolve cache which holds up to maxSize
+// entries for the given ttl each. It uses now to tell the time.
+func newResolveCache(maxSize int, ttl time.Duration, now func() time.Time) *resolveCache {
+	return &resolveCache{
+		entries:       make(map[string]resolveEntry),
+		staticMaxSize: maxSize,
+		staticNow:     now,
+		staticTTL:     ttl,
+	}
+}
+
+// managedGet returns the V1 skylink to which the given V2 skylink resolves, if
+// the cache holds a resolution which hasn't expired yet.
+func (rc *resolveCache) managedGet(skylink string) (string, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	e, exists := rc.entries[skylink]
+	if !exists || !rc.staticNow().Before(e.expires) {
+		rc.misses++
+		return "", false
+	}
+	rc.hits++
+	return e.skylink, true
+}
+
+// managedSet stores the V1 skylink to which the given V2 skylink resolves. If
+// the cache is full it evicts the oldest entries.
+func (rc *resolveCache) managedSet(skylink, resolved string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	now := rc.staticNow()
+	expires := now.Add(rc.staticTTL)
+	rc.entries[skylink] = resolveEntry{
+		skylink: resolved,
+		expires: expires,
+	}
+	rc.order = append(rc.order, resolveKey{skylink: skylink, expires: expires})
+	rc.evict(now)
+}
+
+// managedStats returns the usage stats of the cache.
+func (rc *resolveCache) managedStats() ResolveCacheStats {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return ResolveCacheStats{
+		Hits:   rc.hits,
+		Misses: rc.misses,
+		Size:   len(rc.entries),
+	}
+}
+
+// evict removes the expired entries and, if the cache still holds more than
+// staticMaxSize entries, the oldest ones. The caller must hold the lock.
+func (rc *resolveCache) evict(now time.Time) {
+	for len(rc.order) > 0 {
+		key := rc.order[0]
+		e, exists := rc.entries[key.skylink]
+		// Drop stale keys. A later key in the queue belongs to the entry.
+		stale := !exists || !e.expires.Equal(key.expires)
+		switch {
+		case stale:
+		case !now.Before(e.expires) || len(rc.entries) > rc.staticMaxSize:
+			delete(rc.entries, key.skylink)
+		default:
+			return
+		}
+		rc.order = rc.order[1:]
+	}
+}
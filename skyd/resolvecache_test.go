@@ -0,0 +1,57 @@
+package skyd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestResolveCache ensures that the resolve cache expires its entries and
+// stays within its size limit.
+func TestResolveCache(t *testing.T) {
+	t.Parallel()
+
+	clock := &testClock{now: time.Now()}
+	ttl := time.Minute
+	maxSize := 3
+	rc := newResolveCache(maxSize, ttl, clock.Now)
+
+	// Expect a miss for an unknown skylink.
+	if _, ok := rc.managedGet("v2"); ok {
+		t.Fatal("Expected a miss.")
+	}
+	rc.managedSet("v2", "v1")
+	if resolved, ok := rc.managedGet("v2"); !ok || resolved != "v1" {
+		t.Fatalf("Expected a hit for 'v1', got '%s' %t", resolved, ok)
+	}
+	// Re-point the skylink. Expect the new resolution.
+	rc.managedSet("v2", "v1b")
+	if resolved, ok := rc.managedGet("v2"); !ok || resolved != "v1b" {
+		t.Fatalf("Expected a hit for 'v1b', got '%s' %t", resolved, ok)
+	}
+	// Expire the entry.
+	clock.Advance(ttl)
+	if _, ok := rc.managedGet("v2"); ok {
+		t.Fatal("Expected the entry to have expired.")
+	}
+	stats := rc.managedStats()
+	if stats.Hits != 2 || stats.Misses != 2 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	// Fill the cache over its limit. Expect the expired entry and the oldest
+	// ones to be evicted.
+	for i := 0; i < maxSize+2; i++ {
+		clock.Advance(time.Second)
+		rc.managedSet(fmt.Sprintf("v2-%d", i), fmt.Sprintf("v1-%d", i))
+	}
+	if size := rc.managedStats().Size; size != maxSize {
+		t.Fatalf("Expected a size of %d, got %d", maxSize, size)
+	}
+	for i := 0; i < maxSize+2; i++ {
+		_, ok := rc.managedGet(fmt.Sprintf("v2-%d", i))
+		if expected := i >= 2; ok != expected {
+			t.Fatalf("Expected entry %d to be cached: %t, got %t", i, expected, ok)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package skyd
 
 import (
+	"context"
 	"fmt"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/skynetlabs/pinner/database"
 	"github.com/skynetlabs/pinner/logger"
@@ -10,157 +12,841 @@ import (
 	"gitlab.com/SkynetLabs/skyd/node/api"
 	skydclient "gitlab.com/SkynetLabs/skyd/node/api/client"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
-	"gitlab.com/SkynetLabs/skyd/skymodules/renter"
+	"go.sia.tech/siad/types"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// fileHealthConcurrency is the maximum number of health requests
+	// FileHealthBatch sends to skyd at the same time.
+	fileHealthConcurrency = 10
+	// defaultUnpinConcurrency is the maximum number of unpin requests
+	// UnpinMany sends to skyd at the same time, unless the client is
+	// configured otherwise.
+	defaultUnpinConcurrency = 10
 )
 
 var (
 	// ErrSkylinkAlreadyPinned is returned when the skylink we're trying to pin
 	// is already pinned.
 	ErrSkylinkAlreadyPinned = errors.New("skylink already pinned")
+	// ErrSkylinkBlocked is returned when skyd refuses to pin a skylink
+	// because it's on the blocklist.
+	ErrSkylinkBlocked = errors.New("skylink is blocked")
 )
 
 type (
-	// Client describes the interface exposed by client.
+	// Client describes the interface exposed by client. All methods which
+	// talk to skyd take a context and return the context's error as soon as
+	// it's done.
 	Client interface {
+		// BreakerState returns the state of the circuit breaker around the
+		// calls to skyd.
+		BreakerState() BreakerState
+		// CacheSize returns the number of skylinks in the cache of skylinks
+		// pinned by the local skyd.
+		CacheSize() int
 		// DiffPinnedSkylinks returns two lists of skylinks - the ones that
-		// belong to the given list but are not pinned by skyd (unknown) and the
-		// ones that are pinned by skyd but are not on the list (missing).
-		DiffPinnedSkylinks(skylinks []string) (unknown []string, missing []string)
+		// are visited by the given iterator but are not pinned by skyd
+		// (unknown) and the ones that are pinned by skyd but are not visited
+		// (missing). Both lists are sorted, which allows the caller to page
+		// through them with PageDiff.
+		DiffPinnedSkylinks(iterate SkylinkIterator) (unknown []string, missing []string, err error)
 		// FileHealth returns the health of the given sia file.
 		// Perfect health is 0.
-		FileHealth(sp skymodules.SiaPath) (float64, error)
+		FileHealth(ctx context.Context, sp skymodules.SiaPath) (float64, error)
+		// FileHealthBatch returns the health of each of the given sia
+		// files. The results are in the same order as the given paths.
+		FileHealthBatch(ctx context.Context, sps []skymodules.SiaPath) []FileHealthResult
+		// GetStats returns the number of calls, the number of errors and
+		// the latency histogram of each method which talks to skyd, keyed
+		// by the method's name.
+		GetStats() map[string]CallStats
+		// IsBlocked returns true if the given skylink is on skyd's
+		// blocklist.
+		IsBlocked(ctx context.Context, skylink string) (bool, error)
+		// IsPinning returns true if the local skyd is pinning the given
+		// skylink.
+		IsPinning(ctx context.Context, skylink string) (bool, error)
+		// LastCacheRebuild returns information about the last finished
+		// cache rebuild.
+		LastCacheRebuild() RebuildInfo
 		// Metadata returns the metadata of the skylink
-		Metadata(skylink string) (skymodules.SkyfileMetadata, error)
-		// Pin instructs the local skyd to pin the given skylink.
-		Pin(skylink string) (skymodules.SiaPath, error)
+		Metadata(ctx context.Context, skylink string) (skymodules.SkyfileMetadata, error)
+		// Pin instructs the local skyd to pin the given skylink. If lazy is
+		// true, skyd only uploads the base sector before returning and
+		// leaves the fanout to the repair loop.
+		Pin(ctx context.Context, skylink string, lazy bool) (skymodules.SiaPath, error)
 		// RebuildCache rebuilds the cache of skylinks pinned by the local skyd.
-		RebuildCache() RebuildCacheResult
+		// The rebuild runs in the background and aborts with
+		// ErrRebuildAborted once the given context is done.
+		RebuildCache(ctx context.Context) *RebuildCacheResult
+		// RebuildCacheSubtree rebuilds the part of the cache which belongs
+		// to the subtree under the given root.
+		RebuildCacheSubtree(ctx context.Context, root skymodules.SiaPath) *RebuildCacheResult
 		// RenterDirRootGet is a direct proxy to the skyd client method with the
 		// same name.
-		RenterDirRootGet(siaPath skymodules.SiaPath) (rd api.RenterDirectory, err error)
+		RenterDirRootGet(ctx context.Context, siaPath skymodules.SiaPath) (rd api.RenterDirectory, err error)
+		// RenterSummary returns a summary of the renter's allowance and
+		// contracts.
+		RenterSummary(ctx context.Context) (RenterSummary, error)
 		// Resolve resolves a V2 skylink to a V1 skylink. Returns an error if
 		// the given skylink is not V2.
-		Resolve(skylink string) (string, error)
+		Resolve(ctx context.Context, skylink string) (string, error)
+		// ResolveCacheStats returns the usage stats of the cache of
+		// resolved V2 skylinks.
+		ResolveCacheStats() ResolveCacheStats
+		// ThrottleStats returns the usage stats of the client-side rate
+		// limits on the calls to skyd.
+		ThrottleStats() ThrottleStats
 		// Unpin instructs the local skyd to unpin the given skylink.
-		Unpin(skylink string) error
+		Unpin(ctx context.Context, skylink string) error
+		// UnpinMany instructs the local skyd to unpin the given skylinks,
+		// several at a time. It returns the error of each skylink, nil for
+		// the ones it unpinned.
+		UnpinMany(ctx context.Context, skylinks []string) map[string]error
+	}
+
+	// FileHealthResult holds the health of a sia file, as returned by
+	// FileHealthBatch, or the error we got while fetching it.
+	FileHealthResult struct {
+		Health float64
+		Err    error
+	}
+
+	// RenterSummary holds the renter financials and contract stats we care
+	// about.
+	RenterSummary struct {
+		// AllowanceFunds is the total amount of funds in the allowance.
+		AllowanceFunds types.Currency
+		// RemainingFunds is the part of the allowance which hasn't been
+		// allocated to contracts in the current period.
+		RemainingFunds types.Currency
+		// ActiveContracts is the number of active contracts.
+		ActiveContracts int
+		// StoredBytes is the amount of data stored in the active contracts,
+		// including redundancy.
+		StoredBytes uint64
+	}
+
+	// Option customizes a client created by NewClient.
+	Option func(*clientOptions)
+
+	// clientOptions holds the settings the options customize. NewClient
+	// builds the client from them.
+	clientOptions struct {
+		scheme           string
+		caCert           string
+		timeout          time.Duration
+		retries          int
+		verifyPins       bool
+		readRate         float64
+		writeRate        float64
+		unpinConcurrency int
 	}
 
 	// client allows us to call the local skyd instance.
 	client struct {
+		staticBlocklist     *blocklist
+		staticBreaker       *breaker
 		staticClient        *skydclient.Client
 		staticLogger        logger.ExtFieldLogger
+		staticResolveCache  *resolveCache
 		staticSkylinksCache *PinnedSkylinksCache
+		staticStats         *callStats
+		// staticReadLimiter and staticWriteLimiter limit the rate of the
+		// calls which read from skyd and the ones which change its state,
+		// respectively.
+		staticReadLimiter  *rateLimiter
+		staticWriteLimiter *rateLimiter
+		// staticPinGroup and staticUnpinGroup deduplicate concurrent pins
+		// and unpins of the same skylink.
+		staticPinGroup   singleflight.Group
+		staticUnpinGroup singleflight.Group
+		// staticBlocklistGroup deduplicates concurrent blocklist fetches.
+		staticBlocklistGroup singleflight.Group
+		// staticTimeout is the maximum duration of a single call to skyd.
+		// Zero means no timeout.
+		staticTimeout time.Duration
+		// staticRetries is the number of times we retry failed idempotent
+		// calls.
+		staticRetries int
+		// staticVerifyPins tells us whether to confirm with skyd that it
+		// still pins the skylinks which the cache says are already pinned.
+		staticVerifyPins bool
+		// staticUnpinConcurrency is the maximum number of unpin calls
+		// UnpinMany sends to skyd at the same time.
+		staticUnpinConcurrency int
 	}
 )
 
-// NewClient creates a new skyd client.
-func NewClient(host, port, password string, cache *PinnedSkylinksCache, logger logger.ExtFieldLogger) Client {
+// NewClient creates a new skyd client which talks to the skyd at host:port over
+// HTTP, unless WithScheme says otherwise. Without options, calls to skyd have no
+// timeout and aren't retried or rate-limited. After several consecutive
+// connection-level failures the client considers skyd unavailable and fails
+// all calls with ErrSkydUnavailable for a cool-down period. NewClient fails if
+// the options don't make sense together, e.g. CA certificates over HTTP.
+func NewClient(host, port, password string, cache *PinnedSkylinksCache, logger logger.ExtFieldLogger, customOpts ...Option) (Client, error) {
+	co := clientOptions{
+		scheme:           SchemeHTTP,
+		unpinConcurrency: defaultUnpinConcurrency,
+	}
+	for _, opt := range customOpts {
+		opt(&co)
+	}
 	opts := skydclient.Options{
 		Address:       fmt.Sprintf("%s:%s", host, port),
 		Password:      password,
 		UserAgent:     "Sia-Agent",
 		CheckRedirect: nil,
 	}
+	switch co.scheme {
+	case SchemeHTTP:
+		if co.caCert != "" {
+			return nil, errors.New("CA certificates can only be used over HTTPS")
+		}
+	case SchemeHTTPS:
+		if err := registerHTTPS(opts.Address, co.caCert); err != nil {
+			return nil, errors.AddContext(err, "failed to set up HTTPS to skyd")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme '%s'", co.scheme)
+	}
+	if co.unpinConcurrency < 1 {
+		co.unpinConcurrency = defaultUnpinConcurrency
+	}
 	return &client{
+		staticBlocklist:     newBlocklist(blocklistRefreshInterval, time.Now),
+		staticBreaker:       newBreaker(breakerThreshold, breakerCooldown, time.Now),
 		staticClient:        skydclient.New(opts),
 		staticLogger:        logger,
+		staticResolveCache:  newResolveCache(resolveCacheSize, resolveCacheTTL, time.Now),
 		staticSkylinksCache: cache,
+		staticStats:         newCallStats(),
+		staticReadLimiter:   newRateLimiter(co.readRate, time.Now, sleepCtx),
+		staticWriteLimiter:  newRateLimiter(co.writeRate, time.Now, sleepCtx),
+		staticTimeout:       co.timeout,
+		staticRetries:       co.retries,
+		staticVerifyPins:    co.verifyPins,
+
+		staticUnpinConcurrency: co.unpinConcurrency,
+	}, nil
+}
+
+// WithPinVerification makes Pin confirm with skyd that it still pins the
+// skylinks which the cache says are already pinned, e.g. because an operator
+// might have unpinned them since the last cache rebuild. That costs an extra
+// call to skyd for each such skylink.
+func WithPinVerification(verify bool) Option {
+	return func(co *clientOptions) {
+		co.verifyPins = verify
+	}
+}
+
+// WithRateLimits makes the client send at most readRate calls per second which
+// read from skyd and at most writeRate calls per second which pin or unpin
+// skylinks. A rate of zero means no limit.
+func WithRateLimits(readRate, writeRate float64) Option {
+	return func(co *clientOptions) {
+		co.readRate = readRate
+		co.writeRate = writeRate
+	}
+}
+
+// WithRetries makes the client retry idempotent calls which fail with a timeout
+// or because skyd couldn't be reached up to the given number of times.
+func WithRetries(retries int) Option {
+	return func(co *clientOptions) {
+		co.retries = retries
 	}
 }
 
-// DiffPinnedSkylinks returns two lists of skylinks - the ones that belong to
-// the given list but are not pinned by skyd (unknown) and the ones that are
-// pinned by skyd but are not on the list (missing).
-func (c *client) DiffPinnedSkylinks(skylinks []string) (unknown []string, missing []string) {
-	return c.staticSkylinksCache.Diff(skylinks)
+// WithScheme sets the scheme over which the client talks to skyd, either
+// SchemeHTTP or SchemeHTTPS. Over HTTPS, the client trusts the CA certificates
+// in the PEM file at caCert or the system's CAs if caCert is empty.
+func WithScheme(scheme, caCert string) Option {
+	return func(co *clientOptions) {
+		co.scheme = scheme
+		co.caCert = caCert
+	}
+}
+
+// WithTimeout makes each call to skyd fail with ErrTimeout if it takes longer
+// than the given timeout. Zero disables timeouts.
+func WithTimeout(timeout time.Duration) Option {
+	return func(co *clientOptions) {
+		co.timeout = timeout
+	}
+}
+
+// WithUnpinConcurrency makes UnpinMany send up to the given number of unpin
+// calls at the same time, still within the write rate. It defaults to
+// defaultUnpinConcurrency.
+func WithUnpinConcurrency(n int) Option {
+	return func(co *clientOptions) {
+		co.unpinConcurrency = n
+	}
+}
+
+// BreakerState returns the state of the circuit breaker around the calls to
+// skyd.
+func (c *client) BreakerState() BreakerState {
+	return c.staticBreaker.managedState()
+}
+
+// CacheSize returns the number of skylinks in the cache of skylinks pinned by
+// the local skyd.
+func (c *client) CacheSize() int {
+	return c.staticSkylinksCache.Count()
+}
+
+// DiffPinnedSkylinks returns two lists of skylinks - the ones that are visited
+// by the given iterator but are not pinned by skyd (unknown) and the ones that
+// are pinned by skyd but are not visited (missing). Both lists are sorted.
+func (c *client) DiffPinnedSkylinks(iterate SkylinkIterator) (unknown []string, missing []string, err error) {
+	return c.staticSkylinksCache.DiffStream(iterate)
 }
 
 // FileHealth returns the health of the given sia file.
 // Perfect health is 0.
-func (c *client) FileHealth(sp skymodules.SiaPath) (float64, error) {
+func (c *client) FileHealth(ctx context.Context, sp skymodules.SiaPath) (_ float64, err error) {
 	c.staticLogger.Trace("Entering FileHealth")
 	defer c.staticLogger.Trace("Exiting  FileHealth")
-	rf, err := c.staticClient.RenterFileRootGet(sp)
+	defer c.staticStats.managedRecord("FileHealth", time.Now(), &err)
+	rf, err := callWithRetry(ctx, c.staticReadLimiter, c.staticBreaker, c.staticTimeout, c.staticRetries, func() (api.RenterFile, error) {
+		return c.staticClient.RenterFileRootGet(sp)
+	})
 	if err != nil {
 		return 0, err
 	}
 	return rf.File.Health, nil
 }
 
+// FileHealthBatch returns the health of each of the given sia files. The
+// results are in the same order as the given paths. It fetches the healths
+// concurrently, sending at most fileHealthConcurrency requests at a time. Once
+// the context is done, the files we haven't fetched yet get the context's error.
+func (c *client) FileHealthBatch(ctx context.Context, sps []skymodules.SiaPath) []FileHealthResult {
+	c.staticLogger.Tracef("Entering FileHealthBatch. Files: %d", len(sps))
+	defer c.staticLogger.Tracef("Exiting  FileHealthBatch. Files: %d", len(sps))
+	var err error
+	defer c.staticStats.managedRecord("FileHealthBatch", time.Now(), &err)
+	results := make([]FileHealthResult, len(sps))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, fileHealthConcurrency)
+	for i, sp := range sps {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, sp skymodules.SiaPath) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			// Each goroutine writes to its own element, so we don't need
+			// a lock.
+			results[i].Health, results[i].Err = c.FileHealth(ctx, sp)
+		}(i, sp)
+	}
+	wg.Wait()
+	// Record the batch as failed if any of its files failed.
+	for _, res := range results {
+		if res.Err != nil {
+			err = res.Err
+			break
+		}
+	}
+	return results
+}
+
+// GetStats returns the number of calls, the number of errors and the latency
+// histogram of each method which talks to skyd, keyed by the method's name.
+// Methods which haven't been called yet are missing.
+func (c *client) GetStats() map[string]CallStats {
+	return c.staticStats.managedStats()
+}
+
+// IsBlocked returns true if the given skylink is on skyd's blocklist. We keep a
+// copy of the blocklist and fetch a fresh one once it's older than
+// blocklistRefreshInterval. If we fail to fetch a fresh one, we keep using the
+// old copy. IsBlocked only fails if we've never fetched the blocklist.
+func (c *client) IsBlocked(ctx context.Context, skylink string) (_ bool, err error) {
+	c.staticLogger.Tracef("Entering IsBlocked. Skylink: '%s'", skylink)
+	defer c.staticLogger.Tracef("Exiting  IsBlocked. Skylink: '%s'", skylink)
+	defer c.staticStats.managedRecord("IsBlocked", time.Now(), &err)
+	var sl skymodules.Skylink
+	err = sl.LoadString(skylink)
+	if err != nil {
+		return false, errors.Compose(err, database.ErrInvalidSkylink)
+	}
+	if c.staticBlocklist.managedStale() {
+		err = c.managedRefreshBlocklist(ctx)
+		if err != nil && !c.staticBlocklist.managedFetched() {
+			return false, errors.AddContext(err, "failed to fetch the blocklist")
+		}
+		if err != nil {
+			c.staticLogger.Warnf("Failed to refresh the blocklist, using the old one: %v", err)
+		}
+	}
+	return c.staticBlocklist.managedContains(sl), nil
+}
+
+// IsPinning returns true if the local skyd is pinning the given skylink,
+// according to the skylinks cache. Until the cache has finished its first
+// rebuild, which might take longer than the caller is willing to wait, it asks
+// skyd directly whether it has the skylink's siafile instead. That siafile is
+// where our standard pins place the skylink, so skylinks which skyd stores
+// elsewhere, such as lazy pins and uploads, only show up once the cache is
+// built.
+func (c *client) IsPinning(ctx context.Context, skylink string) (_ bool, err error) {
+	c.staticLogger.Tracef("Entering IsPinning. Skylink: '%s'", skylink)
+	defer c.staticLogger.Tracef("Exiting  IsPinning. Skylink: '%s'", skylink)
+	if !c.staticSkylinksCache.LastRebuild().Start.IsZero() {
+		return c.staticSkylinksCache.Contains(skylink), nil
+	}
+	defer c.staticStats.managedRecord("IsPinning", time.Now(), &err)
+	sl, err := database.SkylinkFromString(skylink)
+	if err != nil {
+		return false, errors.Compose(err, database.ErrInvalidSkylink)
+	}
+	// skyd stores the V1 skylinks which the V2 ones point to.
+	if sl.IsSkylinkV2() {
+		resolved, err := c.Resolve(ctx, skylink)
+		if err != nil {
+			return false, err
+		}
+		sl, err = database.SkylinkFromString(resolved)
+		if err != nil {
+			return false, errors.Compose(err, database.ErrInvalidSkylink)
+		}
+	}
+	sp, err := skylinkSiaPath(sl)
+	if err != nil {
+		return false, err
+	}
+	rf, err := callWithRetry(ctx, c.staticReadLimiter, c.staticBreaker, c.staticTimeout, c.staticRetries, func() (api.RenterFile, error) {
+		return c.staticClient.RenterFileRootGet(sp)
+	})
+	if isNotExistErr(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, s := range rf.File.Skylinks {
+		if s == sl.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LastCacheRebuild returns information about the last finished cache rebuild.
+func (c *client) LastCacheRebuild() RebuildInfo {
+	return c.staticSkylinksCache.LastRebuild()
+}
+
 // Metadata returns the metadata of the skylink
-func (c *client) Metadata(skylink string) (skymodules.SkyfileMetadata, error) {
+func (c *client) Metadata(ctx context.Context, skylink string) (_ skymodules.SkyfileMetadata, err error) {
 	c.staticLogger.Trace("Entering Metadata")
 	defer c.staticLogger.Trace("Exiting  Metadata")
-	_, meta, err := c.staticClient.SkynetMetadataGet(skylink)
+	defer c.staticStats.managedRecord("Metadata", time.Now(), &err)
+	meta, err := callWithRetry(ctx, c.staticReadLimiter, c.staticBreaker, c.staticTimeout, c.staticRetries, func() (skymodules.SkyfileMetadata, error) {
+		_, meta, err := c.staticClient.SkynetMetadataGet(skylink)
+		return meta, err
+	})
 	if err != nil {
 		return skymodules.SkyfileMetadata{}, err
 	}
 	return meta, nil
 }
 
-// Pin instructs the local skyd to pin the given skylink.
-func (c *client) Pin(skylink string) (skymodules.SiaPath, error) {
+// Pin instructs the local skyd to pin the given skylink. If lazy is true, skyd
+// only uploads the base sector before returning. Otherwise, it downloads and
+// uploads the entire skyfile once before returning, so we give it more time
+// than the client's timeout, depending on the skyfile's size.
+func (c *client) Pin(ctx context.Context, skylink string, lazy bool) (_ skymodules.SiaPath, err error) {
 	c.staticLogger.Tracef("Entering Pin. Skylink: '%s'", skylink)
 	defer c.staticLogger.Tracef("Exiting  Pin. Skylink: '%s'", skylink)
-	_, err := database.SkylinkFromString(skylink)
+	defer c.staticStats.managedRecord("Pin", time.Now(), &err)
+	_, err = database.SkylinkFromString(skylink)
 	if err != nil {
 		return skymodules.SiaPath{}, errors.Compose(err, database.ErrInvalidSkylink)
 	}
-	pinned, err := c.isPinned(skylink)
-	if err != nil {
+	// Wait for our turn while we can still give up on the pin. Each caller
+	// waits for its own turn, even if it then joins a pin in progress.
+	if err := c.staticWriteLimiter.managedWait(ctx); err != nil {
 		return skymodules.SiaPath{}, err
 	}
-	if pinned {
-		// The skylink is already locally pinned, nothing to do.
-		return skymodules.SiaPath{}, ErrSkylinkAlreadyPinned
-	}
-	sp, err := c.staticClient.SkynetSkylinkPinLazyPost(skylink)
-	if err == nil || errors.Contains(err, ErrSkylinkAlreadyPinned) {
-		c.staticSkylinksCache.Add(skylink)
+	// Concurrent calls for the same skylink share a single pin. The skyd
+	// client can't cancel a request, so skyd pins the skylink even if all
+	// callers give up on it. That's why the shared pin doesn't use the
+	// callers' contexts and always runs to the end, recording its outcome in
+	// the cache. It's still bounded by its timeout. Callers which
+	// join a pin in progress get it in the mode of the caller which started
+	// it.
+	ch := c.staticPinGroup.DoChan(skylink, func() (interface{}, error) {
+		return c.pin(context.Background(), skylink, lazy)
+	})
+	select {
+	case res := <-ch:
+		return res.Val.(skymodules.SiaPath), res.Err
+	case <-ctx.Done():
+		return skymodules.SiaPath{}, ctx.Err()
 	}
-	return sp, err
 }
 
 // RebuildCache rebuilds the cache of skylinks pinned by the local skyd. The
 // rebuilding happens in a goroutine, allowing the method to return a channel
 // on which the caller can either wait or select. The caller can check whether
-// the rebuild was successful by calling Error().
-func (c *client) RebuildCache() RebuildCacheResult {
+// the rebuild was successful by checking Err once the channel is closed.
+// The rebuild aborts with ErrRebuildAborted once the given context is done.
+func (c *client) RebuildCache(ctx context.Context) *RebuildCacheResult {
 	c.staticLogger.Trace("Entering RebuildCache")
 	defer c.staticLogger.Trace("Exiting  RebuildCache")
-	return c.staticSkylinksCache.Rebuild(c)
+	return c.staticSkylinksCache.Rebuild(ctx, c)
+}
+
+// RebuildCacheSubtree works like RebuildCache but it only walks the subtree
+// under the given root. See PinnedSkylinksCache.RebuildSubtree.
+func (c *client) RebuildCacheSubtree(ctx context.Context, root skymodules.SiaPath) *RebuildCacheResult {
+	c.staticLogger.Trace("Entering RebuildCacheSubtree")
+	defer c.staticLogger.Trace("Exiting  RebuildCacheSubtree")
+	return c.staticSkylinksCache.RebuildSubtree(ctx, c, root)
 }
 
 // RenterDirRootGet is a direct proxy to skyd client's method.
-func (c *client) RenterDirRootGet(siaPath skymodules.SiaPath) (rd api.RenterDirectory, err error) {
-	return c.staticClient.RenterDirRootGet(siaPath)
+func (c *client) RenterDirRootGet(ctx context.Context, siaPath skymodules.SiaPath) (rd api.RenterDirectory, err error) {
+	defer c.staticStats.managedRecord("RenterDirRootGet", time.Now(), &err)
+	return callWithRetry(ctx, c.staticReadLimiter, c.staticBreaker, c.staticTimeout, c.staticRetries, func() (api.RenterDirectory, error) {
+		return c.staticClient.RenterDirRootGet(siaPath)
+	})
+}
+
+// RenterSummary returns a summary of the renter's allowance and contracts.
+func (c *client) RenterSummary(ctx context.Context) (_ RenterSummary, err error) {
+	c.staticLogger.Trace("Entering RenterSummary")
+	defer c.staticLogger.Trace("Exiting  RenterSummary")
+	defer c.staticStats.managedRecord("RenterSummary", time.Now(), &err)
+	rg, err := callWithRetry(ctx, c.staticReadLimiter, c.staticBreaker, c.staticTimeout, c.staticRetries, func() (api.RenterGET, error) {
+		return c.staticClient.RenterGet()
+	})
+	if err != nil {
+		return RenterSummary{}, errors.AddContext(err, "failed to get renter")
+	}
+	rc, err := callWithRetry(ctx, c.staticReadLimiter, c.staticBreaker, c.staticTimeout, c.staticRetries, func() (api.RenterContracts, error) {
+		return c.staticClient.RenterContractsGet()
+	})
+	if err != nil {
+		return RenterSummary{}, errors.AddContext(err, "failed to get renter contracts")
+	}
+	summary := RenterSummary{
+		AllowanceFunds:  rg.Settings.Allowance.Funds,
+		RemainingFunds:  types.ZeroCurrency,
+		ActiveContracts: len(rc.ActiveContracts),
+	}
+	allocated := rg.FinancialMetrics.TotalAllocated
+	if summary.AllowanceFunds.Cmp(allocated) > 0 {
+		summary.RemainingFunds = summary.AllowanceFunds.Sub(allocated)
+	}
+	for _, contract := range rc.ActiveContracts {
+		summary.StoredBytes += contract.Size
+	}
+	return summary, nil
 }
 
 // Resolve resolves a V2 skylink to a V1 skylink. Returns an error if the given
-// skylink is not V2.
-func (c *client) Resolve(skylink string) (string, error) {
+// skylink is not V2. Resolutions are cached for resolveCacheTTL.
+func (c *client) Resolve(ctx context.Context, skylink string) (_ string, err error) {
 	c.staticLogger.Tracef("Entering Resolve. Skylink: '%s'", skylink)
 	defer c.staticLogger.Tracef("Exiting  Resolve. Skylink: '%s'", skylink)
-	return c.staticClient.ResolveSkylinkV2(skylink)
+	defer c.staticStats.managedRecord("Resolve", time.Now(), &err)
+	if resolved, ok := c.staticResolveCache.managedGet(skylink); ok {
+		return resolved, nil
+	}
+	resolved, err := callWithRetry(ctx, c.staticReadLimiter, c.staticBreaker, c.staticTimeout, c.staticRetries, func() (string, error) {
+		return c.staticClient.ResolveSkylinkV2(skylink)
+	})
+	if err != nil {
+		return "", err
+	}
+	c.staticResolveCache.managedSet(skylink, resolved)
+	return resolved, nil
+}
+
+// ResolveCacheStats returns the usage stats of the cache of resolved V2
+// skylinks.
+func (c *client) ResolveCacheStats() ResolveCacheStats {
+	return c.staticResolveCache.managedStats()
+}
+
+// ThrottleStats returns the usage stats of the client-side rate limits on the
+// calls to skyd.
+func (c *client) ThrottleStats() ThrottleStats {
+	return ThrottleStats{
+		Read:  c.staticReadLimiter.managedStats(),
+		Write: c.staticWriteLimiter.managedStats(),
+	}
 }
 
 // Unpin instructs the local skyd to unpin the given skylink.
-func (c *client) Unpin(skylink string) error {
+func (c *client) Unpin(ctx context.Context, skylink string) (err error) {
 	c.staticLogger.Tracef("Entering Unpin. Skylink: '%s'", skylink)
 	defer c.staticLogger.Tracef("Exiting  Unpin. Skylink: '%s'", skylink)
-	err := c.staticClient.SkynetSkylinkUnpinPost(skylink)
-	// Update the cached status of the skylink if there is no error or the error
-	// indicates that the skylink is blocked.
-	if err != nil || strings.Contains(err.Error(), renter.ErrSkylinkBlocked.Error()) {
+	defer c.staticStats.managedRecord("Unpin", time.Now(), &err)
+	// Wait for our turn while we can still give up on the unpin.
+	if err := c.staticWriteLimiter.managedWait(ctx); err != nil {
+		return err
+	}
+	// Concurrent calls for the same skylink share a single unpin. Like the
+	// shared pin, it doesn't use the callers' contexts. See Pin.
+	ch := c.staticUnpinGroup.DoChan(skylink, func() (interface{}, error) {
+		return nil, c.unpin(context.Background(), skylink)
+	})
+	select {
+	case res := <-ch:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// UnpinMany instructs the local skyd to unpin the given skylinks. It sends up
+// to the client's unpin concurrency calls at the same time, each of them
+// waiting for its turn under the write rate limit. It returns the error of each
+// given skylink, nil for the ones it unpinned. Skylinks which it didn't get to
+// before the context was done fail with the context's error.
+//
+// Unlike Unpin, it doesn't share its calls with concurrent unpins of the same
+// skylinks and it updates the cache once, after all calls return.
+func (c *client) UnpinMany(ctx context.Context, skylinks []string) map[string]error {
+	c.staticLogger.Tracef("Entering UnpinMany. Skylinks: %d", len(skylinks))
+	defer c.staticLogger.Tracef("Exiting  UnpinMany. Skylinks: %d", len(skylinks))
+	var err error
+	defer c.staticStats.managedRecord("UnpinMany", time.Now(), &err)
+	errs := make(map[string]error, len(skylinks))
+	var removed []string
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, c.staticUnpinConcurrency)
+	for _, sl := range skylinks {
+		mu.Lock()
+		_, exists := errs[sl]
+		if !exists {
+			// Claim the skylink, so we unpin it only once.
+			errs[sl] = nil
+		}
+		mu.Unlock()
+		if exists {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			mu.Lock()
+			errs[sl] = ctx.Err()
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(sl string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := c.staticWriteLimiter.managedWait(ctx)
+			if err == nil {
+				err = c.callUnpin(ctx, sl)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			errs[sl] = err
+			if removesFromCache(err) {
+				removed = append(removed, sl)
+			}
+		}(sl)
+	}
+	wg.Wait()
+	c.staticSkylinksCache.Remove(removed...)
+	// Record the batch as failed if any of its skylinks failed.
+	for _, errSkylink := range errs {
+		if errSkylink != nil {
+			err = errSkylink
+			break
+		}
+	}
+	return errs
+}
+
+// managedRefreshBlocklist fetches a fresh copy of skyd's blocklist. Concurrent
+// calls share a single fetch, which doesn't use the callers' contexts, so a
+// caller which gives up doesn't fail the fetch for the others.
+func (c *client) managedRefreshBlocklist(ctx context.Context) error {
+	ch := c.staticBlocklistGroup.DoChan("", func() (interface{}, error) {
+		bl, err := callWithRetry(context.Background(), c.staticReadLimiter, c.staticBreaker, c.staticTimeout, c.staticRetries, func() (api.SkynetBlocklistGET, error) {
+			return c.staticClient.SkynetBlocklistGet()
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.staticBlocklist.managedUpdate(bl.Blocklist)
+		return nil, nil
+	})
+	select {
+	case res := <-ch:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pin pins the given skylink to the local skyd, unless the cache says it's
+// already pinned. See Pin.
+func (c *client) pin(ctx context.Context, skylink string, lazy bool) (skymodules.SiaPath, error) {
+	pinned, err := c.isPinned(ctx, skylink)
+	if err != nil {
+		return skymodules.SiaPath{}, err
+	}
+	if pinned {
+		// The skylink is already locally pinned, nothing to do.
+		return skymodules.SiaPath{}, ErrSkylinkAlreadyPinned
+	}
+	timeout := c.staticTimeout
+	if !lazy {
+		timeout = c.fullPinTimeout(ctx, skylink)
+	}
+	// Pinning is not idempotent, so we only try once.
+	sp, err := callOnce(ctx, c.staticBreaker, timeout, func() (skymodules.SiaPath, error) {
+		if lazy {
+			return c.staticClient.SkynetSkylinkPinLazyPost(skylink)
+		}
+		// The standard pin endpoint doesn't report where it placed the
+		// file, so we choose the path ourselves. We place it at the
+		// skylink's siafile, which IsPinning can find without the cache.
+		sl, err := database.SkylinkFromString(skylink)
+		if err != nil {
+			return skymodules.SiaPath{}, errors.Compose(err, database.ErrInvalidSkylink)
+		}
+		sp, err := skylinkSiaPath(sl)
+		if err != nil {
+			return skymodules.SiaPath{}, err
+		}
+		spp := skymodules.SkyfilePinParameters{
+			SiaPath: sp,
+			Root:    true,
+		}
+		err = c.staticClient.SkynetSkylinkPinPost(skylink, spp)
+		if isExistErr(err) {
+			// The skylink's siafile is already there, so skyd pins it.
+			return sp, ErrSkylinkAlreadyPinned
+		}
+		return sp, err
+	})
+	if err == nil || errors.Contains(err, ErrSkylinkAlreadyPinned) {
+		c.staticSkylinksCache.Add(skylink)
+	}
+	return sp, err
+}
+
+// skylinkSiaPath returns the path of the given skylink's siafile, which is
+// derived from the skylink itself and placed in the skynet folder.
+func skylinkSiaPath(sl skymodules.Skylink) (skymodules.SiaPath, error) {
+	sp, err := sl.SiaPath()
+	if err != nil {
+		return skymodules.SiaPath{}, err
+	}
+	return skymodules.SkynetFolder.Join(sp.String())
+}
+
+// fullPinTimeout returns the timeout of a standard pin of the given skylink.
+// Such a pin uploads the base sector and the fanout once before it returns, so
+// we add the time we expect that to take to the client's timeout. If we fail to
+// fetch the skylink's metadata, we can't tell and use the client's timeout.
+func (c *client) fullPinTimeout(ctx context.Context, skylink string) time.Duration {
+	if c.staticTimeout == 0 {
+		return 0
+	}
+	meta, err := c.Metadata(ctx, skylink)
+	if err != nil {
+		c.staticLogger.Debug(errors.AddContext(err, fmt.Sprintf("failed to fetch the metadata of '%s', pinning it with the default timeout", skylink)))
+		return c.staticTimeout
+	}
+	return c.staticTimeout + EstimateUploadTime(meta.Length, 1, BaseSectorRedundancy)
+}
+
+// unpin unpins the given skylink from the local skyd and updates the cache.
+func (c *client) unpin(ctx context.Context, skylink string) error {
+	err := c.callUnpin(ctx, skylink)
+	if removesFromCache(err) {
 		c.staticSkylinksCache.Remove(skylink)
 	}
 	return err
 }
 
+// callUnpin calls skyd to unpin the given skylink.
+func (c *client) callUnpin(ctx context.Context, skylink string) error {
+	// Unpinning is not idempotent, so we only try once.
+	_, err := callOnce(ctx, c.staticBreaker, c.staticTimeout, func() (struct{}, error) {
+		return struct{}{}, c.staticClient.SkynetSkylinkUnpinPost(skylink)
+	})
+	return err
+}
+
+// removesFromCache returns true if an unpin which returned the given error
+// leaves the skylink unpinned, meaning that we should remove it from the
+// cache. That's the case if there is no error or the error indicates that the
+// skylink is blocked.
+func removesFromCache(err error) bool {
+	return err == nil || errors.Contains(err, ErrSkylinkBlocked)
+}
+
 // isPinned checks the list of skylinks pinned by the local skyd for the given
-// skylink and returns true if it finds it.
-func (c *client) isPinned(skylink string) (bool, error) {
+// skylink and returns true if it finds it. If the client verifies pins, it
+// also confirms with skyd that the skylink is still there.
+func (c *client) isPinned(ctx context.Context, skylink string) (bool, error) {
 	c.staticLogger.Tracef("Entering isPinned. Skylink: '%s'", skylink)
 	defer c.staticLogger.Tracef("Exiting  isPinned. Skylink: '%s'", skylink)
-	return c.staticSkylinksCache.Contains(skylink), nil
+	if !c.staticSkylinksCache.Contains(skylink) {
+		return false, nil
+	}
+	if !c.staticVerifyPins {
+		return true, nil
+	}
+	return c.verifyPinned(ctx, skylink)
+}
+
+// verifyPinned confirms with skyd that it still pins the given skylink, which
+// the cache says it pins. It lists the directories in which the cache rebuilds
+// found the skylink. If none of them holds the skylink anymore, skyd no longer
+// pins it, so verifyPinned removes it from the cache and returns false. The
+// cache doesn't know where the skylinks it learned about since the last rebuild
+// are, so we trust it on those.
+func (c *client) verifyPinned(ctx context.Context, skylink string) (bool, error) {
+	dirs := c.staticSkylinksCache.Dirs(skylink)
+	if len(dirs) == 0 {
+		return true, nil
+	}
+	for _, dir := range dirs {
+		rd, err := c.RenterDirRootGet(ctx, dir)
+		if isNotExistErr(err) {
+			continue
+		}
+		if err != nil {
+			return false, errors.AddContext(err, fmt.Sprintf("failed to verify that skyd pins '%s'", skylink))
+		}
+		for _, f := range rd.Files {
+			for _, sl := range f.Skylinks {
+				if sl == skylink {
+					return true, nil
+				}
+			}
+		}
+	}
+	c.staticLogger.Infof("Skylink '%s' is no longer pinned by skyd, removing it from the cache", skylink)
+	c.staticSkylinksCache.Remove(skylink)
+	return false, nil
 }
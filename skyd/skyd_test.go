@@ -0,0 +1,1059 @@
+package skyd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/skynetlabs/pinner/database"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/fastrand"
+	"gitlab.com/SkynetLabs/skyd/node/api"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"gitlab.com/SkynetLabs/skyd/skymodules/renter"
+	"gitlab.com/SkynetLabs/skyd/skymodules/renter/filesystem"
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/types"
+)
+
+// newTestClient returns a client which talks to a local server with the given
+// handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc, timeout time.Duration, retries int) Client {
+	return newCustomTestClient(t, handler, timeout, retries, false, 0, 0)
+}
+
+// newCustomTestClient works like newTestClient but it allows us to enable pin
+// verification and rate limits.
+func newCustomTestClient(t *testing.T, handler http.HandlerFunc, timeout time.Duration, retries int, verifyPins bool, readRate, writeRate float64) Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	c, err := NewClient(host, port, "password", NewCache(), logger,
+		WithTimeout(timeout),
+		WithRetries(retries),
+		WithPinVerification(verifyPins),
+		WithRateLimits(readRate, writeRate),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// randomSkylink returns a random, valid skylink.
+func randomSkylink() string {
+	var h crypto.Hash
+	fastrand.Read(h[:])
+	sl, _ := skymodules.NewSkylinkV1(h, 0, 0)
+	return sl.String()
+}
+
+// TestClientTimeout ensures that calls to a stalled skyd time out, that
+// idempotent calls are retried and that pins are not.
+func TestClientTimeout(t *testing.T) {
+	t.Parallel()
+
+	var numRequests uint64
+	stall := make(chan struct{})
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&numRequests, 1)
+		<-stall
+	}
+	retries := 2
+	c := newTestClient(t, handler, 50*time.Millisecond, retries)
+	// Release the stalled requests before the server shuts down.
+	t.Cleanup(func() { close(stall) })
+
+	_, err := c.Metadata(context.Background(), randomSkylink())
+	if !errors.Contains(err, ErrTimeout) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrTimeout, err)
+	}
+	if n := atomic.LoadUint64(&numRequests); n != uint64(retries+1) {
+		t.Fatalf("Expected %d requests, got %d", retries+1, n)
+	}
+
+	atomic.StoreUint64(&numRequests, 0)
+	_, err = c.Pin(context.Background(), randomSkylink(), true)
+	if !errors.Contains(err, ErrTimeout) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrTimeout, err)
+	}
+	if n := atomic.LoadUint64(&numRequests); n != 1 {
+		t.Fatalf("Expected a single request, got %d", n)
+	}
+}
+
+// TestClientCancel ensures that calls to a stalled skyd return as soon as their
+// context is done, that cancelled calls are not retried and that they don't
+// count against skyd.
+func TestClientCancel(t *testing.T) {
+	t.Parallel()
+
+	var numRequests uint64
+	stall := make(chan struct{})
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&numRequests, 1)
+		<-stall
+	}
+	// No timeout, so only the context can end the calls.
+	c := newTestClient(t, handler, 0, 2)
+	// Release the stalled requests before the server shuts down.
+	t.Cleanup(func() { close(stall) })
+
+	// A call with a cancelled context never reaches skyd.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.Metadata(ctx, randomSkylink())
+	if !errors.Contains(err, context.Canceled) {
+		t.Fatalf("Expected error '%v', got '%v'", context.Canceled, err)
+	}
+	if n := atomic.LoadUint64(&numRequests); n != 0 {
+		t.Fatalf("Expected no requests, got %d", n)
+	}
+
+	// Each kind of call returns once its context is done.
+	calls := map[string]func(ctx context.Context) error{
+		"Metadata": func(ctx context.Context) error {
+			_, err := c.Metadata(ctx, randomSkylink())
+			return err
+		},
+		"Pin": func(ctx context.Context) error {
+			_, err := c.Pin(ctx, randomSkylink(), true)
+			return err
+		},
+		"Unpin": func(ctx context.Context) error {
+			return c.Unpin(ctx, randomSkylink())
+		},
+		"FileHealthBatch": func(ctx context.Context) error {
+			sps := make([]skymodules.SiaPath, 2*fileHealthConcurrency)
+			for i := range sps {
+				sps[i] = skymodules.SiaPath{Path: fmt.Sprint(i)}
+			}
+			for _, res := range c.FileHealthBatch(ctx, sps) {
+				if !errors.Contains(res.Err, context.DeadlineExceeded) {
+					return res.Err
+				}
+			}
+			return context.DeadlineExceeded
+		},
+	}
+	for name, call := range calls {
+		atomic.StoreUint64(&numRequests, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err = call(ctx)
+		cancel()
+		if !errors.Contains(err, context.DeadlineExceeded) {
+			t.Fatalf("%s: expected error '%v', got '%v'", name, context.DeadlineExceeded, err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("%s: expected the call to return right after the deadline, it took %v", name, d)
+		}
+		// Cancelled calls are not retried.
+		if n := atomic.LoadUint64(&numRequests); name != "FileHealthBatch" && n != 1 {
+			t.Fatalf("%s: expected a single request, got %d", name, n)
+		}
+	}
+	// None of the cancelled calls tell us that skyd is unavailable.
+	if s := c.BreakerState(); s != BreakerClosed {
+		t.Fatalf("Expected state '%s', got '%s'", BreakerClosed, s)
+	}
+}
+
+// TestClientFileHealthBatch ensures that FileHealthBatch returns the health of
+// each file, or the error we got for it, in the order of the given paths.
+func TestClientFileHealthBatch(t *testing.T) {
+	t.Parallel()
+
+	healths := map[string]float64{
+		"healthy":   0,
+		"unhealthy": 0.5,
+	}
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(req.URL.Path, "/renter/file/")
+		health, exists := healths[name]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"file not found"}`))
+			return
+		}
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"file":{"health":%f}}`, health)))
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+
+	var sps []skymodules.SiaPath
+	for i := 0; i < 3*fileHealthConcurrency; i++ {
+		name := []string{"healthy", "unhealthy", "missing"}[i%3]
+		sps = append(sps, skymodules.SiaPath{Path: name})
+	}
+	results := c.FileHealthBatch(context.Background(), sps)
+	if len(results) != len(sps) {
+		t.Fatalf("Expected %d results, got %d", len(sps), len(results))
+	}
+	for i, res := range results {
+		health, exists := healths[sps[i].Path]
+		if !exists {
+			if res.Err == nil {
+				t.Fatalf("Expected an error for '%s'", sps[i])
+			}
+			continue
+		}
+		if res.Err != nil {
+			t.Fatalf("Unexpected error for '%s': %v", sps[i], res.Err)
+		}
+		if res.Health != health {
+			t.Fatalf("Expected health %f for '%s', got %f", health, sps[i], res.Health)
+		}
+	}
+}
+
+// TestClientPinDedup ensures that concurrent pins and unpins of the same
+// skylink share a single request to skyd.
+func TestClientPinDedup(t *testing.T) {
+	t.Parallel()
+
+	var numPins, numUnpins uint64
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		// Keep the requests in flight long enough for all calls to overlap.
+		time.Sleep(200 * time.Millisecond)
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/skynet/pin/"):
+			atomic.AddUint64(&numPins, 1)
+			_, _ = w.Write([]byte(`{"siapath":"var/skynet/file"}`))
+		case strings.HasPrefix(req.URL.Path, "/skynet/unpin/"):
+			atomic.AddUint64(&numUnpins, 1)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+
+	sl := randomSkylink()
+	numCalls := 10
+	// run calls fn from numCalls goroutines at the same time and returns
+	// their errors.
+	run := func(fn func() error) []error {
+		errs := make([]error, numCalls)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < numCalls; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				errs[i] = fn()
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+		return errs
+	}
+
+	errs := run(func() error {
+		_, err := c.Pin(context.Background(), sl, true)
+		return err
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadUint64(&numPins); n != 1 {
+		t.Fatalf("Expected a single pin request, got %d", n)
+	}
+
+	errs = run(func() error {
+		return c.Unpin(context.Background(), sl)
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadUint64(&numUnpins); n != 1 {
+		t.Fatalf("Expected a single unpin request, got %d", n)
+	}
+	// The unpinned skylink should be gone from the cache.
+	if c.(*client).staticSkylinksCache.Contains(sl) {
+		t.Fatal("Expected the unpinned skylink to be removed from the cache.")
+	}
+}
+
+// TestClientPinModes ensures that the client uses the lazy pin endpoint for
+// lazy pins and the standard one, with a siapath of its choosing, otherwise.
+func TestClientPinModes(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var query url.Values
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		query = req.URL.Query()
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"siapath":"var/skynet/file"}`))
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+
+	sp, err := c.Pin(context.Background(), randomSkylink(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if query.Get("lazy") != "true" || query.Get("siapath") != "" {
+		t.Fatalf("Expected a lazy pin without a siapath, got query %v", query)
+	}
+	mu.Unlock()
+	if sp.String() != "var/skynet/file" {
+		t.Fatalf("Expected the siapath reported by skyd, got '%s'", sp)
+	}
+
+	skylink := randomSkylink()
+	sp, err = c.Pin(context.Background(), skylink, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if query.Get("lazy") != "" || query.Get("root") != "true" {
+		t.Fatalf("Expected a standard pin at the root, got query %v", query)
+	}
+	if query.Get("siapath") != sp.String() {
+		t.Fatalf("Expected the pin at '%s', got '%s'", sp, query.Get("siapath"))
+	}
+	mu.Unlock()
+	sl, err := database.SkylinkFromString(skylink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := skylinkSiaPath(sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sp.Equals(expected) {
+		t.Fatalf("Expected the pin at the skylink's siafile '%s', got '%s'", expected, sp)
+	}
+}
+
+// TestClientPinExisting ensures that a standard pin reports
+// ErrSkylinkAlreadyPinned when skyd already has the skylink's siafile.
+func TestClientPinExisting(t *testing.T) {
+	t.Parallel()
+
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/skynet/pin/") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"message":"%s"}`, filesystem.ErrExists)))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+	skylink := randomSkylink()
+	_, err := c.Pin(context.Background(), skylink, false)
+	if !errors.Contains(err, ErrSkylinkAlreadyPinned) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrSkylinkAlreadyPinned, err)
+	}
+	if c.CacheSize() != 1 {
+		t.Fatalf("Expected the skylink in the cache, got a cache of size %d", c.CacheSize())
+	}
+}
+
+// TestClientPinTimeout ensures that a standard pin of a large skylink gets more
+// time than the client's timeout, while a lazy pin doesn't.
+func TestClientPinTimeout(t *testing.T) {
+	t.Parallel()
+
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/skynet/metadata/") {
+			_, _ = w.Write([]byte(`{"length":1099511627776}`))
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"siapath":"var/skynet/file"}`))
+	}
+	c := newTestClient(t, handler, 50*time.Millisecond, 0)
+
+	_, err := c.Pin(context.Background(), randomSkylink(), true)
+	if !errors.Contains(err, ErrTimeout) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrTimeout, err)
+	}
+	_, err = c.Pin(context.Background(), randomSkylink(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestClientUnpinMany ensures that UnpinMany unpins skylinks with bounded
+// concurrency, reports the error of each skylink and leaves the cache
+// consistent with a mixed result.
+func TestClientUnpinMany(t *testing.T) {
+	t.Parallel()
+
+	failing := randomSkylink()
+	blocked := randomSkylink()
+	var inFlight, maxInFlight, numUnpins int64
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+				break
+			}
+		}
+		atomic.AddInt64(&numUnpins, 1)
+		// Keep the requests in flight long enough for them to overlap.
+		time.Sleep(20 * time.Millisecond)
+		switch {
+		case strings.HasSuffix(req.URL.Path, failing):
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"message":"failed to unpin"}`))
+		case strings.HasSuffix(req.URL.Path, blocked):
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"message":"` + renter.ErrSkylinkBlocked.Error() + `"}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+	concurrency := 3
+	c.(*client).staticUnpinConcurrency = concurrency
+	cache := c.(*client).staticSkylinksCache
+
+	unpinned := make([]string, 10)
+	for i := range unpinned {
+		unpinned[i] = randomSkylink()
+	}
+	skylinks := append([]string{failing, blocked}, unpinned...)
+	cache.Add(skylinks...)
+	// Pass one of the skylinks twice.
+	errs := c.UnpinMany(context.Background(), append(skylinks, unpinned[0]))
+
+	if len(errs) != len(skylinks) {
+		t.Fatalf("Expected %d results, got %d", len(skylinks), len(errs))
+	}
+	if n := atomic.LoadInt64(&numUnpins); n != int64(len(skylinks)) {
+		t.Fatalf("Expected %d unpin requests, got %d", len(skylinks), n)
+	}
+	if n := atomic.LoadInt64(&maxInFlight); n > int64(concurrency) || n < 2 {
+		t.Fatalf("Expected between 2 and %d unpins at the same time, got %d", concurrency, n)
+	}
+	if errs[failing] == nil {
+		t.Fatal("Expected the failing unpin to fail")
+	}
+	if !errors.Contains(errs[blocked], ErrSkylinkBlocked) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrSkylinkBlocked, errs[blocked])
+	}
+	for _, sl := range unpinned {
+		if errs[sl] != nil {
+			t.Fatal(errs[sl])
+		}
+	}
+	// Only the skylink which failed to unpin remains in the cache.
+	if !cache.Contains(failing) {
+		t.Fatal("Expected the skylink which failed to unpin to stay in the cache")
+	}
+	if n := cache.Count(); n != 1 {
+		t.Fatalf("Expected a single skylink in the cache, got %d", n)
+	}
+
+	// Skylinks we don't get to before the context is done fail with the
+	// context's error.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errs = c.UnpinMany(ctx, unpinned)
+	for _, sl := range unpinned {
+		if !errors.Contains(errs[sl], context.Canceled) {
+			t.Fatalf("Expected error '%v', got '%v'", context.Canceled, errs[sl])
+		}
+	}
+}
+
+// TestClientPinVerify ensures that a client which verifies pins notices that
+// skyd no longer pins a skylink which the cache says it pins, pins it again and
+// fixes the cache. A client which doesn't verify pins trusts the cache.
+func TestClientPinVerify(t *testing.T) {
+	t.Parallel()
+
+	sl := randomSkylink()
+	dir := skymodules.SiaPath{Path: skymodules.SkynetFolder.Path + "/ab"}
+	// unpinned tells the handler whether the skylink got unpinned
+	// out-of-band.
+	var unpinned uint64
+	var numPins uint64
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/skynet/pin/") {
+			atomic.AddUint64(&numPins, 1)
+			_, _ = w.Write([]byte(`{"siapath":"var/skynet/ab/cd"}`))
+			return
+		}
+		var rd api.RenterDirectory
+		switch strings.TrimPrefix(req.URL.Path, "/renter/dir/") {
+		case skymodules.SkynetFolder.Path:
+			rd.Directories = []skymodules.DirectoryInfo{{SiaPath: skymodules.SkynetFolder}, {SiaPath: dir}}
+		case dir.Path:
+			rd.Directories = []skymodules.DirectoryInfo{{SiaPath: dir}}
+			if atomic.LoadUint64(&unpinned) == 0 {
+				rd.Files = []skymodules.FileInfo{{Skylinks: []string{sl}}}
+			}
+		}
+		b, err := json.Marshal(rd)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(b)
+	}
+
+	for _, verify := range []bool{false, true} {
+		atomic.StoreUint64(&unpinned, 0)
+		atomic.StoreUint64(&numPins, 0)
+		c := newCustomTestClient(t, handler, time.Second, 0, verify, 0, 0)
+		rr := c.RebuildCache(context.Background())
+		<-rr.Done()
+		if rr.Err() != nil {
+			t.Fatal(rr.Err())
+		}
+		// While skyd pins the skylink, both clients report it as pinned.
+		_, err := c.Pin(context.Background(), sl, true)
+		if !errors.Contains(err, ErrSkylinkAlreadyPinned) {
+			t.Fatalf("Verify %t: expected error '%v', got '%v'", verify, ErrSkylinkAlreadyPinned, err)
+		}
+		// Unpin the skylink behind the cache's back.
+		atomic.StoreUint64(&unpinned, 1)
+		_, err = c.Pin(context.Background(), sl, true)
+		if !verify {
+			if !errors.Contains(err, ErrSkylinkAlreadyPinned) {
+				t.Fatalf("Expected error '%v', got '%v'", ErrSkylinkAlreadyPinned, err)
+			}
+			if n := atomic.LoadUint64(&numPins); n != 0 {
+				t.Fatalf("Expected no pin requests, got %d", n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadUint64(&numPins); n != 1 {
+			t.Fatalf("Expected a single pin request, got %d", n)
+		}
+		if !c.(*client).staticSkylinksCache.Contains(sl) {
+			t.Fatal("Expected the pinned skylink to be back in the cache.")
+		}
+	}
+}
+
+// TestClientThrottle ensures that the client limits the rate of its calls to
+// skyd and that reads and writes don't share a limit.
+func TestClientThrottle(t *testing.T) {
+	t.Parallel()
+
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/skynet/pin/") {
+			_, _ = w.Write([]byte(`{"siapath":"var/skynet/ab/cd"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}
+	// Allow a single pin every hour.
+	c := newCustomTestClient(t, handler, time.Second, 0, false, 0, 1.0/3600)
+	_, err := c.Pin(context.Background(), randomSkylink(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The next pin has to wait.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Pin(ctx, randomSkylink(), true)
+	if !errors.Contains(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected error '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+	// Reads are not limited.
+	_, err = c.Metadata(context.Background(), randomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := c.ThrottleStats()
+	if stats.Read.Rate != 0 || stats.Read.CurrentWait != 0 || stats.Read.TotalWait != 0 {
+		t.Fatalf("Expected no read throttling, got %+v", stats.Read)
+	}
+	if stats.Write.CurrentWait < time.Hour || stats.Write.TotalWait < 59*time.Minute || stats.Write.Waiting != 0 {
+		t.Fatalf("Expected write throttling, got %+v", stats.Write)
+	}
+}
+
+// TestClientStats ensures that the client records the calls, the errors and
+// the latencies of its methods.
+func TestClientStats(t *testing.T) {
+	t.Parallel()
+
+	sl := randomSkylink()
+	delay := 60 * time.Millisecond
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/skynet/resolve/") {
+			time.Sleep(delay)
+			_, _ = w.Write([]byte(`{"skylink":"` + sl + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"message":"failed to unpin"}`))
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+	if stats := c.GetStats(); len(stats) != 0 {
+		t.Fatalf("Expected no stats before any calls, got %v", stats)
+	}
+
+	// Resolve the same skylink twice. The second call is served from the
+	// resolve cache, so it's fast.
+	for i := 0; i < 2; i++ {
+		if _, err := c.Resolve(context.Background(), sl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Unpin(context.Background(), randomSkylink()); err == nil {
+			t.Fatal("Expected the unpin to fail.")
+		}
+	}
+
+	stats := c.GetStats()
+	if len(stats) != 2 {
+		t.Fatalf("Expected the stats of two methods, got %v", stats)
+	}
+	resolve := stats["Resolve"]
+	if resolve.Calls != 2 || resolve.Errors != 0 {
+		t.Fatalf("Expected 2 calls and no errors, got %d and %d", resolve.Calls, resolve.Errors)
+	}
+	if resolve.MaxLatency < delay || resolve.TotalLatency < resolve.MaxLatency {
+		t.Fatalf("Expected a max latency of at least %v, got %v out of %v", delay, resolve.MaxLatency, resolve.TotalLatency)
+	}
+	if len(resolve.Latency) != len(latencyBuckets)+1 || resolve.Latency[len(resolve.Latency)-1].UpTo != 0 {
+		t.Fatalf("Unexpected histogram %v", resolve.Latency)
+	}
+	// The cached call is in the first bucket and the other one in a bucket
+	// above the delay.
+	if resolve.Latency[0].Count != 1 {
+		t.Fatalf("Expected the cached call in the first bucket, got %v", resolve.Latency)
+	}
+	for _, b := range resolve.Latency[1:] {
+		if b.Count > 0 && b.UpTo != 0 && b.UpTo < delay {
+			t.Fatalf("Expected no calls under %v but the cached one, got %v", delay, resolve.Latency)
+		}
+	}
+	unpin := stats["Unpin"]
+	if unpin.Calls != 3 || unpin.Errors != 3 {
+		t.Fatalf("Expected 3 calls and 3 errors, got %d and %d", unpin.Calls, unpin.Errors)
+	}
+
+	// The returned stats are a copy.
+	resolve.Latency[0].Count = 100
+	if c.GetStats()["Resolve"].Latency[0].Count != 1 {
+		t.Fatal("Expected changes to the returned stats not to affect the client.")
+	}
+}
+
+// TestClientIsPinning ensures that IsPinning doesn't wait for the skylinks
+// TestClientIsPinning ensures that IsPinning asks skyd for the skylink's siafile
+// until the skylinks cache has finished its first rebuild, and that it asks the
+// cache after that.
+func TestClientIsPinning(t *testing.T) {
+	t.Parallel()
+
+	sl := randomSkylink()
+	unpinned := randomSkylink()
+	slSkylink, err := database.SkylinkFromString(sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := skylinkSiaPath(slSkylink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rebuild blocks the listing of the skynet folder until it's closed.
+	rebuild := make(chan struct{})
+	var fileReqs uint64
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/renter/file/") {
+			atomic.AddUint64(&fileReqs, 1)
+			if strings.TrimPrefix(req.URL.Path, "/renter/file/") != sp.String() {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(fmt.Sprintf(`{"message":"%s"}`, filesystem.ErrNotExist)))
+				return
+			}
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"file":{"skylinks":["%s"]}}`, sl)))
+			return
+		}
+		<-rebuild
+		rd := api.RenterDirectory{
+			Directories: []skymodules.DirectoryInfo{{SiaPath: skymodules.SkynetFolder}},
+			Files:       []skymodules.FileInfo{{Skylinks: []string{sl}}},
+		}
+		b, err := json.Marshal(rd)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(b)
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+	rr := c.RebuildCache(context.Background())
+	pinning, err := c.IsPinning(context.Background(), sl)
+	if err != nil || !pinning {
+		t.Fatalf("Expected skyd to report the skylink as pinned, got %t %v", pinning, err)
+	}
+	pinning, err = c.IsPinning(context.Background(), unpinned)
+	if err != nil || pinning {
+		t.Fatalf("Expected skyd to report the skylink as not pinned, got %t %v", pinning, err)
+	}
+	if n := atomic.LoadUint64(&fileReqs); n != 2 {
+		t.Fatalf("Expected 2 requests for siafiles, got %d", n)
+	}
+	close(rebuild)
+	<-rr.Done()
+	if rr.Err() != nil {
+		t.Fatal(rr.Err())
+	}
+	pinning, err = c.IsPinning(context.Background(), sl)
+	if err != nil || !pinning {
+		t.Fatalf("Expected the skylink to be pinned, got %t %v", pinning, err)
+	}
+	pinning, err = c.IsPinning(context.Background(), unpinned)
+	if err != nil || pinning {
+		t.Fatalf("Expected the skylink not to be pinned, got %t %v", pinning, err)
+	}
+	if n := atomic.LoadUint64(&fileReqs); n != 2 {
+		t.Fatalf("Expected the cache to answer, got %d requests for siafiles", n)
+	}
+}
+
+// TestClientPinBlocked ensures that Pin reports blocked skylinks with
+// ErrSkylinkBlocked.
+func TestClientPinBlocked(t *testing.T) {
+	t.Parallel()
+
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"message":"failed to pin: ` + renter.ErrSkylinkBlocked.Error() + `"}`))
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+	_, err := c.Pin(context.Background(), randomSkylink(), true)
+	if !errors.Contains(err, ErrSkylinkBlocked) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrSkylinkBlocked, err)
+	}
+
+	// Other errors are not reported as blocked.
+	handler = func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"message":"failed to pin"}`))
+	}
+	c = newTestClient(t, handler, time.Second, 0)
+	_, err = c.Pin(context.Background(), randomSkylink(), true)
+	if err == nil || errors.Contains(err, ErrSkylinkBlocked) {
+		t.Fatalf("Expected an error other than '%v', got '%v'", ErrSkylinkBlocked, err)
+	}
+}
+
+// TestClientIsBlocked ensures that the client checks skylinks against its copy
+// of skyd's blocklist, that it refreshes the copy once it goes stale and that
+// it keeps using the old copy if it fails to refresh it.
+func TestClientIsBlocked(t *testing.T) {
+	t.Parallel()
+
+	blocked := randomSkylink()
+	other := randomSkylink()
+	var sl skymodules.Skylink
+	if err := sl.LoadString(blocked); err != nil {
+		t.Fatal(err)
+	}
+	hash := crypto.HashObject(sl.MerkleRoot())
+
+	// fail tells the handler to fail the blocklist requests.
+	var fail uint64
+	var numRequests uint64
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/skynet/blocklist" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddUint64(&numRequests, 1)
+		if atomic.LoadUint64(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"message":"failed to get the blocklist"}`))
+			return
+		}
+		b, err := json.Marshal(api.SkynetBlocklistGET{Blocklist: []crypto.Hash{hash}})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(b)
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+	clock := &testClock{now: time.Now()}
+	c.(*client).staticBlocklist = newBlocklist(time.Minute, clock.Now)
+
+	// Invalid skylinks are rejected.
+	_, err := c.IsBlocked(context.Background(), "invalid")
+	if !errors.Contains(err, database.ErrInvalidSkylink) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrInvalidSkylink, err)
+	}
+	// If we never fetched the blocklist, we can't tell.
+	atomic.StoreUint64(&fail, 1)
+	_, err = c.IsBlocked(context.Background(), blocked)
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+	atomic.StoreUint64(&fail, 0)
+
+	isBlocked, err := c.IsBlocked(context.Background(), blocked)
+	if err != nil || !isBlocked {
+		t.Fatalf("Expected the skylink to be blocked, got %t, '%v'", isBlocked, err)
+	}
+	isBlocked, err = c.IsBlocked(context.Background(), other)
+	if err != nil || isBlocked {
+		t.Fatalf("Expected the skylink not to be blocked, got %t, '%v'", isBlocked, err)
+	}
+	// Both checks used the same copy of the blocklist.
+	if n := atomic.LoadUint64(&numRequests); n != 2 {
+		t.Fatalf("Expected 2 blocklist requests, got %d", n)
+	}
+
+	// Once the copy is stale, we fetch a fresh one. If that fails, we keep
+	// using the old one.
+	clock.Advance(time.Minute)
+	atomic.StoreUint64(&fail, 1)
+	isBlocked, err = c.IsBlocked(context.Background(), blocked)
+	if err != nil || !isBlocked {
+		t.Fatalf("Expected the skylink to be blocked, got %t, '%v'", isBlocked, err)
+	}
+	if n := atomic.LoadUint64(&numRequests); n != 3 {
+		t.Fatalf("Expected 3 blocklist requests, got %d", n)
+	}
+}
+
+// TestClientResolveCache ensures that the client serves repeated resolutions
+// from its cache and that failed resolutions are not cached.
+func TestClientResolveCache(t *testing.T) {
+	t.Parallel()
+
+	sl := randomSkylink()
+	var numRequests uint64
+	var fail uint64
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&numRequests, 1)
+		if atomic.LoadUint64(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"message":"internal error"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"skylink":"` + sl + `"}`))
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+
+	// Resolve the same skylink twice. Expect a single request to skyd.
+	v2 := randomSkylink()
+	for i := 0; i < 2; i++ {
+		resolved, err := c.Resolve(context.Background(), v2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved != sl {
+			t.Fatalf("Expected '%s', got '%s'", sl, resolved)
+		}
+	}
+	if n := atomic.LoadUint64(&numRequests); n != 1 {
+		t.Fatalf("Expected a single request, got %d", n)
+	}
+	stats := c.ResolveCacheStats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Size != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	// Fail a resolution. Expect it to not be cached.
+	atomic.StoreUint64(&fail, 1)
+	failing := randomSkylink()
+	_, err := c.Resolve(context.Background(), failing)
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+	atomic.StoreUint64(&fail, 0)
+	_, err = c.Resolve(context.Background(), failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&numRequests); n != 3 {
+		t.Fatalf("Expected 3 requests, got %d", n)
+	}
+}
+
+// TestClientRenterSummary ensures that RenterSummary summarises the renter's
+// allowance and active contracts.
+func TestClientRenterSummary(t *testing.T) {
+	t.Parallel()
+
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/renter":
+			_, _ = w.Write([]byte(`{"settings":{"allowance":{"funds":"1000"}},"financialmetrics":{"totalallocated":"300"}}`))
+		case "/renter/contracts":
+			_, _ = w.Write([]byte(`{"activecontracts":[{"size":10},{"size":20}],"expiredcontracts":[{"size":40}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	c := newTestClient(t, handler, time.Second, 0)
+	summary, err := c.RenterSummary(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RenterSummary{
+		AllowanceFunds:  types.NewCurrency64(1000),
+		RemainingFunds:  types.NewCurrency64(700),
+		ActiveContracts: 2,
+		StoredBytes:     30,
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, summary)
+	}
+}
+
+// TestClientMockRenterSummary ensures that the mock returns the renter summary
+// set via SetRenterSummary.
+func TestClientMockRenterSummary(t *testing.T) {
+	t.Parallel()
+
+	c := NewSkydClientMock()
+	summary, err := c.RenterSummary(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.ActiveContracts == 0 {
+		t.Fatal("Expected the mock to have active contracts by default.")
+	}
+	expected := RenterSummary{StoredBytes: 123}
+	c.SetRenterSummary(expected, nil)
+	summary, err = c.RenterSummary(context.Background())
+	if err != nil || !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("Expected %+v, got %+v, %v", expected, summary, err)
+	}
+	errSummary := errors.New("no renter")
+	c.SetRenterSummary(RenterSummary{}, errSummary)
+	_, err = c.RenterSummary(context.Background())
+	if !errors.Contains(err, errSummary) {
+		t.Fatalf("Expected error '%v', got '%v'", errSummary, err)
+	}
+}
+
+// TestClientRetry ensures that idempotent calls are retried when they fail to
+// reach skyd but not when skyd returns an error.
+func TestClientRetry(t *testing.T) {
+	t.Parallel()
+
+	sl := randomSkylink()
+	var numRequests uint64
+	var numFailures uint64
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddUint64(&numRequests, 1)
+		// Drop the connection for the first few requests.
+		if n <= atomic.LoadUint64(&numFailures) {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+			return
+		}
+		// Don't let the transport reuse connections. It retries requests on
+		// reused connections which fail, which would skew our count.
+		w.Header().Set("Connection", "close")
+		if strings.HasPrefix(req.URL.Path, "/skynet/resolve/") {
+			_, _ = w.Write([]byte(`{"skylink":"` + sl + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"message":"internal error"}`))
+	}
+	c := newTestClient(t, handler, time.Second, 3)
+
+	// Fail fewer times than the number of retries. Expect success.
+	atomic.StoreUint64(&numFailures, 2)
+	resolved, err := c.Resolve(context.Background(), sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved != sl {
+		t.Fatalf("Expected '%s', got '%s'", sl, resolved)
+	}
+	if n := atomic.LoadUint64(&numRequests); n != 3 {
+		t.Fatalf("Expected 3 requests, got %d", n)
+	}
+
+	// Fail more times than the number of retries. Expect failure. Use a
+	// different skylink, so we don't get a cached resolution.
+	atomic.StoreUint64(&numRequests, 0)
+	atomic.StoreUint64(&numFailures, 10)
+	_, err = c.Resolve(context.Background(), randomSkylink())
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+	if n := atomic.LoadUint64(&numRequests); n != 4 {
+		t.Fatalf("Expected 4 requests, got %d", n)
+	}
+
+	// Return an error from skyd. Expect no retries.
+	atomic.StoreUint64(&numRequests, 0)
+	atomic.StoreUint64(&numFailures, 0)
+	_, err = c.Metadata(context.Background(), sl)
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+	if n := atomic.LoadUint64(&numRequests); n != 1 {
+		t.Fatalf("Expected a single request, got %d", n)
+	}
+}
+
+// TestClientMockOptions ensures that the mock's constructor options pre-seed
+// its pinned skylinks and its filesystem.
+func TestClientMockOptions(t *testing.T) {
+	t.Parallel()
+
+	sl := randomSkylink()
+	dir := skymodules.SiaPath{Path: "dir"}
+	errDir := errors.New("failed to read dir")
+	c := NewSkydClientMock(
+		WithPinnedSkylinks(sl),
+		WithDirectory(skymodules.SkynetFolder, api.RenterDirectory{
+			Files: []skymodules.FileInfo{{Skylinks: []string{sl}}},
+		}),
+		WithDirectoryError(dir, errDir),
+	)
+	if !c.Pinning(sl) {
+		t.Fatalf("Expected the mock to pin '%s'", sl)
+	}
+	rd, err := c.RenterDirRootGet(context.Background(), skymodules.SkynetFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rd.Files) != 1 || rd.Files[0].Skylinks[0] != sl {
+		t.Fatalf("Unexpected root directory %+v", rd)
+	}
+	_, err = c.RenterDirRootGet(context.Background(), dir)
+	if !errors.Contains(err, errDir) {
+		t.Fatalf("Expected error '%v', got '%v'", errDir, err)
+	}
+}
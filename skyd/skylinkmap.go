@@ -0,0 +1,184 @@
+package skyd
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/skynetlabs/pinner/database"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+)
+
+const (
+	// rawSkylinkSize is the size of a skylink's raw representation.
+	rawSkylinkSize = 34
+	// encodedSkylinkSize is the size of a skylink's base64 representation,
+	// which is the form in which skyd reports skylinks.
+	encodedSkylinkSize = 46
+)
+
+// base64Alphabet is the alphabet of the unpadded, URL-safe base64 encoding skyd
+// uses for skylinks.
+const base64Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// base64Values maps each byte to its value in base64Alphabet or to 0xFF if it's
+// not part of the alphabet.
+var base64Values = func() (v [256]byte) {
+	for i := range v {
+		v[i] = 0xFF
+	}
+	for i := 0; i < len(base64Alphabet); i++ {
+		v[base64Alphabet[i]] = byte(i)
+	}
+	return v
+}()
+
+type (
+	// skylinkKey is the raw representation of a skylink. It's stored in the
+	// map itself, whereas a string key needs a header in the map and a
+	// separate allocation for its 46 bytes.
+	skylinkKey [rawSkylinkSize]byte
+
+	// skylinkMap maps skylinks to their cache entries. It keys the skylinks
+	// by their raw representation. Strings which don't decode back to the
+	// exact same string, e.g. base32 skylinks, are kept as they are, so the
+	// map always returns the skylinks in the form in which they were added.
+	// The cache normalizes all skylinks before adding them, so it only
+	// relies on the raw keys.
+	skylinkMap struct {
+		raw   map[skylinkKey]cacheEntry
+		other map[string]cacheEntry
+	}
+)
+
+// newSkylinkMap returns an empty skylinkMap.
+func newSkylinkMap() skylinkMap {
+	return skylinkMap{
+		raw:   make(map[skylinkKey]cacheEntry),
+		other: make(map[string]cacheEntry),
+	}
+}
+
+// newSkylinkKey decodes the given base64 skylink into its raw representation.
+// It returns false unless encoding the raw representation gives us back the
+// exact same string. It doesn't validate the skylink. It doesn't allocate,
+// which matters because the cache calls it on every lookup.
+func newSkylinkKey(skylink string) (k skylinkKey, ok bool) {
+	if len(skylink) != encodedSkylinkSize {
+		return skylinkKey{}, false
+	}
+	// Decode the first 44 characters, which hold 33 bytes, in groups of 4.
+	for i, j := 0, 0; i < encodedSkylinkSize-2; i, j = i+4, j+3 {
+		a := base64Values[skylink[i]]
+		b := base64Values[skylink[i+1]]
+		c := base64Values[skylink[i+2]]
+		d := base64Values[skylink[i+3]]
+		// Invalid characters map to 0xFF, which has the top bits set.
+		if (a|b|c|d)&0xC0 != 0 {
+			return skylinkKey{}, false
+		}
+		k[j] = a<<2 | b>>4
+		k[j+1] = b<<4 | c>>2
+		k[j+2] = c<<6 | d
+	}
+	// The last 2 characters hold the last byte and 4 padding bits, which
+	// must be zero for the encoding to be canonical.
+	a := base64Values[skylink[encodedSkylinkSize-2]]
+	b := base64Values[skylink[encodedSkylinkSize-1]]
+	if (a|b)&0xC0 != 0 || b&0x0F != 0 {
+		return skylinkKey{}, false
+	}
+	k[rawSkylinkSize-1] = a<<2 | b>>4
+	return k, true
+}
+
+// normalizeSkylink returns the canonical form of the given skylink, i.e. its
+// base64 form without surrounding whitespace or a path. It returns false if
+// the string is not a valid skylink. Canonical skylinks are returned as they
+// are, without allocating, since they're by far the most common.
+func normalizeSkylink(s string) (string, bool) {
+	if k, ok := newSkylinkKey(s); ok {
+		var sl skymodules.Skylink
+		return s, sl.LoadBytes(k[:]) == nil
+	}
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+	sl, err := database.SkylinkFromString(s)
+	if err != nil {
+		return "", false
+	}
+	return sl.String(), true
+}
+
+// String returns the base64 representation of the skylink.
+func (k skylinkKey) String() string {
+	return base64.RawURLEncoding.EncodeToString(k[:])
+}
+
+// delete removes the given skylink from the map.
+func (m skylinkMap) delete(skylink string) {
+	if k, ok := newSkylinkKey(skylink); ok {
+		delete(m.raw, k)
+		return
+	}
+	delete(m.other, skylink)
+}
+
+// each calls fn for each skylink in the map. fn may update or delete the
+// skylink it's called for.
+func (m skylinkMap) each(fn func(skylink string, e cacheEntry)) {
+	for k, e := range m.raw {
+		fn(k.String(), e)
+	}
+	for sl, e := range m.other {
+		fn(sl, e)
+	}
+}
+
+// get returns the entry of the given skylink and whether the map holds it.
+func (m skylinkMap) get(skylink string) (cacheEntry, bool) {
+	if k, ok := newSkylinkKey(skylink); ok {
+		e, exists := m.raw[k]
+		return e, exists
+	}
+	e, exists := m.other[skylink]
+	return e, exists
+}
+
+// len returns the number of skylinks in the map.
+func (m skylinkMap) len() int {
+	return len(m.raw) + len(m.other)
+}
+
+// set sets the entry of the given skylink.
+func (m skylinkMap) set(skylink string, e cacheEntry) {
+	if k, ok := newSkylinkKey(skylink); ok {
+		m.raw[k] = e
+		return
+	}
+	m.other[skylink] = e
+}
+
+// unmark clears the seen marks of all skylinks and returns the ones which
+// weren't marked. Unlike each, it doesn't encode the skylinks it doesn't
+// return, so it doesn't allocate for them.
+func (m skylinkMap) unmark() (unmarked []string) {
+	for k, e := range m.raw {
+		if !e.seen {
+			unmarked = append(unmarked, k.String())
+			continue
+		}
+		e.seen = false
+		m.raw[k] = e
+	}
+	for sl, e := range m.other {
+		if !e.seen {
+			unmarked = append(unmarked, sl)
+			continue
+		}
+		e.seen = false
+		m.other[sl] = e
+	}
+	return unmarked
+}
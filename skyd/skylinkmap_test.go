@@ -0,0 +1,187 @@
+package skyd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+)
+
+// TestSkylinkKey ensures that newSkylinkKey decodes exactly the canonical
+// base64 skylinks and that the keys encode back to the original strings.
+func TestSkylinkKey(t *testing.T) {
+	t.Parallel()
+
+	// Random raw data, valid or not, round-trips.
+	for i := 0; i < 100; i++ {
+		raw := fastrand.Bytes(rawSkylinkSize)
+		s := base64.RawURLEncoding.EncodeToString(raw)
+		k, ok := newSkylinkKey(s)
+		if !ok {
+			t.Fatalf("Failed to decode '%s'", s)
+		}
+		if !bytes.Equal(k[:], raw) {
+			t.Fatalf("Expected %v, got %v", raw, k[:])
+		}
+		if k.String() != s {
+			t.Fatalf("Expected '%s', got '%s'", s, k.String())
+		}
+	}
+
+	var sl skymodules.Skylink
+	if err := sl.LoadString(randomSkylink()); err != nil {
+		t.Fatal(err)
+	}
+	canonical := sl.String()
+	// Flip one of the padding bits of the last character.
+	last := base64Values[canonical[len(canonical)-1]] | 1
+	nonCanonical := canonical[:len(canonical)-1] + string(base64Alphabet[last])
+	tests := []struct {
+		name    string
+		skylink string
+		ok      bool
+	}{
+		{"canonical", canonical, true},
+		{"base32", sl.Base32EncodedString(), false},
+		{"non-canonical", nonCanonical, false},
+		{"too short", canonical[:len(canonical)-1], false},
+		{"too long", canonical + "A", false},
+		{"invalid character", "+" + canonical[1:], false},
+		{"padded", canonical[:len(canonical)-2] + "==", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		k, ok := newSkylinkKey(tt.skylink)
+		if ok != tt.ok {
+			t.Fatalf("%s: expected %t, got %t", tt.name, tt.ok, ok)
+		}
+		if ok && k.String() != tt.skylink {
+			t.Fatalf("%s: expected '%s', got '%s'", tt.name, tt.skylink, k.String())
+		}
+	}
+}
+
+// TestSkylinkMapForms ensures that the skylink map returns skylinks in the
+// form in which they were set, including the forms it can't key by their raw
+// representation.
+func TestSkylinkMapForms(t *testing.T) {
+	t.Parallel()
+
+	var sl skymodules.Skylink
+	if err := sl.LoadString(randomSkylink()); err != nil {
+		t.Fatal(err)
+	}
+	forms := []string{sl.String(), sl.Base32EncodedString(), "not a skylink"}
+
+	m := newSkylinkMap()
+	for _, s := range forms {
+		m.set(s, cacheEntry{})
+	}
+	if n := m.len(); n != len(forms) {
+		t.Fatalf("Expected %d skylinks, got %d", len(forms), n)
+	}
+	for _, s := range forms {
+		if _, exists := m.get(s); !exists {
+			t.Fatalf("Expected the map to contain '%s'", s)
+		}
+	}
+	found := make(map[string]struct{})
+	m.each(func(s string, _ cacheEntry) {
+		found[s] = struct{}{}
+	})
+	unmarked := m.unmark()
+	for _, s := range forms {
+		if _, ok := found[s]; !ok {
+			t.Fatalf("Expected '%s' among the skylinks, got %v", s, found)
+		}
+	}
+	if len(unmarked) != len(forms) {
+		t.Fatalf("Expected all skylinks to be unmarked, got %v", unmarked)
+	}
+	for _, s := range forms {
+		m.delete(s)
+	}
+	if n := m.len(); n != 0 {
+		t.Fatalf("Expected an empty map, got %d skylinks", n)
+	}
+}
+
+// BenchmarkCacheSkylinks compares the memory usage and the lookup performance
+// of the cache's skylink map with the map of strings it used before. The old
+// entries held their own lists of directories. It reports the heap memory per
+// skylink as bytes/skylink.
+func BenchmarkCacheSkylinks(b *testing.B) {
+	const n = 1000000
+	const skylinksPerDir = 100
+	sls := make([]string, n)
+	for i := range sls {
+		sls[i] = randomSkylink()
+	}
+	// dir returns the directory of the i-th skylink.
+	dir := func(i int) skymodules.SiaPath {
+		return skymodules.SiaPath{Path: fmt.Sprintf("var/skynet/%d", i/skylinksPerDir)}
+	}
+	// heapInUse returns the memory in use on the heap after a GC.
+	heapInUse := func() int64 {
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		return int64(ms.HeapInuse)
+	}
+
+	b.Run("string", func(b *testing.B) {
+		type stringEntry struct {
+			seen bool
+			dirs []skymodules.SiaPath
+		}
+		before := heapInUse()
+		m := make(map[string]stringEntry)
+		var d skymodules.SiaPath
+		for i, sl := range sls {
+			if i%skylinksPerDir == 0 {
+				d = dir(i)
+			}
+			// Clone the skylink, like reading it from a response would.
+			m[strings.Clone(sl)] = stringEntry{dirs: []skymodules.SiaPath{d}}
+		}
+		perSkylink := float64(heapInUse()-before) / n
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, exists := m[sls[i%n]]; !exists {
+				b.Fatalf("missing skylink %d", i%n)
+			}
+		}
+		b.StopTimer()
+		// Report the memory after the timer reset, which drops metrics.
+		b.ReportMetric(perSkylink, "bytes/skylink")
+		runtime.KeepAlive(m)
+	})
+	b.Run("raw", func(b *testing.B) {
+		before := heapInUse()
+		m := newSkylinkMap()
+		var dirOnly *[]skymodules.SiaPath
+		for i, sl := range sls {
+			if i%skylinksPerDir == 0 {
+				dirOnly = &[]skymodules.SiaPath{dir(i)}
+			}
+			m.set(strings.Clone(sl), cacheEntry{dirs: dirOnly})
+		}
+		perSkylink := float64(heapInUse()-before) / n
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, exists := m.get(sls[i%n]); !exists {
+				b.Fatalf("missing skylink %d", i%n)
+			}
+		}
+		b.StopTimer()
+		b.ReportMetric(perSkylink, "bytes/skylink")
+		runtime.KeepAlive(m)
+	})
+}
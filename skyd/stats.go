@@ -0,0 +1,106 @@
+package skyd
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// latencyBuckets are the upper bounds of the buckets of the latency
+	// histograms in CallStats. Calls which take longer than the last bound
+	// fall into an extra, unbounded bucket.
+	latencyBuckets = []time.Duration{
+		10 * time.Millisecond,
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		500 * time.Millisecond,
+		time.Second,
+		5 * time.Second,
+		30 * time.Second,
+	}
+)
+
+type (
+	// CallStats describes the calls made to a single client method.
+	CallStats struct {
+		// Calls is the number of calls which returned.
+		Calls int64 `json:"calls"`
+		// Errors is the number of calls which failed. Batch calls count as
+		// failed if any of their items failed.
+		Errors int64 `json:"errors"`
+		// TotalLatency is the total time the calls took. Together with Calls
+		// it gives us the average latency.
+		TotalLatency time.Duration `json:"totalLatency"`
+		// MaxLatency is the longest time a single call took.
+		MaxLatency time.Duration `json:"maxLatency"`
+		// Latency is the histogram of the calls' latencies.
+		Latency []LatencyBucket `json:"latency"`
+	}
+	// LatencyBucket counts the calls which took longer than the previous
+	// bucket's UpTo and at most UpTo.
+	LatencyBucket struct {
+		// UpTo is the upper bound of the bucket. It's zero for the last
+		// bucket, which has no upper bound.
+		UpTo  time.Duration `json:"upTo"`
+		Count int64         `json:"count"`
+	}
+
+	// callStats records the CallStats of each client method.
+	callStats struct {
+		stats map[string]*CallStats
+		mu    sync.Mutex
+	}
+)
+
+// newCallStats returns an empty callStats.
+func newCallStats() *callStats {
+	return &callStats{
+		stats: make(map[string]*CallStats),
+	}
+}
+
+// managedRecord records a call to the given method which started at the given
+// time and failed with the error err points to, if any. It takes a pointer, so
+// methods can record themselves with a single deferred call.
+func (cs *callStats) managedRecord(method string, start time.Time, err *error) {
+	latency := time.Since(start)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	s, exists := cs.stats[method]
+	if !exists {
+		s = &CallStats{
+			Latency: make([]LatencyBucket, len(latencyBuckets)+1),
+		}
+		for i, upTo := range latencyBuckets {
+			s.Latency[i].UpTo = upTo
+		}
+		cs.stats[method] = s
+	}
+	s.Calls++
+	if err != nil && *err != nil {
+		s.Errors++
+	}
+	s.TotalLatency += latency
+	if latency > s.MaxLatency {
+		s.MaxLatency = latency
+	}
+	i := 0
+	for i < len(latencyBuckets) && latency > latencyBuckets[i] {
+		i++
+	}
+	s.Latency[i].Count++
+}
+
+// managedStats returns a copy of the stats of all methods which have been
+// called so far, keyed by the method's name.
+func (cs *callStats) managedStats() map[string]CallStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	stats := make(map[string]CallStats, len(cs.stats))
+	for method, s := range cs.stats {
+		cp := *s
+		cp.Latency = append([]LatencyBucket{}, s.Latency...)
+		stats[method] = cp
+	}
+	return stats
+}
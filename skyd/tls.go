@@ -0,0 +1,96 @@
+package skyd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// SchemeHTTP and SchemeHTTPS are the schemes over which the client can
+	// talk to skyd.
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+)
+
+var (
+	// staticHTTPSRouter routes the requests to the skyd instances we talk to
+	// over HTTPS. It's installed as http.DefaultTransport by the first client
+	// which uses HTTPS.
+	staticHTTPSRouter     *httpsRouter
+	staticHTTPSRouterOnce sync.Once
+)
+
+type (
+	// httpsRouter is an http.RoundTripper which upgrades the plain HTTP
+	// requests to the registered addresses to HTTPS and sends them with the
+	// TLS config registered for them. It sends all other requests through
+	// the transport it replaced.
+	//
+	// We need it because the skyd client always builds http:// URLs and sends
+	// its requests through http.DefaultTransport, so we can't give it an
+	// http.Client of our own.
+	httpsRouter struct {
+		staticFallback http.RoundTripper
+		transports     map[string]*http.Transport
+		mu             sync.RWMutex
+	}
+)
+
+// RoundTrip implements http.RoundTripper.
+func (r *httpsRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.RLock()
+	t, exists := r.transports[req.URL.Host]
+	r.mu.RUnlock()
+	if !exists || req.URL.Scheme != SchemeHTTP {
+		return r.staticFallback.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the request it's given.
+	req = req.Clone(req.Context())
+	req.URL.Scheme = SchemeHTTPS
+	return t.RoundTrip(req)
+}
+
+// registerHTTPS makes all requests to the given address go over HTTPS. If
+// caCert is not empty, it's the path to a PEM file holding the only CA
+// certificates we trust for that address. Otherwise we trust the system's CAs.
+// Registering the same address again replaces its TLS config.
+func registerHTTPS(address, caCert string) error {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return errors.AddContext(err, fmt.Sprintf("failed to read the CA certificates in '%s'", caCert))
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no valid CA certificates found in '%s'", caCert)
+		}
+	}
+	staticHTTPSRouterOnce.Do(func() {
+		staticHTTPSRouter = &httpsRouter{
+			staticFallback: http.DefaultTransport,
+			transports:     make(map[string]*http.Transport),
+		}
+		http.DefaultTransport = staticHTTPSRouter
+	})
+	var t *http.Transport
+	if dt, ok := staticHTTPSRouter.staticFallback.(*http.Transport); ok {
+		t = dt.Clone()
+	} else {
+		t = &http.Transport{}
+	}
+	t.TLSClientConfig = conf
+	staticHTTPSRouter.mu.Lock()
+	defer staticHTTPSRouter.mu.Unlock()
+	if old, exists := staticHTTPSRouter.transports[address]; exists {
+		old.CloseIdleConnections()
+	}
+	staticHTTPSRouter.transports[address] = t
+	return nil
+}
@@ -0,0 +1,152 @@
+package skyd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestCA generates a self-signed CA and a certificate it signs for
+// 127.0.0.1. It returns the PEM-encoded CA certificate and the server's
+// certificate.
+func newTestCA(t *testing.T) ([]byte, tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pinner test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "skyd"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	srvDER, err := x509.CreateCertificate(rand.Reader, srvTemplate, ca, &srvKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return caPEM, tls.Certificate{Certificate: [][]byte{srvDER}, PrivateKey: srvKey}
+}
+
+// TestClientHTTPS ensures that the client can talk to skyd over HTTPS when it
+// trusts skyd's CA and that it fails to when it doesn't.
+//
+// It doesn't run in parallel because the first HTTPS client replaces
+// http.DefaultTransport, which other tests might be using.
+func TestClientHTTPS(t *testing.T) {
+	caPEM, srvCert := newTestCA(t)
+	sl := randomSkylink()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/skynet/resolve/") {
+			_, _ = w.Write([]byte(`{"skylink":"` + sl + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{srvCert}}
+	// Don't log the handshakes we expect to fail.
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err = os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	newClient := func(scheme, caCert string) (Client, error) {
+		return NewClient(host, port, "password", NewCache(), logger, WithScheme(scheme, caCert), WithTimeout(time.Second))
+	}
+
+	// Trust the CA and expect to reach skyd.
+	c, err := newClient(SchemeHTTPS, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := c.Resolve(context.Background(), randomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved != sl {
+		t.Fatalf("Expected '%s', got '%s'", sl, resolved)
+	}
+
+	// Trust only the system's CAs and expect the TLS handshake to fail.
+	c, err = newClient(SchemeHTTPS, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Resolve(context.Background(), randomSkylink())
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("Expected a certificate error, got '%v'", err)
+	}
+
+	// Expect clear errors for invalid settings.
+	notPEM := filepath.Join(dir, "not.pem")
+	if err = os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := []struct {
+		scheme string
+		caCert string
+		errMsg string
+	}{
+		{scheme: SchemeHTTPS, caCert: filepath.Join(dir, "missing.pem"), errMsg: "failed to read the CA certificates"},
+		{scheme: SchemeHTTPS, caCert: notPEM, errMsg: "no valid CA certificates"},
+		{scheme: SchemeHTTP, caCert: caFile, errMsg: "only be used over HTTPS"},
+		{scheme: "ftp", errMsg: "unsupported scheme"},
+	}
+	for _, tst := range invalid {
+		_, err = newClient(tst.scheme, tst.caCert)
+		if err == nil || !strings.Contains(err.Error(), tst.errMsg) {
+			t.Fatalf("Expected error '%s', got '%v'", tst.errMsg, err)
+		}
+	}
+}
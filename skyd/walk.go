@@ -0,0 +1,173 @@
+package skyd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+)
+
+type (
+	// walk is a walk of skyd's filesystem, performed by a pool of workers.
+	// The workers pull directories from a shared queue and push the
+	// subdirectories they discover back to it.
+	walk struct {
+		// queue holds the directories waiting to be walked and inFlight is
+		// the number of directories being walked right now. The walk is over
+		// when both are empty.
+		queue    []skymodules.SiaPath
+		inFlight int
+		stopped  bool
+		// queued holds all directories we ever queued, so we never walk a
+		// directory twice, even if skyd lists it more than once.
+		queued map[skymodules.SiaPath]struct{}
+
+		// numDirs is the number of directories we walked, including the
+		// ones we failed to fetch.
+		numDirs  int
+		firstErr error
+		skipped  map[skymodules.SiaPath]error
+		sls      skylinkMap
+		walked   map[skymodules.SiaPath]struct{}
+		// invalid is the number of invalid skylinks we found and dropped.
+		invalid int
+
+		staticClient   Client
+		staticProgress func(walked, discovered int)
+		cond           *sync.Cond
+		mu             sync.Mutex
+	}
+)
+
+// walkFilesystem walks the filesystem under root with the given number of
+// workers and collects the skylinks of all files it finds, normalized. It drops
+// and counts the invalid ones, which skyd reports e.g. for files with corrupt
+// metadata. It tolerates
+// failures to fetch directories, those are recorded in the walk's skipped
+// directories. The walk stops early with ErrRebuildAborted when the context
+// is done. It checks the context between directory fetches and it interrupts
+// the fetches in progress.
+func walkFilesystem(ctx context.Context, skydClient Client, root skymodules.SiaPath, numWorkers int, progress func(walked, discovered int)) (*walk, error) {
+	w := &walk{
+		queue:          []skymodules.SiaPath{root},
+		queued:         map[skymodules.SiaPath]struct{}{root: {}},
+		skipped:        make(map[skymodules.SiaPath]error),
+		sls:            newSkylinkMap(),
+		walked:         make(map[skymodules.SiaPath]struct{}),
+		staticClient:   skydClient,
+		staticProgress: progress,
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	// Wake up the workers when we need to stop.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.mu.Lock()
+			w.stopped = true
+			w.cond.Broadcast()
+			w.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.threadedWork(ctx)
+		}()
+	}
+	wg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return nil, errors.Compose(ErrRebuildAborted, ctx.Err())
+	}
+	return w, nil
+}
+
+// threadedWork walks directories from the queue until the walk is over or
+// stopped.
+func (w *walk) threadedWork(ctx context.Context) {
+	for {
+		w.mu.Lock()
+		// Wait for work. If the queue is empty but other workers are still
+		// walking, they might discover more directories.
+		for len(w.queue) == 0 && w.inFlight > 0 && !w.stopped {
+			w.cond.Wait()
+		}
+		if w.stopped || len(w.queue) == 0 {
+			w.mu.Unlock()
+			return
+		}
+		dir := w.queue[0]
+		w.queue = w.queue[1:]
+		w.inFlight++
+		w.mu.Unlock()
+
+		rd, err := w.staticClient.RenterDirRootGet(ctx, dir)
+
+		w.mu.Lock()
+		w.inFlight--
+		w.numDirs++
+		if err != nil {
+			// Record the error and continue walking the rest of the
+			// directories.
+			w.skipped[dir] = err
+			if w.firstErr == nil {
+				w.firstErr = errors.AddContext(err, fmt.Sprintf("failed to fetch skynet directory '%s' from skyd", dir))
+			}
+		} else {
+			w.walked[dir] = struct{}{}
+			// All skylinks found only in this directory share its list.
+			dirOnly := &[]skymodules.SiaPath{dir}
+			for _, f := range rd.Files {
+				for _, sl := range f.Skylinks {
+					sl, ok := normalizeSkylink(sl)
+					if !ok {
+						w.invalid++
+						continue
+					}
+					e, _ := w.sls.get(sl)
+					dirs := e.dirList()
+					// All files of a directory are recorded at once, so we
+					// only need to check the last directory.
+					switch {
+					case len(dirs) == 0:
+						e.dirs = dirOnly
+					case !dirs[len(dirs)-1].Equals(dir):
+						// Copy the list, it might be shared.
+						dirs = append(dirs[:len(dirs):len(dirs)], dir)
+						e.dirs = &dirs
+					default:
+						continue
+					}
+					w.sls.set(sl, e)
+				}
+			}
+			// Grab all subdirs and queue them for walking. The listing
+			// includes the current directory, usually but not necessarily
+			// as its first element, so we skip all directories we've
+			// already queued.
+			for _, d := range rd.Directories {
+				if _, exists := w.queued[d.SiaPath]; exists {
+					continue
+				}
+				w.queued[d.SiaPath] = struct{}{}
+				w.queue = append(w.queue, d.SiaPath)
+			}
+		}
+		w.staticProgress(w.numDirs, w.numDirs+w.inFlight+len(w.queue))
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+}
@@ -0,0 +1,51 @@
+package sweeper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/skynetlabs/pinner/logger"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// alertTimeout is the maximum time we wait for a webhook to accept an
+	// alert.
+	alertTimeout = 10 * time.Second
+)
+
+type (
+	// AlertFn notifies the operator about a problem which needs their
+	// attention.
+	AlertFn func(msg string)
+
+	// webhookAlert is the body of the request we send to an alert webhook.
+	webhookAlert struct {
+		Message string `json:"message"`
+	}
+)
+
+// NewWebhookAlert returns an AlertFn which POSTs the alerts as JSON to the
+// given URL. Failures to deliver an alert are logged.
+func NewWebhookAlert(url string, logger logger.ExtFieldLogger) AlertFn {
+	client := &http.Client{Timeout: alertTimeout}
+	return func(msg string) {
+		body, err := json.Marshal(webhookAlert{Message: msg})
+		if err != nil {
+			logger.Warn(errors.AddContext(err, "failed to marshal alert"))
+			return
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logger.Warn(errors.AddContext(err, "failed to send alert"))
+			return
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			logger.Warn(fmt.Sprintf("alert webhook responded with status %d", resp.StatusCode))
+		}
+	}
+}
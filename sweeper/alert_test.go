@@ -0,0 +1,35 @@
+package sweeper
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestWebhookAlert ensures that the webhook alert POSTs the message to the
+// given URL.
+func TestWebhookAlert(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan webhookAlert, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert webhookAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Error(err)
+		}
+		received <- alert
+	}))
+	defer srv.Close()
+
+	msg := "something is wrong"
+	NewWebhookAlert(srv.URL, newDiscardLogger())(msg)
+	select {
+	case alert := <-received:
+		if alert.Message != msg {
+			t.Fatalf("Expected message '%s', got '%s'", msg, alert.Message)
+		}
+	default:
+		t.Fatal("Expected the webhook to receive the alert.")
+	}
+}
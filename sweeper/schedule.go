@@ -0,0 +1,131 @@
+package sweeper
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/skynetlabs/pinner/conf"
+)
+
+type (
+	// schedule defines how often, if at all, we sweep this server
+	// automatically.
+	schedule struct {
+		// anchor is the time of day, as an offset from midnight UTC, at which
+		// the first scheduled sweep will happen. Anchor is only taken into
+		// account when anchored is true.
+		anchor   time.Duration
+		anchored bool
+		// period is the time between two consecutive scheduled sweeps.
+		period time.Duration
+		// cancel cancels the running schedule, if any.
+		cancel context.CancelFunc
+		// wg tracks the goroutine running the current schedule.
+		wg sync.WaitGroup
+		mu sync.Mutex
+	}
+)
+
+// Update schedules a new series of sweeps to be run, using the given Sweeper.
+// If there are already sweeps scheduled, that schedule is cancelled (running
+// sweeps are not interrupted) and a new schedule is established. Update waits
+// for the goroutine of the old schedule to exit, so there is never more than
+// one schedule running, even when Update is called concurrently.
+//
+// If anchor is not empty, the first sweep of the new schedule happens at the
+// next occurrence of that time of day (UTC) and every period after that.
+// Otherwise, the first sweep happens one period from now.
+func (s *schedule) Update(period time.Duration, anchor string, sweeper *Sweeper) error {
+	var anchorOffset time.Duration
+	var err error
+	if anchor != "" {
+		anchorOffset, err = conf.ParseTimeOfDay(anchor)
+		if err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop()
+	s.period = period
+	s.anchor = anchorOffset
+	s.anchored = anchor != ""
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	s.wg.Add(1)
+	go s.threadedRun(ctx, s.nextSweepTime(time.Now()), period, sweeper)
+	return nil
+}
+
+// Close cancels the current schedule, if any, and waits for its goroutine to
+// exit.
+func (s *schedule) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop()
+}
+
+// stop cancels the current schedule, if any, and waits for its goroutine to
+// exit.
+//
+// Note that this method assumes that the caller holds the schedule's lock.
+func (s *schedule) stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	s.cancel = nil
+	s.wg.Wait()
+}
+
+// threadedRun waits until the first sweep time and then kicks off a sweep
+// every period until the given context is cancelled.
+func (s *schedule) threadedRun(ctx context.Context, first time.Time, period time.Duration, sweeper *Sweeper) {
+	defer s.wg.Done()
+	timer := time.NewTimer(time.Until(first))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+		sweeper.Sweep()
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sweeper.Sweep()
+		}
+	}
+}
+
+// nextSweepTime returns the time at which the first sweep of the schedule
+// should happen, relative to the given moment.
+//
+// Note that this method assumes that the caller holds the schedule's lock.
+func (s *schedule) nextSweepTime(now time.Time) time.Time {
+	if !s.anchored {
+		return now.Add(s.period)
+	}
+	return nextTimeOfDay(now, s.anchor)
+}
+
+// nextTimeOfDay returns the first moment after now which falls on the given
+// time of day in UTC. The time of day is given as an offset from midnight.
+//
+// We work in UTC because it doesn't observe DST, so every day is exactly 24
+// hours long and the schedule doesn't drift during the year.
+func nextTimeOfDay(now time.Time, timeOfDay time.Duration) time.Time {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	next := midnight.Add(timeOfDay)
+	if !next.After(now) {
+		next = next.Add(24 * time.Hour)
+	}
+	return next
+}
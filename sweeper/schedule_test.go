@@ -0,0 +1,136 @@
+package sweeper
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/SkynetLabs/skyd/build"
+)
+
+// TestNextTimeOfDay ensures that nextTimeOfDay returns the next occurrence of
+// the given time of day, including across midnight and for times given in
+// non-UTC locations.
+func TestNextTimeOfDay(t *testing.T) {
+	t.Parallel()
+
+	// A location with a positive offset from UTC. We use a fixed zone because
+	// we don't want the test to depend on the tz database of the host.
+	cet := time.FixedZone("CET", 3600)
+	anchor := 3*time.Hour + 30*time.Minute
+
+	tests := map[string]struct {
+		now      time.Time
+		expected time.Time
+	}{
+		"later today": {
+			now:      time.Date(2022, 6, 10, 1, 0, 0, 0, time.UTC),
+			expected: time.Date(2022, 6, 10, 3, 30, 0, 0, time.UTC),
+		},
+		"exactly now": {
+			now:      time.Date(2022, 6, 10, 3, 30, 0, 0, time.UTC),
+			expected: time.Date(2022, 6, 11, 3, 30, 0, 0, time.UTC),
+		},
+		"tomorrow": {
+			now:      time.Date(2022, 6, 10, 12, 0, 0, 0, time.UTC),
+			expected: time.Date(2022, 6, 11, 3, 30, 0, 0, time.UTC),
+		},
+		"just before midnight": {
+			now:      time.Date(2022, 6, 10, 23, 59, 59, 0, time.UTC),
+			expected: time.Date(2022, 6, 11, 3, 30, 0, 0, time.UTC),
+		},
+		"across month and year": {
+			now:      time.Date(2022, 12, 31, 22, 0, 0, 0, time.UTC),
+			expected: time.Date(2023, 1, 1, 3, 30, 0, 0, time.UTC),
+		},
+		// 04:00 CET is 03:00 UTC, so the next anchor is the same UTC day.
+		"non-UTC input same day": {
+			now:      time.Date(2022, 6, 10, 4, 0, 0, 0, cet),
+			expected: time.Date(2022, 6, 10, 3, 30, 0, 0, time.UTC),
+		},
+		// 00:30 CET on the 11th is 23:30 UTC on the 10th.
+		"non-UTC input across midnight": {
+			now:      time.Date(2022, 6, 11, 0, 30, 0, 0, cet),
+			expected: time.Date(2022, 6, 11, 3, 30, 0, 0, time.UTC),
+		},
+	}
+	for name, tt := range tests {
+		next := nextTimeOfDay(tt.now, anchor)
+		if !next.Equal(tt.expected) {
+			t.Fatalf("%s: expected %v, got %v", name, tt.expected, next)
+		}
+		if next.Location() != time.UTC {
+			t.Fatalf("%s: expected a UTC time, got %v", name, next.Location())
+		}
+	}
+}
+
+// TestScheduleNextSweepTime ensures that the first sweep of a schedule happens
+// either one period from now or on the next anchor, if one is set.
+func TestScheduleNextSweepTime(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2022, 6, 10, 12, 0, 0, 0, time.UTC)
+	s := &schedule{period: time.Hour}
+	if next := s.nextSweepTime(now); !next.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected %v, got %v", now.Add(time.Hour), next)
+	}
+	s.anchor = 3 * time.Hour
+	s.anchored = true
+	expected := time.Date(2022, 6, 11, 3, 0, 0, 0, time.UTC)
+	if next := s.nextSweepTime(now); !next.Equal(expected) {
+		t.Fatalf("Expected %v, got %v", expected, next)
+	}
+}
+
+// TestScheduleUpdateRepeatedly ensures that updating the schedule repeatedly,
+// including concurrently, leaves a single schedule goroutine running.
+func TestScheduleUpdateRepeatedly(t *testing.T) {
+	// This test counts goroutines, so we don't want it to run in parallel with
+	// other tests.
+	s := &schedule{}
+	// The period is long enough for no sweeps to be triggered during the
+	// test, so we don't need a functional sweeper.
+	sweeper := &Sweeper{}
+	baseline := runtime.NumGoroutine()
+
+	// Update the schedule in a tight loop from a few goroutines.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := s.Update(time.Hour, "", sweeper); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Expect a single schedule goroutine on top of the baseline. The helper
+	// goroutines and the cancelled schedules might need a moment to exit.
+	err := build.Retry(100, 10*time.Millisecond, func() error {
+		if n := runtime.NumGoroutine(); n != baseline+1 {
+			return fmt.Errorf("expected %d goroutines, got %d", baseline+1, n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stop the schedule and expect the goroutine to be gone.
+	s.Close()
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		if n := runtime.NumGoroutine(); n != baseline {
+			return fmt.Errorf("expected %d goroutines, got %d", baseline, n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
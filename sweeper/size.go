@@ -0,0 +1,108 @@
+package sweeper
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/skyd"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// metadataConcurrency is the maximum number of concurrent metadata
+	// requests we send to skyd while looking up the sizes of skylinks.
+	metadataConcurrency = 10
+)
+
+// staticSkylinksSize returns the total size of the given skylinks in bytes
+// and the number of skylinks whose size we couldn't determine. It uses the
+// sizes stored in the database and falls back to skyd's metadata for the rest.
+// The sizes we fetch from skyd get stored in the database, so we don't need to
+// fetch them again. Failures don't fail the sweep, the affected skylinks are
+// counted as being of unknown size.
+func (s *Sweeper) staticSkylinksSize(ctx context.Context, skylinks []string) (total uint64, numUnknown int) {
+	if len(skylinks) == 0 {
+		return 0, 0
+	}
+	dbCtx, cancel := context.WithTimeout(ctx, database.MongoDefaultTimeout)
+	sizes, err := s.staticDB.SkylinkSizes(dbCtx, skylinks)
+	cancel()
+	if err != nil {
+		s.staticLogger.Warn(errors.AddContext(err, "failed to fetch the stored skylink sizes"))
+		sizes = make(map[string]uint64)
+	}
+	var toFetch []string
+	for _, sl := range skylinks {
+		if _, exists := sizes[sl]; !exists {
+			toFetch = append(toFetch, sl)
+		}
+	}
+	// The skyd client applies its own timeout to each call, so the fan-out
+	// only shares the sweep's context. The database calls get a timeout each,
+	// so a slow skyd doesn't leave the last one without any time.
+	fetched := fetchSkylinkSizes(ctx, s.staticSkydClient, toFetch)
+	if len(fetched) > 0 {
+		dbCtx, cancel := context.WithTimeout(ctx, database.MongoDefaultTimeout)
+		err = s.staticDB.SetSkylinkSizes(dbCtx, fetched)
+		cancel()
+		if err != nil {
+			s.staticLogger.Warn(errors.AddContext(err, "failed to store skylink sizes"))
+		}
+	}
+	if n := len(toFetch) - len(fetched); n > 0 {
+		s.staticLogger.Debugf("Failed to fetch the size of %d skylinks", n)
+	}
+	for _, size := range sizes {
+		total += size
+	}
+	for _, size := range fetched {
+		total += size
+	}
+	return total, len(toFetch) - len(fetched)
+}
+
+// fetchSkylinkSizes fetches the sizes of the given skylinks from skyd's
+// metadata, sending at most metadataConcurrency requests at a time. Skylinks
+// whose metadata we fail to fetch, including the ones we don't get to before
+// the context is done, are not included in the result.
+func fetchSkylinkSizes(ctx context.Context, skydc skyd.Client, skylinks []string) map[string]uint64 {
+	sizes := make(map[string]uint64, len(skylinks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, metadataConcurrency)
+	for _, sl := range skylinks {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return sizes
+		}
+		wg.Add(1)
+		go func(sl string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			meta, err := skydc.Metadata(ctx, sl)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			sizes[sl] = meta.Length
+			mu.Unlock()
+		}(sl)
+	}
+	wg.Wait()
+	return sizes
+}
+
+// bytesSummary returns a human-readable summary of a total size, e.g. for
+// logging.
+func bytesSummary(total uint64, numUnknown int) string {
+	if numUnknown == 0 {
+		return fmt.Sprintf("%d bytes", total)
+	}
+	return fmt.Sprintf("%d bytes (+%d skylinks of unknown size)", total, numUnknown)
+}
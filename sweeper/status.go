@@ -0,0 +1,349 @@
+package sweeper
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+)
+
+const (
+	// maxSkylinksSample is the maximum number of skylinks we keep in each
+	// of the samples in the sweep status.
+	maxSkylinksSample = 10
+
+	// PhaseRebuildingCache is the phase in which the sweep walks skyd's
+	// filesystem and rebuilds its cache of pinned skylinks.
+	PhaseRebuildingCache = "rebuilding cache"
+	// PhaseUpdatingDatabase is the phase in which the sweep reconciles the
+	// database with the skylinks pinned by skyd.
+	PhaseUpdatingDatabase = "updating database"
+	// PhaseDone means that the sweep is over.
+	PhaseDone = "done"
+
+	// cacheProgressWeight is the share of the overall progress of a sweep
+	// which we attribute to rebuilding the cache. The rest belongs to the
+	// database updates.
+	cacheProgressWeight = 50
+)
+
+type (
+	// Status represents the status of a sweep.
+	Status struct {
+		InProgress bool
+		// Queued tells us whether there is another sweep queued to start
+		// once the current one finishes.
+		Queued bool
+		// Forced tells us whether the sweep bypasses the safety check which
+		// prevents it from removing too many skylinks. See
+		// ErrTooManyRemovals.
+		Forced bool
+		// Path is the root of the subtree of skyd's filesystem the sweep is
+		// limited to. It's empty for sweeps of the entire filesystem.
+		Path skymodules.SiaPath
+		// Phase describes what the sweep is currently doing.
+		Phase string
+		// Progress is a coarse estimate of the overall progress of the
+		// sweep, as a percentage between 0 and 100.
+		Progress int
+		// Error holds the error of the sweep. It isn't serialised because
+		// errors don't marshal to JSON, ErrorMessage is used instead.
+		Error error `json:"-"`
+		// ErrorMessage holds the message of Error, so the error can be
+		// reported over the API.
+		ErrorMessage string
+		StartTime    time.Time
+		EndTime      time.Time
+		// NumInvalidSkylinks is the number of invalid skylinks reported by
+		// skyd during the sweep. These are not added to the database.
+		NumInvalidSkylinks int
+		// InvalidSkylinksSample holds up to maxSkylinksSample of the
+		// invalid skylinks reported by skyd, so an operator can investigate.
+		InvalidSkylinksSample []string
+		// NumUnpinnedSkylinks is the number of skylinks pinned by skyd
+		// which the database marks as unpinned. The sweep doesn't add this
+		// server to their list of pinners.
+		NumUnpinnedSkylinks int
+		// UnpinnedSkylinksSample holds up to maxSkylinksSample of the
+		// skylinks pinned by skyd which the database marks as unpinned.
+		UnpinnedSkylinksSample []string
+		// NumUnpinnedFromSkyd is the number of skylinks marked as unpinned
+		// in the database which the sweep unpinned from skyd.
+		NumUnpinnedFromSkyd int
+		// BytesAdded is the total size of the skylinks the sweep added the
+		// server to. NumUnknownSizeAdded is the number of those skylinks
+		// whose size we couldn't determine, they're not part of the total.
+		BytesAdded          uint64
+		NumUnknownSizeAdded int
+		// BytesRemoved is the total size of the skylinks the sweep removed
+		// the server from. NumUnknownSizeRemoved is the number of those
+		// skylinks whose size we couldn't determine, they're not part of the
+		// total.
+		BytesRemoved          uint64
+		NumUnknownSizeRemoved int
+		// DirsWalked is the number of skyd directories the cache rebuild has
+		// walked so far.
+		DirsWalked int
+		// DirsDiscovered is the number of skyd directories the cache rebuild
+		// has discovered so far. This number grows during the rebuild.
+		DirsDiscovered int
+		// BatchesTotal is the number of database batches the sweep needs to
+		// process in order to update the database.
+		BatchesTotal int
+		// BatchesDone is the number of database batches the sweep has already
+		// processed.
+		BatchesDone int
+		// NumExpiredLocksCleared is the number of expired skylink locks the
+		// sweep cleared.
+		NumExpiredLocksCleared int64
+		// NumUnpinnedDeleted is the number of long-unpinned skylinks the
+		// sweep soft-deleted from the database.
+		NumUnpinnedDeleted int64
+		// NumDeletedPurged is the number of long-deleted skylinks the sweep
+		// removed from the database for good.
+		NumDeletedPurged int64
+		// SkippedDirs lists the skyd directories the sweep failed to walk.
+		// When this is not empty, the sweep only added skylinks to the
+		// database and skipped removing the ones it didn't find.
+		SkippedDirs []string
+		// LastCompleted is the status of the last sweep which finished,
+		// e.g. of the one before a queued sweep which is now in progress.
+		// It's nil until the first sweep finishes.
+		LastCompleted *Status `json:",omitempty"`
+	}
+	// status is the internal, thread-safe, representation of the status of the
+	// latest sweep.
+	status struct {
+		status Status
+		// lastCompleted is the status of the last sweep which finished.
+		lastCompleted *Status
+		// queuedForced tells us whether the queued sweep, if any, is forced.
+		queuedForced bool
+		// queuedPath is the subtree the queued sweep, if any, is limited to.
+		queuedPath skymodules.SiaPath
+		mu         sync.Mutex
+	}
+)
+
+// StartOrQueue marks the start of a new sweep, unless one is already running.
+// If there is a sweep in progress, it queues a follow-up sweep, which will start
+// once the current one finishes. Multiple requests for a follow-up sweep are
+// coalesced into one, which is forced if any of the requests was. The
+// follow-up sweep is limited to a subtree only if all requests were limited to
+// the same one. It returns true if a new sweep was started.
+func (st *status) StartOrQueue(force bool, path skymodules.SiaPath) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.status.InProgress {
+		if !st.status.Queued {
+			st.queuedPath = path
+		} else if !st.queuedPath.Equals(path) {
+			st.queuedPath = skymodules.SiaPath{}
+		}
+		st.status.Queued = true
+		st.queuedForced = st.queuedForced || force
+		return false
+	}
+	st.start(force, path)
+	return true
+}
+
+// Status returns a copy of the status of the current sweep.
+func (st *status) Status() Status {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := st.status.copy()
+	s.Progress = st.progress()
+	if st.lastCompleted != nil {
+		lc := st.lastCompleted.copy()
+		s.LastCompleted = &lc
+	}
+	return s
+}
+
+// Finalize marks a sweep as completed with the given error and keeps its
+// status as the last completed one. If there is a follow-up sweep queued,
+// Finalize marks it as started and returns true. In that case the caller is
+// responsible for running it.
+func (st *status) Finalize(err error) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.InProgress = false
+	st.status.Phase = PhaseDone
+	st.status.EndTime = time.Now().UTC()
+	st.status.Error = err
+	if err != nil {
+		st.status.ErrorMessage = err.Error()
+	}
+	lc := st.status.copy()
+	lc.Progress = st.progress()
+	lc.Queued = false
+	st.lastCompleted = &lc
+	if !st.status.Queued {
+		return false
+	}
+	st.start(st.queuedForced, st.queuedPath)
+	return true
+}
+
+// ReportInvalidSkylinks records the given invalid skylinks in the status of the
+// current sweep.
+func (st *status) ReportInvalidSkylinks(invalid []string) {
+	sample := invalid
+	if len(sample) > maxSkylinksSample {
+		sample = sample[:maxSkylinksSample]
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.NumInvalidSkylinks = len(invalid)
+	st.status.InvalidSkylinksSample = append([]string{}, sample...)
+}
+
+// ReportUnpinnedSkylinks records the given skylinks, which skyd pins but the
+// database marks as unpinned, in the status of the current sweep.
+func (st *status) ReportUnpinnedSkylinks(unpinned []string) {
+	sample := unpinned
+	if len(sample) > maxSkylinksSample {
+		sample = sample[:maxSkylinksSample]
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.NumUnpinnedSkylinks = len(unpinned)
+	st.status.UnpinnedSkylinksSample = append([]string{}, sample...)
+}
+
+// SetUnpinnedFromSkyd records the number of skylinks the current sweep
+// unpinned from skyd.
+func (st *status) SetUnpinnedFromSkyd(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.NumUnpinnedFromSkyd = n
+}
+
+// ReportSkippedDirs records the skyd directories the current sweep failed to
+// walk.
+func (st *status) ReportSkippedDirs(dirs []string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.SkippedDirs = append([]string{}, dirs...)
+}
+
+// copy returns a copy of the status which doesn't share its samples with the
+// original. It leaves out the last completed sweep.
+func (s Status) copy() Status {
+	c := s
+	c.InvalidSkylinksSample = append([]string{}, s.InvalidSkylinksSample...)
+	c.SkippedDirs = append([]string{}, s.SkippedDirs...)
+	c.UnpinnedSkylinksSample = append([]string{}, s.UnpinnedSkylinksSample...)
+	c.LastCompleted = nil
+	return c
+}
+
+// progress calculates the overall progress of the current sweep as a
+// percentage.
+//
+// Note that this method assumes that the caller holds the status' lock.
+func (st *status) progress() int {
+	s := st.status
+	switch s.Phase {
+	case PhaseRebuildingCache:
+		if s.DirsDiscovered == 0 {
+			return 0
+		}
+		return cacheProgressWeight * s.DirsWalked / s.DirsDiscovered
+	case PhaseUpdatingDatabase:
+		if s.BatchesTotal == 0 {
+			return cacheProgressWeight
+		}
+		return cacheProgressWeight + (100-cacheProgressWeight)*s.BatchesDone/s.BatchesTotal
+	case PhaseDone:
+		return 100
+	default:
+		return 0
+	}
+}
+
+// start initialises the status to "a sweep is running".
+//
+// Note that this method assumes that the caller holds the status' lock.
+func (st *status) start(force bool, path skymodules.SiaPath) {
+	st.queuedForced = false
+	st.queuedPath = skymodules.SiaPath{}
+	st.status = Status{
+		InProgress: true,
+		Queued:     false,
+		Forced:     force,
+		Path:       path,
+		Phase:      PhaseRebuildingCache,
+		Error:      nil,
+		StartTime:  time.Now().UTC(),
+		EndTime:    time.Time{},
+	}
+}
+
+// SetCacheProgress updates the progress of the cache rebuild of the current
+// sweep.
+func (st *status) SetCacheProgress(walked, discovered int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.DirsWalked = walked
+	st.status.DirsDiscovered = discovered
+}
+
+// ReportBytes records the total size of the skylinks the current sweep added
+// and removed, along with the number of skylinks of unknown size.
+func (st *status) ReportBytes(added uint64, unknownAdded int, removed uint64, unknownRemoved int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.BytesAdded = added
+	st.status.NumUnknownSizeAdded = unknownAdded
+	st.status.BytesRemoved = removed
+	st.status.NumUnknownSizeRemoved = unknownRemoved
+}
+
+// SetPhase updates the phase of the current sweep.
+func (st *status) SetPhase(phase string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.Phase = phase
+}
+
+// SetBatchesDone updates the number of database batches the current sweep has
+// processed.
+func (st *status) SetBatchesDone(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.BatchesDone = n
+}
+
+// SetBatchesTotal sets the number of database batches the current sweep needs
+// to process.
+func (st *status) SetBatchesTotal(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.BatchesTotal = n
+}
+
+// SetExpiredLocksCleared records the number of expired locks the current sweep
+// cleared.
+func (st *status) SetExpiredLocksCleared(n int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.NumExpiredLocksCleared = n
+}
+
+// SetUnpinnedDeleted records the number of long-unpinned skylinks the current
+// sweep soft-deleted.
+func (st *status) SetUnpinnedDeleted(n int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.NumUnpinnedDeleted = n
+}
+
+// SetDeletedPurged records the number of long-deleted skylinks the current
+// sweep removed for good.
+func (st *status) SetDeletedPurged(n int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status.NumDeletedPurged = n
+}
@@ -0,0 +1,117 @@
+package sweeper
+
+import (
+	"testing"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+)
+
+// TestStatusQueue ensures that status queues a single follow-up sweep when we
+// try to start a sweep while another is in progress.
+func TestStatusQueue(t *testing.T) {
+	t.Parallel()
+
+	st := &status{}
+	if !st.StartOrQueue(false, skymodules.SiaPath{}) {
+		t.Fatal("Expected a sweep to start.")
+	}
+	s := st.Status()
+	if !s.InProgress || s.Queued {
+		t.Fatalf("Unexpected status %+v", s)
+	}
+	// Request two more sweeps. Expect them to be coalesced into a single
+	// queued sweep.
+	if st.StartOrQueue(false, skymodules.SiaPath{}) || st.StartOrQueue(false, skymodules.SiaPath{}) {
+		t.Fatal("Expected the sweeps to be queued.")
+	}
+	if s = st.Status(); !s.InProgress || !s.Queued {
+		t.Fatalf("Unexpected status %+v", s)
+	}
+	// Finalize the current sweep. Expect the queued one to start and the
+	// finished one to be reported as the last completed one.
+	if !st.Finalize(errors.New("error")) {
+		t.Fatal("Expected the queued sweep to start.")
+	}
+	if s = st.Status(); !s.InProgress || s.Queued || s.Error != nil {
+		t.Fatalf("Unexpected status %+v", s)
+	}
+	lc := s.LastCompleted
+	if lc == nil || lc.InProgress || lc.Error == nil || lc.ErrorMessage != "error" || lc.EndTime.IsZero() || lc.Progress != 100 {
+		t.Fatalf("Unexpected last completed sweep %+v", lc)
+	}
+	// Finalize the follow-up sweep. Expect nothing else to start.
+	if st.Finalize(nil) {
+		t.Fatal("Expected no sweep to start.")
+	}
+	if s = st.Status(); s.InProgress || s.Queued || s.EndTime.IsZero() {
+		t.Fatalf("Unexpected status %+v", s)
+	}
+	if lc = s.LastCompleted; lc == nil || lc.Error != nil || !lc.EndTime.Equal(s.EndTime) {
+		t.Fatalf("Unexpected last completed sweep %+v", lc)
+	}
+}
+
+// TestStatusQueueSubtree ensures that a queued sweep is only limited to a
+// subtree if all requests for it were limited to the same subtree.
+func TestStatusQueueSubtree(t *testing.T) {
+	t.Parallel()
+
+	dirA := skymodules.SiaPath{Path: "var/skynet/a"}
+	dirB := skymodules.SiaPath{Path: "var/skynet/b"}
+	tests := map[string]struct {
+		requests []skymodules.SiaPath
+		expected skymodules.SiaPath
+	}{
+		"single":    {requests: []skymodules.SiaPath{dirA}, expected: dirA},
+		"same":      {requests: []skymodules.SiaPath{dirA, dirA}, expected: dirA},
+		"different": {requests: []skymodules.SiaPath{dirA, dirB}, expected: skymodules.SiaPath{}},
+		"full":      {requests: []skymodules.SiaPath{dirA, {}}, expected: skymodules.SiaPath{}},
+	}
+	for name, tt := range tests {
+		st := &status{}
+		st.StartOrQueue(false, dirB)
+		if s := st.Status(); !s.Path.Equals(dirB) {
+			t.Fatalf("%s: expected path '%s', got '%s'", name, dirB, s.Path)
+		}
+		for _, path := range tt.requests {
+			st.StartOrQueue(false, path)
+		}
+		if !st.Finalize(nil) {
+			t.Fatalf("%s: expected the queued sweep to start", name)
+		}
+		if s := st.Status(); !s.Path.Equals(tt.expected) {
+			t.Fatalf("%s: expected path '%s', got '%s'", name, tt.expected, s.Path)
+		}
+	}
+}
+
+// TestStatusProgress ensures that the progress of a sweep grows through its
+// phases.
+func TestStatusProgress(t *testing.T) {
+	t.Parallel()
+
+	st := &status{}
+	st.StartOrQueue(false, skymodules.SiaPath{})
+	if s := st.Status(); s.Phase != PhaseRebuildingCache || s.Progress != 0 {
+		t.Fatalf("Unexpected phase or progress: '%s' %d", s.Phase, s.Progress)
+	}
+	st.SetCacheProgress(1, 2)
+	if s := st.Status(); s.Progress != 25 {
+		t.Fatalf("Expected progress 25, got %d", s.Progress)
+	}
+	st.SetCacheProgress(4, 4)
+	if s := st.Status(); s.Progress != 50 {
+		t.Fatalf("Expected progress 50, got %d", s.Progress)
+	}
+	st.SetPhase(PhaseUpdatingDatabase)
+	st.SetBatchesTotal(4)
+	st.SetBatchesDone(3)
+	if s := st.Status(); s.Phase != PhaseUpdatingDatabase || s.Progress != 87 {
+		t.Fatalf("Unexpected phase or progress: '%s' %d", s.Phase, s.Progress)
+	}
+	st.Finalize(nil)
+	if s := st.Status(); s.Phase != PhaseDone || s.Progress != 100 {
+		t.Fatalf("Unexpected phase or progress: '%s' %d", s.Phase, s.Progress)
+	}
+}
@@ -0,0 +1,591 @@
+package sweeper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	pinnerbuild "github.com/skynetlabs/pinner/build"
+	"github.com/skynetlabs/pinner/conf"
+	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/logger"
+	"github.com/skynetlabs/pinner/skyd"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/threadgroup"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+)
+
+var (
+	// ErrSweeperClosed is returned when a sweep is interrupted because the
+	// sweeper is shutting down.
+	ErrSweeperClosed = errors.New("sweeper closed")
+	// ErrTooManyRemovals is returned when a sweep would remove the server
+	// from a larger fraction of its skylinks than the configured maximum.
+	// This usually means that skyd misreports its filesystem, so we don't
+	// remove anything and we alert the operator. A forced sweep bypasses this
+	// check.
+	ErrTooManyRemovals = errors.New("sweep would remove too many skylinks")
+	// ErrUnpinRefused is returned when the safety check before unpinning a
+	// skylink from skyd fails. Unpinning might remove the last copy of a
+	// skylink, so we only unpin when the database confirms that we should.
+	ErrUnpinRefused = errors.New("refusing to unpin skylink")
+
+	// SweepInterval determines how often we want to sweep the server when
+	// sweeps are scheduled.
+	SweepInterval = build.Select(build.Var{
+		Standard: 24 * time.Hour,
+		Dev:      10 * time.Minute,
+		Testing:  time.Second,
+	}).(time.Duration)
+
+	// progressUpdateInterval determines how often we update the progress of
+	// the cache rebuild in the sweep status.
+	progressUpdateInterval = build.Select(build.Var{
+		Standard: time.Second,
+		Dev:      time.Second,
+		Testing:  10 * time.Millisecond,
+	}).(time.Duration)
+)
+
+type (
+	// UnpinCheckFn checks whether it's safe to unpin the given skylink from
+	// skyd. It returns an error if it's not.
+	UnpinCheckFn func(ctx context.Context, skylink string) error
+
+	// Sweeper takes care of sweeping the files pinned by the local skyd server
+	// and marks them as pinned by the local server in the database.
+	Sweeper struct {
+		staticDB         *database.DB
+		staticLogger     logger.ExtFieldLogger
+		staticSchedule   *schedule
+		staticServerName string
+		staticSkydClient skyd.Client
+		staticStatus     *status
+		staticTG         *threadgroup.ThreadGroup
+		// staticUnpin defines whether sweeps unpin from skyd the skylinks
+		// which the database marks as unpinned.
+		staticUnpin bool
+		// staticMaxRemovalPercent is the maximum percentage of the server's
+		// skylinks a sweep can remove the server from, unless forced.
+		staticMaxRemovalPercent int
+		// staticAlert notifies the operator about problems which need their
+		// attention. It can be nil.
+		staticAlert AlertFn
+		// staticUnpinCheck is called before unpinning each skylink from
+		// skyd. We skip the skylinks it fails for. It defaults to
+		// staticCheckUnpinned.
+		staticUnpinCheck UnpinCheckFn
+	}
+)
+
+// New returns a new Sweeper.
+func New(db *database.DB, skydc skyd.Client, serverName string, unpin bool, maxRemovalPercent int, alert AlertFn, logger logger.ExtFieldLogger) *Sweeper {
+	s := &Sweeper{
+		staticDB:         db,
+		staticLogger:     logger,
+		staticSchedule:   &schedule{},
+		staticServerName: serverName,
+		staticSkydClient: skydc,
+		staticStatus:     &status{},
+		staticTG:         &threadgroup.ThreadGroup{},
+		staticUnpin:      unpin,
+
+		staticMaxRemovalPercent: maxRemovalPercent,
+		staticAlert:             alert,
+	}
+	s.staticUnpinCheck = s.staticCheckUnpinned
+	return s
+}
+
+// Close cancels the sweep schedule and any sweep in progress and waits for the
+// sweep to exit.
+func (s *Sweeper) Close() error {
+	s.staticSchedule.Close()
+	return s.staticTG.Stop()
+}
+
+// Status returns the status of the latest sweep.
+func (s *Sweeper) Status() Status {
+	return s.staticStatus.Status()
+}
+
+// Sweep starts a new skyd sweep. If a sweep is already underway, a single
+// follow-up sweep gets queued and starts as soon as the current one finishes.
+func (s *Sweeper) Sweep() {
+	s.sweep(false, skymodules.SiaPath{})
+}
+
+// ForceSweep works like Sweep but the sweep bypasses the safety check which
+// prevents it from removing too many skylinks from the server.
+func (s *Sweeper) ForceSweep() {
+	s.sweep(true, skymodules.SiaPath{})
+}
+
+// SweepSubtree works like Sweep but the sweep only walks the subtree of skyd's
+// filesystem under the given root and only reconciles the skylinks it finds
+// there. It adds the server to all skylinks it finds and removes the server
+// only from the skylinks which a previous sweep found under root and which are
+// no longer pinned anywhere on skyd. Skylinks pinned under root since the last
+// full sweep can't be recognised as removed, so a full sweep is still needed
+// from time to time. The root must exist. If force is true, the sweep bypasses
+// the safety check which prevents it from removing too many skylinks.
+func (s *Sweeper) SweepSubtree(root skymodules.SiaPath, force bool) {
+	if root.Equals(skymodules.SkynetFolder) {
+		root = skymodules.SiaPath{}
+	}
+	s.sweep(force, root)
+}
+
+// sweep starts a new sweep or queues a follow-up one. An empty path means
+// that the sweep covers the entire filesystem.
+func (s *Sweeper) sweep(force bool, path skymodules.SiaPath) {
+	err := s.staticTG.Add()
+	if err != nil {
+		// The sweeper is shutting down.
+		return
+	}
+	// Mark a sweep as started.
+	if !s.staticStatus.StartOrQueue(force, path) {
+		// A sweep is already in progress, a follow-up is queued.
+		s.staticTG.Done()
+		return
+	}
+	go s.threadedPerformSweep()
+}
+
+// UpdateSchedule schedules a new series of sweeps to be run, one every period.
+// If anchor is a time of day, e.g. "03:30", the first sweep happens on its next
+// occurrence (UTC). Otherwise, the first sweep happens one period from now.
+// If there are already sweeps scheduled, that schedule is cancelled (running
+// sweeps are not interrupted) and a new schedule is established.
+func (s *Sweeper) UpdateSchedule(period time.Duration, anchor string) error {
+	return s.staticSchedule.Update(period, anchor, s)
+}
+
+// threadedPerformSweep performs the actual sweep operation. The caller is
+// expected to have marked the sweep as started and to have added it to the
+// thread group.
+func (s *Sweeper) threadedPerformSweep() {
+	defer s.staticTG.Done()
+	// Define an error variable which will represent the success of the scan.
+	var err error
+	// Ensure that we'll finalize the sweep on returning from this method.
+	defer func() {
+		if err != nil {
+			s.staticLogger.Debug(errors.AddContext(err, "sweeping failed with error"))
+		}
+		// If there is a follow-up sweep queued, start it. If we are shutting
+		// down, finalize it instead.
+		if !s.staticStatus.Finalize(err) {
+			return
+		}
+		if s.staticTG.Add() != nil {
+			s.staticStatus.Finalize(ErrSweeperClosed)
+			return
+		}
+		go s.threadedPerformSweep()
+	}()
+
+	// Perform the actual sweep. Start by rebuilding skyd's cache and report
+	// its progress while we wait for it.
+	var res *skyd.RebuildCacheResult
+	if path := s.staticStatus.Status().Path; path.IsEmpty() {
+		res = s.staticSkydClient.RebuildCache(s.staticTG.StopCtx())
+	} else {
+		res = s.staticSkydClient.RebuildCacheSubtree(s.staticTG.StopCtx(), path)
+	}
+	ticker := time.NewTicker(progressUpdateInterval)
+	for rebuilding := true; rebuilding; {
+		select {
+		case <-s.staticTG.StopChan():
+			ticker.Stop()
+			err = ErrSweeperClosed
+			return
+		case <-ticker.C:
+			s.staticStatus.SetCacheProgress(res.Progress())
+		case <-res.Done():
+			rebuilding = false
+		}
+	}
+	ticker.Stop()
+	s.staticStatus.SetCacheProgress(res.Progress())
+	if errRebuild := res.Err(); errRebuild != nil {
+		err = errors.AddContext(errRebuild, "failed to rebuild skyd cache")
+		return
+	}
+	skippedDirs := res.SkippedDirs()
+	// The rebuild might have skipped a few directories. We can still add the
+	// skylinks we found but we can't be sure that the ones we didn't find are
+	// not pinned, so we won't remove this server from any skylinks.
+	partial := len(skippedDirs) > 0
+	if partial {
+		dirs := make([]string, 0, len(skippedDirs))
+		for dir, errDir := range skippedDirs {
+			s.staticLogger.Warn(errors.AddContext(errDir, fmt.Sprintf("sweep skipped skyd directory '%s'", dir)))
+			dirs = append(dirs, dir.String())
+		}
+		sort.Strings(dirs)
+		s.staticStatus.ReportSkippedDirs(dirs)
+	}
+	if n := res.InvalidSkylinks(); n > 0 {
+		s.staticLogger.Warnf("The cache rebuild dropped %d invalid skylinks reported by skyd.", n)
+	}
+
+	// We use an independent context because we are not strictly bound to a
+	// specific API call. Also, this operation can take significant amount of
+	// time and we don't want it to fail because of a timeout. The context is
+	// cancelled when the sweeper shuts down.
+	ctx := s.staticTG.StopCtx()
+
+	// Stream the skylinks pinned by this server from the database and diff
+	// them against the cache, so we never hold all of them in memory. The
+	// cursor has no deadline, since streaming tens of millions of skylinks
+	// takes far longer than a single database call. It stops with the
+	// sweeper.
+	numDBSkylinks := 0
+	iterate := func(visit func(string)) error {
+		return s.staticDB.ForEachSkylinkForServer(ctx, s.staticServerName, func(sl string) error {
+			numDBSkylinks++
+			visit(sl)
+			return nil
+		})
+	}
+	var unknown, missing []string
+	// If a full rebuild was already in progress when we asked for a subtree
+	// one, we got the full one and we can perform a full sweep.
+	if res.Root.Equals(skymodules.SkynetFolder) {
+		unknown, missing, err = s.staticSkydClient.DiffPinnedSkylinks(iterate)
+	} else {
+		unknown, missing, err = diffSubtree(iterate, res.Found(), res.Removed())
+	}
+	if err != nil {
+		err = errors.AddContext(err, "failed to fetch skylinks for server")
+		return
+	}
+	if partial {
+		unknown = nil
+	}
+	// Make sure we are not about to remove the server from too many of its
+	// skylinks. That would trigger a repin of all of them by other servers.
+	var errGuard error
+	if !s.staticStatus.Status().Forced && len(unknown)*100 > s.staticMaxRemovalPercent*numDBSkylinks {
+		errGuard = errors.AddContext(ErrTooManyRemovals, fmt.Sprintf("sweep would remove the server from %d out of its %d skylinks, maximum allowed is %d%%", len(unknown), numDBSkylinks, s.staticMaxRemovalPercent))
+		s.staticLogger.Error(errGuard)
+		s.staticAlertOperator(errGuard.Error())
+		unknown = nil
+	}
+
+	// Validate all missing skylinks before inserting them because skyd
+	// sometimes reports invalid skylinks (e.g. corrupt metadata) and we don't
+	// want those in the database.
+	valid := make([]string, 0, len(missing))
+	var invalid []string
+	for _, str := range missing {
+		_, errInvalid := database.SkylinkFromString(str)
+		if errInvalid != nil {
+			s.staticLogger.Warn(errors.AddContext(errInvalid, fmt.Sprintf("invalid skylink reported by skyd: '%s'", str)))
+			invalid = append(invalid, str)
+			continue
+		}
+		valid = append(valid, str)
+	}
+	if len(invalid) > 0 {
+		s.staticStatus.ReportInvalidSkylinks(invalid)
+	}
+
+	s.staticStatus.SetPhase(PhaseUpdatingDatabase)
+
+	// Skyd might still pin skylinks which the database marks as unpinned. We
+	// don't want to add this server to their list of pinners because that
+	// would make them look healthy. Instead, we report them and, if
+	// configured to, unpin them from skyd.
+	unpinned, err := s.staticDB.UnpinnedSkylinks(ctx, valid)
+	if err != nil {
+		err = errors.AddContext(err, "failed to fetch the pinned status of skylinks")
+		return
+	}
+	if len(unpinned) > 0 {
+		valid = subtract(valid, unpinned)
+		s.staticStatus.ReportUnpinnedSkylinks(unpinned)
+		s.staticLogger.Infof("Found %d skylinks pinned by skyd but marked as unpinned in the database", len(unpinned))
+		if s.staticUnpin {
+			s.staticUnpinSkylinks(ctx, unpinned)
+		}
+	}
+
+	// Track the progress of the database updates. The batches of the removal
+	// are followed by the batches of the addition.
+	numRemoveBatches := database.NumBatches(len(unknown))
+	s.staticStatus.SetBatchesTotal(numRemoveBatches + database.NumBatches(len(valid)))
+	removeProgress := func(done, _ int) {
+		s.staticStatus.SetBatchesDone(done)
+	}
+	addProgress := func(done, _ int) {
+		s.staticStatus.SetBatchesDone(numRemoveBatches + done)
+	}
+
+	// Remove all unknown skylink from the database. A failure here doesn't
+	// prevent us from adding the missing ones.
+	errRemove := s.staticDB.RemoveServerFromSkylinks(ctx, unknown, s.staticServerName, removeProgress)
+	if errRemove != nil {
+		errRemove = errors.AddContext(errRemove, "failed to remove server from skylinks")
+	}
+	// Add all missing skylinks to the database.
+	errAdd := s.staticDB.AddServerForSkylinks(ctx, valid, s.staticServerName, false, addProgress)
+	if errAdd != nil {
+		errAdd = errors.AddContext(errAdd, "failed to add server for skylinks")
+	}
+	err = errors.Compose(errGuard, errRemove, errAdd)
+	if err != nil {
+		return
+	}
+
+	// Account for the size of the skylinks we added and removed.
+	bytesAdded, unknownAdded := s.staticSkylinksSize(ctx, valid)
+	bytesRemoved, unknownRemoved := s.staticSkylinksSize(ctx, unknown)
+	s.staticStatus.ReportBytes(bytesAdded, unknownAdded, bytesRemoved, unknownRemoved)
+	s.staticLogger.Infof("Sweep added %s and removed %s", bytesSummary(bytesAdded, unknownAdded), bytesSummary(bytesRemoved, unknownRemoved))
+
+	// Clean up any locks left behind by crashed servers. This is not critical
+	// for the sweep, so we only log any errors.
+	s.staticClearExpiredLocks(ctx)
+	s.staticDeleteUnpinned(ctx)
+	s.staticPurgeDeleted(ctx)
+
+	// Now that the database matches skyd, recompute this server's load in
+	// order to correct any drift.
+	s.staticReconcileServerLoad(ctx)
+
+	// Record a heartbeat for this server. We only do that after a successful
+	// sweep, so a failed one leaves the previous heartbeat untouched.
+	numSkylinks := numDBSkylinks - len(unknown) + len(valid)
+	s.staticUpdateServerInfo(ctx, numSkylinks)
+}
+
+// staticClearExpiredLocks clears all expired skylink locks and records their
+// number in the sweep status.
+func (s *Sweeper) staticClearExpiredLocks(ctx context.Context) {
+	dbCtx, cancel := context.WithTimeout(ctx, database.MongoDefaultTimeout)
+	defer cancel()
+	n, err := s.staticDB.ClearExpiredLocks(dbCtx)
+	if err != nil {
+		s.staticLogger.Warn(errors.AddContext(err, "failed to clear expired locks"))
+		return
+	}
+	if n > 0 {
+		s.staticLogger.Infof("Cleared %d expired skylink locks", n)
+	}
+	s.staticStatus.SetExpiredLocksCleared(n)
+}
+
+// staticDeleteUnpinned soft-deletes the skylinks which have been unpinned for
+// longer than unpinned_retention and which no server pins anymore, and records
+// their number in the sweep status. This is not critical for the sweep, so we only
+// log any errors.
+func (s *Sweeper) staticDeleteUnpinned(ctx context.Context) {
+	dbCtx, cancel := context.WithTimeout(ctx, database.MongoDefaultTimeout)
+	defer cancel()
+	retention, err := conf.UnpinnedRetention(dbCtx, s.staticDB)
+	if err != nil {
+		s.staticLogger.Warn(errors.AddContext(err, "failed to fetch the DB value for unpinned_retention"))
+		return
+	}
+	if retention == 0 {
+		s.staticLogger.Debug("Deleting unpinned skylinks is disabled.")
+		return
+	}
+	n, err := s.staticDB.DeleteUnpinned(dbCtx, retention)
+	if err != nil {
+		s.staticLogger.Warn(errors.AddContext(err, "failed to delete unpinned skylinks"))
+		return
+	}
+	if n > 0 {
+		s.staticLogger.Infof("Deleted %d skylinks which have been unpinned for longer than %v", n, retention)
+	}
+	s.staticStatus.SetUnpinnedDeleted(n)
+}
+
+// staticPurgeDeleted removes the skylinks which have been soft-deleted for
+// longer than deleted_retention for good, and records their number in the
+// sweep status. This is not critical for the sweep, so we only log any errors.
+func (s *Sweeper) staticPurgeDeleted(ctx context.Context) {
+	dbCtx, cancel := context.WithTimeout(ctx, database.MongoDefaultTimeout)
+	defer cancel()
+	retention, err := conf.DeletedRetention(dbCtx, s.staticDB)
+	if err != nil {
+		s.staticLogger.Warn(errors.AddContext(err, "failed to fetch the DB value for deleted_retention"))
+		return
+	}
+	if retention == 0 {
+		s.staticLogger.Debug("Purging deleted skylinks is disabled.")
+		return
+	}
+	n, err := s.staticDB.PurgeDeleted(dbCtx, retention)
+	if err != nil {
+		s.staticLogger.Warn(errors.AddContext(err, "failed to purge deleted skylinks"))
+		return
+	}
+	if n > 0 {
+		s.staticLogger.Infof("Purged %d skylinks which have been deleted for longer than %v", n, retention)
+	}
+	s.staticStatus.SetDeletedPurged(n)
+}
+
+// staticReconcileServerLoad recomputes the load of this server. This is not
+// critical for the sweep, so we only log any errors.
+func (s *Sweeper) staticReconcileServerLoad(ctx context.Context) {
+	dbCtx, cancel := context.WithTimeout(ctx, database.MongoDefaultTimeout)
+	defer cancel()
+	err := s.staticDB.ReconcileServerLoad(dbCtx, s.staticServerName)
+	if err != nil {
+		s.staticLogger.Warn(errors.AddContext(err, "failed to reconcile the server's load"))
+	}
+}
+
+// staticAlertOperator sends the given message to the operator, if we have an
+// alert hook.
+func (s *Sweeper) staticAlertOperator(msg string) {
+	if s.staticAlert == nil {
+		return
+	}
+	s.staticAlert(fmt.Sprintf("[%s] %s", s.staticServerName, msg))
+}
+
+// staticUnpinSkylinks unpins the given skylinks from the local skyd and
+// records their number in the sweep status. It respects the dry_run setting
+// of this server.
+func (s *Sweeper) staticUnpinSkylinks(ctx context.Context, skylinks []string) {
+	dbCtx, cancel := context.WithTimeout(ctx, database.MongoDefaultTimeout)
+	defer cancel()
+	dryRun, err := conf.DryRunForServer(dbCtx, s.staticDB, s.staticServerName)
+	if err != nil {
+		s.staticLogger.Warn(errors.AddContext(err, "failed to fetch the dry_run setting, skipping unpinning"))
+		return
+	}
+	if dryRun {
+		s.staticLogger.Infof("Dry run: skipping unpinning %d skylinks from skyd", len(skylinks))
+		return
+	}
+	s.staticStatus.SetUnpinnedFromSkyd(s.staticUnpinFromSkyd(ctx, skylinks))
+}
+
+// staticUnpinFromSkyd unpins the given skylinks from the local skyd, skipping
+// the ones for which the unpin check fails. It returns the number of skylinks
+// it unpinned.
+func (s *Sweeper) staticUnpinFromSkyd(ctx context.Context, skylinks []string) int {
+	n := 0
+	for _, sl := range skylinks {
+		err := s.staticUnpinCheck(ctx, sl)
+		if err != nil {
+			s.staticLogger.Warn(errors.AddContext(err, fmt.Sprintf("skipping unpinning skylink '%s'", sl)))
+			continue
+		}
+		err = s.staticSkydClient.Unpin(ctx, sl)
+		if err != nil {
+			s.staticLogger.Warn(errors.AddContext(err, fmt.Sprintf("failed to unpin skylink '%s'", sl)))
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// staticCheckUnpinned is the default unpin check. It re-reads the skylink from
+// the database right before we unpin it and refuses to unpin it unless the
+// database still marks it as unpinned. This protects us from unpinning
+// skylinks which were re-pinned since the sweep started.
+func (s *Sweeper) staticCheckUnpinned(ctx context.Context, skylink string) error {
+	sl, err := database.SkylinkFromString(skylink)
+	if err != nil {
+		return errors.Compose(err, ErrUnpinRefused)
+	}
+	dbCtx, cancel := context.WithTimeout(ctx, database.MongoDefaultTimeout)
+	defer cancel()
+	doc, err := s.staticDB.FindSkylink(dbCtx, sl)
+	if errors.Contains(err, database.ErrSkylinkNotExist) {
+		return errors.AddContext(ErrUnpinRefused, "skylink not found in the database")
+	}
+	if err != nil {
+		return errors.Compose(errors.AddContext(err, "failed to fetch skylink"), ErrUnpinRefused)
+	}
+	if doc.Pinned {
+		return errors.AddContext(ErrUnpinRefused, "skylink is marked as pinned in the database")
+	}
+	return nil
+}
+
+// staticUpdateServerInfo updates the heartbeat document of the local server
+// after a successful sweep.
+func (s *Sweeper) staticUpdateServerInfo(ctx context.Context, numSkylinks int) {
+	st := s.staticStatus.Status()
+	info := database.ServerInfo{
+		Name:           s.staticServerName,
+		LastSweepStart: st.StartTime,
+		LastSweepEnd:   time.Now().UTC(),
+		NumSkylinks:    numSkylinks,
+		PinnerVersion:  pinnerbuild.GitRevision,
+		SchemaVersion:  database.LatestSchemaVersion(),
+
+		LastSweepBytesAdded:   st.BytesAdded,
+		LastSweepBytesRemoved: st.BytesRemoved,
+	}
+	dbCtx, cancel := context.WithTimeout(ctx, database.MongoDefaultTimeout)
+	defer cancel()
+	err := s.staticDB.UpsertServerInfo(dbCtx, info)
+	if err != nil {
+		s.staticLogger.Warn(errors.AddContext(err, "failed to update the server info"))
+	}
+}
+
+// diffSubtree works like DiffPinnedSkylinks for subtree sweeps. The skylinks
+// visited by the given iterator are the ones the database lists for the
+// server. It returns the removed skylinks which the database lists (unknown)
+// and the found skylinks which it doesn't list (missing). Both lists are
+// sorted.
+func diffSubtree(iterate skyd.SkylinkIterator, found, removed []string) (unknown []string, missing []string, err error) {
+	foundMap := make(map[string]bool, len(found))
+	for _, sl := range found {
+		foundMap[sl] = false
+	}
+	removedMap := make(map[string]struct{}, len(removed))
+	for _, sl := range removed {
+		removedMap[sl] = struct{}{}
+	}
+	err = iterate(func(sl string) {
+		if _, exists := foundMap[sl]; exists {
+			foundMap[sl] = true
+		}
+		if _, exists := removedMap[sl]; exists {
+			unknown = append(unknown, sl)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for sl, seen := range foundMap {
+		if !seen {
+			missing = append(missing, sl)
+		}
+	}
+	sort.Strings(unknown)
+	sort.Strings(missing)
+	return unknown, missing, nil
+}
+
+// subtract returns the skylinks in the given list which are not in the given
+// subset.
+func subtract(skylinks, subset []string) []string {
+	exclude := make(map[string]struct{}, len(subset))
+	for _, sl := range subset {
+		exclude[sl] = struct{}{}
+	}
+	var result []string
+	for _, sl := range skylinks {
+		if _, exists := exclude[sl]; !exists {
+			result = append(result, sl)
+		}
+	}
+	return result
+}
@@ -0,0 +1,209 @@
+package sweeper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/skynetlabs/pinner/skyd"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+)
+
+// newDiscardLogger returns a logger which discards all output.
+func newDiscardLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+// TestSweeperClose ensures that Close interrupts a sweep in progress and
+// returns promptly.
+func TestSweeperClose(t *testing.T) {
+	t.Parallel()
+
+	skydMock := skyd.NewSkydClientMock()
+	// Make the cache rebuild take much longer than the test.
+	skydMock.SetRebuildCacheDelay(time.Hour)
+	// The sweep never reaches the database, so we don't need one.
+	s := New(nil, skydMock, "server", false, 50, nil, newDiscardLogger())
+
+	s.Sweep()
+	// Queue a follow-up sweep. We expect it to never start.
+	s.Sweep()
+	if st := s.Status(); !st.InProgress || !st.Queued {
+		t.Fatalf("Expected a sweep in progress and a queued one, got %+v", st)
+	}
+	start := time.Now()
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected Close to return promptly, it took %v", time.Since(start))
+	}
+	st := s.Status()
+	if st.InProgress || st.Queued {
+		t.Fatalf("Expected no sweeps, got %+v", st)
+	}
+	if !errors.Contains(st.Error, ErrSweeperClosed) {
+		t.Fatalf("Expected error '%v', got '%v'", ErrSweeperClosed, st.Error)
+	}
+	// Make sure that no new sweeps start after closing.
+	s.Sweep()
+	if s.Status().InProgress {
+		t.Fatal("Expected no sweep to start after closing the sweeper.")
+	}
+}
+
+// TestSweepRebuildFailure ensures that a sweep fails when it can't rebuild
+// skyd's cache and that it doesn't touch the database in that case.
+func TestSweepRebuildFailure(t *testing.T) {
+	t.Parallel()
+
+	errRebuild := errors.New("rebuild failed")
+	skydMock := skyd.NewSkydClientMock()
+	skydMock.SetRebuildCacheDelay(0)
+	skydMock.SetRebuildCacheError(errRebuild)
+	// The sweep must never reach the database, so we don't give it one.
+	s := New(nil, skydMock, "server", false, 50, nil, newDiscardLogger())
+	defer func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	s.Sweep()
+	err := build.Retry(100, 10*time.Millisecond, func() error {
+		if s.Status().InProgress {
+			return errors.New("sweep still in progress")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := s.Status()
+	if !errors.Contains(st.Error, errRebuild) {
+		t.Fatalf("Expected error '%v', got '%v'", errRebuild, st.Error)
+	}
+	if st.Phase != PhaseDone || st.EndTime.IsZero() {
+		t.Fatalf("Expected the sweep to be done, got %+v", st)
+	}
+}
+
+// TestSubtract ensures that subtract works as expected.
+func TestSubtract(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		skylinks []string
+		subset   []string
+		expected []string
+	}{
+		"empty":        {skylinks: nil, subset: []string{"a"}, expected: nil},
+		"empty subset": {skylinks: []string{"a", "b"}, subset: nil, expected: []string{"a", "b"}},
+		"overlap":      {skylinks: []string{"a", "b", "c"}, subset: []string{"b", "d"}, expected: []string{"a", "c"}},
+		"all":          {skylinks: []string{"a", "b"}, subset: []string{"b", "a"}, expected: nil},
+	}
+	for name, tt := range tests {
+		if res := subtract(tt.skylinks, tt.subset); !reflect.DeepEqual(res, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", name, tt.expected, res)
+		}
+	}
+}
+
+// TestFetchSkylinkSizes ensures that fetchSkylinkSizes returns the sizes of
+// all skylinks whose metadata it can fetch and skips the rest.
+func TestFetchSkylinkSizes(t *testing.T) {
+	t.Parallel()
+
+	skydMock := skyd.NewSkydClientMock()
+	var skylinks []string
+	for i := 0; i < 3*metadataConcurrency; i++ {
+		sl := fmt.Sprintf("skylink%d", i)
+		skydMock.SetMetadata(sl, skymodules.SkyfileMetadata{Length: uint64(i)}, nil)
+		skylinks = append(skylinks, sl)
+	}
+	skydMock.SetMetadata("broken", skymodules.SkyfileMetadata{}, errors.New("no metadata"))
+	skylinks = append(skylinks, "broken")
+
+	sizes := fetchSkylinkSizes(context.Background(), skydMock, skylinks)
+	if len(sizes) != len(skylinks)-1 {
+		t.Fatalf("Expected %d sizes, got %d", len(skylinks)-1, len(sizes))
+	}
+	for i := 0; i < 3*metadataConcurrency; i++ {
+		sl := fmt.Sprintf("skylink%d", i)
+		if sizes[sl] != uint64(i) {
+			t.Fatalf("Expected size %d for %s, got %d", i, sl, sizes[sl])
+		}
+	}
+	if _, exists := sizes["broken"]; exists {
+		t.Fatal("Expected no size for a skylink without metadata.")
+	}
+}
+
+// TestDiffSubtree ensures that diffSubtree only reports the found skylinks
+// which the database doesn't list and the removed ones which it does, in
+// order.
+func TestDiffSubtree(t *testing.T) {
+	t.Parallel()
+
+	dbSkylinks := []string{"a", "b", "c"}
+	iterate := func(visit func(string)) error {
+		for _, sl := range dbSkylinks {
+			visit(sl)
+		}
+		return nil
+	}
+	unknown, missing, err := diffSubtree(iterate, []string{"a", "f", "d"}, []string{"c", "b", "e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both lists are sorted.
+	if !reflect.DeepEqual(unknown, []string{"b", "c"}) {
+		t.Fatalf("Expected unknown [b c], got %v", unknown)
+	}
+	if !reflect.DeepEqual(missing, []string{"d", "f"}) {
+		t.Fatalf("Expected missing [d f], got %v", missing)
+	}
+	// An iteration error fails the diff.
+	errIterate := errors.New("iteration failed")
+	_, _, err = diffSubtree(func(func(string)) error { return errIterate }, nil, nil)
+	if !errors.Contains(err, errIterate) {
+		t.Fatalf("Expected error '%v', got '%v'", errIterate, err)
+	}
+}
+
+// TestSweeperUnpinCheck ensures that we don't unpin skylinks from skyd when the
+// unpin check refuses it.
+func TestSweeperUnpinCheck(t *testing.T) {
+	t.Parallel()
+
+	safe := "AAA_Cb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	unsafe := "AAB_Cb3BpGxmSbRAg1xj5T8SdB4hiSFiEW2sEEzxt5MNkg"
+	skydMock := skyd.NewSkydClientMock(skyd.WithPinnedSkylinks(safe, unsafe))
+	s := New(nil, skydMock, "server", true, 50, nil, newDiscardLogger())
+	// Simulate the database disagreeing with the sweep about unsafe.
+	s.staticUnpinCheck = func(_ context.Context, sl string) error {
+		if sl == unsafe {
+			return errors.AddContext(ErrUnpinRefused, "skylink is marked as pinned in the database")
+		}
+		return nil
+	}
+	n := s.staticUnpinFromSkyd(context.Background(), []string{safe, unsafe})
+	if n != 1 {
+		t.Fatalf("Expected a single skylink to be unpinned, got %d", n)
+	}
+	if skydMock.Pinning(safe) {
+		t.Fatalf("Expected '%s' to be unpinned.", safe)
+	}
+	if !skydMock.Pinning(unsafe) {
+		t.Fatalf("Expected '%s' to still be pinned.", unsafe)
+	}
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	"github.com/skynetlabs/pinner/accounts"
+)
+
+type (
+	// AccountsMock is a mock of the accounts service's HTTP API. It serves
+	// the skylinks set via SetPinnedSkylinks and reports itself healthy
+	// until told otherwise via SetHealthy.
+	AccountsMock struct {
+		Server *httptest.Server
+
+		pinned    []accounts.PinnedSkylink
+		unhealthy bool
+		mu        sync.Mutex
+	}
+)
+
+// NewAccountsMock starts a new AccountsMock. The caller must close its Server.
+func NewAccountsMock() *AccountsMock {
+	am := &AccountsMock{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", am.healthGET)
+	mux.HandleFunc("/skylinks/pinned", am.pinnedSkylinksGET)
+	am.Server = httptest.NewServer(mux)
+	return am
+}
+
+// SetHealthy sets whether the mock's health endpoint reports it as healthy.
+func (am *AccountsMock) SetHealthy(healthy bool) {
+	am.mu.Lock()
+	am.unhealthy = !healthy
+	am.mu.Unlock()
+}
+
+// SetPinnedSkylinks sets the skylinks the mock reports as pinned by the users.
+func (am *AccountsMock) SetPinnedSkylinks(skylinks []string) {
+	pinned := make([]accounts.PinnedSkylink, 0, len(skylinks))
+	for _, sl := range skylinks {
+		pinned = append(pinned, accounts.PinnedSkylink{Skylink: sl, Users: 1})
+	}
+	am.mu.Lock()
+	am.pinned = pinned
+	am.mu.Unlock()
+}
+
+// healthGET serves the mock's health.
+func (am *AccountsMock) healthGET(w http.ResponseWriter, _ *http.Request) {
+	am.mu.Lock()
+	unhealthy := am.unhealthy
+	am.mu.Unlock()
+	if unhealthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"dbAlive":true}`))
+}
+
+// pinnedSkylinksGET serves a page of the pinned skylinks.
+func (am *AccountsMock) pinnedSkylinksGET(w http.ResponseWriter, req *http.Request) {
+	offset, err1 := strconv.Atoi(req.FormValue("offset"))
+	pageSize, err2 := strconv.Atoi(req.FormValue("pageSize"))
+	if err1 != nil || err2 != nil || offset < 0 || pageSize <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	am.mu.Lock()
+	page := accounts.PinnedSkylinksPage{
+		Items:    []accounts.PinnedSkylink{},
+		Offset:   offset,
+		PageSize: pageSize,
+		Count:    len(am.pinned),
+	}
+	for i := offset; i < len(am.pinned) && i < offset+pageSize; i++ {
+		page.Items = append(page.Items, am.pinned[i])
+	}
+	am.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(page)
+}
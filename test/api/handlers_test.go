@@ -2,16 +2,29 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/skynetlabs/pinner/accounts"
+	"github.com/skynetlabs/pinner/api"
 	"github.com/skynetlabs/pinner/conf"
 	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/skyd"
+	"github.com/skynetlabs/pinner/sweeper"
 	"github.com/skynetlabs/pinner/test"
 	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 // subtest defines the structure of a subtest
@@ -40,10 +53,26 @@ func TestHandlers(t *testing.T) {
 
 	// Specify subtests to run
 	tests := []subtest{
+		{name: "AccountsHook", test: testHandlerAccountsHookPOST},
+		{name: "ConfigDelete", test: testHandlerConfigDELETE},
+		{name: "ConfigEffective", test: testHandlerConfigEffectiveGET},
+		{name: "ConfigExport", test: testHandlerConfigExport},
 		{name: "Health", test: testHandlerHealthGET},
 		{name: "Pin", test: testHandlerPinPOST},
 		{name: "Unpin", test: testHandlerUnpinPOST},
+		{name: "Owners", test: testHandlerOwners},
+		{name: "Skylink", test: testHandlerSkylinkGET},
+		{name: "Stats", test: testHandlerStatsGET},
 		{name: "Sweep", test: testHandlerSweep},
+		{name: "SweepInvalidSkylink", test: testHandlerSweepInvalidSkylink},
+		{name: "SweepProgress", test: testHandlerSweepProgress},
+		{name: "SweepUnpinned", test: testHandlerSweepUnpinned},
+		{name: "SweepBytes", test: testHandlerSweepBytes},
+		{name: "SweepSubtree", test: testHandlerSweepSubtree},
+		{name: "Cache", test: testHandlerCacheGET},
+		{name: "SweepTooManyRemovals", test: testHandlerSweepTooManyRemovals},
+		{name: "ReconcileAccounts", test: testHandlerReconcileAccounts},
+		{name: "ServersRepair", test: testHandlerServersRepair},
 	}
 
 	// Run subtests
@@ -62,12 +91,29 @@ func testHandlerHealthGET(t *testing.T, tt *test.Tester) {
 	}
 	// DBAlive should never be false because if we couldn't reach the DB, we
 	// wouldn't have made it this far in the test.
-	if !status.DBAlive {
-		t.Fatal("DB down.")
+	if !status.DBAlive || status.DBError != "" {
+		t.Fatalf("DB down: '%s'", status.DBError)
 	}
 	if status.MinPinners != 1 {
 		t.Fatalf("Expected min_pinners to have its default value of 1, got %d", status.MinPinners)
 	}
+	if status.SkydBreaker != skyd.BreakerClosed {
+		t.Fatalf("Expected the skyd breaker to be '%s', got '%s'", skyd.BreakerClosed, status.SkydBreaker)
+	}
+	// Make skyd look unavailable.
+	skydMock, ok := tt.SkydClient.(*skyd.ClientMock)
+	if !ok {
+		t.Fatal("Expected the tester to use a skyd mock.")
+	}
+	skydMock.SetBreakerState(skyd.BreakerOpen)
+	status, _, err = tt.HealthGET()
+	skydMock.SetBreakerState(skyd.BreakerClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.SkydBreaker != skyd.BreakerOpen {
+		t.Fatalf("Expected the skyd breaker to be '%s', got '%s'", skyd.BreakerOpen, status.SkydBreaker)
+	}
 	// Set a new min_pinners value.
 	newMinPinners := 2
 	err = tt.DB.SetConfigValue(tt.Ctx, conf.ConfMinPinners, strconv.Itoa(newMinPinners))
@@ -82,6 +128,42 @@ func testHandlerHealthGET(t *testing.T, tt *test.Tester) {
 	if status.MinPinners != newMinPinners {
 		t.Fatalf("Expected %d, got %d", newMinPinners, status.MinPinners)
 	}
+	// Ask for the stats of the calls to skyd and the health of accounts.
+	status, code, err := tt.HealthVerboseGET()
+	if err != nil || code != http.StatusOK {
+		t.Fatal(code, err)
+	}
+	if status.AccountsAlive == nil || !*status.AccountsAlive || status.AccountsError != "" {
+		t.Fatalf("Expected accounts to be alive, got %v '%s'", status.AccountsAlive, status.AccountsError)
+	}
+	// Make accounts look unavailable. We reuse the result of the last
+	// probe for a while, so it takes a moment to show.
+	tt.Accounts.SetHealthy(false)
+	defer tt.Accounts.SetHealthy(true)
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		status, _, err = tt.HealthVerboseGET()
+		if err != nil {
+			return err
+		}
+		if status.AccountsAlive == nil || *status.AccountsAlive {
+			return errors.New("accounts still alive")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.AccountsError == "" {
+		t.Fatal("Expected an accounts error")
+	}
+	// The non-verbose health doesn't probe accounts.
+	status, _, err = tt.HealthGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.AccountsAlive != nil {
+		t.Fatal("Expected no accounts health")
+	}
 }
 
 // testHandlerPinPOST tests "POST /pin"
@@ -101,7 +183,7 @@ func testHandlerPinPOST(t *testing.T, tt *test.Tester) {
 
 	// Mark the skylink as unpinned and pin it again.
 	// Expect it to no longer be unpinned.
-	err = tt.DB.MarkUnpinned(tt.Ctx, sl)
+	err = tt.DB.MarkUnpinned(tt.Ctx, sl, tt.ServerName)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -116,6 +198,255 @@ func testHandlerPinPOST(t *testing.T, tt *test.Tester) {
 	if !slNew.Pinned {
 		t.Fatal("Expected the skylink to be pinned.")
 	}
+
+	// Pinning a skylink stores its metadata.
+	skydMock, ok := tt.SkydClient.(*skyd.ClientMock)
+	if !ok {
+		t.Fatal("Expected a skyd client mock.")
+	}
+	dir := test.RandomSkylink()
+	skydMock.SetMetadata(dir.String(), skymodules.SkyfileMetadata{
+		Filename: "dir",
+		Length:   3 << 20,
+		Subfiles: skymodules.SkyfileSubfiles{
+			"a.txt": {Filename: "a.txt", ContentType: "text/plain", Len: 1 << 20},
+			"b.txt": {Filename: "b.txt", ContentType: "text/plain", Offset: 1 << 20, Len: 2 << 20},
+		},
+	}, nil)
+	status, err = tt.PinPOST(dir.String())
+	if err != nil || status != http.StatusNoContent {
+		t.Fatal(status, err)
+	}
+	resp, _, err := tt.SkylinkGET(dir.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Size != 3<<20 || !resp.IsDirectory || resp.ContentType != "" {
+		t.Fatalf("Unexpected metadata %+v", resp)
+	}
+	// Failing to fetch the metadata doesn't fail the pin.
+	unknown := test.RandomSkylink()
+	skydMock.SetMetadata(unknown.String(), skymodules.SkyfileMetadata{}, skyd.ErrSkydUnreachable)
+	status, err = tt.PinPOST(unknown.String())
+	if err != nil || status != http.StatusNoContent {
+		t.Fatal(status, err)
+	}
+	resp, _, err = tt.SkylinkGET(unknown.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Size != 0 || resp.IsDirectory || resp.ContentType != "" {
+		t.Fatalf("Unexpected metadata %+v", resp)
+	}
+}
+
+// testHandlerSkylinkGET tests "GET /skylink/:skylink"
+func testHandlerSkylinkGET(t *testing.T, tt *test.Tester) {
+	// Get an invalid skylink.
+	_, code, err := tt.SkylinkGET("this_is_not_a_skylink")
+	if err == nil || code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d %v", http.StatusBadRequest, code, err)
+	}
+	// Get a skylink the database doesn't know.
+	sl := test.RandomSkylink()
+	_, code, err = tt.SkylinkGET(sl.String())
+	if err == nil || code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d %v", http.StatusNotFound, code, err)
+	}
+	// Add the skylink to the database but not to skyd.
+	code, err = tt.PinPOST(sl.String())
+	if err != nil || code != http.StatusNoContent {
+		t.Fatal(code, err)
+	}
+	resp, code, err := tt.SkylinkGET(sl.String())
+	if err != nil || code != http.StatusOK {
+		t.Fatal(code, err)
+	}
+	if resp.Skylink != sl.String() || !resp.Pinned || resp.PinnedLocally == nil || *resp.PinnedLocally {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+	if resp.CreatedAt.IsZero() || resp.UpdatedAt.Before(resp.CreatedAt) {
+		t.Fatalf("Unexpected timestamps %+v", resp)
+	}
+	// Pin it to skyd.
+	_, err = tt.SkydClient.Pin(context.Background(), sl.String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _, err = tt.SkylinkGET(sl.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PinnedLocally == nil || !*resp.PinnedLocally {
+		t.Fatalf("Expected the skylink to be pinned locally, got %+v", resp)
+	}
+	if resp.UnpinnedAt != nil || resp.UnpinnedBy != "" {
+		t.Fatalf("Expected a pinned skylink not to report an unpin, got %+v", resp)
+	}
+}
+
+// testHandlerStatsGET tests "GET /stats"
+func testHandlerStatsGET(t *testing.T, tt *test.Tester) {
+	// total returns the number of pinned skylinks in the histogram.
+	total := func(counts map[int]int64) int64 {
+		var n int64
+		for _, c := range counts {
+			n += c
+		}
+		return n
+	}
+	stats, code, err := tt.StatsGET()
+	if err != nil || code != http.StatusOK {
+		t.Fatal(code, err)
+	}
+	mp, err := conf.MinPinners(tt.Ctx, tt.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MinPinners != mp {
+		t.Fatalf("Expected min_pinners %d, got %d", mp, stats.MinPinners)
+	}
+	if stats.DBPool.Open < 1 || stats.DBPool.InUse < 0 {
+		t.Fatalf("Expected open connections to the database, got %+v", stats.DBPool)
+	}
+	// Pin a new skylink and expect it to show up in the histogram.
+	code, err = tt.PinPOST(test.RandomSkylink().String())
+	if err != nil || code != http.StatusNoContent {
+		t.Fatal(code, err)
+	}
+	newStats, _, err := tt.StatsGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total(newStats.PinnerCounts) != total(stats.PinnerCounts)+1 {
+		t.Fatalf("Expected one more pinned skylink, got %v before and %v after", stats.PinnerCounts, newStats.PinnerCounts)
+	}
+	// Only the deep stats report the sizes of the documents.
+	if newStats.DocSizes != nil {
+		t.Fatalf("Expected no document sizes, got %+v", newStats.DocSizes)
+	}
+	deepStats, code, err := tt.StatsDeepGET()
+	if err != nil || code != http.StatusOK {
+		t.Fatal(code, err)
+	}
+	ds := deepStats.DocSizes
+	if ds == nil || ds.Documents < 1 || ds.Max <= 0 || ds.P50 <= 0 || ds.P50 > ds.Max || len(ds.Largest) == 0 {
+		t.Fatalf("Unexpected document sizes %+v", ds)
+	}
+}
+
+// testHandlerConfigExport tests "GET /config/export" and "PUT /config/export".
+func testHandlerConfigExport(t *testing.T, tt *test.Tester) {
+	// Import a value we don't know and make sure it round-trips.
+	key := "some_future_setting"
+	code, err := tt.ConfigExportPUT(api.ConfigExport{key: "value"})
+	if err != nil || code != http.StatusNoContent {
+		t.Fatal(code, err)
+	}
+	values, code, err := tt.ConfigExportGET()
+	if err != nil || code != http.StatusOK {
+		t.Fatal(code, err)
+	}
+	if values[key] != "value" {
+		t.Fatalf("Expected '%s' to be 'value', got %v", key, values)
+	}
+	// The schema version is internal, so we don't export it and refuse to
+	// import it.
+	if _, exists := values["schema_version"]; exists {
+		t.Fatalf("Expected the schema version not to be exported, got %v", values)
+	}
+	code, err = tt.ConfigExportPUT(api.ConfigExport{"schema_version": "1"})
+	if err == nil || code != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and '%v'", http.StatusBadRequest, code, err)
+	}
+	// The per-server dry_run values can be set, as long as they are valid.
+	code, err = tt.ConfigExportPUT(api.ConfigExport{conf.DryRunKey("server1"): "true"})
+	if err != nil || code != http.StatusNoContent {
+		t.Fatal(code, err)
+	}
+	values, code, err = tt.ConfigExportGET()
+	if err != nil || code != http.StatusOK {
+		t.Fatal(code, err)
+	}
+	if values["dry_run.server1"] != "true" {
+		t.Fatalf("Expected 'dry_run.server1' to be 'true', got %v", values)
+	}
+	for k, v := range map[string]string{conf.DryRunKey("server1"): "maybe", conf.DryRunKey(""): "true", conf.ConfDryRun: "yes"} {
+		code, err = tt.ConfigExportPUT(api.ConfigExport{k: v})
+		if err == nil || code != http.StatusBadRequest {
+			t.Fatalf("%s: expected %d, got %d and '%v'", k, http.StatusBadRequest, code, err)
+		}
+	}
+	code, err = tt.ConfigDELETE(conf.DryRunKey("server1"))
+	if err != nil || code != http.StatusNoContent {
+		t.Fatal(code, err)
+	}
+	// An invalid body is rejected.
+	r, err := tt.Request(http.MethodPut, "/config/export", nil, []byte("not json"), nil, nil)
+	if err == nil || r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and '%v'", http.StatusBadRequest, r.StatusCode, err)
+	}
+}
+
+// testHandlerConfigEffectiveGET tests "GET /config/effective".
+func testHandlerConfigEffectiveGET(t *testing.T, tt *test.Tester) {
+	ec, code, err := tt.ConfigEffectiveGET()
+	if err != nil || code != http.StatusOK {
+		t.Fatal(code, err)
+	}
+	if v := ec.Static["SERVER_DOMAIN"]; v.Value != tt.ServerName || v.Source != conf.SourceEnv {
+		t.Fatalf("Expected SERVER_DOMAIN '%s' from the env, got %+v", tt.ServerName, v)
+	}
+	if v := ec.Cluster[conf.ConfLockDuration]; v.Value == "" || v.Source == "" {
+		t.Fatalf("Expected the lock duration and its source, got %+v", v)
+	}
+	if v := ec.Derived["sleep_between_scans"]; v.Value == "" || v.Source == "" {
+		t.Fatalf("Expected the sleep between scans and its source, got %+v", v)
+	}
+	// Neither skyd's API password nor the DB credentials make it out.
+	b, err := json.Marshal(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := test.LoadTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{cfg.SiaAPIPassword, cfg.DBCredentials.Password} {
+		if strings.Contains(string(b), secret) {
+			t.Fatalf("Expected no secrets, got %s", b)
+		}
+	}
+}
+
+// testHandlerConfigDELETE tests "DELETE /config/:key"
+func testHandlerConfigDELETE(t *testing.T, tt *test.Tester) {
+	key := "setting_to_delete"
+	code, err := tt.ConfigExportPUT(api.ConfigExport{key: "value"})
+	if err != nil || code != http.StatusNoContent {
+		t.Fatal(code, err)
+	}
+	code, err = tt.ConfigDELETE(key)
+	if err != nil || code != http.StatusNoContent {
+		t.Fatal(code, err)
+	}
+	values, code, err := tt.ConfigExportGET()
+	if err != nil || code != http.StatusOK {
+		t.Fatal(code, err)
+	}
+	if _, exists := values[key]; exists {
+		t.Fatalf("Expected '%s' to be deleted, got %v", key, values)
+	}
+	// Deleting it again fails.
+	code, err = tt.ConfigDELETE(key)
+	if err == nil || code != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d and '%v'", http.StatusNotFound, code, err)
+	}
+	// The internal values can't be deleted.
+	code, err = tt.ConfigDELETE("schema_version")
+	if err == nil || code != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d and '%v'", http.StatusBadRequest, code, err)
+	}
 }
 
 // testHandlerUnpinPOST tests "POST /unpin"
@@ -145,20 +476,81 @@ func testHandlerUnpinPOST(t *testing.T, tt *test.Tester) {
 	if slNew.Pinned {
 		t.Fatal("Expected the skylink to be marked as unpinned.")
 	}
+	// Make sure we report who unpinned it and when.
+	sg, _, err := tt.SkylinkGET(sl.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sg.UnpinnedBy != tt.ServerName || sg.UnpinnedAt == nil || sg.UnpinnedAt.IsZero() {
+		t.Fatalf("Expected the skylink to be unpinned by '%s', got %+v", tt.ServerName, sg)
+	}
 	// Unpin a valid skylink that's not in the DB, yet.
 	sl2 := test.RandomSkylink()
 	status, err = tt.UnpinPOST(sl2.String())
 	if err != nil || status != http.StatusNoContent {
 		t.Fatal(status, err)
 	}
-	// Make sure the skylink is marked as unpinned.
-	sl2New, err := tt.DB.FindSkylink(tt.Ctx, sl)
+	// Make sure the skylink is marked as unpinned and has an empty list of
+	// servers rather than none.
+	sl2New, err := tt.DB.FindSkylink(tt.Ctx, sl2)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if sl2New.Pinned {
 		t.Fatal("Expected the skylink to be marked as unpinned.")
 	}
+	if sl2New.Servers == nil || len(sl2New.Servers) != 0 || sl2New.NumServers != 0 {
+		t.Fatalf("Expected an empty list of servers, got %+v", sl2New)
+	}
+}
+
+// testHandlerOwners tests pinning and unpinning skylinks on behalf of their
+// owners via "POST /pin" and "POST /unpin".
+func testHandlerOwners(t *testing.T, tt *test.Tester) {
+	sl := test.RandomSkylink()
+
+	// Unpinning a skylink we don't know on behalf of an owner fails.
+	status, err := tt.UnpinOwnerPOST(sl.String(), "alice")
+	if status != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d and '%v'", http.StatusNotFound, status, err)
+	}
+	for _, owner := range []string{"alice", "bob"} {
+		status, err = tt.PinOwnerPOST(sl.String(), owner)
+		if err != nil || status != http.StatusNoContent {
+			t.Fatal(status, err)
+		}
+	}
+	sg, _, err := tt.SkylinkGET(sl.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(sg.Owners)
+	if !sg.Pinned || !reflect.DeepEqual(sg.Owners, []string{"alice", "bob"}) {
+		t.Fatalf("Expected a pinned skylink owned by alice and bob, got %+v", sg)
+	}
+	// The skylink stays pinned until its last owner unpins it.
+	status, err = tt.UnpinOwnerPOST(sl.String(), "alice")
+	if err != nil || status != http.StatusNoContent {
+		t.Fatal(status, err)
+	}
+	sg, _, err = tt.SkylinkGET(sl.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sg.Pinned || !reflect.DeepEqual(sg.Owners, []string{"bob"}) {
+		t.Fatalf("Expected a pinned skylink owned by bob, got %+v", sg)
+	}
+	status, err = tt.UnpinOwnerPOST(sl.String(), "bob")
+	if err != nil || status != http.StatusNoContent {
+		t.Fatal(status, err)
+	}
+	sg, _, err = tt.SkylinkGET(sl.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sg.Pinned || len(sg.Owners) != 0 {
+		t.Fatalf("Expected an unpinned skylink without owners, got %+v", sg)
+	}
 }
 
 // testHandlerSweep tests both "POST /sweep" and "GET /sweep/status"
@@ -173,8 +565,8 @@ func testHandlerSweep(t *testing.T, tt *test.Tester) {
 	sl1 := test.RandomSkylink()
 	sl2 := test.RandomSkylink()
 	sl3 := test.RandomSkylink()
-	_, e1 := tt.SkydClient.Pin(sl1.String())
-	_, e2 := tt.SkydClient.Pin(sl2.String())
+	_, e1 := tt.SkydClient.Pin(context.Background(), sl1.String(), true)
+	_, e2 := tt.SkydClient.Pin(context.Background(), sl2.String(), true)
 	_, e3 := tt.PinPOST(sl2.String())
 	_, e4 := tt.PinPOST(sl3.String())
 	if e := errors.Compose(e1, e2, e3, e4); e != nil {
@@ -212,13 +604,18 @@ func testHandlerSweep(t *testing.T, tt *test.Tester) {
 	if !sweepStatus.InProgress {
 		t.Fatal("Expected to detect a sweep")
 	}
-	// Start a sweep.
-	_, code, err = tt.SweepPOST()
-	if err != nil || code != http.StatusAccepted {
-		t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+	if sweepStatus.Queued {
+		t.Fatal("Expected no queued sweep")
+	}
+	// Start two more sweeps.
+	for i := 0; i < 2; i++ {
+		_, code, err = tt.SweepPOST()
+		if err != nil || code != http.StatusAccepted {
+			t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+		}
 	}
 	// Check status. Expect the sweep start time to be the same as before, i.e.
-	// no new sweep has been kicked off.
+	// no new sweep has been kicked off, but a follow-up one is queued.
 	initialSweepStartTime := sweepStatus.StartTime
 	sweepStatus, code, err = tt.SweepStatusGET()
 	if err != nil || code != http.StatusOK {
@@ -227,9 +624,30 @@ func testHandlerSweep(t *testing.T, tt *test.Tester) {
 	if !sweepStatus.InProgress {
 		t.Fatal("Expected to detect a sweep")
 	}
+	if !sweepStatus.Queued {
+		t.Fatal("Expected a queued sweep")
+	}
 	if !sweepStatus.StartTime.Equal(initialSweepStartTime) {
 		t.Fatalf("Expected the start time of the current scan to match the start time of the first scan we kicked off. Expected %v, got %v", initialSweepStartTime, sweepStatus.StartTime)
 	}
+	// Wait for the queued sweep to start. Expect the two requests to have been
+	// coalesced into a single follow-up sweep.
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		sweepStatus, code, err = tt.SweepStatusGET()
+		if err != nil || code != http.StatusOK {
+			return errors.AddContext(err, fmt.Sprintf("unexpected status code %d", code))
+		}
+		if sweepStatus.StartTime.Equal(initialSweepStartTime) {
+			return errors.New("the queued sweep hasn't started yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sweepStatus.Queued {
+		t.Fatal("Expected no further queued sweeps")
+	}
 	// Wait for the sweep to finish.
 	for sweepStatus.InProgress {
 		time.Sleep(100 * time.Millisecond)
@@ -256,4 +674,689 @@ func testHandlerSweep(t *testing.T, tt *test.Tester) {
 	if test.Contains(skylinks, sl3.String()) {
 		t.Fatalf("Expected %v NOT to contain %s", skylinks, sl3.String())
 	}
+	// Make sure the sweep recorded a heartbeat for the server.
+	info, err := tt.DB.ServerInfo(context.Background(), tt.ServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NumSkylinks != len(skylinks) {
+		t.Fatalf("Expected the heartbeat to report %d skylinks, got %d", len(skylinks), info.NumSkylinks)
+	}
+	if !info.LastSweepStart.Equal(sweepStatus.StartTime.Truncate(time.Millisecond)) {
+		t.Fatalf("Expected the heartbeat's sweep start %v to match the sweep's %v", info.LastSweepStart, sweepStatus.StartTime)
+	}
+}
+
+// testHandlerSweepInvalidSkylink ensures that a sweep doesn't insert invalid
+// skylinks reported by skyd into the database but reports them in its status.
+func testHandlerSweepInvalidSkylink(t *testing.T, tt *test.Tester) {
+	invalidSkylink := "this is not a valid skylink"
+	// The mock doesn't validate the skylinks it pins, so we can use it to make
+	// skyd report an invalid skylink.
+	_, err := tt.SkydClient.Pin(context.Background(), invalidSkylink, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code, err := tt.SweepPOST()
+	if err != nil || code != http.StatusAccepted {
+		t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+	}
+	// Wait for the sweep to finish.
+	var sweepStatus sweeper.Status
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		sweepStatus, code, err = tt.SweepStatusGET()
+		if err != nil || code != http.StatusOK {
+			return errors.AddContext(err, fmt.Sprintf("unexpected status code %d", code))
+		}
+		if sweepStatus.InProgress || sweepStatus.EndTime.IsZero() {
+			return errors.New("sweep still in progress")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sweepStatus.ErrorMessage != "" {
+		t.Fatalf("Unexpected sweep error: %v", sweepStatus.ErrorMessage)
+	}
+	// Make sure the invalid skylink was reported.
+	if sweepStatus.NumInvalidSkylinks != 1 {
+		t.Fatalf("Expected 1 invalid skylink, got %d", sweepStatus.NumInvalidSkylinks)
+	}
+	if !test.Contains(sweepStatus.InvalidSkylinksSample, invalidSkylink) {
+		t.Fatalf("Expected %v to contain '%s'", sweepStatus.InvalidSkylinksSample, invalidSkylink)
+	}
+	// Make sure the invalid skylink didn't make it into the database.
+	skylinks, err := tt.DB.SkylinksForServer(context.Background(), tt.ServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test.Contains(skylinks, invalidSkylink) {
+		t.Fatalf("Expected %v NOT to contain '%s'", skylinks, invalidSkylink)
+	}
+}
+
+// testHandlerSweepProgress ensures that the progress reported by "GET
+// /sweep/status" moves from 0 towards 100 during a sweep.
+func testHandlerSweepProgress(t *testing.T, tt *test.Tester) {
+	// Mock a filesystem, so the cache rebuild has directories to walk.
+	skydMock, ok := tt.SkydClient.(*skyd.ClientMock)
+	if !ok {
+		t.Fatal("Expected the tester to use a skyd mock.")
+	}
+	_ = skydMock.MockFilesystem()
+
+	_, code, err := tt.SweepPOST()
+	if err != nil || code != http.StatusAccepted {
+		t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+	}
+	// Poll the status until the sweep finishes and make sure that the
+	// progress never goes down.
+	var sweepStatus sweeper.Status
+	lastProgress := 0
+	err = build.Retry(1000, 10*time.Millisecond, func() error {
+		sweepStatus, code, err = tt.SweepStatusGET()
+		if err != nil || code != http.StatusOK {
+			return errors.AddContext(err, fmt.Sprintf("unexpected status code %d", code))
+		}
+		if sweepStatus.Progress < lastProgress || sweepStatus.Progress > 100 {
+			t.Fatalf("Unexpected progress %d after %d", sweepStatus.Progress, lastProgress)
+		}
+		lastProgress = sweepStatus.Progress
+		if sweepStatus.InProgress {
+			return errors.New("sweep still in progress")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sweepStatus.Phase != sweeper.PhaseDone || sweepStatus.Progress != 100 {
+		t.Fatalf("Expected phase '%s' and progress 100, got '%s' and %d", sweeper.PhaseDone, sweepStatus.Phase, sweepStatus.Progress)
+	}
+	if sweepStatus.DirsDiscovered == 0 || sweepStatus.DirsWalked != sweepStatus.DirsDiscovered {
+		t.Fatalf("Expected all discovered dirs to be walked, got %d out of %d", sweepStatus.DirsWalked, sweepStatus.DirsDiscovered)
+	}
+}
+
+// testHandlerSweepUnpinned ensures that a sweep doesn't add the server to
+// skylinks which the database marks as unpinned, reports them and unpins them
+// from skyd.
+func testHandlerSweepUnpinned(t *testing.T, tt *test.Tester) {
+	skydMock, ok := tt.SkydClient.(*skyd.ClientMock)
+	if !ok {
+		t.Fatal("Expected the tester to use a skyd mock.")
+	}
+	// Create a skylink pinned by another server and mark it as unpinned.
+	sl := test.RandomSkylink()
+	_, err := tt.DB.CreateSkylink(tt.Ctx, sl, "another-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tt.DB.MarkUnpinned(tt.Ctx, sl, tt.ServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make skyd pin it.
+	_, err = skydMock.Pin(context.Background(), sl.String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, code, err := tt.SweepPOST()
+	if err != nil || code != http.StatusAccepted {
+		t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+	}
+	// Wait for the sweep to finish.
+	var sweepStatus sweeper.Status
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		sweepStatus, code, err = tt.SweepStatusGET()
+		if err != nil || code != http.StatusOK {
+			return errors.AddContext(err, fmt.Sprintf("unexpected status code %d", code))
+		}
+		if sweepStatus.InProgress || sweepStatus.EndTime.IsZero() {
+			return errors.New("sweep still in progress")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sweepStatus.ErrorMessage != "" {
+		t.Fatalf("Unexpected sweep error: %v", sweepStatus.ErrorMessage)
+	}
+	// Make sure the skylink was reported and unpinned from skyd.
+	if sweepStatus.NumUnpinnedSkylinks != 1 || !test.Contains(sweepStatus.UnpinnedSkylinksSample, sl.String()) {
+		t.Fatalf("Expected '%s' to be reported as unpinned, got %+v", sl, sweepStatus)
+	}
+	if sweepStatus.NumUnpinnedFromSkyd != 1 {
+		t.Fatalf("Expected 1 skylink to be unpinned from skyd, got %d", sweepStatus.NumUnpinnedFromSkyd)
+	}
+	if skydMock.Pinning(sl.String()) {
+		t.Fatal("Expected skyd to no longer pin the skylink.")
+	}
+	// Make sure the server wasn't added to the skylink.
+	skylinks, err := tt.DB.SkylinksForServer(tt.Ctx, tt.ServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test.Contains(skylinks, sl.String()) {
+		t.Fatalf("Expected %v NOT to contain '%s'", skylinks, sl)
+	}
+}
+
+// testHandlerSweepBytes ensures that a sweep reports the size of the skylinks
+// it adds the server to and stores their sizes in the database.
+func testHandlerSweepBytes(t *testing.T, tt *test.Tester) {
+	skydMock, ok := tt.SkydClient.(*skyd.ClientMock)
+	if !ok {
+		t.Fatal("Expected the tester to use a skyd mock.")
+	}
+	// Make skyd pin a new skylink of known size.
+	sl := test.RandomSkylink()
+	size := uint64(1234)
+	skydMock.SetMetadata(sl.String(), skymodules.SkyfileMetadata{Length: size}, nil)
+	_, err := skydMock.Pin(context.Background(), sl.String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, code, err := tt.SweepPOST()
+	if err != nil || code != http.StatusAccepted {
+		t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+	}
+	// Wait for the sweep to finish.
+	var sweepStatus sweeper.Status
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		sweepStatus, code, err = tt.SweepStatusGET()
+		if err != nil || code != http.StatusOK {
+			return errors.AddContext(err, fmt.Sprintf("unexpected status code %d", code))
+		}
+		if sweepStatus.InProgress || sweepStatus.EndTime.IsZero() {
+			return errors.New("sweep still in progress")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sweepStatus.ErrorMessage != "" {
+		t.Fatalf("Unexpected sweep error: %v", sweepStatus.ErrorMessage)
+	}
+	// The new skylink is the only one the sweep added.
+	if sweepStatus.BytesAdded != size || sweepStatus.NumUnknownSizeAdded != 0 {
+		t.Fatalf("Expected %d bytes added, got %+v", size, sweepStatus)
+	}
+	// Make sure the size was stored in the database.
+	sizes, err := tt.DB.SkylinkSizes(tt.Ctx, []string{sl.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes[sl.String()] != size {
+		t.Fatalf("Expected a stored size of %d, got %v", size, sizes)
+	}
+}
+
+// testHandlerCacheGET tests "GET /cache".
+func testHandlerCacheGET(t *testing.T, tt *test.Tester) {
+	skydMock, ok := tt.SkydClient.(*skyd.ClientMock)
+	if !ok {
+		t.Fatal("Expected the tester to use a skyd mock.")
+	}
+	_, err := skydMock.Pin(context.Background(), test.RandomSkylink().String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Run a sweep, so the cache gets rebuilt.
+	start := time.Now()
+	_, code, err := tt.SweepPOST()
+	if err != nil || code != http.StatusAccepted {
+		t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+	}
+	var cache api.CacheGET
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		cache, code, err = tt.CacheGET()
+		if err != nil || code != http.StatusOK {
+			return errors.AddContext(err, fmt.Sprintf("unexpected status code %d", code))
+		}
+		if cache.LastRebuild == nil || cache.LastRebuild.Start.Before(start) {
+			return errors.New("cache not rebuilt yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.Size != skydMock.CacheSize() {
+		t.Fatalf("Expected a cache size of %d, got %d", skydMock.CacheSize(), cache.Size)
+	}
+	rb := cache.LastRebuild
+	if rb.End.Before(rb.Start) || rb.Duration != rb.End.Sub(rb.Start) || rb.Error != "" {
+		t.Fatalf("Unexpected rebuild info %+v", rb)
+	}
+}
+
+// testHandlerSweepSubtree ensures that a sweep limited to a subtree adds the
+// skylinks it finds and doesn't remove the ones it can't find.
+func testHandlerSweepSubtree(t *testing.T, tt *test.Tester) {
+	skydMock, ok := tt.SkydClient.(*skyd.ClientMock)
+	if !ok {
+		t.Fatal("Expected the tester to use a skyd mock.")
+	}
+	// Make skyd pin a new skylink.
+	slNew := test.RandomSkylink()
+	_, err := skydMock.Pin(context.Background(), slNew.String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mark a skylink as pinned by this server without pinning it in skyd.
+	// A full sweep would remove it.
+	slGone := test.RandomSkylink()
+	_, err = tt.PinPOST(slGone.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := skymodules.SkynetFolder.Path + "/foo"
+	_, code, err := tt.SweepSubtreePOST(path)
+	if err != nil || code != http.StatusAccepted {
+		t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+	}
+	// Wait for the sweep to finish.
+	var sweepStatus sweeper.Status
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		sweepStatus, code, err = tt.SweepStatusGET()
+		if err != nil || code != http.StatusOK {
+			return errors.AddContext(err, fmt.Sprintf("unexpected status code %d", code))
+		}
+		if sweepStatus.InProgress || sweepStatus.EndTime.IsZero() {
+			return errors.New("sweep still in progress")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sweepStatus.ErrorMessage != "" {
+		t.Fatalf("Unexpected sweep error: %v", sweepStatus.ErrorMessage)
+	}
+	if sweepStatus.Path.Path != path {
+		t.Fatalf("Expected the sweep to be limited to '%s', got '%s'", path, sweepStatus.Path)
+	}
+	skylinks, err := tt.DB.SkylinksForServer(tt.Ctx, tt.ServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !test.Contains(skylinks, slNew.String()) || !test.Contains(skylinks, slGone.String()) {
+		t.Fatalf("Expected %v to contain '%s' and '%s'", skylinks, slNew, slGone)
+	}
+
+	// Make sure we reject paths outside of the skynet folder.
+	r, err := tt.Request(http.MethodPost, "/sweep", url.Values{"path": []string{"var/other"}}, nil, nil, nil)
+	if err == nil || r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, r.StatusCode)
+	}
+}
+
+// testHandlerSweepTooManyRemovals ensures that a sweep refuses to remove the
+// server from most of its skylinks, e.g. when skyd reports an empty
+// filesystem, unless it's forced.
+func testHandlerSweepTooManyRemovals(t *testing.T, tt *test.Tester) {
+	// The tester's sweeper doesn't check the number of removals because the
+	// subtests share state, so we use a dedicated one with the default
+	// threshold which records its alerts.
+	var alerts []string
+	var mu sync.Mutex
+	alert := func(msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		alerts = append(alerts, msg)
+	}
+	numAlerts := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(alerts)
+	}
+	swpr := sweeper.New(tt.DB, tt.SkydClient, tt.ServerName, false, 50, alert, tt.Logger)
+	defer func() {
+		if err := swpr.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	// waitForSweep waits for the current sweep to finish and returns its
+	// status.
+	waitForSweep := func() sweeper.Status {
+		var st sweeper.Status
+		err := build.Retry(100, 100*time.Millisecond, func() error {
+			st = swpr.Status()
+			if st.InProgress || st.EndTime.IsZero() {
+				return errors.New("sweep still in progress")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	// Mark many skylinks as pinned by this server in the database without
+	// pinning them in skyd. From skyd's point of view they are all gone. This
+	// is way above the threshold, regardless of the skylinks left behind by
+	// other tests.
+	var sls []string
+	for i := 0; i < 20; i++ {
+		sl := test.RandomSkylink().String()
+		_, err := tt.PinPOST(sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sls = append(sls, sl)
+	}
+
+	// Sweep. Expect it to fail, alert the operator and leave the skylinks
+	// alone.
+	swpr.Sweep()
+	st := waitForSweep()
+	if !errors.Contains(st.Error, sweeper.ErrTooManyRemovals) {
+		t.Fatalf("Expected error '%v', got '%v'", sweeper.ErrTooManyRemovals, st.Error)
+	}
+	if numAlerts() != 1 {
+		t.Fatalf("Expected a single alert, got %d", numAlerts())
+	}
+	skylinks, err := tt.DB.SkylinksForServer(tt.Ctx, tt.ServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sl := range sls {
+		if !test.Contains(skylinks, sl) {
+			t.Fatalf("Expected %v to contain %s", skylinks, sl)
+		}
+	}
+
+	// Force a sweep. Expect it to succeed and remove the skylinks.
+	swpr.ForceSweep()
+	st = waitForSweep()
+	if st.Error != nil || !st.Forced {
+		t.Fatalf("Expected a successful forced sweep, got %+v", st)
+	}
+	if numAlerts() != 1 {
+		t.Fatalf("Expected no new alerts, got %d", numAlerts())
+	}
+	skylinks, err = tt.DB.SkylinksForServer(tt.Ctx, tt.ServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sl := range sls {
+		if test.Contains(skylinks, sl) {
+			t.Fatalf("Expected %v NOT to contain %s", skylinks, sl)
+		}
+	}
+
+	// Make sure that the API forwards the force parameter to the sweeper.
+	_, code, err := tt.SweepForcePOST()
+	if err != nil || code != http.StatusAccepted {
+		t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+	}
+	sweepStatus, _, err := tt.SweepStatusGET()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sweepStatus.Forced {
+		t.Fatal("Expected a forced sweep.")
+	}
+	r, err := tt.Request(http.MethodPost, "/sweep", url.Values{"force": []string{"maybe"}}, nil, nil, nil)
+	if err == nil || r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, r.StatusCode)
+	}
+}
+
+// testHandlerReconcileAccounts tests the "POST /reconcile/accounts", "GET
+// /reconcile/accounts/status" and "GET /reconcile/accounts/latest" handlers.
+func testHandlerReconcileAccounts(t *testing.T, tt *test.Tester) {
+	// There are no drift reports yet.
+	_, code, err := tt.ReconcileAccountsLatestGET()
+	if code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d, %v", http.StatusNotFound, code, err)
+	}
+	r, err := tt.Request(http.MethodPost, "/reconcile/accounts", url.Values{"dry_run": []string{"maybe"}}, nil, nil, nil)
+	if err == nil || r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, r.StatusCode)
+	}
+
+	// We'll have 3 skylinks:
+	// 1 is marked as unpinned in the database but a user pins it
+	// 2 is unknown to the database but a user pins it
+	// 3 is marked as pinned in the database but no user pins it
+	// Accounts also reports an invalid skylink, which we ignore.
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+	sl3 := test.RandomSkylink()
+	_, e1 := tt.PinPOST(sl1.String())
+	_, e2 := tt.UnpinPOST(sl1.String())
+	_, e3 := tt.PinPOST(sl3.String())
+	if e := errors.Compose(e1, e2, e3); e != nil {
+		t.Fatal(e)
+	}
+	tt.Accounts.SetPinnedSkylinks([]string{sl1.String(), "invalid", sl2.String(), sl1.String()})
+
+	// reconcile runs a reconciliation and waits for it to finish.
+	reconcile := func(dryRun bool) accounts.ReconcileStatus {
+		rr, code, err := tt.ReconcileAccountsPOST(dryRun)
+		if err != nil || code != http.StatusAccepted {
+			t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+		}
+		if rr.Href != "/reconcile/accounts/status" {
+			t.Fatalf("Unexpected href: '%s'", rr.Href)
+		}
+		var rs accounts.ReconcileStatus
+		err = build.Retry(100, 10*time.Millisecond, func() error {
+			rs, code, err = tt.ReconcileAccountsStatusGET()
+			if err != nil || code != http.StatusOK {
+				return errors.AddContext(err, fmt.Sprintf("unexpected status code %d", code))
+			}
+			if rs.InProgress || rs.EndTime.IsZero() {
+				return errors.New("reconciliation still in progress")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs.ErrorMessage != "" {
+			t.Fatalf("Unexpected error: %s", rs.ErrorMessage)
+		}
+		if rs.DryRun != dryRun {
+			t.Fatalf("Expected DryRun to be %t", dryRun)
+		}
+		if rs.NumAccountsSkylinks != 2 || rs.NumInvalidSkylinks != 1 {
+			t.Fatalf("Expected 2 valid and 1 invalid skylinks from accounts, got %d and %d", rs.NumAccountsSkylinks, rs.NumInvalidSkylinks)
+		}
+		if !reflect.DeepEqual(rs.InvalidSample, []string{"invalid"}) {
+			t.Fatalf("Unexpected invalid sample %v", rs.InvalidSample)
+		}
+		if rs.NumUnpinned != 1 || !reflect.DeepEqual(rs.UnpinnedSample, []string{sl1.String()}) {
+			t.Fatalf("Expected skylink 1 to be unpinned, got %d %v", rs.NumUnpinned, rs.UnpinnedSample)
+		}
+		if rs.NumMissing != 1 || !reflect.DeepEqual(rs.MissingSample, []string{sl2.String()}) {
+			t.Fatalf("Expected skylink 2 to be missing, got %d %v", rs.NumMissing, rs.MissingSample)
+		}
+		// The other subtests leave pinned skylinks behind, so we can't tell
+		// exactly how many are unreferenced.
+		if rs.NumUnreferenced < 1 || len(rs.UnreferencedSample) < 1 {
+			t.Fatalf("Expected at least 1 unreferenced skylink, got %d", rs.NumUnreferenced)
+		}
+
+		// The report is stored.
+		report, code, err := tt.ReconcileAccountsLatestGET()
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+		}
+		// The database keeps times with millisecond precision.
+		expected := rs.DriftReport
+		if !report.StartTime.Equal(expected.StartTime.Truncate(time.Millisecond)) || !report.EndTime.Equal(expected.EndTime.Truncate(time.Millisecond)) {
+			t.Fatalf("Expected report from %v to %v, got %v to %v", expected.StartTime, expected.EndTime, report.StartTime, report.EndTime)
+		}
+		report.StartTime, report.EndTime = expected.StartTime, expected.EndTime
+		if !reflect.DeepEqual(report, expected) {
+			t.Fatalf("Expected report %+v, got %+v", expected, report)
+		}
+		return rs
+	}
+
+	// A dry run doesn't change anything.
+	rs := reconcile(true)
+	if rs.NumMarkedPinned != 0 || rs.NumAdded != 0 {
+		t.Fatalf("Expected no changes, got %d skylinks marked as pinned and %d added", rs.NumMarkedPinned, rs.NumAdded)
+	}
+	s, err := tt.DB.FindSkylink(tt.Ctx, sl1)
+	if err != nil || s.Pinned {
+		t.Fatalf("Expected skylink 1 to still be unpinned, got %+v, %v", s, err)
+	}
+	_, err = tt.DB.FindSkylink(tt.Ctx, sl2)
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+
+	rs = reconcile(false)
+	if rs.NumMarkedPinned != 1 || rs.NumAdded != 1 {
+		t.Fatalf("Expected 1 skylink marked as pinned and 1 added, got %d and %d", rs.NumMarkedPinned, rs.NumAdded)
+	}
+	// Skylinks 1 and 2 are pinned now and 3 is left as it was.
+	for _, sl := range []skymodules.Skylink{sl1, sl2, sl3} {
+		s, err := tt.DB.FindSkylink(tt.Ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.Pinned {
+			t.Fatalf("Expected skylink '%s' to be marked as pinned", sl)
+		}
+	}
+	s, err = tt.DB.FindSkylink(tt.Ctx, sl2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Servers) != 0 {
+		t.Fatalf("Expected the added skylink to have no servers, got %v", s.Servers)
+	}
+}
+
+// testHandlerAccountsHookPOST tests the "POST /hooks/accounts" handler.
+func testHandlerAccountsHookPOST(t *testing.T, tt *test.Tester) {
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+	for _, sl := range []skymodules.Skylink{sl1, sl2} {
+		if _, err := tt.PinPOST(sl.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body, err := json.Marshal(api.AccountsHookPOST{Skylinks: []string{sl1.String(), sl2.String(), test.RandomSkylink().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// assertPinned fails the test unless both skylinks are marked as pinned
+	// or both as unpinned, as given.
+	assertPinned := func(pinned bool) {
+		t.Helper()
+		for _, sl := range []skymodules.Skylink{sl1, sl2} {
+			s, err := tt.DB.FindSkylink(tt.Ctx, sl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Pinned != pinned {
+				t.Fatalf("Expected skylink '%s' to have pinned %t, got %t", sl, pinned, s.Pinned)
+			}
+		}
+	}
+
+	// A request with an invalid signature is rejected.
+	now := time.Now().Unix()
+	_, code, err := tt.AccountsHookPOST(body, now, api.SignAccountsHook("wrong secret", now, body))
+	if code != http.StatusUnauthorized || err == nil || !strings.Contains(err.Error(), api.ErrInvalidSignature.Error()) {
+		t.Fatalf("Expected %d and '%v', got %d and '%v'", http.StatusUnauthorized, api.ErrInvalidSignature, code, err)
+	}
+	// So is a request whose body doesn't match the signature.
+	_, code, err = tt.AccountsHookPOST(append(body, ' '), now, api.SignAccountsHook(test.AccountsHookSecret, now, body))
+	if code != http.StatusUnauthorized || err == nil || !strings.Contains(err.Error(), api.ErrInvalidSignature.Error()) {
+		t.Fatalf("Expected %d and '%v', got %d and '%v'", http.StatusUnauthorized, api.ErrInvalidSignature, code, err)
+	}
+	assertPinned(true)
+
+	// A validly signed request replayed after the accepted window is
+	// rejected. So is one signed too far in the future.
+	for _, ts := range []int64{now - 3600, now + 3600} {
+		_, code, err = tt.AccountsHookPOST(body, ts, api.SignAccountsHook(test.AccountsHookSecret, ts, body))
+		if code != http.StatusUnauthorized || err == nil || !strings.Contains(err.Error(), api.ErrStaleRequest.Error()) {
+			t.Fatalf("Expected %d and '%v', got %d and '%v'", http.StatusUnauthorized, api.ErrStaleRequest, code, err)
+		}
+	}
+	assertPinned(true)
+
+	// A valid request unpins the skylinks we know about.
+	resp, code, err := tt.AccountsHookPOST(body, now, api.SignAccountsHook(test.AccountsHookSecret, now, body))
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("Unexpected status code or error: %d %+v", code, err)
+	}
+	if resp.Matched != 2 || resp.Unpinned != 2 {
+		t.Fatalf("Expected 2 matched and 2 unpinned skylinks, got %+v", resp)
+	}
+	assertPinned(false)
+}
+
+// testHandlerServersRepair tests "POST /servers/repair".
+func testHandlerServersRepair(t *testing.T, tt *test.Tester) {
+	r, err := tt.Request(http.MethodPost, "/servers/repair", url.Values{"dry_run": []string{"maybe"}}, nil, nil, nil)
+	if err == nil || r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, r.StatusCode)
+	}
+
+	// The current server pins a skylink which an older version of pinner
+	// also marked as pinned under a capitalized name. The validated writes
+	// reject that name, so we write it directly.
+	sl := test.RandomSkylink()
+	_, err = tt.PinPOST(sl.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := test.NewRawDBClient(tt.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := c.Disconnect(tt.Ctx); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	capitalized := strings.ToUpper(tt.ServerName)
+	coll := c.Database(test.SanitizeName("TestHandlers")).Collection("skylinks")
+	_, err = coll.UpdateOne(tt.Ctx, bson.M{"_id": sl.String()}, bson.M{"$set": bson.M{"servers": bson.A{capitalized, tt.ServerName}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []database.ServerNameMerge{{From: capitalized, To: tt.ServerName}}
+	for _, dryRun := range []bool{true, false} {
+		repair, code, err := tt.ServersRepairPOST(dryRun)
+		if err != nil || code != http.StatusOK {
+			t.Fatal(code, err)
+		}
+		if !reflect.DeepEqual(repair.Merges, expected) {
+			t.Fatalf("Dry run %t: expected merges %v, got %v", dryRun, expected, repair.Merges)
+		}
+	}
+	info, code, err := tt.SkylinkGET(sl.String())
+	if err != nil || code != http.StatusOK {
+		t.Fatal(code, err)
+	}
+	if !reflect.DeepEqual(info.Servers, []string{tt.ServerName}) {
+		t.Fatalf("Expected only '%s' to pin the skylink, got %v", tt.ServerName, info.Servers)
+	}
+	// There is nothing left to merge.
+	repair, code, err := tt.ServersRepairPOST(false)
+	if err != nil || code != http.StatusOK {
+		t.Fatal(code, err)
+	}
+	if len(repair.Merges) != 0 {
+		t.Fatalf("Expected no merges, got %v", repair.Merges)
+	}
 }
@@ -0,0 +1,696 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skynetlabs/pinner/conf"
+	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/test"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestParseConfigValues ensures that the typed configuration parsers accept
+// only valid values within bounds.
+func TestParseConfigValues(t *testing.T) {
+	t.Parallel()
+
+	boolTests := []struct {
+		val   string
+		b     bool
+		valid bool
+	}{
+		{val: "true", b: true, valid: true},
+		{val: "false", valid: true},
+		{val: "1", b: true, valid: true},
+		{val: "yes"},
+		{val: ""},
+	}
+	for _, tst := range boolTests {
+		b, err := database.ParseConfigBool("key", tst.val)
+		if tst.valid && (err != nil || b != tst.b) {
+			t.Fatalf("Expected '%s' to parse as %t, got %t and '%v'", tst.val, tst.b, b, err)
+		}
+		if !tst.valid && !errors.Contains(err, database.ErrInvalidConfigValue) {
+			t.Fatalf("Expected '%s' to be rejected with '%v', got '%v'", tst.val, database.ErrInvalidConfigValue, err)
+		}
+	}
+
+	intTests := []struct {
+		val   string
+		i     int
+		valid bool
+	}{
+		{val: "1", i: 1, valid: true},
+		{val: "5", i: 5, valid: true},
+		{val: "10", i: 10, valid: true},
+		{val: "0"},
+		{val: "11"},
+		{val: "-1"},
+		{val: "1.5"},
+		{val: "one"},
+		{val: ""},
+	}
+	for _, tst := range intTests {
+		i, err := database.ParseConfigInt("key", tst.val, 1, 10)
+		if tst.valid && (err != nil || i != tst.i) {
+			t.Fatalf("Expected '%s' to parse as %d, got %d and '%v'", tst.val, tst.i, i, err)
+		}
+		if !tst.valid && !errors.Contains(err, database.ErrInvalidConfigValue) {
+			t.Fatalf("Expected '%s' to be rejected with '%v', got '%v'", tst.val, database.ErrInvalidConfigValue, err)
+		}
+	}
+
+	durationTests := []struct {
+		val   string
+		d     time.Duration
+		valid bool
+	}{
+		{val: "1m", d: time.Minute, valid: true},
+		{val: "1h30m", d: 90 * time.Minute, valid: true},
+		{val: "2h", d: 2 * time.Hour, valid: true},
+		{val: "59s"},
+		{val: "2h1s"},
+		{val: "60"},
+		{val: ""},
+	}
+	for _, tst := range durationTests {
+		d, err := database.ParseConfigDuration("key", tst.val, time.Minute, 2*time.Hour)
+		if tst.valid && (err != nil || d != tst.d) {
+			t.Fatalf("Expected '%s' to parse as %v, got %v and '%v'", tst.val, tst.d, d, err)
+		}
+		if !tst.valid && !errors.Contains(err, database.ErrInvalidConfigValue) {
+			t.Fatalf("Expected '%s' to be rejected with '%v', got '%v'", tst.val, database.ErrInvalidConfigValue, err)
+		}
+	}
+
+	floatTests := []struct {
+		val   string
+		f     float64
+		valid bool
+	}{
+		{val: "1", f: 1, valid: true},
+		{val: "2.5", f: 2.5, valid: true},
+		{val: "10", f: 10, valid: true},
+		{val: "0.99"},
+		{val: "10.01"},
+		{val: "NaN"},
+		{val: "Inf"},
+		{val: "two"},
+		{val: ""},
+	}
+	for _, tst := range floatTests {
+		f, err := database.ParseConfigFloat("key", tst.val, 1, 10)
+		if tst.valid && (err != nil || f != tst.f) {
+			t.Fatalf("Expected '%s' to parse as %v, got %v and '%v'", tst.val, tst.f, f, err)
+		}
+		if !tst.valid && !errors.Contains(err, database.ErrInvalidConfigValue) {
+			t.Fatalf("Expected '%s' to be rejected with '%v', got '%v'", tst.val, database.ErrInvalidConfigValue, err)
+		}
+	}
+}
+
+// TestConfigValueTyped ensures that the typed configuration getters return the
+// defaults for the values which are not set and reject the invalid ones.
+func TestConfigValueTyped(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.ConfigValueBool(ctx, "bool", true)
+	if err != nil || !b {
+		t.Fatalf("Expected the default, got %t and '%v'", b, err)
+	}
+	i, err := db.ConfigValueInt(ctx, "int", 3, 1, 10)
+	if err != nil || i != 3 {
+		t.Fatalf("Expected the default, got %d and '%v'", i, err)
+	}
+	d, err := db.ConfigValueDuration(ctx, "duration", time.Hour, time.Minute, 2*time.Hour)
+	if err != nil || d != time.Hour {
+		t.Fatalf("Expected the default, got %v and '%v'", d, err)
+	}
+
+	for key, val := range map[string]string{"bool": "false", "int": "7", "duration": "5m"} {
+		err = db.SetConfigValue(ctx, key, val)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err = db.ConfigValueBool(ctx, "bool", true)
+	if err != nil || b {
+		t.Fatalf("Expected false, got %t and '%v'", b, err)
+	}
+	i, err = db.ConfigValueInt(ctx, "int", 3, 1, 10)
+	if err != nil || i != 7 {
+		t.Fatalf("Expected 7, got %d and '%v'", i, err)
+	}
+	d, err = db.ConfigValueDuration(ctx, "duration", time.Hour, time.Minute, 2*time.Hour)
+	if err != nil || d != 5*time.Minute {
+		t.Fatalf("Expected 5m, got %v and '%v'", d, err)
+	}
+	_, err = db.ConfigValueInt(ctx, "int", 3, 1, 5)
+	if !errors.Contains(err, database.ErrInvalidConfigValue) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidConfigValue, err)
+	}
+}
+
+// TestConfigCache ensures that a DB with a config cache serves the values it
+// cached until they expire or we invalidate them.
+func TestConfigCache(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	cached, err := test.NewDatabase(ctx, t.Name(), database.WithConfigCacheTTL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncached, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("configuration")
+	// setRaw sets the value without going through either DB, like another
+	// instance would.
+	setRaw := func(key, val string) {
+		t.Helper()
+		_, err := coll.UpdateOne(ctx, bson.M{"key": key}, bson.M{"$set": bson.M{"value": val}}, options.Update().SetUpsert(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// expectInt fails the test if the DB doesn't return the given value.
+	expectInt := func(step string, db *database.DB, expected int) {
+		t.Helper()
+		i, err := db.ConfigValueInt(ctx, "key", 1, 1, 10)
+		if err != nil {
+			t.Fatal(step, err)
+		}
+		if i != expected {
+			t.Fatalf("%s: expected %d, got %d", step, expected, i)
+		}
+	}
+
+	// Values which are not set are cached as well.
+	expectInt("default", cached, 1)
+	setRaw("key", "2")
+	expectInt("cached default", cached, 1)
+	expectInt("uncached", uncached, 2)
+	cached.InvalidateConfigCache()
+	expectInt("invalidated", cached, 2)
+	setRaw("key", "3")
+	expectInt("cached value", cached, 2)
+	// Setting a value through the DB invalidates its cache.
+	err = cached.SetConfigValue(ctx, "key", "4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectInt("set", cached, 4)
+}
+
+// TestWatchConfig ensures that WatchConfig reports the configuration changes
+// made by other instances and that it drops the changed values from the cache.
+func TestWatchConfig(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db, err := test.NewDatabase(ctx, t.Name(), database.WithConfigCacheTTL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cache the current value.
+	i, err := db.ConfigValueInt(ctx, "key", 1, 1, 10)
+	if err != nil || i != 1 {
+		t.Fatalf("Expected the default, got %d and '%v'", i, err)
+	}
+	updates, err := db.WatchConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, val := range []string{"2", "3"} {
+		err = other.SetConfigValue(ctx, "key", val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case u := <-updates:
+			if u.Key != "key" || u.Value != val {
+				t.Fatalf("Expected key = '%s', got %+v", val, u)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for the change.")
+		}
+	}
+	i, err = db.ConfigValueInt(ctx, "key", 1, 1, 10)
+	if err != nil || i != 3 {
+		t.Fatalf("Expected the new value, got %d and '%v'", i, err)
+	}
+	// Deleting the value drops it from the cache, even though we don't get
+	// an update for it.
+	err = other.DeleteConfigValue(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		i, err := db.ConfigValueInt(ctx, "key", 1, 1, 10)
+		if err != nil || i != 1 {
+			return fmt.Errorf("expected the default, got %d and '%v'", i, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expect the channel to close once we cancel the context.
+	cancel()
+	select {
+	case _, ok := <-updates:
+		if ok {
+			t.Fatal("Expected no more changes.")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the channel to close.")
+	}
+}
+
+// TestConfigExport ensures that the configuration values survive a round trip
+// through AllConfig and SetConfigValues, including the ones with keys we don't
+// know, and that the internal values stay out of it.
+func TestConfigExport(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	src, err := test.NewDatabase(ctx, t.Name()+"_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := test.NewDatabase(ctx, t.Name()+"_dst", database.WithConfigCacheTTL(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{
+		"min_pinners":          "3",
+		"dry_run":              "true",
+		"some_future_setting":  "whatever",
+		"another_future_value": "",
+	}
+	for key, val := range values {
+		err = src.SetConfigValue(ctx, key, val)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	exported, err := src.AllConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exported, values) {
+		t.Fatalf("Expected %v, got %v", values, exported)
+	}
+
+	// Cache a value in the destination, so we know the import invalidates it.
+	err = dst.SetConfigValue(ctx, "min_pinners", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dst.SetConfigValue(ctx, "untouched", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dst.ConfigValue(ctx, "min_pinners"); err != nil {
+		t.Fatal(err)
+	}
+	err = dst.SetConfigValues(ctx, exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := dst.AllConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values["untouched"] = "value"
+	if !reflect.DeepEqual(imported, values) {
+		t.Fatalf("Expected %v, got %v", values, imported)
+	}
+	val, err := dst.ConfigValue(ctx, "min_pinners")
+	if err != nil || val != "3" {
+		t.Fatalf("Expected '3', got '%s' and '%v'", val, err)
+	}
+
+	// The internal values can't be imported.
+	err = dst.SetConfigValues(ctx, map[string]string{"schema_version": "1"})
+	if !errors.Contains(err, database.ErrInternalConfigKey) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInternalConfigKey, err)
+	}
+	v, err := dst.SchemaVersion(ctx)
+	if err != nil || v != database.LatestSchemaVersion() {
+		t.Fatalf("Expected schema version %d, got %d and '%v'", database.LatestSchemaVersion(), v, err)
+	}
+}
+
+// TestConfigImportConcurrent ensures that importing configuration values while
+// other instances set them leaves a single, consistent value per key.
+func TestConfigImportConcurrent(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		imported[fmt.Sprintf("key_%d", i)] = "imported"
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(imported)+1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs <- db.SetConfigValues(ctx, imported)
+	}()
+	for key := range imported {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			errs <- other.SetConfigValue(ctx, key, "set")
+		}(key)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	values, err := db.AllConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(imported) {
+		t.Fatalf("Expected %d values, got %d", len(imported), len(values))
+	}
+	for key, val := range values {
+		if val != "imported" && val != "set" {
+			t.Fatalf("Unexpected value '%s' of key '%s'", val, key)
+		}
+	}
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	n, err := c.Database(test.SanitizeName(t.Name())).Collection("configuration").CountDocuments(ctx, bson.M{"key": bson.M{"$regex": "^key_"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(imported)) {
+		t.Fatalf("Expected a single document per key, got %d documents", n)
+	}
+}
+
+// TestDeleteConfigValue ensures that deleting a configuration value resets it
+// to its default and that we refuse to delete the internal ones.
+func TestDeleteConfigValue(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name(), database.WithConfigCacheTTL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defMinPinners, err := conf.MinPinners(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetConfigValue(ctx, conf.ConfMinPinners, fmt.Sprint(defMinPinners+2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetConfigValue(ctx, conf.ConfDryRun, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read the values, so they get cached.
+	mp, err := conf.MinPinners(ctx, db)
+	if err != nil || mp != defMinPinners+2 {
+		t.Fatalf("Expected %d, got %d and '%v'", defMinPinners+2, mp, err)
+	}
+	dryRun, err := conf.DryRun(ctx, db)
+	if err != nil || !dryRun {
+		t.Fatalf("Expected dry_run to be set, got %t and '%v'", dryRun, err)
+	}
+
+	for _, key := range []string{conf.ConfMinPinners, conf.ConfDryRun} {
+		err = db.DeleteConfigValue(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mp, err = conf.MinPinners(ctx, db)
+	if err != nil || mp != defMinPinners {
+		t.Fatalf("Expected the default %d, got %d and '%v'", defMinPinners, mp, err)
+	}
+	dryRun, err = conf.DryRun(ctx, db)
+	if err != nil || dryRun {
+		t.Fatalf("Expected the default dry_run, got %t and '%v'", dryRun, err)
+	}
+	values, err := db.AllConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := values[conf.ConfMinPinners]; exists {
+		t.Fatalf("Expected min_pinners to be deleted, got %v", values)
+	}
+
+	// Deleting a value which isn't set fails.
+	err = db.DeleteConfigValue(ctx, conf.ConfMinPinners)
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		t.Fatalf("Expected '%v', got '%v'", mongo.ErrNoDocuments, err)
+	}
+	// So does deleting an internal value or an empty key.
+	err = db.DeleteConfigValue(ctx, "schema_version")
+	if !errors.Contains(err, database.ErrInternalConfigKey) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInternalConfigKey, err)
+	}
+	err = db.DeleteConfigValue(ctx, "")
+	if !errors.Contains(err, database.ErrInvalidConfigValue) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidConfigValue, err)
+	}
+}
+
+// TestDryRunForServer ensures that a server's own dry_run value takes
+// precedence over the cluster-wide one and that the servers without one fall
+// back to the cluster-wide value.
+func TestDryRunForServer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server1"
+	other := "server2"
+	expectDryRun := func(server string, expected bool) {
+		t.Helper()
+		dryRun, err := conf.DryRunForServer(ctx, db, server)
+		if err != nil || dryRun != expected {
+			t.Fatalf("Expected dry_run %t for '%s', got %t and '%v'", expected, server, dryRun, err)
+		}
+	}
+	setConfig := func(key, val string) {
+		t.Helper()
+		if err := db.SetConfigValue(ctx, key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is set, so the default applies.
+	expectDryRun(server, false)
+	// The cluster-wide value applies to all servers.
+	setConfig(conf.ConfDryRun, "true")
+	expectDryRun(server, true)
+	expectDryRun(other, true)
+	// A server's own value overrides it, only for that server.
+	setConfig(conf.DryRunKey(server), "false")
+	expectDryRun(server, false)
+	expectDryRun(other, true)
+	// It does so in both directions.
+	setConfig(conf.ConfDryRun, "false")
+	setConfig(conf.DryRunKey(server), "true")
+	expectDryRun(server, true)
+	expectDryRun(other, false)
+	// Once we delete it, the server falls back to the cluster-wide value.
+	err = db.DeleteConfigValue(ctx, conf.DryRunKey(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDryRun(server, false)
+	// An invalid value is an error, rather than a silent fallback.
+	setConfig(conf.DryRunKey(server), "maybe")
+	_, err = conf.DryRunForServer(ctx, db, server)
+	if !errors.Contains(err, database.ErrInvalidConfigValue) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidConfigValue, err)
+	}
+}
+
+// TestConfigValues ensures that ConfigValues returns the values which are set
+// and leaves out the ones which aren't, both from the database and from the
+// cache.
+func TestConfigValues(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name(), database.WithConfigCacheTTL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetConfigValues(ctx, map[string]string{"a": "1", "b": "2", "c": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cache one of the values and one of the missing ones.
+	if _, err = db.ConfigValue(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.ConfigValue(ctx, "x"); !errors.Contains(err, mongo.ErrNoDocuments) {
+		t.Fatalf("Expected '%v', got '%v'", mongo.ErrNoDocuments, err)
+	}
+	expected := map[string]string{"a": "1", "b": "2"}
+	for i := 0; i < 2; i++ {
+		values, err := db.ConfigValues(ctx, "a", "b", "x", "y")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Fatalf("%d: expected %v, got %v", i, expected, values)
+		}
+	}
+	values, err := db.ConfigValues(ctx)
+	if err != nil || len(values) != 0 {
+		t.Fatalf("Expected no values, got %v and '%v'", values, err)
+	}
+}
+
+// TestLoadClusterConfig ensures that LoadClusterConfig combines the values
+// which are set with the defaults of the ones which aren't and that it rejects
+// invalid values.
+func TestLoadClusterConfig(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server1"
+	cc, values, err := conf.LoadClusterConfig(ctx, db, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Fatalf("Expected no values, got %v", values)
+	}
+	if !reflect.DeepEqual(cc, conf.DefaultClusterConfig()) {
+		t.Fatalf("Expected the defaults %+v, got %+v", conf.DefaultClusterConfig(), cc)
+	}
+
+	err = db.SetConfigValues(ctx, map[string]string{
+		conf.ConfMinPinners:        "3",
+		conf.ConfMaxPinsPerCycle:   "20",
+		conf.DryRunKey(server):     "true",
+		conf.DryRunKey("server2"):  "false",
+		conf.ConfPinDeadlineFactor: "1.5",
+		"some_unrelated_setting":   "value",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, values, err = conf.LoadClusterConfig(ctx, db, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the values of the server's settings are there.
+	if len(values) != 4 || values[conf.DryRunKey(server)] != "true" {
+		t.Fatalf("Unexpected values %v", values)
+	}
+	expected := conf.DefaultClusterConfig()
+	expected.MinPinners = 3
+	expected.MaxPinsPerCycle = 20
+	expected.DryRun = true
+	expected.PinDeadlineFactor = 1.5
+	if !reflect.DeepEqual(cc, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, cc)
+	}
+
+	err = db.SetConfigValue(ctx, conf.ConfSleepBetweenPins, "a while")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conf.LoadClusterConfig(ctx, db, server)
+	if !errors.Contains(err, database.ErrInvalidConfigValue) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidConfigValue, err)
+	}
+}
@@ -0,0 +1,215 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/test"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// TestReportingReadPref ensures that the reporting queries read with the
+// reporting read preference while the other reads keep the default one. We
+// can't tell which member of the replica set served the reads, so we check the
+// read preference we send with the commands.
+func TestReportingReadPref(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// modes records the read preference of each command we send.
+	var mu sync.Mutex
+	modes := make(map[string]string)
+	monitor := &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			var cmd struct {
+				ReadPref struct {
+					Mode string `bson:"mode"`
+				} `bson:"$readPreference"`
+			}
+			if err := bson.Unmarshal(e.Command, &cmd); err != nil {
+				return
+			}
+			mu.Lock()
+			modes[e.CommandName] = cmd.ReadPref.Mode
+			mu.Unlock()
+		},
+	}
+	// modeOf returns the read preference of the last command with the
+	// given name.
+	modeOf := func(name string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return modes[name]
+	}
+
+	ctx := context.Background()
+	opts := []database.Option{
+		database.WithCommandMonitor(monitor),
+		database.WithReportingReadPref(readpref.PrimaryPreferredMode),
+	}
+	db, err := database.NewCustomDB(ctx, test.SanitizeName(t.Name()), test.DBTestCredentials(), test.NewDiscardLogger(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := modeOf("find"); mode == "primaryPreferred" {
+		t.Fatalf("Expected FindSkylink to keep the default read preference, got '%s'", mode)
+	}
+	_, err = db.AllServerLoads(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := modeOf("find"); mode != "primaryPreferred" {
+		t.Fatalf("Expected AllServerLoads to read with primaryPreferred, got '%s'", mode)
+	}
+	_, err = db.CountsByPinnerCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := modeOf("aggregate"); mode != "primaryPreferred" {
+		t.Fatalf("Expected CountsByPinnerCount to read with primaryPreferred, got '%s'", mode)
+	}
+	// CountUnderpinned is an aggregate as well.
+	mu.Lock()
+	delete(modes, "aggregate")
+	mu.Unlock()
+	_, err = db.CountUnderpinned(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := modeOf("aggregate"); mode != "primaryPreferred" {
+		t.Fatalf("Expected CountUnderpinned to read with primaryPreferred, got '%s'", mode)
+	}
+}
+
+// TestCommandStats ensures that the DB records the commands it sends to the
+// database and that it still notifies the custom command monitor.
+func TestCommandStats(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	var mu sync.Mutex
+	succeeded := 0
+	monitor := &event.CommandMonitor{
+		Succeeded: func(_ context.Context, _ *event.CommandSucceededEvent) {
+			mu.Lock()
+			succeeded++
+			mu.Unlock()
+		},
+	}
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name(), database.WithCommandMonitor(monitor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := db.CommandStats()
+
+	sl := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.FindSkylink(ctx, test.RandomSkylink())
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+
+	after := db.CommandStats()
+	if n := after["find"].Commands - before["find"].Commands; n != 2 {
+		t.Fatalf("Expected 2 more find commands, got %d", n)
+	}
+	if after["insert"].Commands <= before["insert"].Commands {
+		t.Fatalf("Expected more insert commands, got %d", after["insert"].Commands)
+	}
+	if after["find"].Failures != before["find"].Failures {
+		t.Fatalf("Expected no failed find commands, got %d", after["find"].Failures)
+	}
+	if after["find"].TotalDuration <= before["find"].TotalDuration {
+		t.Fatal("Expected the find commands to take some time")
+	}
+	if len(after) > 32+1 {
+		t.Fatalf("Expected the number of command names to be capped, got %d", len(after))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if succeeded == 0 {
+		t.Fatal("Expected the custom monitor to be notified")
+	}
+}
+
+// TestConnectionURI ensures that we can connect to the database via a
+// connection string, with or without credentials of its own, and that we
+// reject invalid connection strings.
+func TestConnectionURI(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	creds := test.DBTestCredentials()
+	dbName := test.SanitizeName(t.Name())
+	logger := test.NewDiscardLogger()
+
+	invalid := []string{
+		fmt.Sprintf("%s:%s", creds.Host, creds.Port),
+		fmt.Sprintf("http://%s:%s", creds.Host, creds.Port),
+		"mongodb://",
+		fmt.Sprintf("mongodb://%s:%s/?maxPoolSize=many", creds.Host, creds.Port),
+		"mongodb+srv://cluster.example.com:27017",
+	}
+	for _, uri := range invalid {
+		_, err := database.NewCustomDB(ctx, dbName, database.DBCredentials{URI: uri}, logger)
+		if err == nil || !strings.Contains(err.Error(), database.ErrCtxInvalidURI) {
+			t.Fatalf("Expected '%s' to be rejected as invalid, got '%v'", uri, err)
+		}
+	}
+
+	valid := []database.DBCredentials{
+		// The URI holds the credentials.
+		{URI: fmt.Sprintf("mongodb://%s:%s@%s:%s/?authSource=admin", creds.User, creds.Password, creds.Host, creds.Port)},
+		// The URI only holds the hosts, the credentials come separately.
+		{URI: fmt.Sprintf("mongodb://%s:%s/?authSource=admin", creds.Host, creds.Port), User: creds.User, Password: creds.Password},
+		// The URI overrides the host and port.
+		{URI: fmt.Sprintf("mongodb://%s:%s/", creds.Host, creds.Port), User: creds.User, Password: creds.Password, Host: "invalid", Port: "1"},
+	}
+	for i, c := range valid {
+		db, err := database.NewCustomDB(ctx, dbName, c, logger)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		sl := test.RandomSkylink()
+		_, err = db.CreateSkylink(ctx, sl, "server")
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		_, err = db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/test"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TestDriftReports ensures that LatestDriftReport returns the most recent of
+// the drift reports stored by SaveDriftReport.
+func TestDriftReports(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.LatestDriftReport(ctx)
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		t.Fatalf("Expected '%v', got '%v'", mongo.ErrNoDocuments, err)
+	}
+
+	// Store a recent report and then an older one. MongoDB keeps times with
+	// millisecond precision.
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	recent := database.DriftReport{
+		DryRun:              true,
+		StartTime:           now.Add(-time.Minute),
+		EndTime:             now,
+		NumAccountsSkylinks: 3,
+		NumMissing:          1,
+		MissingSample:       []string{test.RandomSkylink().String()},
+		NumUnreferenced:     2,
+		UnreferencedSample:  []string{test.RandomSkylink().String(), test.RandomSkylink().String()},
+	}
+	older := database.DriftReport{
+		StartTime: now.Add(-time.Hour),
+		EndTime:   now.Add(-time.Hour + time.Minute),
+	}
+	for _, r := range []database.DriftReport{recent, older} {
+		if err = db.SaveDriftReport(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := db.LatestDriftReport(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, recent) {
+		t.Fatalf("Expected %+v, got %+v", recent, r)
+	}
+}
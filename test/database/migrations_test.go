@@ -0,0 +1,580 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/test"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestMigrations ensures that the migrations bring a new database to the
+// latest schema version, that it's safe to run them concurrently and that
+// running them again changes nothing.
+func TestMigrations(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	// Connect a few instances at the same time, like a rolling deploy would.
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = test.NewDatabase(ctx, t.Name())
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Run the migrations twice more, one after the other.
+	for i := 0; i < 2; i++ {
+		db, err := test.NewDatabase(ctx, t.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, err := db.SchemaVersion(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != database.LatestSchemaVersion() {
+			t.Fatalf("Expected schema version %d, got %d", database.LatestSchemaVersion(), version)
+		}
+		// Expect the migration lock to be released.
+		_, err = db.ConfigValue(ctx, "schema_migration_lock")
+		if err != mongo.ErrNoDocuments {
+			t.Fatalf("Expected error '%v', got '%v'", mongo.ErrNoDocuments, err)
+		}
+	}
+}
+
+// TestMigrationBackfillCreatedAt ensures that the migrations set the created_at
+// field of the skylinks which predate it.
+func TestMigrationBackfillCreatedAt(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	// Insert a skylink the way older versions of pinner did.
+	id := primitive.NewObjectIDFromTimestamp(time.Now().Add(-24 * time.Hour))
+	sl := test.RandomSkylink()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("skylinks")
+	_, err = coll.InsertOne(ctx, bson.M{"_id": id, "skylink": sl.String(), "servers": bson.A{"server"}, "pinned": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.CreatedAt.Equal(id.Timestamp()) {
+		t.Fatalf("Expected created_at %v, got %v", id.Timestamp(), s.CreatedAt)
+	}
+	if !s.UpdatedAt.IsZero() {
+		t.Fatalf("Expected no updated_at, got %v", s.UpdatedAt)
+	}
+}
+
+// TestMigrationBackfillUnpinnedAt ensures that the migration gives the unpinned
+// skylinks which predate unpinned_at one.
+func TestMigrationBackfillUnpinnedAt(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	// Insert skylinks the way older versions of pinner did.
+	updatedAt := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Millisecond)
+	withUpdate := test.RandomSkylink()
+	withoutUpdate := test.RandomSkylink()
+	pinned := test.RandomSkylink()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("skylinks")
+	_, err = coll.InsertMany(ctx, []interface{}{
+		bson.M{"skylink": withUpdate.String(), "servers": bson.A{}, "pinned": false, "updated_at": updatedAt},
+		bson.M{"skylink": withoutUpdate.String(), "servers": bson.A{}, "pinned": false},
+		bson.M{"skylink": pinned.String(), "servers": bson.A{}, "pinned": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().UTC().Add(-time.Second)
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.FindSkylink(ctx, withUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.UnpinnedAt.Equal(updatedAt) {
+		t.Fatalf("Expected unpinned_at %v, got %v", updatedAt, s.UnpinnedAt)
+	}
+	s, err = db.FindSkylink(ctx, withoutUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.UnpinnedAt.Before(start) {
+		t.Fatalf("Expected unpinned_at to be about now, got %v", s.UnpinnedAt)
+	}
+	s, err = db.FindSkylink(ctx, pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.UnpinnedAt.IsZero() {
+		t.Fatalf("Expected no unpinned_at, got %v", s.UnpinnedAt)
+	}
+}
+
+// TestMigrationBackfillNumServers ensures that the migration gives the skylinks
+// which predate num_servers one which matches their servers.
+func TestMigrationBackfillNumServers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	// Insert skylinks the way older versions of pinner did.
+	expected := map[string]int{
+		test.RandomSkylink().String(): 2,
+		test.RandomSkylink().String(): 0,
+	}
+	noServers := test.RandomSkylink()
+	expected[noServers.String()] = 0
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("skylinks")
+	docs := []interface{}{bson.M{"skylink": noServers.String(), "pinned": true}}
+	for sl, n := range expected {
+		if sl == noServers.String() {
+			continue
+		}
+		servers := bson.A{}
+		for i := 0; i < n; i++ {
+			servers = append(servers, fmt.Sprintf("server %d", i))
+		}
+		docs = append(docs, bson.M{"skylink": sl, "servers": servers, "pinned": true})
+	}
+	_, err = coll.InsertMany(ctx, docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for slStr, n := range expected {
+		sl, err := database.SkylinkFromString(slStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.NumServers != n {
+			t.Fatalf("Expected num_servers %d, got %d", n, s.NumServers)
+		}
+	}
+	// The migrated skylinks are found by the underpinned query.
+	n, err := db.CountUnderpinned(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("Expected 2 underpinned skylinks, got %d", n)
+	}
+}
+
+// TestMigrationBackfillServers ensures that the migration gives the skylinks
+// which older versions of pinner created without servers an empty list of
+// servers and leaves the other skylinks alone.
+func TestMigrationBackfillServers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	// Insert a skylink the way older versions of MarkUnpinned did and one
+	// with servers.
+	skeleton := test.RandomSkylink()
+	withServers := test.RandomSkylink()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("skylinks")
+	_, err = coll.InsertMany(ctx, []interface{}{
+		bson.M{"skylink": skeleton.String(), "pinned": false},
+		bson.M{"skylink": withServers.String(), "servers": bson.A{"server"}, "pinned": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	err = coll.FindOne(ctx, bson.M{"_id": skeleton.String()}).Decode(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if servers, ok := doc["servers"].(bson.A); !ok || len(servers) != 0 {
+		t.Fatalf("Expected an empty list of servers, got %v", doc["servers"])
+	}
+	s, err := db.FindSkylink(ctx, withServers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NumServers != 1 || len(s.Servers) != 1 {
+		t.Fatalf("Expected the skylink to keep its server, got %+v", s)
+	}
+}
+
+// TestMigrationCanonicalizeSkylinks ensures that the migration re-keys the
+// skylinks stored in a non-canonical encoding and merges them into their
+// canonical documents if those exist.
+func TestMigrationCanonicalizeSkylinks(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	// A skylink stored only in base32, a skylink stored in two encodings
+	// with different servers and an invalid one.
+	rekeyed := test.RandomSkylink()
+	merged := test.RandomSkylink()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("skylinks")
+	_, err = coll.InsertMany(ctx, []interface{}{
+		bson.M{"skylink": rekeyed.Base32EncodedString(), "servers": bson.A{"server-a"}, "pinned": true},
+		bson.M{"skylink": merged.String(), "servers": bson.A{"server-a"}, "pinned": false, "size": 10},
+		bson.M{"skylink": merged.String() + "/path", "servers": bson.A{"server-a", "server-b"}, "pinned": true, "owners": bson.A{"alice"}},
+		bson.M{"skylink": "not a skylink", "servers": bson.A{}, "pinned": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := coll.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("Expected 3 documents, got %d", n)
+	}
+	s, err := db.FindSkylink(ctx, rekeyed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NumServers != 1 || !test.Contains(s.Servers, "server-a") {
+		t.Fatalf("Expected the re-keyed skylink to keep its server, got %+v", s)
+	}
+	s, err = db.FindSkylink(ctx, merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NumServers != 2 || !test.Contains(s.Servers, "server-a") || !test.Contains(s.Servers, "server-b") {
+		t.Fatalf("Expected the merged servers, got %+v", s)
+	}
+	if !s.Pinned || s.Size != 10 || !test.Contains(s.Owners, "alice") {
+		t.Fatalf("Expected a pinned skylink with its size and owner, got %+v", s)
+	}
+	// The server loads count the merged skylink once.
+	load, err := db.ServerLoad(ctx, "server-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if load.Skylinks != 2 {
+		t.Fatalf("Expected server a to pin 2 skylinks, got %d", load.Skylinks)
+	}
+}
+
+// TestMigrationKeySkylinks ensures that the migration makes the skylinks the
+// IDs of their documents, keeps the rest of the documents as they were and
+// cleans up after an earlier attempt which failed midway.
+func TestMigrationKeySkylinks(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	rawDB := c.Database(test.SanitizeName(t.Name()))
+	coll := rawDB.Collection("skylinks")
+	// Insert skylinks the way older versions of pinner did.
+	skylinks := make([]string, 0, 10)
+	docs := make([]interface{}, 0, 10)
+	for i := 0; i < 10; i++ {
+		sl := test.RandomSkylink().String()
+		skylinks = append(skylinks, sl)
+		docs = append(docs, bson.M{
+			"_id":     primitive.NewObjectID(),
+			"skylink": sl,
+			"servers": bson.A{fmt.Sprintf("server %d", i%3)},
+			"pinned":  i%2 == 0,
+			"size":    int64(i * 100),
+		})
+	}
+	_, err = coll.InsertMany(ctx, docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave a partial copy behind, as if an earlier attempt failed.
+	_, err = rawDB.Collection("skylinks_keyed").InsertOne(ctx, bson.M{"_id": "partial copy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := coll.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(skylinks)) {
+		t.Fatalf("Expected %d skylinks, got %d", len(skylinks), n)
+	}
+	for i, slStr := range skylinks {
+		var doc bson.M
+		err = coll.FindOne(ctx, bson.M{"_id": slStr}).Decode(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, exists := doc["skylink"]; exists {
+			t.Fatalf("Expected no skylink field, got %v", doc)
+		}
+		sl, err := database.SkylinkFromString(slStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Skylink != slStr || s.Pinned != (i%2 == 0) || s.Size != uint64(i*100) || s.NumServers != 1 {
+			t.Fatalf("Unexpected skylink %+v", s)
+		}
+	}
+	names, err := rawDB.ListCollectionNames(ctx, bson.M{"name": "skylinks_keyed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("Expected the copy to be gone, got %v", names)
+	}
+	// The separate skylink index is gone, its uniqueness is now enforced by
+	// the IDs.
+	cur, err := coll.Indexes().List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes []struct {
+		Name string `bson:"name"`
+	}
+	err = cur.All(ctx, &indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, idx := range indexes {
+		if idx.Name == "skylink" {
+			t.Fatal("Expected the skylink index to be dropped")
+		}
+	}
+	sl, err := database.SkylinkFromString(skylinks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateSkylink(ctx, sl, "server")
+	if !errors.Contains(err, database.ErrSkylinkExists) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkExists, err)
+	}
+}
+
+// TestMigrationKeySkylinksResume ensures that the migration which makes the
+// skylinks the IDs of their documents refuses to run while servers which run
+// an older version of pinner are active and that it resumes an earlier copy
+// which failed midway.
+func TestMigrationKeySkylinksResume(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	rawDB := c.Database(test.SanitizeName(t.Name()))
+	coll := rawDB.Collection("skylinks")
+	// Insert skylinks the way older versions of pinner did and copy the
+	// first few of them, as if an earlier attempt failed after recording its
+	// progress. The copies have a different size, so we can tell whether
+	// the migration copies them again.
+	skylinks := make([]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		sl := test.RandomSkylink().String()
+		skylinks = append(skylinks, sl)
+		id := primitive.NewObjectID()
+		_, err = coll.InsertOne(ctx, bson.M{"_id": id, "skylink": sl, "servers": bson.A{"server"}, "pinned": true, "size": int64(100)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= 4 {
+			continue
+		}
+		_, err = rawDB.Collection("skylinks_keyed").InsertOne(ctx, bson.M{"_id": sl, "servers": bson.A{"server"}, "pinned": true, "size": int64(1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rawDB.Collection("configuration").UpdateOne(ctx, bson.M{"key": "schema_migration_key_skylinks_progress"}, bson.M{"$set": bson.M{"value": id.Hex()}}, options.Update().SetUpsert(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One server still runs an older version of pinner, another one has
+	// been gone for a while.
+	servers := []interface{}{
+		bson.M{"name": "old.example.com", "last_sweep_end": time.Now().UTC()},
+		bson.M{"name": "gone.example.com", "last_sweep_end": time.Now().UTC().Add(-72 * time.Hour)},
+	}
+	_, err = rawDB.Collection("servers").InsertMany(ctx, servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The migration refuses to run and leaves the skylinks alone.
+	_, err = test.NewDatabase(ctx, t.Name())
+	if !errors.Contains(err, database.ErrOldServersActive) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrOldServersActive, err)
+	}
+	n, err := coll.CountDocuments(ctx, bson.M{"skylink": bson.M{"$exists": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(skylinks)) {
+		t.Fatalf("Expected %d skylinks to copy, got %d", len(skylinks), n)
+	}
+
+	// Once the old server runs this version, the migration resumes the copy.
+	db, err := test.NewDatabase(ctx, t.Name(), database.WithServerName("old.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, slStr := range skylinks {
+		sl, err := database.SkylinkFromString(slStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := uint64(100)
+		if i < 4 {
+			expected = 1
+		}
+		if s.Size != expected {
+			t.Fatalf("Expected skylink %d to have size %d, got %+v", i, expected, s)
+		}
+	}
+	_, err = db.ConfigValue(ctx, "schema_migration_key_skylinks_progress")
+	if err != mongo.ErrNoDocuments {
+		t.Fatalf("Expected error '%v', got '%v'", mongo.ErrNoDocuments, err)
+	}
+	info, err := db.ServerInfo(ctx, "old.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SchemaVersion != database.LatestSchemaVersion() {
+		t.Fatalf("Expected schema version %d, got %d", database.LatestSchemaVersion(), info.SchemaVersion)
+	}
+}
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/test"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestOperationTimeout ensures that the DB's operation timeout and the ones
+// set through WithOpOptions cut the operations short.
+func TestOperationTimeout(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A timeout which expires right away fails the operation.
+	shortCtx := database.WithOpOptions(ctx, database.OpOptions{Timeout: time.Nanosecond})
+	_, err = db.FindSkylink(shortCtx, sl)
+	if !errors.Contains(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+	// The default timeout is long enough.
+	_, err = db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The DB's own timeout applies to all operations.
+	shortDB, err := test.NewDatabase(ctx, t.Name(), database.WithOpTimeout(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = shortDB.FindSkylink(ctx, sl)
+	if !errors.Contains(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+	// Unless the caller asks for a longer one.
+	longCtx := database.WithOpOptions(ctx, database.OpOptions{Timeout: time.Minute})
+	_, err = shortDB.FindSkylink(longCtx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSlowOperationLogging ensures that we log the operations which take
+// longer than the slow operation threshold.
+func TestSlowOperationLogging(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	logger, hook := logtest.NewNullLogger()
+	db, err := database.NewCustomDB(ctx, test.SanitizeName(t.Name()), test.DBTestCredentials(), logger, database.WithSlowOpThreshold(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Reset()
+	_, err = db.FindSkylink(ctx, test.RandomSkylink())
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+	entry := hook.LastEntry()
+	if entry == nil || entry.Level != logrus.WarnLevel {
+		t.Fatalf("Expected a warning, got %v", entry)
+	}
+	if !strings.Contains(entry.Message, "FindSkylink") || !strings.Contains(entry.Message, "'skylinks'") {
+		t.Fatalf("Expected the operation and the collection in the message, got '%s'", entry.Message)
+	}
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/skynetlabs/pinner/test"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestSchemaObsoleteIndexes ensures that connecting to a database which has the
+// indexes of an older version of pinner drops the obsolete ones and creates the
+// ones we need.
+func TestSchemaObsoleteIndexes(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("skylinks")
+	// Start from a collection with the old index.
+	_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"unpin", 1}},
+		Options: options.Index().SetName("unpin"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connecting runs ensureDBSchema. Do it twice to make sure it's fine to
+	// run it when there is nothing to drop.
+	for i := 0; i < 2; i++ {
+		_, err = test.NewDatabase(ctx, t.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cur, err := coll.Indexes().List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes []struct {
+		Name string `bson:"name"`
+	}
+	err = cur.All(ctx, &indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(indexes))
+	for _, idx := range indexes {
+		names = append(names, idx.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"_id_", "deleted_at", "lock_expires", "locked_by", "num_servers", "pinned", "pinned_lock_expires", "servers"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected indexes %v, got %v", expected, names)
+	}
+}
@@ -0,0 +1,640 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/test"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/build"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestServerInfo ensures that UpsertServerInfo and ServerInfo work as
+// expected.
+func TestServerInfo(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := "heartbeat-server"
+
+	// Expect no info for the server.
+	_, err = db.ServerInfo(ctx, server)
+	if !errors.Contains(err, database.ErrServerNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrServerNotExist, err)
+	}
+	// Expect an error when we don't provide a name.
+	err = db.UpsertServerInfo(ctx, database.ServerInfo{})
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+	// Create the server's info.
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	info := database.ServerInfo{
+		Name:           server,
+		LastSweepStart: now.Add(-time.Minute),
+		LastSweepEnd:   now,
+		NumSkylinks:    10,
+		PinnerVersion:  "v1",
+	}
+	err = db.UpsertServerInfo(ctx, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := db.ServerInfo(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != info {
+		t.Fatalf("Expected %+v, got %+v", info, i)
+	}
+	// Update the server's info.
+	info.LastSweepStart = now
+	info.LastSweepEnd = now.Add(time.Minute)
+	info.NumSkylinks = 20
+	err = db.UpsertServerInfo(ctx, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err = db.ServerInfo(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != info {
+		t.Fatalf("Expected %+v, got %+v", info, i)
+	}
+}
+
+// transactionModes are the two ways in which a DB runs the callbacks given to
+// WithTransaction. The test Mongo is a replica set, so it supports
+// transactions unless we disable them.
+var transactionModes = []struct {
+	name string
+	opts []database.Option
+}{
+	{name: "Transactional"},
+	{name: "Degraded", opts: []database.Option{database.WithoutTransactions()}},
+}
+
+// TestWithTransaction ensures that WithTransaction rolls back the writes of a
+// failed callback when the database supports transactions and that it still
+// runs the callback when we disable them.
+func TestWithTransaction(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	errFailed := errors.New("callback failed")
+	for _, mode := range transactionModes {
+		mode := mode
+		t.Run(mode.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			db, err := test.NewDatabase(ctx, t.Name(), mode.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sl := test.RandomSkylink()
+			err = db.WithTransaction(ctx, func(ctx context.Context) error {
+				_, err := db.CreateSkylink(ctx, sl, "server")
+				if err != nil {
+					return err
+				}
+				return errFailed
+			})
+			if !errors.Contains(err, errFailed) {
+				t.Fatalf("Expected '%v', got '%v'", errFailed, err)
+			}
+			_, err = db.FindSkylink(ctx, sl)
+			degraded := mode.opts != nil
+			if degraded && err != nil {
+				t.Fatalf("Expected the skylink to survive the failure, got '%v'", err)
+			}
+			if !degraded && !errors.Contains(err, database.ErrSkylinkNotExist) {
+				t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+			}
+
+			// A successful callback commits its writes.
+			err = db.WithTransaction(ctx, func(ctx context.Context) error {
+				_, err := db.CreateSkylink(ctx, test.RandomSkylink(), "server")
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			load, err := db.ServerLoad(ctx, "server")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := int64(1)
+			if degraded {
+				expected = 2
+			}
+			if load.Skylinks != expected {
+				t.Fatalf("Expected %d skylinks, got %+v", expected, load)
+			}
+		})
+	}
+}
+
+// TestRenameServer ensures that RenameServer replaces the server's name
+// everywhere, with and without transactions.
+func TestRenameServer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	for _, mode := range transactionModes {
+		mode := mode
+		t.Run(mode.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			db, err := test.NewDatabase(ctx, t.Name(), mode.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			oldName := "old-name"
+			newName := "new-name"
+			other := "other-server"
+
+			// Both servers pin sl1, only the old one pins sl2 and the old
+			// one holds a lock on sl3.
+			sl1 := test.RandomSkylink()
+			sl2 := test.RandomSkylink()
+			sl3 := test.RandomSkylink()
+			err = db.AddServerForSkylinks(ctx, []string{sl1.String(), sl2.String()}, oldName, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.AddServerForSkylink(ctx, sl1, newName, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateSkylink(ctx, sl3, other)
+			if err != nil {
+				t.Fatal(err)
+			}
+			locked, err := db.FindAndLockUnderpinnedSkylink(ctx, oldName, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if locked.String() != sl3.String() {
+				t.Fatalf("Expected to lock '%s', got '%s'", sl3, locked)
+			}
+			err = db.UpsertServerInfo(ctx, database.ServerInfo{Name: oldName, NumSkylinks: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Expect an error for empty and invalid names.
+			err = db.RenameServer(ctx, oldName, "")
+			if err == nil {
+				t.Fatal("Expected an error.")
+			}
+			err = db.RenameServer(ctx, oldName, "New Name")
+			if !errors.Contains(err, database.ErrInvalidServerName) {
+				t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidServerName, err)
+			}
+			err = db.RenameServer(ctx, oldName, newName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, sl := range []skymodules.Skylink{sl1, sl2} {
+				s, err := db.FindSkylink(ctx, sl)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(s.Servers) != 1 || s.Servers[0] != newName {
+					t.Fatalf("Expected only '%s' to pin '%s', got %v", newName, sl, s.Servers)
+				}
+			}
+			err = db.UnlockSkylink(ctx, sl3, newName)
+			if err != nil {
+				t.Fatalf("Expected '%s' to hold the lock, got '%v'", newName, err)
+			}
+			info, err := db.ServerInfo(ctx, newName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.NumSkylinks != 2 {
+				t.Fatalf("Expected the old server's heartbeat, got %+v", info)
+			}
+			_, err = db.ServerInfo(ctx, oldName)
+			if !errors.Contains(err, database.ErrServerNotExist) {
+				t.Fatalf("Expected '%v', got '%v'", database.ErrServerNotExist, err)
+			}
+			loads, err := db.AllServerLoads(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range loads {
+				if l.Server == oldName {
+					t.Fatalf("Expected no load for the old name, got %+v", l)
+				}
+				if l.Server == newName && l.Skylinks != 2 {
+					t.Fatalf("Expected '%s' to pin 2 skylinks, got %+v", newName, l)
+				}
+			}
+		})
+	}
+}
+
+// TestValidateServerName ensures that ValidateServerName only accepts
+// normalized server names.
+func TestValidateServerName(t *testing.T) {
+	t.Parallel()
+
+	valid := []string{"a", "server", "eu-ger-1.siasky.net", "10.10.10.70", strings.Repeat("a", 253)}
+	for _, name := range valid {
+		if err := database.ValidateServerName(name); err != nil {
+			t.Fatalf("Expected '%s' to be valid, got '%v'", name, err)
+		}
+	}
+	invalid := []string{"", " server", "server\n", "Server", "eu ger 1", "eu_ger_1", "$first", "a/b", "ünicode", strings.Repeat("a", 254)}
+	for _, name := range invalid {
+		if err := database.ValidateServerName(name); !errors.Contains(err, database.ErrInvalidServerName) {
+			t.Fatalf("Expected '%s' to be invalid, got '%v'", name, err)
+		}
+	}
+	// Normalizing a name makes it valid, as long as it only holds the
+	// allowed characters.
+	normalized := map[string]string{
+		"server":                  "server",
+		" Server ":                "server",
+		"\tEU-GER-1.Siasky.net\n": "eu-ger-1.siasky.net",
+	}
+	for name, expected := range normalized {
+		n := database.NormalizeServerName(name)
+		if n != expected {
+			t.Fatalf("Expected '%s' to become '%s', got '%s'", name, expected, n)
+		}
+		if err := database.ValidateServerName(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestRepairServerNames ensures that RepairServerNames merges the server names
+// which only differ from their normalized form by case or whitespace into it
+// and leaves the rest alone.
+func TestRepairServerNames(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := c.Disconnect(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	rawDB := c.Database(test.SanitizeName(t.Name()))
+
+	server := "host.example.com"
+	spaced := "Host.Example.com "
+	upper := "HOST.EXAMPLE.COM"
+	other := "other-server"
+	invalid := "bad_name"
+
+	// sl1 is pinned by the server under its valid name and a spaced one,
+	// sl2 only under the upper-case name and it's locked by the spaced one.
+	// The validated writes reject those names, so we write them directly.
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl1, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateSkylink(ctx, sl2, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skylinks := rawDB.Collection("skylinks")
+	_, err1 := skylinks.UpdateOne(ctx, bson.M{"_id": sl1.String()}, bson.M{"$set": bson.M{"servers": bson.A{server, spaced}}})
+	_, err2 := skylinks.UpdateOne(ctx, bson.M{"_id": sl2.String()}, bson.M{"$set": bson.M{"servers": bson.A{other, upper, invalid}, "locked_by": spaced, "lock_expires": time.Now().Add(time.Hour)}})
+	_, err3 := rawDB.Collection("servers").InsertOne(ctx, bson.M{"name": spaced, "num_skylinks": 1})
+	if err := errors.Compose(err1, err2, err3); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := database.ServerNameRepair{
+		Merges:  []database.ServerNameMerge{{From: upper, To: server}, {From: spaced, To: server}},
+		Invalid: []string{invalid},
+	}
+	// A dry run only reports the merges and the name it can't fix.
+	r, err := db.RepairServerNames(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, r)
+	}
+	s, err := db.FindSkylink(ctx, sl1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Servers) != 2 {
+		t.Fatalf("Expected the dry run to leave the servers alone, got %v", s.Servers)
+	}
+
+	r, err = db.RepairServerNames(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, r)
+	}
+	s, err = db.FindSkylink(ctx, sl1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Servers, []string{server}) {
+		t.Fatalf("Expected only '%s' to pin sl1, got %v", server, s.Servers)
+	}
+	s, err = db.FindSkylink(ctx, sl2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Servers, []string{other, server, invalid}) {
+		t.Fatalf("Expected '%s' to replace '%s', got %v", server, upper, s.Servers)
+	}
+	err = db.UnlockSkylink(ctx, sl2, server)
+	if err != nil {
+		t.Fatalf("Expected '%s' to hold the lock, got '%v'", server, err)
+	}
+	info, err := db.ServerInfo(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NumSkylinks != 1 {
+		t.Fatalf("Expected the merged heartbeat, got %+v", info)
+	}
+	_, err = db.ServerInfo(ctx, spaced)
+	if !errors.Contains(err, database.ErrServerNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrServerNotExist, err)
+	}
+
+	// Once repaired, there is nothing left to merge.
+	r, err = db.RepairServerNames(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Merges) != 0 {
+		t.Fatalf("Expected no merges, got %v", r.Merges)
+	}
+}
+
+// TestRemoveServer ensures that RemoveServer removes every trace of the
+// server, with and without transactions.
+func TestRemoveServer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	for _, mode := range transactionModes {
+		mode := mode
+		t.Run(mode.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			db, err := test.NewDatabase(ctx, t.Name(), mode.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := "removed-server"
+			other := "other-server"
+
+			sl1 := test.RandomSkylink()
+			sl2 := test.RandomSkylink()
+			err = db.AddServerForSkylinks(ctx, []string{sl1.String()}, server, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.AddServerForSkylink(ctx, sl1, other, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateSkylink(ctx, sl2, other)
+			if err != nil {
+				t.Fatal(err)
+			}
+			locked, err := db.FindAndLockUnderpinnedSkylink(ctx, server, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if locked.String() != sl2.String() {
+				t.Fatalf("Expected to lock '%s', got '%s'", sl2, locked)
+			}
+			err = db.UpsertServerInfo(ctx, database.ServerInfo{Name: server})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			removed, err := db.RemoveServer(ctx, server, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != 1 {
+				t.Fatalf("Expected the server to be removed from 1 skylink, got %d", removed)
+			}
+			s, err := db.FindSkylink(ctx, sl1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(s.Servers) != 1 || s.Servers[0] != other {
+				t.Fatalf("Expected only '%s' to pin the skylink, got %v", other, s.Servers)
+			}
+			s, err = db.FindSkylink(ctx, sl2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.LockedBy != "" {
+				t.Fatalf("Expected the lock to be released, got '%s'", s.LockedBy)
+			}
+			_, err = db.ServerInfo(ctx, server)
+			if !errors.Contains(err, database.ErrServerNotExist) {
+				t.Fatalf("Expected '%v', got '%v'", database.ErrServerNotExist, err)
+			}
+			load, err := db.ServerLoad(ctx, server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if load != (database.ServerLoad{Server: server}) {
+				t.Fatalf("Expected no load, got %+v", load)
+			}
+			// Removing it again is a no-op.
+			removed, err = db.RemoveServer(ctx, server, nil)
+			if err != nil || removed != 0 {
+				t.Fatalf("Expected a no-op, got %d and '%v'", removed, err)
+			}
+		})
+	}
+}
+
+// TestRemoveServerBatches ensures that RemoveServer removes the server from all
+// of its skylinks in batches, reports its progress after each one and stops
+// between batches once it's cancelled.
+func TestRemoveServerBatches(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "removed-server"
+	other := "other-server"
+	// Use enough skylinks to span three batches.
+	numSkylinks := 2500
+	skylinks := make([]string, numSkylinks)
+	for i := range skylinks {
+		skylinks[i] = test.RandomSkylink().String()
+	}
+	err = db.AddServerForSkylinks(ctx, skylinks, server, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddServerForSkylinks(ctx, skylinks[:10], other, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UpsertServerInfo(ctx, database.ServerInfo{Name: server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// countPinned returns the number of skylinks the server pins.
+	countPinned := func() int {
+		ls, err := db.SkylinksForServer(ctx, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(ls)
+	}
+
+	// Cancel the removal after the first batch.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var reported []int64
+	removed, err := db.RemoveServer(cancelCtx, server, func(removed int64) {
+		reported = append(reported, removed)
+		cancel()
+	})
+	if !errors.Contains(err, context.Canceled) {
+		t.Fatalf("Expected '%v', got '%v'", context.Canceled, err)
+	}
+	if removed != 1000 || len(reported) != 1 || reported[0] != removed {
+		t.Fatalf("Expected to stop after a batch of 1000, got %d and %v", removed, reported)
+	}
+	if n := countPinned(); n != numSkylinks-1000 {
+		t.Fatalf("Expected the server to still pin %d skylinks, got %d", numSkylinks-1000, n)
+	}
+	// The server's load reflects the skylinks it still pins and its heartbeat
+	// is still around.
+	load, err := db.ServerLoad(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if load.Skylinks != int64(numSkylinks-1000) {
+		t.Fatalf("Expected a load of %d skylinks, got %d", numSkylinks-1000, load.Skylinks)
+	}
+	_, err = db.ServerInfo(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing it again finishes the job.
+	reported = nil
+	removed, err = db.RemoveServer(ctx, server, func(removed int64) {
+		reported = append(reported, removed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != int64(numSkylinks-1000) {
+		t.Fatalf("Expected the server to be removed from %d skylinks, got %d", numSkylinks-1000, removed)
+	}
+	if len(reported) != 2 || reported[0] != 1000 || reported[1] != removed {
+		t.Fatalf("Expected progress after each of the 2 batches, got %v", reported)
+	}
+	if n := countPinned(); n != 0 {
+		t.Fatalf("Expected the server to pin no skylinks, got %d", n)
+	}
+	_, err = db.ServerInfo(ctx, server)
+	if !errors.Contains(err, database.ErrServerNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrServerNotExist, err)
+	}
+	// The other server keeps its skylinks.
+	ls, err := db.SkylinksForServer(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 10 {
+		t.Fatalf("Expected the other server to pin 10 skylinks, got %d", len(ls))
+	}
+}
+
+// TestHealthy ensures that Healthy reports whether we can reach the database
+// and that the pool stats reflect the pool's size.
+func TestHealthy(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name(), database.WithPoolSize(3, 10), database.WithMaxConnIdleTime(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Healthy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The driver opens the minimum number of connections in the background.
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		if ps := db.PoolStats(); ps.Open < 3 || ps.InUse < 0 {
+			return fmt.Errorf("expected at least 3 open connections, got %+v", ps)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expect an error once we can't reach the database anymore.
+	err = db.Disconnect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Healthy(ctx)
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+}
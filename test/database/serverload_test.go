@@ -0,0 +1,251 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/skynetlabs/pinner/database"
+	"github.com/skynetlabs/pinner/test"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestServerLoad ensures that the write methods keep the loads of the servers
+// up to date.
+func TestServerLoad(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvA := "server-a"
+	srvB := "server-b"
+	srvC := "server-c"
+
+	// expectLoad fails the test if the server's load isn't the given one.
+	expectLoad := func(step, server string, skylinks, bytes int64) {
+		t.Helper()
+		load, err := db.ServerLoad(ctx, server)
+		if err != nil {
+			t.Fatal(step, err)
+		}
+		if load.Server != server || load.Skylinks != skylinks || load.Bytes != bytes {
+			t.Fatalf("%s: expected %s to pin %d skylinks and %d bytes, got %+v", step, server, skylinks, bytes, load)
+		}
+	}
+	expectLoad("no skylinks", srvA, 0, 0)
+
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+	sl3 := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl1, srvA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLoad("CreateSkylink", srvA, 1, 0)
+	err = db.SetSkylinkSizes(ctx, map[string]uint64{sl1.String(): 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLoad("SetSkylinkSizes", srvA, 1, 100)
+
+	// Adding a server twice only counts once.
+	for i := 0; i < 2; i++ {
+		err = db.AddServerForSkylink(ctx, sl1, srvB, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectLoad("AddServerForSkylink", srvB, 1, 100)
+	}
+	// Adding a server to a new skylink counts it.
+	err = db.AddServerForSkylink(ctx, sl2, srvB, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLoad("AddServerForSkylink new", srvB, 2, 100)
+	// The batch version counts new skylinks and existing ones which the
+	// server doesn't pin yet.
+	batch := []string{sl1.String(), sl2.String(), sl3.String()}
+	for i := 0; i < 2; i++ {
+		err = db.AddServerForSkylinks(ctx, batch, srvA, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectLoad("AddServerForSkylinks", srvA, 3, 100)
+	}
+	// A new size changes the load of all servers which pin the skylink.
+	err = db.SetSkylinkSizes(ctx, map[string]uint64{sl1.String(): 60, sl2.String(): 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLoad("SetSkylinkSizes A", srvA, 3, 110)
+	expectLoad("SetSkylinkSizes B", srvB, 2, 110)
+
+	// Removing a server twice only counts once.
+	for i := 0; i < 2; i++ {
+		err = db.RemoveServerFromSkylink(ctx, sl1, srvA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectLoad("RemoveServerFromSkylink", srvA, 2, 50)
+	}
+	for i := 0; i < 2; i++ {
+		err = db.RemoveServerFromSkylinks(ctx, batch, srvA, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectLoad("RemoveServerFromSkylinks", srvA, 0, 0)
+	}
+
+	// Pinning a locked skylink counts it.
+	locked, err := db.FindAndLockUnderpinnedSkylink(ctx, srvC, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.FindSkylink(ctx, locked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MarkServerPinnedAndUnlock(ctx, locked, srvC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLoad("MarkServerPinnedAndUnlock", srvC, 1, int64(s.Size))
+
+	// Expect the incremental loads to match the ones we compute from scratch.
+	loads, err := db.AllServerLoads(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.ReconcileServerLoads(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reconciled, err := db.AllServerLoads(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loads) != 3 || len(reconciled) != 3 {
+		t.Fatalf("Expected the loads of 3 servers, got %+v and %+v", loads, reconciled)
+	}
+	for i := range loads {
+		if reconciled[i].ReconciledAt.IsZero() {
+			t.Fatalf("Expected a reconciliation time, got %+v", reconciled[i])
+		}
+		reconciled[i].ReconciledAt = loads[i].ReconciledAt
+	}
+	if !reflect.DeepEqual(loads, reconciled) {
+		t.Fatalf("Expected the reconciled loads %+v to match the incremental ones %+v", reconciled, loads)
+	}
+}
+
+// TestReconcileServerLoad ensures that the reconciliation corrects loads which
+// have drifted.
+func TestReconcileServerLoad(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server"
+	otherServer := "other-server"
+	goneServer := "gone-server"
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+	err = db.AddServerForSkylinks(ctx, []string{sl1.String(), sl2.String()}, server, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddServerForSkylink(ctx, sl1, otherServer, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetSkylinkSizes(ctx, map[string]uint64{sl1.String(): 10, sl2.String(): 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the loads drift.
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("server_stats")
+	for _, srv := range []string{server, otherServer} {
+		_, err = coll.UpdateOne(ctx, bson.M{"server": srv}, bson.M{"$set": bson.M{"skylinks": 999, "bytes": 999}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = coll.InsertOne(ctx, bson.M{"server": goneServer, "skylinks": 5, "bytes": 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reconcile a single server and expect only its load to be corrected.
+	err = db.ReconcileServerLoad(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load, err := db.ServerLoad(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if load.Skylinks != 2 || load.Bytes != 30 || load.ReconciledAt.IsZero() {
+		t.Fatalf("Expected a reconciled load of 2 skylinks and 30 bytes, got %+v", load)
+	}
+	load, err = db.ServerLoad(ctx, otherServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if load.Skylinks != 999 {
+		t.Fatalf("Expected the load of '%s' to be unchanged, got %+v", otherServer, load)
+	}
+
+	// Reconcile all servers. Expect the server which doesn't pin anything to
+	// have no load.
+	err = db.ReconcileServerLoads(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loads, err := db.AllServerLoads(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][2]int64{
+		goneServer:  {0, 0},
+		otherServer: {1, 10},
+		server:      {2, 30},
+	}
+	if len(loads) != len(expected) {
+		t.Fatalf("Expected %d loads, got %+v", len(expected), loads)
+	}
+	for _, l := range loads {
+		if exp := expected[l.Server]; l.Skylinks != exp[0] || l.Bytes != exp[1] {
+			t.Fatalf("Expected '%s' to pin %d skylinks and %d bytes, got %+v", l.Server, exp[0], exp[1], l)
+		}
+	}
+	// Loads of servers we don't know of are zero.
+	load, err = db.ServerLoad(ctx, "unknown-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if load != (database.ServerLoad{Server: "unknown-server"}) {
+		t.Fatalf("Expected no load, got %+v", load)
+	}
+}
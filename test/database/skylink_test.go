@@ -2,11 +2,24 @@ package database
 
 import (
 	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/skynetlabs/pinner/conf"
 	"github.com/skynetlabs/pinner/database"
 	"github.com/skynetlabs/pinner/test"
 	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 )
 
 // TestSkylink is a comprehensive test suite that covers the base functionality
@@ -53,7 +66,7 @@ func TestSkylink(t *testing.T) {
 		t.Fatalf("Expected skylink '%s', got '%s'", sl, s.Skylink)
 	}
 	// Add the skylink again, expect this to fail with ErrSkylinkExists.
-	otherServer := "second create"
+	otherServer := "second-create"
 	_, err = db.CreateSkylink(ctx, sl, otherServer)
 	if !errors.Contains(err, database.ErrSkylinkExists) {
 		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkExists, err)
@@ -65,7 +78,7 @@ func TestSkylink(t *testing.T) {
 	}
 
 	// Add a new server to the list.
-	server := "new server"
+	server := "new-server"
 	err = db.AddServerForSkylink(ctx, sl, server, false)
 	if err != nil {
 		t.Fatal(err)
@@ -92,7 +105,7 @@ func TestSkylink(t *testing.T) {
 		t.Fatalf("Expected to find only '%s' in the list, got '%v'", cfg.ServerName, s.Servers)
 	}
 	// Mark the file as unpinned.
-	err = db.MarkUnpinned(ctx, sl)
+	err = db.MarkUnpinned(ctx, sl, "server")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -116,13 +129,13 @@ func TestSkylink(t *testing.T) {
 		t.Fatal("Expected the skylink to be pinned.")
 	}
 	// Mark the skylink as unpinned again.
-	err = db.MarkUnpinned(ctx, sl)
+	err = db.MarkUnpinned(ctx, sl, "server")
 	if err != nil {
 		t.Fatal(err)
 	}
 	// Add a server to it with the `markUnpinned` set to false.
 	// Expect the skylink to remain unpinned.
-	err = db.AddServerForSkylink(ctx, sl, "new server pin false", false)
+	err = db.AddServerForSkylink(ctx, sl, "new-server-pin-false", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -135,7 +148,7 @@ func TestSkylink(t *testing.T) {
 	}
 	// Add a server to the skylink with `markUnpinned` set to true.
 	// Expect the skylink to be pinned.
-	err = db.AddServerForSkylink(ctx, sl, "new server pin true", true)
+	err = db.AddServerForSkylink(ctx, sl, "new-server-pin-true", true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -148,6 +161,188 @@ func TestSkylink(t *testing.T) {
 	}
 }
 
+// TestAddServerForSkylink ensures that AddServerForSkylink adds servers to
+// existing skylinks and inserts well-formed documents for new ones.
+func TestAddServerForSkylink(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server"
+	otherServer := "other-server"
+
+	// Add a server to skylinks which don't exist, with and without
+	// markPinned. Expect both to be inserted as pinned skylinks.
+	for _, markPinned := range []bool{false, true} {
+		sl := test.RandomSkylink()
+		err = db.AddServerForSkylink(ctx, sl, server, markPinned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Skylink != sl.String() || !s.Pinned || len(s.Servers) != 1 || s.Servers[0] != server {
+			t.Fatalf("Unexpected document for markPinned %t: %+v", markPinned, s)
+		}
+	}
+
+	// Add a server to an existing skylink twice. Expect it to be listed once.
+	sl := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl, otherServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = db.AddServerForSkylink(ctx, sl, server, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Servers) != 2 || !test.Contains(s.Servers, server) || !test.Contains(s.Servers, otherServer) {
+		t.Fatalf("Expected servers to be [%s %s], got %v", otherServer, server, s.Servers)
+	}
+	// Adding a server doesn't pin an unpinned skylink unless we ask it to.
+	err = db.MarkUnpinned(ctx, sl, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddServerForSkylink(ctx, sl, "third-server", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Pinned {
+		t.Fatal("Expected the skylink to remain unpinned.")
+	}
+}
+
+// TestRemoveServerFromSkylink ensures that RemoveServerFromSkylink removes
+// servers from existing skylinks and doesn't insert new ones.
+func TestRemoveServerFromSkylink(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server"
+	otherServer := "other-server"
+
+	// Expect ErrSkylinkNotExist for a skylink which doesn't exist and the
+	// skylink to not get inserted.
+	sl := test.RandomSkylink()
+	err = db.RemoveServerFromSkylink(ctx, sl, server)
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+	_, err = db.FindSkylink(ctx, sl)
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+
+	// Remove a server from an existing skylink. Removing it again, or
+	// removing a server which never pinned the skylink, is not an error.
+	_, err = db.CreateSkylink(ctx, sl, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddServerForSkylink(ctx, sl, otherServer, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range []string{server, server, "unknown-server"} {
+		err = db.RemoveServerFromSkylink(ctx, sl, srv)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Servers) != 1 || s.Servers[0] != otherServer {
+		t.Fatalf("Expected servers to be [%s], got %v", otherServer, s.Servers)
+	}
+}
+
+// TestFindSkylinks ensures that FindSkylinks returns the documents of the
+// skylinks which exist and lists the ones which don't, across batches.
+func TestFindSkylinks(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server"
+
+	// Mix existing and missing skylinks in more than one batch.
+	var existing, missing, all []string
+	for i := 0; i < 1500; i++ {
+		sl := test.RandomSkylink().String()
+		if i%3 == 0 {
+			missing = append(missing, sl)
+		} else {
+			existing = append(existing, sl)
+		}
+		all = append(all, sl)
+	}
+	if database.NumBatches(len(all)) < 2 {
+		t.Fatalf("Expected more than one batch, got %d", database.NumBatches(len(all)))
+	}
+	err = db.AddServerForSkylinks(ctx, existing, server, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, notFound, err := db.FindSkylinks(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(existing) {
+		t.Fatalf("Expected to find %d skylinks, found %d", len(existing), len(found))
+	}
+	for _, s := range found {
+		if !test.Contains(existing, s.Skylink) || len(s.Servers) != 1 || s.Servers[0] != server {
+			t.Fatalf("Unexpected document %+v", s)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(notFound)
+	if !reflect.DeepEqual(notFound, missing) {
+		t.Fatalf("Expected %d missing skylinks, got %d", len(missing), len(notFound))
+	}
+
+	// Expect no results for no skylinks.
+	found, notFound, err = db.FindSkylinks(ctx, nil)
+	if err != nil || len(found) != 0 || len(notFound) != 0 {
+		t.Fatalf("Expected no results, got %v %v %v", found, notFound, err)
+	}
+}
+
 // TestFindAndLock tests the functionality of FindAndLockUnderpinned and
 // UnlockSkylink.
 func TestFindAndLock(t *testing.T) {
@@ -173,7 +368,7 @@ func TestFindAndLock(t *testing.T) {
 	cfg.MinPinners = 1
 
 	// Try to fetch an underpinned skylink, expect none to be found.
-	_, err = db.FindAndLockUnderpinned(ctx, cfg.ServerName, cfg.MinPinners)
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, cfg.ServerName, cfg.MinPinners)
 	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
 		t.Fatalf("Expected to get '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
 	}
@@ -183,7 +378,7 @@ func TestFindAndLock(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Try to fetch an underpinned skylink, expect none to be found.
-	_, err = db.FindAndLockUnderpinned(ctx, cfg.ServerName, cfg.MinPinners)
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, cfg.ServerName, cfg.MinPinners)
 	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
 		t.Fatalf("Expected to get '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
 	}
@@ -193,7 +388,7 @@ func TestFindAndLock(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Try to fetch an underpinned skylink, expect to find one.
-	underpinned, err := db.FindAndLockUnderpinned(ctx, cfg.ServerName, cfg.MinPinners)
+	underpinned, err := db.FindAndLockUnderpinnedSkylink(ctx, cfg.ServerName, cfg.MinPinners)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -203,7 +398,7 @@ func TestFindAndLock(t *testing.T) {
 	// Try to fetch an underpinned skylink from the name of a different server.
 	// Expect to find none because the one we got before is now locked and
 	// shouldn't be returned.
-	_, err = db.FindAndLockUnderpinned(ctx, "different server", cfg.MinPinners)
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, "different-server", cfg.MinPinners)
 	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
 		t.Fatalf("Expected to get '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
 	}
@@ -217,7 +412,7 @@ func TestFindAndLock(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Try to fetch an underpinned skylink, expect none to be found.
-	_, err = db.FindAndLockUnderpinned(ctx, cfg.ServerName, cfg.MinPinners)
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, cfg.ServerName, cfg.MinPinners)
 	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
 		t.Fatalf("Expected to get '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
 	}
@@ -225,19 +420,19 @@ func TestFindAndLock(t *testing.T) {
 	// Increase the minimum number of pinners to two.
 	cfg.MinPinners = 2
 
-	anotherServerName := "another server"
-	thirdServerName := "third server"
+	anotherServerName := "another-server"
+	thirdServerName := "third-server"
 
 	// Try to fetch an underpinned skylink, expect none to be found.
 	// Out test skylink is underpinned but it's pinned by the given server, so
 	// we expect it not to be returned.
-	_, err = db.FindAndLockUnderpinned(ctx, cfg.ServerName, cfg.MinPinners)
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, cfg.ServerName, cfg.MinPinners)
 	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
 		t.Fatalf("Expected to get '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
 	}
 	// Try to fetch an underpinned skylink from the name of a different server.
 	// Expect one to be found.
-	_, err = db.FindAndLockUnderpinned(ctx, anotherServerName, cfg.MinPinners)
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, anotherServerName, cfg.MinPinners)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -249,8 +444,8 @@ func TestFindAndLock(t *testing.T) {
 	// Try to unlock the skylink from the name of a server that hasn't locked
 	// it. Expect this to fail.
 	err = db.UnlockSkylink(ctx, sl, thirdServerName)
-	if !errors.Contains(err, database.ErrNoSkylinksLocked) {
-		t.Fatalf("Expected to get '%v', got '%v'", database.ErrNoSkylinksLocked, err)
+	if !errors.Contains(err, database.ErrLockedByAnotherServer) {
+		t.Fatalf("Expected to get '%v', got '%v'", database.ErrLockedByAnotherServer, err)
 	}
 	err = db.UnlockSkylink(ctx, sl, anotherServerName)
 	if err != nil {
@@ -258,10 +453,208 @@ func TestFindAndLock(t *testing.T) {
 	}
 	// Try to fetch an underpinned skylink with a third server name, expect none
 	// to be found because our skylink is now properly pinned.
-	_, err = db.FindAndLockUnderpinned(ctx, thirdServerName, cfg.MinPinners)
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, thirdServerName, cfg.MinPinners)
+	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
+		t.Fatalf("Expected to get '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
+	}
+}
+
+// TestFindAndLockBlocked ensures that FindAndLockUnderpinned doesn't select
+// blocked skylinks.
+func TestFindAndLockBlocked(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create an underpinned skylink.
+	sl := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl, "other-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RemoveServerFromSkylink(ctx, sl, "other-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Block it and expect it to not be selected.
+	err = db.MarkBlocked(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Blocked {
+		t.Fatal("Expected the skylink to be blocked.")
+	}
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, "server", 1)
+	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
+		t.Fatalf("Expected to get '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
+	}
+}
+
+// TestFindAndLockUnderpinnedBatch ensures that FindAndLockUnderpinnedBatch
+// locks up to the requested number of skylinks and that two servers locking
+// batches concurrently never lock the same skylink.
+func TestFindAndLockUnderpinnedBatch(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	minPinners := 2
+	_, err = db.FindAndLockUnderpinnedBatch(ctx, "server", minPinners, 0)
+	if err == nil {
+		t.Fatal("Expected an error for a zero batch size.")
+	}
+	_, err = db.FindAndLockUnderpinnedBatch(ctx, "server", minPinners, 10)
 	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
 		t.Fatalf("Expected to get '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
 	}
+	// Create underpinned skylinks.
+	numSkylinks := 25
+	for i := 0; i < numSkylinks; i++ {
+		_, err = db.CreateSkylink(ctx, test.RandomSkylink(), "other-server")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two servers keep locking batches until there is nothing left.
+	var mu sync.Mutex
+	lockedBy := make(map[string]string)
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, server := range []string{"server-a", "server-b"} {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			for {
+				batch, err := db.FindAndLockUnderpinnedBatch(ctx, server, minPinners, 10)
+				if errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
+					return
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(batch) > 10 {
+					errs <- fmt.Errorf("expected at most 10 skylinks, got %d", len(batch))
+					return
+				}
+				mu.Lock()
+				for _, sl := range batch {
+					if other, ok := lockedBy[sl.String()]; ok {
+						mu.Unlock()
+						errs <- fmt.Errorf("%s locked %s which %s already locked", server, sl, other)
+						return
+					}
+					lockedBy[sl.String()] = server
+				}
+				mu.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if len(lockedBy) != numSkylinks {
+		t.Fatalf("Expected %d skylinks to be locked, got %d", numSkylinks, len(lockedBy))
+	}
+	// The locks are per skylink, so unlocking one of them makes it available
+	// to the other server.
+	for slStr, server := range lockedBy {
+		sl, err := database.SkylinkFromString(slStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.UnlockSkylink(ctx, sl, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch, err := db.FindAndLockUnderpinnedBatch(ctx, "server-c", minPinners, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) != 1 || !batch[0].Equals(sl) {
+			t.Fatalf("Expected to lock only %s, got %v", sl, batch)
+		}
+		break
+	}
+}
+
+// TestFindAndLockUnderpinnedDocument ensures that FindAndLockUnderpinned
+// returns the locked skylink's document with its fresh lock.
+func TestFindAndLockUnderpinnedDocument(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sl := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl, "other-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := uint64(1 << 20)
+	err = db.SetSkylinkSizes(ctx, map[string]uint64{sl.String(): size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UTC().Truncate(time.Millisecond)
+	s, err := db.FindAndLockUnderpinned(ctx, "locker", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Skylink != sl.String() {
+		t.Fatalf("Expected to lock '%s', got '%s'", sl, s.Skylink)
+	}
+	if s.LockedBy != "locker" {
+		t.Fatalf("Expected the skylink to be locked by 'locker', got '%s'", s.LockedBy)
+	}
+	if s.LockExpires.Before(start.Add(db.LockDuration())) {
+		t.Fatalf("Expected the lock to expire after %v, got %v", start.Add(db.LockDuration()), s.LockExpires)
+	}
+	if s.Size != size {
+		t.Fatalf("Expected size %d, got %d", size, s.Size)
+	}
+	if s.CreatedAt.IsZero() || s.Skylink != sl.String() {
+		t.Fatalf("Expected the full document, got %+v", s)
+	}
+	// The list of servers is left out.
+	if len(s.Servers) != 0 {
+		t.Fatalf("Expected no servers, got %v", s.Servers)
+	}
+	// The returned lock is the one in the database.
+	stored, err := db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LockedBy != s.LockedBy || !stored.LockExpires.Equal(s.LockExpires) {
+		t.Fatalf("Expected lock %s until %v, got %s until %v", stored.LockedBy, stored.LockExpires, s.LockedBy, s.LockExpires)
+	}
 }
 
 // TestFindAndLock ensures that FindAndLockUnderpinned will first check
@@ -289,7 +682,7 @@ func TestFindAndLockOwnFirst(t *testing.T) {
 	sl1 := test.RandomSkylink()
 	sl2 := test.RandomSkylink()
 	cfg.MinPinners = 2
-	otherServer := "other server"
+	otherServer := "other-server"
 	_, err = db.CreateSkylink(ctx, sl1, otherServer)
 	if err != nil {
 		t.Fatal(err)
@@ -299,7 +692,7 @@ func TestFindAndLockOwnFirst(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Fetch and lock one of those.
-	locked, err := db.FindAndLockUnderpinned(ctx, cfg.ServerName, cfg.MinPinners)
+	locked, err := db.FindAndLockUnderpinnedSkylink(ctx, cfg.ServerName, cfg.MinPinners)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -312,7 +705,7 @@ func TestFindAndLockOwnFirst(t *testing.T) {
 	}
 	// Try fetching another underpinned skylink before unlocking this one.
 	// Expect to get a different one.
-	newLocked, err := db.FindAndLockUnderpinned(ctx, cfg.ServerName, cfg.MinPinners)
+	newLocked, err := db.FindAndLockUnderpinnedSkylink(ctx, cfg.ServerName, cfg.MinPinners)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -326,14 +719,16 @@ func TestFindAndLockOwnFirst(t *testing.T) {
 	}
 	// Fetch a new underpinned skylink. Expect it to fail because we've run out
 	// of underpinned skylinks.
-	newLocked, err = db.FindAndLockUnderpinned(ctx, cfg.ServerName, cfg.MinPinners)
+	newLocked, err = db.FindAndLockUnderpinnedSkylink(ctx, cfg.ServerName, cfg.MinPinners)
 	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
 		t.Fatalf("Expected '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
 	}
 }
 
-// TestSkylinksForServer ensures that SkylinksForServer works as expected.
-func TestSkylinksForServer(t *testing.T) {
+// TestUnlockSkylink ensures that UnlockSkylink tells apart the skylinks it
+// unlocks, the ones which don't exist, the ones other servers hold locked and
+// the ones which aren't locked.
+func TestUnlockSkylink(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
 	}
@@ -344,82 +739,2918 @@ func TestSkylinksForServer(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	server := "server"
+	otherServer := "other-server"
 
-	sl1 := test.RandomSkylink()
-	sl2 := test.RandomSkylink()
-
-	srv1 := "server1"
-	srv2 := "server2"
-
-	// List all skylinks pinned by svr1. Expect an empty list.
-	ls, err := db.SkylinksForServer(ctx, srv1)
+	// The skylink doesn't exist.
+	sl := test.RandomSkylink()
+	err = db.UnlockSkylink(ctx, sl, server)
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected to get '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+	// The skylink exists and isn't locked.
+	_, err = db.CreateSkylink(ctx, sl, "pinning-server")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(ls) != 0 {
-		t.Fatalf("Expected empty list, got %d entries: %+v", len(ls), ls)
+	err = db.UnlockSkylink(ctx, sl, server)
+	if err != nil {
+		t.Fatal(err)
 	}
-	// Add a skylink.
-	_, err = db.CreateSkylink(ctx, sl1, srv1)
+	// Another server holds the lock. Expect the lock to stay.
+	locked, err := db.FindAndLockUnderpinnedSkylink(ctx, otherServer, 2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Make sure it shows up on the list.
-	ls, err = db.SkylinksForServer(ctx, srv1)
+	if !locked.Equals(sl) {
+		t.Fatalf("Expected to lock '%s', got '%s'", sl, locked)
+	}
+	err = db.UnlockSkylink(ctx, sl, server)
+	if !errors.Contains(err, database.ErrLockedByAnotherServer) {
+		t.Fatalf("Expected to get '%v', got '%v'", database.ErrLockedByAnotherServer, err)
+	}
+	s, err := db.FindSkylink(ctx, sl)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !test.Contains(ls, sl1.String()) {
-		t.Fatalf("Expected a list containing only %s but got %+v", sl1.String(), ls)
+	if s.LockedBy != otherServer {
+		t.Fatalf("Expected the skylink to be locked by '%s', got '%s'", otherServer, s.LockedBy)
 	}
-	// Add another skylink.
-	_, err = db.CreateSkylink(ctx, sl2, srv1)
+	// We hold the lock.
+	err = db.UnlockSkylink(ctx, sl, otherServer)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Make sure it shows up on the list.
-	ls, err = db.SkylinksForServer(ctx, srv1)
+	s, err = db.FindSkylink(ctx, sl)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !test.Contains(ls, sl1.String()) || !test.Contains(ls, sl2.String()) {
-		t.Fatalf("Expected a list containing both %s and %s but got %+v", sl1.String(), sl2.String(), ls)
+	if s.LockedBy != "" || !s.LockExpires.IsZero() {
+		t.Fatalf("Expected the skylink to be unlocked, got '%s' until %v", s.LockedBy, s.LockExpires)
 	}
-	// Add a second server to sl1 and expect it to still show up on the list.
-	err = db.AddServerForSkylink(ctx, sl1, srv2, false)
+}
+
+// TestMarkServerPinnedAndUnlock ensures that MarkServerPinnedAndUnlock adds the
+// server and releases its lock together and that it leaves other servers' locks
+// alone.
+func TestMarkServerPinnedAndUnlock(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
-	ls, err = db.SkylinksForServer(ctx, srv1)
+	server := "server"
+	otherServer := "other-server"
+	minPinners := 2
+
+	// Lock a skylink, pin it and expect it to be unlocked and pinned by us.
+	_, err = db.CreateSkylink(ctx, test.RandomSkylink(), otherServer)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !test.Contains(ls, sl1.String()) {
-		t.Fatalf("Expected a list containing both %s and %s but got %+v", sl1.String(), sl2.String(), ls)
+	sl, err := db.FindAndLockUnderpinnedSkylink(ctx, server, minPinners)
+	if err != nil {
+		t.Fatal(err)
 	}
-	// Remove srv1 as pinner for both sl1 and sl2.
-	err = db.RemoveServerFromSkylink(ctx, sl1, srv1)
+	err = db.MarkServerPinnedAndUnlock(ctx, sl, server)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = db.RemoveServerFromSkylink(ctx, sl2, srv1)
+	s, err := db.FindSkylink(ctx, sl)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Expect an empty list for srv1.
-	ls, err = db.SkylinksForServer(ctx, srv1)
+	if s.LockedBy != "" || !s.LockExpires.IsZero() {
+		t.Fatalf("Expected the skylink to be unlocked, got %+v", s)
+	}
+	if len(s.Servers) != 2 || !test.Contains(s.Servers, server) || !test.Contains(s.Servers, otherServer) {
+		t.Fatalf("Expected servers to be [%s %s], got %v", otherServer, server, s.Servers)
+	}
+	// Doing it again changes nothing but tells us we don't hold the lock.
+	err = db.MarkServerPinnedAndUnlock(ctx, sl, server)
+	if !errors.Contains(err, database.ErrNoSkylinksLocked) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrNoSkylinksLocked, err)
+	}
+	s2, err := db.FindSkylink(ctx, sl)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(ls) != 0 {
-		t.Fatalf("Expected empty list, got %d entries: %+v", len(ls), ls)
+	if len(s2.Servers) != 2 || s2.LockedBy != "" {
+		t.Fatalf("Expected the skylink to be unchanged, got %+v", s2)
 	}
-	// Expect sl1 to still appear in the list of srv2.
-	ls, err = db.SkylinksForServer(ctx, srv2)
+
+	// Let another server lock a skylink. Expect us to be added as a pinner
+	// but the other server's lock to stay in place.
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, otherServer, minPinners)
+	if !database.IsNoSkylinksNeedPinning(err) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
+	}
+	sl = test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl, server)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !test.Contains(ls, sl1.String()) {
-		t.Fatalf("Expected a list containing only %s but got %+v", sl1.String(), ls)
+	locked, err := db.FindAndLockUnderpinnedSkylink(ctx, otherServer, minPinners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked.Equals(sl) {
+		t.Fatalf("Expected to lock '%s', got '%s'", sl, locked)
+	}
+	before, err := db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RemoveServerFromSkylink(ctx, sl, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MarkServerPinnedAndUnlock(ctx, sl, server)
+	if !errors.Contains(err, database.ErrNoSkylinksLocked) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrNoSkylinksLocked, err)
+	}
+	s, err = db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LockedBy != otherServer || !s.LockExpires.Equal(before.LockExpires) {
+		t.Fatalf("Expected the lock of '%s' to be untouched, got %+v", otherServer, s)
+	}
+	if len(s.Servers) != 1 || s.Servers[0] != server {
+		t.Fatalf("Expected servers to be [%s], got %v", server, s.Servers)
+	}
+}
+
+// TestSkylinksForServer ensures that SkylinksForServer works as expected.
+func TestSkylinksForServer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+
+	srv1 := "server1"
+	srv2 := "server2"
+
+	// List all skylinks pinned by svr1. Expect an empty list.
+	ls, err := db.SkylinksForServer(ctx, srv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 0 {
+		t.Fatalf("Expected empty list, got %d entries: %+v", len(ls), ls)
+	}
+	// Add a skylink.
+	_, err = db.CreateSkylink(ctx, sl1, srv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure it shows up on the list.
+	ls, err = db.SkylinksForServer(ctx, srv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !test.Contains(ls, sl1.String()) {
+		t.Fatalf("Expected a list containing only %s but got %+v", sl1.String(), ls)
+	}
+	// Add another skylink.
+	_, err = db.CreateSkylink(ctx, sl2, srv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure it shows up on the list.
+	ls, err = db.SkylinksForServer(ctx, srv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !test.Contains(ls, sl1.String()) || !test.Contains(ls, sl2.String()) {
+		t.Fatalf("Expected a list containing both %s and %s but got %+v", sl1.String(), sl2.String(), ls)
+	}
+	// Add a second server to sl1 and expect it to still show up on the list.
+	err = db.AddServerForSkylink(ctx, sl1, srv2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err = db.SkylinksForServer(ctx, srv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !test.Contains(ls, sl1.String()) {
+		t.Fatalf("Expected a list containing both %s and %s but got %+v", sl1.String(), sl2.String(), ls)
+	}
+	// Remove srv1 as pinner for both sl1 and sl2.
+	err = db.RemoveServerFromSkylink(ctx, sl1, srv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RemoveServerFromSkylink(ctx, sl2, srv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expect an empty list for srv1.
+	ls, err = db.SkylinksForServer(ctx, srv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 0 {
+		t.Fatalf("Expected empty list, got %d entries: %+v", len(ls), ls)
+	}
+	// Expect sl1 to still appear in the list of srv2.
+	ls, err = db.SkylinksForServer(ctx, srv2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !test.Contains(ls, sl1.String()) {
+		t.Fatalf("Expected a list containing only %s but got %+v", sl1.String(), ls)
+	}
+}
+
+// TestForEachSkylinkForServer ensures that ForEachSkylinkForServer visits all
+// skylinks pinned by the given server and stops on the first error.
+func TestForEachSkylinkForServer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv1 := "server1"
+	srv2 := "server2"
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+	sl3 := test.RandomSkylink()
+	_, e1 := db.CreateSkylink(ctx, sl1, srv1)
+	_, e2 := db.CreateSkylink(ctx, sl2, srv1)
+	_, e3 := db.CreateSkylink(ctx, sl3, srv2)
+	if e := errors.Compose(e1, e2, e3); e != nil {
+		t.Fatal(e)
+	}
+
+	// Expect to visit sl1 and sl2 but not sl3.
+	var visited []string
+	err = db.ForEachSkylinkForServer(ctx, srv1, func(sl string) error {
+		visited = append(visited, sl)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 2 || !test.Contains(visited, sl1.String()) || !test.Contains(visited, sl2.String()) {
+		t.Fatalf("Expected to visit %s and %s, visited %v", sl1, sl2, visited)
+	}
+	// Expect the iteration to stop on the first error.
+	errVisit := errors.New("visit failed")
+	numVisited := 0
+	err = db.ForEachSkylinkForServer(ctx, srv1, func(sl string) error {
+		numVisited++
+		return errVisit
+	})
+	if !errors.Contains(err, errVisit) {
+		t.Fatalf("Expected error '%v', got '%v'", errVisit, err)
+	}
+	if numVisited != 1 {
+		t.Fatalf("Expected to visit a single skylink, visited %d", numVisited)
+	}
+}
+
+// TestSkylinksForServerPage ensures that paging through the skylinks of a
+// server visits each of them exactly once, even when skylinks are added and
+// removed between pages, and that ForEachSkylinkForServer visits the same set.
+func TestSkylinksForServerPage(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server"
+	numSkylinks := 2500
+	seeded := make([]string, 0, numSkylinks)
+	for i := 0; i < numSkylinks; i++ {
+		seeded = append(seeded, test.RandomSkylink().String())
+	}
+	err = db.AddServerForSkylinks(ctx, seeded, server, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another server's skylinks are never listed.
+	err = db.AddServerForSkylinks(ctx, []string{test.RandomSkylink().String()}, "other-server", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expect the streaming form to see all seeded skylinks.
+	streamed := make(map[string]struct{})
+	err = db.ForEachSkylinkForServer(ctx, server, func(sl string) error {
+		streamed[sl] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streamed) != numSkylinks {
+		t.Fatalf("Expected to stream %d skylinks, got %d", numSkylinks, len(streamed))
+	}
+
+	// Page through the skylinks. After the first page, remove a skylink we've
+	// already seen and add a new one. We generate the new one's ID after the
+	// seeded ones', so it's on a later page.
+	limit := 700
+	added := test.RandomSkylink()
+	seen := make(map[string]int)
+	token := ""
+	numPages := 0
+	for {
+		page, next, err := db.SkylinksForServerPage(ctx, server, token, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numPages++
+		if len(page) > limit {
+			t.Fatalf("Expected at most %d skylinks, got %d", limit, len(page))
+		}
+		for _, sl := range page {
+			seen[sl]++
+		}
+		if numPages == 1 {
+			removed, err := database.SkylinkFromString(page[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.RemoveServerFromSkylink(ctx, removed, server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateSkylink(ctx, added, server)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if numPages != numSkylinks/limit+1 {
+		t.Fatalf("Expected %d pages, got %d", numSkylinks/limit+1, numPages)
+	}
+	for _, sl := range seeded {
+		if seen[sl] != 1 {
+			t.Fatalf("Expected to see '%s' once, saw it %d times", sl, seen[sl])
+		}
+	}
+	if seen[added.String()] != 1 || len(seen) != numSkylinks+1 {
+		t.Fatalf("Expected to see the %d seeded skylinks and the added one, saw %d", numSkylinks, len(seen))
+	}
+
+	// Expect an error for invalid tokens and limits.
+	_, _, err = db.SkylinksForServerPage(ctx, server, "not a token", limit)
+	if !errors.Contains(err, database.ErrInvalidPageToken) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrInvalidPageToken, err)
+	}
+	// Older versions of pinner issued the documents' hex IDs as tokens.
+	_, _, err = db.SkylinksForServerPage(ctx, server, "62a1c5f0e4b0a1b2c3d4e5f6", limit)
+	if !errors.Contains(err, database.ErrInvalidPageToken) {
+		t.Fatalf("Expected error '%v', got '%v'", database.ErrInvalidPageToken, err)
+	}
+	_, _, err = db.SkylinksForServerPage(ctx, server, "", 0)
+	if err == nil {
+		t.Fatal("Expected an error for a zero limit.")
+	}
+}
+
+// TestUnpinnedSkylinks ensures that UnpinnedSkylinks only returns the given
+// skylinks which are marked as unpinned.
+func TestUnpinnedSkylinks(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := "server"
+	pinned := test.RandomSkylink()
+	unpinned := test.RandomSkylink()
+	unpinnedOther := test.RandomSkylink()
+	absent := test.RandomSkylink()
+	_, e1 := db.CreateSkylink(ctx, pinned, server)
+	_, e2 := db.CreateSkylink(ctx, unpinned, server)
+	_, e3 := db.CreateSkylink(ctx, unpinnedOther, server)
+	e4 := db.MarkUnpinned(ctx, unpinned, "server")
+	e5 := db.MarkUnpinned(ctx, unpinnedOther, "server")
+	if e := errors.Compose(e1, e2, e3, e4, e5); e != nil {
+		t.Fatal(e)
+	}
+
+	// Expect only the unpinned skylink from the list to be returned.
+	ls, err := db.UnpinnedSkylinks(ctx, []string{pinned.String(), unpinned.String(), absent.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 || ls[0] != unpinned.String() {
+		t.Fatalf("Expected only %s, got %v", unpinned, ls)
+	}
+	// Expect an empty list for an empty input.
+	ls, err = db.UnpinnedSkylinks(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 0 {
+		t.Fatalf("Expected an empty list, got %v", ls)
+	}
+}
+
+// TestSkylinkSizes ensures that SetSkylinkSizes stores the sizes of skylinks
+// and SkylinkSizes only returns the known ones.
+func TestSkylinkSizes(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := "server"
+	sized := test.RandomSkylink()
+	unsized := test.RandomSkylink()
+	absent := test.RandomSkylink()
+	_, e1 := db.CreateSkylink(ctx, sized, server)
+	_, e2 := db.CreateSkylink(ctx, unsized, server)
+	if e := errors.Compose(e1, e2); e != nil {
+		t.Fatal(e)
+	}
+	all := []string{sized.String(), unsized.String(), absent.String()}
+
+	// Expect no sizes before we set any.
+	sizes, err := db.SkylinkSizes(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 0 {
+		t.Fatalf("Expected no sizes, got %v", sizes)
+	}
+	// Set the size of one existing and one absent skylink. We expect only the
+	// existing one to be stored.
+	err = db.SetSkylinkSizes(ctx, map[string]uint64{sized.String(): 123, absent.String(): 456})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes, err = db.SkylinkSizes(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 1 || sizes[sized.String()] != 123 {
+		t.Fatalf("Expected only %s with size 123, got %v", sized, sizes)
+	}
+}
+
+// TestServerForSkylinksBatch ensures that AddServerForSkylinks and
+// RemoveServerFromSkylinks process all skylinks, even when they span multiple
+// batches, and report their progress.
+func TestServerForSkylinksBatch(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Use enough skylinks to span three batches.
+	numSkylinks := 2500
+	expectedBatches := database.NumBatches(numSkylinks)
+	if expectedBatches < 3 {
+		t.Fatalf("Expected at least 3 batches, got %d", expectedBatches)
+	}
+	skylinks := make([]string, numSkylinks)
+	for i := range skylinks {
+		skylinks[i] = test.RandomSkylink().String()
+	}
+	server := "batch-server"
+
+	// Add the server to all skylinks. None of them exist in the DB yet.
+	var calls, lastDone, lastTotal int
+	progress := func(done, total int) {
+		calls++
+		lastDone = done
+		lastTotal = total
+	}
+	err = db.AddServerForSkylinks(ctx, skylinks, server, false, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != expectedBatches || lastDone != expectedBatches || lastTotal != expectedBatches {
+		t.Fatalf("Unexpected progress: %d calls, %d/%d batches, expected %d", calls, lastDone, lastTotal, expectedBatches)
+	}
+	ls, err := db.SkylinksForServer(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != numSkylinks {
+		t.Fatalf("Expected %d skylinks, got %d", numSkylinks, len(ls))
+	}
+	// Adding them again should be a noop.
+	err = db.AddServerForSkylinks(ctx, skylinks, server, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err = db.SkylinksForServer(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != numSkylinks {
+		t.Fatalf("Expected %d skylinks, got %d", numSkylinks, len(ls))
+	}
+
+	// Remove the server from all but the last skylink.
+	calls = 0
+	err = db.RemoveServerFromSkylinks(ctx, skylinks[:numSkylinks-1], server, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != expectedBatches {
+		t.Fatalf("Expected %d progress calls, got %d", expectedBatches, calls)
+	}
+	ls, err = db.SkylinksForServer(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 || ls[0] != skylinks[numSkylinks-1] {
+		t.Fatalf("Expected only '%s', got %d skylinks", skylinks[numSkylinks-1], len(ls))
+	}
+	// Empty inputs are a noop.
+	err = errors.Compose(
+		db.AddServerForSkylinks(ctx, nil, server, false, nil),
+		db.RemoveServerFromSkylinks(ctx, nil, server, nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAddServerForSkylinksNewSkylinks ensures that AddServerForSkylinks inserts
+// well-formed documents for skylinks which don't exist in the database.
+func TestAddServerForSkylinksNewSkylinks(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+	sl3 := test.RandomSkylink()
+	server := "new-server"
+	otherServer := "other-server"
+
+	// sl3 already exists in the DB.
+	_, err = db.CreateSkylink(ctx, sl3, otherServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddServerForSkylinks(ctx, []string{sl1.String(), sl2.String(), sl3.String()}, server, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expect two well-formed documents for the new skylinks.
+	for _, sl := range []string{sl1.String(), sl2.String()} {
+		s, err := database.SkylinkFromString(sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := db.FindSkylink(ctx, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Skylink != sl {
+			t.Fatalf("Expected skylink '%s', got '%s'", sl, doc.Skylink)
+		}
+		if len(doc.Servers) != 1 || doc.Servers[0] != server {
+			t.Fatalf("Expected servers to be [%s], got %v", server, doc.Servers)
+		}
+		if !doc.Pinned {
+			t.Fatal("Expected the new skylink to be pinned.")
+		}
+	}
+	// Expect the existing document to have both servers.
+	doc, err := db.FindSkylink(ctx, sl3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Servers) != 2 || !test.Contains(doc.Servers, server) || !test.Contains(doc.Servers, otherServer) {
+		t.Fatalf("Expected servers to be [%s %s], got %v", otherServer, server, doc.Servers)
+	}
+	// Expect exactly the three skylinks to be listed for the new server, i.e.
+	// no additional malformed documents.
+	ls, err := db.SkylinksForServer(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 3 {
+		t.Fatalf("Expected 3 skylinks, got %d: %v", len(ls), ls)
+	}
+
+	// Add the server to a batch of skylinks none of which exists. This is the
+	// case in which an upsert with an `$in` filter would insert a malformed
+	// document.
+	sl4 := test.RandomSkylink()
+	sl5 := test.RandomSkylink()
+	err = db.AddServerForSkylinks(ctx, []string{sl4.String(), sl5.String()}, server, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sl := range []skymodules.Skylink{sl4, sl5} {
+		doc, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !doc.Pinned || len(doc.Servers) != 1 || doc.Servers[0] != server {
+			t.Fatalf("Unexpected document %+v", doc)
+		}
+	}
+	// Expect the collection to hold exactly the five skylinks. The histogram
+	// counts all pinned documents, whatever their skylink field holds.
+	counts, err := db.CountsByPinnerCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int]int64{1: 4, 2: 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected counts %v, got %v", expected, counts)
+	}
+}
+
+// TestClearExpiredLocks ensures that ClearExpiredLocks only clears locks which
+// have expired.
+func TestClearExpiredLocks(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create two underpinned skylinks.
+	minPinners := 2
+	otherServer := "other-server"
+	locker := "locker"
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl1, otherServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateSkylink(ctx, sl2, otherServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lock one of them with a live lock.
+	live, err := db.FindAndLockUnderpinnedSkylink(ctx, locker, minPinners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lock the other one with an expired lock.
+	db.SetLockDuration(-time.Hour)
+	expired, err := db.FindAndLockUnderpinnedSkylink(ctx, locker, minPinners)
+	db.SetLockDuration(database.DefaultLockDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired.Equals(live) {
+		t.Fatal("Expected to lock a different skylink.")
+	}
+
+	// Clear the expired locks. Expect exactly one to be cleared.
+	n, err := db.ClearExpiredLocks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 cleared lock, got %d", n)
+	}
+	s, err := db.FindSkylink(ctx, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LockedBy != "" || !s.LockExpires.IsZero() {
+		t.Fatalf("Expected the expired lock to be cleared, got '%s' until %v", s.LockedBy, s.LockExpires)
+	}
+	s, err = db.FindSkylink(ctx, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LockedBy != locker {
+		t.Fatalf("Expected the live lock to remain, got '%s'", s.LockedBy)
+	}
+	// Clearing again is a noop.
+	n, err = db.ClearExpiredLocks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("Expected 0 cleared locks, got %d", n)
+	}
+}
+
+// TestLockDuration ensures that FindAndLockUnderpinned locks skylinks for the
+// configured duration and that short locks expire as expected.
+func TestLockDuration(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.LockDuration() != database.DefaultLockDuration {
+		t.Fatalf("Expected the default lock duration of %v, got %v", database.DefaultLockDuration, db.LockDuration())
+	}
+
+	// Use the cluster-wide lock duration.
+	err = db.SetConfigValue(ctx, conf.ConfLockDuration, "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ld, err := conf.LockDuration(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ld != time.Minute {
+		t.Fatalf("Expected a lock duration of %v, got %v", time.Minute, ld)
+	}
+	db.SetLockDuration(ld)
+	minPinners := 2
+	locker := "locker"
+	_, err = db.CreateSkylink(ctx, test.RandomSkylink(), "other-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	sl, err := db.FindAndLockUnderpinnedSkylink(ctx, locker, minPinners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LockExpires.Before(start.Add(ld).Add(-time.Second)) || s.LockExpires.After(time.Now().Add(ld)) {
+		t.Fatalf("Expected the lock to expire in %v, it expires at %v", ld, s.LockExpires)
+	}
+	err = db.UnlockSkylink(ctx, sl, locker)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lock the skylink for a short time. Expect nobody else to lock it until
+	// the lock expires.
+	db.SetLockDuration(time.Second)
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, locker, minPinners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, "another-locker", minPinners)
+	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
+		t.Fatalf("Expected to get '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	relocked, err := db.FindAndLockUnderpinnedSkylink(ctx, "another-locker", minPinners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !relocked.Equals(sl) {
+		t.Fatalf("Expected to lock '%s' again, got '%s'", sl, relocked)
+	}
+}
+
+// TestCountsByPinnerCount ensures that CountsByPinnerCount and CountUnderpinned
+// count the skylinks by their number of pinners correctly.
+func TestCountsByPinnerCount(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An empty collection has an empty histogram.
+	counts, err := db.CountsByPinnerCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 0 {
+		t.Fatalf("Expected no counts, got %v", counts)
+	}
+
+	// createSkylink creates a skylink pinned by the given number of servers.
+	createSkylink := func(pinners int) skymodules.Skylink {
+		sl := test.RandomSkylink()
+		_, err := db.CreateSkylink(ctx, sl, "server0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < pinners; i++ {
+			err = db.AddServerForSkylink(ctx, sl, fmt.Sprintf("server%d", i), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if pinners == 0 {
+			err = db.RemoveServerFromSkylink(ctx, sl, "server0")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return sl
+	}
+	// Seed the collection.
+	expected := map[int]int64{0: 2, 1: 3, 2: 1, 4: 2}
+	for pinners, n := range expected {
+		for i := int64(0); i < n; i++ {
+			createSkylink(pinners)
+		}
+	}
+	// Unpinned skylinks are not counted.
+	err = db.MarkUnpinned(ctx, createSkylink(1), "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocked skylinks are counted in the histogram but they are never
+	// underpinned.
+	err = db.MarkBlocked(ctx, createSkylink(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected[0]++
+
+	counts, err = db.CountsByPinnerCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected counts %v, got %v", expected, counts)
+	}
+	tests := map[int]int64{0: 0, 1: 2, 2: 5, 3: 6, 5: 8}
+	for minPinners, exp := range tests {
+		n, err := db.CountUnderpinned(ctx, minPinners)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != exp {
+			t.Fatalf("Expected %d skylinks with fewer than %d pinners, got %d", exp, minPinners, n)
+		}
+	}
+}
+
+// TestCountUnderpinnedForServer ensures that CountUnderpinnedForServer agrees
+// with the number of skylinks a drain loop of FindAndLockUnderpinned returns.
+func TestCountUnderpinnedForServer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server"
+	n, err := db.CountUnderpinnedForServer(ctx, server, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("Expected no underpinned skylinks, got %d", n)
+	}
+
+	// createSkylink creates a skylink pinned by the given servers.
+	createSkylink := func(servers ...string) skymodules.Skylink {
+		sl := test.RandomSkylink()
+		_, err := db.CreateSkylink(ctx, sl, "seed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range servers {
+			err = db.AddServerForSkylink(ctx, sl, s, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = db.RemoveServerFromSkylink(ctx, sl, "seed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sl
+	}
+	// Seed the collection with skylinks the server could pin, skylinks it
+	// already pins, skylinks which are unpinned or blocked and skylinks
+	// which another server holds locked.
+	for i := 0; i < 5; i++ {
+		createSkylink()
+		createSkylink("other1")
+		createSkylink("other1", "other2")
+		createSkylink(server)
+	}
+	err = db.MarkUnpinned(ctx, createSkylink(), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MarkBlocked(ctx, createSkylink("other1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = db.FindAndLockUnderpinned(ctx, "locker", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, minPinners := range []int{1, 2, 3, 4} {
+		n, err := db.CountUnderpinnedForServer(ctx, server, minPinners)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Drain the underpinned skylinks the way the scanner does.
+		var locked []skymodules.Skylink
+		for {
+			s, err := db.FindAndLockUnderpinned(ctx, server, minPinners)
+			if errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			sl, err := database.SkylinkFromString(s.Skylink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			locked = append(locked, sl)
+		}
+		if n != int64(len(locked)) {
+			t.Fatalf("minPinners %d: expected %d skylinks, drained %d", minPinners, n, len(locked))
+		}
+		// Once we hold them locked, there is nothing left.
+		n, err = db.CountUnderpinnedForServer(ctx, server, minPinners)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Fatalf("minPinners %d: expected no skylinks after the drain, got %d", minPinners, n)
+		}
+		for _, sl := range locked {
+			err = db.UnlockSkylink(ctx, sl, server)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The global count doesn't care about the server or the locks.
+	global, err := db.CountUnderpinned(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = db.CountUnderpinnedForServer(ctx, server, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if global <= n {
+		t.Fatalf("Expected the global count %d to exceed the server's %d", global, n)
+	}
+}
+
+// TestSkylinkTimestamps ensures that the write methods set created_at and
+// updated_at as expected.
+func TestSkylinkTimestamps(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server"
+	otherServer := "other-server"
+
+	// find returns the skylink's document.
+	find := func(sl skymodules.Skylink) database.Skylink {
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	// expectUpdate runs the given write and expects it to move updated_at
+	// but not created_at, or neither of them if moves is false.
+	expectUpdate := func(name string, sl skymodules.Skylink, moves bool, write func() error) {
+		before := find(sl)
+		// The timestamps have a millisecond precision.
+		time.Sleep(10 * time.Millisecond)
+		if err := write(); err != nil {
+			t.Fatal(name, err)
+		}
+		after := find(sl)
+		if !after.CreatedAt.Equal(before.CreatedAt) {
+			t.Fatalf("%s: expected created_at to stay %v, got %v", name, before.CreatedAt, after.CreatedAt)
+		}
+		if moves && !after.UpdatedAt.After(before.UpdatedAt) {
+			t.Fatalf("%s: expected updated_at to move past %v, got %v", name, before.UpdatedAt, after.UpdatedAt)
+		}
+		if !moves && !after.UpdatedAt.Equal(before.UpdatedAt) {
+			t.Fatalf("%s: expected updated_at to stay %v, got %v", name, before.UpdatedAt, after.UpdatedAt)
+		}
+	}
+
+	// Every way of inserting a skylink sets both timestamps.
+	start := time.Now().Add(-time.Second)
+	sl := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slAdd := test.RandomSkylink()
+	err = db.AddServerForSkylink(ctx, slAdd, server, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slAddMany := test.RandomSkylink()
+	err = db.AddServerForSkylinks(ctx, []string{slAddMany.String()}, server, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slMark := test.RandomSkylink()
+	err = db.MarkPinned(ctx, slMark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []skymodules.Skylink{sl, slAdd, slAddMany, slMark} {
+		doc := find(s)
+		if doc.CreatedAt.Before(start) || doc.UpdatedAt.Before(start) {
+			t.Fatalf("Expected both timestamps to be set, got %+v", doc)
+		}
+	}
+	// Unpin the other skylinks, so sl is the only one we can lock.
+	for _, s := range []skymodules.Skylink{slAdd, slAddMany, slMark} {
+		err = db.MarkUnpinned(ctx, s, "server")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The writes which change the skylink move updated_at.
+	expectUpdate("MarkUnpinned", sl, true, func() error { return db.MarkUnpinned(ctx, sl, "server") })
+	expectUpdate("MarkPinned", sl, true, func() error { return db.MarkPinned(ctx, sl) })
+	expectUpdate("AddServerForSkylink", sl, true, func() error {
+		return db.AddServerForSkylink(ctx, sl, otherServer, false)
+	})
+	expectUpdate("RemoveServerFromSkylink", sl, true, func() error {
+		return db.RemoveServerFromSkylink(ctx, sl, otherServer)
+	})
+	expectUpdate("AddServerForSkylinks", sl, true, func() error {
+		return db.AddServerForSkylinks(ctx, []string{sl.String()}, otherServer, false, nil)
+	})
+	expectUpdate("RemoveServerFromSkylinks", sl, true, func() error {
+		return db.RemoveServerFromSkylinks(ctx, []string{sl.String()}, otherServer, nil)
+	})
+	expectUpdate("SetSkylinkSizes", sl, true, func() error {
+		return db.SetSkylinkSizes(ctx, map[string]uint64{sl.String(): 1 << 20})
+	})
+	// Locking and unlocking don't.
+	expectUpdate("FindAndLockUnderpinned", sl, false, func() error {
+		_, err := db.FindAndLockUnderpinnedSkylink(ctx, otherServer, 2)
+		return err
+	})
+	expectUpdate("UnlockSkylink", sl, false, func() error { return db.UnlockSkylink(ctx, sl, otherServer) })
+	// Pinning a locked skylink does, because it adds a server.
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, otherServer, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate("MarkServerPinnedAndUnlock", sl, true, func() error {
+		return db.MarkServerPinnedAndUnlock(ctx, sl, otherServer)
+	})
+	expectUpdate("MarkBlocked", sl, true, func() error { return db.MarkBlocked(ctx, sl) })
+}
+
+// TestProjections ensures that the queries on the hot paths only fetch the
+// fields they need. It compares the bytes they receive from the database with
+// the bytes a query for the full documents receives, over skylinks with long
+// lists of servers.
+func TestProjections(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// received counts the bytes of the replies to the commands we send.
+	var mu sync.Mutex
+	received := 0
+	monitor := &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mu.Lock()
+			received += len(e.Reply)
+			mu.Unlock()
+		},
+	}
+	// measure returns the number of bytes received while running fn.
+	measure := func(fn func() error) int {
+		mu.Lock()
+		received = 0
+		mu.Unlock()
+		if err := fn(); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+
+	ctx := context.Background()
+	db, err := database.NewCustomDB(ctx, test.SanitizeName(t.Name()), test.DBTestCredentials(), test.NewDiscardLogger(), database.WithCommandMonitor(monitor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Seed skylinks with long lists of servers.
+	numSkylinks := 100
+	numServers := 50
+	skylinks := make([]string, 0, numSkylinks)
+	for i := 0; i < numSkylinks; i++ {
+		skylinks = append(skylinks, test.RandomSkylink().String())
+	}
+	for i := 0; i < numServers; i++ {
+		err = db.AddServerForSkylinks(ctx, skylinks, fmt.Sprintf("server-with-a-fairly-long-name-%d", i), false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := "server-with-a-fairly-long-name-0"
+
+	// Fetch the full documents for comparison.
+	full := measure(func() error {
+		for _, sl := range skylinks {
+			s, err := database.SkylinkFromString(sl)
+			if err != nil {
+				return err
+			}
+			if _, err = db.FindSkylink(ctx, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	projected := measure(func() error {
+		ls, err := db.SkylinksForServer(ctx, server)
+		if err == nil && len(ls) != numSkylinks {
+			err = fmt.Errorf("expected %d skylinks, got %d", numSkylinks, len(ls))
+		}
+		return err
+	})
+	t.Logf("SkylinksForServer received %d bytes, the full documents take %d", projected, full)
+	if projected*4 > full {
+		t.Fatalf("Expected SkylinksForServer to receive far fewer than %d bytes, it received %d", full, projected)
+	}
+	perSkylink := full / numSkylinks
+	locked := measure(func() error {
+		_, err := db.FindAndLockUnderpinnedSkylink(ctx, "new-server", numServers+1)
+		return err
+	})
+	t.Logf("FindAndLockUnderpinned received %d bytes, a full document takes about %d", locked, perSkylink)
+	if locked*2 > perSkylink {
+		t.Fatalf("Expected FindAndLockUnderpinned to receive far fewer than %d bytes, it received %d", perSkylink, locked)
+	}
+}
+
+// TestOwners ensures that skylinks keep track of their owners and that they
+// are unpinned once their last owner is removed.
+func TestOwners(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "owners-server"
+	sl := test.RandomSkylink()
+
+	// expectOwners fails the test if the skylink doesn't have the given
+	// owners and pinned flag.
+	expectOwners := func(step string, sl skymodules.Skylink, pinned bool, owners ...string) {
+		t.Helper()
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(step, err)
+		}
+		sort.Strings(s.Owners)
+		if s.Pinned != pinned || len(s.Owners) != len(owners) || (len(owners) > 0 && !reflect.DeepEqual(s.Owners, owners)) {
+			t.Fatalf("%s: expected pinned %t and owners %v, got %t and %v", step, pinned, owners, s.Pinned, s.Owners)
+		}
+	}
+
+	// Owners can only be added to existing skylinks.
+	err = db.AddOwner(ctx, sl, "alice")
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+	_, err = db.RemoveOwner(ctx, sl, "alice")
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+	_, err = db.CreateSkylink(ctx, sl, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddOwner(ctx, sl, "")
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+	expectOwners("no owners", sl, true)
+
+	// Adding an owner twice only adds it once.
+	for _, owner := range []string{"alice", "bob", "alice"} {
+		err = db.AddOwner(ctx, sl, owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectOwners("two owners", sl, true, "alice", "bob")
+
+	// Removing an owner the skylink doesn't have changes nothing.
+	unpinned, err := db.RemoveOwner(ctx, sl, "carol")
+	if err != nil || unpinned {
+		t.Fatalf("Expected no change, got %t and '%v'", unpinned, err)
+	}
+	expectOwners("unknown owner", sl, true, "alice", "bob")
+	// The skylink stays pinned until its last owner is removed.
+	unpinned, err = db.RemoveOwner(ctx, sl, "alice")
+	if err != nil || unpinned {
+		t.Fatalf("Expected the skylink to stay pinned, got %t and '%v'", unpinned, err)
+	}
+	expectOwners("one owner left", sl, true, "bob")
+	// Removing an owner twice only removes it once.
+	unpinned, err = db.RemoveOwner(ctx, sl, "alice")
+	if err != nil || unpinned {
+		t.Fatalf("Expected no change, got %t and '%v'", unpinned, err)
+	}
+	unpinned, err = db.RemoveOwner(ctx, sl, "bob")
+	if err != nil || !unpinned {
+		t.Fatalf("Expected the skylink to be unpinned, got %t and '%v'", unpinned, err)
+	}
+	expectOwners("no owners left", sl, false)
+	// A new owner pins it again.
+	err = db.AddOwner(ctx, sl, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOwners("new owner", sl, true, "carol")
+
+	// Skylinks pinned without an owner can't be unpinned by one.
+	legacy := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, legacy, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpinned, err = db.RemoveOwner(ctx, legacy, "alice")
+	if err != nil || unpinned {
+		t.Fatalf("Expected no change, got %t and '%v'", unpinned, err)
+	}
+	expectOwners("legacy", legacy, true)
+
+	// When all owners are removed concurrently, exactly one removal unpins
+	// the skylink.
+	concurrent := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, concurrent, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := make([]string, 10)
+	for i := range owners {
+		owners[i] = fmt.Sprintf("owner %d", i)
+		err = db.AddOwner(ctx, concurrent, owners[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	var numUnpinned int32
+	for _, owner := range owners {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			unpinned, err := db.RemoveOwner(ctx, concurrent, owner)
+			if err != nil {
+				t.Error(err)
+			}
+			if unpinned {
+				atomic.AddInt32(&numUnpinned, 1)
+			}
+		}(owner)
+	}
+	wg.Wait()
+	if numUnpinned != 1 {
+		t.Fatalf("Expected a single removal to unpin the skylink, got %d", numUnpinned)
+	}
+	expectOwners("concurrent", concurrent, false)
+}
+
+// TestUnpinnedAt ensures that we record when skylinks get unpinned and that we
+// forget it when they get pinned again.
+func TestUnpinnedAt(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := test.RandomSkylink()
+
+	// unpinnedAt returns the skylink's unpinned_at.
+	unpinnedAt := func(sl skymodules.Skylink) time.Time {
+		t.Helper()
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.UnpinnedAt
+	}
+
+	err = db.MarkUnpinned(ctx, sl, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := unpinnedAt(sl)
+	if first.IsZero() {
+		t.Fatal("Expected unpinned_at to be set.")
+	}
+	// Unpinning it again doesn't move the time.
+	time.Sleep(10 * time.Millisecond)
+	err = db.MarkUnpinned(ctx, sl, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at := unpinnedAt(sl); !at.Equal(first) {
+		t.Fatalf("Expected unpinned_at %v, got %v", first, at)
+	}
+	// Each way of pinning the skylink clears it.
+	pinFns := map[string]func() error{
+		"MarkPinned": func() error { return db.MarkPinned(ctx, sl) },
+		"AddOwner":   func() error { return db.AddOwner(ctx, sl, "owner") },
+		"AddServerForSkylink": func() error {
+			return db.AddServerForSkylink(ctx, sl, "server", true)
+		},
+		"AddServerForSkylinks": func() error {
+			return db.AddServerForSkylinks(ctx, []string{sl.String()}, "server", true, nil)
+		},
+	}
+	for name, pin := range pinFns {
+		err = db.MarkUnpinned(ctx, sl, "server")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pin()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if at := unpinnedAt(sl); !at.IsZero() {
+			t.Fatalf("%s: expected no unpinned_at, got %v", name, at)
+		}
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.UnpinnedBy != "" {
+			t.Fatalf("%s: expected no unpinned_by, got '%s'", name, s.UnpinnedBy)
+		}
+	}
+	// Removing the last owner sets it.
+	err = db.AddOwner(ctx, sl, "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.RemoveOwner(ctx, sl, "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpinnedAt(sl).IsZero() {
+		t.Fatal("Expected unpinned_at to be set.")
+	}
+}
+
+// TestUnpinnedBy ensures that we record the server which first unpinned a
+// skylink and that we forget it when the skylink gets pinned again.
+func TestUnpinnedBy(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unpinned returns the skylink's unpinned_by and unpinned_at.
+	unpinned := func() (string, time.Time) {
+		t.Helper()
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.UnpinnedBy, s.UnpinnedAt
+	}
+
+	err = db.MarkUnpinned(ctx, sl, "")
+	if err == nil {
+		t.Fatal("Expected an error for an empty server name.")
+	}
+	if by, _ := unpinned(); by != "" {
+		t.Fatalf("Expected no unpinned_by, got '%s'", by)
+	}
+	err = db.MarkUnpinned(ctx, sl, "$first")
+	if !errors.Contains(err, database.ErrInvalidServerName) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidServerName, err)
+	}
+	err = db.MarkUnpinned(ctx, sl, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	by, at := unpinned()
+	if by != "first" || at.IsZero() {
+		t.Fatalf("Expected the skylink to be unpinned by 'first', got '%s' at %v", by, at)
+	}
+	// Unpinning it again keeps the first server and time.
+	err = db.MarkUnpinned(ctx, sl, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if by2, at2 := unpinned(); by2 != by || !at2.Equal(at) {
+		t.Fatalf("Expected '%s' at %v, got '%s' at %v", by, at, by2, at2)
+	}
+	// Pinning it clears both.
+	err = db.MarkPinned(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if by, at = unpinned(); by != "" || !at.IsZero() {
+		t.Fatalf("Expected no unpinned_by and unpinned_at, got '%s' at %v", by, at)
+	}
+	// The next unpin records its own server.
+	err = db.MarkUnpinned(ctx, sl, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if by, _ = unpinned(); by != "second" {
+		t.Fatalf("Expected the skylink to be unpinned by 'second', got '%s'", by)
+	}
+	// Unpinning a skylink we don't know records the server as well.
+	sl2 := test.RandomSkylink()
+	err = db.MarkUnpinned(ctx, sl2, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.FindSkylink(ctx, sl2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.UnpinnedBy != "server" || s.UnpinnedAt.IsZero() || s.CreatedAt.IsZero() || s.Servers == nil {
+		t.Fatalf("Unexpected skylink %+v", s)
+	}
+}
+
+// TestDeleteUnpinned ensures that DeleteUnpinned only deletes the skylinks which
+// have been unpinned for longer than the retention period and which no server
+// pins anymore.
+func TestDeleteUnpinned(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("skylinks")
+	retention := 90 * 24 * time.Hour
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name       string
+		servers    bson.A
+		pinned     bool
+		unpinnedAt interface{}
+		deleted    bool
+	}{
+		{name: "expired", servers: bson.A{}, unpinnedAt: now.Add(-retention - time.Minute), deleted: true},
+		{name: "long expired without servers field", unpinnedAt: now.Add(-2 * retention), deleted: true},
+		{name: "not expired yet", servers: bson.A{}, unpinnedAt: now.Add(-retention + time.Minute)},
+		{name: "expired but still pinned by a server", servers: bson.A{"server"}, unpinnedAt: now.Add(-2 * retention)},
+		{name: "pinned", servers: bson.A{}, pinned: true},
+		{name: "unpinned without unpinned_at", servers: bson.A{}},
+	}
+	skylinks := make([]skymodules.Skylink, len(tests))
+	for i, tst := range tests {
+		skylinks[i] = test.RandomSkylink()
+		doc := bson.M{"_id": skylinks[i].String(), "pinned": tst.pinned}
+		if tst.servers != nil {
+			doc["servers"] = tst.servers
+		}
+		if tst.unpinnedAt != nil {
+			doc["unpinned_at"] = tst.unpinnedAt
+		}
+		_, err = coll.InsertOne(ctx, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = db.DeleteUnpinned(ctx, 0)
+	if err == nil {
+		t.Fatal("Expected an error for a zero retention.")
+	}
+	n, err := db.DeleteUnpinned(ctx, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("Expected to delete 2 skylinks, deleted %d", n)
+	}
+	for i, tst := range tests {
+		_, err = db.FindSkylink(ctx, skylinks[i])
+		if tst.deleted && !errors.Contains(err, database.ErrSkylinkNotExist) {
+			t.Fatalf("%s: expected the skylink to be deleted, got '%v'", tst.name, err)
+		}
+		if !tst.deleted && err != nil {
+			t.Fatalf("%s: expected the skylink to be kept, got '%v'", tst.name, err)
+		}
+	}
+	// Running it again deletes nothing.
+	n, err = db.DeleteUnpinned(ctx, retention)
+	if err != nil || n != 0 {
+		t.Fatalf("Expected to delete nothing, got %d and '%v'", n, err)
+	}
+}
+
+// TestNumServers ensures that num_servers always matches the skylinks' servers,
+// regardless of which methods change them and whether they do it concurrently.
+func TestNumServers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// expectConsistent checks the given skylinks' num_servers.
+	expectConsistent := func(skylinks []string) {
+		t.Helper()
+		found, _, err := db.FindSkylinks(ctx, skylinks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range found {
+			if s.NumServers != len(s.Servers) {
+				t.Fatalf("Skylink %s has num_servers %d but servers %v", s.Skylink, s.NumServers, s.Servers)
+			}
+		}
+	}
+
+	// Each method keeps the counter up to date.
+	sl := test.RandomSkylink()
+	skylinks := []string{sl.String()}
+	steps := []struct {
+		name string
+		fn   func() error
+		n    int
+	}{
+		{"MarkPinned", func() error { return db.MarkPinned(ctx, sl) }, 0},
+		{"AddServerForSkylink", func() error { return db.AddServerForSkylink(ctx, sl, "a", false) }, 1},
+		{"AddServerForSkylink again", func() error { return db.AddServerForSkylink(ctx, sl, "a", true) }, 1},
+		{"AddServerForSkylinks", func() error { return db.AddServerForSkylinks(ctx, skylinks, "b", false, nil) }, 2},
+		{"MarkServerPinnedAndUnlock", func() error {
+			err := db.MarkServerPinnedAndUnlock(ctx, sl, "c")
+			if errors.Contains(err, database.ErrNoSkylinksLocked) {
+				return nil
+			}
+			return err
+		}, 3},
+		{"RemoveServerFromSkylink", func() error { return db.RemoveServerFromSkylink(ctx, sl, "a") }, 2},
+		{"RemoveServerFromSkylinks", func() error { return db.RemoveServerFromSkylinks(ctx, skylinks, "b", nil) }, 1},
+		{"RenameServer", func() error { return db.RenameServer(ctx, "c", "d") }, 1},
+		{"RemoveServer", func() error {
+			_, err := db.RemoveServer(ctx, "d", nil)
+			return err
+		}, 0},
+	}
+	for _, step := range steps {
+		err = step.fn()
+		if err != nil {
+			t.Fatal(step.name, err)
+		}
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.NumServers != step.n || len(s.Servers) != step.n {
+			t.Fatalf("%s: expected %d servers, got num_servers %d and servers %v", step.name, step.n, s.NumServers, s.Servers)
+		}
+	}
+	created, err := db.CreateSkylink(ctx, test.RandomSkylink(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.NumServers != 1 {
+		t.Fatalf("CreateSkylink: expected num_servers 1, got %d", created.NumServers)
+	}
+
+	// Many servers add and remove themselves concurrently.
+	skylinks = make([]string, 10)
+	for i := range skylinks {
+		skylinks[i] = test.RandomSkylink().String()
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				err := db.AddServerForSkylinks(ctx, skylinks, server, false, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for _, slStr := range skylinks {
+					s, err := database.SkylinkFromString(slStr)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if j%2 == 1 {
+						err = db.RemoveServerFromSkylink(ctx, s, server)
+					} else {
+						err = db.AddServerForSkylink(ctx, s, server, false)
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(fmt.Sprintf("server-%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	expectConsistent(skylinks)
+	// Every server added itself last.
+	found, _, err := db.FindSkylinks(ctx, skylinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range found {
+		if s.NumServers != 10 {
+			t.Fatalf("Expected 10 servers, got %d", s.NumServers)
+		}
+	}
+}
+
+// TestMarkUnknownSkylink ensures that marking a skylink we don't know as pinned
+// or unpinned adds a document with all the fields CreateSkylink sets, so the
+// methods which expect them work on it.
+func TestMarkUnknownSkylink(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("skylinks")
+
+	unpinned := test.RandomSkylink()
+	err = db.MarkUnpinned(ctx, unpinned, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := test.RandomSkylink()
+	err = db.MarkPinned(ctx, pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sl := range []skymodules.Skylink{unpinned, pinned} {
+		var doc bson.M
+		err = coll.FindOne(ctx, bson.M{"_id": sl.String()}).Decode(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range []string{"servers", "num_servers", "locked_by", "lock_expires", "created_at", "updated_at"} {
+			if _, exists := doc[field]; !exists {
+				t.Fatalf("Expected field '%s' in %v", field, doc)
+			}
+		}
+		if servers, ok := doc["servers"].(bson.A); !ok || len(servers) != 0 {
+			t.Fatalf("Expected an empty list of servers, got %v", doc["servers"])
+		}
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.NumServers != 0 {
+			t.Fatalf("Expected num_servers 0, got %d", s.NumServers)
+		}
+	}
+
+	// Servers can be added to and removed from the new documents.
+	err = db.AddServerForSkylinks(ctx, []string{unpinned.String(), pinned.String()}, "server", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.FindSkylink(ctx, pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NumServers != 1 || !test.Contains(s.Servers, "server") {
+		t.Fatalf("Expected the server to be added, got %+v", s)
+	}
+	// The pinned skylink is underpinned and can be locked.
+	locked, err := db.FindAndLockUnderpinnedSkylink(ctx, "other-server", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked.Equals(pinned) {
+		t.Fatalf("Expected to lock '%s', got '%s'", pinned, locked)
+	}
+	err = db.RemoveServerFromSkylinks(ctx, []string{unpinned.String()}, "server", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = db.FindSkylink(ctx, unpinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NumServers != 0 || len(s.Servers) != 0 || s.Pinned {
+		t.Fatalf("Expected an unpinned skylink without servers, got %+v", s)
+	}
+}
+
+// TestCanonicalSkylinks ensures that all encodings of a skylink map to the same
+// canonical document.
+func TestCanonicalSkylinks(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("skylinks")
+
+	sl := test.RandomSkylink()
+	base32 := sl.Base32EncodedString()
+	withPath := sl.String() + "/some/path?format=zip"
+	parsed, err := database.SkylinkFromString(base32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateSkylink(ctx, parsed, "server-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddServerForSkylinks(ctx, []string{base32, withPath}, "server-b", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A new skylink given in two encodings is inserted once.
+	sl2 := test.RandomSkylink()
+	err = db.AddServerForSkylinks(ctx, []string{sl2.Base32EncodedString(), sl2.String() + "/path"}, "server-a", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []skymodules.Skylink{sl, sl2} {
+		n, err := coll.CountDocuments(ctx, bson.M{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("Expected 2 documents, got %d", n)
+		}
+		n, err = coll.CountDocuments(ctx, bson.M{"_id": s.String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("Expected a single canonical document of '%s', got %d", s, n)
+		}
+	}
+	s, err := db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NumServers != 2 || !test.Contains(s.Servers, "server-a") || !test.Contains(s.Servers, "server-b") {
+		t.Fatalf("Expected both servers, got %+v", s)
+	}
+
+	// The lookups accept any encoding and return the skylinks as given.
+	found, missing, err := db.FindSkylinks(ctx, []string{base32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || len(missing) != 0 {
+		t.Fatalf("Expected to find the skylink, got %v and %v", found, missing)
+	}
+	err = db.SetSkylinkSizes(ctx, map[string]uint64{withPath: 123})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes, err := db.SkylinkSizes(ctx, []string{base32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes[base32] != 123 {
+		t.Fatalf("Expected size 123, got %v", sizes)
+	}
+	err = db.MarkUnpinned(ctx, sl, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpinned, err := db.UnpinnedSkylinks(ctx, []string{withPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unpinned) != 1 || unpinned[0] != withPath {
+		t.Fatalf("Expected ['%s'], got %v", withPath, unpinned)
+	}
+	err = db.RemoveServerFromSkylinks(ctx, []string{base32}, "server-b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NumServers != 1 || test.Contains(s.Servers, "server-b") {
+		t.Fatalf("Expected the server to be removed, got %+v", s)
+	}
+
+	// Invalid skylinks are rejected.
+	err = db.AddServerForSkylinks(ctx, []string{sl.String(), "not a skylink"}, "server-c", false, nil)
+	if !errors.Contains(err, database.ErrInvalidSkylink) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrInvalidSkylink, err)
+	}
+}
+
+// TestUnderpinnedHint ensures that FindAndLockUnderpinned hints MongoDB to use
+// the index we configure and that ExplainUnderpinned reports the plan which
+// uses it.
+func TestUnderpinnedHint(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// hints records the hint of each findAndModify command we send.
+	var mu sync.Mutex
+	var hints []string
+	monitor := &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			if e.CommandName != "findAndModify" {
+				return
+			}
+			hint, _ := e.Command.Lookup("hint").StringValueOK()
+			mu.Lock()
+			hints = append(hints, hint)
+			mu.Unlock()
+		},
+	}
+	// lastHint returns the hint of the last findAndModify command.
+	lastHint := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(hints) == 0 {
+			t.Fatal("Expected a findAndModify command")
+		}
+		return hints[len(hints)-1]
+	}
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name(), database.WithCommandMonitor(monitor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl, "other-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a hint we let the query planner pick.
+	_, err = db.FindAndLockUnderpinned(ctx, "server", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hint := lastHint(); hint != "" {
+		t.Fatalf("Expected no hint, got '%s'", hint)
+	}
+	_, err = db.ExplainUnderpinned(ctx, "server", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With a hint we send it with the query.
+	hinted, err := test.NewDatabase(ctx, t.Name(), database.WithCommandMonitor(monitor), database.WithUnderpinnedHint("num_servers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UnlockSkylink(ctx, sl, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = hinted.FindAndLockUnderpinned(ctx, "server", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hint := lastHint(); hint != "num_servers" {
+		t.Fatalf("Expected hint 'num_servers', got '%s'", hint)
+	}
+	// The plan uses the hinted index.
+	plan, err := hinted.ExplainUnderpinned(ctx, "server", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.CollScan || !test.Contains(plan.Indexes, "num_servers") {
+		t.Fatalf("Expected the plan to use the num_servers index, got stages %v and indexes %v", plan.Stages, plan.Indexes)
+	}
+}
+
+// TestUpdateSkylinkWithRevision ensures that the skylinks' revision moves with
+// each update and that UpdateSkylinkWithRevision detects lost updates.
+func TestUpdateSkylinkWithRevision(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := test.RandomSkylink()
+
+	// Updating a skylink we don't know fails.
+	err = db.UpdateSkylinkWithRevision(ctx, sl, 0, bson.M{"$set": bson.M{"size": 1}})
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+	s, err := db.CreateSkylink(ctx, sl, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Revision != 0 {
+		t.Fatalf("Expected revision 0, got %d", s.Revision)
+	}
+	// revision returns the skylink's current revision.
+	revision := func() int64 {
+		t.Helper()
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Revision
+	}
+	// The regular updates move the revision.
+	updates := map[string]func() error{
+		"MarkPinned":          func() error { return db.MarkPinned(ctx, sl) },
+		"AddOwner":            func() error { return db.AddOwner(ctx, sl, "owner") },
+		"AddServerForSkylink": func() error { return db.AddServerForSkylink(ctx, sl, "other-server", false) },
+		"RemoveServerFromSkylink": func() error {
+			return db.RemoveServerFromSkylink(ctx, sl, "other-server")
+		},
+	}
+	for name, update := range updates {
+		before := revision()
+		err = update()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if after := revision(); after != before+1 {
+			t.Fatalf("%s: expected revision %d, got %d", name, before+1, after)
+		}
+	}
+
+	// Simulate two writers which read the skylink at the same revision.
+	rev := revision()
+	err = db.UpdateSkylinkWithRevision(ctx, sl, rev, bson.M{"$set": bson.M{"size": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UpdateSkylinkWithRevision(ctx, sl, rev, bson.M{"$set": bson.M{"size": 2}})
+	if !errors.Contains(err, database.ErrStaleRevision) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrStaleRevision, err)
+	}
+	s, err = db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size != 1 || s.Revision != rev+1 {
+		t.Fatalf("Expected the first write to win, got size %d at revision %d", s.Size, s.Revision)
+	}
+	// A simple update in between makes the revision stale as well.
+	err = db.AddOwner(ctx, sl, "another owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UpdateSkylinkWithRevision(ctx, sl, s.Revision, bson.M{"$set": bson.M{"size": 3}})
+	if !errors.Contains(err, database.ErrStaleRevision) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrStaleRevision, err)
+	}
+
+	// Concurrent read-modify-write loops which retry on stale revisions
+	// don't lose any updates.
+	numWriters := 10
+	var wg sync.WaitGroup
+	errs := make([]error, numWriters)
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				s, err := db.FindSkylink(ctx, sl)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				err = db.UpdateSkylinkWithRevision(ctx, sl, s.Revision, bson.M{"$set": bson.M{"size": s.Size + 1}})
+				if errors.Contains(err, database.ErrStaleRevision) {
+					continue
+				}
+				errs[i] = err
+				return
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err = errors.Compose(errs...); err != nil {
+		t.Fatal(err)
+	}
+	s, err = db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size != uint64(1+numWriters) {
+		t.Fatalf("Expected size %d, got %d", 1+numWriters, s.Size)
+	}
+}
+
+// TestDocSizeGuard ensures that we refuse to grow the skylinks' documents past
+// the maximum size and that DocSizeStats reports the large documents.
+func TestDocSizeGuard(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	logger, hook := logtest.NewNullLogger()
+	maxSize := int64(4096)
+	db, err := database.NewCustomDB(ctx, test.SanitizeName(t.Name()), test.DBTestCredentials(), logger, database.WithMaxDocSize(maxSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Grow a skylink past the maximum size with servers with long names.
+	large := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, large, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	longName := func(i int) string {
+		return fmt.Sprintf("%d-%s", i, strings.Repeat("x", 240))
+	}
+	i := 0
+	for ; ; i++ {
+		err = db.AddServerForSkylink(ctx, large, longName(i), false)
+		if errors.Contains(err, database.ErrSkylinkTooLarge) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 100 {
+			t.Fatal("Expected the skylink to become too large")
+		}
+	}
+	s, err := db.FindSkylink(ctx, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test.Contains(s.Servers, longName(i)) {
+		t.Fatal("Expected the server not to be added")
+	}
+	// Adding a server or an owner it already has still works.
+	err = db.AddServerForSkylink(ctx, large, longName(0), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddOwner(ctx, large, "owner")
+	if !errors.Contains(err, database.ErrSkylinkTooLarge) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkTooLarge, err)
+	}
+	err = db.AddOwner(ctx, test.RandomSkylink(), "owner")
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+	// Neither does marking it as pinned by a server which locked it.
+	locked, err := db.FindAndLockUnderpinnedSkylink(ctx, "locker", len(s.Servers)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked.String() != large.String() {
+		t.Fatalf("Expected to lock '%s', got '%s'", large, locked)
+	}
+	err = db.MarkServerPinnedAndUnlock(ctx, locked, "locker")
+	if !errors.Contains(err, database.ErrSkylinkTooLarge) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkTooLarge, err)
+	}
+	s, err = db.FindSkylink(ctx, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test.Contains(s.Servers, "locker") {
+		t.Fatal("Expected the locking server not to be added")
+	}
+	// The batch skips the large skylink but adds the server to the others.
+	small := test.RandomSkylink()
+	err = db.AddServerForSkylinks(ctx, []string{large.String(), small.String()}, "batch-server", false, nil)
+	if !errors.Contains(err, database.ErrSkylinkTooLarge) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkTooLarge, err)
+	}
+	s, err = db.FindSkylink(ctx, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !test.Contains(s.Servers, "batch-server") {
+		t.Fatalf("Expected the server to be added to the small skylink, got %v", s.Servers)
+	}
+	s, err = db.FindSkylink(ctx, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test.Contains(s.Servers, "batch-server") {
+		t.Fatal("Expected the server not to be added to the large skylink")
+	}
+
+	// The stats report the large skylink and warn about it.
+	hook.Reset()
+	stats, err := db.DocSizeStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 2 || stats.Max < maxSize || len(stats.Largest) != 2 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	if stats.Largest[0].Skylink != large.String() || stats.Largest[0].Size != stats.Max {
+		t.Fatalf("Expected the large skylink first, got %+v", stats.Largest)
+	}
+	if stats.P50 <= 0 || stats.P50 > stats.P99 || stats.P99 > stats.Max {
+		t.Fatalf("Unexpected percentiles %+v", stats)
+	}
+	entry := hook.LastEntry()
+	if entry == nil || entry.Level != logrus.WarnLevel || !strings.Contains(entry.Message, large.String()) {
+		t.Fatalf("Expected a warning about the large skylink, got %v", entry)
+	}
+}
+
+// TestSoftDeleteSkylink ensures that the read queries don't see soft-deleted
+// skylinks and that restoring or pinning them brings them back.
+func TestSoftDeleteSkylink(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server"
+	sl := test.RandomSkylink()
+	ul := test.RandomSkylink()
+	for _, s := range []skymodules.Skylink{sl, ul} {
+		_, err = db.CreateSkylink(ctx, s, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.MarkUnpinned(ctx, ul, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetSkylinkSizes(ctx, map[string]uint64{sl.String(): 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting a skylink we don't know fails.
+	err = db.SoftDeleteSkylink(ctx, test.RandomSkylink())
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+	for _, s := range []skymodules.Skylink{sl, ul} {
+		err = db.SoftDeleteSkylink(ctx, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deleting it twice fails as well.
+	err = db.SoftDeleteSkylink(ctx, sl)
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+
+	// None of the reads see the deleted skylinks.
+	_, err = db.FindSkylink(ctx, sl)
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+	found, missing, err := db.FindSkylinks(ctx, []string{sl.String(), ul.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 || len(missing) != 2 {
+		t.Fatalf("Expected no skylinks found and 2 missing, got %d and %d", len(found), len(missing))
+	}
+	sls, err := db.SkylinksForServer(ctx, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sls) != 0 {
+		t.Fatalf("Expected no skylinks for the server, got %v", sls)
+	}
+	err = db.ForEachSkylinkForServer(ctx, server, func(skylink string) error {
+		return fmt.Errorf("unexpected skylink '%s'", skylink)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sls, _, err = db.SkylinksForServerPage(ctx, server, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sls) != 0 {
+		t.Fatalf("Expected no skylinks on the page, got %v", sls)
+	}
+	sls, err = db.UnpinnedSkylinks(ctx, []string{ul.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sls) != 0 {
+		t.Fatalf("Expected no unpinned skylinks, got %v", sls)
+	}
+	sizes, err := db.SkylinkSizes(ctx, []string{sl.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 0 {
+		t.Fatalf("Expected no sizes, got %v", sizes)
+	}
+	counts, err := db.CountsByPinnerCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 0 {
+		t.Fatalf("Expected no counts, got %v", counts)
+	}
+	n, err := db.CountUnderpinned(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("Expected no underpinned skylinks, got %d", n)
+	}
+	n, err = db.CountUnderpinnedForServer(ctx, "other", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("Expected no underpinned skylinks for the server, got %d", n)
+	}
+	_, err = db.FindAndLockUnderpinned(ctx, "other", 2)
+	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
+	}
+
+	// Restoring a skylink we don't know fails.
+	err = db.RestoreSkylink(ctx, test.RandomSkylink())
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+	// Restoring brings the skylink back as it was.
+	err = db.RestoreSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Pinned || len(s.Servers) != 1 || s.Servers[0] != server || !s.DeletedAt.IsZero() {
+		t.Fatalf("Unexpected skylink after restoring it: %+v", s)
+	}
+	n, err = db.CountUnderpinnedForServer(ctx, "other", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 underpinned skylink for the server, got %d", n)
+	}
+	// Pinning a deleted skylink brings it back as well.
+	err = db.MarkPinned(ctx, ul)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = db.FindSkylink(ctx, ul)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Pinned || !s.DeletedAt.IsZero() {
+		t.Fatalf("Unexpected skylink after pinning it: %+v", s)
+	}
+	// So does a server which reports pinning it.
+	err = db.SoftDeleteSkylink(ctx, ul)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddServerForSkylink(ctx, ul, "other", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = db.FindSkylink(ctx, ul)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !test.Contains(s.Servers, "other") || !s.DeletedAt.IsZero() {
+		t.Fatalf("Unexpected skylink after adding a server: %+v", s)
+	}
+}
+
+// TestPurgeDeleted ensures that PurgeDeleted only removes the skylinks which
+// have been soft-deleted for longer than the retention period.
+func TestPurgeDeleted(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("skylinks")
+	retention := 7 * 24 * time.Hour
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name      string
+		deletedAt interface{}
+		purged    bool
+	}{
+		{name: "expired", deletedAt: now.Add(-retention - time.Minute), purged: true},
+		{name: "not expired yet", deletedAt: now.Add(-retention + time.Minute)},
+		{name: "not deleted"},
+	}
+	skylinks := make([]skymodules.Skylink, len(tests))
+	for i, tst := range tests {
+		skylinks[i] = test.RandomSkylink()
+		doc := bson.M{"_id": skylinks[i].String(), "pinned": false, "servers": bson.A{}}
+		if tst.deletedAt != nil {
+			doc["deleted_at"] = tst.deletedAt
+		}
+		_, err = coll.InsertOne(ctx, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = db.PurgeDeleted(ctx, 0)
+	if err == nil {
+		t.Fatal("Expected an error for a zero retention.")
+	}
+	n, err := db.PurgeDeleted(ctx, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 purged skylink, got %d", n)
+	}
+	for i, tst := range tests {
+		count, err := coll.CountDocuments(ctx, bson.M{"_id": skylinks[i].String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tst.purged != (count == 0) {
+			t.Fatalf("%s: expected purged to be %t, got %d documents", tst.name, tst.purged, count)
+		}
+	}
+}
+
+// TestMarkMany ensures that MarkPinnedMany and MarkUnpinnedMany flip the pinned
+// flag of the existing skylinks across batches, don't add the missing ones and
+// report how many skylinks they found and changed.
+func TestMarkMany(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server"
+
+	// Mix existing and missing skylinks in more than one batch.
+	var existing, missing, all []string
+	var first, last skymodules.Skylink
+	for i := 0; i < 1500; i++ {
+		sl := test.RandomSkylink()
+		if i%3 == 0 {
+			missing = append(missing, sl.String())
+		} else {
+			if len(existing) == 0 {
+				first = sl
+			}
+			last = sl
+			existing = append(existing, sl.String())
+		}
+		all = append(all, sl.String())
+	}
+	if database.NumBatches(len(all)) < 2 {
+		t.Fatalf("Expected more than one batch, got %d", database.NumBatches(len(all)))
+	}
+	err = db.AddServerForSkylinks(ctx, existing, server, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// expectCounts ensures that the counts match the expected ones.
+	expectCounts := func(op string, matched, modified int64, err error, expMatched, expModified int) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", op, err)
+		}
+		if matched != int64(expMatched) || modified != int64(expModified) {
+			t.Fatalf("%s: expected %d matched and %d modified, got %d and %d", op, expMatched, expModified, matched, modified)
+		}
+	}
+
+	_, _, err = db.MarkUnpinnedMany(ctx, all, "")
+	if err == nil {
+		t.Fatal("Expected an error for an empty server.")
+	}
+	// A skylink which is listed twice only counts once.
+	matched, modified, err := db.MarkUnpinnedMany(ctx, append(all, existing[0]), server)
+	expectCounts("unpin", matched, modified, err, len(existing), len(existing))
+	// Unpinning them again changes nothing.
+	matched, modified, err = db.MarkUnpinnedMany(ctx, all, "other")
+	expectCounts("unpin again", matched, modified, err, len(existing), 0)
+	unpinned, err := db.UnpinnedSkylinks(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unpinned) != len(existing) {
+		t.Fatalf("Expected %d unpinned skylinks, got %d", len(existing), len(unpinned))
+	}
+	s, err := db.FindSkylink(ctx, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Pinned || s.UnpinnedBy != server || s.UnpinnedAt.IsZero() {
+		t.Fatalf("Unexpected skylink after unpinning it: %+v", s)
+	}
+	// The missing skylinks are not added.
+	found, _, err := db.FindSkylinks(ctx, missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Fatalf("Expected no missing skylinks to be added, got %d", len(found))
+	}
+
+	matched, modified, err = db.MarkPinnedMany(ctx, all)
+	expectCounts("pin", matched, modified, err, len(existing), len(existing))
+	matched, modified, err = db.MarkPinnedMany(ctx, all)
+	expectCounts("pin again", matched, modified, err, len(existing), 0)
+	s, err = db.FindSkylink(ctx, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Pinned || s.UnpinnedBy != "" || !s.UnpinnedAt.IsZero() {
+		t.Fatalf("Unexpected skylink after pinning it: %+v", s)
+	}
+	found, _, err = db.FindSkylinks(ctx, missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Fatalf("Expected no missing skylinks to be added, got %d", len(found))
+	}
+
+	// Pinning a soft-deleted skylink restores it.
+	err = db.SoftDeleteSkylink(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matched, modified, err = db.MarkPinnedMany(ctx, []string{existing[0]})
+	expectCounts("restore", matched, modified, err, 1, 1)
+	_, err = db.FindSkylink(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSetSkylinkMetadata ensures that SetSkylinkMetadata stores the skyfile's
+// size and type and keeps the loads of the servers which pin it up to date.
+func TestSetSkylinkMetadata(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := "server"
+	sl := test.RandomSkylink()
+	err = db.AddServerForSkylink(ctx, sl, server, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bytesOf returns the bytes the server pins.
+	bytesOf := func() int64 {
+		loads, err := db.AllServerLoads(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range loads {
+			if l.Server == server {
+				return l.Bytes
+			}
+		}
+		return 0
+	}
+
+	err = db.SetSkylinkMetadata(ctx, test.RandomSkylink(), skymodules.SkyfileMetadata{Length: 1})
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+
+	file := skymodules.SkyfileMetadata{
+		Filename: "file.txt",
+		Length:   1 << 20,
+		Subfiles: skymodules.SkyfileSubfiles{
+			"file.txt": {Filename: "file.txt", ContentType: "text/plain", Len: 1 << 20},
+		},
+	}
+	err = db.SetSkylinkMetadata(ctx, sl, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size != 1<<20 || s.ContentType != "text/plain" || s.IsDirectory {
+		t.Fatalf("Unexpected metadata %+v", s)
+	}
+	if b := bytesOf(); b != 1<<20 {
+		t.Fatalf("Expected the server to pin %d bytes, got %d", 1<<20, b)
+	}
+
+	dir := skymodules.SkyfileMetadata{
+		Filename: "dir",
+		Length:   3 << 20,
+		Subfiles: skymodules.SkyfileSubfiles{
+			"a.txt": {Filename: "a.txt", ContentType: "text/plain", Len: 1 << 20},
+			"b.txt": {Filename: "b.txt", ContentType: "text/plain", Offset: 1 << 20, Len: 2 << 20},
+		},
+	}
+	err = db.SetSkylinkMetadata(ctx, sl, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size != 3<<20 || s.ContentType != "" || !s.IsDirectory {
+		t.Fatalf("Unexpected metadata %+v", s)
+	}
+	if b := bytesOf(); b != 3<<20 {
+		t.Fatalf("Expected the server to pin %d bytes, got %d", 3<<20, b)
+	}
+
+	// A zero length keeps the size we know.
+	err = db.SetSkylinkMetadata(ctx, sl, skymodules.SkyfileMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size != 3<<20 || s.IsDirectory {
+		t.Fatalf("Unexpected metadata %+v", s)
+	}
+	if b := bytesOf(); b != 3<<20 {
+		t.Fatalf("Expected the server to pin %d bytes, got %d", 3<<20, b)
+	}
+}
+
+// TestDedupServers ensures that we find and repair the skylinks which list a
+// server more than once or an empty server, and that we refuse to add empty
+// servers.
+func TestDedupServers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := test.NewRawDBClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if errDisc := c.Disconnect(ctx); errDisc != nil {
+			t.Error(errDisc)
+		}
+	}()
+	coll := c.Database(test.SanitizeName(t.Name())).Collection("skylinks")
+
+	tests := []struct {
+		name     string
+		servers  bson.A
+		expected []string
+		corrupt  bool
+	}{
+		{name: "duplicate", servers: bson.A{"a", "b", "a"}, expected: []string{"a", "b"}, corrupt: true},
+		{name: "empty", servers: bson.A{"", "a"}, expected: []string{"a"}, corrupt: true},
+		{name: "duplicate and empty", servers: bson.A{"", "b", "", "b"}, expected: []string{"b"}, corrupt: true},
+		{name: "clean", servers: bson.A{"b", "a"}, expected: []string{"b", "a"}},
+		{name: "no servers", expected: nil},
+	}
+	skylinks := make([]skymodules.Skylink, len(tests))
+	var corrupt []string
+	for i, tst := range tests {
+		skylinks[i] = test.RandomSkylink()
+		doc := bson.M{"_id": skylinks[i].String(), "pinned": true}
+		if tst.servers != nil {
+			doc["servers"] = tst.servers
+			doc["num_servers"] = len(tst.servers)
+		}
+		_, err = coll.InsertOne(ctx, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tst.corrupt {
+			corrupt = append(corrupt, skylinks[i].String())
+		}
+	}
+
+	found, err := db.SkylinksWithCorruptServers(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(found)
+	sort.Strings(corrupt)
+	if !reflect.DeepEqual(found, corrupt) {
+		t.Fatalf("Expected %v, got %v", corrupt, found)
+	}
+	found, err = db.SkylinksWithCorruptServers(ctx, 1)
+	if err != nil || len(found) != 1 {
+		t.Fatalf("Expected a single skylink, got %v and '%v'", found, err)
+	}
+
+	n, err := db.DedupServers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(corrupt)) {
+		t.Fatalf("Expected to repair %d skylinks, repaired %d", len(corrupt), n)
+	}
+	for i, tst := range tests {
+		s, err := db.FindSkylink(ctx, skylinks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Servers) != len(tst.expected) || (len(tst.expected) > 0 && !reflect.DeepEqual(s.Servers, tst.expected)) {
+			t.Fatalf("%s: expected servers %v, got %v", tst.name, tst.expected, s.Servers)
+		}
+		if tst.servers != nil && s.NumServers != len(tst.expected) {
+			t.Fatalf("%s: expected num_servers %d, got %d", tst.name, len(tst.expected), s.NumServers)
+		}
+	}
+	// There is nothing left to repair.
+	n, err = db.DedupServers(ctx)
+	if err != nil || n != 0 {
+		t.Fatalf("Expected to repair nothing, got %d and '%v'", n, err)
+	}
+	found, err = db.SkylinksWithCorruptServers(ctx, 10)
+	if err != nil || len(found) != 0 {
+		t.Fatalf("Expected no corrupt skylinks, got %v and '%v'", found, err)
+	}
+
+	// We refuse to add empty servers.
+	sl := test.RandomSkylink()
+	err = db.AddServerForSkylink(ctx, sl, "", false)
+	if err == nil {
+		t.Fatal("Expected an error for an empty server.")
+	}
+	err = db.AddServerForSkylinks(ctx, []string{sl.String()}, "", false, nil)
+	if err == nil {
+		t.Fatal("Expected an error for an empty server.")
+	}
+	err = db.MarkServerPinnedAndUnlock(ctx, sl, "")
+	if err == nil {
+		t.Fatal("Expected an error for an empty server.")
+	}
+	_, err = db.FindSkylink(ctx, sl)
+	if !errors.Contains(err, database.ErrSkylinkNotExist) {
+		t.Fatalf("Expected '%v', got '%v'", database.ErrSkylinkNotExist, err)
+	}
+}
+
+// TestMissingSkylinks ensures that MissingSkylinks returns the skylinks which
+// don't have a document in the database, as given, and that
+// ForEachPinnedSkylink visits all pinned skylinks.
+func TestMissingSkylinks(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := test.RandomSkylink()
+	unpinned := test.RandomSkylink()
+	deleted := test.RandomSkylink()
+	missing := test.RandomSkylink()
+	_, e1 := db.CreateSkylink(ctx, pinned, "server")
+	e2 := db.MarkUnpinned(ctx, unpinned, "server")
+	_, e3 := db.CreateSkylink(ctx, deleted, "server")
+	e4 := db.SoftDeleteSkylink(ctx, deleted)
+	if err = errors.Compose(e1, e2, e3, e4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the missing skylink is missing, in the encoding we gave it.
+	// Invalid skylinks are never missing.
+	base32 := missing.Base32EncodedString()
+	all := []string{pinned.String(), unpinned.String(), deleted.String(), base32, "invalid"}
+	m, err := db.MissingSkylinks(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m[0] != base32 {
+		t.Fatalf("Expected only '%s' to be missing, got %v", base32, m)
+	}
+
+	// Only the pinned skylink is visited.
+	var visited []string
+	err = db.ForEachPinnedSkylink(ctx, func(sl string) error {
+		visited = append(visited, sl)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 1 || visited[0] != pinned.String() {
+		t.Fatalf("Expected to visit only '%s', got %v", pinned, visited)
 	}
 }
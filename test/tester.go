@@ -4,22 +4,33 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/skynetlabs/pinner/accounts"
 	"github.com/skynetlabs/pinner/api"
+	"github.com/skynetlabs/pinner/conf"
 	"github.com/skynetlabs/pinner/database"
 	"github.com/skynetlabs/pinner/logger"
 	"github.com/skynetlabs/pinner/skyd"
+	"github.com/skynetlabs/pinner/sweeper"
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/SkynetLabs/skyd/build"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
+	// AccountsHookSecret is the secret with which the tester's accounts
+	// signs its requests to the hooks.
+	AccountsHookSecret = "test accounts hook secret"
+
 	testPortalAddr = "http://127.0.0.1"
 	testPortalPort = "6000"
 
@@ -34,6 +45,7 @@ type (
 	// Tester is a simple testing kit. It starts a testing instance of the
 	// service and provides simplified ways to call the handlers.
 	Tester struct {
+		Accounts        *AccountsMock
 		Ctx             context.Context
 		DB              *database.DB
 		FollowRedirects bool
@@ -41,13 +53,44 @@ type (
 		ServerName      string
 		SkydClient      skyd.Client
 
-		cancel context.CancelFunc
+		cancel     context.CancelFunc
+		reconciler *accounts.Reconciler
+		sweeper    *sweeper.Sweeper
+	}
+
+	// dbClusterConfig is the tester's source of the cluster-wide
+	// configuration. The tester has no scanner, so it loads the
+	// configuration from the database on every call.
+	dbClusterConfig struct {
+		db     *database.DB
+		server string
 	}
 )
 
+// ClusterConfig implements api.ClusterConfigSource. It returns the defaults
+// when it fails to load the configuration.
+func (c dbClusterConfig) ClusterConfig() (conf.ClusterConfig, map[string]string) {
+	cc, values, err := conf.LoadClusterConfig(context.Background(), c.db, c.server)
+	if err != nil {
+		return conf.DefaultClusterConfig(), nil
+	}
+	return cc, values
+}
+
 // NewDatabase returns a new DB connection based on the passed parameters.
-func NewDatabase(ctx context.Context, dbName string) (*database.DB, error) {
-	return database.NewCustomDB(ctx, SanitizeName(dbName), DBTestCredentials(), NewDiscardLogger())
+func NewDatabase(ctx context.Context, dbName string, opts ...database.Option) (*database.DB, error) {
+	return database.NewCustomDB(ctx, SanitizeName(dbName), DBTestCredentials(), NewDiscardLogger(), opts...)
+}
+
+// NewRawDBClient connects to the test database server without going through
+// database.DB, e.g. in order to set up documents the way older versions of
+// pinner wrote them. The caller must disconnect the client.
+func NewRawDBClient(ctx context.Context) (*mongo.Client, error) {
+	creds := DBTestCredentials()
+	opts := options.Client().
+		ApplyURI(fmt.Sprintf("mongodb://%s:%s/", creds.Host, creds.Port)).
+		SetAuth(options.Credential{Username: creds.User, Password: creds.Password})
+	return mongo.Connect(ctx, opts)
 }
 
 // NewTester creates and starts a new Tester service.
@@ -69,12 +112,40 @@ func NewTester(dbName string) (*Tester, error) {
 
 	ctxWithCancel, cancel := context.WithCancel(ctx)
 	skydClientMock := skyd.NewSkydClientMock()
+	accountsMock := NewAccountsMock()
+	accountsClient, err := accounts.NewClient(accountsMock.Server.URL, "", cfg.AccountsTimeout)
+	if err != nil {
+		cancel()
+		accountsMock.Server.Close()
+		return nil, errors.AddContext(err, "failed to create the accounts client")
+	}
+	at := &Tester{
+		Accounts:        accountsMock,
+		Ctx:             ctxWithCancel,
+		DB:              db,
+		FollowRedirects: true,
+		Logger:          logger,
+		SkydClient:      skydClientMock,
+		ServerName:      cfg.ServerName,
+		cancel:          cancel,
+	}
+	// The subtests share the tester's state, so we can't predict how many
+	// skylinks a sweep will remove. That's why we disable the removal check.
+	at.sweeper = sweeper.New(db, skydClientMock, cfg.ServerName, true, 100, nil, logger)
+	at.reconciler = accounts.NewReconciler(accountsClient, db, logger)
 	// The server API encapsulates all the modules together.
-	server, err := api.New(cfg.ServerName, db, logger, skydClientMock)
+	server, err := api.New(cfg.ServerName, db, logger, skydClientMock,
+		api.WithAccounts(accountsClient, at.reconciler),
+		api.WithSweeper(at.sweeper),
+		api.WithAccountsHookSecret(AccountsHookSecret),
+	)
 	if err != nil {
 		cancel()
+		accountsMock.Server.Close()
 		return nil, errors.AddContext(err, "failed to build the API")
 	}
+	server.SetConfig(cfg)
+	server.SetClusterConfigSource(dbClusterConfig{db: db, server: cfg.ServerName})
 
 	// Start the HTTP server in a goroutine and gracefully stop it once the
 	// cancel function is called and the context is closed.
@@ -92,15 +163,6 @@ func NewTester(dbName string) (*Tester, error) {
 		}
 	}()
 
-	at := &Tester{
-		Ctx:             ctxWithCancel,
-		DB:              db,
-		FollowRedirects: true,
-		Logger:          logger,
-		SkydClient:      skydClientMock,
-		ServerName:      cfg.ServerName,
-		cancel:          cancel,
-	}
 	// Wait for the tester to be fully ready.
 	err = build.Retry(50, time.Millisecond, func() error {
 		_, _, e := at.HealthGET()
@@ -136,6 +198,15 @@ func SanitizeName(s string) string {
 // Close performs a graceful shutdown of the Tester service.
 func (t *Tester) Close() error {
 	t.cancel()
+	err := t.sweeper.Close()
+	if err != nil {
+		return errors.AddContext(err, "failed to close the sweeper")
+	}
+	err = t.reconciler.Close()
+	if err != nil {
+		return errors.AddContext(err, "failed to close the reconciler")
+	}
+	t.Accounts.Server.Close()
 	if t.DB != nil {
 		err := t.DB.Disconnect(t.Ctx)
 		if err != nil {
@@ -253,6 +324,57 @@ func processResponse(r *http.Response) (*http.Response, []byte, error) {
 	return r, body, err
 }
 
+// AccountsHookPOST sends the given body to the accounts hook with the given
+// timestamp and signature.
+func (t *Tester) AccountsHookPOST(body []byte, timestamp int64, signature string) (api.AccountsHookPOSTResponse, int, error) {
+	var resp api.AccountsHookPOSTResponse
+	headers := map[string]string{
+		api.AccountsHookTimestampHeader: strconv.FormatInt(timestamp, 10),
+		api.AccountsHookSignatureHeader: signature,
+		"Content-Type":                  "application/json",
+	}
+	r, err := t.Request(http.MethodPost, "/hooks/accounts", nil, body, headers, &resp)
+	return resp, r.StatusCode, err
+}
+
+// CacheGET returns the size and the last rebuild of skyd's skylinks cache.
+func (t *Tester) CacheGET() (api.CacheGET, int, error) {
+	var resp api.CacheGET
+	r, err := t.Request(http.MethodGet, "/cache", nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// ConfigDELETE resets the given cluster-wide configuration value to its
+// default.
+func (t *Tester) ConfigDELETE(key string) (int, error) {
+	r, err := t.Request(http.MethodDelete, "/config/"+url.PathEscape(key), nil, nil, nil, nil)
+	return r.StatusCode, err
+}
+
+// ConfigEffectiveGET returns the configuration the server actually uses.
+func (t *Tester) ConfigEffectiveGET() (conf.EffectiveConfig, int, error) {
+	var resp conf.EffectiveConfig
+	r, err := t.Request(http.MethodGet, "/config/effective", nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// ConfigExportGET returns all cluster-wide configuration values.
+func (t *Tester) ConfigExportGET() (api.ConfigExport, int, error) {
+	var resp api.ConfigExport
+	r, err := t.Request(http.MethodGet, "/config/export", nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// ConfigExportPUT sets the given cluster-wide configuration values.
+func (t *Tester) ConfigExportPUT(values api.ConfigExport) (int, error) {
+	body, err := json.Marshal(values)
+	if err != nil {
+		return http.StatusBadRequest, errors.AddContext(err, "unable to marshal request body")
+	}
+	r, err := t.Request(http.MethodPut, "/config/export", nil, body, nil, nil)
+	return r.StatusCode, err
+}
+
 // HealthGET checks the health of the service.
 func (t *Tester) HealthGET() (api.HealthGET, int, error) {
 	var resp api.HealthGET
@@ -260,10 +382,27 @@ func (t *Tester) HealthGET() (api.HealthGET, int, error) {
 	return resp, r.StatusCode, err
 }
 
+// HealthVerboseGET checks the health of the service, including the stats of
+// the calls to skyd.
+func (t *Tester) HealthVerboseGET() (api.HealthGET, int, error) {
+	var resp api.HealthGET
+	params := url.Values{}
+	params.Set("verbose", "true")
+	r, err := t.Request(http.MethodGet, "/health", params, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
 // PinPOST tells pinner that the current server is pinning a given skylink.
 func (t *Tester) PinPOST(sl string) (int, error) {
+	return t.PinOwnerPOST(sl, "")
+}
+
+// PinOwnerPOST tells pinner that the current server is pinning a given skylink
+// on behalf of the given owner.
+func (t *Tester) PinOwnerPOST(sl, owner string) (int, error) {
 	body, err := json.Marshal(api.SkylinkRequest{
 		Skylink: sl,
+		Owner:   owner,
 	})
 	if err != nil {
 		return http.StatusBadRequest, errors.AddContext(err, "unable to marshal request body")
@@ -272,11 +411,79 @@ func (t *Tester) PinPOST(sl string) (int, error) {
 	return r.StatusCode, err
 }
 
+// ReconcileAccountsPOST kicks off a background reconciliation of the skylinks
+// marked as pinned in the database with the ones the users pin according to
+// accounts. A dry run only reports the drift between them.
+func (t *Tester) ReconcileAccountsPOST(dryRun bool) (api.ReconcileAccountsPOSTResponse, int, error) {
+	params := url.Values{}
+	params.Set("dry_run", fmt.Sprint(dryRun))
+	var resp api.ReconcileAccountsPOSTResponse
+	r, err := t.Request(http.MethodPost, "/reconcile/accounts", params, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// ReconcileAccountsLatestGET returns the drift report of the latest successful
+// reconciliation with accounts.
+func (t *Tester) ReconcileAccountsLatestGET() (database.DriftReport, int, error) {
+	var resp database.DriftReport
+	r, err := t.Request(http.MethodGet, "/reconcile/accounts/latest", nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// ReconcileAccountsStatusGET returns the status of the latest reconciliation
+// with accounts.
+func (t *Tester) ReconcileAccountsStatusGET() (accounts.ReconcileStatus, int, error) {
+	var resp accounts.ReconcileStatus
+	r, err := t.Request(http.MethodGet, "/reconcile/accounts/status", nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// ServersRepairPOST merges the server names which only differ from their
+// normalized form into it.
+func (t *Tester) ServersRepairPOST(dryRun bool) (database.ServerNameRepair, int, error) {
+	params := url.Values{}
+	params.Set("dry_run", fmt.Sprint(dryRun))
+	var resp database.ServerNameRepair
+	r, err := t.Request(http.MethodPost, "/servers/repair", params, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// SkylinkGET returns what pinner knows about the given skylink.
+func (t *Tester) SkylinkGET(sl string) (api.SkylinkGET, int, error) {
+	var resp api.SkylinkGET
+	r, err := t.Request(http.MethodGet, "/skylink/"+sl, nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// StatsGET fetches the stats of the skylinks in the database.
+func (t *Tester) StatsGET() (api.StatsGET, int, error) {
+	var resp api.StatsGET
+	r, err := t.Request(http.MethodGet, "/stats", nil, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// StatsDeepGET returns the stats of the service, including the stats of the
+// sizes of the skylinks' documents.
+func (t *Tester) StatsDeepGET() (api.StatsGET, int, error) {
+	var resp api.StatsGET
+	params := url.Values{}
+	params.Set("deep", "true")
+	r, err := t.Request(http.MethodGet, "/stats", params, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
 // UnpinPOST tells pinner that no users are pinning this skylink and it should
 // be unpinned by all servers.
 func (t *Tester) UnpinPOST(sl string) (int, error) {
+	return t.UnpinOwnerPOST(sl, "")
+}
+
+// UnpinOwnerPOST tells pinner that the given owner no longer pins this skylink.
+// It should be unpinned by all servers once none of its owners pin it.
+func (t *Tester) UnpinOwnerPOST(sl, owner string) (int, error) {
 	body, err := json.Marshal(api.SkylinkRequest{
 		Skylink: sl,
+		Owner:   owner,
 	})
 	if err != nil {
 		return http.StatusBadRequest, errors.AddContext(err, "unable to marshal request body")
@@ -295,9 +502,29 @@ func (t *Tester) SweepPOST() (api.SweepPOSTResponse, int, error) {
 	return resp, r.StatusCode, err
 }
 
+// SweepForcePOST works like SweepPOST but the sweep bypasses the safety check
+// which prevents it from removing too many skylinks.
+func (t *Tester) SweepForcePOST() (api.SweepPOSTResponse, int, error) {
+	var resp api.SweepPOSTResponse
+	params := url.Values{}
+	params.Set("force", "true")
+	r, err := t.Request(http.MethodPost, "/sweep", params, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
+// SweepSubtreePOST works like SweepPOST but the sweep is limited to the
+// subtree under the given path.
+func (t *Tester) SweepSubtreePOST(path string) (api.SweepPOSTResponse, int, error) {
+	var resp api.SweepPOSTResponse
+	params := url.Values{}
+	params.Set("path", path)
+	r, err := t.Request(http.MethodPost, "/sweep", params, nil, nil, &resp)
+	return resp, r.StatusCode, err
+}
+
 // SweepStatusGET returns the status of the latest sweep.
-func (t *Tester) SweepStatusGET() (api.SweepStatus, int, error) {
-	var resp api.SweepStatus
+func (t *Tester) SweepStatusGET() (sweeper.Status, int, error) {
+	var resp sweeper.Status
 	r, err := t.Request(http.MethodGet, "/sweep/status", nil, nil, nil, &resp)
 	return resp, r.StatusCode, err
 }
@@ -78,7 +78,8 @@ func LoadTestConfig() (conf.Config, error) {
 	if err := errors.Compose(e1, e2, e3, e4, e5, e6); err != nil {
 		return conf.Config{}, err
 	}
-	return conf.LoadConfig()
+	cfg, _, err := conf.LoadConfig()
+	return cfg, err
 }
 
 // RandomSkylink generates a random skylink
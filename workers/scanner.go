@@ -3,7 +3,6 @@ package workers
 import (
 	"context"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
@@ -16,7 +15,6 @@ import (
 	"gitlab.com/NebulousLabs/threadgroup"
 	"gitlab.com/SkynetLabs/skyd/build"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
-	"go.sia.tech/siad/modules"
 )
 
 /**
@@ -35,25 +33,7 @@ import (
  - add a second scanner which looks for skylinks which should be unpinned and unpins them from the local skyd.
 */
 
-// Handy constants used to improve readability.
-const (
-	assumedUploadSpeedInBytes = 1 << 30 / 4 / 8 // 25% of 1Gbps in bytes
-	baseSectorRedundancy      = 10
-	fanoutRedundancy          = 3
-)
-
 var (
-	// SleepBetweenPins defines how long we'll sleep between pinning files.
-	// We want to add this sleep in order to prevent a single server from
-	// grabbing all underpinned files and overloading itself. We also want to
-	// allow for some time for the newly pinned files to reach full redundancy
-	// before we pin more files.
-	SleepBetweenPins = build.Select(
-		build.Var{
-			Standard: 10 * time.Second,
-			Dev:      time.Second,
-			Testing:  time.Millisecond,
-		}).(time.Duration)
 	// SleepBetweenHealthChecks defines the wait time between calls to skyd to
 	// check the current health of a given file.
 	SleepBetweenHealthChecks = build.Select(
@@ -62,56 +42,58 @@ var (
 			Dev:      time.Second,
 			Testing:  time.Millisecond,
 		}).(time.Duration)
-
-	// sleepBetweenScans defines how often we'll scan the DB for underpinned
-	// skylinks.
-	sleepBetweenScans = build.Select(build.Var{
-		// In production we want to use a prime number of hours, so we can
-		// de-sync the scan and the sweeps.
-		Standard: 19 * time.Hour,
-		Dev:      1 * time.Minute,
-		Testing:  300 * time.Millisecond,
-	}).(time.Duration)
-	// sleepVariationFactor defines how much the sleep between scans will
-	// vary between executions. It represents percent.
-	sleepVariationFactor = 0.1
 )
 
 type (
+	// pinnedFile describes a file we've pinned and which we wait on to
+	// become healthy.
+	pinnedFile struct {
+		skylink skymodules.Skylink
+		siaPath skymodules.SiaPath
+		// lazy is true if we pinned the file lazily.
+		lazy bool
+	}
+	// ScannerStatus describes the state of the scanner.
+	ScannerStatus struct {
+		// SkydBreaker is the state of the circuit breaker around the calls
+		// to skyd. While it's open, the scanner doesn't pin any skylinks.
+		SkydBreaker skyd.BreakerState
+	}
 	// Scanner is a background worker that periodically scans the database for
 	// underpinned skylinks. Once an underpinned skylink is found (and it's not
 	// being pinned by the local server already), Scanner pins it to the local
 	// skyd.
 	Scanner struct {
-		staticDB                *database.DB
-		staticLogger            logger.ExtFieldLogger
-		staticServerName        string
-		staticSkydClient        skyd.Client
-		staticSleepBetweenScans time.Duration
-		staticTG                *threadgroup.ThreadGroup
-
-		dryRun     bool
-		minPinners int
-		mu         sync.Mutex
+		staticDB         *database.DB
+		staticLogger     logger.ExtFieldLogger
+		staticServerName string
+		staticSkydClient skyd.Client
+		staticTG         *threadgroup.ThreadGroup
+
+		// clusterConfig holds the cluster-wide configuration values as
+		// they apply to this server and clusterValues holds the database
+		// values we parsed them from. See managedRefreshClusterConfig.
+		clusterConfig     conf.ClusterConfig
+		clusterValues     map[string]string
+		sleepBetweenScans time.Duration
+		mu                sync.Mutex
 	}
 )
 
 // NewScanner creates a new Scanner instance.
 func NewScanner(db *database.DB, logger logger.ExtFieldLogger, minPinners int, serverName string, customSleepBetweenScans time.Duration, skydClient skyd.Client) *Scanner {
-	sleep := sleepBetweenScans
-	if customSleepBetweenScans > 0 {
-		sleep = customSleepBetweenScans
-	}
-	return &Scanner{
-		staticDB:                db,
-		staticLogger:            logger,
-		staticServerName:        serverName,
-		staticSkydClient:        skydClient,
-		staticSleepBetweenScans: sleep,
-		staticTG:                &threadgroup.ThreadGroup{},
-
-		minPinners: minPinners,
+	s := &Scanner{
+		staticDB:         db,
+		staticLogger:     logger,
+		staticServerName: serverName,
+		staticSkydClient: skydClient,
+		staticTG:         &threadgroup.ThreadGroup{},
+
+		clusterConfig: conf.DefaultClusterConfig(),
 	}
+	s.clusterConfig.MinPinners = minPinners
+	s.SetSleepBetweenScans(customSleepBetweenScans)
+	return s
 }
 
 // Close stops the background worker thread.
@@ -119,6 +101,13 @@ func (s *Scanner) Close() error {
 	return s.staticTG.Stop()
 }
 
+// Status returns the status of the scanner.
+func (s *Scanner) Status() ScannerStatus {
+	return ScannerStatus{
+		SkydBreaker: s.staticSkydClient.BreakerState(),
+	}
+}
+
 // Start launches the background worker thread that scans the DB for underpinned
 // skylinks.
 func (s *Scanner) Start() error {
@@ -129,9 +118,63 @@ func (s *Scanner) Start() error {
 
 	go s.threadedScanAndPin()
 
+	err = s.staticTG.Add()
+	if err != nil {
+		return err
+	}
+	// Start watching before we return, so we don't miss any changes made
+	// after that.
+	updates, err := s.staticDB.WatchConfig(s.staticTG.StopCtx())
+	if err != nil {
+		s.staticLogger.Info(errors.AddContext(err, "failed to watch the configuration, we'll only poll it"))
+	}
+	go s.threadedWatchConfig(updates)
+
 	return nil
 }
 
+// threadedWatchConfig refreshes the configuration values the scanner uses as
+// soon as they change, instead of waiting for the next scan to poll them. If
+// the change stream fails, we watch again after a scan's worth of time and
+// rely on the polling until then. A nil channel means that we failed to watch.
+func (s *Scanner) threadedWatchConfig(updates <-chan database.ConfigUpdate) {
+	defer s.staticTG.Done()
+
+	keys := make(map[string]struct{})
+	for _, key := range conf.ClusterConfigKeys(s.staticServerName) {
+		keys[key] = struct{}{}
+	}
+	for {
+		// Receiving from a nil channel blocks forever, so we only wait for
+		// updates while we have a change stream.
+		for updates != nil {
+			select {
+			case u, ok := <-updates:
+				if !ok {
+					updates = nil
+					continue
+				}
+				s.staticLogger.Debugf("Configuration change: %s = '%s'", u.Key, u.Value)
+				if _, exists := keys[u.Key]; exists {
+					s.managedRefreshClusterConfig()
+				}
+			case <-s.staticTG.StopChan():
+				return
+			}
+		}
+		select {
+		case <-time.After(s.SleepBetweenScans()):
+		case <-s.staticTG.StopChan():
+			return
+		}
+		var err error
+		updates, err = s.staticDB.WatchConfig(s.staticTG.StopCtx())
+		if err != nil {
+			s.staticLogger.Debug(errors.AddContext(err, "failed to watch the configuration"))
+		}
+	}
+}
+
 // threadedScanAndPin defines the scanning operation of Scanner.
 func (s *Scanner) threadedScanAndPin() {
 	defer s.staticTG.Done()
@@ -139,19 +182,18 @@ func (s *Scanner) threadedScanAndPin() {
 	// Main execution loop, goes on forever while the service is running.
 	for {
 		// Rebuild the cache and watch for service shutdown while doing that.
-		res := s.staticSkydClient.RebuildCache()
+		res := s.staticSkydClient.RebuildCache(s.staticTG.StopCtx())
 		select {
 		case <-s.staticTG.StopChan():
 			return
-		case <-res.ErrAvail:
-			if res.ExternErr != nil {
-				s.staticLogger.Warn(errors.AddContext(res.ExternErr, "failed to rebuild skyd client cache"))
+		case <-res.Done():
+			if err := res.Err(); err != nil {
+				s.staticLogger.Warn(errors.AddContext(err, "failed to rebuild skyd client cache"))
 			}
 		}
 
 		s.staticLogger.Tracef("Start scanning")
-		s.managedRefreshDryRun()
-		s.managedRefreshMinPinners()
+		s.managedRefreshClusterConfig()
 		s.managedPinUnderpinnedSkylinks()
 		s.staticLogger.Tracef("End scanning")
 
@@ -170,6 +212,11 @@ func (s *Scanner) threadedScanAndPin() {
 func (s *Scanner) managedPinUnderpinnedSkylinks() {
 	s.staticLogger.Trace("Entering managedPinUnderpinnedSkylinks")
 	defer s.staticLogger.Trace("Exiting  managedPinUnderpinnedSkylinks")
+	if !s.staticRenterCanStore() {
+		return
+	}
+	cc := s.managedClusterConfig()
+	numPinned := 0
 	for {
 		// Check for service shutdown before talking to the DB.
 		select {
@@ -179,7 +226,7 @@ func (s *Scanner) managedPinUnderpinnedSkylinks() {
 		default:
 		}
 
-		skylink, sp, continueScanning, err := s.managedFindAndPinOneUnderpinnedSkylink()
+		pf, continueScanning, err := s.managedFindAndPinOneUnderpinnedSkylink()
 		if !continueScanning {
 			return
 		}
@@ -189,7 +236,12 @@ func (s *Scanner) managedPinUnderpinnedSkylinks() {
 		// is an error, then there is nothing to wait for.
 		if err == nil {
 			// Block until the pinned skylink becomes healthy or until a timeout.
-			s.managedWaitUntilHealthy(skylink, sp)
+			s.managedWaitUntilHealthy([]pinnedFile{pf})
+			numPinned++
+			if cc.MaxPinsPerCycle > 0 && numPinned >= cc.MaxPinsPerCycle {
+				s.staticLogger.Infof("Pinned %d skylinks, which is the maximum per scan.", numPinned)
+				return
+			}
 			continue
 		}
 		// In case of error we still want to sleep for a moment in order to
@@ -201,179 +253,307 @@ func (s *Scanner) managedPinUnderpinnedSkylinks() {
 		case <-s.staticTG.StopChan():
 			s.staticLogger.Trace("Stop channel closed")
 			return
-		case <-time.After(SleepBetweenPins):
+		case <-time.After(cc.SleepBetweenPins):
 		}
 	}
 }
 
+// staticRenterCanStore checks whether the local renter has any active contracts,
+// i.e. whether it can store the skylinks we pin. If we fail to fetch the
+// renter summary, we assume it can and let the pins fail, if they will.
+func (s *Scanner) staticRenterCanStore() bool {
+	summary, err := s.staticSkydClient.RenterSummary(s.staticTG.StopCtx())
+	if err != nil {
+		s.staticLogger.Debug(errors.AddContext(err, "failed to fetch the renter summary"))
+		return true
+	}
+	if summary.ActiveContracts == 0 {
+		s.staticLogger.Warn("The renter has no active contracts, skipping pinning.")
+		return false
+	}
+	return true
+}
+
 // managedFindAndPinOneUnderpinnedSkylink scans the database for one skylinks which is
 // either locked by the current server or underpinned. If it finds such a
 // skylink, it pins it to the local skyd. The method returns true until it finds
 // no further skylinks to process or until it encounters an unrecoverable error,
-// such as bad credentials, dead skyd, etc.
-func (s *Scanner) managedFindAndPinOneUnderpinnedSkylink() (skylink skymodules.Skylink, sf skymodules.SiaPath, continueScanning bool, err error) {
+// such as bad credentials, dead skyd, etc. It pins the skylink in the mode
+// set by lazy_pinning.
+func (s *Scanner) managedFindAndPinOneUnderpinnedSkylink() (pf pinnedFile, continueScanning bool, err error) {
 	s.staticLogger.Trace("Entering managedFindAndPinOneUnderpinnedSkylink")
 	defer s.staticLogger.Trace("Exiting  managedFindAndPinOneUnderpinnedSkylink")
 
-	s.mu.Lock()
-	dryRun := s.dryRun
-	minPinners := s.minPinners
-	s.mu.Unlock()
+	cc := s.managedClusterConfig()
+	dryRun := cc.DryRun
+	lazy := cc.LazyPinning
 
-	sl, err := s.staticDB.FindAndLockUnderpinned(context.TODO(), s.staticServerName, minPinners)
+	locked, err := s.staticDB.FindAndLockUnderpinned(context.TODO(), s.staticServerName, cc.MinPinners)
 	if database.IsNoSkylinksNeedPinning(err) {
-		return skymodules.Skylink{}, skymodules.SiaPath{}, false, err
+		return pinnedFile{}, false, err
 	}
 	if err != nil {
 		s.staticLogger.Warn(errors.AddContext(err, "failed to fetch underpinned skylink"))
-		return skymodules.Skylink{}, skymodules.SiaPath{}, false, err
+		return pinnedFile{}, false, err
 	}
+	s.staticLogger.Tracef("Locked skylink '%s' until %v", locked.Skylink, locked.LockExpires)
+	sl, err := database.SkylinkFromString(locked.Skylink)
+	if err != nil {
+		s.staticLogger.Warn(errors.AddContext(err, "failed to parse underpinned skylink"))
+		return pinnedFile{}, false, err
+	}
+	// Once we've pinned the skylink, we mark it as pinned by us and unlock it
+	// in a single write. Otherwise we only unlock it.
+	unlocked := false
 	defer func() {
-		err = s.staticDB.UnlockSkylink(context.TODO(), sl, s.staticServerName)
-		if err != nil {
-			s.staticLogger.Debug(errors.AddContext(err, "failed to unlock skylink after trying to pin it"))
+		if unlocked {
+			return
+		}
+		errUnlock := s.staticDB.UnlockSkylink(context.TODO(), sl, s.staticServerName)
+		if errors.Contains(errUnlock, database.ErrLockedByAnotherServer) {
+			s.staticLogger.Warnf("skylink '%s' was locked by another server after trying to pin it", sl)
+		} else if errUnlock != nil {
+			s.staticLogger.Debug(errors.AddContext(errUnlock, "failed to unlock skylink after trying to pin it"))
 		}
 	}()
 
+	// Skip the skylinks which are too large. We keep them locked, so we
+	// don't come across them again until the lock expires, by which time
+	// max_pin_size might have changed.
+	if cc.MaxPinSize > 0 && locked.Size > cc.MaxPinSize {
+		unlocked = true
+		err = fmt.Errorf("skylink '%s' is larger than max_pin_size, its size is %d bytes", sl, locked.Size)
+		s.staticLogger.Info(err)
+		return pinnedFile{}, true, err
+	}
+
 	// Check for a dry run.
 	if dryRun {
 		s.staticLogger.Infof("[DRY RUN] Successfully pinned '%s'", sl)
-		return skymodules.Skylink{}, skymodules.SiaPath{}, false, errors.New("dry run")
+		return pinnedFile{}, false, errors.New("dry run")
 	}
 
-	sf, err = s.staticSkydClient.Pin(sl.String())
+	// Don't pin skylinks which skyd's blocklist has caught up with. If we
+	// can't tell, we try to pin and let skyd refuse it, if it will.
+	blocked, err := s.staticSkydClient.IsBlocked(s.staticTG.StopCtx(), sl.String())
+	if err != nil {
+		s.staticLogger.Debug(errors.AddContext(err, "failed to check the blocklist"))
+	}
+	if blocked {
+		err = errors.AddContext(skyd.ErrSkylinkBlocked, "skylink is on skyd's blocklist")
+	} else {
+		pf.siaPath, err = s.staticSkydClient.Pin(s.staticTG.StopCtx(), sl.String(), lazy)
+	}
 	if errors.Contains(err, skyd.ErrSkylinkAlreadyPinned) {
 		s.staticLogger.Info(err)
 		// The skylink is already pinned locally but it's not marked as such.
-		err = s.staticDB.AddServerForSkylink(context.TODO(), sl, s.staticServerName, false)
-		if err != nil {
-			s.staticLogger.Debug(errors.AddContext(err, "failed to mark as pinned by this server"))
+		unlocked = true
+		return pinnedFile{}, true, s.managedMarkPinnedAndUnlock(sl)
+	}
+	if errors.Contains(err, skyd.ErrSkylinkBlocked) {
+		s.staticLogger.Info(errors.AddContext(err, fmt.Sprintf("giving up on blocked skylink '%s'", sl)))
+		// Mark the skylink as blocked, so we stop trying to pin it.
+		errMark := s.staticDB.MarkBlocked(context.TODO(), sl)
+		if errMark != nil {
+			s.staticLogger.Debug(errors.AddContext(errMark, "failed to mark as blocked"))
 		}
-		return skymodules.Skylink{}, skymodules.SiaPath{}, true, err
+		return pinnedFile{}, true, errors.Compose(err, errMark)
 	}
-	if err != nil && (strings.Contains(err.Error(), "API authentication failed.") ||
-		strings.Contains(err.Error(), "connect: connection refused")) {
+	// Stop scanning on errors which would fail all other pins as well.
+	if errors.Contains(err, skyd.ErrSkydUnavailable) ||
+		errors.Contains(err, skyd.ErrSkydUnreachable) ||
+		errors.Contains(err, skyd.ErrAuthFailed) ||
+		errors.Contains(err, skyd.ErrNotEnoughFunds) {
 		err = errors.AddContext(err, fmt.Sprintf("unrecoverable error while pinning '%s'", sl))
 		s.staticLogger.Error(err)
-		return skymodules.Skylink{}, skymodules.SiaPath{}, false, err
+		return pinnedFile{}, false, err
 	}
 	if err != nil {
 		s.staticLogger.Warn(errors.AddContext(err, fmt.Sprintf("failed to pin '%s'", sl)))
 		// Since this is not an unrecoverable error, we'll signal the caller to
 		// continue trying to pin other skylinks.
-		return skymodules.Skylink{}, skymodules.SiaPath{}, true, err
+		return pinnedFile{}, true, err
 	}
 	s.staticLogger.Infof("Successfully pinned '%s'", sl)
-	err = s.staticDB.AddServerForSkylink(context.TODO(), sl, s.staticServerName, false)
+	unlocked = true
+	// The method logs its errors and we still want to wait for the skylink to
+	// become healthy.
+	_ = s.managedMarkPinnedAndUnlock(sl)
+	s.staticStoreMetadata(sl)
+	pf.skylink = sl
+	pf.lazy = lazy
+	return pf, true, nil
+}
+
+// managedMarkPinnedAndUnlock marks the given skylink as pinned by this server
+// and releases our lock on it. It's not an error if our lock is already gone,
+// e.g. because it expired while we were pinning.
+func (s *Scanner) managedMarkPinnedAndUnlock(sl skymodules.Skylink) error {
+	err := s.staticDB.MarkServerPinnedAndUnlock(context.TODO(), sl, s.staticServerName)
+	if errors.Contains(err, database.ErrNoSkylinksLocked) {
+		s.staticLogger.Debugf("skylink '%s' was no longer locked by us after pinning it", sl)
+		return nil
+	}
 	if err != nil {
 		s.staticLogger.Debug(errors.AddContext(err, "failed to mark as pinned by this server"))
 	}
-	return sl, sf, true, nil
+	return err
+}
+
+// staticStoreMetadata fetches the metadata of the given skylink from skyd and
+// stores its size and type in the database. It's not critical for pinning the
+// skylink, so we only log any errors.
+func (s *Scanner) staticStoreMetadata(sl skymodules.Skylink) {
+	meta, err := s.staticSkydClient.Metadata(s.staticTG.StopCtx(), sl.String())
+	if err != nil {
+		s.staticLogger.Debug(errors.AddContext(err, fmt.Sprintf("failed to fetch the metadata of '%s'", sl)))
+		return
+	}
+	err = s.staticDB.SetSkylinkMetadata(context.TODO(), sl, meta)
+	if err != nil {
+		s.staticLogger.Debug(errors.AddContext(err, fmt.Sprintf("failed to store the metadata of '%s'", sl)))
+	}
 }
 
 // estimateTimeToFull calculates how long we should sleep after pinning the given
 // skylink in order to give the renter time to fully upload it before we pin
 // another one. It returns a ballpark value.
 //
-// This method makes some assumptions for simplicity:
-// * assumes lazy pinning, meaning that none of the fanout is uploaded
-// * all skyfiles are assumed to be large files (base sector + fanout) and the
-//	metadata is assumed to fill up the base sector (to err on the safe side)
-func (s *Scanner) estimateTimeToFull(skylink skymodules.Skylink) time.Duration {
-	meta, err := s.staticSkydClient.Metadata(skylink.String())
+// This method assumes for simplicity that a lazy pin uploads none of the
+// fanout, while a standard pin uploads the fanout once before it returns. See
+// skyd.EstimateUploadTime for the rest of its assumptions.
+func (s *Scanner) estimateTimeToFull(skylink skymodules.Skylink, lazy bool) time.Duration {
+	meta, err := s.staticSkydClient.Metadata(s.staticTG.StopCtx(), skylink.String())
 	if err != nil {
 		err = errors.AddContext(err, "failed to get metadata for skylink")
 		s.staticLogger.Error(err)
-		return SleepBetweenPins
-	}
-	chunkSize := 10 * modules.SectorSizeStandard
-	numChunks := meta.Length / chunkSize
-	if meta.Length%chunkSize > 0 {
-		numChunks++
-	}
-	// remainingUpload is the amount of data we expect to need to upload until
-	// the skyfile reaches full redundancy.
-	remainingUpload := numChunks*chunkSize*fanoutRedundancy + (baseSectorRedundancy-1)*modules.SectorSize
-	secondsRemaining := remainingUpload / assumedUploadSpeedInBytes
-	return time.Duration(secondsRemaining) * time.Second
+		return s.managedClusterConfig().SleepBetweenPins
+	}
+	// We expect to need to upload the rest of the copies until the skyfile
+	// reaches full redundancy.
+	fanoutUploads := uint64(skyd.FanoutRedundancy)
+	if !lazy {
+		fanoutUploads--
+	}
+	return skyd.EstimateUploadTime(meta.Length, fanoutUploads, skyd.BaseSectorRedundancy-1)
 }
 
-// managedRefreshDryRun makes sure the local value of dry_run matches the one
-// in the database.
-func (s *Scanner) managedRefreshDryRun() {
-	dr, err := conf.DryRun(context.TODO(), s.staticDB)
-	if err != nil {
-		s.staticLogger.Warn(errors.AddContext(err, "failed to fetch the DB value for dry_run"))
-		return
-	}
-	s.staticLogger.Tracef("Current dry_run value: %t", dr)
+// ClusterConfig returns the cluster-wide configuration values the scanner
+// currently uses, along with the database values they're parsed from. The
+// caller must not modify the values.
+func (s *Scanner) ClusterConfig() (conf.ClusterConfig, map[string]string) {
 	s.mu.Lock()
-	s.dryRun = dr
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	return s.clusterConfig, s.clusterValues
 }
 
-// managedRefreshMinPinners makes sure the local value of min pinners matches the one
-// in the database.
-func (s *Scanner) managedRefreshMinPinners() {
-	mp, err := conf.MinPinners(context.TODO(), s.staticDB)
+// managedClusterConfig returns the cluster-wide configuration values the
+// scanner currently uses.
+func (s *Scanner) managedClusterConfig() conf.ClusterConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clusterConfig
+}
+
+// managedRefreshClusterConfig makes sure the local cluster-wide configuration
+// values match the ones in the database. If any of the values in the database
+// is invalid, we keep using the values we have.
+func (s *Scanner) managedRefreshClusterConfig() {
+	cc, values, err := conf.LoadClusterConfig(context.TODO(), s.staticDB, s.staticServerName)
 	if err != nil {
-		s.staticLogger.Warn(errors.AddContext(err, "failed to fetch the DB value for min_pinners"))
+		s.staticLogger.Warn(errors.AddContext(err, "failed to refresh the cluster configuration"))
 		return
 	}
+	s.staticLogger.Tracef("Current cluster configuration: %+v", cc)
+	s.staticDB.SetLockDuration(cc.LockDuration)
 	s.mu.Lock()
-	s.minPinners = mp
+	s.clusterConfig = cc
+	s.clusterValues = values
 	s.mu.Unlock()
 }
 
-// managedWaitUntilHealthy blocks until the given skylinks becomes fully healthy
-// or a timeout occurs.
+// managedWaitUntilHealthy blocks until each of the given files becomes fully
+// healthy, fails to report its health or reaches its deadline. It fetches the
+// healths of all files we're still waiting on with a single batch call per
+// check.
 //
 // The method is marked as managed because it performs long-running operations.
-func (s *Scanner) managedWaitUntilHealthy(skylink skymodules.Skylink, sp skymodules.SiaPath) {
-	deadlineTimer := s.staticDeadline(skylink)
-	defer deadlineTimer.Stop()
+func (s *Scanner) managedWaitUntilHealthy(files []pinnedFile) {
+	factor := s.managedClusterConfig().PinDeadlineFactor
+	deadlines := make([]time.Time, len(files))
+	for i, f := range files {
+		deadlines[i] = s.staticDeadline(f.skylink, f.lazy, factor)
+	}
 	ticker := time.NewTicker(SleepBetweenHealthChecks)
 	defer ticker.Stop()
 
-	// Wait for the pinned file to become fully healthy.
-	for {
-		health, err := s.staticSkydClient.FileHealth(sp)
-		if err != nil {
-			err = errors.AddContext(err, "failed to get sia file's health")
-			s.staticLogger.Error(err)
-			break
+	// Wait for the pinned files to become fully healthy.
+	for len(files) > 0 {
+		sps := make([]skymodules.SiaPath, len(files))
+		for i, f := range files {
+			sps[i] = f.siaPath
 		}
-		// We use NeedsRepair instead of comparing the health to zero because
-		// skyd might stop repairing the file before it reaches perfect health.
-		if !skymodules.NeedsRepair(health) {
-			break
+		results := s.staticSkydClient.FileHealthBatch(s.staticTG.StopCtx(), sps)
+		// Keep only the files we still need to wait on.
+		var waiting []pinnedFile
+		var waitingDeadlines []time.Time
+		for i, f := range files {
+			res := results[i]
+			if res.Err != nil {
+				err := errors.AddContext(res.Err, fmt.Sprintf("failed to get the health of '%s'", f.skylink))
+				s.staticLogger.Error(err)
+				continue
+			}
+			// We use NeedsRepair instead of comparing the health to zero
+			// because skyd might stop repairing the file before it reaches
+			// perfect health.
+			if !skymodules.NeedsRepair(res.Health) {
+				continue
+			}
+			if time.Now().After(deadlines[i]) {
+				s.staticLogger.Warnf("Skylink '%s' failed to reach full health within the time limit.", f.skylink)
+				continue
+			}
+			s.staticLogger.Debugf("Waiting for '%s' to become fully healthy. Current health: %.2f", f.skylink, res.Health)
+			waiting = append(waiting, f)
+			waitingDeadlines = append(waitingDeadlines, deadlines[i])
+		}
+		files, deadlines = waiting, waitingDeadlines
+		if len(files) == 0 {
+			return
 		}
 		select {
 		case <-ticker.C:
-			s.staticLogger.Debugf("Waiting for '%s' to become fully healthy. Current health: %.2f", skylink, health)
-		case <-deadlineTimer.C:
-			s.staticLogger.Warnf("Skylink '%s' failed to reach full health within the time limit.", skylink)
-			break
 		case <-s.staticTG.StopChan():
 			return
 		}
 	}
 }
 
+// SetSleepBetweenScans changes the time between two scans. It takes effect
+// after the current sleep. A value of zero or less restores the default.
+func (s *Scanner) SetSleepBetweenScans(sleep time.Duration) {
+	sleep, _, _ = conf.SleepBetweenScansBounds(sleep)
+	s.mu.Lock()
+	s.sleepBetweenScans = sleep
+	s.mu.Unlock()
+}
+
 // SleepBetweenScans defines how often we'll scan the DB for underpinned
-// skylinks. The returned value varies by +/-sleepVariationFactor and it's
+// skylinks. The returned value varies by +/-conf.SleepVariationFactor and it's
 // centered on sleepBetweenScans.
 func (s *Scanner) SleepBetweenScans() time.Duration {
-	variation := int(float64(s.staticSleepBetweenScans) * sleepVariationFactor)
-	upper := int(s.staticSleepBetweenScans) + variation
-	lower := int(s.staticSleepBetweenScans) - variation
-	rng := upper - lower
-	return time.Duration(fastrand.Intn(rng) + lower)
+	s.mu.Lock()
+	sleep := s.sleepBetweenScans
+	s.mu.Unlock()
+	_, lower, upper := conf.SleepBetweenScansBounds(sleep)
+	rng := int(upper - lower)
+	return time.Duration(fastrand.Intn(rng)) + lower
 }
 
-// staticDeadline calculates how much we are willing to wait for a skylink to be fully
-// healthy before giving up. It's twice the expected time, as returned by
-// estimateTimeToFull.
-func (s *Scanner) staticDeadline(skylink skymodules.Skylink) *time.Timer {
-	return time.NewTimer(2 * s.estimateTimeToFull(skylink))
+// staticDeadline calculates until when we are willing to wait for a skylink to
+// be fully healthy before giving up. We wait for the given factor times the
+// expected time, as returned by estimateTimeToFull.
+func (s *Scanner) staticDeadline(skylink skymodules.Skylink, lazy bool, factor float64) time.Time {
+	return time.Now().Add(time.Duration(factor * float64(s.estimateTimeToFull(skylink, lazy))))
 }
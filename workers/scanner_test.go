@@ -2,15 +2,19 @@ package workers
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/skynetlabs/pinner/conf"
+	"github.com/skynetlabs/pinner/database"
 	"github.com/skynetlabs/pinner/skyd"
 	"github.com/skynetlabs/pinner/test"
 	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/NebulousLabs/threadgroup"
 	"gitlab.com/SkynetLabs/skyd/build"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"gitlab.com/SkynetLabs/skyd/skymodules/renter"
 )
 
 const (
@@ -22,7 +26,7 @@ const (
 
 var (
 	// maxSleepBetweenScans is the maximum time we might sleep between scans.
-	maxSleepBetweenScans = time.Duration(float64(sleepBetweenScans) * (1 + sleepVariationFactor))
+	maxSleepBetweenScans = time.Duration(float64(conf.DefaultSleepBetweenScans) * (1 + conf.SleepVariationFactor))
 )
 
 // TestScanner ensures that Scanner does its job.
@@ -56,7 +60,7 @@ func TestScanner(t *testing.T) {
 
 	// Add a skylink from the name of a different server.
 	sl := test.RandomSkylink()
-	otherServer := "other server"
+	otherServer := "other-server"
 	_, err = db.CreateSkylink(ctx, sl, otherServer)
 	if err != nil {
 		t.Fatal(err)
@@ -65,7 +69,7 @@ func TestScanner(t *testing.T) {
 	// Sleep for a while, giving a chance to the scanner to pick the skylink up.
 	time.Sleep(cyclesToWait * scanner.SleepBetweenScans())
 	// Make sure the skylink isn't pinned on the local (mock) skyd.
-	if skydcm.IsPinning(sl.String()) {
+	if skydcm.Pinning(sl.String()) {
 		t.Fatal("We didn't expect skyd to be pinning this.")
 	}
 	// Remove the other server, making the file underpinned.
@@ -73,11 +77,313 @@ func TestScanner(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	meta := skymodules.SkyfileMetadata{
+		Filename: "file.txt",
+		Length:   1 << 20,
+		Subfiles: skymodules.SkyfileSubfiles{
+			"file.txt": {Filename: "file.txt", ContentType: "text/plain", Len: 1 << 20},
+		},
+	}
+	skydcm.SetMetadata(sl.String(), meta, nil)
 
 	// Wait for the skylink should be picked up and pinned on the local skyd.
 	err = build.Retry(cyclesToWait, scanner.SleepBetweenScans(), func() error {
 		// Make sure the skylink is pinned on the local (mock) skyd.
-		if !skydcm.IsPinning(sl.String()) {
+		if !skydcm.Pinning(sl.String()) {
+			return errors.New("we expected skyd to be pinning this")
+		}
+		// Make sure we stored its metadata.
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			return err
+		}
+		if s.Size != meta.Length || s.ContentType != "text/plain" || s.IsDirectory {
+			return fmt.Errorf("unexpected metadata %+v", s)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the scanner pinned it lazily, which is the default.
+	if !skydcm.PinnedLazily(sl.String()) {
+		t.Fatal("We expected the skylink to be pinned lazily.")
+	}
+}
+
+// TestScannerSoak runs the scanner against a slow and flaky skyd for a few
+// seconds and ensures that it pins all underpinned skylinks exactly once and
+// that it still shuts down cleanly.
+func TestScannerSoak(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := test.LoadTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skydcm := skyd.NewSkydClientMock()
+	for _, method := range []string{"FileHealthBatch", "IsBlocked", "Metadata", "Pin", "RenterSummary"} {
+		skydcm.SetLatency(method, skyd.MockLatency{Max: 20 * time.Millisecond})
+	}
+	skydcm.SetErrorRate(0.2, nil)
+	scanner := NewScanner(db, test.NewDiscardLogger(), cfg.MinPinners, cfg.ServerName, cfg.SleepBetweenScans, skydcm)
+	err = scanner.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep adding underpinned skylinks while skyd fails some of the calls.
+	// Halfway through, fail a burst of consecutive calls.
+	soak := 3 * time.Second
+	otherServer := "other-server"
+	var sls []skymodules.Skylink
+	for start := time.Now(); time.Since(start) < soak; {
+		sl := test.RandomSkylink()
+		_, err = db.CreateSkylink(ctx, sl, otherServer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.RemoveServerFromSkylink(ctx, sl, otherServer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sls = append(sls, sl)
+		if len(sls) == 10 {
+			skydcm.FailNextCalls(20, nil)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Once skyd recovers, the scanner should catch up with all skylinks.
+	skydcm.SetErrorRate(0, nil)
+	err = build.Retry(4*cyclesToWait, scanner.SleepBetweenScans(), func() error {
+		for _, sl := range sls {
+			if !skydcm.Pinning(sl.String()) {
+				return errors.New("we expected skyd to be pinning " + sl.String())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sl := range sls {
+		if n := skydcm.NumPins(sl.String()); n != 1 {
+			t.Fatalf("Expected '%s' to be pinned once, it was pinned %d times", sl, n)
+		}
+	}
+
+	// Make sure the scanner isn't stuck.
+	closed := make(chan error, 1)
+	go func() {
+		closed <- scanner.Close()
+	}()
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(errors.AddContext(err, "failed to close threadgroup"))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The scanner failed to shut down, it's probably deadlocked.")
+	}
+}
+
+// TestScannerBlocked ensures that the scanner gives up on skylinks which skyd
+// refuses to pin because they are blocked.
+func TestScannerBlocked(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := test.LoadTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skydcm := skyd.NewSkydClientMock()
+	skydcm.SetPinError(errors.AddContext(renter.ErrSkylinkBlocked, "failed to pin"))
+	scanner := NewScanner(db, test.NewDiscardLogger(), cfg.MinPinners, cfg.ServerName, cfg.SleepBetweenScans, skydcm)
+	defer func() {
+		if e := scanner.Close(); e != nil {
+			t.Error(errors.AddContext(e, "failed to close threadgroup"))
+		}
+	}()
+
+	// Add an underpinned skylink.
+	sl := test.RandomSkylink()
+	otherServer := "other-server"
+	_, err = db.CreateSkylink(ctx, sl, otherServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RemoveServerFromSkylink(ctx, sl, otherServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scanner.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the scanner to try to pin the skylink and mark it as blocked.
+	err = build.Retry(cyclesToWait, maxSleepBetweenScans, func() error {
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			return err
+		}
+		if !s.Blocked {
+			return errors.New("skylink not marked as blocked")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the skylink is no longer selected for pinning.
+	_, err = db.FindAndLockUnderpinnedSkylink(ctx, cfg.ServerName, cfg.MinPinners)
+	if !errors.Contains(err, database.ErrNoUnderpinnedSkylinks) {
+		t.Fatalf("Expected to get '%v', got '%v'", database.ErrNoUnderpinnedSkylinks, err)
+	}
+}
+
+// TestScannerBlocklist ensures that the scanner doesn't pin skylinks which are
+// on skyd's blocklist and marks them as blocked instead.
+func TestScannerBlocklist(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := test.LoadTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Add an underpinned skylink which is on the blocklist.
+	sl := test.RandomSkylink()
+	skydcm := skyd.NewSkydClientMock(skyd.WithBlockedSkylinks(sl.String()))
+	scanner := NewScanner(db, test.NewDiscardLogger(), cfg.MinPinners, cfg.ServerName, cfg.SleepBetweenScans, skydcm)
+	defer func() {
+		if e := scanner.Close(); e != nil {
+			t.Error(errors.AddContext(e, "failed to close threadgroup"))
+		}
+	}()
+	otherServer := "other-server"
+	_, err = db.CreateSkylink(ctx, sl, otherServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RemoveServerFromSkylink(ctx, sl, otherServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scanner.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the scanner to find the skylink and mark it as blocked.
+	err = build.Retry(cyclesToWait, maxSleepBetweenScans, func() error {
+		s, err := db.FindSkylink(ctx, sl)
+		if err != nil {
+			return err
+		}
+		if !s.Blocked {
+			return errors.New("skylink not marked as blocked")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the scanner didn't pin the skylink.
+	if skydcm.Pinning(sl.String()) {
+		t.Fatal("Expected the blocked skylink not to be pinned.")
+	}
+	s, err := db.FindSkylink(ctx, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Servers) != 0 {
+		t.Fatalf("Expected no servers to pin the skylink, got %v", s.Servers)
+	}
+}
+
+// TestScannerNoContracts ensures that the scanner doesn't pin skylinks while
+// the renter has no active contracts.
+func TestScannerNoContracts(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := test.LoadTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skydcm := skyd.NewSkydClientMock()
+	summary, err := skydcm.RenterSummary(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	skydcm.SetRenterSummary(skyd.RenterSummary{}, nil)
+	scanner := NewScanner(db, test.NewDiscardLogger(), cfg.MinPinners, cfg.ServerName, cfg.SleepBetweenScans, skydcm)
+	defer func() {
+		if e := scanner.Close(); e != nil {
+			t.Error(errors.AddContext(e, "failed to close threadgroup"))
+		}
+	}()
+	err = scanner.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add an underpinned skylink.
+	sl := test.RandomSkylink()
+	otherServer := "other-server"
+	_, err = db.CreateSkylink(ctx, sl, otherServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RemoveServerFromSkylink(ctx, sl, otherServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Give the scanner a chance to pick the skylink up.
+	time.Sleep(cyclesToWait * scanner.SleepBetweenScans())
+	if skydcm.Pinning(sl.String()) {
+		t.Fatal("We didn't expect skyd to be pinning this.")
+	}
+
+	// Give the renter contracts. Expect the skylink to get pinned.
+	skydcm.SetRenterSummary(summary, nil)
+	err = build.Retry(cyclesToWait, maxSleepBetweenScans, func() error {
+		if !skydcm.Pinning(sl.String()) {
 			return errors.New("we expected skyd to be pinning this")
 		}
 		return nil
@@ -87,6 +393,50 @@ func TestScanner(t *testing.T) {
 	}
 }
 
+// TestScannerStatus ensures that the scanner reports the state of the skyd
+// breaker.
+func TestScannerStatus(t *testing.T) {
+	t.Parallel()
+
+	skydcm := skyd.NewSkydClientMock()
+	scanner := NewScanner(nil, test.NewDiscardLogger(), 1, "server", 0, skydcm)
+	if st := scanner.Status(); st.SkydBreaker != skyd.BreakerClosed {
+		t.Fatalf("Expected breaker state '%s', got '%s'", skyd.BreakerClosed, st.SkydBreaker)
+	}
+	skydcm.SetBreakerState(skyd.BreakerOpen)
+	if st := scanner.Status(); st.SkydBreaker != skyd.BreakerOpen {
+		t.Fatalf("Expected breaker state '%s', got '%s'", skyd.BreakerOpen, st.SkydBreaker)
+	}
+}
+
+// TestScannerWaitUntilHealthy ensures that managedWaitUntilHealthy waits for
+// all unhealthy files and stops waiting on files which are healthy or fail to
+// report their health.
+func TestScannerWaitUntilHealthy(t *testing.T) {
+	t.Parallel()
+
+	skydcm := skyd.NewSkydClientMock()
+	scanner := NewScanner(nil, test.NewDiscardLogger(), 1, "server", 0, skydcm)
+	healthy := pinnedFile{skylink: test.RandomSkylink(), siaPath: skymodules.SiaPath{Path: "healthy"}}
+	unhealthy := pinnedFile{skylink: test.RandomSkylink(), siaPath: skymodules.SiaPath{Path: "unhealthy"}}
+	failing := pinnedFile{skylink: test.RandomSkylink(), siaPath: skymodules.SiaPath{Path: "failing"}}
+	skydcm.SetFileHealth(unhealthy.siaPath, 0.5, nil)
+	skydcm.SetFileHealth(failing.siaPath, 0, errors.New("failed to get health"))
+	// Make the deadline of the unhealthy file long enough for the test.
+	skydcm.SetMetadata(unhealthy.skylink.String(), skymodules.SkyfileMetadata{Length: 1 << 30}, nil)
+
+	// Make the unhealthy file healthy after a while.
+	delay := 100 * time.Millisecond
+	time.AfterFunc(delay, func() {
+		skydcm.SetFileHealth(unhealthy.siaPath, 0, nil)
+	})
+	start := time.Now()
+	scanner.managedWaitUntilHealthy([]pinnedFile{healthy, unhealthy, failing})
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("Expected to wait for at least %v, waited for %v", delay, elapsed)
+	}
+}
+
 // TestScannerDryRun ensures that dry_run works as expected.
 func TestScannerDryRun(t *testing.T) {
 	if testing.Short() {
@@ -132,7 +482,7 @@ func TestScannerDryRun(t *testing.T) {
 	//
 	// Add a skylink from the name of a different server.
 	sl := test.RandomSkylink()
-	otherServer := "other server"
+	otherServer := "other-server"
 	_, err = db.CreateSkylink(ctx, sl, otherServer)
 	if err != nil {
 		t.Fatal(err)
@@ -140,7 +490,7 @@ func TestScannerDryRun(t *testing.T) {
 	// Sleep for a while, giving a chance to the scanner to pick the skylink up.
 	time.Sleep(cyclesToWait * scanner.SleepBetweenScans())
 	// Make sure the skylink isn't pinned on the local (mock) skyd.
-	if skydcm.IsPinning(sl.String()) {
+	if skydcm.Pinning(sl.String()) {
 		t.Fatal("We didn't expect skyd to be pinning this.")
 	}
 	// Remove the other server, making the file underpinned.
@@ -155,7 +505,7 @@ func TestScannerDryRun(t *testing.T) {
 	// Verify skyd doesn't have the pin.
 	//
 	// Make sure the skylink is not pinned on the local (mock) skyd.
-	if skydcm.IsPinning(sl.String()) {
+	if skydcm.Pinning(sl.String()) {
 		t.Fatal("We did not expect skyd to be pinning this.")
 	}
 
@@ -168,7 +518,7 @@ func TestScannerDryRun(t *testing.T) {
 	// Wait for the skylink should be picked up and pinned on the local skyd.
 	err = build.Retry(2*cyclesToWait, scanner.SleepBetweenScans(), func() error {
 		// Make sure the skylink is pinned on the local (mock) skyd.
-		if !skydcm.IsPinning(sl.String()) {
+		if !skydcm.Pinning(sl.String()) {
 			return errors.New("we expected skyd to be pinning this")
 		}
 		return nil
@@ -178,37 +528,401 @@ func TestScannerDryRun(t *testing.T) {
 	}
 }
 
-// TestScanner_calculateSleep ensures that estimateTimeToFull returns what we expect.
+// TestScannerLazyPinning ensures that the scanner pins skylinks in the mode
+// set by lazy_pinning.
+func TestScannerLazyPinning(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	// Don't run this test in parallel since we set "lazy_pinning". mongo is
+	// shared by the tests.
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Set lazy_pinning: false.
+	err = db.SetConfigValue(ctx, conf.ConfLazyPinning, "false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err = db.SetConfigValue(ctx, conf.ConfLazyPinning, "true")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	cfg, err := test.LoadTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skydcm := skyd.NewSkydClientMock()
+	scanner := NewScanner(db, test.NewDiscardLogger(), cfg.MinPinners, cfg.ServerName, cfg.SleepBetweenScans, skydcm)
+	defer func() {
+		if e := scanner.Close(); e != nil {
+			t.Error(errors.AddContext(e, "failed to close threadgroup"))
+		}
+	}()
+	err = scanner.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pinAndCheck adds an underpinned skylink, waits for the scanner to pin
+	// it and makes sure it pinned it in the expected mode.
+	pinAndCheck := func(lazy bool) {
+		sl := test.RandomSkylink()
+		_, err := db.CreateSkylink(ctx, sl, "other-server")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.RemoveServerFromSkylink(ctx, sl, "other-server")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = build.Retry(2*cyclesToWait, scanner.SleepBetweenScans(), func() error {
+			if !skydcm.Pinning(sl.String()) {
+				return errors.New("we expected skyd to be pinning this")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if skydcm.PinnedLazily(sl.String()) != lazy {
+			t.Fatalf("Expected the skylink to be pinned with lazy %t", lazy)
+		}
+	}
+
+	// The skylink should be pinned without lazy pinning.
+	pinAndCheck(false)
+
+	// Turn lazy pinning back on.
+	err = db.SetConfigValue(ctx, conf.ConfLazyPinning, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinAndCheck(true)
+}
+
+// TestScannerWatchConfig ensures that the scanner picks up configuration
+// changes made by other servers without waiting for its next scan.
+func TestScannerWatchConfig(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The other server changes the configuration.
+	other, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.SetConfigValue(ctx, conf.ConfMinPinners, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := test.LoadTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scan once an hour, so the scanner can't poll the changes in time.
+	scanner := NewScanner(db, test.NewDiscardLogger(), cfg.MinPinners, cfg.ServerName, time.Hour, skyd.NewSkydClientMock())
+	defer func() {
+		if e := scanner.Close(); e != nil {
+			t.Error(errors.AddContext(e, "failed to close threadgroup"))
+		}
+	}()
+	err = scanner.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// expectMinPinners waits for the scanner to use the given min_pinners.
+	expectMinPinners := func(expected int) {
+		t.Helper()
+		err := build.Retry(100, 100*time.Millisecond, func() error {
+			mp := scanner.managedClusterConfig().MinPinners
+			if mp != expected {
+				return fmt.Errorf("expected min_pinners %d, got %d", expected, mp)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for the first scan to poll the configuration.
+	expectMinPinners(2)
+	err = other.SetConfigValue(ctx, conf.ConfMinPinners, "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMinPinners(3)
+	err = other.SetConfigValue(ctx, conf.ConfDryRun, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		if !scanner.managedClusterConfig().DryRun {
+			return errors.New("expected dry_run to be on")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestScannerWatchConfigFailed ensures that the scanner shuts down when it
+// fails to watch the configuration, e.g. against a standalone MongoDB.
+func TestScannerWatchConfigFailed(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every attempt to watch fails once we've disconnected.
+	err = db.Disconnect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.WatchConfig(ctx)
+	if err == nil {
+		t.Fatal("Expected WatchConfig to fail.")
+	}
+	cfg, err := test.LoadTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scan often, so the scanner also tries to watch again before we close it.
+	scanner := NewScanner(db, test.NewDiscardLogger(), cfg.MinPinners, cfg.ServerName, 100*time.Millisecond, skyd.NewSkydClientMock())
+	err = scanner.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	expectClose(t, scanner)
+}
+
+// TestScannerWatchConfigNil ensures that threadedWatchConfig returns on
+// shutdown when it has no change stream to watch.
+func TestScannerWatchConfigNil(t *testing.T) {
+	t.Parallel()
+
+	// Sleep for long enough that we never try to watch again.
+	scanner := NewScanner(nil, test.NewDiscardLogger(), 1, "server", time.Hour, skyd.NewSkydClientMock())
+	err := scanner.staticTG.Add()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go scanner.threadedWatchConfig(nil)
+	expectClose(t, scanner)
+}
+
+// expectClose closes the given scanner and fails the test if that takes longer
+// than a few seconds.
+func expectClose(t *testing.T, s *Scanner) {
+	t.Helper()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Close()
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(errors.AddContext(err, "failed to close threadgroup"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the scanner to close.")
+	}
+}
+
+// TestScannerDryRunForServer ensures that the scanner honours its server's own
+// dry_run value while the cluster-wide one is off.
+func TestScannerDryRunForServer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := test.LoadTestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Dry-run only this server.
+	err = db.SetConfigValue(ctx, conf.ConfDryRun, "false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetConfigValue(ctx, conf.DryRunKey(cfg.ServerName), "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	skydcm := skyd.NewSkydClientMock()
+	scanner := NewScanner(db, test.NewDiscardLogger(), cfg.MinPinners, cfg.ServerName, cfg.SleepBetweenScans, skydcm)
+	defer func() {
+		if e := scanner.Close(); e != nil {
+			t.Error(errors.AddContext(e, "failed to close threadgroup"))
+		}
+	}()
+	err = scanner.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add an underpinned skylink. The scanner shouldn't pin it.
+	sl := test.RandomSkylink()
+	_, err = db.CreateSkylink(ctx, sl, "other-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RemoveServerFromSkylink(ctx, sl, "other-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(cyclesToWait * scanner.SleepBetweenScans())
+	if skydcm.Pinning(sl.String()) {
+		t.Fatal("We did not expect skyd to be pinning this.")
+	}
+	// Another server's value doesn't affect us.
+	err = db.SetConfigValue(ctx, conf.DryRunKey("other-server"), "false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(cyclesToWait * scanner.SleepBetweenScans())
+	if skydcm.Pinning(sl.String()) {
+		t.Fatal("We did not expect skyd to be pinning this.")
+	}
+
+	// Turn off this server's dry run. The scanner should pin the skylink.
+	err = db.SetConfigValue(ctx, conf.DryRunKey(cfg.ServerName), "false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = build.Retry(2*cyclesToWait, scanner.SleepBetweenScans(), func() error {
+		if !skydcm.Pinning(sl.String()) {
+			return errors.New("we expected skyd to be pinning this")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestScannerClusterConfigLimits ensures that the scanner pins no more than
+// max_pins_per_cycle skylinks per scan and that it skips the skylinks which
+// are larger than max_pin_size.
+func TestScannerClusterConfigLimits(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx := context.Background()
+	db, err := test.NewDatabase(ctx, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetConfigValues(ctx, map[string]string{conf.ConfMaxPinsPerCycle: "2", conf.ConfMaxPinSize: "1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Add an underpinned skylink which is too large and three small ones.
+	otherServer := "other-server"
+	large := test.RandomSkylink()
+	small := []skymodules.Skylink{test.RandomSkylink(), test.RandomSkylink(), test.RandomSkylink()}
+	for _, sl := range append([]skymodules.Skylink{large}, small...) {
+		_, err = db.CreateSkylink(ctx, sl, otherServer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.SetSkylinkMetadata(ctx, large, skymodules.SkyfileMetadata{Length: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sl := range append([]skymodules.Skylink{large}, small...) {
+		err = db.RemoveServerFromSkylink(ctx, sl, otherServer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	skydcm := skyd.NewSkydClientMock()
+	scanner := NewScanner(db, test.NewDiscardLogger(), 1, "server", 0, skydcm)
+	scanner.managedRefreshClusterConfig()
+	scanner.managedPinUnderpinnedSkylinks()
+	if skydcm.Pinning(large.String()) {
+		t.Fatal("We did not expect skyd to be pinning the large skylink.")
+	}
+	pinned := 0
+	for _, sl := range small {
+		if skydcm.Pinning(sl.String()) {
+			pinned++
+		}
+	}
+	if pinned != 2 {
+		t.Fatalf("Expected 2 pinned skylinks, got %d", pinned)
+	}
+}
+
+// TestScanner_calculateSleep ensures that estimateTimeToFull returns what we
+// expect for both lazy and standard pins.
 func TestScanner_calculateSleep(t *testing.T) {
 	tests := map[string]struct {
 		dataSize      uint64
-		expectedSleep time.Duration
+		lazySleep     time.Duration
+		standardSleep time.Duration
 	}{
 		"small file": {
 			1 << 20, // 1 MB
 			3 * time.Second,
+			2 * time.Second,
 		},
 		"5 MB": {
 			1 << 20 * 5, // 5 MB
 			3 * time.Second,
+			2 * time.Second,
 		},
 		"50 MB": {
 			1 << 20 * 50, // 50 MB
 			7 * time.Second,
+			5 * time.Second,
 		},
 		"500 MB": {
 			1 << 20 * 500, // 500 MB
 			48 * time.Second,
+			32 * time.Second,
 		},
 		"5 GB": {
 			1 << 30 * 5, // 5 GB
 			480 * time.Second,
+			320 * time.Second,
 		},
 	}
 
 	skydMock := skyd.NewSkydClientMock()
 	scanner := Scanner{
 		staticSkydClient: skydMock,
+		staticTG:         &threadgroup.ThreadGroup{},
 	}
 	skylink := test.RandomSkylink()
 
@@ -217,9 +931,35 @@ func TestScanner_calculateSleep(t *testing.T) {
 		meta := skymodules.SkyfileMetadata{Length: tt.dataSize}
 		skydMock.SetMetadata(skylink.String(), meta, nil)
 
-		sleep := scanner.estimateTimeToFull(skylink)
-		if sleep != tt.expectedSleep {
-			t.Errorf("%s: expected %ds, got %ds", tname, tt.expectedSleep/time.Second, sleep/time.Second)
+		sleep := scanner.estimateTimeToFull(skylink, true)
+		if sleep != tt.lazySleep {
+			t.Errorf("%s, lazy: expected %ds, got %ds", tname, tt.lazySleep/time.Second, sleep/time.Second)
+		}
+		sleep = scanner.estimateTimeToFull(skylink, false)
+		if sleep != tt.standardSleep {
+			t.Errorf("%s, standard: expected %ds, got %ds", tname, tt.standardSleep/time.Second, sleep/time.Second)
+		}
+	}
+}
+
+// TestScannerSetSleepBetweenScans ensures that SetSleepBetweenScans changes
+// the time between scans and that non-positive values restore the default.
+func TestScannerSetSleepBetweenScans(t *testing.T) {
+	t.Parallel()
+
+	// inBounds checks that the scanner sleeps for about d between scans.
+	inBounds := func(s *Scanner, d time.Duration) {
+		variation := time.Duration(float64(d) * conf.SleepVariationFactor)
+		for i := 0; i < 100; i++ {
+			if sleep := s.SleepBetweenScans(); sleep < d-variation || sleep > d+variation {
+				t.Fatalf("Expected a sleep of %v +/- %v, got %v", d, variation, sleep)
+			}
 		}
 	}
+	s := NewScanner(nil, nil, 1, "server", time.Hour, nil)
+	inBounds(s, time.Hour)
+	s.SetSleepBetweenScans(time.Minute)
+	inBounds(s, time.Minute)
+	s.SetSleepBetweenScans(0)
+	inBounds(s, conf.DefaultSleepBetweenScans)
 }